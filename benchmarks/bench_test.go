@@ -0,0 +1,175 @@
+package benchmarks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+)
+
+// BenchmarkUnary measures sequential unary round trips of small messages
+func BenchmarkUnary(b *testing.B) {
+	for _, size := range []int{1 << 10} {
+		b.Run(sizeName(size), func(b *testing.B) {
+			forEachTarget(b, func(b *testing.B, client testpb.TestServiceClient) {
+				benchmarkUnary(b, client, size)
+			})
+		})
+	}
+}
+
+// BenchmarkLargeUnary measures unary round trips of messages up to just
+// under gRPC's default 4 MiB limit
+func BenchmarkLargeUnary(b *testing.B) {
+	for _, size := range []int{256 << 10, 1 << 20, 3 << 20} {
+		b.Run(sizeName(size), func(b *testing.B) {
+			forEachTarget(b, func(b *testing.B, client testpb.TestServiceClient) {
+				benchmarkUnary(b, client, size)
+			})
+		})
+	}
+}
+
+func benchmarkUnary(b *testing.B, client testpb.TestServiceClient, size int) {
+	req := &testpb.SimpleRequest{Payload: &testpb.Payload{Body: make([]byte, size)}}
+	ctx := context.Background()
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.UnaryCall(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkConcurrentClients measures unary throughput with many calls in
+// flight on one connection
+func BenchmarkConcurrentClients(b *testing.B) {
+	for _, clients := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			forEachTarget(b, func(b *testing.B, client testpb.TestServiceClient) {
+				req := &testpb.SimpleRequest{Payload: &testpb.Payload{Body: make([]byte, 1<<10)}}
+				ctx := context.Background()
+
+				b.SetBytes(1 << 10)
+				b.ReportAllocs()
+				b.SetParallelism(clients)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if _, err := client.UnaryCall(ctx, req); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		})
+	}
+}
+
+// BenchmarkStreamRoundTrip measures ping-pong messages on one long-lived
+// bidirectional stream
+func BenchmarkStreamRoundTrip(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		b.Run(sizeName(size), func(b *testing.B) {
+			forEachTarget(b, func(b *testing.B, client testpb.TestServiceClient) {
+				stream, err := client.FullDuplexCall(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				req := &testpb.StreamingOutputCallRequest{Payload: &testpb.Payload{Body: make([]byte, size)}}
+
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := stream.Send(req); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := stream.Recv(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				stream.CloseSend()
+			})
+		})
+	}
+}
+
+// BenchmarkStreamUpload measures client-to-upstream streaming throughput,
+// one message per iteration on a single stream
+func BenchmarkStreamUpload(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		b.Run(sizeName(size), func(b *testing.B) {
+			forEachTarget(b, func(b *testing.B, client testpb.TestServiceClient) {
+				stream, err := client.StreamingInputCall(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				req := &testpb.StreamingInputCallRequest{Payload: &testpb.Payload{Body: make([]byte, size)}}
+
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := stream.Send(req); err != nil {
+						b.Fatal(err)
+					}
+				}
+				resp, err := stream.CloseAndRecv()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if want := int32(b.N * size); resp.AggregatedPayloadSize != want {
+					b.Fatalf("upstream received %d bytes, want %d", resp.AggregatedPayloadSize, want)
+				}
+			})
+		})
+	}
+}
+
+// downloadBatch is how many responses each download call asks for
+const downloadBatch = 100
+
+// BenchmarkStreamDownload measures upstream-to-client streaming throughput,
+// one message per iteration, in calls of downloadBatch responses
+func BenchmarkStreamDownload(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		b.Run(sizeName(size), func(b *testing.B) {
+			forEachTarget(b, func(b *testing.B, client testpb.TestServiceClient) {
+				params := make([]*testpb.ResponseParameters, downloadBatch)
+				for i := range params {
+					params[i] = &testpb.ResponseParameters{Size: int32(size)}
+				}
+
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for received := 0; received < b.N; {
+					n := min(downloadBatch, b.N-received)
+					stream, err := client.StreamingOutputCall(context.Background(), &testpb.StreamingOutputCallRequest{ResponseParameters: params[:n]})
+					if err != nil {
+						b.Fatal(err)
+					}
+					for {
+						_, err := stream.Recv()
+						if err == io.EOF {
+							break
+						}
+						if err != nil {
+							b.Fatal(err)
+						}
+						received++
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,12 @@
+// Package benchmarks measures the proxy's forwarding path against an
+// in-process echo upstream. Every benchmark runs against four targets:
+//
+//   - direct: the upstream without a proxy, the floor for the others
+//   - endpoint: a full proxy endpoint, with its director and interceptors
+//   - forward: the bare proxy.ForwardServerOptions handler
+//   - transparent: the mwitkow/grpc-proxy TransparentHandler it replaced
+//
+// The client, proxy and upstream share one process and talk over loopback
+// TCP, so allocation counts cover all three. Run the suite with make bench
+// and collect CPU and heap profiles with make profile.
+package benchmarks
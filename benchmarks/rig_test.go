@@ -0,0 +1,166 @@
+package benchmarks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	grpcproxy "github.com/mwitkow/grpc-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// targets are what every benchmark runs against, in order
+var targets = []string{"direct", "endpoint", "forward", "transparent"}
+
+// echoService is the upstream: it echoes payloads, streams the responses
+// it is asked for and sums uploads
+type echoService struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (echoService) UnaryCall(_ context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	return &testpb.SimpleResponse{Payload: req.Payload}, nil
+}
+
+func (echoService) StreamingOutputCall(req *testpb.StreamingOutputCallRequest, stream testpb.TestService_StreamingOutputCallServer) error {
+	for _, p := range req.ResponseParameters {
+		resp := &testpb.StreamingOutputCallResponse{Payload: &testpb.Payload{Body: make([]byte, p.Size)}}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (echoService) StreamingInputCall(stream testpb.TestService_StreamingInputCallServer) error {
+	var total int32
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&testpb.StreamingInputCallResponse{AggregatedPayloadSize: total})
+		}
+		if err != nil {
+			return err
+		}
+		total += int32(len(req.Payload.GetBody()))
+	}
+}
+
+func (echoService) FullDuplexCall(stream testpb.TestService_FullDuplexCallServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{Payload: req.Payload}); err != nil {
+			return err
+		}
+	}
+}
+
+// serve serves server on a free loopback port until the benchmark ends
+func serve(b *testing.B, server *grpc.Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go server.Serve(lis)
+	b.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+// dial connects to addr until the benchmark ends
+func dial(b *testing.B, addr string) *grpc.ClientConn {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// freeAddress returns a loopback address nothing listens on
+func freeAddress(b *testing.B) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// start serves the echo upstream behind target and returns a client for it
+func start(b *testing.B, target string) testpb.TestServiceClient {
+	// Keep the proxy's log lines out of the results
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, echoService{})
+	upstreamAddr := serve(b, upstream)
+
+	var addr string
+	switch target {
+	case "direct":
+		addr = upstreamAddr
+	case "endpoint":
+		addr = freeAddress(b)
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{Name: "bench", ListenAddress: addr, RemoteAddress: upstreamAddr, JWTToken: "bench_jwt_token"}},
+		})
+		if err := manager.Start(); err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { manager.Stop() })
+	case "forward":
+		addr = serve(b, grpc.NewServer(proxy.ForwardServerOptions(director(dial(b, upstreamAddr)))...))
+	case "transparent":
+		handler := grpcproxy.TransparentHandler(grpcproxy.StreamDirector(director(dial(b, upstreamAddr))))
+		addr = serve(b, grpc.NewServer(grpc.UnknownServiceHandler(handler)))
+	default:
+		b.Fatalf("unknown target %q", target)
+	}
+	return testpb.NewTestServiceClient(dial(b, addr))
+}
+
+// director forwards every call to conn with a bearer token, like a minimal
+// endpoint would
+func director(conn *grpc.ClientConn) proxy.StreamDirector {
+	return func(ctx context.Context, _ string) (context.Context, grpc.ClientConnInterface, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		md.Set("authorization", "Bearer bench_jwt_token")
+		return metadata.NewOutgoingContext(ctx, md), conn, nil
+	}
+}
+
+// forEachTarget runs bench as a sub-benchmark per target
+func forEachTarget(b *testing.B, bench func(b *testing.B, client testpb.TestServiceClient)) {
+	for _, target := range targets {
+		b.Run("target="+target, func(b *testing.B) {
+			bench(b, start(b, target))
+		})
+	}
+}
+
+// sizeName formats a message size for a sub-benchmark name
+func sizeName(size int) string {
+	switch {
+	case size >= 1<<20 && size%(1<<20) == 0:
+		return fmt.Sprintf("size=%dM", size>>20)
+	case size >= 1<<10 && size%(1<<10) == 0:
+		return fmt.Sprintf("size=%dK", size>>10)
+	}
+	return fmt.Sprintf("size=%d", size)
+}
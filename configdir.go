@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// configDir is a conf.d directory whose files are merged over the config file
+var configDir string
+
+// mergedLists are the top-level lists concatenated across config files
+// instead of replaced, so each file can hold its own endpoints and clients
+var mergedLists = []string{"endpoints", "clients"}
+
+// configDirExts are the config file formats read from a config directory
+var configDirExts = map[string]bool{".yaml": true, ".yml": true, ".toml": true, ".json": true}
+
+// configDirFiles returns the config files of dir in merge order, sorted by
+// name. Hidden files, such as editor swap files and the ..data entries of
+// a mounted ConfigMap, are skipped.
+func configDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || e.IsDir() {
+			continue
+		}
+		if configDirExts[filepath.Ext(name)] {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// os.ReadDir sorts by name already; keep the order explicit
+	sort.Strings(files)
+	return files, nil
+}
+
+// namedList accumulates a merged list. An item whose name an earlier item
+// already has replaces it in place.
+type namedList struct {
+	items   []interface{}
+	sources map[string]string
+}
+
+// add appends the items of a list read from source
+func (l *namedList) add(key string, list interface{}, source string) error {
+	if list == nil {
+		return nil
+	}
+	items, ok := list.([]interface{})
+	if !ok {
+		return fmt.Errorf("%s in %s must be a list", key, source)
+	}
+	for _, item := range items {
+		fields, _ := item.(map[string]interface{})
+		name, _ := fields["name"].(string)
+		previous, seen := l.sources[name]
+		if name == "" || !seen {
+			if name != "" {
+				l.sources[name] = source
+			}
+			l.items = append(l.items, item)
+			continue
+		}
+		for i, existing := range l.items {
+			if existingFields, _ := existing.(map[string]interface{}); existingFields["name"] == name {
+				l.items[i] = item
+			}
+		}
+		l.sources[name] = source
+		log.Printf("%s entry %s from %s replaces the one from %s", key, name, source, previous)
+	}
+	return nil
+}
+
+// mergeConfigDir merges the config files of dir, in name order, over the
+// config file viper has read. Settings from later files override earlier
+// ones, except endpoints and clients: their lists are concatenated, and an
+// entry named like an earlier one replaces it.
+func mergeConfigDir(dir string) error {
+	files, err := configDirFiles(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read config directory %s: %v", dir, err)
+	}
+
+	lists := make(map[string]*namedList, len(mergedLists))
+	for _, key := range mergedLists {
+		lists[key] = &namedList{sources: make(map[string]string)}
+		if err := lists[key].add(key, viper.Get(key), viper.ConfigFileUsed()); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range files {
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		settings := v.AllSettings()
+		for key, list := range lists {
+			if err := list.add(key, settings[key], path); err != nil {
+				return err
+			}
+			delete(settings, key)
+		}
+		if err := viper.MergeConfigMap(settings); err != nil {
+			return fmt.Errorf("failed to merge %s: %v", path, err)
+		}
+		log.Printf("Merged config file: %s", path)
+	}
+
+	merged := make(map[string]interface{}, len(lists))
+	for key, list := range lists {
+		if len(list.items) > 0 {
+			merged[key] = list.items
+		}
+	}
+	return viper.MergeConfigMap(merged)
+}
+
+// readConfigSources returns the contents of the config file and the files
+// of the config directory by path. It returns false if the config file
+// cannot be read, e.g. midway through a ConfigMap update.
+func readConfigSources() (map[string][]byte, bool) {
+	sources := make(map[string][]byte)
+	if path := viper.ConfigFileUsed(); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, false
+		}
+		sources[path] = data
+	}
+	if configDir != "" {
+		files, err := configDirFiles(configDir)
+		if err != nil {
+			return nil, false
+		}
+		for _, path := range files {
+			if data, err := os.ReadFile(path); err == nil {
+				sources[path] = data
+			}
+		}
+	}
+	return sources, true
+}
+
+// changedSource returns the first path, in name order, that was added,
+// removed or changed between two reads of the config sources, or ""
+func changedSource(last, current map[string][]byte) string {
+	paths := make([]string, 0, len(last)+len(current))
+	for path := range last {
+		paths = append(paths, path)
+	}
+	for path := range current {
+		if _, ok := last[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		a, inLast := last[path]
+		b, inCurrent := current[path]
+		if inLast != inCurrent || !bytes.Equal(a, b) {
+			return path
+		}
+	}
+	return ""
+}
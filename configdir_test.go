@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfigFiles writes files by name into dir
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+}
+
+// readConfigWithDir reads the config file at path into a fresh viper and
+// merges dir over it
+func readConfigWithDir(t *testing.T, path, dir string) error {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile(path)
+	require.NoError(t, viper.ReadInConfig())
+	return mergeConfigDir(dir)
+}
+
+func TestMergeConfigDir(t *testing.T) {
+	base := t.TempDir()
+	configFile := filepath.Join(base, "config.yaml")
+	writeConfigFiles(t, base, map[string]string{"config.yaml": `
+shutdown_timeout: 10s
+log_level: info
+endpoints:
+  - name: cosmos
+    local_port: 9090
+  - name: osmosis
+    local_port: 9091
+clients:
+  - name: indexer
+`})
+
+	dir := filepath.Join(base, "conf.d")
+	require.NoError(t, os.Mkdir(dir, 0700))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested.yaml"), 0700))
+	writeConfigFiles(t, dir, map[string]string{
+		"20-last.json": `{"shutdown_timeout": "30s", "endpoints": [{"name": "akash", "local_port": 9093}], "clients": [{"name": "wallet"}]}`,
+		"10-first.yaml": `
+shutdown_timeout: 20s
+endpoints:
+  - name: osmosis
+    local_port: 9191
+  - name: juno
+    local_port: 9092
+`,
+		".10-first.yaml.swp": "not: [valid",
+		"README.txt":         "not a config file",
+	})
+
+	require.NoError(t, readConfigWithDir(t, configFile, dir))
+
+	// Later files override settings of earlier ones and of the config file,
+	// hidden files, other extensions and directories are skipped
+	assert.Equal(t, "30s", viper.GetString("shutdown_timeout"))
+	assert.Equal(t, "info", viper.GetString("log_level"))
+
+	// Endpoints and clients are concatenated in file order, and an entry
+	// named like an earlier one replaces it in place
+	names := func(key string) []string {
+		var out []string
+		for _, item := range viper.Get(key).([]interface{}) {
+			out = append(out, item.(map[string]interface{})["name"].(string))
+		}
+		return out
+	}
+	assert.Equal(t, []string{"cosmos", "osmosis", "juno", "akash"}, names("endpoints"))
+	assert.Equal(t, []string{"indexer", "wallet"}, names("clients"))
+	osmosis := viper.Get("endpoints").([]interface{})[1].(map[string]interface{})
+	assert.EqualValues(t, 9191, osmosis["local_port"])
+}
+
+func TestMergeConfigDirErrors(t *testing.T) {
+	base := t.TempDir()
+	configFile := filepath.Join(base, "config.yaml")
+	writeConfigFiles(t, base, map[string]string{"config.yaml": "endpoints:\n  - name: cosmos\n"})
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{"malformed file", map[string]string{"10-bad.yaml": "endpoints: [\n"}, "failed to read"},
+		{"endpoints not a list", map[string]string{"10-map.yaml": "endpoints:\n  name: juno\n"}, "must be a list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfigFiles(t, dir, tt.files)
+			err := readConfigWithDir(t, configFile, dir)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	err := readConfigWithDir(t, configFile, filepath.Join(base, "missing"))
+	assert.ErrorContains(t, err, "failed to read config directory")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// firstImportedPort is where generated endpoints are assigned local ports
+// from when their source has none
+const firstImportedPort = 9090
+
+// generatedEndpoint is an endpoint written by init or import
+type generatedEndpoint struct {
+	Name          string
+	LocalPort     int
+	RemoteAddress string
+	UseTLS        bool
+
+	// JWTToken is written as a placeholder when empty
+	JWTToken string
+
+	// ChainID is written as expected_chain_id when set
+	ChainID string
+
+	// Provider annotates remote_address, and Alternatives are written as
+	// commented-out remote_address lines
+	Provider     string
+	Alternatives []string
+}
+
+// placeholderToken is the jwt_token written for an endpoint whose token is
+// not known; the proxy refuses to start until it is replaced
+func placeholderToken(name string) string {
+	return "your_" + name + "_jwt_token_here"
+}
+
+// writeEndpointsYAML renders endpoints in the same layout as
+// config.example.yaml, after header
+func writeEndpointsYAML(w io.Writer, header string, endpoints []generatedEndpoint) error {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, e := range endpoints {
+		if e.JWTToken == "" {
+			b.WriteString("# Replace the jwt_token placeholders before starting the proxy\n")
+			break
+		}
+	}
+	b.WriteString("\nendpoints:\n")
+	for i, e := range endpoints {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "  - name: %s\n", strconv.Quote(e.Name))
+		fmt.Fprintf(&b, "    local_port: %d\n", e.LocalPort)
+		if e.Provider != "" {
+			fmt.Fprintf(&b, "    remote_address: %s # %s\n", strconv.Quote(e.RemoteAddress), e.Provider)
+		} else {
+			fmt.Fprintf(&b, "    remote_address: %s\n", strconv.Quote(e.RemoteAddress))
+		}
+		for _, alt := range e.Alternatives {
+			fmt.Fprintf(&b, "    # remote_address: %s\n", strconv.Quote(alt))
+		}
+		fmt.Fprintf(&b, "    use_tls: %t\n", e.UseTLS)
+		token := e.JWTToken
+		if token == "" {
+			token = placeholderToken(e.Name)
+		}
+		fmt.Fprintf(&b, "    jwt_token: %s\n", strconv.Quote(token))
+		if e.ChainID != "" {
+			fmt.Fprintf(&b, "    expected_chain_id: %s\n", strconv.Quote(e.ChainID))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
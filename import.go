@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var importFrom string
+
+// importCmd converts existing proxy configurations into endpoint YAML
+var importCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Convert another proxy's configuration into endpoint YAML",
+	Long: `Convert an existing envoy, nginx (grpc_pass) or grpcwebproxy configuration
+into this proxy's endpoint YAML and print it to stdout.
+
+Upstream addresses, local ports and TLS settings are carried over. Bearer
+tokens are carried over when the source config injects an Authorization
+header; otherwise jwt_token is set to a placeholder that must be replaced.`,
+	Example: `  grpc-proxy import --from envoy envoy.yaml > config.yaml
+  grpc-proxy import --from nginx-grpc /etc/nginx/conf.d/grpc.conf
+  grpc-proxy import --from grpcwebproxy grpcwebproxy.service`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", args[0], err)
+		}
+
+		var endpoints []generatedEndpoint
+		switch importFrom {
+		case "envoy":
+			endpoints, err = importEnvoy(data)
+		case "nginx-grpc":
+			endpoints, err = importNginx(data)
+		case "grpcwebproxy":
+			endpoints, err = importGRPCWebProxy(data)
+		default:
+			return fmt.Errorf("unsupported source %q (expected envoy, nginx-grpc or grpcwebproxy)", importFrom)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %s config: %v", importFrom, err)
+		}
+		if len(endpoints) == 0 {
+			return fmt.Errorf("no gRPC endpoints found in %s", args[0])
+		}
+
+		assignImportedPorts(endpoints)
+		return writeEndpointsYAML(cmd.OutOrStdout(), fmt.Sprintf("# Imported from %s config %s\n", importFrom, args[0]), endpoints)
+	},
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importFrom, "from", "", "source config format: envoy, nginx-grpc or grpcwebproxy")
+	importCmd.MarkFlagRequired("from")
+	rootCmd.AddCommand(importCmd)
+}
+
+// assignImportedPorts gives endpoints without a known local port the next free port
+func assignImportedPorts(endpoints []generatedEndpoint) {
+	used := make(map[int]bool)
+	for _, e := range endpoints {
+		used[e.LocalPort] = true
+	}
+	next := firstImportedPort
+	for i := range endpoints {
+		if endpoints[i].LocalPort != 0 {
+			continue
+		}
+		for used[next] {
+			next++
+		}
+		endpoints[i].LocalPort = next
+		used[next] = true
+	}
+}
+
+// bearerToken extracts the token from an Authorization header value
+func bearerToken(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+		return strings.TrimSpace(value[7:])
+	}
+	return ""
+}
+
+// endpointName derives a config-friendly endpoint name from a host name
+func endpointName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		if i := strings.Index(host, "."); i > 0 {
+			host = host[:i]
+		}
+	}
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, host)
+	return strings.Trim(name, "-")
+}
+
+// Envoy
+
+type envoyConfig struct {
+	StaticResources struct {
+		Listeners []envoyListener `yaml:"listeners"`
+		Clusters  []envoyCluster  `yaml:"clusters"`
+	} `yaml:"static_resources"`
+}
+
+type envoyAddress struct {
+	SocketAddress struct {
+		Address   string `yaml:"address"`
+		PortValue int    `yaml:"port_value"`
+	} `yaml:"socket_address"`
+}
+
+type envoyHeaderValueOption struct {
+	Header struct {
+		Key   string `yaml:"key"`
+		Value string `yaml:"value"`
+	} `yaml:"header"`
+}
+
+type envoyRouteConfig struct {
+	RequestHeadersToAdd []envoyHeaderValueOption `yaml:"request_headers_to_add"`
+	VirtualHosts        []struct {
+		RequestHeadersToAdd []envoyHeaderValueOption `yaml:"request_headers_to_add"`
+		Routes              []struct {
+			Route struct {
+				Cluster string `yaml:"cluster"`
+			} `yaml:"route"`
+			RequestHeadersToAdd []envoyHeaderValueOption `yaml:"request_headers_to_add"`
+		} `yaml:"routes"`
+	} `yaml:"virtual_hosts"`
+}
+
+type envoyListener struct {
+	Name         string       `yaml:"name"`
+	Address      envoyAddress `yaml:"address"`
+	FilterChains []struct {
+		Filters []struct {
+			Name        string `yaml:"name"`
+			TypedConfig struct {
+				RouteConfig envoyRouteConfig `yaml:"route_config"`
+			} `yaml:"typed_config"`
+		} `yaml:"filters"`
+	} `yaml:"filter_chains"`
+}
+
+type envoyCluster struct {
+	Name           string `yaml:"name"`
+	LoadAssignment struct {
+		Endpoints []struct {
+			LbEndpoints []struct {
+				Endpoint struct {
+					Address envoyAddress `yaml:"address"`
+				} `yaml:"endpoint"`
+			} `yaml:"lb_endpoints"`
+		} `yaml:"endpoints"`
+	} `yaml:"load_assignment"`
+	TransportSocket *struct {
+		Name string `yaml:"name"`
+	} `yaml:"transport_socket"`
+}
+
+// importEnvoy converts envoy static listeners routed to clusters. JSON configs
+// are accepted too since they are valid YAML.
+func importEnvoy(data []byte) ([]generatedEndpoint, error) {
+	var cfg envoyConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	clusters := make(map[string]envoyCluster)
+	for _, c := range cfg.StaticResources.Clusters {
+		clusters[c.Name] = c
+	}
+
+	var endpoints []generatedEndpoint
+	for _, l := range cfg.StaticResources.Listeners {
+		var clusterName, token string
+		for _, fc := range l.FilterChains {
+			for _, f := range fc.Filters {
+				rc := f.TypedConfig.RouteConfig
+				token = firstEnvoyToken(token, rc.RequestHeadersToAdd)
+				for _, vh := range rc.VirtualHosts {
+					token = firstEnvoyToken(token, vh.RequestHeadersToAdd)
+					for _, r := range vh.Routes {
+						token = firstEnvoyToken(token, r.RequestHeadersToAdd)
+						if clusterName == "" {
+							clusterName = r.Route.Cluster
+						}
+					}
+				}
+			}
+		}
+
+		cluster, ok := clusters[clusterName]
+		if !ok {
+			continue
+		}
+		var remote string
+		for _, e := range cluster.LoadAssignment.Endpoints {
+			for _, lb := range e.LbEndpoints {
+				sa := lb.Endpoint.Address.SocketAddress
+				if remote == "" && sa.Address != "" {
+					remote = net.JoinHostPort(sa.Address, strconv.Itoa(sa.PortValue))
+				}
+			}
+		}
+		if remote == "" {
+			continue
+		}
+
+		name := l.Name
+		if name == "" {
+			name = cluster.Name
+		}
+		endpoints = append(endpoints, generatedEndpoint{
+			Name:          name,
+			LocalPort:     l.Address.SocketAddress.PortValue,
+			RemoteAddress: remote,
+			UseTLS:        cluster.TransportSocket != nil,
+			JWTToken:      token,
+		})
+	}
+	return endpoints, nil
+}
+
+func firstEnvoyToken(current string, headers []envoyHeaderValueOption) string {
+	if current != "" {
+		return current
+	}
+	for _, h := range headers {
+		if strings.EqualFold(h.Header.Key, "authorization") {
+			if t := bearerToken(h.Header.Value); t != "" {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// nginx
+
+// nginxDirective is a single nginx directive with an optional block
+type nginxDirective struct {
+	Name  string
+	Args  []string
+	Block []nginxDirective
+}
+
+// importNginx converts server blocks that grpc_pass to an upstream
+func importNginx(data []byte) ([]generatedEndpoint, error) {
+	directives, err := parseNginx(tokenizeNginx(string(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams := make(map[string]string)
+	walkNginx(directives, func(d nginxDirective) {
+		if d.Name != "upstream" || len(d.Args) == 0 {
+			return
+		}
+		for _, s := range d.Block {
+			if s.Name == "server" && len(s.Args) > 0 {
+				upstreams[d.Args[0]] = s.Args[0]
+				return
+			}
+		}
+	})
+
+	var endpoints []generatedEndpoint
+	walkNginx(directives, func(server nginxDirective) {
+		if server.Name != "server" || server.Block == nil {
+			return
+		}
+
+		var e generatedEndpoint
+		serverToken := nginxToken(server.Block)
+		for _, d := range server.Block {
+			switch d.Name {
+			case "listen":
+				if len(d.Args) > 0 && e.LocalPort == 0 {
+					e.LocalPort = nginxListenPort(d.Args[0])
+				}
+			case "server_name":
+				if len(d.Args) > 0 && d.Args[0] != "_" {
+					e.Name = endpointName(d.Args[0])
+				}
+			case "location":
+				if e.RemoteAddress != "" {
+					continue
+				}
+				for _, ld := range d.Block {
+					if ld.Name != "grpc_pass" || len(ld.Args) == 0 {
+						continue
+					}
+					target := ld.Args[0]
+					switch {
+					case strings.HasPrefix(target, "grpcs://"):
+						e.UseTLS = true
+						target = strings.TrimPrefix(target, "grpcs://")
+					case strings.HasPrefix(target, "grpc://"):
+						target = strings.TrimPrefix(target, "grpc://")
+					}
+					if addr, ok := upstreams[target]; ok {
+						target = addr
+					}
+					e.RemoteAddress = target
+					e.JWTToken = nginxToken(d.Block)
+				}
+			}
+		}
+		if e.RemoteAddress == "" {
+			return
+		}
+		if e.JWTToken == "" {
+			e.JWTToken = serverToken
+		}
+		if e.Name == "" {
+			e.Name = endpointName(e.RemoteAddress)
+		}
+		endpoints = append(endpoints, e)
+	})
+	return endpoints, nil
+}
+
+// nginxToken returns the bearer token set via grpc_set_header in a block
+func nginxToken(block []nginxDirective) string {
+	for _, d := range block {
+		if d.Name == "grpc_set_header" && len(d.Args) == 2 && strings.EqualFold(d.Args[0], "authorization") {
+			return bearerToken(d.Args[1])
+		}
+	}
+	return ""
+}
+
+// nginxListenPort extracts the port from a listen argument such as "9090", "127.0.0.1:9090" or "[::]:9090"
+func nginxListenPort(arg string) int {
+	if _, port, err := net.SplitHostPort(arg); err == nil {
+		arg = port
+	}
+	port, _ := strconv.Atoi(arg)
+	return port
+}
+
+func walkNginx(directives []nginxDirective, fn func(nginxDirective)) {
+	for _, d := range directives {
+		fn(d)
+		walkNginx(d.Block, fn)
+	}
+}
+
+// tokenizeNginx splits nginx configuration into words, quoted strings and the
+// punctuation tokens "{", "}" and ";", dropping comments
+func tokenizeNginx(src string) []string {
+	var tokens []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '#':
+			flush()
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			flush()
+			quote := c
+			for i++; i < len(src) && src[i] != quote; i++ {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				cur.WriteByte(src[i])
+			}
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		case c == '{' || c == '}' || c == ';':
+			flush()
+			tokens = append(tokens, string(c))
+		case unicode.IsSpace(rune(c)):
+			flush()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// parseNginx builds the directive tree from tokens
+func parseNginx(tokens []string) ([]nginxDirective, error) {
+	directives, rest, err := parseNginxBlock(tokens)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected %q", rest[0])
+	}
+	return directives, nil
+}
+
+func parseNginxBlock(tokens []string) ([]nginxDirective, []string, error) {
+	var directives []nginxDirective
+	var cur *nginxDirective
+	for len(tokens) > 0 {
+		tok := tokens[0]
+		tokens = tokens[1:]
+		switch tok {
+		case ";":
+			if cur != nil {
+				directives = append(directives, *cur)
+				cur = nil
+			}
+		case "{":
+			if cur == nil {
+				return nil, nil, fmt.Errorf("block without directive")
+			}
+			block, rest, err := parseNginxBlock(tokens)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(rest) == 0 || rest[0] != "}" {
+				return nil, nil, fmt.Errorf("unterminated %s block", cur.Name)
+			}
+			cur.Block = append([]nginxDirective{}, block...)
+			directives = append(directives, *cur)
+			cur = nil
+			tokens = rest[1:]
+		case "}":
+			if cur != nil {
+				return nil, nil, fmt.Errorf("missing ';' after %s", cur.Name)
+			}
+			return directives, append([]string{tok}, tokens...), nil
+		default:
+			if cur == nil {
+				cur = &nginxDirective{Name: tok}
+			} else {
+				cur.Args = append(cur.Args, tok)
+			}
+		}
+	}
+	if cur != nil {
+		return nil, nil, fmt.Errorf("missing ';' after %s", cur.Name)
+	}
+	return directives, nil, nil
+}
+
+// grpcwebproxy
+
+// importGRPCWebProxy converts grpcwebproxy invocations found in a shell
+// script, systemd unit or flags file. Each command line becomes one endpoint.
+func importGRPCWebProxy(data []byte) ([]generatedEndpoint, error) {
+	src := strings.ReplaceAll(string(data), "\\\n", " ")
+
+	var endpoints []generatedEndpoint
+	for _, line := range strings.Split(src, "\n") {
+		flags := grpcWebProxyFlags(line)
+		backend := flags["backend_addr"]
+		if backend == "" {
+			continue
+		}
+
+		e := generatedEndpoint{
+			Name:          endpointName(backend),
+			RemoteAddress: backend,
+			UseTLS:        flags["backend_tls"] == "true",
+		}
+		for _, key := range []string{"server_http_debug_port", "server_http_tls_port"} {
+			if port, err := strconv.Atoi(flags[key]); err == nil && port > 0 {
+				e.LocalPort = port
+				break
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// grpcWebProxyFlags parses "--name=value", "--name value" and bare boolean flags
+func grpcWebProxyFlags(line string) map[string]string {
+	fields := strings.Fields(line)
+	flags := make(map[string]string)
+	for i := 0; i < len(fields); i++ {
+		f := strings.Trim(fields[i], `"'`)
+		if !strings.HasPrefix(f, "-") {
+			continue
+		}
+		f = strings.TrimLeft(f, "-")
+		if name, value, ok := strings.Cut(f, "="); ok {
+			flags[name] = strings.Trim(value, `"'`)
+			continue
+		}
+		if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+			flags[f] = strings.Trim(fields[i+1], `"'`)
+			i++
+			continue
+		}
+		flags[f] = "true"
+	}
+	return flags
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const envoyImportConfig = `
+static_resources:
+  listeners:
+    - name: cosmos
+      address:
+        socket_address: {address: 0.0.0.0, port_value: 9091}
+      filter_chains:
+        - filters:
+            - name: envoy.filters.network.http_connection_manager
+              typed_config:
+                "@type": type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager
+                stat_prefix: cosmos
+                route_config:
+                  virtual_hosts:
+                    - name: cosmos
+                      domains: ["*"]
+                      routes:
+                        - match: {prefix: "/"}
+                          route: {cluster: cosmos_grpc}
+                      request_headers_to_add:
+                        - header: {key: Authorization, value: "Bearer cosmos-token"}
+    - name: orphan
+      address:
+        socket_address: {address: 0.0.0.0, port_value: 9095}
+      filter_chains:
+        - filters:
+            - name: envoy.filters.network.http_connection_manager
+              typed_config:
+                route_config:
+                  virtual_hosts:
+                    - routes:
+                        - route: {cluster: missing}
+  clusters:
+    - name: cosmos_grpc
+      type: STRICT_DNS
+      http2_protocol_options: {}
+      load_assignment:
+        cluster_name: cosmos_grpc
+        endpoints:
+          - lb_endpoints:
+              - endpoint:
+                  address:
+                    socket_address: {address: cosmos-grpc.example.com, port_value: 443}
+      transport_socket:
+        name: envoy.transport_sockets.tls
+`
+
+const nginxImportConfig = `
+upstream osmosis_backend {
+    server osmosis-grpc.example.com:9090;
+}
+
+server {
+    listen 9092 http2;
+    server_name osmosis.internal;
+
+    # The token is set for every location
+    grpc_set_header Authorization "Bearer osmosis-token";
+
+    location / {
+        grpc_pass grpc://osmosis_backend;
+    }
+}
+
+server {
+    listen [::]:443 ssl http2;
+    server_name _;
+
+    location /cosmos. {
+        grpc_set_header authorization 'Bearer juno-token';
+        grpc_pass grpcs://juno-grpc.example.com:443;
+    }
+}
+
+server {
+    listen 80;
+    location / {
+        proxy_pass http://127.0.0.1:8080;
+    }
+}
+`
+
+const grpcWebProxyImportConfig = `#!/bin/sh
+grpcwebproxy \
+  --backend_addr=akash-grpc.example.com:443 \
+  --backend_tls \
+  --server_http_debug_port 9093 \
+  --run_tls_server=false
+grpcwebproxy --backend_addr="10.0.0.5:9090" --run_tls_server=false
+`
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name   string
+		parse  func([]byte) ([]generatedEndpoint, error)
+		config string
+		want   []generatedEndpoint
+	}{
+		{
+			name:   "envoy",
+			parse:  importEnvoy,
+			config: envoyImportConfig,
+			want: []generatedEndpoint{
+				{Name: "cosmos", LocalPort: 9091, RemoteAddress: "cosmos-grpc.example.com:443", UseTLS: true, JWTToken: "cosmos-token"},
+			},
+		},
+		{
+			name:   "nginx",
+			parse:  importNginx,
+			config: nginxImportConfig,
+			want: []generatedEndpoint{
+				{Name: "osmosis", LocalPort: 9092, RemoteAddress: "osmosis-grpc.example.com:9090", JWTToken: "osmosis-token"},
+				{Name: "juno-grpc", LocalPort: 443, RemoteAddress: "juno-grpc.example.com:443", UseTLS: true, JWTToken: "juno-token"},
+			},
+		},
+		{
+			name:   "grpcwebproxy",
+			parse:  importGRPCWebProxy,
+			config: grpcWebProxyImportConfig,
+			want: []generatedEndpoint{
+				{Name: "akash-grpc", LocalPort: 9093, RemoteAddress: "akash-grpc.example.com:443", UseTLS: true},
+				{Name: "10-0-0-5", RemoteAddress: "10.0.0.5:9090"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints, err := tt.parse([]byte(tt.config))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, endpoints)
+		})
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		parse  func([]byte) ([]generatedEndpoint, error)
+		config string
+		err    string
+	}{
+		{"envoy invalid yaml", importEnvoy, "static_resources: [", "did not find expected node content"},
+		{"nginx unterminated block", importNginx, "server { listen 9090;", "unterminated server block"},
+		{"nginx missing semicolon", importNginx, "server { listen 9090 }", "missing ';' after listen"},
+		{"nginx stray brace", importNginx, "}", `unexpected "}"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.parse([]byte(tt.config))
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+	run := func(from, path string) (string, error) {
+		var out bytes.Buffer
+		importFrom = from
+		importCmd.SetOut(&out)
+		err := importCmd.RunE(importCmd, []string{path})
+		return out.String(), err
+	}
+
+	out, err := run("grpcwebproxy", write("grpcwebproxy.sh", grpcWebProxyImportConfig))
+	require.NoError(t, err)
+	assert.Contains(t, out, "# Replace the jwt_token placeholders before starting the proxy")
+	// The endpoint without a port gets the first free one
+	assert.Contains(t, out, `  - name: "10-0-0-5"
+    local_port: 9090
+    remote_address: "10.0.0.5:9090"
+    use_tls: false
+`)
+
+	_, err = run("haproxy", write("haproxy.cfg", "frontend grpc"))
+	assert.ErrorContains(t, err, `unsupported source "haproxy"`)
+
+	_, err = run("nginx-grpc", write("plain.conf", "server { listen 80; location / { proxy_pass http://app; } }"))
+	assert.ErrorContains(t, err, "no gRPC endpoints found")
+
+	_, err = run("envoy", filepath.Join(dir, "missing.yaml"))
+	assert.ErrorContains(t, err, "failed to read")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultChainRegistry serves the chain.json files of the Cosmos chain registry
+const defaultChainRegistry = "https://raw.githubusercontent.com/cosmos/chain-registry/master"
+
+// registryChain is the part of a chain registry chain.json that init uses
+type registryChain struct {
+	ChainName string `json:"chain_name"`
+	ChainID   string `json:"chain_id"`
+	APIs      struct {
+		GRPC []struct {
+			Address  string `json:"address"`
+			Provider string `json:"provider"`
+		} `json:"grpc"`
+	} `json:"apis"`
+}
+
+var (
+	initChains   []string
+	initRegistry string
+	initOutput   string
+	initForce    bool
+)
+
+// initCmd writes config.yaml scaffolding for chains in the Cosmos chain registry
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate config.yaml for chains in the Cosmos chain registry",
+	Long: `Look up each chain in the Cosmos chain registry and write config.yaml
+scaffolding with one endpoint per chain: the first listed gRPC endpoint as
+remote_address (the others as comments), the chain-id as expected_chain_id,
+local ports from 9090 upward and a jwt_token placeholder to fill in.
+
+The proxy refuses to start until the placeholders are replaced.`,
+	Example: `  grpc-proxy init --chains cosmoshub,osmosis,juno
+  grpc-proxy init --chains cosmoshub --output -`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(initChains) == 0 {
+			return fmt.Errorf("--chains is required")
+		}
+		if initOutput != "-" && !initForce {
+			if _, err := os.Stat(initOutput); err == nil {
+				return fmt.Errorf("%s already exists; pass --force to overwrite it", initOutput)
+			}
+		}
+
+		client := &http.Client{Timeout: 30 * time.Second}
+		var endpoints []generatedEndpoint
+		for i, name := range initChains {
+			chain, err := fetchRegistryChain(client, initRegistry, strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			e, err := registryEndpoint(chain)
+			if err != nil {
+				return err
+			}
+			e.LocalPort = firstImportedPort + i
+			endpoints = append(endpoints, e)
+		}
+
+		var out io.Writer = cmd.OutOrStdout()
+		if initOutput != "-" {
+			f, err := os.OpenFile(initOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		header := "# Generated by grpc-proxy init from the Cosmos chain registry\n"
+		if err := writeEndpointsYAML(out, header, endpoints); err != nil {
+			return err
+		}
+		if initOutput != "-" {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Wrote %d endpoints to %s; set their jwt_token values before starting the proxy\n", len(endpoints), initOutput)
+		}
+		return nil
+	},
+}
+
+func init() {
+	initCmd.Flags().StringSliceVar(&initChains, "chains", nil, "comma-separated chain registry names, e.g. cosmoshub,osmosis,juno")
+	initCmd.Flags().StringVar(&initRegistry, "registry", defaultChainRegistry, "base URL of the chain registry")
+	initCmd.Flags().StringVarP(&initOutput, "output", "o", "config.yaml", "file to write, or - for stdout")
+	initCmd.Flags().BoolVar(&initForce, "force", false, "overwrite an existing output file")
+	rootCmd.AddCommand(initCmd)
+}
+
+// fetchRegistryChain downloads <registry>/<name>/chain.json
+func fetchRegistryChain(client *http.Client, registry, name string) (*registryChain, error) {
+	url := strings.TrimSuffix(registry, "/") + "/" + name + "/chain.json"
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("chain %q not found in the chain registry", name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	var chain registryChain
+	if err := json.NewDecoder(resp.Body).Decode(&chain); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", url, err)
+	}
+	if chain.ChainName == "" {
+		chain.ChainName = name
+	}
+	return &chain, nil
+}
+
+// registryEndpoint picks the first usable gRPC address of chain
+func registryEndpoint(chain *registryChain) (generatedEndpoint, error) {
+	e := generatedEndpoint{Name: chain.ChainName, ChainID: chain.ChainID}
+	for _, api := range chain.APIs.GRPC {
+		address, useTLS, ok := registryAddress(api.Address)
+		if !ok {
+			continue
+		}
+		if e.RemoteAddress == "" {
+			e.RemoteAddress, e.UseTLS, e.Provider = address, useTLS, api.Provider
+			continue
+		}
+		e.Alternatives = append(e.Alternatives, address)
+	}
+	if e.RemoteAddress == "" {
+		return e, fmt.Errorf("chain %q lists no gRPC endpoints in the chain registry", chain.ChainName)
+	}
+	return e, nil
+}
+
+// registryAddress turns a chain registry gRPC address, which may carry a
+// scheme or omit the port, into host:port. Only https and port 443 are
+// assumed to use TLS.
+func registryAddress(address string) (string, bool, bool) {
+	address = strings.TrimSuffix(strings.TrimSpace(address), "/")
+	useTLS := false
+	if rest, ok := strings.CutPrefix(address, "https://"); ok {
+		address, useTLS = rest, true
+	} else if rest, ok := strings.CutPrefix(address, "http://"); ok {
+		address = rest
+	} else if strings.Contains(address, "://") {
+		return "", false, false
+	}
+	if address == "" {
+		return "", false, false
+	}
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		return address, useTLS || port == "443", true
+	}
+	if useTLS {
+		return net.JoinHostPort(address, "443"), true, true
+	}
+	return net.JoinHostPort(address, "9090"), false, true
+}
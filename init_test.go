@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testChainRegistry serves chain.json files like the Cosmos chain registry
+var testChainRegistry = map[string]string{
+	"cosmoshub": `{
+  "chain_name": "cosmoshub",
+  "chain_id": "cosmoshub-4",
+  "apis": {"grpc": [
+    {"address": "grpc-cosmoshub.example.com:443", "provider": "Example"},
+    {"address": "tcp://ignored.example.com:9090", "provider": "Ignored"},
+    {"address": "http://cosmos-backup.example.com", "provider": "Backup"}
+  ]}
+}`,
+	"osmosis": `{
+  "chain_name": "osmosis",
+  "chain_id": "osmosis-1",
+  "apis": {"grpc": [{"address": "https://grpc.osmosis.example.com/"}]}
+}`,
+	"empty": `{"chain_name": "empty", "chain_id": "empty-1", "apis": {"grpc": []}}`,
+}
+
+func TestInitCommand(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(path.Dir(r.URL.Path))
+		chain, ok := testChainRegistry[name]
+		if !ok || path.Base(r.URL.Path) != "chain.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(chain))
+	}))
+	defer registry.Close()
+
+	output := filepath.Join(t.TempDir(), "config.yaml")
+	run := func(force bool, chains ...string) error {
+		initChains, initRegistry, initOutput, initForce = chains, registry.URL+"/", output, force
+		initCmd.SetErr(&bytes.Buffer{})
+		return initCmd.RunE(initCmd, nil)
+	}
+
+	require.NoError(t, run(false, "cosmoshub", " osmosis"))
+	config, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, `# Generated by grpc-proxy init from the Cosmos chain registry
+# Replace the jwt_token placeholders before starting the proxy
+
+endpoints:
+  - name: "cosmoshub"
+    local_port: 9090
+    remote_address: "grpc-cosmoshub.example.com:443" # Example
+    # remote_address: "cosmos-backup.example.com:9090"
+    use_tls: true
+    jwt_token: "your_cosmoshub_jwt_token_here"
+    expected_chain_id: "cosmoshub-4"
+
+  - name: "osmosis"
+    local_port: 9091
+    remote_address: "grpc.osmosis.example.com:443"
+    use_tls: true
+    jwt_token: "your_osmosis_jwt_token_here"
+    expected_chain_id: "osmosis-1"
+`, string(config))
+
+	err = run(false, "cosmoshub")
+	assert.ErrorContains(t, err, "already exists; pass --force to overwrite it")
+	require.NoError(t, run(true, "osmosis"))
+	config, err = os.ReadFile(output)
+	require.NoError(t, err)
+	assert.NotContains(t, string(config), "cosmoshub")
+
+	err = run(true, "unknown")
+	assert.ErrorContains(t, err, `chain "unknown" not found in the chain registry`)
+	err = run(true, "empty")
+	assert.ErrorContains(t, err, `chain "empty" lists no gRPC endpoints`)
+	err = run(true)
+	assert.ErrorContains(t, err, "--chains is required")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+var (
+	kubernetesEndpoints bool
+	kubernetesSource    *proxy.KubernetesEndpointSource
+)
+
+// podInfoLabels is where the downward API volume in the example manifests mounts pod labels
+const podInfoLabels = "/etc/podinfo/labels"
+
+// setPodLogPrefix prefixes log lines with the pod's namespace and name when
+// they are exposed through the downward API as POD_NAMESPACE and POD_NAME,
+// so lines from replicas can be told apart once aggregated
+func setPodLogPrefix() {
+	namespace, pod := os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME")
+	if pod == "" {
+		return
+	}
+	if namespace != "" {
+		pod = namespace + "/" + pod
+	}
+	log.SetPrefix("[" + pod + "] ")
+
+	if labels, err := os.ReadFile(podInfoLabels); err == nil {
+		log.Printf("Pod labels: %s", bytes.Join(bytes.Fields(labels), []byte(" ")))
+	}
+}
+
+// watchConfigFiles polls the config file and the files of the config
+// directory, and requests a reload through signals when one of them is
+// added, removed or changed. Reading the paths follows symlinks, so a
+// ConfigMap update, which swaps the ..data symlink, is picked up.
+func watchConfigFiles(interval time.Duration, signals chan<- os.Signal) {
+	last, _ := readConfigSources()
+	for range time.Tick(interval) {
+		current, ok := readConfigSources()
+		if !ok {
+			continue
+		}
+		path := changedSource(last, current)
+		if path == "" {
+			continue
+		}
+		last = current
+		log.Printf("Config file %s changed", path)
+		signals <- syscall.SIGHUP
+	}
+}
+
+// readKubernetesEndpoints lists the ChandraProxyEndpoint resources of the
+// pod's namespace as raw endpoint configurations
+func readKubernetesEndpoints() ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+	endpoints, err := kubernetesSource.Endpoints(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", kubernetesSource, err)
+	}
+	log.Printf("Loaded %d endpoints from %s", len(endpoints), kubernetesSource)
+	return endpoints, nil
+}
+
+// watchKubernetesEndpoints requests a reload through signals whenever a
+// ChandraProxyEndpoint is added, changed or deleted. Failed watches are
+// logged and retried.
+func watchKubernetesEndpoints(signals chan<- os.Signal) {
+	for {
+		if err := kubernetesSource.Watch(context.Background()); err != nil {
+			log.Printf("Warning: watching %s failed, retrying in %s: %v", kubernetesSource, remoteWatchRetry, err)
+			time.Sleep(remoteWatchRetry)
+			continue
+		}
+		log.Printf("ChandraProxyEndpoint resources in %s changed", kubernetesSource)
+		signals <- syscall.SIGHUP
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// loginCmd signs in to the OIDC provider of an endpoint
+var loginCmd = &cobra.Command{
+	Use:   "login <endpoint>",
+	Short: "Sign in to the OIDC provider of an endpoint",
+	Long: `Sign in to the OpenID Connect provider configured under an endpoint's
+oidc section with the device flow: open the printed URL in any browser, enter
+the code and approve the login. The refresh token the provider issues is
+stored at the endpoint's refresh_token_ref (the OS keychain by default), and
+the proxy uses it to obtain and renew access tokens.
+
+A running proxy picks up the new login at its next renewal.`,
+	Example: `  grpc-proxy login cosmos-hub
+  grpc-proxy login cosmos-hub --config /etc/grpc-proxy/config.yaml`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		initConfig()
+		var endpoint *proxy.Config
+		for i := range proxyConfig.Endpoints {
+			if proxyConfig.Endpoints[i].Name == args[0] {
+				endpoint = &proxyConfig.Endpoints[i]
+			}
+		}
+		if endpoint == nil {
+			return fmt.Errorf("no endpoint named '%s' in the config", args[0])
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		login, err := proxy.StartDeviceLogin(ctx, *endpoint)
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		if login.VerificationURIComplete != "" {
+			fmt.Fprintf(out, "Open %s\nand confirm the code %s to sign in.\n", login.VerificationURIComplete, login.UserCode)
+		} else {
+			fmt.Fprintf(out, "Open %s\nand enter the code %s to sign in.\n", login.VerificationURI, login.UserCode)
+		}
+		fmt.Fprintf(out, "Waiting for approval (the code expires at %s)...\n", login.ExpiresAt.Format("15:04:05"))
+
+		ref, err := login.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Signed in; stored the refresh token for %s at %s\n", endpoint.Name, ref)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(loginCmd)
+}
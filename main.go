@@ -1,135 +1,36 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/mwitkow/grpc-proxy/proxy"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/keepalive"
-	"google.golang.org/grpc/metadata"
-)
-
-// Config represents the configuration for a single endpoint
-type Config struct {
-	Name          string `mapstructure:"name"`
-	LocalPort     int    `mapstructure:"local_port"`
-	RemoteAddress string `mapstructure:"remote_address"`
-	UseTLS        bool   `mapstructure:"use_tls"`
-	JWTToken      string `mapstructure:"jwt_token"`
-}
-
-// ProxyConfig represents the entire proxy configuration
-type ProxyConfig struct {
-	Endpoints []Config `mapstructure:"endpoints"`
-}
-
-// ProxyServer represents a single proxy server instance
-type ProxyServer struct {
-	config   Config
-	server   *grpc.Server
-	upstream *grpc.ClientConn
-	listener net.Listener
-}
-
-// NewProxyServer creates a new proxy server with the specified configuration
-func NewProxyServer(config Config) (*ProxyServer, error) {
-	// Create upstream connection with keep alive parameters
-	var opts []grpc.DialOption
-
-	// Add keep alive parameters as recommended
-	keepAliveParams := keepalive.ClientParameters{
-		Time:                10 * time.Second, // send pings every 10 seconds if there is no activity
-		Timeout:             time.Second,      // wait 1 second for ping ack before considering the connection dead
-		PermitWithoutStream: true,             // send pings even without active streams
-	}
-	opts = append(opts, grpc.WithKeepaliveParams(keepAliveParams))
-
-	// Configure TLS or insecure credentials
-	if config.UseTLS {
-		tlsConfig := &tls.Config{
-			MinVersion:         tls.VersionTLS12,
-			ClientSessionCache: tls.NewLRUClientSessionCache(1024),
-		}
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
-	} else {
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	}
-
-	conn, err := grpc.NewClient(config.RemoteAddress, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to upstream: %v", err)
-	}
-
-	return &ProxyServer{
-		config:   config,
-		upstream: conn,
-	}, nil
-}
-
-// director function that handles JWT authentication forwarding
-func (p *ProxyServer) director(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
-	// Get incoming metadata
-	inMD, _ := metadata.FromIncomingContext(ctx)
-
-	// Copy incoming metadata and add/override authorization header with JWT token
-	outMD := inMD.Copy()
-	outMD.Set("authorization", fmt.Sprintf("Bearer %s", p.config.JWTToken))
-
-	// Create outgoing context with modified metadata
-	ctx = metadata.NewOutgoingContext(ctx, outMD)
-
-	return ctx, p.upstream, nil
-}
-
-// Start starts the proxy server
-func (p *ProxyServer) Start() error {
-	var err error
-	p.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", p.config.LocalPort))
-	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %v", p.config.LocalPort, err)
-	}
-
-	log.Printf("Starting gRPC proxy for %s on port %d -> %s",
-		p.config.Name, p.config.LocalPort, p.config.RemoteAddress)
 
-	// Create gRPC server with the mwitkow proxy handler
-	p.server = grpc.NewServer(
-		grpc.UnknownServiceHandler(proxy.TransparentHandler(p.director)),
-	)
-
-	return p.server.Serve(p.listener)
-}
-
-// Stop gracefully stops the proxy server
-func (p *ProxyServer) Stop() {
-	if p.server != nil {
-		log.Printf("Stopping proxy server for %s", p.config.Name)
-		p.server.GracefulStop()
-	}
-	if p.upstream != nil {
-		p.upstream.Close()
-	}
-	if p.listener != nil {
-		p.listener.Close()
-	}
-}
+	"grpc-auth-proxy/pkg/proxy"
+)
 
 var (
 	cfgFile     string
-	proxyConfig *ProxyConfig
+	watchConfig time.Duration
+	proxyConfig *proxy.ProxyConfig
+
+	// onlyEndpoints and excludeEndpoints select, by name or group, the
+	// endpoints this host serves
+	onlyEndpoints    []string
+	excludeEndpoints []string
+
+	// logOutput is the configured log output, closed when a reload replaces it
+	logOutput io.WriteCloser
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -142,6 +43,14 @@ while automatically injecting JWT authentication tokens.
 The proxy supports multiple endpoints, each with their own configuration
 including different JWT tokens, TLS settings, and port mappings.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		setPodLogPrefix()
+		initConfig()
+		if err := setupLogging(proxyConfig.Log); err != nil {
+			log.Fatalf("Error setting up logging: %v", err)
+		}
+		if err := applyRuntime(proxyConfig.Runtime); err != nil {
+			log.Fatalf("Error applying runtime limits: %v", err)
+		}
 		startProxy()
 	},
 }
@@ -155,10 +64,17 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
+	// Scrub tokens and API keys from every log line, including upstream error strings
+	log.SetOutput(proxy.NewRedactingWriter(os.Stderr))
 
 	// Define flags
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./config.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file in YAML, TOML or JSON, by extension (default is ./config.yaml, .yml, .toml or .json)")
+	rootCmd.PersistentFlags().StringVar(&configDir, "config-dir", "", "directory of YAML, TOML or JSON files merged over the config file in name order, e.g. /etc/grpc-proxy/conf.d")
+	rootCmd.PersistentFlags().StringVar(&remoteConfig, "remote-config", "", "read the config from a Consul or etcd key instead of a file and reload when it changes, e.g. consul://127.0.0.1:8500/grpc-proxy/config.yaml")
+	rootCmd.PersistentFlags().BoolVar(&kubernetesEndpoints, "kubernetes-endpoints", false, "also load endpoints from the ChandraProxyEndpoint resources of the pod's namespace and reload when they change")
+	rootCmd.PersistentFlags().StringSliceVar(&onlyEndpoints, "only", nil, "serve only these endpoints and groups, e.g. cosmos,osmosis")
+	rootCmd.PersistentFlags().StringSliceVar(&excludeEndpoints, "exclude", nil, "skip these endpoints and groups, e.g. juno")
+	rootCmd.Flags().DurationVar(&watchConfig, "watch-config", 0, "reload when the config file changes, checking at this interval (e.g. 5s for a mounted ConfigMap)")
 
 	// Bind flags to viper
 	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
@@ -166,22 +82,39 @@ func init() {
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
+	if remoteConfig != "" {
+		if cfgFile != "" {
+			log.Fatalf("--config and --remote-config cannot be used together")
+		}
+		source, err := proxy.NewRemoteConfigSource(remoteConfig)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		remoteSource = source
+	} else if cfgFile != "" {
+		// Use config file from the flag; its extension selects the format.
 		viper.SetConfigFile(cfgFile)
+	} else if path := defaultConfigFile(); path != "" {
+		viper.SetConfigFile(path)
 	} else {
-		// Search for config in current directory with name "config" (without extension).
+		// Let viper report the missing config file
 		viper.AddConfigPath(".")
 		viper.SetConfigType("yaml")
 		viper.SetConfigName("config")
 	}
 
+	if kubernetesEndpoints {
+		source, err := proxy.NewKubernetesEndpointSource(proxy.KubernetesSourceConfig{})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		kubernetesSource = source
+	}
+
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		log.Printf("Using config file: %s", viper.ConfigFileUsed())
-	} else {
+	if err := readConfig(); err != nil {
 		log.Fatalf("Error reading config file: %v", err)
 	}
 
@@ -189,71 +122,241 @@ func initConfig() {
 	if err := viper.Unmarshal(&proxyConfig); err != nil {
 		log.Fatalf("Error unmarshaling config: %v", err)
 	}
+	if err := selectEndpoints(proxyConfig); err != nil {
+		log.Fatalf("%v", err)
+	}
 }
 
-// startProxy starts all configured proxy servers
-func startProxy() {
-	if len(proxyConfig.Endpoints) == 0 {
-		log.Fatalf("No endpoints configured")
+// selectEndpoints keeps the endpoints chosen by --only and --exclude, and
+// warns about names and groups that match no endpoint
+func selectEndpoints(config *proxy.ProxyConfig) error {
+	if len(onlyEndpoints) == 0 && len(excludeEndpoints) == 0 {
+		return nil
 	}
+	selected, unmatched, err := proxy.SelectEndpoints(config.Endpoints, onlyEndpoints, excludeEndpoints)
+	if err != nil {
+		return err
+	}
+	for _, name := range unmatched {
+		log.Printf("Warning: no endpoint or group named %s", name)
+	}
+	if skipped := len(config.Endpoints) - len(selected); skipped > 0 {
+		log.Printf("Skipping %d of %d endpoints not selected on this host", skipped, len(config.Endpoints))
+	}
+	config.Endpoints = selected
+	return nil
+}
 
-	log.Printf("Loaded configuration with %d endpoints", len(proxyConfig.Endpoints))
-
-	var wg sync.WaitGroup
-	var servers []*ProxyServer
+// defaultConfigFiles are looked for in the current directory, in this order,
+// when --config is not given
+var defaultConfigFiles = []string{"config.yaml", "config.yml", "config.toml", "config.json"}
+
+// defaultConfigFile returns the absolute path of the first default config
+// file that exists, or ""
+func defaultConfigFile() string {
+	for _, name := range defaultConfigFiles {
+		if _, err := os.Stat(name); err == nil {
+			if path, err := filepath.Abs(name); err == nil {
+				return path
+			}
+			return name
+		}
+	}
+	return ""
+}
 
-	// Create and start all proxy servers
-	for _, endpoint := range proxyConfig.Endpoints {
-		// Validate endpoint configuration
-		if endpoint.JWTToken == "" ||
-			endpoint.JWTToken == "your_cosmos_jwt_token_here" ||
-			endpoint.JWTToken == "your_osmosis_jwt_token_here" {
-			log.Fatalf("Please set a valid JWT token for endpoint '%s'", endpoint.Name)
+// readConfig reads the config file or the remote config, merges the files
+// of --config-dir, the ChandraProxyEndpoint resources and the endpoints
+// defined by environment variables over it, and expands variables in the
+// endpoints. With --config-dir, --kubernetes-endpoints or endpoints in the
+// environment, the default ./config.yaml is optional.
+func readConfig() error {
+	if remoteSource != nil {
+		if err := readRemoteConfig(); err != nil {
+			return err
 		}
+		log.Printf("Using remote config: %s", remoteSource)
+		return mergeConfig()
+	}
+
+	err := viper.ReadInConfig()
+	if _, notFound := err.(viper.ConfigFileNotFoundError); notFound && (configDir != "" || kubernetesSource != nil || proxy.HasEnvEndpoints(os.Environ())) {
+		// Start from an empty config, also dropping what a previous read left
+		viper.SetConfigType("yaml")
+		err = viper.ReadConfig(strings.NewReader(""))
+	} else if err == nil {
+		log.Printf("Using config file: %s", viper.ConfigFileUsed())
+	}
+	if err != nil {
+		return err
+	}
+	return mergeConfig()
+}
 
-		proxy, err := NewProxyServer(endpoint)
+// mergeConfig merges the files of --config-dir, the ChandraProxyEndpoint
+// resources and the endpoints defined by environment variables over the
+// config viper has read, and expands variables in the endpoints
+func mergeConfig() error {
+	if configDir != "" {
+		if err := mergeConfigDir(configDir); err != nil {
+			return err
+		}
+	}
+	settings := viper.AllSettings()
+	if kubernetesSource != nil {
+		endpoints, err := readKubernetesEndpoints()
 		if err != nil {
-			log.Fatalf("Failed to create proxy server %s: %v", endpoint.Name, err)
+			return err
 		}
-		servers = append(servers, proxy)
+		proxy.MergeEndpoints(settings, endpoints)
+	}
+	if err := proxy.MergeEnvEndpoints(settings, os.Environ()); err != nil {
+		return err
+	}
+	if err := proxy.ExpandVars(settings); err != nil {
+		return err
+	}
+	if settings["endpoints"] == nil {
+		return nil
+	}
+	return viper.MergeConfigMap(map[string]interface{}{"endpoints": settings["endpoints"]})
+}
 
-		wg.Add(1)
-		go func(p *ProxyServer) {
-			defer wg.Done()
-			if err := p.Start(); err != nil {
-				log.Printf("Proxy server %s error: %v", p.config.Name, err)
-			}
-		}(proxy)
+// startProxy starts all configured proxy servers and runs until a shutdown
+// signal, or until an endpoint cannot be restarted with exit_on_failure set
+func startProxy() {
+	log.Printf("Loaded configuration with %d endpoints", len(proxyConfig.Endpoints))
+
+	manager := proxy.NewManager(proxyConfig)
+	if err := manager.Start(); err != nil {
+		log.Fatalf("%v", err)
 	}
 
 	log.Println("All proxy servers started")
 
-	// Set up signal handling for graceful shutdown
+	// Start has bound every listener and checked the upstreams, so the service is ready
+	sdNotify(fmt.Sprintf("READY=1\nSTATUS=Serving %d endpoints", len(manager.Servers())))
+	stopWatchdog := make(chan struct{})
+	go sdWatchdog(stopWatchdog)
+	defer close(stopWatchdog)
+
+	// Set up signal handling for graceful shutdown and configuration reload
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if watchConfig > 0 {
+		go watchConfigFiles(watchConfig, sigChan)
+	}
+	if remoteSource != nil {
+		go watchRemoteConfig(sigChan)
+	}
+	if kubernetesSource != nil {
+		go watchKubernetesEndpoints(sigChan)
+	}
 
-	// Wait for shutdown signal
-	<-sigChan
-	log.Println("Received shutdown signal, stopping all servers...")
+	var failed error
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				reloadConfig(manager)
+				continue
+			}
+			log.Println("Received shutdown signal, stopping all servers...")
+			break wait
+		case failed = <-manager.Failed():
+			log.Printf("%v, stopping all servers because supervision.exit_on_failure is set", failed)
+			break wait
+		}
+	}
+	sdNotify("STOPPING=1")
 
-	// Stop all servers gracefully
-	for _, server := range servers {
-		go server.Stop()
+	shutdownTimeout := manager.ShutdownTimeout()
+	if err := manager.Stop(); err != nil {
+		log.Printf("Shutdown timeout of %s reached, remaining streams were cancelled", shutdownTimeout)
+	} else {
+		log.Println("All servers stopped gracefully")
+	}
+	if failed != nil {
+		os.Exit(1)
 	}
+}
 
-	// Give servers time to shutdown gracefully
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+// reloadConfig re-reads the config file and applies it to the running endpoints
+func reloadConfig(manager *proxy.Manager) {
+	log.Println("Received SIGHUP, reloading configuration...")
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
 
-	select {
-	case <-done:
-		log.Println("All servers stopped gracefully")
-	case <-time.After(30 * time.Second):
-		log.Println("Timeout waiting for servers to stop, forcing exit")
+	if err := readConfig(); err != nil {
+		log.Printf("Error reading config file, keeping current configuration: %v", err)
+		return
+	}
+	var config proxy.ProxyConfig
+	if err := viper.Unmarshal(&config); err != nil {
+		log.Printf("Error unmarshaling config, keeping current configuration: %v", err)
+		return
+	}
+	if err := selectEndpoints(&config); err != nil {
+		log.Printf("Error selecting endpoints, keeping current configuration: %v", err)
+		return
+	}
+	err := manager.Reload(&config)
+	var partial *proxy.PartialReloadError
+	if err != nil && !errors.As(err, &partial) {
+		log.Printf("Error applying config, keeping current configuration: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(config.Log, proxyConfig.Log) {
+		if err := setupLogging(config.Log); err != nil {
+			log.Printf("Error switching log output, keeping the current one: %v", err)
+			config.Log = proxyConfig.Log
+		}
+	}
+	if !reflect.DeepEqual(config.Runtime, proxyConfig.Runtime) {
+		if err := applyRuntime(config.Runtime); err != nil {
+			log.Printf("Error applying runtime limits, keeping the current ones: %v", err)
+			config.Runtime = proxyConfig.Runtime
+		}
+	}
+	proxyConfig = &config
+	if partial != nil {
+		log.Printf("Configuration reloaded with %d endpoints, but some did not start: %v", len(config.Endpoints), partial)
+		return
+	}
+	log.Printf("Configuration reloaded with %d endpoints", len(config.Endpoints))
+}
+
+// setupLogging sends the log to the configured output, still redacted, and
+// closes the output it replaces
+func setupLogging(config *proxy.LogConfig) error {
+	w, err := proxy.OpenLog(config)
+	if err != nil {
+		return err
+	}
+	// Syslog and the journal stamp entries themselves
+	flags := log.LstdFlags
+	if config.Timestamped() {
+		flags = 0
+	}
+	log.SetFlags(flags)
+	log.SetOutput(proxy.NewRedactingWriter(w))
+	if logOutput != nil {
+		logOutput.Close()
+	}
+	logOutput = w
+	return nil
+}
+
+// applyRuntime sets GOMAXPROCS and the memory limit from the config and
+// the container's limits
+func applyRuntime(config *proxy.RuntimeConfig) error {
+	limits, err := proxy.ApplyRuntime(config)
+	if err != nil {
+		return err
 	}
+	log.Printf("Running with %s", limits)
+	return nil
 }
 
 func main() {
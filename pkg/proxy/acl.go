@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cidrACL decides which client networks may connect to an endpoint
+type cidrACL struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// newCIDRACL parses allowed_cidrs and denied_cidrs; bare IPs are accepted as
+// single-address networks. It returns nil when neither list is set.
+func newCIDRACL(allowed, denied []string) (*cidrACL, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	acl := &cidrACL{}
+	var err error
+	if acl.allowed, err = parseCIDRs(allowed); err != nil {
+		return nil, fmt.Errorf("invalid allowed_cidrs: %v", err)
+	}
+	if acl.denied, err = parseCIDRs(denied); err != nil {
+		return nil, fmt.Errorf("invalid denied_cidrs: %v", err)
+	}
+	return acl, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// permits reports whether ip may connect. Denied networks take precedence;
+// when allowed networks are set the IP must be in one of them.
+func (a *cidrACL) permits(ip net.IP) bool {
+	for _, n := range a.denied {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allowed) == 0 {
+		return true
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclListener closes accepted connections from networks the ACL does not permit
+type aclListener struct {
+	net.Listener
+	acl     *cidrACL
+	metrics *expvar.Map
+}
+
+// Accept returns the next permitted connection. Unix socket connections are
+// always permitted; file permissions control who can reach them.
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if ok && !l.acl.permits(addr.IP) {
+			l.metrics.Add("connections_denied", 1)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
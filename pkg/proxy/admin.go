@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	channelz "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/adminpb"
+)
+
+// AdminConfig configures the management listener serving the ProxyAdmin
+// and channelz services, server reflection and the status page
+type AdminConfig struct {
+	BindAddress string `mapstructure:"bind_address"`
+	LocalPort   int    `mapstructure:"local_port"`
+
+	// ListenAddress overrides bind_address/local_port, e.g. "unix:///run/grpc-proxy/admin.sock"
+	ListenAddress string `mapstructure:"listen_address"`
+
+	// Debug also serves net/http/pprof profiles under /debug/pprof/ and the
+	// expvar metrics at /debug/vars
+	Debug bool `mapstructure:"debug"`
+}
+
+// Address returns the address the admin listener binds to
+func (c AdminConfig) Address() string {
+	if c.ListenAddress != "" {
+		return c.ListenAddress
+	}
+	return listenAddress(c.BindAddress, c.LocalPort)
+}
+
+// adminServer implements adminpb.ProxyAdminServer on top of a Manager
+type adminServer struct {
+	adminpb.UnimplementedProxyAdminServer
+	manager *Manager
+}
+
+// RegisterAdmin registers the ProxyAdmin service for m on s. It is used by
+// the admin listener and lets library users mount the service on their own server.
+func (m *Manager) RegisterAdmin(s grpc.ServiceRegistrar) {
+	adminpb.RegisterProxyAdminServer(s, &adminServer{manager: m})
+}
+
+// startAdmin binds the admin listener and serves it in the background. Callers must hold m.mu.
+func (m *Manager) startAdmin(config *AdminConfig) error {
+	addr := config.Address()
+	lis, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address %s: %v", addr, err)
+	}
+
+	m.admin = grpc.NewServer(grpc.ChainUnaryInterceptor(m.auditInterceptor))
+	m.RegisterAdmin(m.admin)
+	reflection.Register(m.admin)
+	channelz.RegisterChannelzServiceToServer(m.admin)
+	m.adminHTTP = &http.Server{Handler: m.adminHandler(config.Debug), ReadHeaderTimeout: 10 * time.Second}
+
+	log.Printf("Starting admin service and status page on %s", addr)
+	if config.Debug {
+		if !isLocalAddress(addr) {
+			log.Printf("Warning: debug endpoints are enabled on %s, which is not a loopback address; profiles can reveal tokens held in memory", addr)
+		}
+		log.Printf("Serving pprof and expvar under http://%s/debug/", addr)
+	}
+
+	grpcLis, httpLis := splitAdminListener(lis)
+	go func(s *grpc.Server) {
+		if err := s.Serve(grpcLis); err != nil {
+			log.Printf("Admin service error: %v", err)
+		}
+	}(m.admin)
+	go func(s *http.Server) {
+		if err := s.Serve(httpLis); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Status page error: %v", err)
+		}
+	}(m.adminHTTP)
+	return nil
+}
+
+// stopAdmin stops the admin server if it is running. Callers must hold m.mu.
+func (m *Manager) stopAdmin() {
+	if m.admin != nil {
+		m.admin.Stop()
+		m.adminHTTP.Close()
+		m.admin = nil
+		m.adminHTTP = nil
+	}
+}
+
+// endpointInfo describes a running endpoint
+func endpointInfo(p *ProxyServer) *adminpb.Endpoint {
+	config := p.Config()
+	return &adminpb.Endpoint{
+		Name:          config.Name,
+		ListenAddress: config.Address(),
+		RemoteAddress: config.RemoteAddress,
+		UseTls:        config.UseTLS,
+	}
+}
+
+// server looks up a running endpoint, returning NOT_FOUND if there is none
+func (a *adminServer) server(name string) (*ProxyServer, error) {
+	p, ok := a.manager.Server(name)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no running endpoint named %q", name)
+	}
+	return p, nil
+}
+
+// ListEndpoints returns every running endpoint
+func (a *adminServer) ListEndpoints(ctx context.Context, req *adminpb.ListEndpointsRequest) (*adminpb.ListEndpointsResponse, error) {
+	resp := &adminpb.ListEndpointsResponse{}
+	for _, p := range a.manager.Servers() {
+		resp.Endpoints = append(resp.Endpoints, endpointInfo(p))
+	}
+	return resp, nil
+}
+
+// GetEndpointStatus reports the serving state and call counters of an endpoint
+func (a *adminServer) GetEndpointStatus(ctx context.Context, req *adminpb.GetEndpointStatusRequest) (*adminpb.EndpointStatus, error) {
+	p, err := a.server(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	total, failed := p.Calls()
+	return &adminpb.EndpointStatus{
+		Endpoint:      endpointInfo(p),
+		ServingStatus: p.ServingStatus().String(),
+		UpstreamState: p.UpstreamState().String(),
+		ActiveStreams: p.ActiveStreams(),
+		CallsTotal:    total,
+		CallsFailed:   failed,
+		Maintenance:   p.InMaintenance(),
+	}, nil
+}
+
+// UpdateToken swaps the JWT of a running endpoint without restarting it
+func (a *adminServer) UpdateToken(ctx context.Context, req *adminpb.UpdateTokenRequest) (*adminpb.UpdateTokenResponse, error) {
+	p, err := a.server(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := (Config{Name: p.Name(), JWTToken: req.JwtToken}).Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	p.rotateToken(req.JwtToken, a.manager.rpcActor(ctx))
+	return &adminpb.UpdateTokenResponse{}, nil
+}
+
+// Drain stops an endpoint once its active streams finish or the timeout expires
+func (a *adminServer) Drain(ctx context.Context, req *adminpb.DrainRequest) (*adminpb.DrainResponse, error) {
+	timeout := a.manager.ShutdownTimeout()
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	remaining, err := a.manager.Drain(ctx, req.Name)
+	if err != nil && remaining == 0 {
+		return nil, err
+	}
+	return &adminpb.DrainResponse{RemainingStreams: remaining}, nil
+}
+
+// SetMaintenance turns maintenance mode of an endpoint on or off
+func (a *adminServer) SetMaintenance(ctx context.Context, req *adminpb.SetMaintenanceRequest) (*adminpb.SetMaintenanceResponse, error) {
+	p, err := a.server(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	p.SetMaintenance(req.Enabled, time.Duration(req.RetryAfterSeconds)*time.Second, req.Message)
+	return &adminpb.SetMaintenanceResponse{ActiveStreams: p.ActiveStreams()}, nil
+}
+
+// isLocalAddress reports whether a listen address only accepts local
+// connections: a unix socket or a loopback host
+func isLocalAddress(addr string) bool {
+	if strings.HasPrefix(addr, unixScheme) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const defaultAffinityTTL = 10 * time.Minute
+
+// AffinityConfig spreads calls over every address of the endpoint's
+// upstream, like outlier_detection, but keeps the calls of one client on
+// the same address so stateful query sequences see a consistent node
+type AffinityConfig struct {
+	// Key identifies a client: "connection" (default) for one connection
+	// to the proxy, or "peer_ip" for all connections from one address
+	Key string `mapstructure:"key"`
+
+	// Metadata optionally names a header, e.g. x-session-id, whose value
+	// identifies the client instead. Calls without it fall back to Key.
+	Metadata string `mapstructure:"metadata"`
+
+	// TTL is how long an idle client stays bound to its address (default 10m)
+	TTL time.Duration `mapstructure:"ttl"`
+
+	// PinHeight, with Metadata, also pins a session to the block height its
+	// first call was served at, so later calls without their own
+	// x-cosmos-block-height query the same snapshot and share cached
+	// responses
+	PinHeight bool `mapstructure:"pin_height"`
+}
+
+// validate checks the key and the TTL
+func (c *AffinityConfig) validate() error {
+	switch c.Key {
+	case "", "connection", "peer_ip":
+	default:
+		return fmt.Errorf("affinity key must be connection or peer_ip, not %q", c.Key)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("affinity ttl must not be negative")
+	}
+	if c.PinHeight && c.Metadata == "" {
+		return fmt.Errorf("affinity pin_height requires metadata")
+	}
+	return nil
+}
+
+// ttl returns the configured TTL or the default
+func (c *AffinityConfig) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return defaultAffinityTTL
+}
+
+// key returns the affinity key of a call, or "" if the client cannot be
+// identified
+func (c *AffinityConfig) key(ctx context.Context, md metadata.MD) string {
+	if key := c.sessionKey(md); key != "" {
+		return key
+	}
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.Addr == nil {
+		return ""
+	}
+	addr := pr.Addr.String()
+	if c.Key == "peer_ip" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		return "ip:" + addr
+	}
+	return "conn:" + addr
+}
+
+// sessionKey returns the affinity key of a call that names its session in
+// the Metadata header, or ""
+func (c *AffinityConfig) sessionKey(md metadata.MD) string {
+	if c.Metadata == "" {
+		return ""
+	}
+	if values := md.Get(c.Metadata); len(values) > 0 && values[0] != "" {
+		return "metadata:" + values[0]
+	}
+	return ""
+}
+
+// affinityCallKey is the context key the director stores a call's affinity
+// key under for the picker
+type affinityCallKey struct{}
+
+// affinityBinding is the address a client is bound to, and with pin_height
+// the block height its session queries
+type affinityBinding struct {
+	addr    string
+	expires time.Time
+	height  int64
+}
+
+// affinityTable binds clients to upstream addresses. The picker looks a
+// call's client up in it and binds new clients to the address it picks.
+type affinityTable struct {
+	id      string
+	ttl     time.Duration
+	metrics *expvar.Map
+
+	mu       sync.Mutex
+	bindings map[string]*affinityBinding
+}
+
+// affinityTables lets the balancer of a connection find its endpoint's
+// table, named in the connection's service config
+var (
+	affinityTables   sync.Map
+	affinityTableIDs atomic.Int64
+)
+
+// newAffinityTable registers an empty table for an endpoint
+func newAffinityTable(config *AffinityConfig, name string) *affinityTable {
+	t := &affinityTable{
+		id:       strconv.FormatInt(affinityTableIDs.Add(1), 10),
+		ttl:      config.ttl(),
+		metrics:  endpointMetrics(name),
+		bindings: make(map[string]*affinityBinding),
+	}
+	t.metrics.Set("affinity_sessions", intVar(0))
+	affinityTables.Store(t.id, t)
+	return t
+}
+
+// close unregisters the table
+func (t *affinityTable) close() {
+	affinityTables.Delete(t.id)
+}
+
+// lookup returns the address key is bound to, or "", and keeps the binding
+// alive for another TTL
+func (t *affinityTable) lookup(key string, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bindings[key]
+	if b == nil || now.After(b.expires) {
+		return ""
+	}
+	b.expires = now.Add(t.ttl)
+	return b.addr
+}
+
+// bind binds key to addr. Moving a live binding to another address, because
+// its address went away or was ejected, counts as a rebind.
+func (t *affinityTable) bind(key, addr string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	binding := &affinityBinding{addr: addr, expires: now.Add(t.ttl)}
+	if b := t.bindings[key]; b != nil && !now.After(b.expires) {
+		if b.addr != addr {
+			t.metrics.Add("affinity_rebinds", 1)
+		}
+		binding.height = b.height
+	}
+	t.bindings[key] = binding
+	t.metrics.Set("affinity_sessions", intVar(int64(len(t.bindings))))
+}
+
+// height returns the block height key's session is pinned to, or 0
+func (t *affinityTable) height(key string, now time.Time) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.bindings[key]; b != nil && !now.After(b.expires) {
+		return b.height
+	}
+	return 0
+}
+
+// pinHeight pins key's session to height unless it is already pinned. The
+// session must be bound, which its first call through the picker does.
+func (t *affinityTable) pinHeight(key string, height int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.bindings[key]; b != nil && !now.After(b.expires) && b.height == 0 {
+		b.height = height
+		t.metrics.Add("affinity_height_pins", 1)
+	}
+}
+
+// expire drops the bindings of clients idle for longer than the TTL
+func (t *affinityTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, b := range t.bindings {
+		if now.After(b.expires) {
+			delete(t.bindings, key)
+		}
+	}
+	t.metrics.Set("affinity_sessions", intVar(int64(len(t.bindings))))
+}
+
+// watchAffinity expires idle bindings every TTL
+func (p *ProxyServer) watchAffinity() {
+	ticker := time.NewTicker(p.affinity.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case now := <-ticker.C:
+			p.affinity.expire(now)
+		}
+	}
+}
+
+// sessionHeightInterceptor queries the block height a session is pinned to
+// when a call does not ask for its own, and pins new sessions to the height
+// their first call is served at
+func (p *ProxyServer) sessionHeightInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.affinity == nil || !p.config.Affinity.PinHeight || p.isLocalService(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	key := p.config.Affinity.sessionKey(md)
+	if key == "" || headerValue(md, blockHeightHeader) != "" {
+		return handler(srv, ss)
+	}
+
+	if height := p.affinity.height(key, time.Now()); height > 0 {
+		md = md.Copy()
+		md.Set(blockHeightHeader, strconv.FormatInt(height, 10))
+		return handler(srv, &sessionHeightStream{ServerStream: ss, ctx: metadata.NewIncomingContext(ss.Context(), md)})
+	}
+
+	// A response without a height header was served at about the latest
+	// known block
+	latest := p.latestHeight.Load()
+	stream := &sessionHeightStream{ServerStream: ss, ctx: ss.Context()}
+	err := handler(srv, stream)
+	if err == nil {
+		served := stream.served
+		if served == 0 {
+			served = latest
+		}
+		if served > 0 {
+			p.affinity.pinHeight(key, served, time.Now())
+		}
+	}
+	return err
+}
+
+// sessionHeightStream gives the rest of the chain the session's height and
+// records the height the upstream served the call at
+type sessionHeightStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	served int64
+}
+
+func (s *sessionHeightStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *sessionHeightStream) SendHeader(md metadata.MD) error {
+	if height, err := strconv.ParseInt(headerValue(md, blockHeightHeader), 10, 64); err == nil {
+		s.served = height
+	}
+	return s.ServerStream.SendHeader(md)
+}
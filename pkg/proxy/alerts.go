@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Alert events
+const (
+	// AlertEndpointDown is sent when an endpoint's upstream connection fails,
+	// and AlertEndpointUp when it is ready again
+	AlertEndpointDown = "endpoint_down"
+	AlertEndpointUp   = "endpoint_up"
+
+	// AlertEndpointStale is sent when freshness checks find the upstreams
+	// behind and the endpoint starts reporting NOT_SERVING
+	AlertEndpointStale = "endpoint_stale"
+
+	// AlertChainIDMismatch is sent when an upstream serves an unexpected
+	// chain and the endpoint starts rejecting calls
+	AlertChainIDMismatch = "chain_id_mismatch"
+
+	// AlertTokenExpiring is sent once per token when an endpoint's JWT
+	// expires within token_expiry
+	AlertTokenExpiring = "token_expiring"
+
+	// AlertReloadFailed is sent when a configuration reload is rejected
+	AlertReloadFailed = "reload_failed"
+
+	// AlertSLOBurn is sent when an SLO burns its error budget too fast
+	AlertSLOBurn = "slo_burn"
+
+	// AlertUpstreamTier is sent when an endpoint falls back to a lower
+	// upstream tier or returns to a higher one
+	AlertUpstreamTier = "upstream_tier"
+
+	// AlertEndpointCrashed is sent when an endpoint's listener stops
+	// serving, and again if it cannot be restarted
+	AlertEndpointCrashed = "endpoint_crashed"
+)
+
+const (
+	defaultAlertTimeout     = 5 * time.Second
+	defaultAlertRetries     = 3
+	defaultAlertRetryDelay  = time.Second
+	defaultAlertTokenExpiry = 72 * time.Hour
+
+	// tokenExpiryCheckInterval is how often endpoint tokens are checked
+	tokenExpiryCheckInterval = time.Hour
+)
+
+// AlertsConfig posts alerts about failing upstreams, expiring tokens and
+// rejected reloads to webhooks
+type AlertsConfig struct {
+	Webhooks []WebhookConfig `mapstructure:"webhooks"`
+
+	// Timeout bounds each delivery attempt (default 5s)
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// Retries is how often a failed delivery is retried (default 3), waiting
+	// RetryDelay (default 1s) before the first retry and doubling it after each
+	Retries    int           `mapstructure:"retries"`
+	RetryDelay time.Duration `mapstructure:"retry_delay"`
+
+	// TokenExpiry alerts when an endpoint's JWT expires within this long
+	// (default 72h)
+	TokenExpiry time.Duration `mapstructure:"token_expiry"`
+}
+
+// WebhookConfig is one URL alerts are posted to
+type WebhookConfig struct {
+	URL string `mapstructure:"url"`
+
+	// Headers are added to every request, e.g. an Authorization header
+	Headers map[string]string `mapstructure:"headers"`
+
+	// Events limits the webhook to these events; empty sends all of them
+	Events []string `mapstructure:"events"`
+
+	// Type is "slack" or "discord" to post a chat message instead of the
+	// Alert JSON, rendered from Template
+	Type     string `mapstructure:"type"`
+	Template string `mapstructure:"template"`
+
+	// Channel and Username override the webhook's defaults where the
+	// service allows it; Discord ignores Channel
+	Channel  string `mapstructure:"channel"`
+	Username string `mapstructure:"username"`
+}
+
+// timeout returns the configured timeout or the default
+func (c *AlertsConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultAlertTimeout
+}
+
+// retries returns the configured number of retries or the default
+func (c *AlertsConfig) retries() int {
+	if c.Retries > 0 {
+		return c.Retries
+	}
+	return defaultAlertRetries
+}
+
+// retryDelay returns the configured first retry delay or the default
+func (c *AlertsConfig) retryDelay() time.Duration {
+	if c.RetryDelay > 0 {
+		return c.RetryDelay
+	}
+	return defaultAlertRetryDelay
+}
+
+// tokenExpiry returns the configured warning window or the default
+func (c *AlertsConfig) tokenExpiry() time.Duration {
+	if c.TokenExpiry > 0 {
+		return c.TokenExpiry
+	}
+	return defaultAlertTokenExpiry
+}
+
+// validate checks every webhook has an http(s) URL and known events
+func (c *AlertsConfig) validate() error {
+	if len(c.Webhooks) == 0 {
+		return fmt.Errorf("alerts require at least one webhook")
+	}
+	known := []string{AlertEndpointDown, AlertEndpointUp, AlertEndpointStale, AlertChainIDMismatch, AlertTokenExpiring, AlertReloadFailed, AlertSLOBurn, AlertUpstreamTier, AlertEndpointCrashed}
+	for _, w := range c.Webhooks {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid alert webhook url '%s'", w.URL)
+		}
+		for _, event := range w.Events {
+			if !slices.Contains(known, event) {
+				return fmt.Errorf("unknown alert event '%s'", event)
+			}
+		}
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Alert is the JSON body posted to webhooks
+type Alert struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// alerter delivers alerts to the configured webhooks in the background. One
+// alerter is shared by a Manager and its endpoints; until it is configured,
+// and on a nil *alerter, alerts are dropped.
+type alerter struct {
+	config atomic.Pointer[AlertsConfig]
+	client http.Client
+
+	// pending tracks deliveries; stop ends their retries on Close
+	pending  sync.WaitGroup
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newAlerter returns an alerter with no webhooks
+func newAlerter() *alerter {
+	return &alerter{stop: make(chan struct{})}
+}
+
+// configure validates and applies config; nil disables alerts
+func (a *alerter) configure(config *AlertsConfig) error {
+	if config != nil {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		for _, w := range config.Webhooks {
+			for _, v := range w.Headers {
+				knownSecrets.add(v)
+			}
+		}
+	}
+	a.config.Store(config)
+	return nil
+}
+
+// enabled reports whether any webhook is configured
+func (a *alerter) enabled() bool {
+	return a != nil && a.config.Load() != nil
+}
+
+// send posts an alert to every webhook subscribed to event
+func (a *alerter) send(event, endpoint, format string, args ...interface{}) {
+	if !a.enabled() {
+		return
+	}
+	config := a.config.Load()
+	alert := Alert{Time: time.Now().UTC(), Event: event, Endpoint: endpoint, Message: redactSecrets(fmt.Sprintf(format, args...))}
+	for _, w := range config.Webhooks {
+		if len(w.Events) > 0 && !slices.Contains(w.Events, event) {
+			continue
+		}
+		body, err := w.payload(alert)
+		if err != nil {
+			log.Printf("Failed to encode %s alert for %s: %v", event, redactURL(w.URL), err)
+			continue
+		}
+		a.pending.Add(1)
+		go func(w WebhookConfig, body []byte) {
+			defer a.pending.Done()
+			a.deliver(config, w, event, body)
+		}(w, body)
+	}
+}
+
+// deliver posts body to w, retrying failures with exponential backoff
+func (a *alerter) deliver(config *AlertsConfig, w WebhookConfig, event string, body []byte) {
+	delay := config.retryDelay()
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = a.post(config, w, body); err == nil {
+			return
+		}
+		if attempt >= config.retries() {
+			break
+		}
+		select {
+		case <-a.stop:
+			log.Printf("Dropping %s alert to %s on shutdown: %v", event, redactURL(w.URL), err)
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	log.Printf("Failed to deliver %s alert to %s after %d attempts: %v", event, redactURL(w.URL), config.retries()+1, err)
+}
+
+// post makes one delivery attempt; any status other than 2xx is a failure
+func (a *alerter) post(config *AlertsConfig, w WebhookConfig, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		// The *url.Error would repeat the whole URL
+		if ue, ok := err.(*url.Error); ok {
+			return ue.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// redactURL reduces a webhook URL to its scheme and host for logging, since
+// services like Slack put their secret in the path
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Close stops retrying and waits for deliveries in progress
+func (a *alerter) Close() {
+	if a == nil {
+		return
+	}
+	a.stopOnce.Do(func() { close(a.stop) })
+	a.pending.Wait()
+}
+
+// watchTokenExpiry alerts once per token when the endpoint's JWT expires
+// within token_expiry, checking right away and then every hour
+func (p *ProxyServer) watchTokenExpiry() {
+	ticker := time.NewTicker(tokenExpiryCheckInterval)
+	defer ticker.Stop()
+	var warned string
+	for {
+		if config := p.alerts.config.Load(); config != nil {
+			token := p.Token()
+			if claims, err := DecodeToken(token); err == nil && !claims.ExpiresAt.IsZero() && token != warned {
+				if left := time.Until(claims.ExpiresAt); left < config.tokenExpiry() {
+					warned = token
+					if left <= 0 {
+						p.alerts.send(AlertTokenExpiring, p.config.Name, "JWT token for %s expired at %s", p.config.Name, claims.ExpiresAt.UTC().Format(time.RFC3339))
+					} else {
+						p.alerts.send(AlertTokenExpiring, p.config.Name, "JWT token for %s expires at %s, in %s", p.config.Name, claims.ExpiresAt.UTC().Format(time.RFC3339), left.Round(time.Minute))
+					}
+				}
+			}
+		}
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// AuditConfig configures the append-only audit log of configuration and
+// token changes and admin API calls
+type AuditConfig struct {
+	// Path appends one JSON object per line to this file
+	Path string `mapstructure:"path"`
+
+	// Syslog also sends every entry to the local syslog daemon (facility auth)
+	Syslog bool `mapstructure:"syslog"`
+}
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Result   string    `json:"result,omitempty"`
+	Changes  []Change  `json:"changes,omitempty"`
+}
+
+// Change is one field that differs between two configurations. Secret
+// values are replaced by a fingerprint, so a change is visible without the
+// value being written down.
+type Change struct {
+	Field  string `json:"field"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// auditLog writes audit entries. One log is shared by a Manager and its
+// endpoints; until it is opened, and on a nil *auditLog, entries are discarded.
+type auditLog struct {
+	mu      sync.Mutex
+	writers []io.WriteCloser
+}
+
+// open starts writing to the configured sinks
+func (a *auditLog) open(config *AuditConfig) error {
+	if config == nil {
+		return nil
+	}
+	var writers []io.WriteCloser
+	if config.Path != "" {
+		f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %v", err)
+		}
+		writers = append(writers, f)
+	}
+	if config.Syslog {
+		w, err := newAuditSyslog()
+		if err != nil {
+			for _, w := range writers {
+				w.Close()
+			}
+			return fmt.Errorf("failed to connect to syslog for the audit log: %v", err)
+		}
+		writers = append(writers, w)
+	}
+
+	a.mu.Lock()
+	a.writers = writers
+	a.mu.Unlock()
+	return nil
+}
+
+// enabled reports whether entries are being written
+func (a *auditLog) enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.writers) > 0
+}
+
+// record writes entry to every sink, stamping the time
+func (a *auditLog) record(entry AuditEntry) {
+	if !a.enabled() {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, w := range a.writers {
+		if _, err := w.Write(line); err != nil {
+			log.Printf("Failed to write audit entry: %v", err)
+		}
+	}
+}
+
+// Close closes the audit sinks
+func (a *auditLog) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, w := range a.writers {
+		w.Close()
+	}
+	a.writers = nil
+}
+
+// localActor names the OS user running the proxy, who applies config
+// reloads triggered by signals or file changes
+func localActor() string {
+	if u, err := user.Current(); err == nil {
+		return "local:" + u.Username
+	}
+	return "local"
+}
+
+// rpcActor names the caller of an admin RPC: the client whose API key it
+// sent, or else its network address
+func (m *Manager) rpcActor(ctx context.Context) string {
+	if client, ok, _ := m.clients.authenticate(ctx); ok {
+		return "client:" + client.Name
+	}
+	return "peer:" + peerAddress(ctx)
+}
+
+// auditInterceptor records every admin RPC with its caller and outcome
+func (m *Manager) auditInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if !m.audit.enabled() {
+		return resp, err
+	}
+	entry := AuditEntry{
+		Action: "admin." + info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:],
+		Actor:  m.rpcActor(ctx),
+		Result: status.Code(err).String(),
+	}
+	if named, ok := req.(interface{ GetName() string }); ok {
+		entry.Endpoint = named.GetName()
+	}
+	m.audit.record(entry)
+	return resp, err
+}
+
+// auditReload records a configuration reload and, if it was applied, the
+// endpoints it added and removed
+func (a *auditLog) auditReload(actor string, before, after *ProxyConfig, applied bool, err error) {
+	if !a.enabled() {
+		return
+	}
+	result := "OK"
+	if err != nil {
+		result = err.Error()
+	}
+	a.record(AuditEntry{Action: "config.reload", Actor: actor, Result: result, Changes: diffConfig(before, after)})
+	if !applied {
+		return
+	}
+
+	old := make(map[string]bool, len(before.Endpoints))
+	for _, e := range before.Endpoints {
+		old[e.Name] = true
+	}
+	for _, e := range after.Endpoints {
+		if !old[e.Name] {
+			a.record(AuditEntry{Action: "endpoint.add", Actor: actor, Endpoint: e.Name})
+		}
+		delete(old, e.Name)
+	}
+	for name := range old {
+		a.record(AuditEntry{Action: "endpoint.remove", Actor: actor, Endpoint: name})
+	}
+}
+
+// auditToken records a token rotation on an endpoint
+func (a *auditLog) auditToken(actor, endpoint, before, after string) {
+	a.record(AuditEntry{
+		Action:   "token.rotate",
+		Actor:    actor,
+		Endpoint: endpoint,
+		Changes:  []Change{{Field: "jwt_token", Before: fingerprint(before), After: fingerprint(after)}},
+	})
+}
+
+// diffConfig lists the fields that differ between two configurations.
+// Endpoints and clients are keyed by name rather than position.
+func diffConfig(before, after *ProxyConfig) []Change {
+	old, cur := flattenConfig(before), flattenConfig(after)
+	var changes []Change
+	for field, value := range old {
+		if cur[field] != value {
+			changes = append(changes, Change{Field: field, Before: value, After: cur[field]})
+		}
+	}
+	for field, value := range cur {
+		if _, ok := old[field]; !ok {
+			changes = append(changes, Change{Field: field, After: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// secretFields are configuration keys whose values must not be logged
+var secretFields = map[string]bool{
+	"jwt_token": true,
+	"api_key":   true,
+	"token":     true,
+	"tokens":    true,
+	"password":  true,
+
+	// Webhook URLs and headers often embed a credential
+	"url":     true,
+	"headers": true,
+}
+
+// flattenConfig maps dotted configuration keys to their values, with secrets fingerprinted
+func flattenConfig(config *ProxyConfig) map[string]string {
+	out := make(map[string]string)
+	if config != nil {
+		flatten(out, "", reflect.ValueOf(*config), false)
+	}
+	return out
+}
+
+func flatten(out map[string]string, prefix string, v reflect.Value, secret bool) {
+	if d, ok := v.Interface().(time.Duration); ok {
+		if d != 0 {
+			out[prefix] = d.String()
+		}
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			flatten(out, prefix, v.Elem(), secret)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("mapstructure"), ",")[0]
+			if name == "" || !t.Field(i).IsExported() {
+				continue
+			}
+			flatten(out, join(prefix, name), v.Field(i), secret || secretFields[name])
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			key := fmt.Sprintf("%s[%d]", prefix, i)
+			// Key named items by name so reordering is not reported as a change
+			if item := reflect.Indirect(v.Index(i)); item.Kind() == reflect.Struct {
+				if name := item.FieldByName("Name"); name.IsValid() && name.Kind() == reflect.String && name.String() != "" {
+					key = fmt.Sprintf("%s[%s]", prefix, name.String())
+				}
+			}
+			flatten(out, key, v.Index(i), secret)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			flatten(out, join(prefix, fmt.Sprint(k.Interface())), v.MapIndex(k), secret)
+		}
+	default:
+		if v.IsZero() {
+			return
+		}
+		value := fmt.Sprint(v.Interface())
+		if secret {
+			value = fingerprint(value)
+		}
+		out[prefix] = value
+	}
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// fingerprint identifies a secret without revealing it
+func fingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
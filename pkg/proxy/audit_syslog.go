@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newAuditSyslog connects to the local syslog daemon
+func newAuditSyslog() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, "grpc-proxy-audit")
+}
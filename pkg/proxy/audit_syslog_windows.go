@@ -0,0 +1,11 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+)
+
+// newAuditSyslog reports that syslog is unavailable on Windows
+func newAuditSyslog() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on Windows")
+}
@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWSConfig configures the AWS Secrets Manager (aws-sm:) and SSM Parameter
+// Store (aws-ssm:) backends. Credentials come from the environment, an EKS
+// web identity token, the ECS or EKS Pod Identity container endpoint, or the
+// EC2 instance role, in that order.
+type AWSConfig struct {
+	// Region defaults to $AWS_REGION, then $AWS_DEFAULT_REGION
+	Region string `mapstructure:"region"`
+
+	// Endpoint overrides the service URL, e.g. for VPC endpoints or LocalStack
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+const (
+	// imdsAddress is the EC2 instance metadata service
+	imdsAddress = "http://169.254.169.254"
+
+	// ecsCredentialsAddress serves task credentials for AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+	ecsCredentialsAddress = "http://169.254.170.2"
+
+	// awsCredentialsMargin renews temporary credentials this long before they expire
+	awsCredentialsMargin = 5 * time.Minute
+)
+
+// awsCredentials signs requests; temporary credentials carry a session token and expiry
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// awsCredentialSource finds and caches credentials for the AWS backends
+type awsCredentialSource struct {
+	client *http.Client
+	region string
+
+	mu     sync.Mutex
+	cached *awsCredentials
+}
+
+// get returns cached credentials, renewing temporary ones shortly before they expire
+func (s *awsCredentialSource) get(ctx context.Context) (*awsCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != nil && (s.cached.Expires.IsZero() || time.Until(s.cached.Expires) > awsCredentialsMargin) {
+		return s.cached, nil
+	}
+	creds, err := s.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials: %v", err)
+	}
+	s.cached = creds
+	return creds, nil
+}
+
+// load walks the credential chain
+func (s *awsCredentialSource) load(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return s.webIdentity(ctx, tokenFile, os.Getenv("AWS_ROLE_ARN"))
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return s.containerCredentials(ctx, ecsCredentialsAddress+uri)
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		return s.containerCredentials(ctx, uri)
+	}
+	return s.instanceRole(ctx)
+}
+
+// webIdentity exchanges an EKS service account token for role credentials
+func (s *awsCredentialSource) webIdentity(ctx context.Context, tokenFile, roleARN string) (*awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web identity token: %v", err)
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "grpc-proxy"
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://sts.%s.amazonaws.com/", s.region),
+		strings.NewReader(query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := secretsDo(s.client, req)
+	if err != nil {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity: %v", err)
+	}
+
+	var resp struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid AssumeRoleWithWebIdentity response: %v", err)
+	}
+	c := resp.Credentials
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// containerCredentials reads ECS task or EKS Pod Identity credentials
+func (s *awsCredentialSource) containerCredentials(ctx context.Context, uri string) (*awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read container authorization token: %v", err)
+		}
+		auth = strings.TrimSpace(string(b))
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	body, err := secretsDo(s.client, req)
+	if err != nil {
+		return nil, fmt.Errorf("container credentials: %v", err)
+	}
+	return parseRoleCredentials(body)
+}
+
+// instanceRole reads the EC2 instance profile credentials using IMDSv2
+func (s *awsCredentialSource) instanceRole(ctx context.Context) (*awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsAddress+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := secretsDo(s.client, req)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, imdsAddress+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return secretsDo(s.client, req)
+	}
+	role, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("instance role: %v", err)
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	body, err := get("/latest/meta-data/iam/security-credentials/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("instance role %s: %v", name, err)
+	}
+	return parseRoleCredentials(body)
+}
+
+// parseRoleCredentials decodes the JSON credentials served by IMDS and container endpoints
+func parseRoleCredentials(body []byte) (*awsCredentials, error) {
+	var c struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, fmt.Errorf("invalid credentials response: %v", err)
+	}
+	if c.AccessKeyID == "" {
+		return nil, fmt.Errorf("credentials response has no access key")
+	}
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.Token, Expires: c.Expiration}, nil
+}
+
+// awsBackend reads secrets from Secrets Manager or SSM Parameter Store
+type awsBackend struct {
+	service  string // secretsmanager or ssm
+	region   string
+	endpoint string
+	client   *http.Client
+	creds    *awsCredentialSource
+}
+
+// newAWSBackends returns the aws-sm and aws-ssm backends sharing one credential source
+func newAWSBackends(config AWSConfig) (sm, ssm *awsBackend) {
+	region := config.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	client := &http.Client{Timeout: secretFetchTimeout}
+	creds := &awsCredentialSource{client: client, region: region}
+	newBackend := func(service string) *awsBackend {
+		return &awsBackend{service: service, region: region, endpoint: config.Endpoint, client: client, creds: creds}
+	}
+	return newBackend("secretsmanager"), newBackend("ssm")
+}
+
+// fetch reads a secret name (optionally #field of a JSON secret) or a parameter name
+func (b *awsBackend) fetch(ctx context.Context, path string) (secret, error) {
+	if b.region == "" {
+		return secret{}, fmt.Errorf("AWS region is not set (secrets.aws.region or AWS_REGION)")
+	}
+
+	if b.service == "ssm" {
+		var resp struct {
+			Parameter struct {
+				Value string `json:"Value"`
+			} `json:"Parameter"`
+		}
+		err := b.call(ctx, "AmazonSSM.GetParameter", map[string]interface{}{"Name": path, "WithDecryption": true}, &resp)
+		return secret{value: resp.Parameter.Value}, err
+	}
+
+	name, field, hasField := strings.Cut(path, "#")
+	var resp struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := b.call(ctx, "secretsmanager.GetSecretValue", map[string]interface{}{"SecretId": name}, &resp); err != nil {
+		return secret{}, err
+	}
+	if !hasField {
+		return secret{value: resp.SecretString}, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.SecretString), &fields); err != nil {
+		return secret{}, fmt.Errorf("secret %s is not a JSON object: %v", name, err)
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return secret{}, fmt.Errorf("field %q not found in secret %s", field, name)
+	}
+	return secret{value: value}, nil
+}
+
+// call sends a signed JSON API request and decodes the response into out
+func (b *awsBackend) call(ctx context.Context, target string, params interface{}, out interface{}) error {
+	creds, err := b.creds.get(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	endpoint := b.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", b.service, b.region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, creds, b.region, b.service, time.Now())
+
+	resp, err := secretsDo(b.client, req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(resp, out); err != nil {
+		return fmt.Errorf("invalid %s response: %v", target, err)
+	}
+	return nil
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header to req
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery sorts and strictly encodes query parameters for signing
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// AzureConfig configures the Azure Key Vault backend (azure-kv:). Credentials
+// come from a service principal secret ($AZURE_TENANT_ID, $AZURE_CLIENT_ID,
+// $AZURE_CLIENT_SECRET), AKS workload identity ($AZURE_FEDERATED_TOKEN_FILE),
+// or the VM's managed identity.
+type AzureConfig struct {
+	// ClientID selects a user-assigned managed identity; it defaults to $AZURE_CLIENT_ID
+	ClientID string `mapstructure:"client_id"`
+}
+
+const (
+	// azureIMDSAddress serves managed identity tokens on Azure VMs
+	azureIMDSAddress = "http://169.254.169.254"
+
+	// azureVaultResource is the audience of Key Vault access tokens
+	azureVaultResource = "https://vault.azure.net"
+
+	// azureKeyVaultAPIVersion is the Key Vault REST API version used for reads
+	azureKeyVaultAPIVersion = "7.4"
+)
+
+// azureBackend reads secrets over the Key Vault REST API
+type azureBackend struct {
+	clientID string
+	client   *http.Client
+	token    *accessToken
+}
+
+func newAzureBackend(config AzureConfig) *azureBackend {
+	b := &azureBackend{
+		clientID: config.ClientID,
+		client:   &http.Client{Timeout: secretFetchTimeout},
+	}
+	if b.clientID == "" {
+		b.clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	b.token = &accessToken{fetch: b.fetchToken}
+	return b
+}
+
+// secretURL expands <vault>/<secret>[/<version>] to the secret's URL. A full
+// secret identifier such as https://chandra.vault.azure.net/secrets/cosmos-token
+// is used as is.
+func secretURL(path string) (string, error) {
+	if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") {
+		return path, nil
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("azure-kv reference must be <vault>/<secret>[/<version>] or a secret URL, got %q", path)
+	}
+	u := fmt.Sprintf("https://%s.vault.azure.net/secrets/%s", parts[0], parts[1])
+	if len(parts) == 3 {
+		u += "/" + parts[2]
+	}
+	return u, nil
+}
+
+// fetch reads a secret's current (or pinned) version
+func (b *azureBackend) fetch(ctx context.Context, path string) (secret, error) {
+	u, err := secretURL(path)
+	if err != nil {
+		return secret{}, err
+	}
+	token, err := b.token.get(ctx)
+	if err != nil {
+		return secret{}, fmt.Errorf("no Azure credentials: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u+"?api-version="+azureKeyVaultAPIVersion, nil)
+	if err != nil {
+		return secret{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	body, err := secretsDo(b.client, req)
+	if err != nil {
+		return secret{}, err
+	}
+
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return secret{}, fmt.Errorf("invalid Key Vault response: %v", err)
+	}
+	return secret{value: resp.Value}, nil
+}
+
+// fetchToken obtains a Key Vault access token from Microsoft Entra ID or the managed identity endpoint
+func (b *azureBackend) fetchToken(ctx context.Context) (string, time.Duration, error) {
+	tenant := os.Getenv("AZURE_TENANT_ID")
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com/"
+	}
+	tokenURL := strings.TrimSuffix(authority, "/") + "/" + tenant + "/oauth2/v2.0/token"
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {b.clientID},
+		"scope":      {azureVaultResource + "/.default"},
+	}
+
+	if clientSecret := os.Getenv("AZURE_CLIENT_SECRET"); clientSecret != "" && tenant != "" {
+		form.Set("client_secret", clientSecret)
+		return postForm(ctx, b.client, tokenURL, form)
+	}
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" && tenant != "" {
+		assertion, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read AZURE_FEDERATED_TOKEN_FILE: %v", err)
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+		return postForm(ctx, b.client, tokenURL, form)
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureVaultResource}}
+	if b.clientID != "" {
+		query.Set("client_id", b.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		azureIMDSAddress+"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata", "true")
+	return doTokenRequest(b.client, req)
+}
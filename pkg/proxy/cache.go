@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// defaultCacheTTL is how long a cached response is served
+	defaultCacheTTL = 5 * time.Second
+
+	// defaultCacheMaxEntries caps the responses an endpoint caches
+	defaultCacheMaxEntries = 10000
+
+	// defaultCacheHeightInterval is how often height invalidation polls the
+	// upstream's latest block
+	defaultCacheHeightInterval = time.Second
+)
+
+// Cache invalidation modes
+const (
+	// CacheInvalidationTTL expires every response after the TTL
+	CacheInvalidationTTL = "ttl"
+
+	// CacheInvalidationHeight drops responses about the latest state when a
+	// new block arrives and keeps height-pinned responses until evicted
+	CacheInvalidationHeight = "height"
+)
+
+// CacheConfig caches the successful responses of selected methods
+type CacheConfig struct {
+	// Methods are the full method name prefixes whose responses are cached
+	Methods []string `mapstructure:"methods"`
+
+	// TTL is how long responses are served (default 5s). In height mode it
+	// only bounds latest-state responses, in case height tracking stalls.
+	TTL time.Duration `mapstructure:"ttl"`
+
+	// MaxEntries caps the cached responses, evicting the least recently
+	// used (default 10000)
+	MaxEntries int `mapstructure:"max_entries"`
+
+	// Invalidation is "ttl" (default) or "height"
+	Invalidation string `mapstructure:"invalidation"`
+
+	// HeightInterval is how often height mode asks the upstream for its
+	// latest block (default 1s)
+	HeightInterval time.Duration `mapstructure:"height_interval"`
+}
+
+// validate checks the cache selects methods and names a known mode
+func (c *CacheConfig) validate() error {
+	if len(c.Methods) == 0 {
+		return fmt.Errorf("cache requires methods")
+	}
+	switch c.Invalidation {
+	case "", CacheInvalidationTTL, CacheInvalidationHeight:
+	default:
+		return fmt.Errorf("unknown cache invalidation '%s' (expected ttl or height)", c.Invalidation)
+	}
+	if c.TTL < 0 || c.MaxEntries < 0 || c.HeightInterval < 0 {
+		return fmt.Errorf("cache ttl, max_entries and height_interval must not be negative")
+	}
+	return nil
+}
+
+// ttl returns the configured TTL or the default
+func (c *CacheConfig) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return defaultCacheTTL
+}
+
+// maxEntries returns the configured entry limit or the default
+func (c *CacheConfig) maxEntries() int {
+	if c.MaxEntries > 0 {
+		return c.MaxEntries
+	}
+	return defaultCacheMaxEntries
+}
+
+// heightInterval returns the configured polling interval or the default
+func (c *CacheConfig) heightInterval() time.Duration {
+	if c.HeightInterval > 0 {
+		return c.HeightInterval
+	}
+	return defaultCacheHeightInterval
+}
+
+// byHeight reports whether latest-state responses are invalidated by new blocks
+func (c *CacheConfig) byHeight() bool {
+	return c.Invalidation == CacheInvalidationHeight
+}
+
+// cacheEntry is a cached response. pinned responses answer a query at an
+// explicit height; the others describe the latest state as of height.
+type cacheEntry struct {
+	key    string
+	result *callResult
+	stored time.Time
+	pinned bool
+	height int64
+}
+
+// responseCache holds the responses of an endpoint, least recently used last
+type responseCache struct {
+	config *CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newResponseCache(config *CacheConfig) *responseCache {
+	return &responseCache{config: config, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// valid reports whether e may still be served when latest is the newest
+// known block height
+func (c *responseCache) valid(e *cacheEntry, latest int64) bool {
+	if !c.config.byHeight() {
+		return time.Since(e.stored) < c.config.ttl()
+	}
+	if e.pinned {
+		return true
+	}
+	return e.height >= latest && time.Since(e.stored) < c.config.ttl()
+}
+
+// get returns the response cached for key while it is valid
+func (c *responseCache) get(key string, latest int64) (*callResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.valid(e, latest) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.result, true
+}
+
+// put caches e under its key, evicting the least recently used entries
+// beyond max_entries
+func (c *responseCache) put(e *cacheEntry) {
+	e.stored = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	for c.order.Len() > c.config.maxEntries() {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops the latest-state entries older than height and returns
+// how many it dropped
+func (c *responseCache) invalidate(height int64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); !e.pinned && e.height < height {
+			c.remove(el)
+			dropped++
+		}
+		el = next
+	}
+	return dropped
+}
+
+// len returns the number of cached responses
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// remove deletes el; the caller holds mu
+func (c *responseCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// cacheInterceptor answers selected single-request calls from the response
+// cache and caches the successful responses of the others
+func (p *ProxyServer) cacheInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.cache == nil || !matchesMethod(p.config.Cache.Methods, info.FullMethod) || p.isLocalService(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	req, stream, ok := singleRequest(ss)
+	if !ok {
+		return handler(srv, stream)
+	}
+	key, ok := p.callKey(ss.Context(), info.FullMethod, req)
+	if !ok {
+		return handler(srv, stream)
+	}
+
+	if result, ok := p.cache.get(key, p.latestHeight.Load()); ok {
+		p.metrics.Add("cache_hits", 1)
+		p.setCacheStatus(ss, "hit")
+		return result.replay(ss)
+	}
+	p.metrics.Add("cache_misses", 1)
+	p.setCacheStatus(ss, "miss")
+
+	// A response without a height header describes the state as of the
+	// latest block known when the call started
+	latest := p.latestHeight.Load()
+	rec := newRecordStream(stream)
+	err := handler(srv, rec)
+	result := rec.finish(err)
+	if err != nil {
+		return err
+	}
+
+	pinned, _ := strconv.ParseInt(incomingHeader(ss.Context(), blockHeightHeader), 10, 64)
+	e := &cacheEntry{key: key, result: result, pinned: pinned > 0, height: latest}
+	if served, err := strconv.ParseInt(headerValue(result.header, blockHeightHeader), 10, 64); err == nil {
+		e.height = served
+	}
+	p.cache.put(e)
+	p.metrics.Set("cache_entries", intVar(int64(p.cache.len())))
+	return nil
+}
+
+// watchCacheHeight polls the upstream's latest block every height_interval
+// until the server's upstreams are closed, dropping latest-state responses
+// whenever a new block arrives
+func (p *ProxyServer) watchCacheHeight() {
+	ticker := time.NewTicker(p.config.Cache.heightInterval())
+	defer ticker.Stop()
+	failing := false
+	for {
+		height, _, err := p.latestBlock(p.upstream)
+		if err != nil && !failing {
+			p.logf(levelWarn, "Warning: endpoint %s: failed to read latest block for cache invalidation: %v", p.config.Name, err)
+		}
+		failing = err != nil
+		if err == nil {
+			p.observeHeight(strconv.FormatInt(height, 10))
+		}
+		p.invalidateCache()
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// invalidateCache drops the latest-state responses older than the latest
+// known block
+func (p *ProxyServer) invalidateCache() {
+	if p.cache == nil || !p.config.Cache.byHeight() {
+		return
+	}
+	if dropped := p.cache.invalidate(p.latestHeight.Load()); dropped > 0 {
+		p.metrics.Add("cache_invalidated", int64(dropped))
+		p.metrics.Set("cache_entries", intVar(int64(p.cache.len())))
+	}
+}
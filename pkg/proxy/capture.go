@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// CaptureConfig enables recording of proxied calls to a file for later replay
+type CaptureConfig struct {
+	// Path is the capture file; calls are appended as JSON lines
+	Path string `mapstructure:"path"`
+
+	// Methods limits recording to these full method name prefixes (default all)
+	Methods []string `mapstructure:"methods"`
+}
+
+// matches reports whether fullMethodName is selected for recording
+func (c *CaptureConfig) matches(fullMethodName string) bool {
+	return len(c.Methods) == 0 || matchesMethod(c.Methods, fullMethodName)
+}
+
+// CapturedCall is one recorded call, stored as a single JSON line
+type CapturedCall struct {
+	Time      time.Time           `json:"time"`
+	Endpoint  string              `json:"endpoint,omitempty"`
+	Method    string              `json:"method"`
+	Metadata  map[string][]string `json:"metadata,omitempty"`
+	Requests  []CapturedMessage   `json:"requests"`
+	Header    map[string][]string `json:"header,omitempty"`
+	Responses []CapturedMessage   `json:"responses"`
+	Trailer   map[string][]string `json:"trailer,omitempty"`
+	Code      string              `json:"code"`
+	Message   string              `json:"message,omitempty"`
+	Duration  time.Duration       `json:"duration"`
+}
+
+// CapturedMessage is one raw protobuf message and when it was seen
+type CapturedMessage struct {
+	Time time.Time `json:"time"`
+	Data []byte    `json:"data"`
+}
+
+// capturedMetadata copies md without credentials and transport headers, so a
+// capture neither leaks secrets nor confuses the transport on replay
+func capturedMetadata(md metadata.MD) map[string][]string {
+	out := make(map[string][]string, len(md))
+	for k, v := range md {
+		switch {
+		case k == "authorization", k == apiKeyHeader, k == "content-type", k == "user-agent",
+			strings.HasPrefix(k, ":"), strings.HasPrefix(k, "grpc-"):
+			continue
+		}
+		out[k] = append([]string(nil), v...)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// captureFile serializes captured calls to the capture file
+type captureFile struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openCaptureFile opens path for appending; captures can contain sensitive
+// query data, so the file is only readable by its owner
+func openCaptureFile(path string) (*captureFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &captureFile{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (c *captureFile) write(call *CapturedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(call); err != nil {
+		log.Printf("Failed to write capture for %s: %v", call.Method, err)
+	}
+}
+
+func (c *captureFile) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f.Close()
+}
+
+// captureInterceptor records selected calls to the capture file
+func (p *ProxyServer) captureInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	p.mu.Lock()
+	file := p.captureFile
+	p.mu.Unlock()
+	if file == nil || !p.config.Capture.matches(info.FullMethod) {
+		return handler(srv, ss)
+	}
+
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	rec := &captureStream{
+		ServerStream: ss,
+		call: CapturedCall{
+			Time:     time.Now(),
+			Endpoint: p.config.Name,
+			Method:   info.FullMethod,
+			Metadata: capturedMetadata(md),
+		},
+	}
+	err := handler(srv, rec)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	st := status.Convert(err)
+	rec.call.Code = st.Code().String()
+	rec.call.Message = st.Message()
+	rec.call.Duration = time.Since(rec.call.Time)
+	file.write(&rec.call)
+	return err
+}
+
+// captureStream wraps the client-facing stream to record raw frames
+type captureStream struct {
+	grpc.ServerStream
+
+	mu   sync.Mutex
+	call CapturedCall
+}
+
+// record appends the wire bytes of m to msgs
+func (s *captureStream) record(msgs *[]CapturedMessage, m interface{}) {
+	b, ok := messageBytes(m)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	*msgs = append(*msgs, CapturedMessage{Time: time.Now(), Data: b})
+	s.mu.Unlock()
+}
+
+func (s *captureStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.record(&s.call.Requests, m)
+	}
+	return err
+}
+
+func (s *captureStream) SendMsg(m interface{}) error {
+	s.record(&s.call.Responses, m)
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *captureStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	s.call.Header = capturedMetadata(metadata.Join(metadata.MD(s.call.Header), md))
+	s.mu.Unlock()
+	return s.ServerStream.SetHeader(md)
+}
+
+func (s *captureStream) SendHeader(md metadata.MD) error {
+	s.mu.Lock()
+	s.call.Header = capturedMetadata(metadata.Join(metadata.MD(s.call.Header), md))
+	s.mu.Unlock()
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *captureStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	s.call.Trailer = capturedMetadata(metadata.Join(metadata.MD(s.call.Trailer), md))
+	s.mu.Unlock()
+	s.ServerStream.SetTrailer(md)
+}
+
+// ReadCapture reads the calls recorded in a capture file
+func ReadCapture(r io.Reader) ([]CapturedCall, error) {
+	var calls []CapturedCall
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var call CapturedCall
+		if err := json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		calls = append(calls, call)
+	}
+	return calls, scanner.Err()
+}
+
+// Replay re-sends a captured call on conn with its recorded metadata and
+// request frames, and returns what the server answered this time
+func Replay(ctx context.Context, conn grpc.ClientConnInterface, call CapturedCall) *CapturedCall {
+	result := &CapturedCall{Time: time.Now(), Method: call.Method}
+	defer func() { result.Duration = time.Since(result.Time) }()
+
+	outMD, _ := metadata.FromOutgoingContext(ctx)
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Join(outMD, metadata.MD(call.Metadata)))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	finish := func(err error) *CapturedCall {
+		st := status.Convert(err)
+		result.Code = st.Code().String()
+		result.Message = st.Message()
+		return result
+	}
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, call.Method)
+	if err != nil {
+		return finish(err)
+	}
+	for _, req := range call.Requests {
+		// Raw frames travel as unknown fields of an empty message, exactly as the proxy forwards them
+		msg := &emptypb.Empty{}
+		if err := proto.Unmarshal(req.Data, msg); err != nil {
+			return finish(err)
+		}
+		result.Requests = append(result.Requests, CapturedMessage{Time: time.Now(), Data: req.Data})
+		if err := stream.SendMsg(msg); err != nil {
+			break
+		}
+	}
+	stream.CloseSend()
+
+	for {
+		msg := &emptypb.Empty{}
+		err := stream.RecvMsg(msg)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			result.Trailer = capturedMetadata(stream.Trailer())
+			return finish(err)
+		}
+		b, _ := proto.Marshal(msg)
+		result.Responses = append(result.Responses, CapturedMessage{Time: time.Now(), Data: b})
+	}
+	if header, err := stream.Header(); err == nil {
+		result.Header = capturedMetadata(header)
+	}
+	result.Trailer = capturedMetadata(stream.Trailer())
+	return finish(nil)
+}
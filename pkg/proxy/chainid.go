@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// getNodeInfoMethod reports the chain-id (network) an upstream node serves
+const getNodeInfoMethod = "/cosmos.base.tendermint.v1beta1.Service/GetNodeInfo"
+
+// defaultChainIDCheckInterval is how often expected_chain_id is re-checked
+const defaultChainIDCheckInterval = 5 * time.Minute
+
+// nodeCheckTimeout bounds a single GetNodeInfo or GetLatestBlock call
+const nodeCheckTimeout = 10 * time.Second
+
+// chainIDCheckInterval returns the configured re-check interval or the default
+func (c Config) chainIDCheckInterval() time.Duration {
+	if c.ChainIDCheckInterval > 0 {
+		return c.ChainIDCheckInterval
+	}
+	return defaultChainIDCheckInterval
+}
+
+// errChainMismatch is returned by verifyChainID when an upstream serves another chain
+type errChainMismatch struct {
+	address, got, want string
+}
+
+func (e *errChainMismatch) Error() string {
+	return fmt.Sprintf("upstream %s serves chain %q, expected %q", e.address, e.got, e.want)
+}
+
+// fetchChainID asks the upstream behind conn for its chain-id
+func (p *ProxyServer) fetchChainID(conn *grpc.ClientConn) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeCheckTimeout)
+	defer cancel()
+	ctx = p.upstreamContext(ctx, getNodeInfoMethod)
+
+	// The response is kept as unknown fields and decoded by hand, so the
+	// proxy needs no Cosmos SDK types
+	resp := &emptypb.Empty{}
+	if err := conn.Invoke(ctx, getNodeInfoMethod, &emptypb.Empty{}, resp); err != nil {
+		return "", err
+	}
+	b, err := proto.Marshal(resp)
+	if err != nil {
+		return "", err
+	}
+	// GetNodeInfoResponse.default_node_info (1) -> DefaultNodeInfo.network (4)
+	nodeInfo, ok := protoField(b, 1)
+	if !ok {
+		return "", fmt.Errorf("GetNodeInfo response has no node info")
+	}
+	network, ok := protoField(nodeInfo, 4)
+	if !ok {
+		return "", fmt.Errorf("GetNodeInfo response has no network")
+	}
+	return string(network), nil
+}
+
+// protoField returns the last occurrence of the length-delimited field num in b
+func protoField(b []byte, num protowire.Number) ([]byte, bool) {
+	var value []byte
+	found := false
+	for len(b) > 0 {
+		n, typ, length := protowire.ConsumeTag(b)
+		if length < 0 {
+			return nil, false
+		}
+		b = b[length:]
+		if n == num && typ == protowire.BytesType {
+			v, length := protowire.ConsumeBytes(b)
+			if length < 0 {
+				return nil, false
+			}
+			value, found = v, true
+			b = b[length:]
+			continue
+		}
+		length = protowire.ConsumeFieldValue(n, typ, b)
+		if length < 0 {
+			return nil, false
+		}
+		b = b[length:]
+	}
+	return value, found
+}
+
+// verifyChainID checks that every upstream of the endpoint serves
+// expected_chain_id. A wrong chain is reported as *errChainMismatch; any other
+// error means the check could not be made.
+func (p *ProxyServer) verifyChainID() error {
+	primary := &route{config: RouteConfig{RemoteAddress: p.config.RemoteAddress}, conn: p.upstream}
+	for _, u := range append([]*route{primary}, p.routes...) {
+		chainID, err := p.fetchChainID(u.conn)
+		if err != nil {
+			return fmt.Errorf("failed to read chain-id from upstream %s: %v", u.config.RemoteAddress, err)
+		}
+		if chainID != p.config.ExpectedChainID {
+			return &errChainMismatch{address: u.config.RemoteAddress, got: chainID, want: p.config.ExpectedChainID}
+		}
+	}
+	return nil
+}
+
+// checkChainID runs verifyChainID and, on a mismatch, rejects proxied calls
+// and reports NOT_SERVING until the upstream serves the expected chain again.
+// A failed check leaves the current state alone.
+func (p *ProxyServer) checkChainID() error {
+	err := p.verifyChainID()
+	mismatch, isMismatch := err.(*errChainMismatch)
+	switch {
+	case isMismatch:
+		if p.chainMismatch.Swap(mismatch) == nil {
+			p.logf(levelError, "Endpoint %s: %v; rejecting calls", p.config.Name, err)
+			p.alerts.send(AlertChainIDMismatch, p.config.Name, "endpoint %s: %v", p.config.Name, err)
+		}
+		p.metrics.Set("chain_id_mismatch", intVar(1))
+	case err != nil:
+		p.logf(levelWarn, "Warning: endpoint %s: %v", p.config.Name, err)
+		return err
+	default:
+		if p.chainMismatch.Swap(nil) != nil {
+			p.logf(levelInfo, "Endpoint %s upstreams serve %q again", p.config.Name, p.config.ExpectedChainID)
+		}
+		p.metrics.Set("chain_id_mismatch", intVar(0))
+	}
+	p.updateHealth()
+	return err
+}
+
+// watchChainID re-checks expected_chain_id until the server's upstreams are closed
+func (p *ProxyServer) watchChainID() {
+	ticker := time.NewTicker(p.config.chainIDCheckInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+		p.checkChainID()
+	}
+}
+
+// chainError returns the error for proxied calls while the upstream serves
+// the wrong chain, or nil
+func (p *ProxyServer) chainError() error {
+	if mismatch := p.chainMismatch.Load(); mismatch != nil {
+		return status.Errorf(codes.Unavailable, "endpoint %s is unavailable: upstream serves the wrong chain", p.config.Name)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+)
+
+// CheckResult is the outcome of the preflight check of one upstream
+type CheckResult struct {
+	Endpoint string
+
+	// Role is what the endpoint uses the upstream for: upstream,
+	// route, fallback, compare or hedge
+	Role    string
+	Address string
+
+	// Services is the number of services the upstream lists over
+	// reflection, or -1 if it does not serve reflection or is an http upstream
+	Services int
+	Latency  time.Duration
+	Err      error
+}
+
+// checkTarget is an upstream connection with the token calls to it carry
+type checkTarget struct {
+	role, address, token string
+	conn                 *grpc.ClientConn
+
+	// auth puts in the token, and signs the calls to the endpoint's own
+	// upstreams; nil sends it as a bearer token
+	auth *upstreamAuth
+}
+
+// Check dials every upstream of every endpoint without listening, and lists
+// the services of gRPC upstreams over server reflection with the token
+// calls would carry, so a rejected token fails the check. Each upstream
+// gets timeout. The error is only set when the configuration is invalid;
+// failed upstreams are reported in their result.
+func (m *Manager) Check(timeout time.Duration) ([]CheckResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.config.Validate(); err != nil {
+		return nil, err
+	}
+	registerConfigSecrets(m.config)
+	if err := m.secrets.configure(m.config.Secrets); err != nil {
+		return nil, err
+	}
+	m.config.DNS.apply()
+
+	var servers []*ProxyServer
+	defer func() {
+		for _, p := range servers {
+			p.closeUpstreams()
+		}
+	}()
+	for _, endpoint := range m.config.Endpoints {
+		p, err := NewProxyServer(endpoint, m.opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create proxy server %s: %v", endpoint.Name, err)
+		}
+		servers = append(servers, p)
+	}
+
+	results := make([][]CheckResult, len(servers))
+	var wg sync.WaitGroup
+	for i, p := range servers {
+		wg.Add(1)
+		go func(i int, p *ProxyServer) {
+			defer wg.Done()
+			results[i] = p.check(timeout)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var all []CheckResult
+	for _, r := range results {
+		all = append(all, r...)
+	}
+	return all, nil
+}
+
+// check checks every upstream of the endpoint in parallel
+func (p *ProxyServer) check(timeout time.Duration) []CheckResult {
+	if p.upstream == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		start := time.Now()
+		err := p.checkHTTP(ctx)
+		return []CheckResult{{Endpoint: p.config.Name, Role: "upstream", Address: p.config.RemoteAddress, Services: -1, Latency: time.Since(start), Err: err}}
+	}
+
+	targets := p.checkTargets()
+	results := make([]CheckResult, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t checkTarget) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			services, err := listUpstreamServices(ctx, t.conn, t.token, t.auth)
+			results[i] = CheckResult{Endpoint: p.config.Name, Role: t.role, Address: t.address, Services: services, Latency: time.Since(start), Err: err}
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// checkTargets returns the upstreams of a gRPC endpoint with the tokens
+// calls to them carry
+func (p *ProxyServer) checkTargets() []checkTarget {
+	targets := []checkTarget{{role: "upstream", address: p.config.RemoteAddress, token: p.Token(), conn: p.upstream, auth: p.auth}}
+	for _, r := range p.routes {
+		targets = append(targets, checkTarget{role: "route", address: r.config.RemoteAddress, token: p.Token(), conn: r.conn, auth: p.auth})
+	}
+	for _, f := range p.fallbacks {
+		targets = append(targets, checkTarget{role: "fallback", address: f.config.RemoteAddress, token: f.config.JWTToken, conn: f.conn})
+	}
+	if p.compareConn != nil {
+		t := checkTarget{role: "compare", address: p.config.Compare.RemoteAddress, token: p.config.Compare.JWTToken, conn: p.compareConn}
+		if t.token == "" {
+			t.token, t.auth = p.Token(), p.auth
+		}
+		targets = append(targets, t)
+	}
+	if p.hedgeConn != nil {
+		t := checkTarget{role: "hedge", address: p.config.Hedge.RemoteAddress, token: p.config.Hedge.JWTToken, conn: p.hedgeConn}
+		if t.token == "" {
+			t.token, t.auth = p.Token(), p.auth
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// listUpstreamServices asks an upstream for its services over reflection,
+// v1 first and then v1alpha. An upstream serving neither is reachable but
+// its services are unknown, so -1 is returned without an error.
+func listUpstreamServices(ctx context.Context, conn *grpc.ClientConn, token string, auth *upstreamAuth) (int, error) {
+	md := metadata.MD{}
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	for _, service := range reflectionServices {
+		method := "/" + service + "/ServerReflectionInfo"
+		auth.setMetadata(md, method, token)
+		stream, err := conn.NewStream(metadata.NewOutgoingContext(ctx, md.Copy()), desc, method)
+		if err == nil {
+			err = stream.SendMsg(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"}})
+		}
+		if err == nil {
+			err = stream.CloseSend()
+		}
+		resp := &rpb.ServerReflectionResponse{}
+		if err == nil {
+			err = stream.RecvMsg(resp)
+		}
+		if status.Code(err) == codes.Unimplemented {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return 0, status.Error(codes.Code(e.ErrorCode), e.ErrorMessage)
+		}
+		return len(resp.GetListServicesResponse().GetService()), nil
+	}
+	return -1, nil
+}
+
+// checkHTTP sends a GET to an http endpoint's upstream with its token and
+// fails on a transport error, a rejected token or a server error
+func (p *ProxyServer) checkHTTP(ctx context.Context) error {
+	target, err := httpTarget(p.config.RemoteAddress)
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	defer transport.CloseIdleConnections()
+	if target.Scheme == "https" {
+		transport.TLSClientConfig = upstreamTLSConfig(p.config, p.roots)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	if p.config.AuthorityOverride != "" {
+		req.Host = p.config.AuthorityOverride
+	}
+	p.auth.setHeader(req.Header, target.Path, p.Token())
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden || res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream answered %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ClientJWTConfig makes local callers present a JWT, verified against the
+// issuer's published keys before the call is proxied. Its claims are
+// available to rule expressions as claims.
+type ClientJWTConfig struct {
+	// JWKSURL is where the issuer publishes its signing keys
+	JWKSURL string `mapstructure:"jwks_url"`
+
+	// Issuer must match the iss claim
+	Issuer string `mapstructure:"issuer"`
+
+	// Audience, if set, must be one of the aud claim's values
+	Audience string `mapstructure:"audience"`
+
+	// Header carries the token (default authorization, as a bearer token)
+	Header string `mapstructure:"header"`
+
+	// Leeway tolerates clock skew in exp and nbf (default 30s)
+	Leeway time.Duration `mapstructure:"leeway"`
+
+	// Require is a rule expression calls must satisfy, e.g.
+	// claims.scope.contains("write") || !request.method.startsWith("cosmos.tx.")
+	Require string `mapstructure:"require"`
+
+	// Tokens select the upstream token by the call: the first whose
+	// expression matches replaces the endpoint's and the client's token
+	Tokens []ClaimTokenConfig `mapstructure:"tokens"`
+}
+
+// ClaimTokenConfig is an upstream token for the calls matching an
+// expression, e.g. claims.tenant == "acme"
+type ClaimTokenConfig struct {
+	When     string `mapstructure:"when"`
+	JWTToken string `mapstructure:"jwt_token"`
+}
+
+// defaultClientJWTLeeway is used when leeway is not configured
+const defaultClientJWTLeeway = 30 * time.Second
+
+// jwksRefreshInterval is how often the issuer's keys are re-read, and
+// jwksMissInterval how soon after the last attempt, failed or not, a token
+// signed by an unknown key may trigger another re-read
+const (
+	jwksRefreshInterval = time.Hour
+	jwksMissInterval    = 30 * time.Second
+)
+
+// header returns the lower-case name of the header carrying the token
+func (c *ClientJWTConfig) header() string {
+	if c.Header == "" {
+		return "authorization"
+	}
+	return strings.ToLower(c.Header)
+}
+
+// leeway returns the configured clock skew allowance or the default
+func (c *ClientJWTConfig) leeway() time.Duration {
+	if c.Leeway > 0 {
+		return c.Leeway
+	}
+	return defaultClientJWTLeeway
+}
+
+// validate checks the key source, issuer, header and token rules
+func (c *ClientJWTConfig) validate() error {
+	if u, err := url.Parse(c.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("client_jwt needs an http(s) jwks_url")
+	}
+	if c.Issuer == "" {
+		return fmt.Errorf("client_jwt needs an issuer")
+	}
+	if header := c.header(); header == apiKeyHeader || strings.HasPrefix(header, "grpc-") || strings.HasPrefix(header, ":") {
+		return fmt.Errorf("client_jwt may not use header %q", c.Header)
+	}
+	if c.Leeway < 0 {
+		return fmt.Errorf("client_jwt leeway must not be negative")
+	}
+	for i, t := range c.Tokens {
+		if t.When == "" {
+			return fmt.Errorf("client_jwt token %d needs when", i+1)
+		}
+		if t.JWTToken == "" || isPlaceholderToken(t.JWTToken) {
+			return fmt.Errorf("please set a valid JWT token for client_jwt token %d", i+1)
+		}
+	}
+	return nil
+}
+
+// claimToken is a ClaimTokenConfig with its compiled expression
+type claimToken struct {
+	when  *ruleExpr
+	token string
+}
+
+// clientJWT verifies the JWTs of local callers
+type clientJWT struct {
+	config  *ClientJWTConfig
+	header  string
+	require *ruleExpr
+	tokens  []claimToken
+
+	// keys holds the issuer's keys, replaced whole when re-read
+	keys atomic.Pointer[jwkSet]
+
+	// missMu coalesces the re-reads triggered by unknown keys; missed is
+	// when the last one was attempted
+	missMu sync.Mutex
+	missed time.Time
+}
+
+// jwkSet is the issuer's keys by key ID
+type jwkSet struct {
+	keys map[string]crypto.PublicKey
+}
+
+// newClientJWT compiles the expressions of config and reads the issuer's
+// keys
+func newClientJWT(config *ClientJWTConfig) (*clientJWT, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	v := &clientJWT{config: config, header: config.header()}
+	if config.Require != "" {
+		var err error
+		if v.require, err = compileExpr(config.Require); err != nil {
+			return nil, fmt.Errorf("client_jwt require: %v", err)
+		}
+	}
+	for i, t := range config.Tokens {
+		when, err := compileExpr(t.When)
+		if err != nil {
+			return nil, fmt.Errorf("client_jwt token %d: %v", i+1, err)
+		}
+		knownSecrets.add(t.JWTToken)
+		v.tokens = append(v.tokens, claimToken{when: when, token: t.JWTToken})
+	}
+	if err := v.fetchKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// fetchKeys re-reads the issuer's keys
+func (v *clientJWT) fetchKeys(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, oidcHTTPTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.config.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+	body, err := secretsDo(http.DefaultClient, req)
+	if err != nil {
+		return fmt.Errorf("failed to read client_jwt keys from %s: %v", redactURL(v.config.JWKSURL), err)
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return fmt.Errorf("invalid client_jwt keys at %s: %v", redactURL(v.config.JWKSURL), err)
+	}
+	v.keys.Store(&jwkSet{keys: keys})
+	return nil
+}
+
+// jsonWebKey is the subset of RFC 7517 fields needed for RSA and EC keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS decodes the signing keys of a JWK set. Keys of other types or
+// uses are skipped.
+func parseJWKS(body []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %q has an invalid modulus or exponent", k.Kid)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || errX != nil || errY != nil {
+				return nil, fmt.Errorf("key %q has an unsupported curve or invalid coordinates", k.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("key %q is not on its curve", k.Kid)
+			}
+			key = pub
+		default:
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+// verify checks the signature, issuer, audience and lifetime of a token
+// and returns its claims
+func (v *clientJWT) verify(ctx context.Context, token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding")
+	}
+
+	key, known := v.keys.Load().keys[header.Kid]
+	if !known {
+		key, known = v.missingKey(ctx, header.Kid, now)
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown signing key %q", header.Kid)
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	registered, err := DecodeToken(token)
+	if err != nil {
+		return nil, err
+	}
+	leeway := v.config.leeway()
+	switch {
+	case registered.ExpiresAt.IsZero():
+		return nil, fmt.Errorf("token has no exp")
+	case now.After(registered.ExpiresAt.Add(leeway)):
+		return nil, fmt.Errorf("token expired")
+	case !registered.NotBefore.IsZero() && now.Add(leeway).Before(registered.NotBefore):
+		return nil, fmt.Errorf("token is not valid yet")
+	case registered.Issuer != v.config.Issuer:
+		return nil, fmt.Errorf("token has issuer %q", registered.Issuer)
+	case v.config.Audience != "" && !slices.Contains(registered.Audience, v.config.Audience):
+		return nil, fmt.Errorf("token is not for audience %q", v.config.Audience)
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %v", err)
+	}
+	return claims, nil
+}
+
+// missingKey re-reads the issuer's keys for a key ID not among them, as the
+// issuer may have rotated to a key published since the last read. Callers
+// arriving while a re-read is running wait for it rather than starting
+// their own, and after an attempt, failed or not, no other is made for
+// jwksMissInterval, so tokens with made-up key IDs cannot flood the issuer.
+func (v *clientJWT) missingKey(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, bool) {
+	v.missMu.Lock()
+	defer v.missMu.Unlock()
+	if key, ok := v.keys.Load().keys[kid]; ok {
+		return key, true
+	}
+	if !v.missed.IsZero() && now.Sub(v.missed) <= jwksMissInterval {
+		return nil, false
+	}
+	v.missed = now
+	if err := v.fetchKeys(ctx); err != nil {
+		return nil, false
+	}
+	key, ok := v.keys.Load().keys[kid]
+	return key, ok
+}
+
+// verifyJWS checks a signature by alg, which must fit the key's type
+func verifyJWS(alg string, key crypto.PublicKey, input, sig []byte) error {
+	hash, ok := jwtHashes[alg[min(2, len(alg)):]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil {
+				return nil
+			}
+			return fmt.Errorf("invalid signature")
+		case "PS":
+			if rsa.VerifyPSS(k, hash, digest, sig, nil) == nil {
+				return nil
+			}
+			return fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return fmt.Errorf("invalid signature")
+		}
+	}
+	return fmt.Errorf("algorithm %q does not fit the signing key", alg)
+}
+
+// watchJWKS re-reads the issuer's keys until the server's upstreams are
+// closed. A failed read keeps the current keys.
+func (p *ProxyServer) watchJWKS() {
+	delay := jwksRefreshInterval
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(delay):
+		}
+		if err := p.clientJWT.fetchKeys(context.Background()); err != nil {
+			p.logf(levelWarn, "Keeping the client_jwt keys of %s: %v", p.config.Name, err)
+			p.metrics.Add("client_jwt_key_failures", 1)
+			delay = secretRetryDelay
+			continue
+		}
+		delay = jwksRefreshInterval
+	}
+}
+
+// callerJWT is the verified client JWT of a call and the upstream token its
+// claims selected, if any
+type callerJWT struct {
+	claims map[string]interface{}
+	token  string
+}
+
+// callerKey carries the callerJWT of a call or HTTP request
+type callerKey struct{}
+
+// callerFromContext returns the callerJWT stored by checkClientJWT, if any
+func callerFromContext(ctx context.Context) *callerJWT {
+	caller, _ := ctx.Value(callerKey{}).(*callerJWT)
+	return caller
+}
+
+// claimSet returns the caller's claims, nil without a client JWT
+func (c *callerJWT) claimSet() map[string]interface{} {
+	if c == nil {
+		return nil
+	}
+	return c.claims
+}
+
+// checkClientJWT verifies a call's token and checks require, returning the
+// caller with the upstream token its claims select
+func (p *ProxyServer) checkClientJWT(ctx context.Context, raw, method string, md metadata.MD, client string) (*callerJWT, error) {
+	v := p.clientJWT
+	token := raw
+	if v.header == "authorization" {
+		scheme, rest, found := strings.Cut(raw, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			token = ""
+		} else {
+			token = strings.TrimSpace(rest)
+		}
+	}
+	if token == "" {
+		p.metrics.Add("client_jwt_rejected", 1)
+		return nil, status.Errorf(codes.Unauthenticated, "missing client JWT in %s", v.header)
+	}
+	claims, err := v.verify(ctx, token, time.Now())
+	if err != nil {
+		p.metrics.Add("client_jwt_rejected", 1)
+		return nil, status.Errorf(codes.Unauthenticated, "invalid client JWT: %v", err)
+	}
+
+	env := p.callEnv(method, md, client, claims)
+	if v.require != nil && !v.require.matches(env) {
+		p.metrics.Add("client_jwt_denied", 1)
+		return nil, status.Errorf(codes.PermissionDenied, "client JWT does not allow %s on endpoint %s", method, p.config.Name)
+	}
+	caller := &callerJWT{claims: claims}
+	for _, t := range v.tokens {
+		if t.when.matches(env) {
+			caller.token = t.token
+			break
+		}
+	}
+	return caller, nil
+}
+
+// clientJWTInterceptor verifies the client JWT of every proxied call and
+// hands its claims down the chain. The token is not forwarded upstream.
+func (p *ProxyServer) clientJWTInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	// Health checks come from orchestrators, which hold no client JWT
+	if p.clientJWT == nil || strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+		return handler(srv, ss)
+	}
+	ctx := ss.Context()
+	// FromIncomingContext returns a copy, so it can be changed in place
+	md, _ := metadata.FromIncomingContext(ctx)
+	if md == nil {
+		md = metadata.MD{}
+	}
+	client, _, _ := p.clients.authenticate(ctx)
+	caller, err := p.checkClientJWT(ctx, headerValue(md, p.clientJWT.header), info.FullMethod, md, client.Name)
+	if err != nil {
+		return err
+	}
+	md.Delete(p.clientJWT.header)
+	ctx = context.WithValue(metadata.NewIncomingContext(ctx, md), callerKey{}, caller)
+	return handler(srv, &callerStream{ServerStream: ss, ctx: ctx})
+}
+
+// callerStream gives the rest of the chain the context carrying the caller
+type callerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *callerStream) Context() context.Context {
+	return s.ctx
+}
+
+// checkHTTPClientJWT is clientJWTInterceptor for HTTP requests, whose path
+// stands in for the method and headers for the metadata. It returns the
+// request to serve, carrying the caller.
+func (p *ProxyServer) checkHTTPClientJWT(r *http.Request, client string) (*http.Request, error) {
+	if p.clientJWT == nil {
+		return r, nil
+	}
+	md := make(metadata.MD, len(r.Header))
+	for key, values := range r.Header {
+		md[strings.ToLower(key)] = values
+	}
+	caller, err := p.checkClientJWT(r.Context(), r.Header.Get(p.clientJWT.header), r.URL.Path, md, client)
+	if err != nil {
+		return r, err
+	}
+	r = r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+	r.Header.Del(p.clientJWT.header)
+	return r, nil
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// apiKeyHeader is the metadata key local clients send their API key in
+const apiKeyHeader = "x-api-key"
+
+// ClientConfig names a local caller identified by its API key or client
+// certificate
+type ClientConfig struct {
+	Name   string `mapstructure:"name"`
+	APIKey string `mapstructure:"api_key"`
+
+	// CertNames identify the client by a verified client certificate whose
+	// common name, DNS name or URI matches one of them
+	CertNames []string `mapstructure:"cert_names"`
+
+	// JWTToken, when set, replaces the endpoint's token for this client's calls
+	JWTToken string `mapstructure:"jwt_token"`
+
+	// Tokens overrides JWTToken for individual endpoints, keyed by endpoint name
+	Tokens map[string]string `mapstructure:"tokens"`
+
+	// Quotas limit the client's calls or bytes per day or month
+	Quotas []QuotaConfig `mapstructure:"quotas"`
+
+	// Policies name the policies whose methods the client may call; a
+	// client without any may call every method
+	Policies []string `mapstructure:"policies"`
+
+	// policy combines Policies, resolved when the clients are set
+	policy *clientPolicy
+}
+
+// token returns the upstream JWT this client uses on the named endpoint, or
+// "" to use the endpoint's own token
+func (c ClientConfig) token(endpoint string) string {
+	for name, token := range c.Tokens {
+		// Viper lower-cases map keys, so endpoint names match case-insensitively
+		if strings.EqualFold(name, endpoint) {
+			return token
+		}
+	}
+	return c.JWTToken
+}
+
+// validateClients checks that every client has a name and a unique API key
+// or certificate names
+func validateClients(clients []ClientConfig, policies []PolicyConfig) error {
+	if err := validatePolicies(policies); err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(policies))
+	for _, p := range policies {
+		known[p.Name] = true
+	}
+	names := make(map[string]bool, len(clients))
+	keys := make(map[string]bool, len(clients))
+	certNames := make(map[string]bool)
+	for _, c := range clients {
+		if c.Name == "" {
+			return fmt.Errorf("client without a name")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate client name '%s'", c.Name)
+		}
+		names[c.Name] = true
+		if c.APIKey == "" && len(c.CertNames) == 0 {
+			return fmt.Errorf("please set an api_key or cert_names for client '%s'", c.Name)
+		}
+		if c.APIKey != "" {
+			if keys[c.APIKey] {
+				return fmt.Errorf("client '%s' reuses another client's api_key", c.Name)
+			}
+			keys[c.APIKey] = true
+		}
+		for _, name := range c.CertNames {
+			if name == "" {
+				return fmt.Errorf("client '%s' has an empty cert name", c.Name)
+			}
+			if certNames[name] {
+				return fmt.Errorf("client '%s' reuses cert name '%s'", c.Name, name)
+			}
+			certNames[name] = true
+		}
+		if isPlaceholderToken(c.JWTToken) {
+			return fmt.Errorf("please set a valid JWT token for client '%s'", c.Name)
+		}
+		for endpoint, token := range c.Tokens {
+			if token == "" || isPlaceholderToken(token) {
+				return fmt.Errorf("please set a valid JWT token for client '%s' on endpoint '%s'", c.Name, endpoint)
+			}
+		}
+		for _, q := range c.Quotas {
+			if err := q.validate(); err != nil {
+				return fmt.Errorf("client '%s': %v", c.Name, err)
+			}
+		}
+		for _, policy := range c.Policies {
+			if !known[policy] {
+				return fmt.Errorf("client '%s' has unknown policy '%s'", c.Name, policy)
+			}
+		}
+	}
+	return nil
+}
+
+// clientSet holds the API keys shared by all endpoints of a Manager. It is
+// swapped atomically on reload so revoked keys stop working without
+// restarting any endpoint.
+type clientSet struct {
+	index atomic.Pointer[clientIndex]
+}
+
+// clientIndex finds clients by API key and certificate name
+type clientIndex struct {
+	keys  map[string]ClientConfig
+	certs map[string]ClientConfig
+}
+
+// set replaces the known clients and the policies they hold
+func (s *clientSet) set(clients []ClientConfig, policies []PolicyConfig) {
+	index := &clientIndex{keys: make(map[string]ClientConfig, len(clients)), certs: make(map[string]ClientConfig)}
+	for _, c := range clients {
+		c.policy = newClientPolicy(c.Policies, policies)
+		if c.APIKey != "" {
+			index.keys[c.APIKey] = c
+		}
+		for _, name := range c.CertNames {
+			index.certs[name] = c
+		}
+	}
+	s.index.Store(index)
+}
+
+// authenticate returns the client calling with ctx's API key or, without
+// one, its verified client certificate. When no clients are configured
+// every call is allowed and ok is false.
+func (s *clientSet) authenticate(ctx context.Context) (client ClientConfig, ok bool, err error) {
+	if s == nil {
+		return ClientConfig{}, false, nil
+	}
+	var state *tls.ConnectionState
+	if pr, found := peer.FromContext(ctx); found {
+		if info, isTLS := pr.AuthInfo.(credentials.TLSInfo); isTLS {
+			state = &info.State
+		}
+	}
+	return s.authenticateKey(incomingHeader(ctx, apiKeyHeader), state)
+}
+
+// authenticateKey is authenticate for an API key taken from an HTTP header
+// on a connection with the given TLS state, nil for plaintext
+func (s *clientSet) authenticateKey(key string, state *tls.ConnectionState) (client ClientConfig, ok bool, err error) {
+	if s == nil {
+		return ClientConfig{}, false, nil
+	}
+	index := s.index.Load()
+	if index == nil || (len(index.keys) == 0 && len(index.certs) == 0) {
+		return ClientConfig{}, false, nil
+	}
+	if key == "" && len(index.certs) > 0 && state != nil && len(state.VerifiedChains) > 0 {
+		leaf := state.VerifiedChains[0][0]
+		for _, name := range certNames(leaf) {
+			if client, ok := index.certs[name]; ok {
+				return client, true, nil
+			}
+		}
+		return ClientConfig{}, false, status.Errorf(codes.Unauthenticated, "client certificate %q is not assigned to a client", leaf.Subject.CommonName)
+	}
+	if key == "" {
+		return ClientConfig{}, false, status.Errorf(codes.Unauthenticated, "missing %s", apiKeyHeader)
+	}
+	client, ok = index.keys[key]
+	if !ok {
+		return ClientConfig{}, false, status.Errorf(codes.Unauthenticated, "invalid %s", apiKeyHeader)
+	}
+	return client, true, nil
+}
+
+// certNames returns the names a client certificate can be assigned to a
+// client by: its common name, DNS names and URIs
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// upstreamToken returns the JWT to forward for a call: one its client JWT's
+// claims selected, the authenticated client's own token if it has one, else
+// the endpoint's
+func (p *ProxyServer) upstreamToken(ctx context.Context, client ClientConfig, ok bool) string {
+	if caller := callerFromContext(ctx); caller != nil && caller.token != "" {
+		return caller.token
+	}
+	if ok {
+		if token := client.token(p.config.Name); token != "" {
+			return token
+		}
+	}
+	return p.Token()
+}
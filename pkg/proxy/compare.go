@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// blockHeightHeader is the metadata key Cosmos nodes use to report the height a query was served at
+const blockHeightHeader = "x-cosmos-block-height"
+
+// defaultCompareTimeout bounds a shadow call when no timeout is configured
+const defaultCompareTimeout = 10 * time.Second
+
+// CompareConfig configures compare mode, where read-only calls are also sent
+// to a second upstream and any divergence in the responses is logged
+type CompareConfig struct {
+	RemoteAddress string        `mapstructure:"remote_address"`
+	UseTLS        bool          `mapstructure:"use_tls"`
+	JWTToken      string        `mapstructure:"jwt_token"`
+	Methods       []string      `mapstructure:"methods"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+}
+
+// matches reports whether fullMethodName is selected for comparison.
+// Without an explicit method list, only Cosmos Query services are compared.
+func (c *CompareConfig) matches(fullMethodName string) bool {
+	if len(c.Methods) == 0 {
+		service := strings.TrimPrefix(fullMethodName, "/")
+		if i := strings.Index(service, "/"); i >= 0 {
+			service = service[:i]
+		}
+		return strings.HasSuffix(service, ".Query")
+	}
+	return matchesMethod(c.Methods, fullMethodName)
+}
+
+// matchesMethod reports whether fullMethodName starts with one of prefixes;
+// prefixes may omit the leading slash
+func matchesMethod(prefixes []string, fullMethodName string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(fullMethodName, "/"+strings.TrimPrefix(prefix, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// callResult captures everything needed to compare one side of a proxied
+// call, or to replay it to callers sharing it
+type callResult struct {
+	header    metadata.MD
+	responses [][]byte
+	trailer   metadata.MD
+	err       error
+}
+
+// compareInterceptor records selected calls and replays them against the compare upstream
+func (p *ProxyServer) compareInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.compareConn == nil || !p.config.Compare.matches(info.FullMethod) {
+		return handler(srv, ss)
+	}
+
+	rec := &compareStream{
+		ServerStream: ss,
+		proxy:        p,
+		method:       info.FullMethod,
+		shadow:       make(chan *callResult, 1),
+	}
+	err := handler(srv, rec)
+
+	go p.reportDivergence(info.FullMethod, rec, err)
+
+	return err
+}
+
+// compareStream wraps the client-facing stream to capture request and response messages.
+// The shadow call starts as soon as the client has finished sending, so both upstreams
+// are queried concurrently.
+type compareStream struct {
+	grpc.ServerStream
+	proxy  *ProxyServer
+	method string
+
+	mu        sync.Mutex
+	requests  [][]byte
+	header    metadata.MD
+	responses [][]byte
+	started   bool
+	shadow    chan *callResult
+}
+
+func (s *compareStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		if b, ok := messageBytes(m); ok {
+			s.requests = append(s.requests, b)
+		}
+	} else if err == io.EOF && !s.started {
+		s.started = true
+		requests := s.requests
+		go func() {
+			s.shadow <- s.proxy.shadowCall(s.ServerStream.Context(), s.method, requests)
+		}()
+	}
+	return err
+}
+
+func (s *compareStream) SendHeader(md metadata.MD) error {
+	s.mu.Lock()
+	s.header = md.Copy()
+	s.mu.Unlock()
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *compareStream) SendMsg(m interface{}) error {
+	if b, ok := messageBytes(m); ok {
+		s.mu.Lock()
+		s.responses = append(s.responses, b)
+		s.mu.Unlock()
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// shadowCall replays the recorded requests against the compare upstream.
+// Messages are sent and received as raw frames, so both sides are compared
+// byte for byte.
+func (p *ProxyServer) shadowCall(parent context.Context, method string, requests [][]byte) *callResult {
+	timeout := p.config.Compare.Timeout
+	if timeout <= 0 {
+		timeout = defaultCompareTimeout
+	}
+	// Detach from the client's context so the shadow call is not cancelled when the primary completes
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Without a token of its own the shadow call carries the endpoint's credentials
+	token := p.config.Compare.JWTToken
+	var auth *upstreamAuth
+	if token == "" {
+		// The primary call was already authenticated, so this only selects the caller's token
+		client, ok, _ := p.clients.authenticate(parent)
+		token, auth = p.upstreamToken(parent, client, ok), p.auth
+	}
+	// FromIncomingContext returns a copy, so outgoingMetadata may change it
+	inMD, _ := metadata.FromIncomingContext(parent)
+	if inMD == nil {
+		inMD = metadata.MD{}
+	}
+	ctx = metadata.NewOutgoingContext(ctx, p.outgoingMetadata(inMD, method, token, auth))
+
+	result := &callResult{}
+	stream, err := p.compareConn.NewStream(ctx, forwardStreamDesc, method, grpc.ForceCodecV2(codec))
+	if err != nil {
+		result.err = err
+		return result
+	}
+	for _, req := range requests {
+		if err := stream.SendMsg(&frame{payload: mem.BufferSlice{mem.SliceBuffer(req)}}); err != nil {
+			break
+		}
+	}
+	stream.CloseSend()
+
+	resp := &frame{}
+	for {
+		if err := stream.RecvMsg(resp); err != nil {
+			if err != io.EOF {
+				result.err = err
+			}
+			break
+		}
+		result.responses = append(result.responses, resp.payload.Materialize())
+	}
+	resp.release()
+	result.header, _ = stream.Header()
+	return result
+}
+
+// reportDivergence waits for the shadow call and logs any difference from the primary response
+func (p *ProxyServer) reportDivergence(method string, s *compareStream, primaryErr error) {
+	s.mu.Lock()
+	started := s.started
+	primary := &callResult{header: s.header, responses: s.responses, err: primaryErr}
+	s.mu.Unlock()
+
+	// The client never half-closed, so there is nothing meaningful to replay
+	if !started {
+		return
+	}
+	shadow := <-s.shadow
+
+	p.metrics.Add("compare_total", 1)
+
+	primaryCode, shadowCode := status.Code(primary.err), status.Code(shadow.err)
+	if primaryCode != shadowCode {
+		p.metrics.Add("compare_status_mismatch", 1)
+		p.logf(levelWarn, "[compare] %s %s: status differs: primary=%s compare=%s (%v)",
+			p.config.Name, method, primaryCode, shadowCode, shadow.err)
+		return
+	}
+
+	primaryHeight, shadowHeight := headerValue(primary.header, blockHeightHeader), headerValue(shadow.header, blockHeightHeader)
+	if primaryHeight != shadowHeight {
+		p.metrics.Add("compare_height_mismatch", 1)
+		p.logf(levelWarn, "[compare] %s %s: height differs: primary=%s compare=%s",
+			p.config.Name, method, primaryHeight, shadowHeight)
+		return
+	}
+
+	if !equalResponses(primary.responses, shadow.responses) {
+		p.metrics.Add("compare_data_mismatch", 1)
+		p.logf(levelWarn, "[compare] %s %s: response data differs at height %s: primary=%d msgs/%d bytes compare=%d msgs/%d bytes",
+			p.config.Name, method, primaryHeight,
+			len(primary.responses), totalSize(primary.responses),
+			len(shadow.responses), totalSize(shadow.responses))
+		return
+	}
+
+	p.metrics.Add("compare_match", 1)
+}
+
+// headerValue returns the first value of key in md, or "" if it is absent
+func headerValue(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// incomingHeader returns the first value of an incoming metadata key
+// without copying the rest of the call's metadata
+func incomingHeader(ctx context.Context, key string) string {
+	if v := metadata.ValueFromIncomingContext(ctx, key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func equalResponses(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func totalSize(msgs [][]byte) int {
+	n := 0
+	for _, m := range msgs {
+		n += len(m)
+	}
+	return n
+}
@@ -0,0 +1,473 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config represents the configuration for a single endpoint
+type Config struct {
+	Name string `mapstructure:"name"`
+
+	// Groups tag the endpoint so --only and --exclude can select it along
+	// with others, e.g. "cosmos" or "mainnet"
+	Groups []string `mapstructure:"groups"`
+
+	// Type is grpc (default) or http, which reverse-proxies HTTP and
+	// WebSocket traffic to a remote_address URL such as a CometBFT RPC host
+	Type string `mapstructure:"type"`
+
+	BindAddress   string `mapstructure:"bind_address"`
+	LocalPort     int    `mapstructure:"local_port"`
+	RemoteAddress string `mapstructure:"remote_address"`
+	UseTLS        bool   `mapstructure:"use_tls"`
+
+	// AllowedCIDRs and DeniedCIDRs restrict which client networks may connect
+	AllowedCIDRs []string `mapstructure:"allowed_cidrs"`
+	DeniedCIDRs  []string `mapstructure:"denied_cidrs"`
+
+	// ClientJWT makes callers present a JWT from a trusted issuer, whose
+	// claims rule expressions can then use
+	ClientJWT *ClientJWTConfig `mapstructure:"client_jwt"`
+
+	// AllowedMethods and DeniedMethods restrict which methods clients may
+	// call, by full method name prefix; reflection hides the others
+	AllowedMethods []string `mapstructure:"allowed_methods"`
+	DeniedMethods  []string `mapstructure:"denied_methods"`
+
+	// ListenAddress overrides bind_address/local_port, e.g. "unix:///run/grpc-proxy/cosmos.sock"
+	ListenAddress string `mapstructure:"listen_address"`
+	JWTToken      string `mapstructure:"jwt_token"`
+
+	// JWTTokenRef reads the token from a secrets backend instead, e.g.
+	// "vault:secret/data/chandra#cosmos_token"
+	JWTTokenRef string `mapstructure:"jwt_token_ref"`
+
+	// Auth selects how calls authenticate to the upstream, by default with
+	// jwt_token as a bearer token
+	Auth *UpstreamAuthConfig `mapstructure:"auth"`
+
+	// MintJWT signs short-lived tokens for the upstream in place of
+	// jwt_token
+	MintJWT *MintJWTConfig `mapstructure:"mint_jwt"`
+
+	// OIDC obtains the token from an OpenID Connect provider after
+	// grpc-proxy login, in place of jwt_token
+	OIDC *OIDCConfig `mapstructure:"oidc"`
+
+	// TokenRefresh renews jwt_token with a refresh token before it expires
+	TokenRefresh *TokenRefreshConfig `mapstructure:"token_refresh"`
+
+	// CAFile, ServerName and InsecureSkipVerify customise upstream TLS
+	// verification, e.g. for staging gateways with self-signed certificates
+	CAFile             string `mapstructure:"ca_file"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+
+	// CARef reads the PEM CA bundle from a secrets backend instead of ca_file
+	CARef string `mapstructure:"ca_ref"`
+
+	// UpstreamProtocol is tls, h2c or alts; empty follows use_tls
+	UpstreamProtocol string `mapstructure:"upstream_protocol"`
+
+	// AuthorityOverride sets the :authority (and TLS server name) sent
+	// upstream when it must differ from the dialed address
+	AuthorityOverride string `mapstructure:"authority_override"`
+
+	// ResolveTo pins the upstream to these host:port addresses instead of
+	// resolving remote_address, which is still used for TLS verification
+	ResolveTo []string `mapstructure:"resolve_to"`
+
+	// ExpectedChainID makes the proxy check the chain-id reported by the
+	// upstream's GetNodeInfo at startup and every ChainIDCheckInterval
+	// (default 5m), and refuse calls while it does not match
+	ExpectedChainID      string        `mapstructure:"expected_chain_id"`
+	ChainIDCheckInterval time.Duration `mapstructure:"chain_id_check_interval"`
+
+	// Freshness optionally reports NOT_SERVING while an upstream lags behind
+	Freshness *FreshnessConfig `mapstructure:"freshness"`
+
+	// OutlierDetection optionally balances calls over the upstream's
+	// addresses and ejects degraded ones for a while
+	OutlierDetection *OutlierDetectionConfig `mapstructure:"outlier_detection"`
+
+	// Affinity optionally balances calls over the upstream's addresses
+	// while keeping each client on one of them
+	Affinity *AffinityConfig `mapstructure:"affinity"`
+
+	// WebSocket optionally supervises the WebSocket connections of an http
+	// endpoint, reconnecting dropped upstreams and replaying subscriptions
+	WebSocket *WebSocketConfig `mapstructure:"websocket"`
+
+	// Cache optionally caches the responses of selected methods
+	Cache *CacheConfig `mapstructure:"cache"`
+
+	// Dedup optionally collapses identical concurrent calls into one upstream call
+	Dedup *DedupConfig `mapstructure:"dedup"`
+
+	// Connect tunes upstream connection establishment and reconnect backoff
+	Connect ConnectConfig `mapstructure:"connect"`
+
+	// MaxConcurrentStreams caps proxied calls in flight; further calls fail
+	// fast with RESOURCE_EXHAUSTED (0 = unlimited)
+	MaxConcurrentStreams int `mapstructure:"max_concurrent_streams"`
+
+	// DiagnosticHeaders adds x-proxy-endpoint, x-upstream-address,
+	// x-proxy-duration-ms and x-cache-status to responses
+	DiagnosticHeaders bool `mapstructure:"diagnostic_headers"`
+
+	// SlowRequestThreshold logs a warning for every call that takes longer,
+	// naming its method, sizes, client and peer (0 = off)
+	SlowRequestThreshold time.Duration `mapstructure:"slow_request_threshold"`
+
+	// LogLevel is debug, info (default), warn or error. It hides this
+	// endpoint's less important log lines; debug also logs every call.
+	LogLevel string `mapstructure:"log_level"`
+
+	// LogSampling logs only a percentage of calls at debug level
+	LogSampling *LogSamplingConfig `mapstructure:"log_sampling"`
+
+	// MetricTags are added to this endpoint's metrics sent to DogStatsD,
+	// e.g. "chain:cosmoshub-4"
+	MetricTags []string `mapstructure:"metric_tags"`
+
+	// Compression names the compressor used for upstream calls (e.g. "gzip")
+	Compression string `mapstructure:"compression"`
+
+	// Fallbacks are lower-priority upstreams, in order, used while every
+	// upstream above them is unreachable
+	Fallbacks []FallbackConfig `mapstructure:"fallbacks"`
+
+	// Routes send selected method prefixes to other upstreams; calls that
+	// match no route go to remote_address
+	Routes []RouteConfig `mapstructure:"routes"`
+
+	// Compare optionally shadows read-only calls to a second upstream
+	Compare *CompareConfig `mapstructure:"compare"`
+
+	// Hedge optionally sends slow single-request calls to a second upstream
+	// as well and returns the first answer
+	Hedge *HedgeConfig `mapstructure:"hedge"`
+
+	// REST optionally exposes a companion Cosmos LCD/REST listener
+	REST *RESTConfig `mapstructure:"rest"`
+
+	// Capture optionally records proxied calls to a file for replay
+	Capture *CaptureConfig `mapstructure:"capture"`
+
+	// MessageLog optionally logs decoded messages of selected methods
+	MessageLog *MessageLogConfig `mapstructure:"message_log"`
+
+	// DescriptorSet is a compiled FileDescriptorSet describing the upstream's
+	// services, used instead of upstream reflection when set
+	DescriptorSet string `mapstructure:"descriptor_set"`
+
+	// ReflectionCache optionally answers server reflection from a local
+	// cache of the upstream's responses
+	ReflectionCache *ReflectionCacheConfig `mapstructure:"reflection_cache"`
+
+	// Faults optionally injects delays, aborts and connection resets
+	Faults *FaultConfig `mapstructure:"faults"`
+
+	// SizeLimits optionally caps request and response sizes
+	SizeLimits *SizeLimitsConfig `mapstructure:"size_limits"`
+
+	// Errors optionally rewrites upstream errors and attaches the endpoint
+	// name to them
+	Errors *ErrorsConfig `mapstructure:"errors"`
+
+	// Lanes isolate traffic selected by LaneHeader (default x-proxy-lane)
+	LaneHeader string       `mapstructure:"lane_header"`
+	Lanes      []LaneConfig `mapstructure:"lanes"`
+
+	// HeaderRules change the metadata sent upstream for calls matching
+	// their expressions
+	HeaderRules []HeaderRuleConfig `mapstructure:"header_rules"`
+
+	// SLOs track latency objectives for selected methods
+	SLOs []SLOConfig `mapstructure:"slos"`
+
+	// TLS serves the endpoint's listeners over TLS
+	TLS *ListenerTLSConfig `mapstructure:"tls"`
+
+	// Processor inspects and changes every call, e.g. for custom
+	// authorization
+	Processor *ProcessorConfig `mapstructure:"processor"`
+
+	// MethodMetrics optionally counts calls, status codes and latency per
+	// method
+	MethodMetrics *MethodMetricsConfig `mapstructure:"method_metrics"`
+}
+
+// ProxyConfig represents the entire proxy configuration
+type ProxyConfig struct {
+	Endpoints []Config `mapstructure:"endpoints"`
+
+	// PortRange, e.g. "9100-9199", supplies local ports to endpoints that
+	// set neither local_port nor listen_address
+	PortRange string `mapstructure:"port_range"`
+
+	// SecurityMode is standard (default) or deny_by_default; see
+	// SecurityDenyByDefault
+	SecurityMode string `mapstructure:"security_mode"`
+
+	// StartupPolicy is strict or partial; see StartupStrict and
+	// StartupPartial. By default endpoints that cannot be created or bind
+	// stop the start, and only required upstreams must be reachable.
+	StartupPolicy string `mapstructure:"startup_policy"`
+
+	// Supervision tunes restarts of endpoints that stop serving
+	Supervision SupervisionConfig `mapstructure:"supervision"`
+
+	// ShutdownTimeout bounds how long active streams may drain on shutdown
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	// DNS tunes upstream name resolution for all endpoints
+	DNS DNSConfig `mapstructure:"dns"`
+
+	// ConnectionLimits caps client connections per IP and in total
+	ConnectionLimits ConnectionLimits `mapstructure:"connection_limits"`
+
+	// Clients, when set, require local callers to send a known API key
+	Clients []ClientConfig `mapstructure:"clients"`
+
+	// Policies are roles restricting the methods clients may call
+	Policies []PolicyConfig `mapstructure:"policies"`
+
+	// ACME obtains listener certificates for endpoints with tls acme_hosts
+	ACME *ACMEConfig `mapstructure:"acme"`
+
+	// Admin optionally exposes the ProxyAdmin gRPC service on a management port
+	Admin *AdminConfig `mapstructure:"admin"`
+
+	// Secrets configures the backends that resolve jwt_token_ref
+	Secrets SecretsConfig `mapstructure:"secrets"`
+
+	// Audit optionally records configuration, token and admin changes
+	Audit *AuditConfig `mapstructure:"audit"`
+
+	// Usage optionally records calls, errors and bytes per client and endpoint
+	Usage *UsageConfig `mapstructure:"usage"`
+
+	// Redis optionally shares lane rate limits and client quotas between
+	// replicas of the proxy
+	Redis *RedisConfig `mapstructure:"redis"`
+
+	// Alerts optionally posts upstream failures, expiring tokens and
+	// rejected reloads to webhooks
+	Alerts *AlertsConfig `mapstructure:"alerts"`
+
+	// Statsd optionally pushes every endpoint's metrics to a statsd or
+	// DogStatsD agent
+	Statsd *StatsdConfig `mapstructure:"statsd"`
+
+	// Log optionally sends the log to a rotated file, syslog or journald
+	// instead of stderr
+	Log *LogConfig `mapstructure:"log"`
+
+	// Runtime optionally overrides the GOMAXPROCS and memory limit taken
+	// from the container
+	Runtime *RuntimeConfig `mapstructure:"runtime"`
+}
+
+// DefaultShutdownTimeout is used when shutdown_timeout is not configured
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout returns the configured shutdown timeout or the default
+func (c *ProxyConfig) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout > 0 {
+		return c.ShutdownTimeout
+	}
+	return DefaultShutdownTimeout
+}
+
+// isPlaceholderToken reports whether token is a placeholder such as the ones
+// in config.example.yaml or written by grpc-proxy init and import, "your_<name>_jwt_token_here"
+func isPlaceholderToken(token string) bool {
+	return strings.HasPrefix(token, "your_") && strings.HasSuffix(token, "_jwt_token_here")
+}
+
+// Validate checks that an endpoint is usable
+func (c Config) Validate() error {
+	for _, g := range c.Groups {
+		if strings.TrimSpace(g) == "" || strings.Contains(g, ",") {
+			return fmt.Errorf("endpoint '%s' has an invalid group %q", c.Name, g)
+		}
+	}
+	if err := validateMetricTags("endpoint '"+c.Name+"' metric_tags", c.MetricTags); err != nil {
+		return err
+	}
+	if c.CARef != "" {
+		if c.CAFile != "" {
+			return fmt.Errorf("endpoint '%s' sets both ca_file and ca_ref", c.Name)
+		}
+		if _, _, err := parseSecretRef(c.CARef); err != nil {
+			return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+		}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(); err != nil {
+			return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+		}
+	}
+	if err := c.Auth.validate(); err != nil {
+		return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+	}
+	if c.ClientJWT != nil {
+		if err := c.ClientJWT.validate(); err != nil {
+			return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+		}
+	}
+	if c.TokenRefresh != nil {
+		if c.JWTTokenRef != "" || c.MintJWT != nil || c.OIDC != nil {
+			return fmt.Errorf("endpoint '%s' sets token_refresh with jwt_token_ref, mint_jwt or oidc", c.Name)
+		}
+		if err := c.TokenRefresh.validate(); err != nil {
+			return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+		}
+		return nil
+	}
+	if c.OIDC != nil {
+		if c.JWTToken != "" || c.JWTTokenRef != "" || c.MintJWT != nil {
+			return fmt.Errorf("endpoint '%s' sets oidc with jwt_token, jwt_token_ref or mint_jwt", c.Name)
+		}
+		if err := c.OIDC.validate(c.Name); err != nil {
+			return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+		}
+		return nil
+	}
+	if c.MintJWT != nil {
+		if c.JWTToken != "" || c.JWTTokenRef != "" {
+			return fmt.Errorf("endpoint '%s' sets both mint_jwt and a jwt_token", c.Name)
+		}
+		if err := c.MintJWT.validate(); err != nil {
+			return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+		}
+		return nil
+	}
+	if c.JWTTokenRef != "" {
+		if c.JWTToken != "" {
+			return fmt.Errorf("endpoint '%s' sets both jwt_token and jwt_token_ref", c.Name)
+		}
+		if _, _, err := parseSecretRef(c.JWTTokenRef); err != nil {
+			return fmt.Errorf("endpoint '%s': %v", c.Name, err)
+		}
+		return nil
+	}
+	// A signature or a basic auth password may be all the upstream needs
+	if c.JWTToken == "" && !c.Auth.needsToken() {
+		return nil
+	}
+	if c.JWTToken == "" || isPlaceholderToken(c.JWTToken) {
+		return fmt.Errorf("please set a valid JWT token for endpoint '%s'", c.Name)
+	}
+	return nil
+}
+
+// Validate checks the proxy configuration and every endpoint in it
+func (c *ProxyConfig) Validate() error {
+	if len(c.Endpoints) == 0 {
+		return fmt.Errorf("no endpoints configured")
+	}
+	names := make(map[string]bool, len(c.Endpoints))
+	for _, e := range c.Endpoints {
+		if names[e.Name] {
+			return fmt.Errorf("duplicate endpoint name '%s'", e.Name)
+		}
+		names[e.Name] = true
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.PortRange != "" {
+		if _, _, err := parsePortRange(c.PortRange); err != nil {
+			return err
+		}
+	}
+	if err := c.validateListeners(); err != nil {
+		return err
+	}
+	if err := c.validateStartupPolicy(); err != nil {
+		return err
+	}
+	if err := c.validateSecurityMode(); err != nil {
+		return err
+	}
+	if err := c.validateACME(); err != nil {
+		return err
+	}
+	if err := c.Supervision.validate(); err != nil {
+		return err
+	}
+	if c.Log != nil {
+		if err := c.Log.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Statsd != nil {
+		if err := c.Statsd.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Runtime != nil {
+		if err := c.Runtime.validate(); err != nil {
+			return err
+		}
+	}
+	return validateClients(c.Clients, c.Policies)
+}
+
+// defaultBindAddress keeps listeners private unless an endpoint opts in to wider exposure
+const defaultBindAddress = "127.0.0.1"
+
+// listenAddress returns the host:port a listener binds to
+func listenAddress(bindAddress string, port int) string {
+	if bindAddress == "" {
+		bindAddress = defaultBindAddress
+	}
+	return net.JoinHostPort(bindAddress, strconv.Itoa(port))
+}
+
+// Address returns the address the endpoint's gRPC listener binds to
+func (c Config) Address() string {
+	if c.ListenAddress != "" {
+		return c.ListenAddress
+	}
+	return listenAddress(c.BindAddress, c.LocalPort)
+}
+
+// unixScheme prefixes addresses that refer to a unix domain socket
+const unixScheme = "unix://"
+
+// listen opens a listener for a host:port or unix:///path address. A stale
+// socket file left behind by an unclean exit is removed first; a socket
+// another process still accepts connections on is left alone.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixScheme)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", path, syscall.EADDRINUSE)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("failed to check socket %s: %v", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
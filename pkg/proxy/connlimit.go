@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"sync"
+)
+
+// ConnectionLimits caps simultaneous client connections across all endpoints
+type ConnectionLimits struct {
+	// PerIP caps connections from a single client IP (0 = unlimited)
+	PerIP int `mapstructure:"per_ip"`
+
+	// Total caps connections across all clients (0 = unlimited)
+	Total int `mapstructure:"total"`
+}
+
+// connLimiter counts open connections per client IP. One limiter is shared by
+// every listener of a Manager, so a single client cannot exhaust the host's
+// connections by spreading them over several endpoints.
+type connLimiter struct {
+	mu     sync.Mutex
+	limits ConnectionLimits
+	perIP  map[string]int
+	total  int
+
+	// rejecting remembers IPs that are over the limit so each episode is logged once
+	rejecting map[string]bool
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		perIP:     make(map[string]int),
+		rejecting: make(map[string]bool),
+	}
+}
+
+// setLimits replaces the limits; connections that are already open are kept
+func (l *connLimiter) setLimits(limits ConnectionLimits) {
+	l.mu.Lock()
+	l.limits = limits
+	l.mu.Unlock()
+}
+
+// acquire reserves a connection slot for ip, returning false if a limit is reached
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.Total > 0 && l.total >= l.limits.Total {
+		return false
+	}
+	if ip != "" && l.limits.PerIP > 0 && l.perIP[ip] >= l.limits.PerIP {
+		if !l.rejecting[ip] {
+			l.rejecting[ip] = true
+			log.Printf("Client %s reached the limit of %d connections, rejecting new ones", ip, l.limits.PerIP)
+		}
+		return false
+	}
+	l.total++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	return true
+}
+
+// release frees a slot reserved by acquire
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if ip == "" {
+		return
+	}
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	delete(l.rejecting, ip)
+}
+
+// limitListener closes accepted connections that exceed the limiter's caps
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+	metrics *expvar.Map
+}
+
+// Accept returns the next connection within the limits, closing any that are over
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(conn)
+		if !l.limiter.acquire(ip) {
+			l.metrics.Add("connections_rejected", 1)
+			conn.Close()
+			continue
+		}
+		l.metrics.Add("connections", 1)
+		return &limitConn{Conn: conn, release: func() {
+			l.limiter.release(ip)
+			l.metrics.Add("connections", -1)
+		}}, nil
+	}
+}
+
+// limitConn releases its slot exactly once when closed
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// remoteIP returns the client IP of a TCP connection, or "" for unix sockets
+func remoteIP(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
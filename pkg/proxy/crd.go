@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// EndpointCRDGroup and EndpointCRDVersion identify the
+	// ChandraProxyEndpoint custom resource
+	EndpointCRDGroup   = "grpcproxy.chandrastation.com"
+	EndpointCRDVersion = "v1alpha1"
+
+	// endpointCRDResource is the plural resource name of ChandraProxyEndpoint
+	endpointCRDResource = "chandraproxyendpoints"
+
+	// serviceAccountDir is where Kubernetes mounts a pod's service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// crdWatchTimeoutSeconds is how long the API server keeps a watch open
+	crdWatchTimeoutSeconds = 300
+)
+
+// KubernetesSourceConfig locates the API server. Unset fields default to
+// the pod's in-cluster service account.
+type KubernetesSourceConfig struct {
+	// APIServer defaults to https://$KUBERNETES_SERVICE_HOST:$KUBERNETES_SERVICE_PORT
+	APIServer string
+
+	// Namespace defaults to the pod's namespace
+	Namespace string
+
+	// TokenFile and CAFile default to the service account's
+	TokenFile string
+	CAFile    string
+}
+
+// KubernetesEndpointSource lists the ChandraProxyEndpoint objects of a
+// namespace through the Kubernetes API and watches them for changes
+type KubernetesEndpointSource struct {
+	apiServer string
+	namespace string
+	tokenFile string
+	client    *http.Client
+
+	// resourceVersion is where the next watch starts
+	mu              sync.Mutex
+	resourceVersion string
+}
+
+// NewKubernetesEndpointSource creates a source for config, filling in the
+// pod's service account for unset fields
+func NewKubernetesEndpointSource(config KubernetesSourceConfig) (*KubernetesEndpointSource, error) {
+	if config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+		}
+		config.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if config.Namespace == "" {
+		namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pod's namespace: %v", err)
+		}
+		config.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if config.TokenFile == "" {
+		config.TokenFile = filepath.Join(serviceAccountDir, "token")
+	}
+	if config.CAFile == "" && strings.HasPrefix(config.APIServer, "https://") {
+		config.CAFile = filepath.Join(serviceAccountDir, "ca.crt")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the Kubernetes CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &KubernetesEndpointSource{
+		apiServer: strings.TrimSuffix(config.APIServer, "/"),
+		namespace: config.Namespace,
+		tokenFile: config.TokenFile,
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// String names the watched resources
+func (s *KubernetesEndpointSource) String() string {
+	return endpointCRDResource + "." + EndpointCRDGroup + " in namespace " + s.namespace
+}
+
+// endpointObject is the part of a ChandraProxyEndpoint the proxy reads
+type endpointObject struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec map[string]interface{} `json:"spec"`
+}
+
+// get sends a GET to path of the custom resource's API with query
+func (s *KubernetesEndpointSource) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	u := fmt.Sprintf("%s/apis/%s/%s/namespaces/%s/%s?%s", s.apiServer, EndpointCRDGroup, EndpointCRDVersion,
+		url.PathEscape(s.namespace), endpointCRDResource, query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Re-read the token on every request, as the kubelet rotates it
+	if token, err := os.ReadFile(s.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(msg, &status) == nil && status.Message != "" {
+			return nil, fmt.Errorf("kubernetes API returned %s: %s", resp.Status, status.Message)
+		}
+		return nil, fmt.Errorf("kubernetes API returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// Endpoints lists the ChandraProxyEndpoint objects and returns their specs
+// as raw endpoint configurations, ordered by name. An endpoint is named
+// after its object unless its spec sets a name.
+func (s *KubernetesEndpointSource) Endpoints(ctx context.Context) ([]map[string]interface{}, error) {
+	resp, err := s.get(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointObject `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid %s list: %v", endpointCRDResource, err)
+	}
+
+	endpoints := make([]map[string]interface{}, 0, len(list.Items))
+	for _, item := range list.Items {
+		endpoint := make(map[string]interface{}, len(item.Spec)+1)
+		for key, value := range item.Spec {
+			endpoint[strings.ToLower(key)] = value
+		}
+		if name, _ := endpoint["name"].(string); name == "" {
+			endpoint["name"] = item.Metadata.Name
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i]["name"].(string) < endpoints[j]["name"].(string)
+	})
+	s.setResourceVersion(list.Metadata.ResourceVersion)
+	return endpoints, nil
+}
+
+// setResourceVersion records where the next watch starts
+func (s *KubernetesEndpointSource) setResourceVersion(version string) {
+	s.mu.Lock()
+	s.resourceVersion = version
+	s.mu.Unlock()
+}
+
+// Watch blocks until a ChandraProxyEndpoint is added, changed or deleted
+// after the last list or watch. When the API server ends the watch, it is
+// reopened. After an error the next watch starts from the current state,
+// which reports every object as added.
+func (s *KubernetesEndpointSource) Watch(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		version := s.resourceVersion
+		s.mu.Unlock()
+		changed, err := s.watch(ctx, version)
+		if err != nil {
+			s.setResourceVersion("")
+			return err
+		}
+		if changed {
+			return nil
+		}
+	}
+}
+
+// watch reads one watch stream, reporting whether it saw a change before
+// the API server ended it
+func (s *KubernetesEndpointSource) watch(ctx context.Context, version string) (bool, error) {
+	query := url.Values{"watch": {"1"}, "timeoutSeconds": {fmt.Sprint(crdWatchTimeoutSeconds)}}
+	if version != "" {
+		query.Set("resourceVersion", version)
+	}
+	resp, err := s.get(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("%s watch ended: %v", endpointCRDResource, err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var object endpointObject
+			if err := json.Unmarshal(event.Object, &object); err == nil && object.Metadata.ResourceVersion != "" {
+				s.setResourceVersion(object.Metadata.ResourceVersion)
+			}
+			return true, nil
+		case "ERROR":
+			var status struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			return false, fmt.Errorf("%s watch failed: %s", endpointCRDResource, status.Message)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// DedupConfig collapses identical calls that are in flight at the same
+// time into a single upstream call whose response is sent to every caller
+type DedupConfig struct {
+	// Methods limits deduplication to these full method name prefixes
+	// (default all). Only calls sending a single request are deduplicated.
+	Methods []string `mapstructure:"methods"`
+}
+
+func (c *DedupConfig) matches(fullMethodName string) bool {
+	return len(c.Methods) == 0 || matchesMethod(c.Methods, fullMethodName)
+}
+
+// dedupCall is an upstream call shared by identical concurrent calls
+type dedupCall struct {
+	done   chan struct{}
+	result *callResult
+}
+
+// dedupGroup tracks the shared calls in flight by key
+type dedupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*dedupCall
+}
+
+// join returns the call in flight for key, or starts one and reports that
+// the caller leads it
+func (g *dedupGroup) join(key string) (*dedupCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*dedupCall)
+	}
+	call := &dedupCall{done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+// finish publishes the leader's result to the waiting callers
+func (g *dedupGroup) finish(key string, call *dedupCall, result *callResult) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	call.result = result
+	close(call.done)
+}
+
+// dedupInterceptor lets the first of several identical calls reach the
+// upstream and answers the others with a copy of its response
+func (p *ProxyServer) dedupInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.config.Dedup == nil || !p.config.Dedup.matches(info.FullMethod) || p.isLocalService(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	req, stream, ok := singleRequest(ss)
+	if !ok {
+		return handler(srv, stream)
+	}
+	key, ok := p.callKey(ss.Context(), info.FullMethod, req)
+	if !ok {
+		return handler(srv, stream)
+	}
+
+	call, leader := p.dedup.join(key)
+	if !leader {
+		select {
+		case <-call.done:
+		case <-ss.Context().Done():
+			return status.FromContextError(ss.Context().Err()).Err()
+		}
+		// A leader whose client went away takes the shared call with it
+		if status.Code(call.result.err) != codes.Canceled {
+			p.metrics.Add("dedup_shared", 1)
+			return call.result.replay(ss)
+		}
+		return handler(srv, stream)
+	}
+
+	rec := newRecordStream(stream)
+	err := handler(srv, rec)
+	p.dedup.finish(key, call, rec.finish(err))
+	return err
+}
+
+// singleRequest reads the request of a call that sends exactly one. It
+// returns the stream to hand the handler, which replays what was read, and
+// false when the client sent none or more than one.
+func singleRequest(ss grpc.ServerStream) (proto.Message, grpc.ServerStream, bool) {
+	req := &emptypb.Empty{}
+	if err := ss.RecvMsg(req); err != nil {
+		return nil, &replayStream{ServerStream: ss, err: err}, false
+	}
+	next := &emptypb.Empty{}
+	if err := ss.RecvMsg(next); err != io.EOF {
+		if err != nil {
+			return nil, &replayStream{ServerStream: ss, requests: []proto.Message{req}, err: err}, false
+		}
+		return nil, &replayStream{ServerStream: ss, requests: []proto.Message{req, next}, passThrough: true}, false
+	}
+	return req, &replayStream{ServerStream: ss, requests: []proto.Message{req}, err: io.EOF}, true
+}
+
+// callKey identifies a single-request call by method, request, block height
+// header and upstream token. It returns false when the caller cannot be
+// authenticated, leaving the director to reject the call.
+func (p *ProxyServer) callKey(ctx context.Context, fullMethodName string, req proto.Message) (string, bool) {
+	client, ok, err := p.clients.authenticate(ctx)
+	if err != nil {
+		return "", false
+	}
+	payload, _ := proto.Marshal(req)
+	md, _ := metadata.FromIncomingContext(ctx)
+	return strings.Join([]string{fullMethodName, headerValue(md, blockHeightHeader), p.upstreamToken(ctx, client, ok), string(payload)}, "\x00"), true
+}
+
+// isLocalService reports whether the proxy serves fullMethodName itself,
+// like health and reflection, rather than proxying it
+func (p *ProxyServer) isLocalService(fullMethodName string) bool {
+	service, _, _ := strings.Cut(strings.TrimPrefix(fullMethodName, "/"), "/")
+	_, ok := p.server.GetServiceInfo()[service]
+	return ok
+}
+
+// replay sends a shared call's header, responses and trailer to ss and
+// returns its status
+func (r *callResult) replay(ss grpc.ServerStream) error {
+	if r.header != nil {
+		if err := ss.SendHeader(r.header); err != nil {
+			return err
+		}
+	}
+	for _, b := range r.responses {
+		m := &emptypb.Empty{}
+		if err := proto.Unmarshal(b, m); err != nil {
+			return status.Errorf(codes.Internal, "failed to replay shared response: %v", err)
+		}
+		if err := ss.SendMsg(m); err != nil {
+			return err
+		}
+	}
+	ss.SetTrailer(r.trailer)
+	return r.err
+}
+
+// replayStream hands requests already read from the client to the handler
+// before err, or before reading the rest from the client when passThrough
+type replayStream struct {
+	grpc.ServerStream
+	requests    []proto.Message
+	err         error
+	passThrough bool
+}
+
+func (s *replayStream) RecvMsg(m interface{}) error {
+	if len(s.requests) > 0 {
+		b, err := proto.Marshal(s.requests[0])
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to replay request: %v", err)
+		}
+		s.requests = s.requests[1:]
+		return setMessage(m, b)
+	}
+	if s.passThrough {
+		return s.ServerStream.RecvMsg(m)
+	}
+	return s.err
+}
+
+// recordStream records the response a handler sends, so it can be replayed
+// to other callers
+type recordStream struct {
+	grpc.ServerStream
+
+	mu     sync.Mutex
+	result *callResult
+}
+
+func newRecordStream(ss grpc.ServerStream) *recordStream {
+	return &recordStream{ServerStream: ss, result: &callResult{}}
+}
+
+// finish records the call's status and returns the complete result
+func (s *recordStream) finish(err error) *callResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.result.err = err
+	return s.result
+}
+
+func (s *recordStream) SendHeader(md metadata.MD) error {
+	s.mu.Lock()
+	s.result.header = md.Copy()
+	s.mu.Unlock()
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *recordStream) SendMsg(m interface{}) error {
+	if b, ok := messageBytes(m); ok {
+		s.mu.Lock()
+		s.result.responses = append(s.result.responses, b)
+		s.mu.Unlock()
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *recordStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	s.result.trailer = metadata.Join(s.result.trailer, md)
+	s.mu.Unlock()
+	s.ServerStream.SetTrailer(md)
+}
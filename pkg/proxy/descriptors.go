@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// descriptorSet holds the files of an endpoint's descriptor_set
+type descriptorSet struct {
+	files *protoregistry.Files
+	types *dynamicpb.Types
+}
+
+// loadDescriptorSet reads a binary FileDescriptorSet, as written by
+// `buf build -o` or `protoc --include_imports --descriptor_set_out`
+func loadDescriptorSet(path string) (*descriptorSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read descriptor_set: %v", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, fmt.Errorf("failed to parse descriptor_set %s: %v", path, err)
+	}
+	protos := make(map[string]*descriptorpb.FileDescriptorProto, len(set.File))
+	for _, fd := range set.File {
+		protos[fd.GetName()] = fd
+	}
+	files, err := buildFiles(protos)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor_set %s: %v", path, err)
+	}
+	return &descriptorSet{files: files, types: dynamicpb.NewTypes(files)}, nil
+}
+
+// buildFiles links file descriptors, resolving imports among protos first
+// and then among the descriptors compiled into the binary
+func buildFiles(protos map[string]*descriptorpb.FileDescriptorProto) (*protoregistry.Files, error) {
+	files := new(protoregistry.Files)
+	var register func(name string) error
+	register = func(name string) error {
+		if _, err := files.FindFileByPath(name); err == nil {
+			return nil
+		}
+		fd, ok := protos[name]
+		if !ok {
+			// Known to the binary, or reported as missing by NewFile
+			return nil
+		}
+		for _, dep := range fd.Dependency {
+			if err := register(dep); err != nil {
+				return err
+			}
+		}
+		file, err := protodesc.NewFile(fd, fallbackResolver{files})
+		if err != nil {
+			return fmt.Errorf("invalid descriptor %s: %v", name, err)
+		}
+		return files.RegisterFile(file)
+	}
+	for name := range protos {
+		if err := register(name); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// service returns the descriptor of a fully-qualified service name
+func (s *descriptorSet) service(name string) (protoreflect.ServiceDescriptor, bool) {
+	d, err := s.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, false
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	return sd, ok
+}
+
+// describe answers a reflection request from the set like a reflection
+// server would, without asking the upstream
+func (s *descriptorSet) describe(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+	resp := &rpb.ServerReflectionResponse{ValidHost: req.Host, OriginalRequest: req}
+	resolver := fallbackResolver{s.files}
+	fail := func(code codes.Code, format string, args ...interface{}) *rpb.ServerReflectionResponse {
+		resp.MessageResponse = &rpb.ServerReflectionResponse_ErrorResponse{ErrorResponse: &rpb.ErrorResponse{
+			ErrorCode:    int32(code),
+			ErrorMessage: fmt.Sprintf(format, args...),
+		}}
+		return resp
+	}
+
+	switch r := req.MessageRequest.(type) {
+	case *rpb.ServerReflectionRequest_ListServices:
+		var services []*rpb.ServiceResponse
+		s.files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+			for i := 0; i < fd.Services().Len(); i++ {
+				services = append(services, &rpb.ServiceResponse{Name: string(fd.Services().Get(i).FullName())})
+			}
+			return true
+		})
+		sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+		resp.MessageResponse = &rpb.ServerReflectionResponse_ListServicesResponse{
+			ListServicesResponse: &rpb.ListServiceResponse{Service: services},
+		}
+
+	case *rpb.ServerReflectionRequest_FileByFilename:
+		fd, err := resolver.FindFileByPath(r.FileByFilename)
+		if err != nil {
+			return fail(codes.NotFound, "file not found: %s", r.FileByFilename)
+		}
+		resp.MessageResponse = fileResponse(fd)
+
+	case *rpb.ServerReflectionRequest_FileContainingSymbol:
+		d, err := resolver.FindDescriptorByName(protoreflect.FullName(r.FileContainingSymbol))
+		if err != nil {
+			return fail(codes.NotFound, "symbol not found: %s", r.FileContainingSymbol)
+		}
+		resp.MessageResponse = fileResponse(d.ParentFile())
+
+	case *rpb.ServerReflectionRequest_FileContainingExtension:
+		ext := r.FileContainingExtension
+		xt, err := s.types.FindExtensionByNumber(protoreflect.FullName(ext.ContainingType), protoreflect.FieldNumber(ext.ExtensionNumber))
+		if err != nil {
+			return fail(codes.NotFound, "extension not found: %s %d", ext.ContainingType, ext.ExtensionNumber)
+		}
+		resp.MessageResponse = fileResponse(xt.TypeDescriptor().ParentFile())
+
+	case *rpb.ServerReflectionRequest_AllExtensionNumbersOfType:
+		name := protoreflect.FullName(r.AllExtensionNumbersOfType)
+		if _, err := resolver.FindDescriptorByName(name); err != nil {
+			return fail(codes.NotFound, "type not found: %s", name)
+		}
+		var numbers []int32
+		s.files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+			numbers = appendExtensionNumbers(numbers, name, fd.Extensions(), fd.Messages())
+			return true
+		})
+		resp.MessageResponse = &rpb.ServerReflectionResponse_AllExtensionNumbersResponse{
+			AllExtensionNumbersResponse: &rpb.ExtensionNumberResponse{BaseTypeName: string(name), ExtensionNumber: numbers},
+		}
+
+	default:
+		return fail(codes.InvalidArgument, "invalid reflection request")
+	}
+	return resp
+}
+
+// appendExtensionNumbers appends the numbers of the extensions of message
+// declared in exts or nested in msgs
+func appendExtensionNumbers(numbers []int32, message protoreflect.FullName, exts protoreflect.ExtensionDescriptors, msgs protoreflect.MessageDescriptors) []int32 {
+	for i := 0; i < exts.Len(); i++ {
+		if xd := exts.Get(i); xd.ContainingMessage().FullName() == message {
+			numbers = append(numbers, int32(xd.Number()))
+		}
+	}
+	for i := 0; i < msgs.Len(); i++ {
+		numbers = appendExtensionNumbers(numbers, message, msgs.Get(i).Extensions(), msgs.Get(i).Messages())
+	}
+	return numbers
+}
+
+// fileResponse returns fd followed by its transitive imports
+func fileResponse(fd protoreflect.FileDescriptor) *rpb.ServerReflectionResponse_FileDescriptorResponse {
+	var encoded [][]byte
+	seen := make(map[string]bool)
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		if b, err := proto.Marshal(protodesc.ToFileDescriptorProto(fd)); err == nil {
+			encoded = append(encoded, b)
+		}
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+	}
+	add(fd)
+	return &rpb.ServerReflectionResponse_FileDescriptorResponse{
+		FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: encoded},
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Diagnostic response headers
+const (
+	endpointHeader        = "x-proxy-endpoint"
+	upstreamAddressHeader = "x-upstream-address"
+	durationHeader        = "x-proxy-duration-ms"
+	cacheStatusHeader     = "x-cache-status"
+)
+
+// diagnosticsKey is the context key of a call's diagnostics
+type diagnosticsKey struct{}
+
+// diagnostics collects what the response headers report about a call as
+// it passes through the proxy
+type diagnostics struct {
+	mu       sync.Mutex
+	upstream string
+}
+
+// setUpstream records the address of the upstream that served the call
+func (d *diagnostics) setUpstream(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.upstream = addr
+}
+
+func (d *diagnostics) upstreamAddress() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.upstream
+}
+
+// recordUpstreamPeer notes the address cs is connected to in the
+// diagnostics of the call ctx belongs to, if it has any
+func recordUpstreamPeer(ctx context.Context, cs grpc.ClientStream) {
+	d, ok := ctx.Value(diagnosticsKey{}).(*diagnostics)
+	if !ok {
+		return
+	}
+	if pr, ok := peer.FromContext(cs.Context()); ok && pr.Addr != nil {
+		d.setUpstream(pr.Addr.String())
+	}
+}
+
+// setCacheStatus reports whether the response cache answered the call
+func (p *ProxyServer) setCacheStatus(ss grpc.ServerStream, cacheStatus string) {
+	if p.config.DiagnosticHeaders {
+		ss.SetHeader(metadata.Pairs(cacheStatusHeader, cacheStatus))
+	}
+}
+
+// diagnosticsInterceptor tells clients which endpoint and upstream served
+// their call and how long the proxy took, in response headers and the
+// trailer
+func (p *ProxyServer) diagnosticsInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !p.config.DiagnosticHeaders {
+		return handler(srv, ss)
+	}
+	start := time.Now()
+	d := &diagnostics{}
+	ss.SetHeader(metadata.Pairs(endpointHeader, p.config.Name))
+	stream := &diagnosticsStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), diagnosticsKey{}, d), diagnostics: d}
+	err := handler(srv, stream)
+
+	trailer := metadata.Pairs(durationHeader, strconv.FormatInt(time.Since(start).Milliseconds(), 10))
+	// Calls that failed before a response only send a trailer
+	if !stream.sentHeader {
+		trailer.Set(endpointHeader, p.config.Name)
+		if addr := d.upstreamAddress(); addr != "" {
+			trailer.Set(upstreamAddressHeader, addr)
+		}
+	}
+	ss.SetTrailer(trailer)
+	return err
+}
+
+// diagnosticsStream carries the call's diagnostics in its context, adds the
+// upstream address to the header once it is known and notes whether a
+// header was sent
+type diagnosticsStream struct {
+	grpc.ServerStream
+	ctx         context.Context
+	diagnostics *diagnostics
+	sentHeader  bool
+}
+
+func (s *diagnosticsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *diagnosticsStream) SendHeader(md metadata.MD) error {
+	if addr := s.diagnostics.upstreamAddress(); addr != "" {
+		md = md.Copy()
+		md.Set(upstreamAddressHeader, addr)
+	}
+	s.sentHeader = true
+	return s.ServerStream.SendHeader(md)
+}
+
+// SendMsg notes the header, which gRPC sends with the first message
+func (s *diagnosticsStream) SendMsg(m interface{}) error {
+	s.sentHeader = true
+	return s.ServerStream.SendMsg(m)
+}
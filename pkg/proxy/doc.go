@@ -0,0 +1,20 @@
+// Package proxy implements a transparent gRPC proxy that injects JWT
+// authentication toward upstream services.
+//
+// A ProxyServer serves one endpoint; a Manager runs every endpoint of a
+// ProxyConfig and applies configuration reloads:
+//
+//	manager := proxy.NewManager(&proxy.ProxyConfig{
+//		Endpoints: []proxy.Config{{
+//			Name:          "cosmos-hub",
+//			LocalPort:     9090,
+//			RemoteAddress: "cosmos-grpc-api.chandrastation.com:443",
+//			UseTLS:        true,
+//			JWTToken:      token,
+//		}},
+//	})
+//	if err := manager.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer manager.Stop()
+package proxy
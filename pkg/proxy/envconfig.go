@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvEndpointPrefix starts the environment variables that define endpoints,
+// e.g. GRPC_PROXY_ENDPOINTS_0_NAME
+const EnvEndpointPrefix = "GRPC_PROXY_ENDPOINTS_"
+
+// HasEnvEndpoints reports whether environ defines any endpoint
+func HasEnvEndpoints(environ []string) bool {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, EnvEndpointPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envEndpoints returns the endpoints defined by environ, ordered by their
+// index. GRPC_PROXY_ENDPOINTS_<n>_<KEY>=value sets key of endpoint n, with
+// __ separating nested keys, e.g. GRPC_PROXY_ENDPOINTS_0_CONNECT__TIMEOUT.
+func envEndpoints(environ []string) ([]map[string]interface{}, error) {
+	byIndex := make(map[int]map[string]interface{})
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, EnvEndpointPrefix)
+		if !ok {
+			continue
+		}
+		index, key, ok := strings.Cut(rest, "_")
+		n, err := strconv.Atoi(index)
+		if !ok || err != nil || n < 0 || key == "" {
+			return nil, fmt.Errorf("invalid endpoint variable %s, expected %s<n>_<KEY>", name, EnvEndpointPrefix)
+		}
+		endpoint := byIndex[n]
+		if endpoint == nil {
+			endpoint = make(map[string]interface{})
+			byIndex[n] = endpoint
+		}
+		path := strings.Split(strings.ToLower(key), "__")
+		section := endpoint
+		for _, part := range path[:len(path)-1] {
+			next, ok := section[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				section[part] = next
+			}
+			section = next
+		}
+		section[path[len(path)-1]] = value
+	}
+
+	indexes := make([]int, 0, len(byIndex))
+	for n := range byIndex {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+	endpoints := make([]map[string]interface{}, 0, len(indexes))
+	for _, n := range indexes {
+		if name, _ := byIndex[n]["name"].(string); name == "" {
+			return nil, fmt.Errorf("%s%d_NAME is not set", EnvEndpointPrefix, n)
+		}
+		endpoints = append(endpoints, byIndex[n])
+	}
+	return endpoints, nil
+}
+
+// MergeEnvEndpoints adds the endpoints defined by environment variables in
+// environ to the endpoints of a raw configuration, in index order, like
+// MergeEndpoints. Values are strings, converted when the configuration is
+// decoded, and lists are comma-separated.
+func MergeEnvEndpoints(settings map[string]interface{}, environ []string) error {
+	defined, err := envEndpoints(environ)
+	if err != nil {
+		return err
+	}
+	MergeEndpoints(settings, defined)
+	return nil
+}
+
+// MergeEndpoints adds endpoints to the endpoints of a raw configuration. One
+// named like an endpoint of the configuration overrides the keys it sets,
+// nested sections key by key; the others are appended.
+func MergeEndpoints(settings map[string]interface{}, defined []map[string]interface{}) {
+	if len(defined) == 0 {
+		return
+	}
+	endpoints, _ := settings["endpoints"].([]interface{})
+	for _, e := range defined {
+		merged := false
+		for i, existing := range endpoints {
+			if fields, ok := existing.(map[string]interface{}); ok && fields["name"] == e["name"] {
+				endpoints[i] = mergeDefaults(fields, e)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			endpoints = append(endpoints, e)
+		}
+	}
+	settings["endpoints"] = endpoints
+}
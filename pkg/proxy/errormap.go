@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorInfoDomain is the domain of the ErrorInfo details the proxy attaches
+const errorInfoDomain = "grpc-proxy"
+
+// ErrorsConfig rewrites the errors an endpoint returns to its clients, so
+// provider-specific failures become errors the client's team can act on
+type ErrorsConfig struct {
+	// Details attaches a google.rpc.ErrorInfo naming the endpoint to every
+	// error, with the upstream's code when a mapping changed it
+	Details bool `mapstructure:"details"`
+
+	// Mappings are tried in order; the first that matches rewrites the error
+	Mappings []ErrorMapping `mapstructure:"mappings"`
+}
+
+// ErrorMapping matches errors by code and message and replaces them
+type ErrorMapping struct {
+	// Code matches errors with this code, e.g. UNAUTHENTICATED (default any)
+	Code string `mapstructure:"code"`
+
+	// Message is a regular expression matched against the error message
+	// (default any)
+	Message string `mapstructure:"message"`
+
+	// NewCode replaces the code (default unchanged)
+	NewCode string `mapstructure:"new_code"`
+
+	// NewMessage replaces the message (default unchanged). {message} stands
+	// for the original message and {endpoint} for the endpoint name.
+	NewMessage string `mapstructure:"new_message"`
+}
+
+// errorMapping is a parsed ErrorMapping
+type errorMapping struct {
+	code, newCode *codes.Code
+	message       *regexp.Regexp
+	newMessage    string
+}
+
+// parseCode parses a code name such as UNAVAILABLE
+func parseCode(name string) (codes.Code, error) {
+	var c codes.Code
+	if err := c.UnmarshalJSON([]byte(fmt.Sprintf("%q", strings.ToUpper(name)))); err != nil {
+		return 0, fmt.Errorf("unknown status code %q", name)
+	}
+	return c, nil
+}
+
+var camelBoundary = regexp.MustCompile(`([a-z])([A-Z])`)
+
+// codeName returns the canonical name of c, e.g. DEADLINE_EXCEEDED
+func codeName(c codes.Code) string {
+	return strings.ToUpper(camelBoundary.ReplaceAllString(c.String(), "${1}_${2}"))
+}
+
+// newErrorMappings validates and parses the mappings of config
+func newErrorMappings(config *ErrorsConfig) ([]errorMapping, error) {
+	if config == nil {
+		return nil, nil
+	}
+	var mappings []errorMapping
+	for i, m := range config.Mappings {
+		var parsed errorMapping
+		if m.Code != "" {
+			c, err := parseCode(m.Code)
+			if err != nil {
+				return nil, fmt.Errorf("errors mapping %d: %v", i+1, err)
+			}
+			parsed.code = &c
+		}
+		if m.NewCode != "" {
+			c, err := parseCode(m.NewCode)
+			if err != nil {
+				return nil, fmt.Errorf("errors mapping %d: %v", i+1, err)
+			}
+			if c == codes.OK {
+				return nil, fmt.Errorf("errors mapping %d: new_code must not be OK", i+1)
+			}
+			parsed.newCode = &c
+		}
+		if m.Message != "" {
+			re, err := regexp.Compile(m.Message)
+			if err != nil {
+				return nil, fmt.Errorf("errors mapping %d: invalid message pattern: %v", i+1, err)
+			}
+			parsed.message = re
+		}
+		if m.NewCode == "" && m.NewMessage == "" {
+			return nil, fmt.Errorf("errors mapping %d sets neither new_code nor new_message", i+1)
+		}
+		parsed.newMessage = m.NewMessage
+		mappings = append(mappings, parsed)
+	}
+	return mappings, nil
+}
+
+// matches reports whether the mapping applies to st
+func (m errorMapping) matches(st *status.Status) bool {
+	if m.code != nil && st.Code() != *m.code {
+		return false
+	}
+	return m.message == nil || m.message.MatchString(st.Message())
+}
+
+// translateError applies the first matching error mapping to err and, when
+// configured, attaches an ErrorInfo naming the endpoint
+func (p *ProxyServer) translateError(err error) error {
+	if err == nil || p.config.Errors == nil {
+		return err
+	}
+	st := status.Convert(err)
+	translated := st
+	for _, m := range p.errorMappings {
+		if !m.matches(st) {
+			continue
+		}
+		code, msg := st.Code(), st.Message()
+		if m.newCode != nil {
+			code = *m.newCode
+		}
+		if m.newMessage != "" {
+			msg = strings.NewReplacer("{message}", st.Message(), "{endpoint}", p.config.Name).Replace(m.newMessage)
+		}
+		pb := st.Proto()
+		pb.Code, pb.Message = int32(code), msg
+		translated = status.FromProto(pb)
+		p.metrics.Add("errors_translated", 1)
+		break
+	}
+	if !p.config.Errors.Details {
+		return translated.Err()
+	}
+	info := &errdetails.ErrorInfo{
+		Reason:   codeName(translated.Code()),
+		Domain:   errorInfoDomain,
+		Metadata: map[string]string{"endpoint": p.config.Name},
+	}
+	if translated.Code() != st.Code() {
+		info.Metadata["upstream_code"] = codeName(st.Code())
+	}
+	withDetails, detailsErr := translated.WithDetails(info)
+	if detailsErr != nil {
+		return translated.Err()
+	}
+	return withDetails.Err()
+}
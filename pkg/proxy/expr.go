@@ -0,0 +1,510 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Rule expressions use a subset of CEL, checked and compiled when the
+// endpoint is created so calls only evaluate them. They see:
+//
+//	request.method   the full method name without the leading slash,
+//	                 e.g. "cosmos.bank.v1beta1.Query/Balance"
+//	request.service  the service part of the method name
+//	request.height   the x-cosmos-block-height the call asks for, 0 for latest
+//	metadata         the call's metadata by lower-case key; missing keys are ""
+//	client           the API key's client name, "" without clients
+//	endpoint         the endpoint's name
+//	claims           the claims of the verified client JWT by name, e.g.
+//	                 claims.tenant or claims["org_id"]; lists are joined by
+//	                 spaces, and missing claims and calls without a client
+//	                 JWT give ""
+//
+// Strings, integers and booleans combine with ||, &&, !, ==, !=, <, <=, >,
+// >=, `key in metadata`, `name in claims` and the string methods startsWith, endsWith,
+// contains and matches, whose regular expression must be a literal.
+
+// exprEnv is what an expression is evaluated against
+type exprEnv struct {
+	fullMethodName string
+	height         int64
+	md             metadata.MD
+	client         string
+	endpoint       string
+	claims         map[string]interface{}
+}
+
+// callEnv describes a call for rule expressions and routes
+func (p *ProxyServer) callEnv(fullMethodName string, md metadata.MD, client string, claims map[string]interface{}) *exprEnv {
+	// A missing or malformed height means the latest block
+	height, _ := strconv.ParseInt(headerValue(md, blockHeightHeader), 10, 64)
+	return &exprEnv{fullMethodName: fullMethodName, height: height, md: md, client: client, endpoint: p.config.Name, claims: claims}
+}
+
+// claimValue renders a claim as an expression string
+func claimValue(claims map[string]interface{}, name string) string {
+	switch v := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			if s, ok := item.(string); ok {
+				parts[i] = s
+			} else {
+				b, _ := json.Marshal(item)
+				parts[i] = string(b)
+			}
+		}
+		return strings.Join(parts, " ")
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// exprType is the static type of an expression
+type exprType int
+
+const (
+	typeString exprType = iota
+	typeInt
+	typeBool
+	typeMetadata
+	typeRequest
+	typeClaims
+)
+
+func (t exprType) String() string {
+	return [...]string{"string", "int", "bool", "map", "request", "claims"}[t]
+}
+
+// exprNode is a checked subexpression
+type exprNode struct {
+	typ  exprType
+	eval func(env *exprEnv) interface{}
+}
+
+// ruleExpr is a compiled boolean expression
+type ruleExpr struct {
+	source string
+	node   exprNode
+}
+
+// matches evaluates the expression for a call
+func (e *ruleExpr) matches(env *exprEnv) bool {
+	return e.node.eval(env).(bool)
+}
+
+// compileExpr parses and type-checks a boolean expression
+func compileExpr(source string) (*ruleExpr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %v", source, err)
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = fmt.Errorf("unexpected %s", p.peek())
+	}
+	if err == nil && node.typ != typeBool {
+		err = fmt.Errorf("expression is a %s, not a bool", node.typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %v", source, err)
+	}
+	return &ruleExpr{source: source, node: node}, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenInt
+	tokenOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	str  string
+	num  int64
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return "'" + t.text + "'"
+}
+
+// exprOperators are matched longest first
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">", "(", ")", "[", "]", ".", ","}
+
+// lexExpr splits an expression into tokens
+func lexExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(s) && s[end] != s[i] {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			body := s[i+1 : end]
+			if c == '\'' {
+				body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+			}
+			str, err := strconv.Unquote(`"` + body + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", s[i:end+1])
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, text: s[i : end+1], str: str})
+			i = end + 1
+		case unicode.IsDigit(c):
+			end := i
+			for end < len(s) && unicode.IsDigit(rune(s[end])) {
+				end++
+			}
+			n, err := strconv.ParseInt(s[i:end], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s", s[i:end])
+			}
+			tokens = append(tokens, exprToken{kind: tokenInt, text: s[i:end], num: n})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i
+			for end < len(s) && (unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end])) || s[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, text: s[i:end]})
+			i = end
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(s[i:], op) {
+					tokens = append(tokens, exprToken{kind: tokenOp, text: op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: tokenEOF}), nil
+}
+
+// exprParser is a recursive descent parser that checks types as it goes
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the operator or keyword text if it is next
+func (p *exprParser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokenOp || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected '%s' but found %s", text, p.peek())
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left, err = logical("||", left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseRelation()
+	for err == nil && p.accept("&&") {
+		var right exprNode
+		if right, err = p.parseRelation(); err == nil {
+			left, err = logical("&&", left, right)
+		}
+	}
+	return left, err
+}
+
+// logical combines two bools, evaluating the right side only when needed
+func logical(op string, left, right exprNode) (exprNode, error) {
+	if left.typ != typeBool || right.typ != typeBool {
+		return exprNode{}, fmt.Errorf("'%s' needs bools, not %s and %s", op, left.typ, right.typ)
+	}
+	l, r := left.eval, right.eval
+	if op == "&&" {
+		return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} { return l(env).(bool) && r(env).(bool) }}, nil
+	}
+	return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} { return l(env).(bool) || r(env).(bool) }}, nil
+}
+
+func (p *exprParser) parseRelation() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return left, err
+	}
+	t := p.peek()
+	if t.kind == tokenIdent && t.text == "in" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return right, err
+		}
+		if left.typ != typeString || (right.typ != typeMetadata && right.typ != typeClaims) {
+			return exprNode{}, fmt.Errorf("'in' needs a string and metadata or claims, not %s and %s", left.typ, right.typ)
+		}
+		key := left.eval
+		if right.typ == typeClaims {
+			return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} {
+				_, ok := env.claims[key(env).(string)]
+				return ok
+			}}, nil
+		}
+		return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} {
+			return len(env.md.Get(key(env).(string))) > 0
+		}}, nil
+	}
+	if t.kind != tokenOp {
+		return left, nil
+	}
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseUnary()
+	if err != nil {
+		return right, err
+	}
+	return compare(t.text, left, right)
+}
+
+// compare checks and builds an equality or ordering
+func compare(op string, left, right exprNode) (exprNode, error) {
+	if left.typ != right.typ || left.typ == typeMetadata || left.typ == typeRequest || left.typ == typeClaims {
+		return exprNode{}, fmt.Errorf("cannot compare %s %s %s", left.typ, op, right.typ)
+	}
+	l, r := left.eval, right.eval
+	if op == "==" || op == "!=" {
+		equal := op == "=="
+		return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} { return (l(env) == r(env)) == equal }}, nil
+	}
+	if left.typ == typeBool {
+		return exprNode{}, fmt.Errorf("cannot order bools with '%s'", op)
+	}
+	less := func(a, b interface{}) bool {
+		if x, ok := a.(int64); ok {
+			return x < b.(int64)
+		}
+		return a.(string) < b.(string)
+	}
+	var eval func(env *exprEnv) interface{}
+	switch op {
+	case "<":
+		eval = func(env *exprEnv) interface{} { return less(l(env), r(env)) }
+	case "<=":
+		eval = func(env *exprEnv) interface{} { return !less(r(env), l(env)) }
+	case ">":
+		eval = func(env *exprEnv) interface{} { return less(r(env), l(env)) }
+	default:
+		eval = func(env *exprEnv) interface{} { return !less(l(env), r(env)) }
+	}
+	return exprNode{typ: typeBool, eval: eval}, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return operand, err
+		}
+		if operand.typ != typeBool {
+			return exprNode{}, fmt.Errorf("'!' needs a bool, not %s", operand.typ)
+		}
+		eval := operand.eval
+		return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} { return !eval(env).(bool) }}, nil
+	}
+	return p.parseMember()
+}
+
+func (p *exprParser) parseMember() (exprNode, error) {
+	node, err := p.parsePrimary()
+	for err == nil {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenIdent {
+				return exprNode{}, fmt.Errorf("expected a name after '.' but found %s", name)
+			}
+			if p.accept("(") {
+				node, err = p.parseCall(node, name.text)
+			} else {
+				node, err = field(node, name.text)
+			}
+		case p.accept("["):
+			var key exprNode
+			if key, err = p.parseOr(); err != nil {
+				break
+			}
+			if err = p.expect("]"); err != nil {
+				break
+			}
+			if (node.typ != typeMetadata && node.typ != typeClaims) || key.typ != typeString {
+				return exprNode{}, fmt.Errorf("only metadata and claims can be indexed, by a string")
+			}
+			k := key.eval
+			if node.typ == typeClaims {
+				node = exprNode{typ: typeString, eval: func(env *exprEnv) interface{} { return claimValue(env.claims, k(env).(string)) }}
+			} else {
+				node = exprNode{typ: typeString, eval: func(env *exprEnv) interface{} { return headerValue(env.md, k(env).(string)) }}
+			}
+		default:
+			return node, nil
+		}
+	}
+	return node, err
+}
+
+// field selects a field of request or a claim
+func field(node exprNode, name string) (exprNode, error) {
+	if node.typ == typeClaims {
+		return exprNode{typ: typeString, eval: func(env *exprEnv) interface{} { return claimValue(env.claims, name) }}, nil
+	}
+	if node.typ != typeRequest {
+		return exprNode{}, fmt.Errorf("%s has no field %s", node.typ, name)
+	}
+	switch name {
+	case "method":
+		return exprNode{typ: typeString, eval: func(env *exprEnv) interface{} {
+			return strings.TrimPrefix(env.fullMethodName, "/")
+		}}, nil
+	case "service":
+		return exprNode{typ: typeString, eval: func(env *exprEnv) interface{} {
+			service, _, _ := strings.Cut(strings.TrimPrefix(env.fullMethodName, "/"), "/")
+			return service
+		}}, nil
+	case "height":
+		return exprNode{typ: typeInt, eval: func(env *exprEnv) interface{} { return env.height }}, nil
+	}
+	return exprNode{}, fmt.Errorf("request has no field %s", name)
+}
+
+// parseCall parses the argument of a string method
+func (p *exprParser) parseCall(receiver exprNode, name string) (exprNode, error) {
+	argStart := p.peek()
+	arg, err := p.parseOr()
+	if err != nil {
+		return arg, err
+	}
+	if err := p.expect(")"); err != nil {
+		return exprNode{}, err
+	}
+	if receiver.typ != typeString || arg.typ != typeString {
+		return exprNode{}, fmt.Errorf("%s needs a string and a string argument", name)
+	}
+	s, a := receiver.eval, arg.eval
+	var test func(s, arg string) bool
+	switch name {
+	case "startsWith":
+		test = strings.HasPrefix
+	case "endsWith":
+		test = strings.HasSuffix
+	case "contains":
+		test = strings.Contains
+	case "matches":
+		if argStart.kind != tokenString || p.tokens[p.pos-2] != argStart {
+			return exprNode{}, fmt.Errorf("matches needs a literal regular expression")
+		}
+		re, err := regexp.Compile(argStart.str)
+		if err != nil {
+			return exprNode{}, fmt.Errorf("invalid regular expression: %v", err)
+		}
+		return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} { return re.MatchString(s(env).(string)) }}, nil
+	default:
+		return exprNode{}, fmt.Errorf("unknown function %s", name)
+	}
+	return exprNode{typ: typeBool, eval: func(env *exprEnv) interface{} { return test(s(env).(string), a(env).(string)) }}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return exprNode{typ: typeString, eval: func(*exprEnv) interface{} { return t.str }}, nil
+	case tokenInt:
+		return exprNode{typ: typeInt, eval: func(*exprEnv) interface{} { return t.num }}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true", "false":
+			value := t.text == "true"
+			return exprNode{typ: typeBool, eval: func(*exprEnv) interface{} { return value }}, nil
+		case "request":
+			return exprNode{typ: typeRequest, eval: func(*exprEnv) interface{} { return nil }}, nil
+		case "metadata":
+			return exprNode{typ: typeMetadata, eval: func(*exprEnv) interface{} { return nil }}, nil
+		case "claims":
+			return exprNode{typ: typeClaims, eval: func(*exprEnv) interface{} { return nil }}, nil
+		case "client":
+			return exprNode{typ: typeString, eval: func(env *exprEnv) interface{} { return env.client }}, nil
+		case "endpoint":
+			return exprNode{typ: typeString, eval: func(env *exprEnv) interface{} { return env.endpoint }}, nil
+		}
+		return exprNode{}, fmt.Errorf("unknown name %s", t.text)
+	case tokenOp:
+		if t.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return node, err
+			}
+			return node, p.expect(")")
+		}
+	}
+	return exprNode{}, fmt.Errorf("unexpected %s", t)
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// FaultConfig injects artificial failures into a percentage of calls, to test
+// how downstream applications cope with a degraded upstream. Percentages are
+// 0-100 and drawn independently for each call.
+type FaultConfig struct {
+	// Methods limits faults to these full method name prefixes (default all)
+	Methods []string `mapstructure:"methods"`
+
+	// Delay is added before DelayPercent of calls are forwarded
+	Delay        time.Duration `mapstructure:"delay"`
+	DelayPercent float64       `mapstructure:"delay_percent"`
+
+	// AbortCode (e.g. UNAVAILABLE) is returned without contacting the upstream
+	// for AbortPercent of calls
+	AbortCode    string  `mapstructure:"abort_code"`
+	AbortPercent float64 `mapstructure:"abort_percent"`
+
+	// ResetPercent of calls have their client connection reset, failing every
+	// call in flight on it. Only TCP listeners support resets.
+	ResetPercent float64 `mapstructure:"reset_percent"`
+}
+
+// faults enforces a FaultConfig
+type faults struct {
+	config    FaultConfig
+	abortCode codes.Code
+
+	// conns maps client addresses to their connections so a call can reset its own
+	mu    sync.Mutex
+	conns map[string]net.Conn
+}
+
+// newFaults validates config; it returns nil when no faults are configured
+func newFaults(config *FaultConfig) (*faults, error) {
+	if config == nil {
+		return nil, nil
+	}
+	for name, pct := range map[string]float64{
+		"delay_percent": config.DelayPercent,
+		"abort_percent": config.AbortPercent,
+		"reset_percent": config.ResetPercent,
+	} {
+		if pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("faults %s must be between 0 and 100", name)
+		}
+	}
+	f := &faults{config: *config, conns: make(map[string]net.Conn)}
+	if config.AbortPercent > 0 {
+		if config.AbortCode == "" {
+			return nil, fmt.Errorf("faults abort_percent requires an abort_code")
+		}
+		if err := f.abortCode.UnmarshalJSON([]byte(fmt.Sprintf("%q", config.AbortCode))); err != nil {
+			return nil, fmt.Errorf("invalid faults abort_code %q", config.AbortCode)
+		}
+	}
+	return f, nil
+}
+
+// hit reports whether a call falls within pct percent
+func hit(pct float64) bool {
+	return pct > 0 && rand.Float64()*100 < pct
+}
+
+// faultInterceptor injects the configured delays, aborts and resets
+func (p *ProxyServer) faultInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	f := p.faults
+	if f == nil || (len(f.config.Methods) > 0 && !matchesMethod(f.config.Methods, info.FullMethod)) {
+		return handler(srv, ss)
+	}
+	ctx := ss.Context()
+
+	if hit(f.config.ResetPercent) && f.reset(ctx) {
+		p.metrics.Add("fault_resets", 1)
+		return status.Error(codes.Unavailable, "connection reset by fault injection")
+	}
+	if hit(f.config.DelayPercent) {
+		p.metrics.Add("fault_delays", 1)
+		select {
+		case <-time.After(f.config.Delay):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if hit(f.config.AbortPercent) {
+		p.metrics.Add("fault_aborts", 1)
+		return status.Errorf(f.abortCode, "aborted by fault injection")
+	}
+	return handler(srv, ss)
+}
+
+// reset abruptly closes the client connection carrying ctx's call
+func (f *faults) reset(ctx context.Context) bool {
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.Addr == nil {
+		return false
+	}
+	f.mu.Lock()
+	conn, ok := f.conns[pr.Addr.String()]
+	f.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		// Discard unsent data and send RST instead of a graceful FIN
+		tcp.SetLinger(0)
+	}
+	log.Printf("Fault injection: resetting connection from %s", pr.Addr)
+	conn.Close()
+	return true
+}
+
+// faultListener tracks accepted TCP connections so calls can reset them
+type faultListener struct {
+	net.Listener
+	faults *faults
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+	key := tcp.RemoteAddr().String()
+	l.faults.mu.Lock()
+	l.faults.conns[key] = tcp
+	l.faults.mu.Unlock()
+	return &faultConn{Conn: conn, release: func() {
+		l.faults.mu.Lock()
+		delete(l.faults.conns, key)
+		l.faults.mu.Unlock()
+	}}, nil
+}
+
+// faultConn forgets its connection when closed
+type faultConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *faultConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// filePollInterval is how often mounted token and certificate files are
+// checked for changes. Polling the path follows symlinks, so Kubernetes
+// Secret and ConfigMap updates, which swap the ..data symlink, are seen.
+const filePollInterval = 2 * time.Second
+
+// fileBackend reads file: references, e.g. a mounted Kubernetes Secret
+type fileBackend struct{}
+
+func (fileBackend) fetch(ctx context.Context, path string) (secret, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return secret{}, err
+	}
+	return secret{value: strings.TrimSpace(string(b)), poll: filePollInterval}, nil
+}
+
+// watchCAFile reloads ca_file when its contents change until the server's
+// upstreams are closed. New upstream connections verify against the new
+// bundle; established ones are kept.
+func (p *ProxyServer) watchCAFile() {
+	last, _ := os.ReadFile(p.config.CAFile)
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := os.ReadFile(p.config.CAFile)
+		if err != nil || bytes.Equal(current, last) {
+			continue
+		}
+		last = current
+		if err := p.roots.set(current, p.config.CAFile); err != nil {
+			p.logf(levelWarn, "Ignoring updated ca_file for %s: %v", p.config.Name, err)
+			continue
+		}
+		p.logf(levelInfo, "Reloaded ca_file for %s", p.config.Name)
+	}
+}
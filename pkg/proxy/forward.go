@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	encodingproto "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// StreamDirector picks the upstream connection for a call to fullMethodName
+// and returns the context to call it with, carrying the outgoing metadata.
+// The returned context must derive from ctx. An error fails the call
+// without contacting any upstream.
+type StreamDirector func(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error)
+
+// forwardStreamDesc describes a proxied call; every call is forwarded as a
+// bidirectional stream whatever its real shape
+var forwardStreamDesc = &grpc.StreamDesc{
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// frame is a message passed through undecoded. Its payload holds the
+// buffers gRPC read it into, reference counted so they go back to gRPC's
+// pool once the frame and the transport are both done with them.
+type frame struct {
+	payload mem.BufferSlice
+}
+
+// framePool reuses frames across calls
+var framePool = sync.Pool{New: func() any { return new(frame) }}
+
+// release drops the frame's reference to its payload
+func (f *frame) release() {
+	f.payload.Free()
+	f.payload = nil
+}
+
+// set replaces the payload with b
+func (f *frame) set(b []byte) {
+	f.release()
+	f.payload = mem.BufferSlice{mem.SliceBuffer(b)}
+}
+
+// frameCodec passes frames through as raw bytes and leaves every other
+// message to the proto codec, so the services the proxy answers itself
+// keep working on the same server
+type frameCodec struct {
+	proto encoding.CodecV2
+}
+
+// codec is the frameCodec of proxy servers and of the calls they forward
+var codec = frameCodec{proto: encoding.GetCodecV2(encodingproto.Name)}
+
+func (c frameCodec) Marshal(v any) (mem.BufferSlice, error) {
+	if f, ok := v.(*frame); ok {
+		// gRPC frees what Marshal returns once it is written
+		f.payload.Ref()
+		return f.payload, nil
+	}
+	return c.proto.Marshal(v)
+}
+
+func (c frameCodec) Unmarshal(data mem.BufferSlice, v any) error {
+	if f, ok := v.(*frame); ok {
+		// gRPC frees data when Unmarshal returns, so keep a reference
+		f.release()
+		data.Ref()
+		f.payload = data
+		return nil
+	}
+	return c.proto.Unmarshal(data, v)
+}
+
+// Name keeps the content type of proxied calls application/grpc+proto
+func (frameCodec) Name() string {
+	return encodingproto.Name
+}
+
+// ForwardServerOptions returns the options that make a gRPC server forward
+// every call it does not implement itself to the upstream director picks.
+// Messages are passed through without being decoded or copied.
+func ForwardServerOptions(director StreamDirector) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ForceServerCodecV2(codec),
+		grpc.UnknownServiceHandler(ForwardHandler(director)),
+	}
+}
+
+// ForwardHandler returns a stream handler forwarding calls to the upstream
+// director picks. The server must use the codec set by ForwardServerOptions.
+func ForwardHandler(director StreamDirector) grpc.StreamHandler {
+	return func(srv interface{}, ss grpc.ServerStream) error {
+		fullMethodName, ok := grpc.MethodFromServerStream(ss)
+		if !ok {
+			return status.Errorf(codes.Internal, "no method name in server stream")
+		}
+		outgoingCtx, conn, err := director(ss.Context(), fullMethodName)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(outgoingCtx)
+		defer cancel()
+		cs, err := conn.NewStream(ctx, forwardStreamDesc, upstreamMethod(ctx, fullMethodName), grpc.ForceCodecV2(codec))
+		if err != nil {
+			return err
+		}
+
+		done := make(chan forwardResult, 2)
+		go func() { done <- forwardResult{err: forwardRequests(ss, cs)} }()
+		go func() { done <- forwardResult{responses: true, err: forwardResponses(cs, ss)} }()
+
+		// Either side may finish first
+		for i := 0; i < 2; i++ {
+			r := <-done
+			if !r.responses {
+				if r.err != io.EOF {
+					// Reading from the client failed; abandon the upstream call
+					cancel()
+					return status.Errorf(codes.Internal, "failed proxying s2c: %v", r.err)
+				}
+				cs.CloseSend()
+				continue
+			}
+			// The upstream finished, with its trailer unless the stream broke
+			recordUpstreamPeer(ss.Context(), cs)
+			ss.SetTrailer(cs.Trailer())
+			if r.err != io.EOF {
+				return r.err
+			}
+			return nil
+		}
+		return status.Errorf(codes.Internal, "gRPC proxying should never reach this stage")
+	}
+}
+
+// forwardResult is how one direction of a forwarded call ended
+type forwardResult struct {
+	responses bool
+	err       error
+}
+
+// forwardRequests copies the client's messages to the upstream until either
+// side stops, returning io.EOF once the client is done sending
+func forwardRequests(src grpc.ServerStream, dst grpc.ClientStream) error {
+	f := framePool.Get().(*frame)
+	defer func() {
+		f.release()
+		framePool.Put(f)
+	}()
+	for {
+		if err := src.RecvMsg(f); err != nil {
+			return err
+		}
+		if err := dst.SendMsg(f); err != nil {
+			return err
+		}
+		f.release()
+	}
+}
+
+// forwardResponses copies the upstream's header and messages to the client,
+// returning io.EOF once the upstream finished successfully
+func forwardResponses(src grpc.ClientStream, dst grpc.ServerStream) error {
+	f := framePool.Get().(*frame)
+	defer func() {
+		f.release()
+		framePool.Put(f)
+	}()
+	for i := 0; ; i++ {
+		if err := src.RecvMsg(f); err != nil {
+			return err
+		}
+		if i == 0 {
+			// The upstream header is only known once its first message
+			// arrived, and must be sent before that message
+			md, err := src.Header()
+			if err != nil {
+				return err
+			}
+			recordUpstreamPeer(dst.Context(), src)
+			if err := dst.SendHeader(md); err != nil {
+				return err
+			}
+		}
+		if err := dst.SendMsg(f); err != nil {
+			return err
+		}
+		f.release()
+	}
+}
+
+// messageBytes returns the wire encoding of a message the proxy forwards
+func messageBytes(m interface{}) ([]byte, bool) {
+	switch msg := m.(type) {
+	case *frame:
+		return msg.payload.Materialize(), true
+	case proto.Message:
+		b, err := proto.Marshal(msg)
+		return b, err == nil
+	}
+	return nil, false
+}
+
+// messageSize returns the encoded size of a message the proxy forwards
+func messageSize(m interface{}) (int, bool) {
+	switch msg := m.(type) {
+	case *frame:
+		return msg.payload.Len(), true
+	case proto.Message:
+		return proto.Size(msg), true
+	}
+	return 0, false
+}
+
+// setMessage replaces the content of a message the proxy forwards with the
+// wire encoding b
+func setMessage(m interface{}, b []byte) error {
+	switch msg := m.(type) {
+	case *frame:
+		msg.set(b)
+		return nil
+	case proto.Message:
+		proto.Reset(msg)
+		return proto.Unmarshal(b, msg)
+	}
+	return status.Errorf(codes.Internal, "unexpected message type %T", m)
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// getLatestBlockMethod reports the newest block an upstream node has
+const getLatestBlockMethod = "/cosmos.base.tendermint.v1beta1.Service/GetLatestBlock"
+
+// defaultFreshnessInterval is how often upstream freshness is checked
+const defaultFreshnessInterval = 30 * time.Second
+
+// defaultMaxLagBlocks is the lag behind reference_rpc tolerated when max_lag_blocks is unset
+const defaultMaxLagBlocks = 10
+
+// FreshnessConfig marks the endpoint unhealthy while an upstream serves stale
+// state, judged by the age of its latest block or its lag behind a reference node
+type FreshnessConfig struct {
+	// Interval between checks (default 30s)
+	Interval time.Duration `mapstructure:"interval"`
+
+	// MaxBlockAge is how old the upstream's latest block may be
+	MaxBlockAge time.Duration `mapstructure:"max_block_age"`
+
+	// ReferenceRPC is a CometBFT RPC URL whose /status height the upstream
+	// must stay within MaxLagBlocks of (default 10)
+	ReferenceRPC string `mapstructure:"reference_rpc"`
+	MaxLagBlocks int64  `mapstructure:"max_lag_blocks"`
+}
+
+// validate checks that the freshness check has something to compare against
+func (c *FreshnessConfig) validate() error {
+	if c.MaxBlockAge <= 0 && c.ReferenceRPC == "" {
+		return fmt.Errorf("freshness requires max_block_age or reference_rpc")
+	}
+	if c.MaxLagBlocks < 0 {
+		return fmt.Errorf("freshness max_lag_blocks must not be negative")
+	}
+	return nil
+}
+
+// interval returns the configured check interval or the default
+func (c *FreshnessConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return defaultFreshnessInterval
+}
+
+// maxLagBlocks returns the configured lag or the default
+func (c *FreshnessConfig) maxLagBlocks() int64 {
+	if c.MaxLagBlocks > 0 {
+		return c.MaxLagBlocks
+	}
+	return defaultMaxLagBlocks
+}
+
+// latestBlock asks the upstream behind conn for the height and time of its newest block
+func (p *ProxyServer) latestBlock(conn *grpc.ClientConn) (int64, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeCheckTimeout)
+	defer cancel()
+	ctx = p.upstreamContext(ctx, getLatestBlockMethod)
+
+	resp := &emptypb.Empty{}
+	if err := conn.Invoke(ctx, getLatestBlockMethod, &emptypb.Empty{}, resp); err != nil {
+		return 0, time.Time{}, err
+	}
+	b, err := proto.Marshal(resp)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	// GetLatestBlockResponse.block (2), or sdk_block (3) on newer nodes,
+	// -> Block.header (1) -> Header.height (3) and Header.time (4)
+	block, ok := protoField(b, 2)
+	if !ok {
+		if block, ok = protoField(b, 3); !ok {
+			return 0, time.Time{}, fmt.Errorf("GetLatestBlock response has no block")
+		}
+	}
+	header, ok := protoField(block, 1)
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("GetLatestBlock response has no block header")
+	}
+	height, _ := protoVarint(header, 3)
+	var blockTime time.Time
+	if ts, ok := protoField(header, 4); ok {
+		seconds, _ := protoVarint(ts, 1)
+		nanos, _ := protoVarint(ts, 2)
+		blockTime = time.Unix(int64(seconds), int64(nanos))
+	}
+	return int64(height), blockTime, nil
+}
+
+// protoVarint returns the last occurrence of the varint field num in b
+func protoVarint(b []byte, num protowire.Number) (uint64, bool) {
+	var value uint64
+	found := false
+	for len(b) > 0 {
+		n, typ, length := protowire.ConsumeTag(b)
+		if length < 0 {
+			return 0, false
+		}
+		b = b[length:]
+		if n == num && typ == protowire.VarintType {
+			v, length := protowire.ConsumeVarint(b)
+			if length < 0 {
+				return 0, false
+			}
+			value, found = v, true
+			b = b[length:]
+			continue
+		}
+		length = protowire.ConsumeFieldValue(n, typ, b)
+		if length < 0 {
+			return 0, false
+		}
+		b = b[length:]
+	}
+	return value, found
+}
+
+// referenceHeight reads the latest block height from a CometBFT RPC /status endpoint
+func referenceHeight(rpcURL string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(rpcURL, "/")+"/status", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s/status returned %s", rpcURL, resp.Status)
+	}
+	var status struct {
+		Result struct {
+			SyncInfo struct {
+				LatestBlockHeight string `json:"latest_block_height"`
+			} `json:"sync_info"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("failed to decode %s/status: %v", rpcURL, err)
+	}
+	return strconv.ParseInt(status.Result.SyncInfo.LatestBlockHeight, 10, 64)
+}
+
+// staleness describes why an upstream is stale, or returns "" if it is fresh.
+// reference is the reference node's height, or 0 if unknown.
+func (c *FreshnessConfig) staleness(height int64, blockTime time.Time, reference int64) string {
+	if c.MaxBlockAge > 0 && !blockTime.IsZero() {
+		if age := time.Since(blockTime); age > c.MaxBlockAge {
+			return fmt.Sprintf("latest block %d is %s old (max %s)", height, age.Round(time.Second), c.MaxBlockAge)
+		}
+	}
+	if reference > 0 {
+		if lag := reference - height; lag > c.maxLagBlocks() {
+			return fmt.Sprintf("latest block %d is %d blocks behind the reference (max %d)", height, lag, c.maxLagBlocks())
+		}
+	}
+	return ""
+}
+
+// checkFreshness checks every upstream of the endpoint and marks it stale,
+// reporting NOT_SERVING, while any of them is. Upstreams that cannot be
+// checked leave the current state alone.
+func (p *ProxyServer) checkFreshness() {
+	config := p.config.Freshness
+	var reference int64
+	if config.ReferenceRPC != "" {
+		var err error
+		if reference, err = referenceHeight(config.ReferenceRPC); err != nil {
+			p.logf(levelWarn, "Warning: endpoint %s: failed to read reference height: %v", p.config.Name, err)
+		}
+	}
+
+	primary := &route{config: RouteConfig{RemoteAddress: p.config.RemoteAddress}, conn: p.upstream}
+	var stale []string
+	for _, u := range append([]*route{primary}, p.routes...) {
+		height, blockTime, err := p.latestBlock(u.conn)
+		if err != nil {
+			p.logf(levelWarn, "Warning: endpoint %s: failed to read latest block from upstream %s: %v", p.config.Name, u.config.RemoteAddress, err)
+			return
+		}
+		p.observeHeight(strconv.FormatInt(height, 10))
+		if u == primary {
+			p.metrics.Set("upstream_height", intVar(height))
+			if reference > 0 {
+				p.metrics.Set("upstream_lag_blocks", intVar(reference-height))
+			}
+		}
+		if reason := config.staleness(height, blockTime, reference); reason != "" {
+			stale = append(stale, fmt.Sprintf("upstream %s: %s", u.config.RemoteAddress, reason))
+		}
+	}
+
+	if len(stale) > 0 {
+		reason := strings.Join(stale, "; ")
+		if p.stale.Swap(&reason) == nil {
+			p.logf(levelWarn, "Endpoint %s is stale, reporting NOT_SERVING: %s", p.config.Name, reason)
+			p.alerts.send(AlertEndpointStale, p.config.Name, "endpoint %s is stale: %s", p.config.Name, reason)
+		}
+		p.metrics.Set("upstream_stale", intVar(1))
+	} else {
+		if p.stale.Swap(nil) != nil {
+			p.logf(levelInfo, "Endpoint %s upstreams have caught up", p.config.Name)
+		}
+		p.metrics.Set("upstream_stale", intVar(0))
+	}
+	p.updateHealth()
+}
+
+// watchFreshness checks upstream freshness right away and then every
+// interval until the server's upstreams are closed
+func (p *ProxyServer) watchFreshness() {
+	ticker := time.NewTicker(p.config.Freshness.interval())
+	defer ticker.Stop()
+	for {
+		p.checkFreshness()
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
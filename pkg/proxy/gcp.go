@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// GCPConfig configures the Google Secret Manager backend (gcp-sm:).
+// Credentials come from $GOOGLE_APPLICATION_CREDENTIALS (a service account
+// key or gcloud user credentials) or the GCE/GKE metadata server.
+type GCPConfig struct {
+	// Project is used for short references; it defaults to
+	// $GOOGLE_CLOUD_PROJECT or the service account's project
+	Project string `mapstructure:"project"`
+
+	// Endpoint overrides https://secretmanager.googleapis.com
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+const (
+	// gcpMetadataAddress is the GCE and GKE metadata server
+	gcpMetadataAddress = "http://metadata.google.internal"
+
+	// gcpScope grants access to Secret Manager
+	gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// gcpBackend reads secret versions over the Secret Manager REST API
+type gcpBackend struct {
+	project  string
+	endpoint string
+	client   *http.Client
+	token    *accessToken
+}
+
+func newGCPBackend(config GCPConfig) *gcpBackend {
+	b := &gcpBackend{
+		project:  config.Project,
+		endpoint: strings.TrimSuffix(config.Endpoint, "/"),
+		client:   &http.Client{Timeout: secretFetchTimeout},
+	}
+	if b.project == "" {
+		b.project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if b.project == "" {
+		if creds, err := readGCPCredentials(); err == nil && creds != nil {
+			b.project = creds.ProjectID
+		}
+	}
+	if b.endpoint == "" {
+		b.endpoint = "https://secretmanager.googleapis.com"
+	}
+	b.token = &accessToken{fetch: b.fetchToken}
+	return b
+}
+
+// resourceName expands a reference to projects/<p>/secrets/<s>/versions/<v>.
+// Short references name just the secret, or <secret>/versions/<v>, in the
+// default project; the latest version is used unless one is given.
+func (b *gcpBackend) resourceName(path string) (string, error) {
+	if !strings.HasPrefix(path, "projects/") {
+		if b.project == "" {
+			return "", fmt.Errorf("GCP project is not set for %q (secrets.gcp.project or GOOGLE_CLOUD_PROJECT)", path)
+		}
+		path = "projects/" + b.project + "/secrets/" + path
+	}
+	if !strings.Contains(path, "/versions/") {
+		path += "/versions/latest"
+	}
+	return path, nil
+}
+
+// fetch accesses a secret version and returns its payload
+func (b *gcpBackend) fetch(ctx context.Context, path string) (secret, error) {
+	token, err := b.token.get(ctx)
+	if err != nil {
+		return secret{}, fmt.Errorf("no GCP credentials: %v", err)
+	}
+	name, err := b.resourceName(path)
+	if err != nil {
+		return secret{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.endpoint+"/v1/"+name+":access", nil)
+	if err != nil {
+		return secret{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	body, err := secretsDo(b.client, req)
+	if err != nil {
+		return secret{}, err
+	}
+
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return secret{}, fmt.Errorf("invalid Secret Manager response: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return secret{}, fmt.Errorf("invalid secret payload: %v", err)
+	}
+	return secret{value: strings.TrimSpace(string(data))}, nil
+}
+
+// gcpCredentialsFile is the subset of an application default credentials file the proxy uses
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ProjectID    string `json:"project_id"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user, as written by gcloud auth application-default login
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// fetchToken obtains an access token from the credentials file or the metadata server
+func (b *gcpBackend) fetchToken(ctx context.Context) (string, time.Duration, error) {
+	creds, err := readGCPCredentials()
+	if err != nil {
+		return "", 0, err
+	}
+	if creds == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			gcpMetadataAddress+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return doTokenRequest(b.client, req)
+	}
+
+	switch creds.Type {
+	case "service_account":
+		assertion, err := serviceAccountAssertion(*creds, time.Now())
+		if err != nil {
+			return "", 0, err
+		}
+		return postForm(ctx, b.client, creds.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+	case "authorized_user":
+		return postForm(ctx, b.client, "https://oauth2.googleapis.com/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {creds.ClientID},
+			"client_secret": {creds.ClientSecret},
+			"refresh_token": {creds.RefreshToken},
+		})
+	default:
+		return "", 0, fmt.Errorf("unsupported credentials type %q in GOOGLE_APPLICATION_CREDENTIALS", creds.Type)
+	}
+}
+
+// readGCPCredentials loads $GOOGLE_APPLICATION_CREDENTIALS, returning nil when it is not set
+func readGCPCredentials() (*gcpCredentialsFile, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GOOGLE_APPLICATION_CREDENTIALS: %v", err)
+	}
+	var creds gcpCredentialsFile
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return nil, fmt.Errorf("invalid GOOGLE_APPLICATION_CREDENTIALS: %v", err)
+	}
+	return &creds, nil
+}
+
+// serviceAccountAssertion signs the JWT a service account exchanges for an access token
+func serviceAccountAssertion(creds gcpCredentialsFile, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("service account private_key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("invalid service account private_key: %v", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("service account private_key is not an RSA key")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": creds.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcpScope,
+		"aud":   creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
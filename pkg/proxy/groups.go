@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// inGroup reports whether selector names the endpoint or one of its groups
+func (c Config) inGroup(selector string) bool {
+	if c.Name == selector {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == selector {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectEndpoints returns the endpoints matching a name or group in only,
+// all of them if only is empty, minus those matching a name or group in
+// exclude. It also returns the selectors that match no endpoint, which
+// usually means a typo. Selecting no endpoint at all is an error.
+func SelectEndpoints(endpoints []Config, only, exclude []string) ([]Config, []string, error) {
+	used := make(map[string]bool, len(only)+len(exclude))
+	matches := func(c Config, selectors []string) bool {
+		matched := false
+		for _, s := range selectors {
+			if c.inGroup(s) {
+				used[s] = true
+				matched = true
+			}
+		}
+		return matched
+	}
+
+	var selected []Config
+	for _, c := range endpoints {
+		included := len(only) == 0 || matches(c, only)
+		if matches(c, exclude) || !included {
+			continue
+		}
+		selected = append(selected, c)
+	}
+
+	var unmatched []string
+	for _, s := range append(append([]string{}, only...), exclude...) {
+		if !used[s] {
+			unmatched = append(unmatched, s)
+		}
+	}
+	if len(selected) == 0 && len(endpoints) > 0 {
+		return nil, unmatched, fmt.Errorf("no endpoint left after selecting %s", describeSelection(only, exclude))
+	}
+	return selected, unmatched, nil
+}
+
+// describeSelection formats only and exclude like the flags that set them
+func describeSelection(only, exclude []string) string {
+	var parts []string
+	if len(only) > 0 {
+		parts = append(parts, "--only "+strings.Join(only, ","))
+	}
+	if len(exclude) > 0 {
+		parts = append(parts, "--exclude "+strings.Join(exclude, ","))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// defaultHedgeDelay is how long the primary upstream has before a call is
+// hedged when no delay is configured
+const defaultHedgeDelay = 100 * time.Millisecond
+
+// HedgeConfig sends a call that the endpoint's upstream has not answered
+// within Delay to a second upstream as well, and returns whichever answers
+// first. Only calls sending a single request are hedged.
+type HedgeConfig struct {
+	RemoteAddress string `mapstructure:"remote_address"`
+	UseTLS        bool   `mapstructure:"use_tls"`
+
+	// JWTToken authenticates hedged calls (default the endpoint's token)
+	JWTToken string `mapstructure:"jwt_token"`
+
+	// Delay is how long the primary has to answer (default 100ms)
+	Delay time.Duration `mapstructure:"delay"`
+
+	// Methods limits hedging to these full method name prefixes. Without a
+	// list, only Cosmos Query services are hedged, as they are read-only.
+	Methods []string `mapstructure:"methods"`
+}
+
+// matches reports whether fullMethodName may be hedged
+func (c *HedgeConfig) matches(fullMethodName string) bool {
+	return (&CompareConfig{Methods: c.Methods}).matches(fullMethodName)
+}
+
+// delay returns the configured delay or the default
+func (c *HedgeConfig) delay() time.Duration {
+	if c.Delay > 0 {
+		return c.Delay
+	}
+	return defaultHedgeDelay
+}
+
+// validate checks the hedge upstream and delay
+func (c *HedgeConfig) validate() error {
+	if c.RemoteAddress == "" {
+		return fmt.Errorf("hedge requires a remote_address")
+	}
+	if c.Delay < 0 {
+		return fmt.Errorf("hedge delay must not be negative")
+	}
+	return nil
+}
+
+// hedgeInterceptor is the innermost interceptor. For selected single-request
+// calls to the endpoint's upstream it makes the upstream call itself,
+// hedges it after the delay, and replays the first successful answer to
+// the client. The other call is cancelled.
+func (p *ProxyServer) hedgeInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.hedgeConn == nil || !p.config.Hedge.matches(info.FullMethod) || p.isLocalService(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	req, stream, ok := singleRequest(ss)
+	if !ok {
+		return handler(srv, stream)
+	}
+	ctx, conn, err := p.director(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	// Calls routed elsewhere, e.g. to an archive node, have no equivalent to hedge to
+	if conn != p.upstream {
+		return handler(srv, stream)
+	}
+	return p.hedgedCall(ctx, upstreamMethod(ctx, info.FullMethod), req).replay(ss)
+}
+
+// hedgedCall sends req to the upstream and, if it has not answered within
+// the delay, to the hedge upstream too. The first success wins; if both
+// fail, the primary's error is returned.
+func (p *ProxyServer) hedgedCall(ctx context.Context, method string, req proto.Message) *callResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type answer struct {
+		result *callResult
+		hedged bool
+	}
+	answers := make(chan answer, 2)
+	go func() {
+		answers <- answer{result: unaryCall(ctx, p.upstream, method, req)}
+	}()
+
+	timer := time.NewTimer(p.config.Hedge.delay())
+	defer timer.Stop()
+	var primary *callResult
+	select {
+	case a := <-answers:
+		// An error before the delay is returned as is; retrying is not hedging
+		return a.result
+	case <-timer.C:
+	}
+
+	p.metrics.Add("hedged_calls", 1)
+	hedgeCtx := ctx
+	if token := p.config.Hedge.JWTToken; token != "" {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		md = md.Copy()
+		p.auth.removeMetadata(md)
+		md.Set("authorization", "Bearer "+token)
+		hedgeCtx = metadata.NewOutgoingContext(ctx, md)
+	}
+	go func() {
+		answers <- answer{result: unaryCall(hedgeCtx, p.hedgeConn, method, req), hedged: true}
+	}()
+
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		if a.result.err == nil {
+			if a.hedged {
+				p.metrics.Add("hedge_wins", 1)
+			}
+			return a.result
+		}
+		if !a.hedged {
+			primary = a.result
+		}
+	}
+	return primary
+}
+
+// unaryCall sends a single request on conn and collects the header,
+// responses and trailer
+func unaryCall(ctx context.Context, conn grpc.ClientConnInterface, method string, req proto.Message) *callResult {
+	result := &callResult{}
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if err := stream.SendMsg(req); err == nil {
+		stream.CloseSend()
+	}
+	for {
+		resp := &emptypb.Empty{}
+		if err := stream.RecvMsg(resp); err != nil {
+			if err != io.EOF {
+				result.err = err
+			}
+			break
+		}
+		b, _ := proto.Marshal(resp)
+		result.responses = append(result.responses, b)
+	}
+	result.header, _ = stream.Header()
+	result.trailer = stream.Trailer()
+	return result
+}
@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/status"
+)
+
+// Endpoint types
+const (
+	// TypeGRPC proxies gRPC calls (the default)
+	TypeGRPC = "grpc"
+
+	// TypeHTTP reverse-proxies HTTP and WebSocket traffic, e.g. a
+	// Tendermint/CometBFT RPC or Cosmos LCD host
+	TypeHTTP = "http"
+)
+
+// httpUnsupported lists the gRPC-only options set on an http endpoint
+func (c Config) httpUnsupported() []string {
+	options := []struct {
+		name  string
+		isSet bool
+	}{
+		{"allowed_methods", len(c.AllowedMethods) > 0},
+		{"denied_methods", len(c.DeniedMethods) > 0},
+		{"compare", c.Compare != nil},
+		{"hedge", c.Hedge != nil},
+		{"cache", c.Cache != nil},
+		{"dedup", c.Dedup != nil},
+		{"rest", c.REST != nil},
+		{"routes", len(c.Routes) > 0},
+		{"fallbacks", len(c.Fallbacks) > 0},
+		{"capture", c.Capture != nil},
+		{"message_log", c.MessageLog != nil},
+		{"descriptor_set", c.DescriptorSet != ""},
+		{"reflection_cache", c.ReflectionCache != nil},
+		{"faults", c.Faults != nil},
+		{"errors", c.Errors != nil},
+		{"lanes", len(c.Lanes) > 0},
+		{"slos", len(c.SLOs) > 0},
+		{"expected_chain_id", c.ExpectedChainID != ""},
+		{"freshness", c.Freshness != nil},
+		{"outlier_detection", c.OutlierDetection != nil},
+		{"affinity", c.Affinity != nil},
+		{"upstream_protocol", c.UpstreamProtocol != ""},
+		{"resolve_to", len(c.ResolveTo) > 0},
+		{"compression", c.Compression != ""},
+	}
+	var set []string
+	for _, o := range options {
+		if o.isSet {
+			set = append(set, o.name)
+		}
+	}
+	return set
+}
+
+// httpTarget parses an http endpoint's remote_address; ws:// and wss:// are
+// accepted as aliases of http:// and https://
+func httpTarget(remoteAddress string) (*url.URL, error) {
+	target, err := url.Parse(remoteAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote_address: %v", err)
+	}
+	switch target.Scheme {
+	case "http", "https":
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("remote_address of an http endpoint must be an http:// or https:// URL, got %q", remoteAddress)
+	}
+	return target, nil
+}
+
+// newHTTPProxyServer creates the ProxyServer for a type: http endpoint, which
+// serves a reverse proxy instead of a gRPC server
+func newHTTPProxyServer(config Config, o options, token secret, roots *rootCAs, acl *cidrACL, auth *upstreamAuth, callers *clientJWT, level logLevel) (*ProxyServer, error) {
+	if unsupported := config.httpUnsupported(); len(unsupported) > 0 {
+		return nil, fmt.Errorf("endpoint '%s' of type http does not support %s", config.Name, strings.Join(unsupported, ", "))
+	}
+	target, err := httpTarget(config.RemoteAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ProxyServer{
+		config:   config,
+		logLevel: level,
+		metrics:  endpointMetrics(config.Name),
+		health:   health.NewServer(),
+		clients:  o.clients,
+
+		connLimiter: o.connLimiter,
+		acl:         acl,
+		secrets:     o.secrets,
+		roots:       roots,
+		audit:       o.audit,
+		usage:       o.usage,
+		quotas:      o.quotas,
+		alerts:      o.alerts,
+		auth:        auth,
+		clientJWT:   callers,
+		closed:      make(chan struct{}),
+	}
+	knownSecrets.add(token.value)
+	p.token.Store(&token.value)
+	if config.MaxConcurrentStreams > 0 {
+		p.metrics.Set("max_concurrent_streams", intVar(int64(config.MaxConcurrentStreams)))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if target.Scheme == "https" {
+		transport.TLSClientConfig = upstreamTLSConfig(config, roots)
+	}
+	rp := &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			if config.AuthorityOverride != "" {
+				r.Out.Host = config.AuthorityOverride
+			}
+			client, ok := clientFromContext(r.In.Context())
+			// The local API key must never reach the provider
+			r.Out.Header.Del(apiKeyHeader)
+			p.auth.setHeader(r.Out.Header, r.Out.URL.Path, p.upstreamToken(r.In.Context(), client, ok))
+		},
+		// httpHandler already returns the request ID, so drop one the upstream echoed
+		ModifyResponse: func(res *http.Response) error {
+			res.Header.Del(requestIDHeader)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logf(levelWarn, "HTTP proxy %s error for %s: %v", config.Name, r.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	var handler http.Handler = rp
+	if config.WebSocket != nil {
+		handler = p.superviseWebSockets(target, transport.TLSClientConfig, rp)
+	}
+
+	// Requests derive from baseCtx, so cancelling it at the end of a drain
+	// also closes hijacked WebSocket connections, which Shutdown leaves alone
+	baseCtx, cancel := context.WithCancel(context.Background())
+	p.httpCancel = cancel
+	p.httpServer = &http.Server{
+		Handler:           p.httpHandler(handler),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	if config.JWTTokenRef != "" || p.auth.renewer != nil {
+		go p.refreshToken(token)
+	}
+	if p.alerts != nil {
+		go p.watchTokenExpiry()
+	}
+	if callers != nil {
+		go p.watchJWKS()
+	}
+	if roots != nil && config.CAFile != "" {
+		go p.watchCAFile()
+	}
+	return p, nil
+}
+
+// clientKey carries the authenticated client of an HTTP request
+type clientKey struct{}
+
+// clientFromContext returns the client stored by httpHandler, if any
+func clientFromContext(ctx context.Context) (ClientConfig, bool) {
+	client, ok := ctx.Value(clientKey{}).(ClientConfig)
+	return client, ok
+}
+
+// httpHandler authenticates local callers, enforces max_concurrent_streams
+// and client quotas, and counts requests and usage like trackInterceptor
+// does for gRPC calls. A WebSocket
+// connection counts as one request for as long as it stays open.
+func (p *ProxyServer) httpHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active := p.activeStreams.Add(1)
+		p.metrics.Add("active_streams", 1)
+		defer func() {
+			p.activeStreams.Add(-1)
+			p.metrics.Add("active_streams", -1)
+		}()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = httpRequestID(rec, r)
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		client, ok, err := p.clients.authenticateKey(r.Header.Get(apiKeyHeader), r.TLS)
+		var jwtErr error
+		if err == nil {
+			r, jwtErr = p.checkHTTPClientJWT(r, client.Name)
+		}
+		m := p.maintenance.Load()
+		switch {
+		case m != nil:
+			p.metrics.Add("maintenance_rejected", 1)
+			p.rejectMaintenanceHTTP(rec, m)
+		case err != nil:
+			p.metrics.Add("unauthenticated", 1)
+			http.Error(rec, status.Convert(err).Message(), http.StatusUnauthorized)
+		case jwtErr != nil:
+			code := http.StatusUnauthorized
+			if status.Code(jwtErr) == codes.PermissionDenied {
+				code = http.StatusForbidden
+			}
+			http.Error(rec, status.Convert(jwtErr).Message(), code)
+		case ok && client.policy != nil:
+			// Policies name gRPC methods, which HTTP requests have none of
+			p.metrics.Add("policy_denied", 1)
+			http.Error(rec, fmt.Sprintf("client %s is restricted by policies to gRPC methods", client.Name), http.StatusForbidden)
+		case p.config.MaxConcurrentStreams > 0 && active > int64(p.config.MaxConcurrentStreams):
+			p.metrics.Add("concurrency_rejected", 1)
+			http.Error(rec, fmt.Sprintf("endpoint %s is at its limit of %d concurrent requests", p.config.Name, p.config.MaxConcurrentStreams), http.StatusServiceUnavailable)
+		default:
+			if reset, err := p.quotas.check(client); err != nil {
+				p.metrics.Add("quota_rejected", 1)
+				rec.Header().Set(quotaResetHeader, reset.Format(time.RFC3339))
+				http.Error(rec, status.Convert(err).Message(), http.StatusTooManyRequests)
+				break
+			}
+			if ok {
+				p.metrics.Add("client_"+client.Name+"_calls", 1)
+				r = r.WithContext(context.WithValue(r.Context(), clientKey{}, client))
+			}
+			next.ServeHTTP(rec, r)
+			if ok {
+				p.quotas.add(client, body.n+rec.written)
+			}
+		}
+
+		p.callsTotal.Add(1)
+		p.metrics.Add("calls_total", 1)
+		failed := rec.status >= http.StatusInternalServerError || rec.status == http.StatusUnauthorized || rec.status == http.StatusTooManyRequests
+		if failed {
+			p.callsFailed.Add(1)
+			p.metrics.Add("calls_failed", 1)
+		}
+		// A WebSocket connection's lifetime is not a latency
+		if elapsed := time.Since(start); !isWebSocketUpgrade(r) {
+			p.recent.record(elapsed, failed)
+			if threshold := p.config.SlowRequestThreshold; threshold > 0 && elapsed > threshold {
+				p.logSlowCall(r.Method+" "+r.URL.Path, requestIDFromContext(r.Context()), r.URL.Query().Get("height"), elapsed, body.n, rec.written, client.Name, r.RemoteAddr, http.StatusText(rec.status))
+			}
+		}
+		p.logAccess(r.Method+" "+r.URL.Path, requestIDFromContext(r.Context()), strconv.Itoa(rec.status), failed, time.Since(start), body.n, rec.written, client.Name, r.RemoteAddr)
+		p.usage.add(p.config.Name, client.Name, body.n, rec.written, failed)
+	})
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// statusRecorder remembers the response status and counts the body bytes
+// written. Unwrap lets the reverse proxy reach the underlying connection to
+// hijack it for WebSockets.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// drainHTTP stops an http endpoint: new connections are refused and open
+// requests, including WebSocket connections, get until ctx expires to finish
+func (p *ProxyServer) drainHTTP(ctx context.Context) (int64, error) {
+	p.logf(levelInfo, "Draining HTTP proxy for %s (%d active requests)", p.config.Name, p.activeStreams.Load())
+	err := p.httpServer.Shutdown(ctx)
+
+	// Shutdown does not wait for hijacked WebSocket connections
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for err == nil && p.activeStreams.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	var remaining int64
+	if err != nil {
+		remaining = p.activeStreams.Load()
+		p.logf(levelInfo, "Drain timeout for %s, closing %d remaining requests", p.config.Name, remaining)
+		p.httpServer.Close()
+	} else {
+		p.logf(levelInfo, "Stopped HTTP proxy for %s", p.config.Name)
+	}
+	p.httpCancel()
+	return remaining, err
+}
+
+// serveHTTP serves an http endpoint on lis until it is drained
+func (p *ProxyServer) serveHTTP(lis net.Listener) error {
+	if err := p.serveHTTPServer(p.httpServer, lis); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveHTTPServer serves s on lis, over TLS when the endpoint's listeners
+// use it
+func (p *ProxyServer) serveHTTPServer(s *http.Server, lis net.Listener) error {
+	if p.listenerTLS == nil {
+		return s.Serve(lis)
+	}
+	s.TLSConfig = p.listenerTLS
+	return s.ServeTLS(lis, "", "")
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenClaims are the registered claims of a JWT, decoded without verifying
+// its signature. The proxy never needs to trust these; they are only used to
+// report on tokens, e.g. when they expire.
+type TokenClaims struct {
+	Algorithm string
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	IssuedAt  time.Time
+	NotBefore time.Time
+}
+
+// DecodeToken decodes the header and registered claims of a JWT
+func DecodeToken(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT: expected 3 dot-separated parts, got %d", len(parts))
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %v", err)
+	}
+
+	var claims struct {
+		Iss string          `json:"iss"`
+		Sub string          `json:"sub"`
+		Aud json.RawMessage `json:"aud"`
+		Exp json.Number     `json:"exp"`
+		Iat json.Number     `json:"iat"`
+		Nbf json.Number     `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %v", err)
+	}
+
+	tc := &TokenClaims{
+		Algorithm: header.Alg,
+		Issuer:    claims.Iss,
+		Subject:   claims.Sub,
+		ExpiresAt: numericDate(claims.Exp),
+		IssuedAt:  numericDate(claims.Iat),
+		NotBefore: numericDate(claims.Nbf),
+	}
+
+	// aud is either a single string or an array of strings
+	if len(claims.Aud) > 0 {
+		var single string
+		if err := json.Unmarshal(claims.Aud, &single); err == nil {
+			tc.Audience = []string{single}
+		} else if err := json.Unmarshal(claims.Aud, &tc.Audience); err != nil {
+			return nil, fmt.Errorf("invalid JWT aud claim: %v", err)
+		}
+	}
+	return tc, nil
+}
+
+// decodeSegment decodes a base64url JWT segment into v
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// numericDate converts a JWT NumericDate (seconds since the epoch) to a time;
+// a missing or malformed value gives the zero time
+func numericDate(n json.Number) time.Time {
+	f, err := n.Float64()
+	if err != nil || f == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(f), 0)
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// keyringService is the service name tokens are stored under in the OS keychain
+const keyringService = "grpc-proxy"
+
+// keyringBackend reads keyring: references from the OS keychain: macOS
+// Keychain, Windows Credential Manager, or the Secret Service on Linux
+type keyringBackend struct{}
+
+func (keyringBackend) fetch(ctx context.Context, name string) (secret, error) {
+	value, err := keyringGet(ctx, name)
+	if err != nil {
+		return secret{}, err
+	}
+	return secret{value: strings.TrimSpace(value)}, nil
+}
+
+// SetKeyringToken stores token in the OS keychain, where jwt_token_ref
+// keyring:<name> finds it
+func SetKeyringToken(name, token string) error {
+	if name == "" || strings.ContainsAny(name, "\"\n") {
+		return fmt.Errorf("invalid keyring name %q", name)
+	}
+	if token == "" {
+		return fmt.Errorf("empty token")
+	}
+	return keyringSet(name, token)
+}
+
+// commandError describes a failed keychain command, including its error output
+func commandError(action string, err error, stderr string) error {
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		return fmt.Errorf("%s: %v: %s", action, err, stderr)
+	}
+	return fmt.Errorf("%s: %v", action, err)
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keyringGet reads a generic password from the login keychain
+func keyringGet(ctx context.Context, name string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "security", "find-generic-password", "-s", keyringService, "-a", name, "-w")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", commandError(fmt.Sprintf("keychain item %s/%s", keyringService, name), err, stderr.String())
+	}
+	return string(out), nil
+}
+
+// keyringSet adds or updates a generic password in the login keychain. The
+// command is fed through security's interactive mode so the token never
+// appears in the process list.
+func keyringSet(name, token string) error {
+	if strings.ContainsAny(token, "\"\\\n") {
+		return fmt.Errorf("token contains characters that cannot be stored")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %q -a %q -w \"%s\"\n", keyringService, name, token))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return commandError("failed to store in keychain", err, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build !darwin && !windows
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keyringGet looks the token up through the Secret Service (GNOME Keyring,
+// KWallet) with secret-tool from libsecret
+func keyringGet(ctx context.Context, name string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "secret-tool", "lookup", "service", keyringService, "account", name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", commandError(fmt.Sprintf("secret service item %s/%s", keyringService, name), err, stderr.String())
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("no secret service item %s/%s", keyringService, name)
+	}
+	return string(out), nil
+}
+
+// keyringSet stores the token through the Secret Service; secret-tool reads
+// it from stdin so it never appears in the process list
+func keyringSet(name, token string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "store", "--label", fmt.Sprintf("%s token for %s", keyringService, name),
+		"service", keyringService, "account", name)
+	cmd.Stdin = strings.NewReader(token)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return commandError("failed to store in secret service", err, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultLaneHeader is the metadata key clients use to select a traffic lane
+const defaultLaneHeader = "x-proxy-lane"
+
+// defaultLaneName is the lane used by calls that do not select one
+const defaultLaneName = "default"
+
+// LaneConfig configures a named traffic lane with its own concurrency pool and
+// rate limit, so e.g. batch jobs cannot degrade latency for interactive clients
+type LaneConfig struct {
+	Name string `mapstructure:"name"`
+
+	// MaxConcurrent caps in-flight calls in the lane (0 = unlimited)
+	MaxConcurrent int `mapstructure:"max_concurrent"`
+
+	// RateLimit is the sustained calls per second admitted to the lane (0 = unlimited)
+	RateLimit float64 `mapstructure:"rate_limit"`
+	Burst     int     `mapstructure:"burst"`
+
+	// QueueTimeout bounds how long a call waits for a slot before it is
+	// rejected with RESOURCE_EXHAUSTED (0 = wait for as long as the client does)
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+}
+
+// minSharedRateWindow is the shortest window of a rate limit shared through Redis
+const minSharedRateWindow = 100 * time.Millisecond
+
+// lane enforces a LaneConfig
+type lane struct {
+	config  LaneConfig
+	slots   chan struct{}
+	limiter *rate.Limiter
+
+	// shared enforces the rate limit across replicas under key when Redis
+	// is configured
+	shared *redisClient
+	key    string
+}
+
+func newLane(endpoint string, config LaneConfig, shared *redisClient) *lane {
+	l := &lane{config: config, shared: shared, key: endpoint + ":" + config.Name}
+	if config.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, config.MaxConcurrent)
+	}
+	if config.RateLimit > 0 {
+		burst := config.Burst
+		if burst <= 0 {
+			burst = int(config.RateLimit)
+			if burst < 1 {
+				burst = 1
+			}
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), burst)
+	}
+	return l
+}
+
+// acquire waits for the lane's rate limit and a concurrency slot. The returned
+// function releases the slot and must be called when the call completes.
+func (l *lane) acquire(ctx context.Context) (func(), error) {
+	if l.config.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.config.QueueTimeout)
+		defer cancel()
+	}
+
+	if l.limiter != nil {
+		if err := l.wait(ctx); err != nil {
+			return nil, status.Errorf(codes.ResourceExhausted, "lane %q rate limit exceeded", l.config.Name)
+		}
+	}
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, status.Errorf(codes.ResourceExhausted, "lane %q has no free slots (max %d concurrent)", l.config.Name, l.config.MaxConcurrent)
+	}
+}
+
+// wait blocks until the lane's rate limit admits a call. With Redis the
+// limit is shared by every replica: each window of burst/rate seconds (at
+// least 100ms) admits burst calls. The local limiter takes over while Redis
+// cannot be reached.
+func (l *lane) wait(ctx context.Context) error {
+	if !l.shared.enabled() {
+		return l.limiter.Wait(ctx)
+	}
+	limit := int64(l.limiter.Burst())
+	window := time.Duration(float64(limit) / l.config.RateLimit * float64(time.Second))
+	if window < minSharedRateWindow {
+		window = minSharedRateWindow
+		limit = int64(math.Ceil(l.config.RateLimit * window.Seconds()))
+	}
+	for {
+		index := time.Now().UnixNano() / int64(window)
+		key := l.shared.key(fmt.Sprintf("rate:%s:%d", l.key, index))
+		replies, err := l.shared.do(ctx, []string{"INCR", key}, []string{"PEXPIRE", key, strconv.FormatInt(2*window.Milliseconds(), 10)})
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !l.shared.observe(err) {
+			return l.limiter.Wait(ctx)
+		}
+		if redisInt(replies[0]) <= limit {
+			return nil
+		}
+		timer := time.NewTimer(time.Until(time.Unix(0, (index+1)*int64(window))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// newLanes builds the lane table for an endpoint, sharing rate limits
+// through Redis when it is configured
+func newLanes(endpoint string, configs []LaneConfig, shared *redisClient) (map[string]*lane, error) {
+	lanes := make(map[string]*lane, len(configs))
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("lane without a name")
+		}
+		if _, dup := lanes[c.Name]; dup {
+			return nil, fmt.Errorf("duplicate lane %q", c.Name)
+		}
+		lanes[c.Name] = newLane(endpoint, c, shared)
+	}
+	return lanes, nil
+}
+
+// laneHeader returns the metadata key used to select a lane on this endpoint
+func (p *ProxyServer) laneHeader() string {
+	if p.config.LaneHeader != "" {
+		return p.config.LaneHeader
+	}
+	return defaultLaneHeader
+}
+
+// laneInterceptor admits each call through the lane selected by the lane header.
+// Calls without a header, or naming an unknown lane, use the "default" lane if
+// one is configured and are otherwise unrestricted.
+func (p *ProxyServer) laneInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if len(p.lanes) == 0 {
+		return handler(srv, ss)
+	}
+
+	l, ok := p.lanes[incomingHeader(ss.Context(), p.laneHeader())]
+	if !ok {
+		if l, ok = p.lanes[defaultLaneName]; !ok {
+			return handler(srv, ss)
+		}
+	}
+
+	release, err := l.acquire(ss.Context())
+	if err != nil {
+		p.metrics.Add("lane_"+l.config.Name+"_rejected", 1)
+		return err
+	}
+	defer release()
+
+	p.metrics.Add("lane_"+l.config.Name+"_inflight", 1)
+	defer p.metrics.Add("lane_"+l.config.Name+"_inflight", -1)
+
+	return handler(srv, ss)
+}
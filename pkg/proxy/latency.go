@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentCallsSize is how many of the latest calls latency and error rate
+// are computed over
+const recentCallsSize = 1024
+
+// recentCall is one finished call
+type recentCall struct {
+	duration time.Duration
+	failed   bool
+}
+
+// recentCalls keeps the latest finished calls of an endpoint in a ring
+type recentCalls struct {
+	mu    sync.Mutex
+	calls [recentCallsSize]recentCall
+	next  int
+	full  bool
+}
+
+// record adds a finished call, replacing the oldest once the ring is full
+func (r *recentCalls) record(d time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[r.next] = recentCall{duration: d, failed: failed}
+	r.next++
+	if r.next == recentCallsSize {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// callStats summarizes the latest calls of an endpoint
+type callStats struct {
+	calls     int
+	p50, p99  time.Duration
+	errorRate float64
+}
+
+// stats returns the latency percentiles and error rate of the recorded calls
+func (r *recentCalls) stats() callStats {
+	r.mu.Lock()
+	n := r.next
+	if r.full {
+		n = recentCallsSize
+	}
+	durations := make([]time.Duration, n)
+	failed := 0
+	for i := 0; i < n; i++ {
+		durations[i] = r.calls[i].duration
+		if r.calls[i].failed {
+			failed++
+		}
+	}
+	r.mu.Unlock()
+
+	if n == 0 {
+		return callStats{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(q float64) time.Duration {
+		return durations[int(q*float64(n-1)+0.5)]
+	}
+	return callStats{calls: n, p50: percentile(0.50), p99: percentile(0.99), errorRate: float64(failed) / float64(n)}
+}
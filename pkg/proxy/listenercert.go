@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspFetchTimeout bounds a request to the OCSP responder
+const ocspFetchTimeout = 10 * time.Second
+
+// ocspRetryInterval is how soon a failed OCSP fetch is retried, and the
+// soonest a response is refreshed
+const ocspRetryInterval = time.Minute
+
+// maxOCSPResponseSize limits how much of a responder's answer is read
+const maxOCSPResponseSize = 1 << 20
+
+// listenerCert is a listener certificate loaded from cert_file and
+// key_file. Handshakes use whichever certificate was loaded last.
+type listenerCert struct {
+	config *ListenerTLSConfig
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+// loadListenerCert reads the certificate files of config
+func loadListenerCert(config *ListenerTLSConfig) (*listenerCert, error) {
+	certPEM, err := os.ReadFile(config.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load listener certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load listener certificate: %v", err)
+	}
+	c := &listenerCert{config: config}
+	cert, err := c.parse(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	c.cert.Store(cert)
+	return c, nil
+}
+
+// parse checks a certificate and key read from the files
+func (c *listenerCert) parse(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load listener certificate: %v", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("failed to load listener certificate: %v", err)
+		}
+	}
+	if c.config.OCSPStapling && len(cert.Certificate) < 2 {
+		return nil, fmt.Errorf("tls ocsp_stapling needs the issuer certificate after the leaf in cert_file")
+	}
+	return &cert, nil
+}
+
+// getCertificate serves the current certificate to every handshake
+func (c *listenerCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// watchListenerCert reloads the listener certificate when cert_file or
+// key_file change until the server's upstreams are closed. New handshakes
+// use the new certificate; established connections are kept. With
+// ocsp_stapling it also keeps the stapled OCSP response fresh.
+func (p *ProxyServer) watchListenerCert() {
+	lc := p.listenerCert
+	lastCert, _ := os.ReadFile(lc.config.CertFile)
+	lastKey, _ := os.ReadFile(lc.config.KeyFile)
+
+	// refresh is when the staple is next fetched; zero fetches it at once
+	var refresh time.Time
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+	for {
+		if lc.config.OCSPStapling && !time.Now().Before(refresh) {
+			refresh = p.stapleOCSP()
+		}
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+
+		certPEM, certErr := os.ReadFile(lc.config.CertFile)
+		keyPEM, keyErr := os.ReadFile(lc.config.KeyFile)
+		if certErr != nil || keyErr != nil || (bytes.Equal(certPEM, lastCert) && bytes.Equal(keyPEM, lastKey)) {
+			continue
+		}
+		// A half-written pair is retried once the other file changes too
+		lastCert, lastKey = certPEM, keyPEM
+		cert, err := lc.parse(certPEM, keyPEM)
+		if err != nil {
+			p.logf(levelWarn, "Ignoring updated listener certificate for %s: %v", p.config.Name, err)
+			continue
+		}
+		lc.cert.Store(cert)
+		p.metrics.Add("listener_cert_reloads", 1)
+		p.logf(levelInfo, "Reloaded listener certificate for %s, valid until %s", p.config.Name, cert.Leaf.NotAfter.Format(time.RFC3339))
+		refresh = time.Time{}
+	}
+}
+
+// stapleOCSP fetches an OCSP response for the listener certificate and
+// staples it, returning when to refresh it. On failure the previous
+// staple, if any, is kept until it is replaced.
+func (p *ProxyServer) stapleOCSP() time.Time {
+	current := p.listenerCert.cert.Load()
+	ctx, cancel := context.WithTimeout(context.Background(), ocspFetchTimeout)
+	defer cancel()
+	resp, raw, err := fetchOCSP(ctx, current)
+	if err == nil && resp.Status != ocsp.Good {
+		err = fmt.Errorf("responder reports the certificate as %s", ocspStatusName(resp.Status))
+	}
+	if err != nil {
+		p.metrics.Add("ocsp_errors", 1)
+		p.logf(levelWarn, "Warning: endpoint %s: failed to staple OCSP response: %v", p.config.Name, err)
+		return time.Now().Add(ocspRetryInterval)
+	}
+
+	stapled := *current
+	stapled.OCSPStaple = raw
+	// A certificate reloaded meanwhile gets its own staple on the next pass
+	p.listenerCert.cert.CompareAndSwap(current, &stapled)
+	return ocspRefreshTime(resp, time.Now())
+}
+
+// fetchOCSP asks the OCSP responder named in cert's leaf about it
+func fetchOCSP(ctx context.Context, cert *tls.Certificate) (*ocsp.Response, []byte, error) {
+	leaf := cert.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, fmt.Errorf("the certificate names no OCSP responder")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid issuer certificate: %v", err)
+	}
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder %s returned %s", leaf.OCSPServer[0], res.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(res.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	return resp, raw, nil
+}
+
+// ocspRefreshTime is halfway through the response's validity, so a staple
+// is replaced well before clients would reject it
+func ocspRefreshTime(resp *ocsp.Response, now time.Time) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return now.Add(time.Hour)
+	}
+	refresh := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if refresh.Before(now.Add(ocspRetryInterval)) {
+		return now.Add(ocspRetryInterval)
+	}
+	return refresh
+}
+
+// ocspStatusName describes an OCSP certificate status for the log
+func ocspStatusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
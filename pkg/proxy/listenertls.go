@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ListenerTLSConfig serves an endpoint's listeners, including its REST
+// companion, over TLS with either a certificate from files or one obtained
+// through ACME
+type ListenerTLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+
+	// ACMEHosts are the hostnames to obtain a certificate for from the CA
+	// configured under acme
+	ACMEHosts []string `mapstructure:"acme_hosts"`
+
+	// OCSPStapling staples the issuer's OCSP response for cert_file to
+	// handshakes. cert_file must hold the issuer certificate after the leaf.
+	OCSPStapling bool `mapstructure:"ocsp_stapling"`
+
+	// ClientCAFile requires clients to present a certificate issued by one
+	// of the CAs in this PEM bundle
+	ClientCAFile string `mapstructure:"client_ca_file"`
+
+	// ClientCertOptional also accepts clients without a certificate, which
+	// then authenticate with an API key; presented certificates are still
+	// verified
+	ClientCertOptional bool `mapstructure:"client_cert_optional"`
+}
+
+// validate checks the listener has exactly one certificate source
+func (c *ListenerTLSConfig) validate() error {
+	files := c.CertFile != "" || c.KeyFile != ""
+	switch {
+	case files && len(c.ACMEHosts) > 0:
+		return fmt.Errorf("tls sets both cert_file/key_file and acme_hosts")
+	case files && (c.CertFile == "" || c.KeyFile == ""):
+		return fmt.Errorf("tls needs both cert_file and key_file")
+	case !files && len(c.ACMEHosts) == 0:
+		return fmt.Errorf("tls needs cert_file and key_file or acme_hosts")
+	case c.OCSPStapling && !files:
+		return fmt.Errorf("tls ocsp_stapling needs cert_file and key_file")
+	case c.ClientCertOptional && c.ClientCAFile == "":
+		return fmt.Errorf("tls client_cert_optional needs client_ca_file")
+	}
+	for _, host := range c.ACMEHosts {
+		if host == "" || strings.ContainsAny(host, ":/ ") {
+			return fmt.Errorf("tls has an invalid acme host %q", host)
+		}
+	}
+	return nil
+}
+
+// newListenerTLS returns the TLS configuration for an endpoint's listeners,
+// and the certificate loaded from cert_file and key_file, if any
+func newListenerTLS(config *ListenerTLSConfig, issuer *acmeIssuer) (*tls.Config, *listenerCert, error) {
+	if err := config.validate(); err != nil {
+		return nil, nil, err
+	}
+	var tlsConfig *tls.Config
+	var cert *listenerCert
+	if len(config.ACMEHosts) > 0 {
+		if !issuer.enabled() {
+			return nil, nil, fmt.Errorf("tls acme_hosts needs acme to be configured")
+		}
+		tlsConfig = issuer.tlsConfig()
+	} else {
+		var err error
+		if cert, err = loadListenerCert(config); err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: cert.getCertificate,
+		}
+	}
+	if config.ClientCAFile != "" {
+		pem, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read client_ca_file: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in client_ca_file %s", config.ClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.ClientCertOptional {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		if len(config.ACMEHosts) > 0 {
+			// The CA has no client certificate when it checks a TLS-ALPN-01
+			// challenge. Such handshakes only ever get a challenge certificate.
+			challenge := tlsConfig.Clone()
+			challenge.ClientAuth = tls.NoClientCert
+			tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+					return challenge, nil
+				}
+				return nil, nil
+			}
+		}
+	}
+	return tlsConfig, cert, nil
+}
+
+// ACMEConfig obtains and renews listener certificates from an ACME CA such
+// as Let's Encrypt for the hostnames in the endpoints' acme_hosts
+type ACMEConfig struct {
+	// AcceptTOS agrees to the CA's terms of service, which it requires
+	AcceptTOS bool `mapstructure:"accept_tos"`
+
+	// Email is given to the CA for notices about the certificates
+	Email string `mapstructure:"email"`
+
+	// DirectoryURL is the CA's directory (default Let's Encrypt production)
+	DirectoryURL string `mapstructure:"directory_url"`
+
+	// CacheDir keeps the account key and certificates across restarts
+	// (default acme-cache)
+	CacheDir string `mapstructure:"cache_dir"`
+
+	// HTTPAddress serves HTTP-01 challenges, e.g. ":80". Without it only
+	// TLS-ALPN-01 challenges answered on the listeners themselves are used.
+	HTTPAddress string `mapstructure:"http_address"`
+
+	// RenewBefore renews certificates this long before they expire
+	// (default 30 days)
+	RenewBefore time.Duration `mapstructure:"renew_before"`
+}
+
+// defaultACMECacheDir is where certificates are kept when cache_dir is not set
+const defaultACMECacheDir = "acme-cache"
+
+// cacheDir returns the configured cache directory or the default
+func (c *ACMEConfig) cacheDir() string {
+	if c.CacheDir != "" {
+		return c.CacheDir
+	}
+	return defaultACMECacheDir
+}
+
+// validate checks the terms are accepted and the durations are in range
+func (c *ACMEConfig) validate() error {
+	if !c.AcceptTOS {
+		return fmt.Errorf("acme needs accept_tos to agree to the CA's terms of service")
+	}
+	if c.RenewBefore < 0 {
+		return fmt.Errorf("acme renew_before must not be negative")
+	}
+	return nil
+}
+
+// acmeHosts returns every hostname the endpoints obtain certificates for
+func (c *ProxyConfig) acmeHosts() map[string]bool {
+	hosts := make(map[string]bool)
+	for _, e := range c.Endpoints {
+		if e.TLS != nil {
+			for _, host := range e.TLS.ACMEHosts {
+				hosts[strings.ToLower(host)] = true
+			}
+		}
+	}
+	return hosts
+}
+
+// validateACME checks acme_hosts are only used with acme configured
+func (c *ProxyConfig) validateACME() error {
+	if c.ACME != nil {
+		return c.ACME.validate()
+	}
+	for _, e := range c.Endpoints {
+		if e.TLS != nil && len(e.TLS.ACMEHosts) > 0 {
+			return fmt.Errorf("endpoint '%s' sets tls acme_hosts but acme is not configured", e.Name)
+		}
+	}
+	return nil
+}
+
+// acmeIssuer obtains certificates for the Manager's endpoints. Its host list
+// follows reloads; the rest of its settings are fixed at start.
+type acmeIssuer struct {
+	mu      sync.Mutex
+	manager *autocert.Manager
+	hosts   map[string]bool
+
+	// challenges serves HTTP-01 challenges on httpAddress, if set
+	httpAddress string
+	challenges  *http.Server
+}
+
+// configure sets up the issuer from config. It does nothing without acme.
+func (a *acmeIssuer) configure(config *ProxyConfig) error {
+	if config.ACME == nil {
+		return nil
+	}
+	c := config.ACME
+	manager := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(c.cacheDir()),
+		HostPolicy:  a.hostPolicy,
+		Email:       c.Email,
+		RenewBefore: c.RenewBefore,
+	}
+	if c.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.manager = manager
+	a.hosts = config.acmeHosts()
+	a.httpAddress = c.HTTPAddress
+	return nil
+}
+
+// listen starts serving HTTP-01 challenges when http_address is set
+func (a *acmeIssuer) listen() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.manager == nil || a.httpAddress == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", a.httpAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on acme http_address %s: %v", a.httpAddress, err)
+	}
+	// Other requests are redirected to HTTPS
+	a.challenges = &http.Server{Handler: a.manager.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("Serving ACME HTTP-01 challenges on %s", a.httpAddress)
+	go func(s *http.Server) {
+		if err := s.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("ACME challenge listener error: %v", err)
+		}
+	}(a.challenges)
+	return nil
+}
+
+// setHosts replaces the hostnames certificates may be obtained for
+func (a *acmeIssuer) setHosts(hosts map[string]bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hosts = hosts
+}
+
+// hostPolicy only lets the CA be asked for configured hostnames, so
+// clients cannot make the proxy request certificates for arbitrary names
+func (a *acmeIssuer) hostPolicy(_ context.Context, host string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.hosts[strings.ToLower(host)] {
+		return fmt.Errorf("acme: host %q is not in any endpoint's acme_hosts", host)
+	}
+	return nil
+}
+
+// enabled reports whether acme is configured
+func (a *acmeIssuer) enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.manager != nil
+}
+
+// tlsConfig returns a listener configuration serving the issuer's
+// certificates and answering TLS-ALPN-01 challenges
+func (a *acmeIssuer) tlsConfig() *tls.Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: a.manager.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+// Close stops the challenge listener
+func (a *acmeIssuer) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.challenges != nil {
+		a.challenges.Close()
+		a.challenges = nil
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log outputs
+const (
+	LogStderr   = "stderr"
+	LogFile     = "file"
+	LogSyslog   = "syslog"
+	LogJournald = "journald"
+)
+
+const (
+	defaultLogMaxSizeMB  = 100
+	defaultLogMaxBackups = 5
+	defaultLogTag        = "grpc-proxy"
+)
+
+// LogConfig selects where the proxy's log goes
+type LogConfig struct {
+	// Output is stderr (default), file, syslog or journald
+	Output string `mapstructure:"output"`
+
+	// Path is the log file of the file output
+	Path string `mapstructure:"path"`
+
+	// MaxSizeMB rotates the file once it grows past this size (default 100)
+	MaxSizeMB int `mapstructure:"max_size_mb"`
+
+	// MaxAge rotates the file once it has been written to for this long
+	// (0 = by size only)
+	MaxAge time.Duration `mapstructure:"max_age"`
+
+	// MaxBackups is how many rotated files are kept (default 5)
+	MaxBackups int `mapstructure:"max_backups"`
+
+	// Tag identifies the proxy in syslog and the journal (default grpc-proxy)
+	Tag string `mapstructure:"tag"`
+}
+
+// output returns the configured output or the default
+func (c *LogConfig) output() string {
+	if c == nil || c.Output == "" {
+		return LogStderr
+	}
+	return c.Output
+}
+
+// tag returns the configured tag or the default
+func (c *LogConfig) tag() string {
+	if c.Tag != "" {
+		return c.Tag
+	}
+	return defaultLogTag
+}
+
+// validate checks the output is known and has what it needs
+func (c *LogConfig) validate() error {
+	switch c.output() {
+	case LogStderr, LogSyslog, LogJournald:
+	case LogFile:
+		if c.Path == "" {
+			return fmt.Errorf("log output file requires a path")
+		}
+	default:
+		return fmt.Errorf("unknown log output '%s', expected stderr, file, syslog or journald", c.Output)
+	}
+	if c.MaxSizeMB < 0 || c.MaxAge < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("log max_size_mb, max_age and max_backups must not be negative")
+	}
+	return nil
+}
+
+// Timestamped reports whether the output stamps each entry itself, so the
+// log package should not add a date and time
+func (c *LogConfig) Timestamped() bool {
+	output := c.output()
+	return output == LogSyslog || output == LogJournald
+}
+
+// OpenLog opens the configured log output. Pass the writer through
+// NewRedactingWriter to log.SetOutput, and close it once another output
+// has replaced it.
+func OpenLog(config *LogConfig) (io.WriteCloser, error) {
+	if config == nil {
+		return nopCloser{os.Stderr}, nil
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	switch config.output() {
+	case LogFile:
+		return openRotatingFile(config)
+	case LogSyslog:
+		w, err := newLogSyslog(config.tag())
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		return w, nil
+	case LogJournald:
+		w, err := newLogJournald(config.tag())
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to journald: %v", err)
+		}
+		return w, nil
+	}
+	return nopCloser{os.Stderr}, nil
+}
+
+// nopCloser keeps Close from closing stderr
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Log priorities, as numbered by syslog
+const (
+	logPriorityCrit    = 2
+	logPriorityErr     = 3
+	logPriorityWarning = 4
+	logPriorityInfo    = 6
+)
+
+// logPriority classifies a log line by how it starts: panics are critical,
+// "Error" and "Failed" lines errors and "Warning" lines warnings. A log
+// prefix in brackets, such as the pod name, is skipped.
+func logPriority(line string) int {
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			line = line[i+2:]
+		}
+	}
+	switch {
+	case strings.HasPrefix(line, "Panic"):
+		return logPriorityCrit
+	case strings.HasPrefix(line, "Error"), strings.HasPrefix(line, "Failed"):
+		return logPriorityErr
+	case strings.HasPrefix(line, "Warning"):
+		return logPriorityWarning
+	}
+	return logPriorityInfo
+}
+
+// rotatingFile appends to a log file and renames it aside once it grows
+// past the size limit or has been written to for longer than the age limit
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(config *LogConfig) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       config.Path,
+		maxSize:    int64(config.MaxSizeMB) << 20,
+		maxAge:     config.MaxAge,
+		maxBackups: config.MaxBackups,
+	}
+	if r.maxSize == 0 {
+		r.maxSize = defaultLogMaxSizeMB << 20
+	}
+	if r.maxBackups == 0 {
+		r.maxBackups = defaultLogMaxBackups
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the current file for appending; the caller holds mu
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	r.f, r.size, r.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && (r.size+int64(len(p)) > r.maxSize || (r.maxAge > 0 && time.Since(r.opened) >= r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file aside with a timestamp, starts a new one
+// and removes the oldest backups; the caller holds mu
+func (r *rotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().UTC().Format("2006-01-02T15-04-05.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	// On failure the renamed file stays open, so no line is lost
+	previous := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	previous.Close()
+	backups, _ := filepath.Glob(r.path + ".[0-9]*")
+	// Backup names sort by time
+	sort.Strings(backups)
+	for len(backups) > r.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+// journaldSocket is where systemd-journald accepts native protocol entries
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldWriter sends each log line to the journal as one entry with the
+// priority of its kind
+type journaldWriter struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+// newLogJournald connects to the journal's native socket
+func newLogJournald(tag string) (io.WriteCloser, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{conn: conn, tag: tag}, nil
+}
+
+func (j *journaldWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimSuffix(p, []byte("\n"))
+	var entry bytes.Buffer
+	entry.WriteString("PRIORITY=" + strconv.Itoa(logPriority(string(msg))) + "\n")
+	entry.WriteString("SYSLOG_IDENTIFIER=" + j.tag + "\n")
+	// The binary form allows newlines in the message, e.g. a stack trace
+	entry.WriteString("MESSAGE\n")
+	binary.Write(&entry, binary.LittleEndian, uint64(len(msg)))
+	entry.Write(msg)
+	entry.WriteByte('\n')
+	if _, err := j.conn.Write(entry.Bytes()); err != nil {
+		// Keep the line on stderr rather than losing it
+		os.Stderr.Write(p)
+	}
+	return len(p), nil
+}
+
+func (j *journaldWriter) Close() error {
+	return j.conn.Close()
+}
@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"io"
+	"log/syslog"
+	"os"
+)
+
+// syslogWriter sends each log line to syslog with the priority of its kind
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// newLogSyslog connects to the local syslog daemon (facility daemon)
+func newLogSyslog(tag string) (io.WriteCloser, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{w}, nil
+}
+
+func (s syslogWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	var err error
+	switch logPriority(msg) {
+	case logPriorityCrit:
+		err = s.w.Crit(msg)
+	case logPriorityErr:
+		err = s.w.Err(msg)
+	case logPriorityWarning:
+		err = s.w.Warning(msg)
+	default:
+		err = s.w.Info(msg)
+	}
+	if err != nil {
+		// Keep the line on stderr rather than losing it
+		os.Stderr.Write(p)
+	}
+	return len(p), nil
+}
+
+func (s syslogWriter) Close() error {
+	return s.w.Close()
+}
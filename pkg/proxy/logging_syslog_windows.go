@@ -0,0 +1,11 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+)
+
+// newLogSyslog reports that syslog is unavailable on Windows
+func newLogSyslog(tag string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on Windows")
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Log levels of an endpoint, from the most to the least verbose
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// logLevel orders the log levels
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// parseLogLevel returns the level named by s; "" is info
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case LogLevelDebug:
+		return levelDebug, nil
+	case "", LogLevelInfo:
+		return levelInfo, nil
+	case LogLevelWarn:
+		return levelWarn, nil
+	case LogLevelError:
+		return levelError, nil
+	}
+	return levelInfo, fmt.Errorf("unknown log_level '%s', expected debug, info, warn or error", s)
+}
+
+// LogSamplingConfig limits the debug access log of a busy endpoint to a
+// percentage of its calls. Percentages are 0-100 and default to 100.
+type LogSamplingConfig struct {
+	// SuccessPercent of calls that succeed are logged
+	SuccessPercent *float64 `mapstructure:"success_percent"`
+
+	// ErrorPercent of calls that fail are logged
+	ErrorPercent *float64 `mapstructure:"error_percent"`
+}
+
+// validate checks both percentages are in range
+func (c *LogSamplingConfig) validate() error {
+	for name, pct := range map[string]*float64{"success_percent": c.SuccessPercent, "error_percent": c.ErrorPercent} {
+		if pct != nil && (*pct < 0 || *pct > 100) {
+			return fmt.Errorf("log_sampling %s must be between 0 and 100", name)
+		}
+	}
+	return nil
+}
+
+// sampled reports whether a call that failed or not is logged
+func (c *LogSamplingConfig) sampled(failed bool) bool {
+	if c == nil {
+		return true
+	}
+	pct := c.SuccessPercent
+	if failed {
+		pct = c.ErrorPercent
+	}
+	return pct == nil || *pct >= 100 || hit(*pct)
+}
+
+// logf logs a line about the endpoint unless it is below the endpoint's
+// log_level
+func (p *ProxyServer) logf(level logLevel, format string, args ...interface{}) {
+	if level < p.logLevel {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// accessLogEnabled reports whether calls are logged at debug level
+func (p *ProxyServer) accessLogEnabled() bool {
+	return p.logLevel == levelDebug
+}
+
+// logAccess logs a finished call at debug level, subject to log_sampling.
+// result is the gRPC code or HTTP status of the call.
+func (p *ProxyServer) logAccess(method, id, result string, failed bool, elapsed time.Duration, bytesIn, bytesOut int64, client, addr string) {
+	if !p.accessLogEnabled() || !p.config.LogSampling.sampled(failed) {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s %s %s %s (request %d bytes, response %d bytes) from %s", p.config.Name, id, method, result, elapsed.Round(time.Microsecond), bytesIn, bytesOut, addr)
+	if client != "" {
+		fmt.Fprintf(&b, ", client %s", client)
+	}
+	log.Print(b.String())
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// defaultMaintenanceRetryAfter is the retry hint when none is given
+const defaultMaintenanceRetryAfter = time.Minute
+
+// retryPushbackHeader is the trailer gRPC clients with a retry policy read
+// to delay their next attempt
+const retryPushbackHeader = "grpc-retry-pushback-ms"
+
+// maintenance describes an endpoint in maintenance mode
+type maintenance struct {
+	retryAfter time.Duration
+	message    string
+}
+
+// SetMaintenance puts the endpoint into maintenance mode, in which new calls
+// are rejected with UNAVAILABLE and a hint to retry after retryAfter while
+// calls in flight finish, or takes it out again. message is added to the
+// rejection. Health reports NOT_SERVING during maintenance.
+func (p *ProxyServer) SetMaintenance(enabled bool, retryAfter time.Duration, message string) {
+	if !enabled {
+		if p.maintenance.Swap(nil) != nil {
+			p.logf(levelInfo, "Endpoint %s is out of maintenance mode", p.config.Name)
+		}
+		p.metrics.Set("maintenance", intVar(0))
+		p.updateHealth()
+		return
+	}
+	if retryAfter <= 0 {
+		retryAfter = defaultMaintenanceRetryAfter
+	}
+	p.maintenance.Store(&maintenance{retryAfter: retryAfter, message: message})
+	p.logf(levelWarn, "Warning: endpoint %s is in maintenance mode, rejecting new calls (%d active streams left to finish)", p.config.Name, p.activeStreams.Load())
+	p.metrics.Set("maintenance", intVar(1))
+	p.updateHealth()
+}
+
+// InMaintenance reports whether the endpoint is in maintenance mode
+func (p *ProxyServer) InMaintenance() bool {
+	return p.maintenance.Load() != nil
+}
+
+// String describes the maintenance for error messages and the status page
+func (m *maintenance) String() string {
+	if m.message != "" {
+		return "down for maintenance: " + m.message
+	}
+	return "down for maintenance"
+}
+
+// maintenanceError is the status returned to calls rejected during m. It
+// carries a RetryInfo detail with the retry hint.
+func (p *ProxyServer) maintenanceError(m *maintenance) error {
+	st := status.New(codes.Unavailable, fmt.Sprintf("endpoint %s is %s", p.config.Name, m))
+	withInfo, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(m.retryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return withInfo.Err()
+}
+
+// rejectMaintenanceHTTP answers an HTTP request during m with 503 and a
+// Retry-After header
+func (p *ProxyServer) rejectMaintenanceHTTP(w http.ResponseWriter, m *maintenance) {
+	seconds := int64((m.retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	http.Error(w, fmt.Sprintf("endpoint %s is %s", p.config.Name, m), http.StatusServiceUnavailable)
+}
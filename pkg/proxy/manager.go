@@ -0,0 +1,701 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Manager runs one ProxyServer per configured endpoint and applies
+// configuration reloads to the running set
+type Manager struct {
+	mu      sync.Mutex
+	config  *ProxyConfig
+	servers map[string]*ProxyServer
+	opts    []Option
+
+	// failed holds why configured endpoints that are not serving failed to
+	// start or stopped serving
+	failed map[string]error
+
+	// restarts counts the restarts in a row of endpoints that stopped
+	// serving; fatal reports one that could not be restarted, and done is
+	// closed on shutdown to stop pending restarts
+	restarts map[string]int
+	fatal    chan error
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// reloadMu serializes reloads, which release mu while they probe
+	// upstreams and drain endpoints
+	reloadMu sync.Mutex
+
+	// wg tracks the serving goroutines of all endpoints
+	wg sync.WaitGroup
+
+	// admin serves the ProxyAdmin service when configured, and adminHTTP
+	// the status page on the same listener
+	admin     *grpc.Server
+	adminHTTP *http.Server
+
+	// clients holds the local API keys shared by all endpoints
+	clients *clientSet
+
+	// connLimiter caps client connections across all endpoints
+	connLimiter *connLimiter
+
+	// secrets resolves jwt_token_ref for all endpoints
+	secrets *secretStore
+
+	// renewals keeps the refresh tokens of oidc and token_refresh across
+	// reloads
+	renewals *renewalStore
+
+	// audit records configuration, token and admin changes
+	audit *auditLog
+
+	// usage accounts calls per client and endpoint
+	usage *usageLog
+
+	// quotas counts client usage against their quotas across all endpoints
+	quotas *quotaTracker
+
+	// redis shares rate limit and quota counters with other replicas
+	redis *redisClient
+
+	// alerts posts failures and expiring tokens to webhooks
+	alerts *alerter
+
+	// statsd pushes the endpoints' metrics to a statsd agent
+	statsd *statsdExporter
+
+	// acme obtains listener certificates for endpoints with acme_hosts
+	acme *acmeIssuer
+}
+
+// NewManager creates a manager for the given configuration. The options are
+// applied to every endpoint's ProxyServer. Nothing is started until Start is called.
+func NewManager(config *ProxyConfig, opts ...Option) *Manager {
+	clients := &clientSet{}
+	limiter := newConnLimiter()
+	secrets := &secretStore{}
+	renewals := &renewalStore{}
+	audit := &auditLog{}
+	usage := &usageLog{}
+	redis := &redisClient{}
+	quotas := &quotaTracker{shared: redis}
+	alerts := newAlerter()
+	issuer := &acmeIssuer{}
+	return &Manager{
+		config:      config,
+		servers:     make(map[string]*ProxyServer),
+		failed:      make(map[string]error),
+		restarts:    make(map[string]int),
+		fatal:       make(chan error, 1),
+		done:        make(chan struct{}),
+		opts:        append(append([]Option{}, opts...), withClients(clients), withConnLimiter(limiter), withSecrets(secrets), withRenewals(renewals), withAudit(audit), withUsage(usage), withQuotas(quotas), withRedis(redis), withAlerts(alerts), withACME(issuer), withDenyByDefault(config.denyByDefault())),
+		clients:     clients,
+		connLimiter: limiter,
+		secrets:     secrets,
+		renewals:    renewals,
+		audit:       audit,
+		usage:       usage,
+		quotas:      quotas,
+		redis:       redis,
+		alerts:      alerts,
+		statsd:      &statsdExporter{},
+		acme:        issuer,
+	}
+}
+
+// Start validates the configuration and starts every endpoint. Endpoints are
+// created before any of them starts listening, so a configuration error
+// leaves nothing running. With the partial startup policy, endpoints that
+// cannot be created, reach a required upstream or bind their listener are
+// skipped instead, and Start only fails if none could start. Like Reload,
+// Start builds the endpoints and probes their upstreams without holding m.mu.
+func (m *Manager) Start() error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	config, err := m.configure()
+	if err != nil {
+		return err
+	}
+	partial := config.StartupPolicy == StartupPartial
+
+	var created []*ProxyServer
+	for _, endpoint := range config.Endpoints {
+		p, err := NewProxyServer(endpoint, m.opts...)
+		if err != nil {
+			err = fmt.Errorf("failed to create proxy server %s: %v", endpoint.Name, err)
+			if partial {
+				m.mu.Lock()
+				m.markFailed(endpoint.Name, err)
+				m.mu.Unlock()
+				continue
+			}
+			for _, c := range created {
+				c.closeUpstreams()
+			}
+			return err
+		}
+		created = append(created, p)
+	}
+	errs := checkEachUpstream(created, config.StartupPolicy == StartupStrict)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopping() {
+		for _, c := range created {
+			c.closeUpstreams()
+		}
+		return fmt.Errorf("manager is shutting down")
+	}
+	if partial {
+		created = m.startPartially(created, errs)
+	} else if err := firstError(errs); err != nil {
+		for _, c := range created {
+			c.closeUpstreams()
+		}
+		return err
+	}
+	return m.listen(created)
+}
+
+// configure validates the configuration and sets up what the endpoints
+// share, returning the configuration of the endpoints to start
+func (m *Manager) configure() (*ProxyConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.config.assignPorts(nil); err != nil {
+		return nil, err
+	}
+	partial := m.config.StartupPolicy == StartupPartial
+	config := m.config
+	if partial {
+		config = m.withValidEndpoints(config)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	registerConfigSecrets(m.config)
+	if err := m.secrets.configure(m.config.Secrets); err != nil {
+		return nil, err
+	}
+	if err := m.audit.open(m.config.Audit); err != nil {
+		return nil, err
+	}
+	m.audit.record(AuditEntry{Action: "config.load", Actor: localActor(), Changes: diffConfig(nil, m.config)})
+	if err := m.redis.configure(m.config.Redis); err != nil {
+		return nil, err
+	}
+	if m.redis.enabled() {
+		go m.quotas.syncEvery(quotaSyncInterval, m.done)
+	}
+	if err := m.alerts.configure(m.config.Alerts); err != nil {
+		return nil, err
+	}
+	if err := m.statsd.configure(m.config.Statsd, m.config.Endpoints); err != nil {
+		return nil, err
+	}
+	// Redis keeps quota usage across restarts itself
+	if m.config.Usage != nil && !m.redis.enabled() {
+		m.seedQuotas(m.config.Usage.Path)
+	}
+	if err := m.usage.open(m.config.Usage); err != nil {
+		return nil, err
+	}
+	if err := m.acme.configure(m.config); err != nil {
+		return nil, err
+	}
+	m.clients.set(m.config.Clients, m.config.Policies)
+	m.connLimiter.setLimits(m.config.ConnectionLimits)
+	m.config.DNS.apply()
+	return config, nil
+}
+
+// listen starts the admin listener and binds and serves the created
+// servers. Callers must hold m.mu.
+func (m *Manager) listen(created []*ProxyServer) error {
+	partial := m.config.StartupPolicy == StartupPartial
+	if m.config.Admin != nil {
+		if err := m.startAdmin(m.config.Admin); err != nil {
+			for _, c := range created {
+				c.closeUpstreams()
+			}
+			return err
+		}
+	}
+	if err := m.acme.listen(); err != nil {
+		for _, c := range created {
+			c.closeUpstreams()
+		}
+		m.stopAdmin()
+		return err
+	}
+
+	// Bind every listener before serving on any, so when Start returns all
+	// endpoints accept connections and a port conflict leaves nothing running
+	var listening []*ProxyServer
+	for i, p := range created {
+		if err := p.Listen(); err != nil {
+			if partial {
+				p.closeUpstreams()
+				m.markFailed(p.Name(), err)
+				continue
+			}
+			for _, c := range listening {
+				c.Shutdown(context.Background())
+			}
+			for _, c := range created[i:] {
+				c.closeUpstreams()
+			}
+			m.stopAdmin()
+			m.acme.Close()
+			return err
+		}
+		listening = append(listening, p)
+	}
+	if len(listening) == 0 {
+		m.stopAdmin()
+		m.acme.Close()
+		return fmt.Errorf("none of the %d endpoints could be started", len(m.config.Endpoints))
+	}
+	if len(m.failed) > 0 {
+		log.Printf("Warning: started %d of %d endpoints, the others failed", len(listening), len(m.config.Endpoints))
+	}
+
+	for _, p := range listening {
+		m.serve(p)
+	}
+	return nil
+}
+
+// serve runs a listening p in the background and registers it. If it stops
+// serving with an error, it is supervised. Callers must hold m.mu.
+func (m *Manager) serve(p *ProxyServer) {
+	m.servers[p.Name()] = p
+	m.clearFailed(p.Name())
+	started := time.Now()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if err := p.Serve(); err != nil {
+			log.Printf("Proxy server %s error: %v", p.Name(), err)
+			m.supervise(p, started, err)
+		}
+	}()
+}
+
+// checkUpstreams waits in parallel for every server's upstream to become
+// ready. Endpoints that require their upstream fail the check; the others
+// only log a warning and keep reconnecting in the background.
+func checkUpstreams(servers []*ProxyServer) error {
+	return firstError(checkEachUpstream(servers, false))
+}
+
+// firstError returns the first non-nil error of errs
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEachUpstream is checkUpstreams returning the outcome of every
+// server. With requireAll, every upstream is required.
+func checkEachUpstream(servers []*ProxyServer, requireAll bool) []error {
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, p := range servers {
+		wg.Add(1)
+		go func(i int, p *ProxyServer) {
+			defer wg.Done()
+			required := p.config.Connect.Required || requireAll
+			if err := p.waitForUpstream(); err != nil {
+				if required {
+					errs[i] = fmt.Errorf("endpoint %s: %v", p.Name(), err)
+					return
+				}
+				log.Printf("Warning: endpoint %s: %v; will keep retrying", p.Name(), err)
+				return
+			}
+			// A wrong chain is a configuration error whether or not the upstream is required
+			if p.config.ExpectedChainID != "" {
+				err := p.checkChainID()
+				if _, mismatch := err.(*errChainMismatch); mismatch || (err != nil && required) {
+					errs[i] = fmt.Errorf("endpoint %s: %v", p.Name(), err)
+				}
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+// mapValues returns the servers of a name-keyed map
+func mapValues(servers map[string]*ProxyServer) []*ProxyServer {
+	values := make([]*ProxyServer, 0, len(servers))
+	for _, p := range servers {
+		values = append(values, p)
+	}
+	return values
+}
+
+// Servers returns the running proxy servers ordered by endpoint name
+func (m *Manager) Servers() []*ProxyServer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	servers := make([]*ProxyServer, 0, len(m.servers))
+	for _, p := range m.servers {
+		servers = append(servers, p)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name() < servers[j].Name() })
+	return servers
+}
+
+// Server returns the running proxy server for the named endpoint
+func (m *Manager) Server(name string) (*ProxyServer, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.servers[name]
+	return p, ok
+}
+
+// Reload applies a new configuration. Unchanged endpoints keep running
+// untouched, removed endpoints are drained, and new or changed endpoints are
+// (re)started. The new configuration is validated, and new endpoints are
+// built and their upstreams checked, before anything changes. If endpoints
+// then fail to start, the rest of the configuration stays applied and a
+// *PartialReloadError is returned.
+func (m *Manager) Reload(config *ProxyConfig) error {
+	m.mu.Lock()
+	before := m.config
+	m.mu.Unlock()
+
+	err := m.reload(config)
+
+	m.mu.Lock()
+	applied := m.config == config
+	m.mu.Unlock()
+	m.audit.auditReload(localActor(), before, config, applied, err)
+	if err != nil {
+		m.alerts.send(AlertReloadFailed, "", "configuration reload failed: %v", err)
+	}
+	return err
+}
+
+// reload implements Reload. The new servers are built and their upstreams
+// probed before m.mu is taken, and replaced endpoints are drained without
+// holding it, so admin calls and supervision are not held up meanwhile.
+func (m *Manager) reload(config *ProxyConfig) error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	m.mu.Lock()
+	previous := m.config
+	m.mu.Unlock()
+	if err := config.assignPorts(previous); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if config.denyByDefault() != previous.denyByDefault() {
+		return fmt.Errorf("security_mode cannot be changed by a reload")
+	}
+	if config.Alerts != nil {
+		if err := config.Alerts.validate(); err != nil {
+			return err
+		}
+	}
+	registerConfigSecrets(config)
+
+	m.mu.Lock()
+	// Backends are swapped before building servers so new references resolve
+	// against them; running endpoints pick them up on their next refresh
+	if !reflect.DeepEqual(m.config.Secrets, config.Secrets) {
+		if err := m.secrets.configure(config.Secrets); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		log.Printf("Applying secrets backends from reloaded configuration")
+	}
+	running := make(map[string]*ProxyServer, len(m.servers))
+	for name, p := range m.servers {
+		running[name] = p
+	}
+	m.mu.Unlock()
+
+	// Build all new servers first so a bad endpoint leaves the running set alone
+	wanted := make(map[string]Config, len(config.Endpoints))
+	replacements := make(map[string]*ProxyServer)
+	for _, endpoint := range config.Endpoints {
+		wanted[endpoint.Name] = endpoint
+		if old, ok := running[endpoint.Name]; ok && reflect.DeepEqual(old.Config(), endpoint) {
+			continue
+		}
+		p, err := NewProxyServer(endpoint, m.opts...)
+		if err != nil {
+			for _, r := range replacements {
+				r.closeUpstreams()
+			}
+			return fmt.Errorf("failed to create proxy server %s: %v", endpoint.Name, err)
+		}
+		replacements[endpoint.Name] = p
+	}
+	if err := checkUpstreams(mapValues(replacements)); err != nil {
+		for _, r := range replacements {
+			r.closeUpstreams()
+		}
+		return err
+	}
+
+	m.mu.Lock()
+	if m.stopping() {
+		m.mu.Unlock()
+		for _, r := range replacements {
+			r.closeUpstreams()
+		}
+		return fmt.Errorf("manager is shutting down")
+	}
+
+	// Take removed and changed endpoints out of the running set; their
+	// ports must be free before replacements bind
+	var draining []*ProxyServer
+	for name, old := range m.servers {
+		_, keep := wanted[name]
+		r, replaced := replacements[name]
+		if keep && !replaced {
+			continue
+		}
+		if replaced {
+			// Maintenance is set at runtime, so it outlives a change to the endpoint
+			r.maintenance.Store(old.maintenance.Load())
+		}
+		delete(m.servers, name)
+		if !keep {
+			log.Printf("Removing endpoint %s", name)
+		}
+		draining = append(draining, old)
+	}
+
+	if !reflect.DeepEqual(m.config.Clients, config.Clients) || !reflect.DeepEqual(m.config.Policies, config.Policies) {
+		log.Printf("Applying %d client API keys from reloaded configuration", len(config.Clients))
+		m.clients.set(config.Clients, config.Policies)
+	}
+
+	if m.config.ConnectionLimits != config.ConnectionLimits {
+		log.Printf("Applying connection limits from reloaded configuration")
+		m.connLimiter.setLimits(config.ConnectionLimits)
+	}
+	if !reflect.DeepEqual(m.config.Alerts, config.Alerts) {
+		m.alerts.configure(config.Alerts)
+		log.Printf("Applying alert webhooks from reloaded configuration")
+	}
+	if !reflect.DeepEqual(m.config.Statsd, config.Statsd) {
+		log.Printf("Applying statsd settings from reloaded configuration")
+	}
+	if err := m.statsd.configure(config.Statsd, config.Endpoints); err != nil {
+		log.Printf("Failed to apply statsd settings: %v", err)
+	}
+
+	if !reflect.DeepEqual(m.config.Admin, config.Admin) {
+		log.Printf("Admin listener changes take effect after a restart")
+	}
+	if !reflect.DeepEqual(m.config.ACME, config.ACME) {
+		log.Printf("ACME changes take effect after a restart")
+	}
+	m.acme.setHosts(config.acmeHosts())
+	if m.config.DNS != config.DNS {
+		log.Printf("DNS resolver changes take effect after a restart")
+	}
+	if !reflect.DeepEqual(m.config.Audit, config.Audit) {
+		log.Printf("Audit log changes take effect after a restart")
+	}
+	if !reflect.DeepEqual(m.config.Usage, config.Usage) {
+		log.Printf("Usage recording changes take effect after a restart")
+	}
+	if !reflect.DeepEqual(m.config.Redis, config.Redis) {
+		log.Printf("Redis changes take effect after a restart")
+	}
+
+	// Supervision only restarts endpoints that match m.config, so once it
+	// holds the new config the drained endpoints are not brought back
+	m.pruneFailed(config)
+	m.renewals.prune(config)
+	m.config = config
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout())
+	defer cancel()
+	var drain sync.WaitGroup
+	for _, old := range draining {
+		drain.Add(1)
+		go func(p *ProxyServer) {
+			defer drain.Done()
+			p.Shutdown(ctx)
+		}(old)
+	}
+	drain.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var listenErr error
+	for name, p := range replacements {
+		// Shutdown may have begun, or supervision restarted the endpoint, while draining
+		if m.stopping() || m.servers[name] != nil {
+			p.closeUpstreams()
+			continue
+		}
+		log.Printf("Starting endpoint %s from reloaded configuration", name)
+		if err := p.Listen(); err != nil {
+			m.markFailed(name, err)
+			p.closeUpstreams()
+			if listenErr == nil {
+				listenErr = &PartialReloadError{Err: fmt.Errorf("failed to start endpoint %s: %v", name, err)}
+			}
+			continue
+		}
+		delete(m.restarts, name)
+		m.serve(p)
+	}
+	return listenErr
+}
+
+// PartialReloadError is returned by Reload when the new configuration was
+// applied but some of its endpoints failed to start
+type PartialReloadError struct {
+	Err error
+}
+
+func (e *PartialReloadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialReloadError) Unwrap() error {
+	return e.Err
+}
+
+// stopping reports whether Shutdown has begun. Shutdown closes done before
+// collecting the servers under m.mu, so a server registered by a caller
+// holding m.mu that saw false is still drained.
+func (m *Manager) stopping() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain stops the named endpoint, giving its active streams until ctx
+// expires to finish. The endpoint stays stopped until the next reload. It
+// returns how many streams had to be cancelled.
+func (m *Manager) Drain(ctx context.Context, name string) (int64, error) {
+	m.mu.Lock()
+	p, ok := m.servers[name]
+	if ok {
+		delete(m.servers, name)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return 0, status.Errorf(codes.NotFound, "no running endpoint named %q", name)
+	}
+
+	log.Printf("Draining endpoint %s on request", name)
+	return p.drain(ctx)
+}
+
+// Shutdown drains all endpoints in parallel; each one force-closes its
+// remaining streams when ctx expires. It returns ctx.Err() if any endpoint
+// had to be cut short.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.stopOnce.Do(func() { close(m.done) })
+	m.mu.Lock()
+	servers := make([]*ProxyServer, 0, len(m.servers))
+	for _, p := range m.servers {
+		servers = append(servers, p)
+	}
+	m.mu.Unlock()
+
+	var drain sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, p := range servers {
+		drain.Add(1)
+		go func(p *ProxyServer) {
+			defer drain.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(p)
+	}
+	drain.Wait()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	m.stopAdmin()
+	m.audit.Close()
+	m.usage.Close()
+	m.quotas.sync()
+	m.redis.Close()
+	m.alerts.Close()
+	m.statsd.Close()
+	m.acme.Close()
+	m.mu.Unlock()
+	return firstErr
+}
+
+// Stop drains all endpoints using the configured shutdown timeout
+func (m *Manager) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.ShutdownTimeout())
+	defer cancel()
+	return m.Shutdown(ctx)
+}
+
+// ShutdownTimeout returns the drain deadline from the current configuration
+func (m *Manager) ShutdownTimeout() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config.shutdownTimeout()
+}
+
+// seedQuotas counts the usage recorded in path towards the current quota
+// periods, so a restart does not hand every client a fresh quota
+func (m *Manager) seedQuotas(path string) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read usage file for quotas: %v", err)
+		return
+	}
+	defer f.Close()
+	records, err := ReadUsage(f)
+	if err != nil {
+		log.Printf("Warning: failed to read usage file for quotas: %v", err)
+		return
+	}
+	m.quotas.seed(records)
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultMaxMethods caps the methods counted separately
+	defaultMaxMethods = 100
+
+	// otherMethods counts the calls of methods beyond max_methods
+	otherMethods = "other"
+)
+
+// defaultMethodBuckets are the latency histogram's upper bounds
+var defaultMethodBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// MethodMetricsConfig counts calls, status codes and latency per method
+type MethodMetricsConfig struct {
+	// Methods are the full method name prefixes counted (default all)
+	Methods []string `mapstructure:"methods"`
+
+	// MaxMethods caps the methods counted separately; calls of further
+	// methods are counted under "other" (default 100)
+	MaxMethods int `mapstructure:"max_methods"`
+
+	// Buckets are the upper bounds of the latency histogram
+	// (default 5ms to 10s)
+	Buckets []time.Duration `mapstructure:"buckets"`
+}
+
+// validate checks the cap and that the buckets ascend
+func (c *MethodMetricsConfig) validate() error {
+	if c.MaxMethods < 0 {
+		return fmt.Errorf("method_metrics max_methods must not be negative")
+	}
+	for i, b := range c.Buckets {
+		if b <= 0 || (i > 0 && b <= c.Buckets[i-1]) {
+			return fmt.Errorf("method_metrics buckets must be positive and ascending")
+		}
+	}
+	return nil
+}
+
+// maxMethods returns the configured cap or the default
+func (c *MethodMetricsConfig) maxMethods() int {
+	if c.MaxMethods > 0 {
+		return c.MaxMethods
+	}
+	return defaultMaxMethods
+}
+
+// buckets returns the configured buckets or the default
+func (c *MethodMetricsConfig) buckets() []time.Duration {
+	if len(c.Buckets) > 0 {
+		return c.Buckets
+	}
+	return defaultMethodBuckets
+}
+
+// methodMetrics publishes per-method counters in the endpoint's metrics
+// under "methods"
+type methodMetrics struct {
+	config  *MethodMetricsConfig
+	buckets []time.Duration
+	names   []string // bucket keys, "le_<bound>" and "le_+Inf"
+	metrics *expvar.Map
+
+	mu      sync.Mutex
+	methods map[string]*expvar.Map
+}
+
+func newMethodMetrics(config *MethodMetricsConfig, endpoint *expvar.Map) (*methodMetrics, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	m := &methodMetrics{
+		config:  config,
+		buckets: config.buckets(),
+		metrics: new(expvar.Map).Init(),
+		methods: make(map[string]*expvar.Map),
+	}
+	for _, b := range m.buckets {
+		m.names = append(m.names, "le_"+b.String())
+	}
+	m.names = append(m.names, "le_+Inf")
+	endpoint.Set("methods", m.metrics)
+	return m, nil
+}
+
+// method returns the counters of fullMethodName, or of "other" once
+// max_methods are counted
+func (m *methodMetrics) method(fullMethodName string) *expvar.Map {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stats, ok := m.methods[fullMethodName]; ok {
+		return stats
+	}
+	name := fullMethodName
+	if len(m.methods) >= m.config.maxMethods() {
+		name = otherMethods
+		if stats, ok := m.methods[name]; ok {
+			return stats
+		}
+	}
+	stats := new(expvar.Map).Init()
+	latency := new(expvar.Map).Init()
+	for _, key := range m.names {
+		latency.Set(key, intVar(0))
+	}
+	stats.Set("latency", latency)
+	stats.Set("codes", new(expvar.Map).Init())
+	m.methods[name] = stats
+	m.metrics.Set(name, stats)
+	return stats
+}
+
+// record counts a finished call of fullMethodName
+func (m *methodMetrics) record(fullMethodName string, d time.Duration, err error) {
+	if len(m.config.Methods) > 0 && !matchesMethod(m.config.Methods, fullMethodName) {
+		return
+	}
+	stats := m.method(fullMethodName)
+	stats.Add("calls", 1)
+	if err != nil {
+		stats.Add("calls_failed", 1)
+	}
+	stats.AddFloat("latency_sum_ms", float64(d)/float64(time.Millisecond))
+	stats.Get("codes").(*expvar.Map).Add(status.Code(err).String(), 1)
+
+	// Buckets are cumulative: a call counts in every bucket it fits
+	latency := stats.Get("latency").(*expvar.Map)
+	i := sort.Search(len(m.buckets), func(i int) bool { return d <= m.buckets[i] })
+	for _, key := range m.names[i:] {
+		latency.Add(key, 1)
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// hasMethodRules reports whether allowed_methods or denied_methods is set
+func (c Config) hasMethodRules() bool {
+	return len(c.AllowedMethods) > 0 || len(c.DeniedMethods) > 0
+}
+
+// isReflectionService reports whether service is a server reflection version
+func isReflectionService(service string) bool {
+	for _, s := range reflectionServices {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// methodAllowed reports whether clients may call fullMethodName; denied
+// wins. Reflection is filtered rather than blocked by allowed_methods, so
+// it only needs an entry in denied_methods to be turned off.
+func (c Config) methodAllowed(fullMethodName string) bool {
+	if matchesMethod(c.DeniedMethods, fullMethodName) {
+		return false
+	}
+	if len(c.AllowedMethods) == 0 || matchesMethod(c.AllowedMethods, fullMethodName) {
+		return true
+	}
+	service, _, _ := strings.Cut(strings.TrimPrefix(fullMethodName, "/"), "/")
+	return isReflectionService(service)
+}
+
+// serviceVisible reports whether clients may call at least one method of
+// service, judging by the rules alone
+func (c Config) serviceVisible(service string) bool {
+	prefix := "/" + service + "/"
+	if matchesMethod(c.DeniedMethods, prefix) {
+		return false
+	}
+	if len(c.AllowedMethods) == 0 || matchesMethod(c.AllowedMethods, prefix) || isReflectionService(service) {
+		return true
+	}
+	// An allowed_methods entry naming a method inside the service
+	for _, allowed := range c.AllowedMethods {
+		if strings.HasPrefix("/"+strings.TrimPrefix(allowed, "/"), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterReflection removes the services and methods clients may not call
+// from a reflection response. A lookup of a hidden symbol is answered like
+// one for a symbol the upstream doesn't know.
+func (c Config) filterReflection(req *rpb.ServerReflectionRequest, resp *rpb.ServerReflectionResponse) *rpb.ServerReflectionResponse {
+	switch r := resp.MessageResponse.(type) {
+	case *rpb.ServerReflectionResponse_ListServicesResponse:
+		var services []*rpb.ServiceResponse
+		for _, s := range r.ListServicesResponse.GetService() {
+			if c.serviceVisible(s.Name) {
+				services = append(services, s)
+			}
+		}
+		filtered := proto.Clone(resp).(*rpb.ServerReflectionResponse)
+		filtered.GetListServicesResponse().Service = services
+		return filtered
+
+	case *rpb.ServerReflectionResponse_FileDescriptorResponse:
+		hidden := make(map[string]bool)
+		var files [][]byte
+		for _, b := range r.FileDescriptorResponse.GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fd); err != nil {
+				files = append(files, b)
+				continue
+			}
+			if !c.filterFile(fd, hidden) {
+				files = append(files, b)
+				continue
+			}
+			filteredFile, err := proto.Marshal(fd)
+			if err != nil {
+				continue
+			}
+			files = append(files, filteredFile)
+		}
+		if symbol := req.GetFileContainingSymbol(); hidden[symbol] {
+			return &rpb.ServerReflectionResponse{
+				ValidHost:       resp.ValidHost,
+				OriginalRequest: resp.OriginalRequest,
+				MessageResponse: &rpb.ServerReflectionResponse_ErrorResponse{ErrorResponse: &rpb.ErrorResponse{
+					ErrorCode:    int32(codes.NotFound),
+					ErrorMessage: "symbol not found: " + symbol,
+				}},
+			}
+		}
+		filtered := proto.Clone(resp).(*rpb.ServerReflectionResponse)
+		filtered.GetFileDescriptorResponse().FileDescriptorProto = files
+		return filtered
+	}
+	return resp
+}
+
+// filterFile drops the methods of fd that clients may not call, and the
+// services left without any, recording their full names in hidden. It
+// reports whether fd changed.
+func (c Config) filterFile(fd *descriptorpb.FileDescriptorProto, hidden map[string]bool) bool {
+	changed := false
+	var services []*descriptorpb.ServiceDescriptorProto
+	for _, sd := range fd.Service {
+		service := sd.GetName()
+		if fd.GetPackage() != "" {
+			service = fd.GetPackage() + "." + service
+		}
+		var methods []*descriptorpb.MethodDescriptorProto
+		for _, md := range sd.Method {
+			if c.methodAllowed("/" + service + "/" + md.GetName()) {
+				methods = append(methods, md)
+				continue
+			}
+			hidden[service+"."+md.GetName()] = true
+			changed = true
+		}
+		if !c.serviceVisible(service) || (len(methods) == 0 && len(sd.Method) > 0) {
+			hidden[service] = true
+			changed = true
+			continue
+		}
+		sd.Method = methods
+		services = append(services, sd)
+	}
+	fd.Service = services
+	return changed
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"expvar"
+	"sync"
+)
+
+// proxyMetrics holds per-endpoint counters, published via expvar as "grpc_proxy"
+var (
+	proxyMetrics   = expvar.NewMap("grpc_proxy")
+	proxyMetricsMu sync.Mutex
+)
+
+// endpointMetrics returns the counter map for the named endpoint, creating it on first use
+func endpointMetrics(name string) *expvar.Map {
+	proxyMetricsMu.Lock()
+	defer proxyMetricsMu.Unlock()
+
+	if m, ok := proxyMetrics.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	proxyMetrics.Set(name, m)
+	return m
+}
+
+// intVar wraps an int as an expvar value
+func intVar(i int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(i)
+	return v
+}
+
+// stringVar wraps a string as an expvar value
+func stringVar(s string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(s)
+	return v
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MintJWTConfig makes the proxy sign its own short-lived JWTs for the
+// upstream instead of sending a pre-issued jwt_token
+type MintJWTConfig struct {
+	// Secret is an HMAC key; KeyFile a PEM RSA or ECDSA private key
+	Secret  string `mapstructure:"secret"`
+	KeyFile string `mapstructure:"key_file"`
+
+	// Algorithm is HS256/384/512, RS256/384/512 or ES256/384/512; by
+	// default HS256, RS256 or the ES algorithm of the key's curve
+	Algorithm string `mapstructure:"algorithm"`
+
+	// KeyID is sent as the kid header, if set
+	KeyID string `mapstructure:"key_id"`
+
+	// Claims are added to every token. In string values {endpoint} is
+	// replaced by the endpoint name and, with per_request, {method} by the
+	// full method name. iat, exp and jti are always set by the proxy.
+	Claims map[string]interface{} `mapstructure:"claims"`
+
+	// Lifetime is how long a token is valid (default 5m)
+	Lifetime time.Duration `mapstructure:"lifetime"`
+
+	// PerRequest mints a token for every call; by default one token is
+	// minted per minute and shared by the calls within it
+	PerRequest bool `mapstructure:"per_request"`
+}
+
+// defaultMintLifetime is used when lifetime is not configured
+const defaultMintLifetime = 5 * time.Minute
+
+// lifetime returns the configured token lifetime or the default
+func (c *MintJWTConfig) lifetime() time.Duration {
+	if c.Lifetime > 0 {
+		return c.Lifetime
+	}
+	return defaultMintLifetime
+}
+
+// validate checks the key source, lifetime and claims
+func (c *MintJWTConfig) validate() error {
+	if (c.Secret == "") == (c.KeyFile == "") {
+		return fmt.Errorf("mint_jwt needs exactly one of secret and key_file")
+	}
+	if c.Lifetime < 0 {
+		return fmt.Errorf("mint_jwt lifetime must not be negative")
+	}
+	// A token minted at the start of a minute is still sent at its end
+	if !c.PerRequest && c.lifetime() <= time.Minute {
+		return fmt.Errorf("mint_jwt lifetime must exceed 1m unless per_request is set")
+	}
+	for name, value := range c.Claims {
+		if s, ok := value.(string); ok && strings.Contains(s, "{method}") && !c.PerRequest {
+			return fmt.Errorf("mint_jwt claim %q uses {method}, which needs per_request", name)
+		}
+	}
+	return nil
+}
+
+// jwtMinter signs the tokens of mint_jwt
+type jwtMinter struct {
+	config   *MintJWTConfig
+	endpoint string
+	header   string
+	sign     func(signingInput []byte) ([]byte, error)
+
+	// mu guards the token shared by the calls of the current minute
+	mu     sync.Mutex
+	minute time.Time
+	token  string
+}
+
+// newJWTMinter loads the signing key of config
+func newJWTMinter(endpoint string, config *MintJWTConfig) (*jwtMinter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	var key interface{}
+	if config.Secret != "" {
+		key = []byte(config.Secret)
+		knownSecrets.add(config.Secret)
+	} else {
+		pemBytes, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mint_jwt key_file: %v", err)
+		}
+		if key, err = parsePrivateKey(pemBytes); err != nil {
+			return nil, fmt.Errorf("mint_jwt key_file %s: %v", config.KeyFile, err)
+		}
+	}
+	alg, sign, err := jwtSigner(config.Algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if config.KeyID != "" {
+		header["kid"] = config.KeyID
+	}
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	m := &jwtMinter{
+		config:   config,
+		endpoint: endpoint,
+		header:   base64.RawURLEncoding.EncodeToString(encoded),
+		sign:     sign,
+	}
+	// Claims that cannot be encoded fail here rather than on every call
+	if _, err := m.mint("", time.Now()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parsePrivateKey decodes a PEM PKCS#1, PKCS#8 or SEC 1 private key
+func parsePrivateKey(pemBytes []byte) (interface{}, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %v", err)
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T (expected RSA or ECDSA)", key)
+}
+
+// jwtHashes are the hashes of the JWS algorithm suffixes
+var jwtHashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+// jwtSigner returns the algorithm and signing function for key, checking
+// a configured algorithm fits it
+func jwtSigner(alg string, key interface{}) (string, func([]byte) ([]byte, error), error) {
+	alg = strings.ToUpper(alg)
+	switch k := key.(type) {
+	case []byte:
+		if alg == "" {
+			alg = "HS256"
+		}
+		hash, ok := jwtHashes[strings.TrimPrefix(alg, "HS")]
+		if !strings.HasPrefix(alg, "HS") || !ok {
+			return "", nil, fmt.Errorf("mint_jwt algorithm %s does not fit a secret (expected HS256, HS384 or HS512)", alg)
+		}
+		return alg, func(input []byte) ([]byte, error) {
+			mac := hmac.New(hash.New, k)
+			mac.Write(input)
+			return mac.Sum(nil), nil
+		}, nil
+	case *rsa.PrivateKey:
+		if alg == "" {
+			alg = "RS256"
+		}
+		hash, ok := jwtHashes[strings.TrimPrefix(alg, "RS")]
+		if !strings.HasPrefix(alg, "RS") || !ok {
+			return "", nil, fmt.Errorf("mint_jwt algorithm %s does not fit an RSA key (expected RS256, RS384 or RS512)", alg)
+		}
+		return alg, func(input []byte) ([]byte, error) {
+			h := hash.New()
+			h.Write(input)
+			return rsa.SignPKCS1v15(rand.Reader, k, hash, h.Sum(nil))
+		}, nil
+	case *ecdsa.PrivateKey:
+		curveAlg := map[elliptic.Curve]string{elliptic.P256(): "ES256", elliptic.P384(): "ES384", elliptic.P521(): "ES512"}[k.Curve]
+		if curveAlg == "" {
+			return "", nil, fmt.Errorf("mint_jwt key uses an unsupported curve")
+		}
+		if alg == "" {
+			alg = curveAlg
+		}
+		if alg != curveAlg {
+			return "", nil, fmt.Errorf("mint_jwt algorithm %s does not fit the key's curve (expected %s)", alg, curveAlg)
+		}
+		hash := jwtHashes[strings.TrimPrefix(alg, "ES")]
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return alg, func(input []byte) ([]byte, error) {
+			h := hash.New()
+			h.Write(input)
+			r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+			if err != nil {
+				return nil, err
+			}
+			// JWS wants r and s as fixed-size big-endian integers
+			sig := make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+			return sig, nil
+		}, nil
+	}
+	return "", nil, fmt.Errorf("unsupported mint_jwt key type %T", key)
+}
+
+// tokenFor returns a token for a call to method, minting one if needed
+func (m *jwtMinter) tokenFor(method string, now time.Time) (string, error) {
+	if m.config.PerRequest {
+		return m.mint(method, now)
+	}
+	minute := now.Truncate(time.Minute)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && m.minute.Equal(minute) {
+		return m.token, nil
+	}
+	token, err := m.mint(method, now)
+	if err != nil {
+		return "", err
+	}
+	m.minute, m.token = minute, token
+	return token, nil
+}
+
+// mint signs a new token issued at now
+func (m *jwtMinter) mint(method string, now time.Time) (string, error) {
+	claims := make(map[string]interface{}, len(m.config.Claims)+3)
+	replacer := strings.NewReplacer("{endpoint}", m.endpoint, "{method}", method)
+	for name, value := range m.config.Claims {
+		if s, ok := value.(string); ok {
+			value = replacer.Replace(s)
+		}
+		claims[name] = value
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(m.config.lifetime()).Unix()
+	claims["jti"] = hex.EncodeToString(jti)
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("invalid mint_jwt claims: %v", err)
+	}
+	input := m.header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := m.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
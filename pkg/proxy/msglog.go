@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// defaultMessageLogMaxBytes truncates logged messages that would flood the log
+const defaultMessageLogMaxBytes = 4096
+
+// reflectionTimeout bounds a descriptor lookup against the upstream
+const reflectionTimeout = 5 * time.Second
+
+// MessageLogConfig enables debug logging of decoded request and response
+// messages. Descriptors come from the descriptor_set or the upstream's
+// reflection service.
+type MessageLogConfig struct {
+	// Methods limits logging to these full method name prefixes (default all)
+	Methods []string `mapstructure:"methods"`
+
+	// MaxBytes truncates each logged message (default 4096)
+	MaxBytes int `mapstructure:"max_bytes"`
+}
+
+func (c *MessageLogConfig) matches(fullMethodName string) bool {
+	return len(c.Methods) == 0 || matchesMethod(c.Methods, fullMethodName)
+}
+
+func (c *MessageLogConfig) maxBytes() int {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return defaultMessageLogMaxBytes
+}
+
+// descriptorResolver looks up method descriptors through the upstream's
+// reflection service and caches them per service, including failures
+type descriptorResolver struct {
+	proxy *ProxyServer
+
+	mu       sync.Mutex
+	services map[string]protoreflect.ServiceDescriptor
+	failed   map[string]bool
+}
+
+func newDescriptorResolver(p *ProxyServer) *descriptorResolver {
+	return &descriptorResolver{
+		proxy:    p,
+		services: make(map[string]protoreflect.ServiceDescriptor),
+		failed:   make(map[string]bool),
+	}
+}
+
+// method returns the descriptor of a full method name such as /pkg.Service/Method
+func (r *descriptorResolver) method(fullMethodName string) protoreflect.MethodDescriptor {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethodName, "/"), "/")
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sd, ok := r.services[service]
+	if !ok {
+		if r.failed[service] {
+			return nil
+		}
+		var err error
+		if sd, err = r.fetch(service); err != nil {
+			r.proxy.logf(levelWarn, "Message logging for %s on %s unavailable: %v", service, r.proxy.config.Name, err)
+			r.failed[service] = true
+			return nil
+		}
+		r.services[service] = sd
+	}
+	return sd.Methods().ByName(protoreflect.Name(method))
+}
+
+// fetch resolves a service from the descriptor_set, or else with its file's
+// dependencies via reflection
+func (r *descriptorResolver) fetch(service string) (protoreflect.ServiceDescriptor, error) {
+	if set := r.proxy.descriptorSet; set != nil {
+		if sd, ok := set.service(service); ok {
+			return sd, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reflectionTimeout)
+	defer cancel()
+	ctx = r.proxy.upstreamContext(ctx, rpb.ServerReflection_ServerReflectionInfo_FullMethodName)
+
+	stream, err := rpb.NewServerReflectionClient(r.proxy.upstream).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	protos := make(map[string]*descriptorpb.FileDescriptorProto)
+	add := func(resp *rpb.ServerReflectionResponse) error {
+		if e := resp.GetErrorResponse(); e != nil {
+			return fmt.Errorf("reflection error: %s", e.ErrorMessage)
+		}
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fd); err != nil {
+				return err
+			}
+			protos[fd.GetName()] = fd
+		}
+		return nil
+	}
+	request := func(req *rpb.ServerReflectionRequest) error {
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		return add(resp)
+	}
+
+	err = request(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers usually send all dependencies along; fetch any that are missing
+	// unless the binary already knows them (e.g. well-known types)
+	for {
+		var missing string
+		for _, fd := range protos {
+			for _, dep := range fd.Dependency {
+				if _, ok := protos[dep]; ok {
+					continue
+				}
+				if _, err := protoregistry.GlobalFiles.FindFileByPath(dep); err == nil {
+					continue
+				}
+				missing = dep
+			}
+		}
+		if missing == "" {
+			break
+		}
+		err := request(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: missing},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := protos[missing]; !ok {
+			return nil, fmt.Errorf("upstream did not return %s", missing)
+		}
+	}
+
+	files, err := buildFiles(protos)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+	return sd, nil
+}
+
+// fallbackResolver resolves from reflected files first, then from the
+// descriptors compiled into the binary
+type fallbackResolver struct {
+	files *protoregistry.Files
+}
+
+func (r fallbackResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r fallbackResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// messageLogInterceptor logs decoded messages of selected calls
+func (p *ProxyServer) messageLogInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.config.MessageLog == nil || !p.config.MessageLog.matches(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	md := p.descriptors.method(info.FullMethod)
+	if md == nil {
+		return handler(srv, ss)
+	}
+	return handler(srv, &messageLogStream{ServerStream: ss, proxy: p, method: info.FullMethod, desc: md})
+}
+
+// messageLogStream decodes and logs messages as they pass through
+type messageLogStream struct {
+	grpc.ServerStream
+	proxy  *ProxyServer
+	method string
+	desc   protoreflect.MethodDescriptor
+}
+
+func (s *messageLogStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.log("request", s.desc.Input(), m)
+	}
+	return err
+}
+
+func (s *messageLogStream) SendMsg(m interface{}) error {
+	s.log("response", s.desc.Output(), m)
+	return s.ServerStream.SendMsg(m)
+}
+
+// log decodes the raw frame in m as desc and logs it as JSON
+func (s *messageLogStream) log(kind string, desc protoreflect.MessageDescriptor, m interface{}) {
+	b, ok := messageBytes(m)
+	if !ok {
+		return
+	}
+	decoded := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(b, decoded); err != nil {
+		s.proxy.logf(levelInfo, "[%s] %s %s %s: undecodable %d bytes: %v", s.proxy.config.Name, requestIDFromContext(s.Context()), s.method, kind, len(b), err)
+		return
+	}
+	out, err := protojson.Marshal(decoded)
+	if err != nil {
+		s.proxy.logf(levelInfo, "[%s] %s %s %s: %d bytes: %v", s.proxy.config.Name, requestIDFromContext(s.Context()), s.method, kind, len(b), err)
+		return
+	}
+	if max := s.proxy.config.MessageLog.maxBytes(); len(out) > max {
+		out = append(out[:max:max], []byte("...(truncated)")...)
+	}
+	s.proxy.logf(levelInfo, "[%s] %s %s %s: %s", s.proxy.config.Name, requestIDFromContext(s.Context()), s.method, kind, out)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Webhook types that post chat messages instead of the Alert JSON
+const (
+	WebhookSlack   = "slack"
+	WebhookDiscord = "discord"
+)
+
+// defaultAlertTemplate renders chat messages when a webhook sets no template
+const defaultAlertTemplate = `[{{.Event}}]{{if .Endpoint}} {{.Endpoint}}:{{end}} {{.Message}}`
+
+// discordMaxContent is the most characters Discord accepts in a message
+const discordMaxContent = 2000
+
+// validate checks the webhook type and that its template parses
+func (w WebhookConfig) validate() error {
+	switch w.Type {
+	case "", WebhookSlack, WebhookDiscord:
+	default:
+		return fmt.Errorf("unknown alert webhook type '%s' (expected slack or discord)", w.Type)
+	}
+	if w.Type == "" && (w.Template != "" || w.Channel != "" || w.Username != "") {
+		return fmt.Errorf("alert webhook %s sets template, channel or username without a slack or discord type", redactURL(w.URL))
+	}
+	_, err := w.template()
+	return err
+}
+
+// template parses the webhook's message template or the default
+func (w WebhookConfig) template() (*template.Template, error) {
+	text := w.Template
+	if text == "" {
+		text = defaultAlertTemplate
+	}
+	t, err := template.New("alert").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alert template: %v", err)
+	}
+	return t, nil
+}
+
+// payload encodes alert as the request body the webhook expects
+func (w WebhookConfig) payload(alert Alert) ([]byte, error) {
+	if w.Type == "" {
+		return json.Marshal(alert)
+	}
+	t, err := w.template()
+	if err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	if err := t.Execute(&text, alert); err != nil {
+		return nil, err
+	}
+
+	switch w.Type {
+	case WebhookSlack:
+		return json.Marshal(struct {
+			Text     string `json:"text"`
+			Channel  string `json:"channel,omitempty"`
+			Username string `json:"username,omitempty"`
+		}{text.String(), w.Channel, w.Username})
+	default:
+		content := text.String()
+		if runes := []rune(content); len(runes) > discordMaxContent {
+			content = string(runes[:discordMaxContent-1]) + "…"
+		}
+		return json.Marshal(struct {
+			Content  string `json:"content"`
+			Username string `json:"username,omitempty"`
+		}{content, w.Username})
+	}
+}
@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// OIDCConfig obtains the endpoint's token from an OpenID Connect provider
+// instead of jwt_token. grpc-proxy login signs in with the device flow and
+// stores a refresh token, which the proxy then uses to keep access tokens
+// fresh.
+type OIDCConfig struct {
+	// Issuer is the provider's URL, where its discovery document is found
+	Issuer string `mapstructure:"issuer"`
+
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+
+	// Scopes are requested at login (default openid and offline_access)
+	Scopes []string `mapstructure:"scopes"`
+
+	// Audience is sent at login for providers that need it to issue JWT
+	// access tokens for an API
+	Audience string `mapstructure:"audience"`
+
+	// RefreshTokenRef is where login stores the refresh token and the proxy
+	// reads it (default keyring:oidc-<endpoint>). login can store to
+	// keyring: and file: references.
+	RefreshTokenRef string `mapstructure:"refresh_token_ref"`
+}
+
+// defaultOIDCScopes are requested when scopes is not configured
+var defaultOIDCScopes = []string{"openid", "offline_access"}
+
+// oidcHTTPTimeout bounds a single request to the provider
+const oidcHTTPTimeout = 30 * time.Second
+
+// refreshTokenRef returns where the refresh token of endpoint is kept
+func (c *OIDCConfig) refreshTokenRef(endpoint string) string {
+	if c.RefreshTokenRef != "" {
+		return c.RefreshTokenRef
+	}
+	return "keyring:oidc-" + endpoint
+}
+
+// validate checks the provider and the refresh token reference
+func (c *OIDCConfig) validate(endpoint string) error {
+	if c.Issuer == "" || c.ClientID == "" {
+		return fmt.Errorf("oidc needs issuer and client_id")
+	}
+	if u, err := url.Parse(c.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("oidc issuer %q is not an http(s) URL", c.Issuer)
+	}
+	if _, _, err := parseSecretRef(c.refreshTokenRef(endpoint)); err != nil {
+		return fmt.Errorf("oidc: %v", err)
+	}
+	return nil
+}
+
+// oidcProvider holds the endpoints of a provider's discovery document
+type oidcProvider struct {
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// discoverOIDC reads the discovery document of issuer
+func discoverOIDC(ctx context.Context, issuer string) (*oidcProvider, error) {
+	ctx, cancel := context.WithTimeout(ctx, oidcHTTPTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := secretsDo(http.DefaultClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider %s: %v", issuer, err)
+	}
+	var provider oidcProvider
+	if err := json.Unmarshal(body, &provider); err != nil {
+		return nil, fmt.Errorf("invalid discovery document of %s: %v", issuer, err)
+	}
+	if provider.TokenEndpoint == "" {
+		return nil, fmt.Errorf("discovery document of %s has no token_endpoint", issuer)
+	}
+	return &provider, nil
+}
+
+// oauthError is an error answer of an OAuth endpoint
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// oidcTokens is a token endpoint's answer
+type oidcTokens struct {
+	AccessToken  string      `json:"access_token"`
+	RefreshToken string      `json:"refresh_token"`
+	ExpiresIn    json.Number `json:"expires_in"`
+}
+
+// lifetime returns how long the access token is valid: expires_in, else
+// its exp claim, else five minutes
+func (t *oidcTokens) lifetime() time.Duration {
+	if seconds, err := t.ExpiresIn.Int64(); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if claims, err := DecodeToken(t.AccessToken); err == nil && !claims.ExpiresAt.IsZero() {
+		if left := time.Until(claims.ExpiresAt); left > 0 {
+			return left
+		}
+	}
+	return 5 * time.Minute
+}
+
+// postOAuth posts form to an OAuth endpoint and decodes a successful answer
+// into v. Error answers are returned as *oauthError.
+func postOAuth(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, oidcHTTPTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &oauthError{}
+		if json.Unmarshal(body, e) == nil && e.Code != "" {
+			return e
+		}
+		return fmt.Errorf("%s: %s", resp.Status, errorMessage(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// clientForm returns the client credentials of an OAuth request
+func (c *OIDCConfig) clientForm(form url.Values) url.Values {
+	form.Set("client_id", c.ClientID)
+	if c.ClientSecret != "" {
+		form.Set("client_secret", c.ClientSecret)
+	}
+	return form
+}
+
+// DeviceLogin is a device authorization (RFC 8628) waiting for the user to
+// approve it in a browser
+type DeviceLogin struct {
+	// UserCode is entered at VerificationURI; VerificationURIComplete, if
+	// the provider sends one, already carries it
+	UserCode                string
+	VerificationURI         string
+	VerificationURIComplete string
+	ExpiresAt               time.Time
+
+	endpoint   string
+	config     *OIDCConfig
+	tokenURL   string
+	deviceCode string
+	interval   time.Duration
+}
+
+// StartDeviceLogin starts signing in to the OIDC provider of an endpoint
+func StartDeviceLogin(ctx context.Context, endpoint Config) (*DeviceLogin, error) {
+	config := endpoint.OIDC
+	if config == nil {
+		return nil, fmt.Errorf("endpoint '%s' has no oidc section", endpoint.Name)
+	}
+	if err := config.validate(endpoint.Name); err != nil {
+		return nil, fmt.Errorf("endpoint '%s': %v", endpoint.Name, err)
+	}
+	provider, err := discoverOIDC(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if provider.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("OIDC provider %s does not support the device flow", config.Issuer)
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultOIDCScopes
+	}
+	form := config.clientForm(url.Values{"scope": {strings.Join(scopes, " ")}})
+	if config.Audience != "" {
+		form.Set("audience", config.Audience)
+	}
+	var resp struct {
+		DeviceCode              string      `json:"device_code"`
+		UserCode                string      `json:"user_code"`
+		VerificationURI         string      `json:"verification_uri"`
+		VerificationURIComplete string      `json:"verification_uri_complete"`
+		ExpiresIn               json.Number `json:"expires_in"`
+		Interval                json.Number `json:"interval"`
+	}
+	if err := postOAuth(ctx, provider.DeviceAuthorizationEndpoint, form, &resp); err != nil {
+		return nil, fmt.Errorf("device authorization failed: %v", err)
+	}
+	if resp.DeviceCode == "" || resp.UserCode == "" || resp.VerificationURI == "" {
+		return nil, fmt.Errorf("device authorization response is incomplete")
+	}
+	expiresIn, _ := resp.ExpiresIn.Int64()
+	if expiresIn <= 0 {
+		expiresIn = 600
+	}
+	// RFC 8628 polls every five seconds unless told otherwise
+	interval, _ := resp.Interval.Int64()
+	if interval <= 0 {
+		interval = 5
+	}
+	return &DeviceLogin{
+		UserCode:                resp.UserCode,
+		VerificationURI:         resp.VerificationURI,
+		VerificationURIComplete: resp.VerificationURIComplete,
+		ExpiresAt:               time.Now().Add(time.Duration(expiresIn) * time.Second),
+		endpoint:                endpoint.Name,
+		config:                  config,
+		tokenURL:                provider.TokenEndpoint,
+		deviceCode:              resp.DeviceCode,
+		interval:                time.Duration(interval) * time.Second,
+	}, nil
+}
+
+// Wait polls the provider until the user approves or denies the login or
+// it expires, then stores the refresh token and returns the reference it
+// was stored at
+func (d *DeviceLogin) Wait(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithDeadline(ctx, d.ExpiresAt)
+	defer cancel()
+	form := d.config.clientForm(url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {d.deviceCode},
+	})
+	interval := d.interval
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", fmt.Errorf("the login code expired; run login again")
+			}
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+
+		var tokens oidcTokens
+		err := postOAuth(ctx, d.tokenURL, form, &tokens)
+		var oe *oauthError
+		if errors.As(err, &oe) {
+			switch oe.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			case "access_denied":
+				return "", fmt.Errorf("the login was denied")
+			case "expired_token":
+				return "", fmt.Errorf("the login code expired; run login again")
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("login failed: %v", err)
+		}
+		if tokens.RefreshToken == "" {
+			return "", fmt.Errorf("the provider issued no refresh token; request the offline_access scope")
+		}
+		ref := d.config.refreshTokenRef(d.endpoint)
+		if err := storeRefreshToken(ref, tokens.RefreshToken); err != nil {
+			return "", err
+		}
+		return ref, nil
+	}
+}
+
+// storeRefreshToken writes a refresh token to a keyring: or file: reference
+func storeRefreshToken(ref, token string) error {
+	scheme, path, err := parseSecretRef(ref)
+	if err != nil {
+		return err
+	}
+	switch scheme {
+	case "keyring":
+		return SetKeyringToken(path, token)
+	case "file":
+		if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			return fmt.Errorf("failed to store refresh token: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot store a refresh token at %s; use a keyring: or file: refresh_token_ref", ref)
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"net"
+
+	"google.golang.org/grpc"
+)
+
+// Option customizes a ProxyServer at construction
+type Option func(*options)
+
+type options struct {
+	streamInterceptors []grpc.StreamServerInterceptor
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+
+	// listenerWrappers wrap the endpoint's listener, in order
+	listenerWrappers []func(endpoint string, lis net.Listener) net.Listener
+
+	// processor handles calls of endpoints without a processor configured
+	processor Processor
+
+	// clients is set by the Manager to authenticate local callers
+	clients *clientSet
+
+	// connLimiter is set by the Manager to cap client connections
+	connLimiter *connLimiter
+
+	// secrets is set by the Manager to resolve jwt_token_ref
+	secrets *secretStore
+
+	// renewals is set by the Manager to keep rotated refresh tokens across
+	// reloads
+	renewals *renewalStore
+
+	// audit is set by the Manager to record token rotations
+	audit *auditLog
+
+	// usage is set by the Manager to account calls per client
+	usage *usageLog
+
+	// quotas is set by the Manager to enforce client quotas
+	quotas *quotaTracker
+
+	// redis is set by the Manager to share lane rate limits across replicas
+	redis *redisClient
+
+	// alerts is set by the Manager to report upstream failures and expiring tokens
+	alerts *alerter
+
+	// acme is set by the Manager to obtain listener certificates
+	acme *acmeIssuer
+
+	// denyByDefault is set by the Manager in security_mode deny_by_default
+	denyByDefault bool
+}
+
+// WithInterceptors adds stream interceptors around the proxy handler. Every
+// proxied call is a stream at this layer, including calls that are unary for
+// the client and upstream, so these see all forwarded traffic. Interceptors
+// run in the order given, after the proxy's in-flight accounting and before
+// its own admission control; they may reject calls, log them, or wrap the
+// ServerStream (e.g. to replace its context with modified incoming metadata,
+// which the director then forwards upstream).
+func WithInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(o *options) {
+		o.streamInterceptors = append(o.streamInterceptors, interceptors...)
+	}
+}
+
+// WithUnaryInterceptors adds unary interceptors. They only apply to services
+// the proxy serves itself (such as grpc.health.v1.Health), never to proxied calls.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(o *options) {
+		o.unaryInterceptors = append(o.unaryInterceptors, interceptors...)
+	}
+}
+
+// WithListenerWrapper wraps the listeners of every endpoint, including REST
+// companions, before the proxy's own access control and connection limits,
+// e.g. to decode the PROXY protocol or count connections. The wrapper is
+// given the endpoint's name.
+func WithListenerWrapper(wrap func(endpoint string, lis net.Listener) net.Listener) Option {
+	return func(o *options) {
+		o.listenerWrappers = append(o.listenerWrappers, wrap)
+	}
+}
+
+// WithProcessor hands the calls of every endpoint without a processor of
+// its own configured to processor, after authentication and before method
+// checks and routing. It may reject calls, rewrite their method and
+// metadata, or pick their upstream.
+func WithProcessor(processor Processor) Option {
+	return func(o *options) {
+		o.processor = processor
+	}
+}
+
+// withClients authenticates local callers against a Manager's client set
+func withClients(clients *clientSet) Option {
+	return func(o *options) {
+		o.clients = clients
+	}
+}
+
+// withConnLimiter caps accepted connections with a Manager's shared limiter
+func withConnLimiter(limiter *connLimiter) Option {
+	return func(o *options) {
+		o.connLimiter = limiter
+	}
+}
+
+// withSecrets resolves secret references with a Manager's secret store
+func withSecrets(secrets *secretStore) Option {
+	return func(o *options) {
+		o.secrets = secrets
+	}
+}
+
+// withRenewals keeps token renewal state in a Manager's store
+func withRenewals(renewals *renewalStore) Option {
+	return func(o *options) {
+		o.renewals = renewals
+	}
+}
+
+// withAudit records token rotations in a Manager's audit log
+func withAudit(audit *auditLog) Option {
+	return func(o *options) {
+		o.audit = audit
+	}
+}
+
+// withUsage accounts calls in a Manager's usage log
+func withUsage(usage *usageLog) Option {
+	return func(o *options) {
+		o.usage = usage
+	}
+}
+
+// withQuotas enforces client quotas with a Manager's shared tracker
+func withQuotas(quotas *quotaTracker) Option {
+	return func(o *options) {
+		o.quotas = quotas
+	}
+}
+
+// withRedis shares lane rate limits through a Manager's Redis client
+func withRedis(redis *redisClient) Option {
+	return func(o *options) {
+		o.redis = redis
+	}
+}
+
+// withACME obtains listener certificates through a Manager's ACME issuer
+func withACME(acme *acmeIssuer) Option {
+	return func(o *options) {
+		o.acme = acme
+	}
+}
+
+// withAlerts reports upstream failures and expiring tokens through a Manager's alerter
+func withAlerts(alerts *alerter) Option {
+	return func(o *options) {
+		o.alerts = alerts
+	}
+}
@@ -0,0 +1,469 @@
+package proxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultOutlierInterval           = 10 * time.Second
+	defaultOutlierMinCalls           = 20
+	defaultOutlierMaxErrorPercent    = 50
+	defaultOutlierEjectionTime       = 30 * time.Second
+	defaultOutlierRampUp             = 30 * time.Second
+	defaultOutlierMaxEjectionPercent = 50
+)
+
+// outlierBalancerName is the load balancing policy of upstreams with
+// outlier detection
+const outlierBalancerName = "grpc_proxy_outlier_detection"
+
+// OutlierDetectionConfig spreads calls over every address of the endpoint's
+// upstream, from DNS or resolve_to, and takes an address out of the
+// rotation for a while when its error rate or latency degrades
+type OutlierDetectionConfig struct {
+	// Interval is how often addresses are judged, over the calls since the
+	// previous judgement (default 10s)
+	Interval time.Duration `mapstructure:"interval"`
+
+	// MinCalls an address must have served in an interval to be judged (default 20)
+	MinCalls int `mapstructure:"min_calls"`
+
+	// MaxErrorPercent of calls failing with UNAVAILABLE, INTERNAL, UNKNOWN,
+	// DEADLINE_EXCEEDED or DATA_LOSS ejects the address (default 50)
+	MaxErrorPercent float64 `mapstructure:"max_error_percent"`
+
+	// MaxLatency ejects an address whose calls take longer than this on
+	// average (default off)
+	MaxLatency time.Duration `mapstructure:"max_latency"`
+
+	// EjectionTime is how long an ejected address gets no calls (default 30s)
+	EjectionTime time.Duration `mapstructure:"ejection_time"`
+
+	// RampUp is how long a re-admitted address takes to get its full share
+	// of calls again (default 30s)
+	RampUp time.Duration `mapstructure:"ramp_up"`
+
+	// MaxEjectionPercent of the addresses may be ejected at once (default 50)
+	MaxEjectionPercent float64 `mapstructure:"max_ejection_percent"`
+}
+
+// validate checks the thresholds are in range
+func (c *OutlierDetectionConfig) validate() error {
+	if c.Interval < 0 || c.MaxLatency < 0 || c.EjectionTime < 0 || c.RampUp < 0 || c.MinCalls < 0 {
+		return fmt.Errorf("outlier_detection durations and min_calls must not be negative")
+	}
+	for name, pct := range map[string]float64{"max_error_percent": c.MaxErrorPercent, "max_ejection_percent": c.MaxEjectionPercent} {
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("outlier_detection %s must be between 0 and 100", name)
+		}
+	}
+	return nil
+}
+
+// interval returns the configured interval or the default
+func (c *OutlierDetectionConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return defaultOutlierInterval
+}
+
+// minCalls returns the configured minimum or the default
+func (c *OutlierDetectionConfig) minCalls() int64 {
+	if c.MinCalls > 0 {
+		return int64(c.MinCalls)
+	}
+	return defaultOutlierMinCalls
+}
+
+// maxErrorPercent returns the configured threshold or the default
+func (c *OutlierDetectionConfig) maxErrorPercent() float64 {
+	if c.MaxErrorPercent > 0 {
+		return c.MaxErrorPercent
+	}
+	return defaultOutlierMaxErrorPercent
+}
+
+// ejectionTime returns the configured cool-down or the default
+func (c *OutlierDetectionConfig) ejectionTime() time.Duration {
+	if c.EjectionTime > 0 {
+		return c.EjectionTime
+	}
+	return defaultOutlierEjectionTime
+}
+
+// rampUp returns the configured ramp-up or the default
+func (c *OutlierDetectionConfig) rampUp() time.Duration {
+	if c.RampUp > 0 {
+		return c.RampUp
+	}
+	return defaultOutlierRampUp
+}
+
+// maxEjectionPercent returns the configured limit or the default
+func (c *OutlierDetectionConfig) maxEjectionPercent() float64 {
+	if c.MaxEjectionPercent > 0 {
+		return c.MaxEjectionPercent
+	}
+	return defaultOutlierMaxEjectionPercent
+}
+
+// upstreamFailure reports whether err counts against the address that
+// served the call. Errors about the request itself, and calls the client
+// cancelled, do not.
+func upstreamFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.Unknown, codes.DeadlineExceeded, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// outlierHost is what the detector knows about one upstream address
+type outlierHost struct {
+	calls, failures int64
+	latency         time.Duration
+
+	// ejectedUntil is when the last ejection ends; the ramp-up starts there
+	ejectedUntil time.Time
+	// ejected is set until the end of the ejection has been logged
+	ejected bool
+}
+
+// outlierDetector judges the addresses of an endpoint's upstream. The
+// picker reports every call to it and asks it which addresses to use.
+type outlierDetector struct {
+	id      string
+	config  *OutlierDetectionConfig
+	name    string
+	metrics *expvar.Map
+	logf    func(level logLevel, format string, args ...interface{})
+
+	mu    sync.Mutex
+	hosts map[string]*outlierHost
+}
+
+// outlierDetectors lets the balancer of a connection find its endpoint's
+// detector, named in the connection's service config
+var (
+	outlierDetectors   sync.Map
+	outlierDetectorIDs atomic.Int64
+)
+
+// newOutlierDetector registers a detector for an endpoint
+func newOutlierDetector(config *OutlierDetectionConfig, name string) *outlierDetector {
+	d := &outlierDetector{
+		id:      strconv.FormatInt(outlierDetectorIDs.Add(1), 10),
+		config:  config,
+		name:    name,
+		metrics: endpointMetrics(name),
+		logf:    func(logLevel, string, ...interface{}) {},
+		hosts:   make(map[string]*outlierHost),
+	}
+	d.metrics.Set("upstream_ejected", intVar(0))
+	outlierDetectors.Store(d.id, d)
+	return d
+}
+
+// balancedDialOption makes a connection spread calls over the upstream's
+// addresses, with the detector and the affinity table given, either of
+// which may be nil
+func balancedDialOption(d *outlierDetector, t *affinityTable) grpc.DialOption {
+	var id, affinity string
+	if d != nil {
+		id = d.id
+	}
+	if t != nil {
+		affinity = t.id
+	}
+	serviceConfig := fmt.Sprintf(`{"loadBalancingConfig": [{%q: {"id": %q, "affinity": %q}}]}`, outlierBalancerName, id, affinity)
+	return grpc.WithDefaultServiceConfig(serviceConfig)
+}
+
+// close unregisters the detector
+func (d *outlierDetector) close() {
+	outlierDetectors.Delete(d.id)
+}
+
+// setHosts starts tracking new addresses and forgets ones that went away,
+// unless they are ejected
+func (d *outlierDetector) setHosts(addrs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = true
+		if d.hosts[addr] == nil {
+			d.hosts[addr] = &outlierHost{}
+		}
+	}
+	for addr, h := range d.hosts {
+		if !current[addr] && !h.ejected {
+			delete(d.hosts, addr)
+		}
+	}
+}
+
+// record counts a finished call served by addr
+func (d *outlierDetector) record(addr string, err error, elapsed time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.hosts[addr]
+	if h == nil || status.Code(err) == codes.Canceled {
+		return
+	}
+	h.calls++
+	h.latency += elapsed
+	if upstreamFailure(err) {
+		h.failures++
+	}
+}
+
+// weight returns the share of its calls addr should get: 0 while it is
+// ejected, rising to 1 over the ramp-up after that
+func (d *outlierDetector) weight(addr string, now time.Time) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.hosts[addr]
+	if h == nil || h.ejectedUntil.IsZero() {
+		return 1
+	}
+	if now.Before(h.ejectedUntil) {
+		return 0
+	}
+	ramp := now.Sub(h.ejectedUntil)
+	if ramp >= d.config.rampUp() {
+		return 1
+	}
+	return float64(ramp) / float64(d.config.rampUp())
+}
+
+// evaluate judges every address on the calls since the previous evaluation
+// and ejects the ones past a threshold, as long as max_ejection_percent allows
+func (d *outlierDetector) evaluate(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addrs := make([]string, 0, len(d.hosts))
+	ejected := 0
+	for addr, h := range d.hosts {
+		addrs = append(addrs, addr)
+		if now.Before(h.ejectedUntil) {
+			ejected++
+		} else if h.ejected {
+			h.ejected = false
+			d.logf(levelInfo, "Re-admitting upstream %s of %s, ramping up over %s", addr, d.name, d.config.rampUp())
+		}
+	}
+	sort.Strings(addrs)
+	allowed := int(float64(len(addrs)) * d.config.maxEjectionPercent() / 100)
+
+	for _, addr := range addrs {
+		h := d.hosts[addr]
+		calls, failures, latency := h.calls, h.failures, h.latency
+		h.calls, h.failures, h.latency = 0, 0, 0
+		if now.Before(h.ejectedUntil) || calls < d.config.minCalls() {
+			continue
+		}
+
+		var reason string
+		if errorPercent := float64(failures) * 100 / float64(calls); errorPercent > d.config.maxErrorPercent() {
+			reason = fmt.Sprintf("%.0f%% of %d calls failed", errorPercent, calls)
+		} else if mean := latency / time.Duration(calls); d.config.MaxLatency > 0 && mean > d.config.MaxLatency {
+			reason = fmt.Sprintf("mean latency %s over %d calls", mean.Round(time.Millisecond), calls)
+		}
+		if reason == "" {
+			continue
+		}
+		if ejected >= allowed {
+			d.logf(levelWarn, "Warning: upstream %s of %s is degraded (%s) but stays in rotation, as max_ejection_percent is reached", addr, d.name, reason)
+			continue
+		}
+		ejected++
+		h.ejectedUntil = now.Add(d.config.ejectionTime())
+		h.ejected = true
+		d.metrics.Add("upstream_ejections", 1)
+		d.logf(levelWarn, "Warning: ejecting upstream %s of %s for %s: %s", addr, d.name, d.config.ejectionTime(), reason)
+	}
+	d.metrics.Set("upstream_ejected", intVar(int64(ejected)))
+}
+
+// watchOutliers evaluates the upstream's addresses every interval
+func (p *ProxyServer) watchOutliers() {
+	ticker := time.NewTicker(p.outliers.config.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case now := <-ticker.C:
+			p.outliers.evaluate(now)
+		}
+	}
+}
+
+func init() {
+	balancer.Register(outlierBalancerBuilder{})
+}
+
+// outlierBalancerConfig names the detector and the affinity table of a connection
+type outlierBalancerConfig struct {
+	serviceconfig.LoadBalancingConfig
+	ID       string `json:"id"`
+	Affinity string `json:"affinity"`
+}
+
+// outlierBalancerBuilder builds round-robin balancers whose picker skips
+// the addresses the endpoint's detector ejected and keeps bound clients on
+// their address
+type outlierBalancerBuilder struct{}
+
+func (outlierBalancerBuilder) Name() string {
+	return outlierBalancerName
+}
+
+func (outlierBalancerBuilder) ParseConfig(raw json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := &outlierBalancerConfig{}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %v", outlierBalancerName, err)
+	}
+	return config, nil
+}
+
+func (outlierBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pickers := &outlierPickerBuilder{}
+	return &outlierBalancer{
+		Balancer: base.NewBalancerBuilder(outlierBalancerName, pickers, base.Config{}).Build(cc, opts),
+		pickers:  pickers,
+	}
+}
+
+// outlierBalancer hands its picker builder the detector and the affinity
+// table named in the connection's service config
+type outlierBalancer struct {
+	balancer.Balancer
+	pickers *outlierPickerBuilder
+}
+
+func (b *outlierBalancer) UpdateClientConnState(state balancer.ClientConnState) error {
+	if config, ok := state.BalancerConfig.(*outlierBalancerConfig); ok {
+		if d, ok := outlierDetectors.Load(config.ID); ok {
+			b.pickers.detector = d.(*outlierDetector)
+		}
+		if t, ok := affinityTables.Load(config.Affinity); ok {
+			b.pickers.affinity = t.(*affinityTable)
+		}
+	}
+	return b.Balancer.UpdateClientConnState(state)
+}
+
+// outlierPickerBuilder builds a picker over the ready addresses
+type outlierPickerBuilder struct {
+	detector *outlierDetector
+	affinity *affinityTable
+}
+
+func (b *outlierPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	picker := &outlierPicker{detector: b.detector, affinity: b.affinity}
+	for sc, scInfo := range info.ReadySCs {
+		picker.subConns = append(picker.subConns, sc)
+		picker.addrs = append(picker.addrs, scInfo.Address.Addr)
+	}
+	sort.Sort(picker)
+	picker.next.Store(uint32(rand.Intn(len(picker.addrs))))
+	if b.detector != nil {
+		b.detector.setHosts(picker.addrs)
+	}
+	return picker
+}
+
+// outlierPicker picks addresses round-robin, skipping ejected ones and
+// sending ramping ones their share of calls. Calls of a bound client go to
+// its address while that is ready and not ejected.
+type outlierPicker struct {
+	detector *outlierDetector
+	affinity *affinityTable
+	subConns []balancer.SubConn
+	addrs    []string
+	next     atomic.Uint32
+}
+
+func (p *outlierPicker) Len() int           { return len(p.addrs) }
+func (p *outlierPicker) Less(i, j int) bool { return p.addrs[i] < p.addrs[j] }
+func (p *outlierPicker) Swap(i, j int) {
+	p.addrs[i], p.addrs[j] = p.addrs[j], p.addrs[i]
+	p.subConns[i], p.subConns[j] = p.subConns[j], p.subConns[i]
+}
+
+func (p *outlierPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	key, _ := info.Ctx.Value(affinityCallKey{}).(string)
+	if p.affinity == nil || key == "" {
+		return p.result(p.pick(time.Now())), nil
+	}
+	now := time.Now()
+	if addr := p.affinity.lookup(key, now); addr != "" {
+		i := sort.SearchStrings(p.addrs, addr)
+		if i < len(p.addrs) && p.addrs[i] == addr && (p.detector == nil || p.detector.weight(addr, now) > 0) {
+			return p.result(i), nil
+		}
+	}
+	i := p.pick(now)
+	p.affinity.bind(key, p.addrs[i], now)
+	return p.result(i), nil
+}
+
+// pick returns the index of the next address in the rotation
+func (p *outlierPicker) pick(now time.Time) int {
+	n := len(p.subConns)
+	start := int(p.next.Add(1))
+	if p.detector == nil {
+		return start % n
+	}
+	// With every address ejected, or skipped while ramping up, calls still
+	// need somewhere to go
+	fallback := start % n
+	for i := 0; i < n; i++ {
+		j := (start + i) % n
+		weight := p.detector.weight(p.addrs[j], now)
+		if weight == 0 {
+			continue
+		}
+		if weight == 1 || rand.Float64() < weight {
+			return j
+		}
+		fallback = j
+	}
+	return fallback
+}
+
+// result picks the address at index i and reports the call to the detector
+func (p *outlierPicker) result(i int) balancer.PickResult {
+	if p.detector == nil {
+		return balancer.PickResult{SubConn: p.subConns[i]}
+	}
+	addr, begin := p.addrs[i], time.Now()
+	return balancer.PickResult{
+		SubConn: p.subConns[i],
+		Done: func(info balancer.DoneInfo) {
+			p.detector.record(addr, info.Err, time.Since(begin))
+		},
+	}
+}
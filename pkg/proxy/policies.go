@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PolicyConfig is a role clients can be given: the methods its holders may
+// call, by full method name pattern. A pattern matches names starting with
+// it, and * in a pattern matches any characters, e.g. "/cosmos.*.Query/"
+// matches every Cosmos SDK query service.
+type PolicyConfig struct {
+	Name string `mapstructure:"name"`
+
+	// AllowedMethods are the patterns holders may call
+	AllowedMethods []string `mapstructure:"allowed_methods"`
+
+	// DeniedMethods are patterns holders may not call even when allowed
+	DeniedMethods []string `mapstructure:"denied_methods"`
+}
+
+// validatePolicies checks policies are named uniquely, allow something and
+// compile
+func validatePolicies(policies []PolicyConfig) error {
+	names := make(map[string]bool, len(policies))
+	for _, p := range policies {
+		if p.Name == "" {
+			return fmt.Errorf("policy without a name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate policy name '%s'", p.Name)
+		}
+		names[p.Name] = true
+		if len(p.AllowedMethods) == 0 {
+			return fmt.Errorf("policy '%s' requires allowed_methods", p.Name)
+		}
+		for _, pattern := range append(append([]string{}, p.AllowedMethods...), p.DeniedMethods...) {
+			if pattern == "" {
+				return fmt.Errorf("policy '%s' has an empty method pattern", p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// methodPattern compiles a method pattern into an anchored prefix match
+func methodPattern(pattern string) *regexp.Regexp {
+	parts := strings.Split("/"+strings.TrimPrefix(pattern, "/"), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*"))
+}
+
+// clientPolicy is the union of the policies a client holds
+type clientPolicy struct {
+	allowed, denied []*regexp.Regexp
+}
+
+// newClientPolicy combines the named policies, or returns nil for a client
+// without any, which may call every method
+func newClientPolicy(names []string, policies []PolicyConfig) *clientPolicy {
+	if len(names) == 0 {
+		return nil
+	}
+	cp := &clientPolicy{}
+	for _, name := range names {
+		for _, p := range policies {
+			if p.Name != name {
+				continue
+			}
+			for _, pattern := range p.AllowedMethods {
+				cp.allowed = append(cp.allowed, methodPattern(pattern))
+			}
+			for _, pattern := range p.DeniedMethods {
+				cp.denied = append(cp.denied, methodPattern(pattern))
+			}
+		}
+	}
+	return cp
+}
+
+// allows reports whether the client may call fullMethodName; denied wins
+func (cp *clientPolicy) allows(fullMethodName string) bool {
+	if cp == nil {
+		return true
+	}
+	for _, re := range cp.denied {
+		if re.MatchString(fullMethodName) {
+			return false
+		}
+	}
+	for _, re := range cp.allowed {
+		if re.MatchString(fullMethodName) {
+			return true
+		}
+	}
+	return false
+}
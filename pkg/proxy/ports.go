@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parsePortRange parses a port_range such as "9100-9199"
+func parsePortRange(s string) (first, last int, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if ok {
+		first, err = strconv.Atoi(strings.TrimSpace(from))
+		if err == nil {
+			last, err = strconv.Atoi(strings.TrimSpace(to))
+		}
+	}
+	if !ok || err != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port_range %q, expected e.g. \"9100-9199\"", s)
+	}
+	return first, last, nil
+}
+
+// needsPort reports whether an endpoint gets its local port from port_range
+func (c Config) needsPort() bool {
+	return c.LocalPort == 0 && c.ListenAddress == ""
+}
+
+// assignPorts gives every endpoint without local_port or listen_address the
+// lowest free port of port_range. An endpoint keeps the port it had in
+// previous, by name, so reloads do not move running endpoints. Ports of
+// other listeners in the config and ports another process has bound are
+// skipped.
+func (c *ProxyConfig) assignPorts(previous *ProxyConfig) error {
+	if c.PortRange == "" {
+		return nil
+	}
+	first, last, err := parsePortRange(c.PortRange)
+	if err != nil {
+		return err
+	}
+
+	taken := make(map[int]bool)
+	for _, l := range c.listeners() {
+		if port := l.port(); port > 0 {
+			taken[port] = true
+		}
+	}
+	kept := make(map[string]int)
+	if previous != nil {
+		for _, e := range previous.Endpoints {
+			kept[e.Name] = e.LocalPort
+		}
+	}
+
+	next := first
+	for i := range c.Endpoints {
+		e := &c.Endpoints[i]
+		if !e.needsPort() {
+			continue
+		}
+		if port := kept[e.Name]; port >= first && port <= last && !taken[port] {
+			e.LocalPort = port
+			taken[port] = true
+			continue
+		}
+		for ; next <= last; next++ {
+			if !taken[next] && portFree(e.BindAddress, next) {
+				break
+			}
+		}
+		if next > last {
+			return fmt.Errorf("no free port left in port_range %s for endpoint '%s'", c.PortRange, e.Name)
+		}
+		e.LocalPort = next
+		taken[next] = true
+		log.Printf("Assigned local port %d to endpoint %s", next, e.Name)
+	}
+	return nil
+}
+
+// portFree reports whether port can be bound on bindAddress right now
+func portFree(bindAddress string, port int) bool {
+	lis, err := net.Listen("tcp", listenAddress(bindAddress, port))
+	if err != nil {
+		return false
+	}
+	lis.Close()
+	return true
+}
+
+// configListener is a listen address of the config and what it belongs to
+type configListener struct {
+	owner, address string
+}
+
+// port returns the TCP port of the listener, or 0 for unix sockets and
+// ports left to the OS
+func (l configListener) port() int {
+	if strings.HasPrefix(l.address, unixScheme) {
+		return 0
+	}
+	_, port, _ := net.SplitHostPort(l.address)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// conflicts reports whether two listeners cannot both bind: the same socket
+// path, or the same port on the same host or on a wildcard address
+func (l configListener) conflicts(other configListener) bool {
+	if l.port() == 0 || other.port() == 0 {
+		return strings.HasPrefix(l.address, unixScheme) && l.address == other.address
+	}
+	if l.port() != other.port() {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(l.address)
+	otherHost, _, _ := net.SplitHostPort(other.address)
+	wildcard := func(h string) bool { return h == "" || h == "0.0.0.0" || h == "::" }
+	return host == otherHost || wildcard(host) || wildcard(otherHost)
+}
+
+// listeners returns every address the config binds: the endpoints, their
+// REST companions and the admin service
+func (c *ProxyConfig) listeners() []configListener {
+	var listeners []configListener
+	for _, e := range c.Endpoints {
+		listeners = append(listeners, configListener{"endpoint '" + e.Name + "'", e.Address()})
+		if e.REST != nil {
+			bind := e.REST.BindAddress
+			if bind == "" {
+				bind = e.BindAddress
+			}
+			listeners = append(listeners, configListener{"endpoint '" + e.Name + "' rest", listenAddress(bind, e.REST.LocalPort)})
+		}
+	}
+	if c.Admin != nil {
+		listeners = append(listeners, configListener{"admin", c.Admin.Address()})
+	}
+	return listeners
+}
+
+// validateListeners fails with every pair of listeners that would collide,
+// instead of the first "address already in use" when binding
+func (c *ProxyConfig) validateListeners() error {
+	listeners := c.listeners()
+	var conflicts []string
+	for i, l := range listeners {
+		for _, other := range listeners[i+1:] {
+			if l.conflicts(other) {
+				conflicts = append(conflicts, fmt.Sprintf("%s (%s) and %s (%s)", l.owner, l.address, other.owner, other.address))
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return fmt.Errorf("listen address conflicts: %s", strings.Join(conflicts, "; "))
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// endpointReadiness is one endpoint in the /readyz response
+type endpointReadiness struct {
+	Name      string `json:"name"`
+	Ready     bool   `json:"ready"`
+	Listening bool   `json:"listening"`
+
+	// ReadyUpstreams counts the upstream and fallbacks in the READY
+	// state; http endpoints connect per request and have none
+	ReadyUpstreams int `json:"ready_upstreams"`
+
+	TokenExpires *time.Time `json:"token_expires,omitempty"`
+
+	// Problems lists why the endpoint is not ready
+	Problems []string `json:"problems,omitempty"`
+}
+
+// readiness checks that p is listening, that its upstream or one of its
+// fallbacks is READY, and that its token has not expired
+func (p *ProxyServer) readiness(now time.Time) endpointReadiness {
+	r := endpointReadiness{Name: p.config.Name}
+
+	p.mu.Lock()
+	r.Listening = p.listener != nil
+	p.mu.Unlock()
+	if !r.Listening {
+		r.Problems = append(r.Problems, "listener is not bound")
+	}
+
+	if p.upstream != nil {
+		if p.upstream.GetState() == connectivity.Ready {
+			r.ReadyUpstreams++
+		}
+		for _, f := range p.fallbacks {
+			if f.conn.GetState() == connectivity.Ready {
+				r.ReadyUpstreams++
+			}
+		}
+		if r.ReadyUpstreams == 0 {
+			r.Problems = append(r.Problems, "no upstream is READY, upstream is "+p.upstream.GetState().String())
+		}
+	}
+
+	if claims, err := DecodeToken(p.Token()); err == nil && !claims.ExpiresAt.IsZero() {
+		expires := claims.ExpiresAt.UTC()
+		r.TokenExpires = &expires
+		if !expires.After(now) {
+			r.Problems = append(r.Problems, "token expired at "+expires.Format(time.RFC3339))
+		}
+	}
+
+	r.Ready = len(r.Problems) == 0
+	return r
+}
+
+// readiness reports whether every configured endpoint is ready. Endpoints
+// that are not running, e.g. drained ones or ones that failed to start,
+// are not ready.
+func (m *Manager) readiness() (bool, []endpointReadiness) {
+	m.mu.Lock()
+	endpoints := m.config.Endpoints
+	m.mu.Unlock()
+
+	now := time.Now()
+	ready := true
+	statuses := make([]endpointReadiness, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		r := endpointReadiness{Name: endpoint.Name, Problems: []string{"endpoint is not running"}}
+		if p, ok := m.Server(endpoint.Name); ok {
+			r = p.readiness(now)
+		} else if err := m.failure(endpoint.Name); err != nil {
+			r.Problems = []string{"failed to start: " + err.Error()}
+		}
+		ready = ready && r.Ready
+		statuses = append(statuses, r)
+	}
+	return ready, statuses
+}
+
+// handleHealthz answers liveness probes: the process is serving HTTP, so
+// it is alive
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReadyz answers readiness probes with 200 when every endpoint is
+// ready and 503 otherwise, with the details of each endpoint
+func (m *Manager) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, endpoints := m.readiness()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Ready     bool                `json:"ready"`
+		Endpoints []endpointReadiness `json:"endpoints"`
+	}{ready, endpoints})
+}
@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"plugin"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// defaultProcessorTimeout bounds a processor call when no timeout is
+// configured
+const defaultProcessorTimeout = time.Second
+
+// ProcessorMethod is the method the proxy calls on an external processor.
+// Its request and response are google.protobuf.Struct messages laid out like
+// ProcessorRequest and ProcessorResponse, with snake_case field names.
+const ProcessorMethod = "/grpcproxy.processor.v1.Processor/Process"
+
+// ProcessorConfig hands every call of an endpoint to a processor, an
+// external gRPC service or a Go plugin, which may reject it, rewrite its
+// method and metadata, or pick its upstream
+type ProcessorConfig struct {
+	// Address is the external processor serving ProcessorMethod
+	Address string `mapstructure:"address"`
+	UseTLS  bool   `mapstructure:"use_tls"`
+
+	// Plugin is a Go plugin exporting "var Processor proxy.Processor"
+	Plugin string `mapstructure:"plugin"`
+
+	// Methods are full method name prefixes the processor sees (default all)
+	Methods []string `mapstructure:"methods"`
+
+	// Timeout bounds each processor call (default 1s)
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// FailOpen forwards calls unchanged when the processor fails instead of
+	// rejecting them
+	FailOpen bool `mapstructure:"fail_open"`
+}
+
+// ProcessorRequest describes a call after the proxy authenticated it
+type ProcessorRequest struct {
+	Endpoint string
+
+	// Method is the full method name, e.g. /cosmos.bank.v1beta1.Query/Balance
+	Method string
+
+	// Client is the API key client's name, empty without clients
+	Client string
+
+	// Metadata is a copy of what the client sent, without binary keys
+	Metadata metadata.MD
+}
+
+// ProcessorResponse is what the proxy should do with a call. The zero value
+// forwards it unchanged.
+type ProcessorResponse struct {
+	// Deny rejects the call with this status
+	Deny *status.Status
+
+	// Method replaces the full method name called upstream
+	Method string
+
+	// SetMetadata and RemoveMetadata change the metadata sent upstream
+	SetMetadata    map[string]string
+	RemoveMetadata []string
+
+	// Upstream sends the call to the endpoint's remote_address or the
+	// remote_address of one of its routes
+	Upstream string
+}
+
+// Processor inspects and changes proxied calls. It is called once per call,
+// concurrently, and should be quick; the call waits for it.
+type Processor interface {
+	Process(ctx context.Context, req *ProcessorRequest) (*ProcessorResponse, error)
+}
+
+// callProcessor is an endpoint's processor with its settings
+type callProcessor struct {
+	processor Processor
+	methods   []string
+	timeout   time.Duration
+	failOpen  bool
+
+	// conn is the external processor's connection, if any
+	conn *grpc.ClientConn
+}
+
+// newCallProcessor sets up the processor of config, or fallback, given with
+// WithProcessor, when the endpoint configures none. It returns nil when
+// there is neither.
+func newCallProcessor(config *ProcessorConfig, fallback Processor, extra ...grpc.DialOption) (*callProcessor, error) {
+	if config == nil {
+		if fallback == nil {
+			return nil, nil
+		}
+		return &callProcessor{processor: fallback, timeout: defaultProcessorTimeout}, nil
+	}
+	if (config.Address == "") == (config.Plugin == "") {
+		return nil, fmt.Errorf("processor needs either address or plugin")
+	}
+	if config.Timeout < 0 {
+		return nil, fmt.Errorf("processor timeout must not be negative")
+	}
+	cp := &callProcessor{methods: config.Methods, timeout: config.Timeout, failOpen: config.FailOpen}
+	if cp.timeout == 0 {
+		cp.timeout = defaultProcessorTimeout
+	}
+	if config.Plugin != "" {
+		processor, err := loadProcessorPlugin(config.Plugin)
+		if err != nil {
+			return nil, err
+		}
+		cp.processor = processor
+		return cp, nil
+	}
+	conn, err := dialUpstream(config.Address, tlsOrInsecure(config.UseTLS), extra...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to processor: %v", err)
+	}
+	cp.conn = conn
+	cp.processor = NewRemoteProcessor(conn)
+	return cp, nil
+}
+
+// loadProcessorPlugin opens a Go plugin built with -buildmode=plugin
+// against the same proxy version and looks up its Processor variable
+func loadProcessorPlugin(path string) (Processor, error) {
+	plug, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open processor plugin: %v", err)
+	}
+	sym, err := plug.Lookup("Processor")
+	if err != nil {
+		return nil, fmt.Errorf("processor plugin %s has no Processor variable", path)
+	}
+	if processor, ok := sym.(*Processor); ok && *processor != nil {
+		return *processor, nil
+	}
+	return nil, fmt.Errorf("processor plugin %s: Processor is %T, not a proxy.Processor", path, sym)
+}
+
+// close closes the external processor's connection
+func (cp *callProcessor) close() {
+	if cp != nil && cp.conn != nil {
+		cp.conn.Close()
+	}
+}
+
+// matches reports whether the processor sees calls to fullMethodName
+func (cp *callProcessor) matches(fullMethodName string) bool {
+	return len(cp.methods) == 0 || matchesMethod(cp.methods, fullMethodName)
+}
+
+// upstreamMethodKey is the context key the director stores a method
+// rewritten by the processor under
+type upstreamMethodKey struct{}
+
+// upstreamMethod returns the method to call upstream for a call to
+// fullMethodName directed with ctx
+func upstreamMethod(ctx context.Context, fullMethodName string) string {
+	if method, ok := ctx.Value(upstreamMethodKey{}).(string); ok {
+		return method
+	}
+	return fullMethodName
+}
+
+// process hands a call to the processor and applies its changes to md. It
+// returns the method to call upstream and the connection the processor
+// picked, nil to leave it to the routes. Processor failures reject the call
+// unless the processor fails open.
+func (p *ProxyServer) process(ctx context.Context, fullMethodName string, md metadata.MD, client string) (string, *grpc.ClientConn, error) {
+	cp := p.processor
+	if !cp.matches(fullMethodName) {
+		return fullMethodName, nil, nil
+	}
+	p.metrics.Add("processor_calls", 1)
+
+	callCtx, cancel := context.WithTimeout(ctx, cp.timeout)
+	defer cancel()
+	resp, err := cp.processor.Process(callCtx, &ProcessorRequest{
+		Endpoint: p.config.Name,
+		Method:   fullMethodName,
+		Client:   client,
+		Metadata: processorMetadata(md),
+	})
+	var conn *grpc.ClientConn
+	if err == nil && resp != nil {
+		if resp.Deny != nil {
+			p.metrics.Add("processor_denied", 1)
+			if resp.Deny.Code() == codes.OK {
+				return "", nil, status.Error(codes.PermissionDenied, resp.Deny.Message())
+			}
+			return "", nil, resp.Deny.Err()
+		}
+		conn, err = p.checkProcessorResponse(resp)
+	}
+	if err != nil {
+		p.metrics.Add("processor_errors", 1)
+		if cp.failOpen {
+			p.logf(levelWarn, "Warning: endpoint %s: processor failed for %s, forwarding unchanged: %v", p.config.Name, fullMethodName, err)
+			return fullMethodName, nil, nil
+		}
+		p.logf(levelError, "Endpoint %s: processor failed for %s: %v", p.config.Name, fullMethodName, err)
+		return "", nil, status.Errorf(codes.Unavailable, "call processor failed")
+	}
+	if resp == nil {
+		return fullMethodName, nil, nil
+	}
+
+	for _, key := range resp.RemoveMetadata {
+		md.Delete(key)
+	}
+	for key, value := range resp.SetMetadata {
+		md.Set(key, value)
+	}
+	if resp.Method != "" {
+		fullMethodName = resp.Method
+	}
+	return fullMethodName, conn, nil
+}
+
+// checkProcessorResponse rejects changes the processor may not make and
+// returns the connection to the upstream it picked, if any
+func (p *ProxyServer) checkProcessorResponse(resp *ProcessorResponse) (*grpc.ClientConn, error) {
+	if resp.Method != "" {
+		service, method, ok := strings.Cut(strings.TrimPrefix(resp.Method, "/"), "/")
+		if !strings.HasPrefix(resp.Method, "/") || !ok || service == "" || method == "" {
+			return nil, fmt.Errorf("invalid method '%s'", resp.Method)
+		}
+	}
+	for key := range resp.SetMetadata {
+		if protectedHeader(strings.ToLower(key)) {
+			return nil, fmt.Errorf("cannot set %s", key)
+		}
+	}
+	for _, key := range resp.RemoveMetadata {
+		if protectedHeader(strings.ToLower(key)) {
+			return nil, fmt.Errorf("cannot remove %s", key)
+		}
+	}
+	if resp.Upstream == "" {
+		return nil, nil
+	}
+	if resp.Upstream == p.config.RemoteAddress {
+		return p.upstream, nil
+	}
+	for _, r := range p.routes {
+		if r.config.RemoteAddress == resp.Upstream {
+			return r.conn, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown upstream '%s'", resp.Upstream)
+}
+
+// processorMetadata copies the text metadata of a call for the processor
+func processorMetadata(md metadata.MD) metadata.MD {
+	out := make(metadata.MD, len(md))
+	for key, values := range md {
+		if !strings.HasSuffix(key, "-bin") {
+			out[key] = append([]string(nil), values...)
+		}
+	}
+	return out
+}
+
+// remoteProcessor calls an external processor over gRPC
+type remoteProcessor struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewRemoteProcessor returns a Processor calling ProcessorMethod on conn
+func NewRemoteProcessor(conn grpc.ClientConnInterface) Processor {
+	return &remoteProcessor{conn: conn}
+}
+
+func (r *remoteProcessor) Process(ctx context.Context, req *ProcessorRequest) (*ProcessorResponse, error) {
+	in, err := req.toStruct()
+	if err != nil {
+		return nil, err
+	}
+	out := new(structpb.Struct)
+	if err := r.conn.Invoke(ctx, ProcessorMethod, in, out); err != nil {
+		return nil, err
+	}
+	return processorResponseFromStruct(out)
+}
+
+// RegisterProcessorServer serves processor on server at ProcessorMethod, so
+// an external processor can be written against the Processor interface
+func RegisterProcessorServer(server grpc.ServiceRegistrar, processor Processor) {
+	server.RegisterService(&processorServiceDesc, processor)
+}
+
+var processorServiceDesc = grpc.ServiceDesc{
+	ServiceName: "grpcproxy.processor.v1.Processor",
+	HandlerType: (*Processor)(nil),
+	Methods:     []grpc.MethodDesc{{MethodName: "Process", Handler: processHandler}},
+	Metadata:    "processor",
+}
+
+// processHandler decodes a processor request, calls the registered
+// Processor and encodes its response
+func processHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(structpb.Struct)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handle := func(ctx context.Context, req interface{}) (interface{}, error) {
+		resp, err := srv.(Processor).Process(ctx, processorRequestFromStruct(req.(*structpb.Struct)))
+		if err != nil {
+			return nil, err
+		}
+		if resp == nil {
+			resp = &ProcessorResponse{}
+		}
+		return resp.toStruct()
+	}
+	if interceptor == nil {
+		return handle(ctx, in)
+	}
+	return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: ProcessorMethod}, handle)
+}
+
+// toStruct encodes the request for an external processor
+func (r *ProcessorRequest) toStruct() (*structpb.Struct, error) {
+	md := make(map[string]interface{}, len(r.Metadata))
+	for key, values := range r.Metadata {
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		md[key] = list
+	}
+	s, err := structpb.NewStruct(map[string]interface{}{
+		"endpoint": r.Endpoint,
+		"method":   r.Method,
+		"client":   r.Client,
+		"metadata": md,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode processor request: %v", err)
+	}
+	return s, nil
+}
+
+// processorRequestFromStruct decodes a request from the proxy
+func processorRequestFromStruct(s *structpb.Struct) *ProcessorRequest {
+	fields := s.GetFields()
+	req := &ProcessorRequest{
+		Endpoint: fields["endpoint"].GetStringValue(),
+		Method:   fields["method"].GetStringValue(),
+		Client:   fields["client"].GetStringValue(),
+		Metadata: metadata.MD{},
+	}
+	for key, values := range fields["metadata"].GetStructValue().GetFields() {
+		for _, v := range values.GetListValue().GetValues() {
+			req.Metadata.Append(key, v.GetStringValue())
+		}
+	}
+	return req
+}
+
+// toStruct encodes the response for the proxy
+func (r *ProcessorResponse) toStruct() (*structpb.Struct, error) {
+	fields := map[string]interface{}{}
+	if r.Deny != nil {
+		fields["deny"] = map[string]interface{}{
+			"code":    float64(r.Deny.Code()),
+			"message": r.Deny.Message(),
+		}
+	}
+	if r.Method != "" {
+		fields["method"] = r.Method
+	}
+	if len(r.SetMetadata) > 0 {
+		set := make(map[string]interface{}, len(r.SetMetadata))
+		for key, value := range r.SetMetadata {
+			set[key] = value
+		}
+		fields["set_metadata"] = set
+	}
+	if len(r.RemoveMetadata) > 0 {
+		remove := make([]interface{}, len(r.RemoveMetadata))
+		for i, key := range r.RemoveMetadata {
+			remove[i] = key
+		}
+		fields["remove_metadata"] = remove
+	}
+	if r.Upstream != "" {
+		fields["upstream"] = r.Upstream
+	}
+	s, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode processor response: %v", err)
+	}
+	return s, nil
+}
+
+// processorResponseFromStruct decodes a response from an external
+// processor, rejecting fields of the wrong type
+func processorResponseFromStruct(s *structpb.Struct) (*ProcessorResponse, error) {
+	resp := &ProcessorResponse{}
+	for name, v := range s.GetFields() {
+		var ok bool
+		switch name {
+		case "deny":
+			if _, ok = v.GetKind().(*structpb.Value_StructValue); ok {
+				fields := v.GetStructValue().GetFields()
+				resp.Deny = status.New(codes.Code(fields["code"].GetNumberValue()), fields["message"].GetStringValue())
+			}
+		case "method":
+			_, ok = v.GetKind().(*structpb.Value_StringValue)
+			resp.Method = v.GetStringValue()
+		case "upstream":
+			_, ok = v.GetKind().(*structpb.Value_StringValue)
+			resp.Upstream = v.GetStringValue()
+		case "set_metadata":
+			if _, ok = v.GetKind().(*structpb.Value_StructValue); ok {
+				resp.SetMetadata = make(map[string]string)
+				for key, value := range v.GetStructValue().GetFields() {
+					if _, isString := value.GetKind().(*structpb.Value_StringValue); !isString {
+						return nil, fmt.Errorf("processor set_metadata %s is not a string", key)
+					}
+					resp.SetMetadata[key] = value.GetStringValue()
+				}
+			}
+		case "remove_metadata":
+			if _, ok = v.GetKind().(*structpb.Value_ListValue); ok {
+				for _, key := range v.GetListValue().GetValues() {
+					resp.RemoveMetadata = append(resp.RemoveMetadata, key.GetStringValue())
+				}
+			}
+		default:
+			// Unknown fields are ignored, so processors can be newer than the proxy
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("processor response field %s has the wrong type", name)
+		}
+	}
+	return resp, nil
+}
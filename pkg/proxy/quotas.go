@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quotaResetHeader tells a client rejected by a hard quota when its quota resets
+const quotaResetHeader = "x-quota-reset"
+
+// Quota periods, which start at midnight UTC
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+)
+
+// QuotaConfig limits the calls or bytes a client may use per period, summed
+// over all endpoints
+type QuotaConfig struct {
+	// Period is "daily" or "monthly"
+	Period string `mapstructure:"period"`
+
+	// Calls and Bytes are the limits; 0 leaves that measure unlimited.
+	// Bytes counts what is received from and sent to the client.
+	Calls int64 `mapstructure:"calls"`
+	Bytes int64 `mapstructure:"bytes"`
+
+	// Hard rejects calls with RESOURCE_EXHAUSTED once the quota is used up;
+	// otherwise exceeding it only logs a warning
+	Hard bool `mapstructure:"hard"`
+}
+
+// validate checks the quota has a known period and a limit
+func (q QuotaConfig) validate() error {
+	switch q.Period {
+	case QuotaDaily, QuotaMonthly:
+	default:
+		return fmt.Errorf("unknown quota period '%s' (expected daily or monthly)", q.Period)
+	}
+	if q.Calls < 0 || q.Bytes < 0 {
+		return fmt.Errorf("quota limits must not be negative")
+	}
+	if q.Calls == 0 && q.Bytes == 0 {
+		return fmt.Errorf("%s quota sets neither calls nor bytes", q.Period)
+	}
+	return nil
+}
+
+// periodStart returns the start of the period containing t
+func periodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	if period == QuotaMonthly {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// periodEnd returns the end of the period starting at start
+func periodEnd(period string, start time.Time) time.Time {
+	if period == QuotaMonthly {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// exceeded describes the measure of q that used uses up, or returns ""
+func (q QuotaConfig) exceeded(used *quotaUsage) string {
+	if q.Calls > 0 && used.calls >= q.Calls {
+		return fmt.Sprintf("%s quota of %d calls", q.Period, q.Calls)
+	}
+	if q.Bytes > 0 && used.bytes >= q.Bytes {
+		return fmt.Sprintf("%s quota of %d bytes", q.Period, q.Bytes)
+	}
+	return ""
+}
+
+// quotaSyncInterval is how often quota counts are exchanged with Redis
+const quotaSyncInterval = time.Second
+
+// quotaUsage is what a client used in the period starting at start
+type quotaUsage struct {
+	start        time.Time
+	calls, bytes int64
+
+	// pending is what was counted here since the last sync with Redis, and
+	// shared the replicas' combined usage as of that sync, if synced
+	pending quotaCount
+	shared  quotaCount
+	synced  bool
+
+	// warned holds the soft quotas already reported this period
+	warned map[QuotaConfig]bool
+}
+
+// quotaCount is a number of calls and bytes
+type quotaCount struct {
+	calls, bytes int64
+}
+
+// quotaTracker counts client usage per period. One tracker is shared by a
+// Manager and its endpoints, so quotas span endpoints and survive reloads.
+// With Redis the counts are also shared by every replica: each replica
+// counts locally and syncs its counts with Redis every quotaSyncInterval,
+// so calls never wait for Redis. The local counts are used while Redis
+// cannot be reached.
+type quotaTracker struct {
+	mu    sync.Mutex
+	usage map[string]map[string]*quotaUsage
+
+	shared *redisClient
+}
+
+// current returns the client's usage in the period containing now; the
+// caller holds mu
+func (t *quotaTracker) current(client, period string, now time.Time) *quotaUsage {
+	if t.usage == nil {
+		t.usage = make(map[string]map[string]*quotaUsage)
+	}
+	periods, ok := t.usage[client]
+	if !ok {
+		periods = make(map[string]*quotaUsage)
+		t.usage[client] = periods
+	}
+	start := periodStart(period, now)
+	used, ok := periods[period]
+	if !ok || !used.start.Equal(start) {
+		used = &quotaUsage{start: start, warned: make(map[QuotaConfig]bool)}
+		periods[period] = used
+	}
+	return used
+}
+
+// total returns the usage quotas are enforced against: the replicas'
+// combined usage once synced with Redis, else the local counts. The caller
+// holds mu.
+func (t *quotaTracker) total(used *quotaUsage) quotaUsage {
+	total := quotaUsage{start: used.start, calls: used.calls, bytes: used.bytes}
+	if used.synced && t.shared.enabled() && !t.shared.failing.Load() {
+		total.calls = used.shared.calls + used.pending.calls
+		total.bytes = used.shared.bytes + used.pending.bytes
+	}
+	return total
+}
+
+// count adds calls and bytes to the client's usage in each of periods; the
+// caller holds mu
+func (t *quotaTracker) count(client string, periods []string, calls, bytes int64, now time.Time) {
+	for _, period := range periods {
+		used := t.current(client, period, now)
+		used.calls += calls
+		used.bytes += bytes
+		if t.shared.enabled() {
+			used.pending.calls += calls
+			used.pending.bytes += bytes
+		}
+	}
+}
+
+// sharedKeys returns the Redis keys of a client's calls and bytes in the
+// period starting at start
+func (t *quotaTracker) sharedKeys(client, period string, start time.Time) (string, string) {
+	prefix := t.shared.key(fmt.Sprintf("quota:%s:%s:%s:", client, period, start.Format("2006-01-02")))
+	return prefix + "calls", prefix + "bytes"
+}
+
+// quotaPeriods returns the periods of quotas, each once
+func quotaPeriods(quotas []QuotaConfig) []string {
+	var periods []string
+	for _, q := range quotas {
+		if !slices.Contains(periods, q.Period) {
+			periods = append(periods, q.Period)
+		}
+	}
+	return periods
+}
+
+// check reserves a call by client in each of its quota periods, or rejects
+// it once one of its hard quotas is used up, returning when that quota
+// resets. Checking and counting the call in one step keeps concurrent calls
+// from overshooting a hard quota; add counts its bytes once it finished. A
+// nil tracker allows everything.
+func (t *quotaTracker) check(client ClientConfig) (time.Time, error) {
+	if t == nil || len(client.Quotas) == 0 {
+		return time.Time{}, nil
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, q := range client.Quotas {
+		if !q.Hard {
+			continue
+		}
+		used := t.total(t.current(client.Name, q.Period, now))
+		if limit := q.exceeded(&used); limit != "" {
+			reset := periodEnd(q.Period, used.start)
+			return reset, status.Errorf(codes.ResourceExhausted, "client %s has used up its %s; it resets at %s", client.Name, limit, reset.Format(time.RFC3339))
+		}
+	}
+	t.count(client.Name, quotaPeriods(client.Quotas), 1, 0, now)
+	return time.Time{}, nil
+}
+
+// add counts the bytes of a call by client that check admitted and warns
+// once per period about each soft quota it exceeds
+func (t *quotaTracker) add(client ClientConfig, bytes int64) {
+	if t == nil || len(client.Quotas) == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count(client.Name, quotaPeriods(client.Quotas), 0, bytes, now)
+	for _, q := range client.Quotas {
+		if q.Hard {
+			continue
+		}
+		used := t.current(client.Name, q.Period, now)
+		total := t.total(used)
+		if limit := q.exceeded(&total); limit != "" && !used.warned[q] {
+			used.warned[q] = true
+			log.Printf("Warning: client %s has exceeded its soft %s", client.Name, limit)
+		}
+	}
+}
+
+// syncEvery syncs the counts with Redis every interval until done is
+// closed
+func (t *quotaTracker) syncEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			t.sync()
+		}
+	}
+}
+
+// sync adds the pending counts of every client to Redis in one round trip
+// and learns the replicas' combined usage from the replies. If Redis cannot
+// be reached, the counts stay pending for the next sync; a round trip that
+// timed out after Redis applied it is then counted twice, erring towards
+// enforcing quotas.
+func (t *quotaTracker) sync() {
+	if !t.shared.enabled() {
+		return
+	}
+	type syncing struct {
+		used *quotaUsage
+		sent quotaCount
+	}
+	var batch []syncing
+	var cmds [][]string
+	now := time.Now()
+	t.mu.Lock()
+	for client, periods := range t.usage {
+		for period, used := range periods {
+			sent := used.pending
+			if sent == (quotaCount{}) && !used.start.Equal(periodStart(period, now)) {
+				// Nothing is left to add to a period that ended
+				delete(periods, period)
+				continue
+			}
+			batch = append(batch, syncing{used: used, sent: sent})
+			used.pending = quotaCount{}
+			calls, bytes := t.sharedKeys(client, period, used.start)
+			expire := strconv.FormatInt(periodEnd(period, used.start).Add(24*time.Hour).Unix(), 10)
+			cmds = append(cmds,
+				[]string{"INCRBY", calls, strconv.FormatInt(sent.calls, 10)},
+				[]string{"INCRBY", bytes, strconv.FormatInt(sent.bytes, 10)},
+				[]string{"EXPIREAT", calls, expire},
+				[]string{"EXPIREAT", bytes, expire})
+		}
+	}
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	replies, err := t.shared.do(context.Background(), cmds...)
+	ok := t.shared.observe(err)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, b := range batch {
+		if !ok {
+			b.used.pending.calls += b.sent.calls
+			b.used.pending.bytes += b.sent.bytes
+			continue
+		}
+		b.used.shared = quotaCount{calls: redisInt(replies[4*i]), bytes: redisInt(replies[4*i+1])}
+		b.used.synced = true
+	}
+}
+
+// seed counts the usage recorded in the current periods, so quotas carry
+// over a restart. Records spanning a period start are counted in full.
+func (t *quotaTracker) seed(records []UsageRecord) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range records {
+		if r.Client == "" {
+			continue
+		}
+		for _, period := range []string{QuotaDaily, QuotaMonthly} {
+			used := t.current(r.Client, period, now)
+			if r.End.After(used.start) {
+				used.calls += r.Calls
+				used.bytes += r.BytesIn + r.BytesOut
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"runtime/debug"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recoveryInterceptor wraps everything but request ID handling: it turns
+// panics in the forwarding path into INTERNAL errors carrying an incident ID that is
+// logged with the stack, and sanitizes and translates every error returned
+// to clients
+func (p *ProxyServer) recoveryInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			id := incidentID()
+			p.logf(levelError, "Panic in proxy %s for %s (incident %s, request %s): %v\n%s", p.config.Name, info.FullMethod, id, requestIDFromContext(ss.Context()), r, debug.Stack())
+			p.metrics.Add("panics", 1)
+			err = status.Errorf(codes.Internal, "internal proxy error (incident %s)", id)
+		}
+	}()
+	return p.translateError(p.sanitizeError(handler(srv, ss)))
+}
+
+// incidentID returns a short random identifier to correlate a client error with the log
+func incidentID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+var (
+	bearerPattern = regexp.MustCompile(`(?i)bearer\s+\S+`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	ipv4Pattern   = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+)
+
+// minSecretLength avoids redacting ordinary words that happen to equal a short test token
+const minSecretLength = 8
+
+// sanitizeError removes tokens and internal addresses from an error's
+// message while keeping its code and details
+func (p *ProxyServer) sanitizeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return status.Error(codes.Unknown, p.sanitizeMessage(err.Error()))
+	}
+	msg := p.sanitizeMessage(st.Message())
+	if msg == st.Message() {
+		return err
+	}
+	pb := st.Proto()
+	pb.Message = msg
+	return status.FromProto(pb).Err()
+}
+
+// sanitizeMessage redacts secrets and upstream addresses from msg
+func (p *ProxyServer) sanitizeMessage(msg string) string {
+	msg = bearerPattern.ReplaceAllString(msg, "Bearer [redacted]")
+	msg = jwtPattern.ReplaceAllString(msg, "[redacted]")
+	for _, secret := range []string{p.Token(), p.config.JWTToken} {
+		if len(secret) >= minSecretLength {
+			msg = strings.ReplaceAll(msg, secret, "[redacted]")
+		}
+	}
+	for _, addr := range p.upstreamAddresses() {
+		msg = strings.ReplaceAll(msg, addr, "upstream")
+	}
+	return ipv4Pattern.ReplaceAllString(msg, "[address]")
+}
+
+// upstreamAddresses lists the configured upstream addresses, each host:port
+// followed by its bare host so the full address is replaced first
+func (p *ProxyServer) upstreamAddresses() []string {
+	var addrs []string
+	add := func(addr string) {
+		if addr == "" {
+			return
+		}
+		addrs = append(addrs, addr)
+		if i := strings.LastIndex(addr, ":"); i > 0 && !strings.Contains(addr, "://") {
+			addrs = append(addrs, addr[:i])
+		}
+	}
+	add(p.config.RemoteAddress)
+	if p.config.Compare != nil {
+		add(p.config.Compare.RemoteAddress)
+	}
+	if p.config.Hedge != nil {
+		add(p.config.Hedge.RemoteAddress)
+	}
+	for _, r := range p.config.Routes {
+		add(r.RemoteAddress)
+	}
+	for _, f := range p.config.Fallbacks {
+		add(f.RemoteAddress)
+	}
+	return addrs
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// knownSecrets collects every token and API key the proxy has seen, so log
+// output can be scrubbed of them wherever they end up, e.g. in an upstream
+// error string. Secrets are never removed: a rotated token stays redacted.
+var knownSecrets secretRegistry
+
+type secretRegistry struct {
+	mu       sync.Mutex
+	values   map[string]bool
+	replacer atomic.Pointer[strings.Replacer]
+}
+
+// add registers secrets; values shorter than minSecretLength are ignored
+func (r *secretRegistry) add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values == nil {
+		r.values = make(map[string]bool)
+	}
+	changed := false
+	for _, s := range secrets {
+		if len(s) >= minSecretLength && !r.values[s] {
+			r.values[s] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// Longer secrets first so one that contains another is replaced whole
+	sorted := make([]string, 0, len(r.values))
+	for s := range r.values {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, s := range sorted {
+		pairs = append(pairs, s, redactedValue(s))
+	}
+	r.replacer.Store(strings.NewReplacer(pairs...))
+}
+
+// registerConfigSecrets adds the tokens and keys in config to knownSecrets
+func registerConfigSecrets(config *ProxyConfig) {
+	var secrets []string
+	for _, e := range config.Endpoints {
+		secrets = append(secrets, e.JWTToken)
+		if e.MintJWT != nil {
+			secrets = append(secrets, e.MintJWT.Secret)
+		}
+		if e.OIDC != nil {
+			secrets = append(secrets, e.OIDC.ClientSecret)
+		}
+		if e.ClientJWT != nil {
+			for _, t := range e.ClientJWT.Tokens {
+				secrets = append(secrets, t.JWTToken)
+			}
+		}
+		if e.TokenRefresh != nil {
+			secrets = append(secrets, e.TokenRefresh.RefreshToken, e.TokenRefresh.ClientSecret)
+		}
+		if e.Auth != nil {
+			secrets = append(secrets, e.Auth.Password)
+			if e.Auth.HMAC != nil {
+				secrets = append(secrets, e.Auth.HMAC.Secret)
+			}
+		}
+		if e.Compare != nil {
+			secrets = append(secrets, e.Compare.JWTToken)
+		}
+		if e.Hedge != nil {
+			secrets = append(secrets, e.Hedge.JWTToken)
+		}
+		for _, f := range e.Fallbacks {
+			secrets = append(secrets, f.JWTToken)
+		}
+	}
+	for _, c := range config.Clients {
+		secrets = append(secrets, c.APIKey, c.JWTToken)
+		for _, token := range c.Tokens {
+			secrets = append(secrets, token)
+		}
+	}
+	if config.Secrets.Vault != nil {
+		secrets = append(secrets, config.Secrets.Vault.Token)
+	}
+	if config.Redis != nil {
+		secrets = append(secrets, config.Redis.Password)
+	}
+	knownSecrets.add(secrets...)
+}
+
+var (
+	// bearerValuePattern matches bearer credentials up to the end of a printed metadata value
+	bearerValuePattern = regexp.MustCompile(`(?i)bearer\s+[^\s"'\],]+`)
+
+	// headerSecretPattern matches authorization and API key metadata as
+	// printed by fmt (authorization:[...]), JSON ("authorization":"...") or
+	// HTTP headers, skipping an auth scheme such as Basic
+	headerSecretPattern = regexp.MustCompile(`(?i)((?:authorization|x-api-key|x-vault-token)["']?\s*[:=]\s*\[?["']?(?:(?:basic|bearer|token)\s+)?)([^\s"'\],]+)`)
+)
+
+// redactSecrets replaces known secrets, bearer credentials, JWTs and
+// authorization metadata values in s with their fingerprints
+func redactSecrets(s string) string {
+	if r := knownSecrets.replacer.Load(); r != nil {
+		s = r.Replace(s)
+	}
+	s = bearerValuePattern.ReplaceAllStringFunc(s, func(m string) string {
+		fields := strings.Fields(m)
+		if strings.HasPrefix(fields[1], redactedPrefix) {
+			return m
+		}
+		return fields[0] + " " + redactedValue(fields[1])
+	})
+	s = jwtPattern.ReplaceAllStringFunc(s, redactedValue)
+	return headerSecretPattern.ReplaceAllStringFunc(s, func(m string) string {
+		parts := headerSecretPattern.FindStringSubmatch(m)
+		value := parts[2]
+		if strings.HasPrefix(value, redactedPrefix) {
+			return m
+		}
+		return parts[1] + redactedValue(value)
+	})
+}
+
+// redactedPrefix starts every redacted value
+const redactedPrefix = "[redacted"
+
+// redactedValue identifies a secret by its first six characters and a hash.
+// Short secrets show only the hash so most of the value is not revealed.
+func redactedValue(secret string) string {
+	if len(secret) < 24 {
+		return redactedPrefix + " " + fingerprint(secret) + "]"
+	}
+	return redactedPrefix + " " + secret[:6] + "… " + fingerprint(secret) + "]"
+}
+
+// NewRedactingWriter returns a writer that scrubs configured tokens, API keys,
+// bearer credentials and JWTs from everything written to w. Pass it to
+// log.SetOutput so no logging path can leak a secret.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return redactingWriter{w}
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultRedisTimeout bounds a round trip to Redis
+	defaultRedisTimeout = 500 * time.Millisecond
+
+	// defaultRedisKeyPrefix namespaces the proxy's keys
+	defaultRedisKeyPrefix = "grpc-proxy:"
+
+	// redisIdleConns is how many connections are kept open between commands
+	redisIdleConns = 8
+)
+
+// RedisConfig points the proxy at a Redis server holding the lane rate
+// limit and client quota counters, so replicas enforce limits together
+type RedisConfig struct {
+	// Address is the host:port of the server
+	Address  string `mapstructure:"address"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
+	UseTLS   bool   `mapstructure:"use_tls"`
+
+	// KeyPrefix is prepended to every key (default "grpc-proxy:")
+	KeyPrefix string `mapstructure:"key_prefix"`
+
+	// Timeout bounds each round trip (default 500ms). Limits fall back to
+	// each replica's own counters while Redis cannot be reached.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// timeout returns the configured timeout or the default
+func (c *RedisConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultRedisTimeout
+}
+
+// keyPrefix returns the configured key prefix or the default
+func (c *RedisConfig) keyPrefix() string {
+	if c.KeyPrefix != "" {
+		return c.KeyPrefix
+	}
+	return defaultRedisKeyPrefix
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisClient sends commands to the configured Redis server over a small
+// pool of connections. One client is shared by a Manager and its endpoints;
+// until it is configured, and on a nil *redisClient, it is disabled.
+type redisClient struct {
+	config atomic.Pointer[RedisConfig]
+
+	// mu guards idle, which configure replaces
+	mu   sync.Mutex
+	idle chan *redisConn
+
+	// failing is set while Redis cannot be reached, so the outage is
+	// logged once rather than for every call
+	failing atomic.Bool
+}
+
+// redisConn is a connection with its reply reader
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// configure connects to the server and checks it answers PING. A nil config
+// disables the client.
+func (c *redisClient) configure(config *RedisConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.Address == "" {
+		return fmt.Errorf("redis requires an address")
+	}
+	c.mu.Lock()
+	c.closeIdle()
+	c.idle = make(chan *redisConn, redisIdleConns)
+	c.config.Store(config)
+	c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout())
+	defer cancel()
+	if _, err := c.do(ctx, []string{"PING"}); err != nil {
+		c.config.Store(nil)
+		return fmt.Errorf("failed to reach redis at %s: %v", config.Address, err)
+	}
+	return nil
+}
+
+// enabled reports whether a server is configured
+func (c *redisClient) enabled() bool {
+	return c != nil && c.config.Load() != nil
+}
+
+// key returns name under the configured prefix
+func (c *redisClient) key(name string) string {
+	return c.config.Load().keyPrefix() + name
+}
+
+// dial opens a connection, authenticating and selecting the database
+func (c *redisClient) dial(ctx context.Context, config *RedisConfig) (*redisConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{}
+	if config.UseTLS {
+		host, _, _ := net.SplitHostPort(config.Address)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}).DialContext(ctx, "tcp", config.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", config.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if config.Password != "" {
+		if config.Username != "" {
+			setup = append(setup, []string{"AUTH", config.Username, config.Password})
+		} else {
+			setup = append(setup, []string{"AUTH", config.Password})
+		}
+	}
+	if config.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(config.DB)})
+	}
+	if len(setup) > 0 {
+		if _, err := rc.roundTrip(ctx, setup); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do sends cmds in one pipeline and returns their replies in order. An
+// error reply to any command is returned as the error.
+func (c *redisClient) do(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	config := c.config.Load()
+	if config == nil {
+		return nil, fmt.Errorf("redis is not configured")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.timeout())
+		defer cancel()
+	}
+
+	conn, idle := c.get()
+	if conn == nil {
+		var err error
+		if conn, err = c.dial(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := conn.roundTrip(ctx, cmds)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn, idle)
+	return replies, err
+}
+
+// get takes an idle connection, or returns nil if there is none, along with
+// the pool it belongs to
+func (c *redisClient) get() (*redisConn, chan *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case conn := <-c.idle:
+		return conn, c.idle
+	default:
+		return nil, c.idle
+	}
+}
+
+// put returns conn to the pool it was taken for. It is closed instead if
+// the pool is full or was replaced meanwhile, since it may point at the
+// previous server.
+func (c *redisClient) put(conn *redisConn, idle chan *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if idle != c.idle {
+		conn.Close()
+		return
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// closeIdle closes the pooled connections. Callers must hold c.mu.
+func (c *redisClient) closeIdle() {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// roundTrip writes cmds and reads one reply per command
+func (rc *redisConn) roundTrip(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		rc.SetDeadline(deadline)
+	}
+	var b strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(rc, b.String()); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		reply, err := readRedisReply(rc.r)
+		if _, isReply := err.(redisError); err != nil && !isReply {
+			return nil, err
+		} else if err != nil && replyErr == nil {
+			replyErr = err
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// readRedisReply reads one RESP2 reply: a string, an int64, nil, or a
+// []interface{} of those
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+// redisInt converts an integer or bulk string reply, treating nil as 0
+func redisInt(reply interface{}) int64 {
+	switch v := reply.(type) {
+	case int64:
+		return v
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// observe logs when Redis becomes unreachable or reachable again, and
+// reports whether err is nil
+func (c *redisClient) observe(err error) bool {
+	config := c.config.Load()
+	if config == nil {
+		return false
+	}
+	if err != nil {
+		if !c.failing.Swap(true) {
+			log.Printf("Warning: redis %s unavailable, enforcing limits per replica: %v", config.Address, err)
+		}
+		return false
+	}
+	if c.failing.Swap(false) {
+		log.Printf("Redis %s is reachable again", config.Address)
+	}
+	return true
+}
+
+// Close closes the idle connections
+func (c *redisClient) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config.Store(nil)
+	c.closeIdle()
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultReflectionCacheTTL is how long a cached reflection response is
+// served before the upstream is asked again
+const defaultReflectionCacheTTL = time.Hour
+
+// reflectionServices are answered by the proxy itself. v1alpha shares v1's
+// wire format, so both are decoded with the v1 types.
+var reflectionServices = []string{
+	"grpc.reflection.v1.ServerReflection",
+	"grpc.reflection.v1alpha.ServerReflection",
+}
+
+// ReflectionCacheConfig makes the proxy answer server reflection itself,
+// fetching each distinct request from the upstream once per TTL
+type ReflectionCacheConfig struct {
+	// TTL is how long responses are reused (default 1h). Expired responses
+	// are still served while the upstream cannot be reached.
+	TTL time.Duration `mapstructure:"ttl"`
+}
+
+// ttl returns the configured TTL or the default
+func (c *ReflectionCacheConfig) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return defaultReflectionCacheTTL
+}
+
+// reflectionEntry is a cached upstream reflection response
+type reflectionEntry struct {
+	response *rpb.ServerReflectionResponse
+	fetched  time.Time
+}
+
+// reflectionCache holds upstream reflection responses keyed by request
+type reflectionCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]reflectionEntry
+}
+
+func newReflectionCache(config *ReflectionCacheConfig) *reflectionCache {
+	return &reflectionCache{ttl: config.ttl(), entries: make(map[string]reflectionEntry)}
+}
+
+// get returns the cached response for key and whether it is still fresh. A
+// nil cache holds nothing.
+func (c *reflectionCache) get(key string) (*rpb.ServerReflectionResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return e.response, time.Since(e.fetched) < c.ttl
+}
+
+func (c *reflectionCache) put(key string, response *rpb.ServerReflectionResponse) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = reflectionEntry{response: response, fetched: time.Now()}
+}
+
+// reflectionKey identifies what a request asks for, ignoring its host
+func reflectionKey(req *rpb.ServerReflectionRequest) string {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(&rpb.ServerReflectionRequest{MessageRequest: req.MessageRequest})
+	return string(b)
+}
+
+// otherReflectionMethod returns the ServerReflectionInfo method of the
+// other reflection version
+func otherReflectionMethod(fullMethodName string) string {
+	for i, service := range reflectionServices {
+		if fullMethodName == "/"+service+"/ServerReflectionInfo" {
+			return "/" + reflectionServices[1-i] + "/ServerReflectionInfo"
+		}
+	}
+	return fullMethodName
+}
+
+// registerReflection serves both reflection versions on the endpoint's gRPC
+// server instead of proxying them, so they can be translated and cached
+func (p *ProxyServer) registerReflection() {
+	for _, service := range reflectionServices {
+		p.server.RegisterService(&grpc.ServiceDesc{
+			ServiceName: service,
+			HandlerType: (*interface{})(nil),
+			Streams: []grpc.StreamDesc{{
+				StreamName:    "ServerReflectionInfo",
+				Handler:       p.reflectionHandler("/" + service + "/ServerReflectionInfo"),
+				ServerStreams: true,
+				ClientStreams: true,
+			}},
+		}, nil)
+	}
+}
+
+// reflectionHandler answers a reflection stream from the descriptor_set or
+// the cache, if enabled, and otherwise from an upstream reflection stream
+// opened on the first request. The upstream is asked in whichever reflection version it
+// supports, regardless of the version the client speaks.
+func (p *ProxyServer) reflectionHandler(fullMethodName string) grpc.StreamHandler {
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	return func(_ interface{}, ss grpc.ServerStream) error {
+		// The director authenticates the caller even when nothing is fetched
+		ctx, conn, err := p.director(ss.Context(), fullMethodName)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		method := fullMethodName
+		if m := p.reflectionMethod.Load(); m != nil {
+			method = *m
+		}
+		var upstream grpc.ClientStream
+		headerSent := false
+		roundTrip := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+			if upstream == nil {
+				s, err := conn.NewStream(ctx, desc, method)
+				if err != nil {
+					return nil, err
+				}
+				upstream = s
+			}
+			resp := &rpb.ServerReflectionResponse{}
+			err := upstream.SendMsg(req)
+			if err == nil {
+				err = upstream.RecvMsg(resp)
+			}
+			if err != nil {
+				// Reopen the stream on the next request
+				upstream = nil
+				return nil, err
+			}
+			// Pass on the upstream's response headers (e.g. the block height)
+			// unless a cached response already went out without them
+			if !headerSent {
+				if md, err := upstream.Header(); err == nil {
+					ss.SendHeader(md)
+				}
+				headerSent = true
+			}
+			return resp, nil
+		}
+		fetch := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+			resp, err := roundTrip(req)
+			if status.Code(err) == codes.Unimplemented {
+				method = otherReflectionMethod(method)
+				resp, err = roundTrip(req)
+			}
+			if err == nil {
+				if known := p.reflectionMethod.Load(); known == nil || *known != method {
+					if method != fullMethodName {
+						p.logf(levelInfo, "Endpoint %s: upstream only serves %s, translating reflection calls", p.config.Name, strings.Split(method, "/")[1])
+					}
+					known := method
+					p.reflectionMethod.Store(&known)
+				}
+			}
+			return resp, err
+		}
+
+		for {
+			req := &rpb.ServerReflectionRequest{}
+			if err := ss.RecvMsg(req); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if p.descriptorSet != nil {
+				resp := p.descriptorSet.describe(req)
+				if p.config.hasMethodRules() {
+					resp = p.config.filterReflection(req, resp)
+				}
+				if err := ss.SendMsg(resp); err != nil {
+					return err
+				}
+				headerSent = true
+				continue
+			}
+
+			key := reflectionKey(req)
+			cached, fresh := p.reflection.get(key)
+			resp := cached
+			if fresh {
+				p.metrics.Add("reflection_cache_hits", 1)
+			} else {
+				if p.reflection != nil {
+					p.metrics.Add("reflection_cache_misses", 1)
+				}
+				fetched, err := fetch(req)
+				switch {
+				case err == nil:
+					resp, cached = fetched, nil
+					if fetched.GetErrorResponse() == nil {
+						p.reflection.put(key, fetched)
+					}
+				case cached != nil:
+					p.logf(levelWarn, "Warning: endpoint %s: serving cached reflection response, upstream failed: %v", p.config.Name, err)
+				default:
+					return err
+				}
+			}
+
+			if cached != nil {
+				resp = proto.Clone(cached).(*rpb.ServerReflectionResponse)
+				resp.ValidHost = req.Host
+				resp.OriginalRequest = req
+			}
+			if p.config.hasMethodRules() {
+				resp = p.config.filterReflection(req, resp)
+			}
+			if err := ss.SendMsg(resp); err != nil {
+				return err
+			}
+			headerSent = true
+		}
+	}
+}
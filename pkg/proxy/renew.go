@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TokenRefreshConfig renews the endpoint's token with an OAuth refresh
+// token before it expires
+type TokenRefreshConfig struct {
+	// TokenURL is the OAuth token endpoint of the token's issuer
+	TokenURL string `mapstructure:"token_url"`
+
+	// RefreshToken, or RefreshTokenRef to read it from a secrets backend.
+	// Refresh tokens rotated by the issuer are stored back to keyring: and
+	// file: references and otherwise kept in memory, across reloads.
+	RefreshToken    string `mapstructure:"refresh_token"`
+	RefreshTokenRef string `mapstructure:"refresh_token_ref"`
+
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+}
+
+// validate checks the token endpoint and the refresh token source
+func (c *TokenRefreshConfig) validate() error {
+	if u, err := url.Parse(c.TokenURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("token_refresh needs an http(s) token_url")
+	}
+	if (c.RefreshToken == "") == (c.RefreshTokenRef == "") {
+		return fmt.Errorf("token_refresh needs exactly one of refresh_token and refresh_token_ref")
+	}
+	if c.RefreshTokenRef != "" {
+		if _, _, err := parseSecretRef(c.RefreshTokenRef); err != nil {
+			return fmt.Errorf("token_refresh: %v", err)
+		}
+	}
+	return nil
+}
+
+// tokenRenewer obtains access tokens for oidc and token_refresh with a
+// refresh token
+type tokenRenewer struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+
+	// source names the issuer in the audit log
+	source string
+
+	// ref is where the refresh token is kept, empty for one in the config
+	ref     string
+	secrets *secretStore
+
+	// state holds the refresh token in use, shared with the renewers that
+	// replace this one when the endpoint is reloaded or restarted
+	state *renewalState
+}
+
+// renewalState is what a renewer learned from the issuer that the
+// configuration does not hold. Renewals hold mu, so an endpoint's old and
+// new server never present the same rotating refresh token twice.
+type renewalState struct {
+	mu sync.Mutex
+
+	// origin is the token URL and configured refresh token or reference the
+	// state started from; configuring another one starts over
+	origin string
+
+	// stored is the refresh token last read from ref and refreshToken the
+	// one to use, which differ when a rotated token could not be stored
+	stored       string
+	refreshToken string
+
+	// access is the last access token obtained and expires when it expires
+	access  string
+	expires time.Time
+}
+
+// renewalStore keeps the renewal state of a Manager's endpoints across
+// reloads and restarts, so a refresh token rotated in memory is not lost
+type renewalStore struct {
+	mu     sync.Mutex
+	states map[string]*renewalState
+}
+
+// state returns the renewal state of endpoint, or a new one if it has none
+// or started from another origin. A nil store keeps no state.
+func (s *renewalStore) state(endpoint, origin, refreshToken string) *renewalState {
+	fresh := &renewalState{origin: origin, refreshToken: refreshToken}
+	if s == nil {
+		return fresh
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.states[endpoint]; ok && state.origin == origin {
+		return state
+	}
+	if s.states == nil {
+		s.states = make(map[string]*renewalState)
+	}
+	s.states[endpoint] = fresh
+	return fresh
+}
+
+// prune forgets the endpoints config no longer has
+func (s *renewalStore) prune(config *ProxyConfig) {
+	wanted := make(map[string]bool, len(config.Endpoints))
+	for _, e := range config.Endpoints {
+		wanted[e.Name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.states {
+		if !wanted[name] {
+			delete(s.states, name)
+		}
+	}
+}
+
+// newTokenRenewer returns the renewer of an endpoint with oidc or
+// token_refresh, or nil if it has neither
+func newTokenRenewer(ctx context.Context, endpoint Config, secrets *secretStore, renewals *renewalStore) (*tokenRenewer, error) {
+	switch {
+	case endpoint.OIDC != nil:
+		config := endpoint.OIDC
+		if err := config.validate(endpoint.Name); err != nil {
+			return nil, err
+		}
+		provider, err := discoverOIDC(ctx, config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		ref := config.refreshTokenRef(endpoint.Name)
+		return &tokenRenewer{
+			tokenURL:     provider.TokenEndpoint,
+			clientID:     config.ClientID,
+			clientSecret: config.ClientSecret,
+			source:       "oidc:" + config.Issuer,
+			ref:          ref,
+			secrets:      secrets,
+			state:        renewals.state(endpoint.Name, provider.TokenEndpoint+" "+ref, ""),
+		}, nil
+	case endpoint.TokenRefresh != nil:
+		config := endpoint.TokenRefresh
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+		knownSecrets.add(config.RefreshToken)
+		return &tokenRenewer{
+			tokenURL:     config.TokenURL,
+			clientID:     config.ClientID,
+			clientSecret: config.ClientSecret,
+			source:       "token_refresh:" + redactURL(config.TokenURL),
+			ref:          config.RefreshTokenRef,
+			secrets:      secrets,
+			state:        renewals.state(endpoint.Name, config.TokenURL+" "+config.RefreshTokenRef+config.RefreshToken, config.RefreshToken),
+		}, nil
+	}
+	return nil, nil
+}
+
+// initial returns the token to start with: the one the endpoint's previous
+// server obtained or token while it is still valid for a while, else a
+// renewed one
+func (r *tokenRenewer) initial(ctx context.Context, token string) (secret, error) {
+	r.state.mu.Lock()
+	access, left := r.state.access, time.Until(r.state.expires)
+	r.state.mu.Unlock()
+	if access != "" && left > time.Minute {
+		return secret{value: access, ttl: left}, nil
+	}
+	if claims, err := DecodeToken(token); err == nil && !claims.ExpiresAt.IsZero() {
+		if left := time.Until(claims.ExpiresAt); left > time.Minute {
+			return secret{value: token, ttl: left}, nil
+		}
+	}
+	return r.renew(ctx)
+}
+
+// renew exchanges the refresh token for a new access token
+func (r *tokenRenewer) renew(ctx context.Context) (secret, error) {
+	state := r.state
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if r.ref != "" {
+		// A new login or an external rotation replaces the token in use
+		stored, err := r.secrets.fetch(ctx, r.ref)
+		switch {
+		case err == nil && stored.value != state.stored:
+			state.stored, state.refreshToken = stored.value, stored.value
+		case err != nil && state.refreshToken == "":
+			return secret{}, fmt.Errorf("no refresh token found: %v", err)
+		}
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {state.refreshToken},
+	}
+	if r.clientID != "" {
+		form.Set("client_id", r.clientID)
+	}
+	if r.clientSecret != "" {
+		form.Set("client_secret", r.clientSecret)
+	}
+	var tokens oidcTokens
+	if err := postOAuth(ctx, r.tokenURL, form, &tokens); err != nil {
+		return secret{}, fmt.Errorf("failed to renew token: %v", err)
+	}
+	if tokens.AccessToken == "" {
+		return secret{}, fmt.Errorf("token response has no access_token")
+	}
+	if tokens.RefreshToken != "" && tokens.RefreshToken != state.refreshToken {
+		state.refreshToken = tokens.RefreshToken
+		knownSecrets.add(tokens.RefreshToken)
+		if r.ref != "" {
+			if err := storeRefreshToken(r.ref, tokens.RefreshToken); err != nil {
+				log.Printf("Warning: keeping the rotated refresh token in memory only: %v", err)
+			} else {
+				state.stored = tokens.RefreshToken
+			}
+		}
+	}
+	lifetime := tokens.lifetime()
+	state.access, state.expires = tokens.AccessToken, time.Now().Add(lifetime)
+	return secret{value: tokens.AccessToken, ttl: lifetime}, nil
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// requestIDHeader carries the ID that ties a call's log lines on the proxy
+// to the client's and the upstream's
+const requestIDHeader = "x-request-id"
+
+// maxRequestIDLength bounds client-supplied IDs, which end up in log lines
+const maxRequestIDLength = 128
+
+// requestIDKey carries the request ID of a call in its context
+type requestIDKey struct{}
+
+// requestIDFromContext returns the request ID stored by requestIDInterceptor
+// or httpHandler, or "" outside a proxied call
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random version 4 UUID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	var id [36]byte
+	hex.Encode(id[0:8], b[0:4])
+	id[8] = '-'
+	hex.Encode(id[9:13], b[4:6])
+	id[13] = '-'
+	hex.Encode(id[14:18], b[6:8])
+	id[18] = '-'
+	hex.Encode(id[19:23], b[8:10])
+	id[23] = '-'
+	hex.Encode(id[24:], b[10:])
+	return string(id[:])
+}
+
+// validRequestID reports whether a client-supplied ID is safe to log and
+// forward: non-empty, bounded and printable ASCII without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the client's ID if it is usable, or a new one
+func requestID(supplied string) string {
+	if validRequestID(supplied) {
+		return supplied
+	}
+	return newRequestID()
+}
+
+// requestIDInterceptor is the outermost interceptor: it keeps the client's
+// x-request-id or generates one, so the director forwards it upstream, and
+// returns it to the client in the response header
+func (p *ProxyServer) requestIDInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := ss.Context()
+	supplied := metadata.ValueFromIncomingContext(ctx, requestIDHeader)
+	var first string
+	if len(supplied) > 0 {
+		first = supplied[0]
+	}
+	id := requestID(first)
+	if len(supplied) != 1 || id != first {
+		// FromIncomingContext returns a copy, so it can be changed in place
+		md, _ := metadata.FromIncomingContext(ctx)
+		if md == nil {
+			md = metadata.MD{}
+		}
+		md.Set(requestIDHeader, id)
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+	ss.SetHeader(metadata.Pairs(requestIDHeader, id))
+	return handler(srv, &requestIDStream{ServerStream: ss, ctx: ctx})
+}
+
+// requestIDStream gives the rest of the chain the context carrying the
+// request ID
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
+
+// SendHeader drops an ID the upstream echoed, which the proxy already set
+func (s *requestIDStream) SendHeader(md metadata.MD) error {
+	if len(md.Get(requestIDHeader)) > 0 {
+		md = md.Copy()
+		md.Delete(requestIDHeader)
+	}
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *requestIDStream) SetHeader(md metadata.MD) error {
+	if len(md.Get(requestIDHeader)) > 0 {
+		md = md.Copy()
+		md.Delete(requestIDHeader)
+	}
+	return s.ServerStream.SetHeader(md)
+}
+
+// httpRequestID keeps the X-Request-Id of an HTTP request or generates one,
+// sets it on the request so the reverse proxy forwards it, and returns it
+// to the client
+func httpRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := requestID(r.Header.Get(requestIDHeader))
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
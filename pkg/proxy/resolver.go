@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/dns"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// DNSConfig tunes gRPC's DNS resolver for all upstreams. gRPC only allows
+// these to be set once per process, so changes need a restart.
+type DNSConfig struct {
+	// MinResolutionInterval is the minimum time between re-resolutions of an
+	// upstream name (gRPC default 30s). Lower it when gateway IPs rotate often.
+	MinResolutionInterval time.Duration `mapstructure:"min_resolution_interval"`
+
+	// ResolvingTimeout bounds a single DNS lookup (gRPC default 30s)
+	ResolvingTimeout time.Duration `mapstructure:"resolving_timeout"`
+}
+
+var applyDNSOnce sync.Once
+
+// apply sets the process-wide DNS resolver options. Only the first call has
+// any effect, and it must happen before any upstream is dialed.
+func (c DNSConfig) apply() {
+	if c == (DNSConfig{}) {
+		return
+	}
+	applyDNSOnce.Do(func() {
+		if c.MinResolutionInterval > 0 {
+			dns.SetMinResolutionInterval(c.MinResolutionInterval)
+		}
+		if c.ResolvingTimeout > 0 {
+			dns.SetResolvingTimeout(c.ResolvingTimeout)
+		}
+		log.Printf("DNS resolver: min resolution interval %s, resolving timeout %s",
+			orDefault(c.MinResolutionInterval), orDefault(c.ResolvingTimeout))
+	})
+}
+
+func orDefault(d time.Duration) string {
+	if d <= 0 {
+		return "default"
+	}
+	return d.String()
+}
+
+// staticScheme is the resolver scheme for endpoints with resolve_to
+const staticScheme = "static"
+
+// staticResolver returns the target and dial option that connect to a fixed
+// list of addresses instead of resolving remoteAddress. remoteAddress stays
+// the target's authority, so TLS still verifies the upstream's hostname.
+func staticResolver(remoteAddress string, addresses []string) (string, grpc.DialOption, error) {
+	state := resolver.State{}
+	for _, addr := range addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", nil, fmt.Errorf("invalid resolve_to address %q: %v", addr, err)
+		}
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	r := manual.NewBuilderWithScheme(staticScheme)
+	r.InitialState(state)
+	return staticScheme + ":///" + remoteAddress, grpc.WithResolvers(r), nil
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// RESTConfig configures the companion HTTP listener that forwards Cosmos
+// LCD/REST calls to the provider's REST host with the endpoint's JWT injected
+type RESTConfig struct {
+	// BindAddress defaults to the endpoint's bind_address
+	BindAddress   string `mapstructure:"bind_address"`
+	LocalPort     int    `mapstructure:"local_port"`
+	RemoteAddress string `mapstructure:"remote_address"`
+}
+
+// newRESTServer builds the HTTP reverse proxy for an endpoint's REST companion.
+// Requests go through httpHandler, so client API keys, quotas and maintenance
+// mode apply as they do to the endpoint's gRPC calls.
+func (p *ProxyServer) newRESTServer() (*http.Server, error) {
+	config := p.config
+	target, err := url.Parse(config.REST.RemoteAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rest remote_address: %v", err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("rest remote_address must be an http:// or https:// URL, got %q", config.REST.RemoteAddress)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if target.Scheme == "https" {
+		transport.TLSClientConfig = upstreamTLSConfig(config, p.roots)
+	}
+	rp := &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			client, ok := clientFromContext(r.In.Context())
+			// The local API key must never reach the provider
+			r.Out.Header.Del(apiKeyHeader)
+			p.auth.setHeader(r.Out.Header, r.Out.URL.Path, p.upstreamToken(r.In.Context(), client, ok))
+		},
+		// httpHandler already returns the request ID, so drop one the upstream echoed
+		ModifyResponse: func(res *http.Response) error {
+			res.Header.Del(requestIDHeader)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logf(levelWarn, "REST proxy %s error for %s: %v", config.Name, r.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return &http.Server{
+		Handler:           p.httpHandler(rp),
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// startREST binds the REST companion listener and serves it in the background
+func (p *ProxyServer) startREST() error {
+	bind := p.config.REST.BindAddress
+	if bind == "" {
+		bind = p.config.BindAddress
+	}
+	addr := listenAddress(bind, p.config.REST.LocalPort)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on REST address %s: %v", addr, err)
+	}
+	lis = p.wrapListener(lis)
+
+	p.logf(levelInfo, "Starting REST proxy for %s on %s -> %s",
+		p.config.Name, addr, p.config.REST.RemoteAddress)
+
+	go func() {
+		if err := p.serveHTTPServer(p.restServer, lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.logf(levelError, "REST proxy %s error: %v", p.config.Name, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RouteConfig sends selected calls to a different upstream than the
+// endpoint's remote_address, e.g. transactions to a tx-optimized node while
+// queries go to a query node, or historical queries to an archive node
+type RouteConfig struct {
+	// Methods are full method name prefixes such as "cosmos.tx." or
+	// "cosmos.tx.*"; the leading slash may be omitted. Empty matches every
+	// method, which requires a height condition or an expression.
+	Methods       []string `mapstructure:"methods"`
+	RemoteAddress string   `mapstructure:"remote_address"`
+	UseTLS        bool     `mapstructure:"use_tls"`
+
+	// MaxHeight selects queries pinned to this block height or lower with
+	// the x-cosmos-block-height header
+	MaxHeight int64 `mapstructure:"max_height"`
+
+	// OlderThanBlocks selects queries pinned more than this many blocks below
+	// the latest height reported by the endpoint's upstreams, e.g. the
+	// pruning window of the node at remote_address
+	OlderThanBlocks int64 `mapstructure:"older_than_blocks"`
+
+	// When is a rule expression the call must also satisfy, e.g.
+	// metadata["x-env"] == "staging"
+	When string `mapstructure:"when"`
+}
+
+// byHeight reports whether the route selects calls by block height
+func (c RouteConfig) byHeight() bool {
+	return c.MaxHeight > 0 || c.OlderThanBlocks > 0
+}
+
+// describe summarises which calls the route selects for logging
+func (c RouteConfig) describe() string {
+	var parts []string
+	if len(c.Methods) > 0 {
+		parts = append(parts, strings.Join(c.Methods, ", "))
+	}
+	if c.MaxHeight > 0 {
+		parts = append(parts, fmt.Sprintf("height <= %d", c.MaxHeight))
+	}
+	if c.OlderThanBlocks > 0 {
+		parts = append(parts, fmt.Sprintf("older than %d blocks", c.OlderThanBlocks))
+	}
+	if c.When != "" {
+		parts = append(parts, "when "+c.When)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// route is a RouteConfig with its upstream connection and compiled
+// expression
+type route struct {
+	config RouteConfig
+	conn   *grpc.ClientConn
+	when   *ruleExpr
+}
+
+// matches reports whether a call is sent to this route. latest is the
+// highest height seen from the upstreams (0 if none yet).
+func (r *route) matches(env *exprEnv, latest int64) bool {
+	if len(r.config.Methods) > 0 && !r.matchesMethod(env.fullMethodName) {
+		return false
+	}
+	if r.when != nil && !r.when.matches(env) {
+		return false
+	}
+	if !r.config.byHeight() {
+		return true
+	}
+	height := env.height
+	if height <= 0 {
+		return false
+	}
+	if r.config.MaxHeight > 0 && height <= r.config.MaxHeight {
+		return true
+	}
+	return r.config.OlderThanBlocks > 0 && latest > 0 && height < latest-r.config.OlderThanBlocks
+}
+
+// matchesMethod reports whether fullMethodName starts with one of the route's prefixes
+func (r *route) matchesMethod(fullMethodName string) bool {
+	for _, prefix := range r.config.Methods {
+		if matchesMethod([]string{strings.TrimSuffix(prefix, "*")}, fullMethodName) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRoutes validates the route table and dials every route's upstream
+func newRoutes(configs []RouteConfig, extra ...grpc.DialOption) ([]*route, error) {
+	routes := make([]*route, 0, len(configs))
+	for i, c := range configs {
+		var err error
+		switch {
+		case len(c.Methods) == 0 && !c.byHeight() && c.When == "":
+			err = fmt.Errorf("route %d needs methods, max_height, older_than_blocks or when", i+1)
+		case c.MaxHeight < 0 || c.OlderThanBlocks < 0:
+			err = fmt.Errorf("route %d has a negative height condition", i+1)
+		case c.RemoteAddress == "":
+			err = fmt.Errorf("route %d has no remote_address", i+1)
+		}
+		var when *ruleExpr
+		if err == nil && c.When != "" {
+			if when, err = compileExpr(c.When); err != nil {
+				err = fmt.Errorf("route %d: %v", i+1, err)
+			}
+		}
+		var conn *grpc.ClientConn
+		if err == nil {
+			conn, err = dialUpstream(c.RemoteAddress, tlsOrInsecure(c.UseTLS), extra...)
+			if err != nil {
+				err = fmt.Errorf("failed to connect to route upstream %s: %v", c.RemoteAddress, err)
+			}
+		}
+		if err != nil {
+			closeRoutes(routes)
+			return nil, err
+		}
+		conn.Connect()
+		routes = append(routes, &route{config: c, conn: conn, when: when})
+	}
+	return routes, nil
+}
+
+// closeRoutes closes the upstream connections of routes
+func closeRoutes(routes []*route) {
+	for _, r := range routes {
+		r.conn.Close()
+	}
+}
+
+// upstreamFor returns the connection for the first route matching the call,
+// or the endpoint's upstream when none does
+func (p *ProxyServer) upstreamFor(env *exprEnv) *grpc.ClientConn {
+	if len(p.routes) == 0 {
+		return p.upstream
+	}
+	latest := p.latestHeight.Load()
+	for _, r := range p.routes {
+		if r.matches(env, latest) {
+			return r.conn
+		}
+	}
+	return p.upstream
+}
+
+// heightInterceptor records the highest block height reported in upstream
+// response headers, which older_than_blocks routes and height cache
+// invalidation measure against
+func (p *ProxyServer) heightInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.cache != nil && p.config.Cache.byHeight() {
+		return handler(srv, &heightStream{ServerStream: ss, proxy: p})
+	}
+	for _, r := range p.routes {
+		if r.config.OlderThanBlocks > 0 {
+			return handler(srv, &heightStream{ServerStream: ss, proxy: p})
+		}
+	}
+	return handler(srv, ss)
+}
+
+// heightStream observes the block height header sent back to the client
+type heightStream struct {
+	grpc.ServerStream
+	proxy *ProxyServer
+}
+
+func (s *heightStream) SendHeader(md metadata.MD) error {
+	s.proxy.observeHeight(headerValue(md, blockHeightHeader))
+	return s.ServerStream.SendHeader(md)
+}
+
+// observeHeight raises the latest known block height to value
+func (p *ProxyServer) observeHeight(value string) {
+	height, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		latest := p.latestHeight.Load()
+		if height <= latest {
+			return
+		}
+		if p.latestHeight.CompareAndSwap(latest, height) {
+			p.metrics.Set("latest_height", intVar(height))
+			return
+		}
+	}
+}
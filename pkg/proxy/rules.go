@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// HeaderRuleConfig changes the metadata sent upstream for calls matching an
+// expression
+type HeaderRuleConfig struct {
+	// When is the rule expression calls must satisfy (default every call)
+	When string `mapstructure:"when"`
+
+	// Set adds or replaces metadata keys
+	Set map[string]string `mapstructure:"set"`
+
+	// Remove drops metadata keys
+	Remove []string `mapstructure:"remove"`
+}
+
+// headerRule is a HeaderRuleConfig with its compiled expression
+type headerRule struct {
+	config HeaderRuleConfig
+	when   *ruleExpr
+}
+
+// protectedHeader reports whether header rules may not touch key: the
+// proxy sets the upstream token itself and never forwards the API key
+func protectedHeader(key string) bool {
+	return key == "authorization" || key == apiKeyHeader || strings.HasPrefix(key, "grpc-") || strings.HasPrefix(key, ":")
+}
+
+// newHeaderRules checks and compiles an endpoint's header rules
+func newHeaderRules(configs []HeaderRuleConfig) ([]*headerRule, error) {
+	rules := make([]*headerRule, 0, len(configs))
+	for i, c := range configs {
+		if len(c.Set) == 0 && len(c.Remove) == 0 {
+			return nil, fmt.Errorf("header rule %d needs set or remove", i+1)
+		}
+		for key := range c.Set {
+			if protectedHeader(strings.ToLower(key)) {
+				return nil, fmt.Errorf("header rule %d cannot set %s", i+1, key)
+			}
+		}
+		for _, key := range c.Remove {
+			if protectedHeader(strings.ToLower(key)) {
+				return nil, fmt.Errorf("header rule %d cannot remove %s", i+1, key)
+			}
+		}
+		r := &headerRule{config: c}
+		if c.When != "" {
+			var err error
+			if r.when, err = compileExpr(c.When); err != nil {
+				return nil, fmt.Errorf("header rule %d: %v", i+1, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// applyHeaderRules changes md by the rules matching the call. Every rule is
+// evaluated against the metadata the client sent before any is applied.
+func (p *ProxyServer) applyHeaderRules(md metadata.MD, env *exprEnv) {
+	var matched []*headerRule
+	for _, r := range p.headerRules {
+		if r.when == nil || r.when.matches(env) {
+			matched = append(matched, r)
+		}
+	}
+	for _, r := range matched {
+		for _, key := range r.config.Remove {
+			md.Delete(key)
+		}
+		for key, value := range r.config.Set {
+			md.Set(key, value)
+		}
+	}
+}
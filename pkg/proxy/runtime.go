@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// DefaultCgroupRoot is where the container's cgroup filesystem is mounted
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+// defaultMemoryLimitRatio leaves room for memory the Go runtime does not
+// account for, such as thread stacks and cgo
+const defaultMemoryLimitRatio = 0.9
+
+// RuntimeConfig tunes GOMAXPROCS and the Go memory limit. By default both
+// follow the CPU quota and memory limit of the container, unless the
+// GOMAXPROCS or GOMEMLIMIT environment variables are set.
+type RuntimeConfig struct {
+	// GOMAXPROCS overrides the number of threads running Go code
+	// (0 = from the CPU quota)
+	GOMAXPROCS int `mapstructure:"gomaxprocs"`
+
+	// MemoryLimitMB overrides the soft memory limit of the Go runtime
+	// (0 = memory_limit_ratio of the container's memory limit)
+	MemoryLimitMB int `mapstructure:"memory_limit_mb"`
+
+	// MemoryLimitRatio is the share of the container's memory limit the Go
+	// runtime aims to stay under (default 0.9)
+	MemoryLimitRatio float64 `mapstructure:"memory_limit_ratio"`
+
+	// IgnoreContainer keeps the Go defaults instead of the container limits
+	IgnoreContainer bool `mapstructure:"ignore_container"`
+}
+
+// memoryLimitRatio returns the configured ratio or the default
+func (c *RuntimeConfig) memoryLimitRatio() float64 {
+	if c.MemoryLimitRatio > 0 {
+		return c.MemoryLimitRatio
+	}
+	return defaultMemoryLimitRatio
+}
+
+// validate checks the overrides are in range
+func (c *RuntimeConfig) validate() error {
+	if c.GOMAXPROCS < 0 || c.MemoryLimitMB < 0 {
+		return fmt.Errorf("runtime gomaxprocs and memory_limit_mb must not be negative")
+	}
+	if c.MemoryLimitRatio < 0 || c.MemoryLimitRatio > 1 {
+		return fmt.Errorf("runtime memory_limit_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// ContainerLimits are the CPU and memory limits of a cgroup
+type ContainerLimits struct {
+	// CPUs is the CPU quota in cores, 0 when unlimited
+	CPUs float64
+
+	// Memory is the memory limit in bytes, 0 when unlimited
+	Memory int64
+}
+
+// ReadContainerLimits reads the limits of the cgroup mounted at root,
+// trying cgroup v2 and then v1. Missing files mean no limit.
+func ReadContainerLimits(root string) (ContainerLimits, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return readCgroupV2(root)
+	}
+	return readCgroupV1(root)
+}
+
+// readCgroupV2 reads cpu.max and memory.max
+func readCgroupV2(root string) (ContainerLimits, error) {
+	var limits ContainerLimits
+	if fields, err := readCgroupFields(filepath.Join(root, "cpu.max")); err != nil {
+		return limits, err
+	} else if len(fields) == 2 && fields[0] != "max" {
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 != nil || err2 != nil || period <= 0 {
+			return limits, fmt.Errorf("invalid cpu.max '%s'", strings.Join(fields, " "))
+		}
+		limits.CPUs = quota / period
+	}
+	if fields, err := readCgroupFields(filepath.Join(root, "memory.max")); err != nil {
+		return limits, err
+	} else if len(fields) == 1 && fields[0] != "max" {
+		memory, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid memory.max '%s'", fields[0])
+		}
+		limits.Memory = memory
+	}
+	return limits, nil
+}
+
+// unlimitedCgroupV1Memory is above any real memory limit; cgroup v1 reports
+// a page-aligned maximum when there is none
+const unlimitedCgroupV1Memory = 1 << 62
+
+// readCgroupV1 reads the CFS quota and the memory limit
+func readCgroupV1(root string) (ContainerLimits, error) {
+	var limits ContainerLimits
+	quota, err := readCgroupInt(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return limits, err
+	}
+	period, err := readCgroupInt(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return limits, err
+	}
+	if quota > 0 && period > 0 {
+		limits.CPUs = float64(quota) / float64(period)
+	}
+	memory, err := readCgroupInt(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	if err != nil {
+		return limits, err
+	}
+	if memory > 0 && memory < unlimitedCgroupV1Memory {
+		limits.Memory = memory
+	}
+	return limits, nil
+}
+
+// readCgroupFields returns the fields of a cgroup file, or none when it
+// does not exist
+func readCgroupFields(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// readCgroupInt returns the number in a cgroup file, or 0 when it does not
+// exist
+func readCgroupInt(path string) (int64, error) {
+	fields, err := readCgroupFields(path)
+	if err != nil || len(fields) == 0 {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s'", filepath.Base(path), fields[0])
+	}
+	return n, nil
+}
+
+// RuntimeLimits are the GOMAXPROCS and memory limit the proxy runs with
+type RuntimeLimits struct {
+	GOMAXPROCS int
+
+	// MemoryLimit is in bytes, math.MaxInt64 when there is none
+	MemoryLimit int64
+
+	// Source says where each value came from
+	GOMAXPROCSSource  string
+	MemoryLimitSource string
+}
+
+// String describes the limits for the log
+func (l RuntimeLimits) String() string {
+	memory := "none"
+	if l.MemoryLimit != math.MaxInt64 {
+		memory = fmt.Sprintf("%d MiB", l.MemoryLimit>>20)
+	}
+	return fmt.Sprintf("GOMAXPROCS %d (%s), memory limit %s (%s)", l.GOMAXPROCS, l.GOMAXPROCSSource, memory, l.MemoryLimitSource)
+}
+
+// ResolveRuntimeLimits works out the GOMAXPROCS and memory limit for config
+// in a container with the given limits. Overrides in config come first,
+// then the GOMAXPROCS and GOMEMLIMIT environment variables, then the
+// container. getenv is usually os.Getenv.
+func ResolveRuntimeLimits(config *RuntimeConfig, container ContainerLimits, getenv func(string) string) RuntimeLimits {
+	if config == nil {
+		config = &RuntimeConfig{}
+	}
+	limits := RuntimeLimits{
+		GOMAXPROCS:        runtime.NumCPU(),
+		GOMAXPROCSSource:  "host CPUs",
+		MemoryLimit:       math.MaxInt64,
+		MemoryLimitSource: "default",
+	}
+	if config.IgnoreContainer {
+		container = ContainerLimits{}
+	}
+
+	envProcs, envProcsErr := strconv.Atoi(getenv("GOMAXPROCS"))
+	envMemory, envMemoryErr := parseGoMemLimit(getenv("GOMEMLIMIT"))
+
+	switch {
+	case config.GOMAXPROCS > 0:
+		limits.GOMAXPROCS, limits.GOMAXPROCSSource = config.GOMAXPROCS, "config"
+	case envProcsErr == nil && envProcs > 0:
+		limits.GOMAXPROCS, limits.GOMAXPROCSSource = envProcs, "GOMAXPROCS"
+	case container.CPUs > 0:
+		// Round down, so a thread is never scheduled without quota left
+		procs := int(math.Floor(container.CPUs))
+		if procs < 1 {
+			procs = 1
+		}
+		if procs < limits.GOMAXPROCS {
+			limits.GOMAXPROCS = procs
+		}
+		limits.GOMAXPROCSSource = "container CPU quota"
+	}
+
+	switch {
+	case config.MemoryLimitMB > 0:
+		limits.MemoryLimit, limits.MemoryLimitSource = int64(config.MemoryLimitMB)<<20, "config"
+	case envMemoryErr == nil:
+		limits.MemoryLimit, limits.MemoryLimitSource = envMemory, "GOMEMLIMIT"
+	case container.Memory > 0:
+		limits.MemoryLimit = int64(float64(container.Memory) * config.memoryLimitRatio())
+		limits.MemoryLimitSource = "container memory limit"
+	}
+	return limits
+}
+
+// goMemLimitUnits are the suffixes GOMEMLIMIT accepts
+var goMemLimitUnits = []struct {
+	suffix string
+	shift  uint
+}{{"KiB", 10}, {"MiB", 20}, {"GiB", 30}, {"TiB", 40}, {"B", 0}}
+
+// parseGoMemLimit parses a GOMEMLIMIT value the way the Go runtime does,
+// with "off" meaning no limit
+func parseGoMemLimit(value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("GOMEMLIMIT is not set")
+	}
+	if value == "off" {
+		return math.MaxInt64, nil
+	}
+	number, shift := value, uint(0)
+	for _, unit := range goMemLimitUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, shift = strings.TrimSuffix(value, unit.suffix), unit.shift
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid GOMEMLIMIT '%s'", value)
+	}
+	return n << shift, nil
+}
+
+// ApplyRuntime sets GOMAXPROCS and the Go memory limit from config and the
+// limits of the container the proxy runs in, and returns what it set
+func ApplyRuntime(config *RuntimeConfig) (RuntimeLimits, error) {
+	container, err := ReadContainerLimits(DefaultCgroupRoot)
+	if err != nil {
+		return RuntimeLimits{}, fmt.Errorf("failed to read container limits: %w", err)
+	}
+	limits := ResolveRuntimeLimits(config, container, os.Getenv)
+	runtime.GOMAXPROCS(limits.GOMAXPROCS)
+	debug.SetMemoryLimit(limits.MemoryLimit)
+	return limits, nil
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSecretRefresh is how often secrets without a lease are re-read
+	defaultSecretRefresh = 5 * time.Minute
+
+	// secretRetryDelay is how long a failed refresh waits before trying again
+	secretRetryDelay = 30 * time.Second
+
+	// secretFetchTimeout bounds a single request to a secrets backend
+	secretFetchTimeout = 30 * time.Second
+)
+
+// SecretsConfig configures the backends that resolve *_ref settings such as
+// jwt_token_ref. References have the form <backend>:<path>.
+type SecretsConfig struct {
+	// RefreshInterval is how often secrets without a lease are re-read (default 5m)
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+
+	Vault *VaultConfig `mapstructure:"vault"`
+
+	// Cloud backend settings are optional; without them project, region and
+	// credentials come from the environment
+	AWS   AWSConfig   `mapstructure:"aws"`
+	GCP   GCPConfig   `mapstructure:"gcp"`
+	Azure AzureConfig `mapstructure:"azure"`
+}
+
+// secret is a value read from a secrets backend
+type secret struct {
+	value string
+
+	// ttl is the remaining lease; zero means the backend reported none
+	ttl time.Duration
+
+	// poll asks for the secret to be re-read this often, for cheap local sources
+	poll time.Duration
+}
+
+// secretBackend reads secrets for one reference scheme
+type secretBackend interface {
+	fetch(ctx context.Context, path string) (secret, error)
+}
+
+// secretSchemes lists the reference prefixes the proxy knows about
+var secretSchemes = []string{"file", "keyring", "vault", "aws-sm", "aws-ssm", "gcp-sm", "azure-kv"}
+
+// parseSecretRef splits a reference into its backend scheme and path
+func parseSecretRef(ref string) (scheme, path string, err error) {
+	scheme, path, ok := strings.Cut(ref, ":")
+	if !ok || path == "" {
+		return "", "", fmt.Errorf("invalid secret reference %q (expected <backend>:<path>)", ref)
+	}
+	for _, s := range secretSchemes {
+		if s == scheme {
+			return scheme, path, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown secrets backend %q in %q (expected one of %s)", scheme, ref, strings.Join(secretSchemes, ", "))
+}
+
+// secretStore resolves secret references with the configured backends. One
+// store is shared by every endpoint of a Manager.
+type secretStore struct {
+	mu       sync.RWMutex
+	backends map[string]secretBackend
+	refresh  time.Duration
+}
+
+// configure replaces the backends from config
+func (s *secretStore) configure(config SecretsConfig) error {
+	backends := map[string]secretBackend{"file": fileBackend{}, "keyring": keyringBackend{}}
+	if config.Vault != nil {
+		vault, err := newVaultBackend(*config.Vault)
+		if err != nil {
+			return err
+		}
+		backends["vault"] = vault
+	}
+	backends["aws-sm"], backends["aws-ssm"] = newAWSBackends(config.AWS)
+	backends["gcp-sm"] = newGCPBackend(config.GCP)
+	backends["azure-kv"] = newAzureBackend(config.Azure)
+
+	s.mu.Lock()
+	s.backends = backends
+	s.refresh = config.RefreshInterval
+	s.mu.Unlock()
+	return nil
+}
+
+// fetch reads the secret a reference points to
+func (s *secretStore) fetch(ctx context.Context, ref string) (secret, error) {
+	scheme, path, err := parseSecretRef(ref)
+	if err != nil {
+		return secret{}, err
+	}
+
+	s.mu.RLock()
+	backend := s.backends[scheme]
+	s.mu.RUnlock()
+	if backend == nil {
+		return secret{}, fmt.Errorf("secret reference %q needs the %s backend, which is not configured under secrets", ref, scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, secretFetchTimeout)
+	defer cancel()
+	sec, err := backend.fetch(ctx, path)
+	if err != nil {
+		return secret{}, fmt.Errorf("failed to read %s: %v", ref, err)
+	}
+	if sec.value == "" {
+		return secret{}, fmt.Errorf("secret %s is empty", ref)
+	}
+	return sec, nil
+}
+
+// refreshDelay returns how long to wait before re-reading a secret: two
+// thirds of its lease, or the refresh interval when it has none
+func (s *secretStore) refreshDelay(sec secret) time.Duration {
+	if sec.poll > 0 {
+		return sec.poll
+	}
+	if sec.ttl > 0 {
+		return sec.ttl * 2 / 3
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.refresh > 0 {
+		return s.refresh
+	}
+	return defaultSecretRefresh
+}
+
+// refreshToken keeps the token read from jwt_token_ref or renewed through
+// oidc or token_refresh current until the server's upstreams are closed
+func (p *ProxyServer) refreshToken(current secret) {
+	delay := p.secrets.refreshDelay(current)
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(delay):
+		}
+
+		var sec secret
+		var err error
+		source := "secrets:" + p.config.JWTTokenRef
+		if p.auth.renewer != nil {
+			sec, err = p.auth.renewer.renew(context.Background())
+			source = p.auth.renewer.source
+		} else {
+			sec, err = p.secrets.fetch(context.Background(), p.config.JWTTokenRef)
+		}
+		if err != nil {
+			p.logf(levelError, "Failed to refresh JWT token for %s, keeping the current one: %v", p.config.Name, err)
+			p.metrics.Add("secret_refresh_failures", 1)
+			delay = secretRetryDelay
+			continue
+		}
+		if sec.value != p.Token() {
+			p.rotateToken(sec.value, source)
+		}
+		delay = p.secrets.refreshDelay(sec)
+	}
+}
+
+// accessToken is a cached OAuth bearer token for a cloud secrets API
+type accessToken struct {
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+
+	// fetch obtains a new token and its lifetime
+	fetch func(ctx context.Context) (string, time.Duration, error)
+}
+
+// get returns the cached token, fetching a new one shortly before it expires
+func (t *accessToken) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.value != "" && time.Until(t.expires) > time.Minute {
+		return t.value, nil
+	}
+	value, lifetime, err := t.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.value, t.expires = value, time.Now().Add(lifetime)
+	return value, nil
+}
+
+// oauthTokenResponse is the token endpoint response shared by Google and
+// Azure. Azure's managed identity endpoint sends expires_in as a string.
+type oauthTokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+// postForm sends an OAuth token request and decodes the response
+func postForm(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(client, req)
+}
+
+// doTokenRequest sends req and decodes an OAuth token response
+func doTokenRequest(client *http.Client, req *http.Request) (string, time.Duration, error) {
+	body, err := secretsDo(client, req)
+	if err != nil {
+		return "", 0, err
+	}
+	var token oauthTokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+	seconds, _ := token.ExpiresIn.Int64()
+	if seconds <= 0 {
+		seconds = 300
+	}
+	return token.AccessToken, time.Duration(seconds) * time.Second, nil
+}
+
+// secretsDo sends req and returns the body of a 2xx response
+func secretsDo(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, errorMessage(body))
+	}
+	return body, nil
+}
+
+// errorMessage extracts a readable error from an AWS, Google, Azure or OAuth error body
+func errorMessage(body []byte) string {
+	var e struct {
+		// AWS JSON APIs
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+
+		// Google and Azure APIs nest an object under error; OAuth sends a code string
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return strings.TrimSpace(string(body))
+	}
+	if e.Type != "" {
+		if _, t, ok := strings.Cut(e.Type, "#"); ok {
+			e.Type = t
+		}
+		return strings.TrimSpace(e.Type + " " + e.Message)
+	}
+	var nested struct {
+		Code    json.RawMessage `json:"code"`
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(e.Error, &nested) == nil && nested.Message != "" {
+		code := nested.Status
+		if code == "" {
+			code = strings.Trim(string(nested.Code), `"`)
+		}
+		return strings.TrimSpace(code + " " + nested.Message)
+	}
+	var code string
+	if json.Unmarshal(e.Error, &code) == nil && code != "" {
+		return strings.TrimSpace(code + " " + e.ErrorDescription)
+	}
+	return strings.TrimSpace(string(body))
+}
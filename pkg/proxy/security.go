@@ -0,0 +1,59 @@
+package proxy
+
+import "fmt"
+
+// Security modes
+const (
+	// SecurityStandard forwards every method an endpoint does not deny
+	SecurityStandard = "standard"
+
+	// SecurityDenyByDefault only forwards allowlisted methods, including
+	// reflection, and requires client API keys on every endpoint
+	SecurityDenyByDefault = "deny_by_default"
+)
+
+// denyByDefault reports whether the proxy runs in the hardened mode
+func (c *ProxyConfig) denyByDefault() bool {
+	return c != nil && c.SecurityMode == SecurityDenyByDefault
+}
+
+// validateSecurityMode checks the mode is known and, in deny_by_default,
+// that every endpoint has an allowlist and callers must present API keys
+func (c *ProxyConfig) validateSecurityMode() error {
+	switch c.SecurityMode {
+	case "", SecurityStandard:
+		return nil
+	case SecurityDenyByDefault:
+	default:
+		return fmt.Errorf("unknown security_mode '%s', expected standard or deny_by_default", c.SecurityMode)
+	}
+	if len(c.Clients) == 0 {
+		return fmt.Errorf("security_mode deny_by_default requires clients")
+	}
+	for _, e := range c.Endpoints {
+		// HTTP traffic has no method names to allowlist
+		if e.Type == TypeHTTP || e.REST != nil {
+			return fmt.Errorf("endpoint %s: security_mode deny_by_default only supports gRPC endpoints without rest", e.Name)
+		}
+		if len(e.AllowedMethods) == 0 {
+			return fmt.Errorf("endpoint %s: security_mode deny_by_default requires allowed_methods", e.Name)
+		}
+	}
+	return nil
+}
+
+// withDenyByDefault only lets clients call explicitly allowed methods
+func withDenyByDefault(deny bool) Option {
+	return func(o *options) {
+		o.denyByDefault = deny
+	}
+}
+
+// methodAllowed reports whether clients may call fullMethodName. In
+// deny_by_default, reflection must be allowlisted like any other service.
+func (p *ProxyServer) methodAllowed(fullMethodName string) bool {
+	if p.denyByDefault && !matchesMethod(p.config.AllowedMethods, fullMethodName) {
+		return false
+	}
+	return p.config.methodAllowed(fullMethodName)
+}
@@ -0,0 +1,995 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+
+	// Register the gzip compressor so upstream calls can use it and
+	// compressed requests from local clients are accepted
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ProxyServer represents a single proxy server instance
+type ProxyServer struct {
+	config   Config
+	logLevel logLevel
+	server   *grpc.Server
+	upstream *grpc.ClientConn
+	metrics  *expvar.Map
+	health   *health.Server
+
+	mu       sync.Mutex
+	listener net.Listener
+
+	// captureFile receives recorded calls while the server is listening
+	captureFile *captureFile
+
+	// descriptors decodes messages for message logging
+	descriptors *descriptorResolver
+
+	// descriptorSet describes the upstream's services when descriptor_set is set
+	descriptorSet *descriptorSet
+
+	// reflection answers server reflection locally when configured
+	reflection *reflectionCache
+
+	// reflectionMethod is the reflection method the upstream last answered
+	reflectionMethod atomic.Pointer[string]
+
+	// cache holds responses when cache is configured
+	cache *responseCache
+
+	// dedup tracks shared calls when dedup is configured
+	dedup dedupGroup
+
+	// faults injects artificial failures when configured
+	faults *faults
+
+	// errorMappings rewrite upstream errors when errors is configured
+	errorMappings []errorMapping
+
+	// maintenance is set while the endpoint is in maintenance mode
+	maintenance atomic.Pointer[maintenance]
+
+	// token is the JWT injected into upstream calls; UpdateToken swaps it at runtime
+	token atomic.Pointer[string]
+
+	// auth puts the token into upstream calls the way the upstream expects
+	auth *upstreamAuth
+
+	// clientJWT verifies callers' JWTs when client_jwt is set
+	clientJWT *clientJWT
+
+	// activeStreams counts proxied calls currently in flight
+	activeStreams atomic.Int64
+
+	// callsTotal and callsFailed count finished proxied calls
+	callsTotal  atomic.Int64
+	callsFailed atomic.Int64
+
+	// recent holds the latest calls for latency and error rate
+	recent recentCalls
+
+	// slos track the endpoint's latency objectives
+	slos []*sloTracker
+
+	// headerRules change the metadata of calls matching their expressions
+	headerRules []*headerRule
+
+	// listenerTLS serves the endpoint's listeners over TLS when tls is
+	// configured
+	listenerTLS *tls.Config
+
+	// listenerCert is the listener certificate loaded from files, which is
+	// reloaded when they change
+	listenerCert *listenerCert
+
+	// processor inspects and changes calls when processor is configured or
+	// given with WithProcessor
+	processor *callProcessor
+
+	// methodMetrics counts calls per method when method_metrics is configured
+	methodMetrics *methodMetrics
+
+	// compareConn is the shadow upstream used in compare mode
+	compareConn *grpc.ClientConn
+
+	// hedgeConn is the second upstream slow calls are hedged to
+	hedgeConn *grpc.ClientConn
+
+	// outliers ejects degraded upstream addresses when outlier_detection is configured
+	outliers *outlierDetector
+
+	// affinity binds clients to upstream addresses when affinity is configured
+	affinity *affinityTable
+
+	// fallbacks are the lower upstream tiers, and tier the one calls go to
+	// (0 for the endpoint's upstream)
+	fallbacks []*upstreamTier
+	tier      atomic.Int32
+	tierMu    sync.Mutex
+
+	// routes send selected calls to other upstreams, first match wins
+	routes []*route
+
+	// latestHeight is the highest block height reported by the upstreams
+	latestHeight atomic.Int64
+
+	// chainMismatch is set while an upstream serves a chain other than expected_chain_id
+	chainMismatch atomic.Pointer[errChainMismatch]
+
+	// stale describes why an upstream is serving stale state, nil while all are fresh
+	stale atomic.Pointer[string]
+
+	// restServer is the optional companion REST proxy
+	restServer *http.Server
+
+	// httpServer replaces server on type: http endpoints; httpCancel closes
+	// its remaining WebSocket connections
+	httpServer *http.Server
+	httpCancel context.CancelFunc
+
+	// lanes maps lane names to their admission control
+	lanes map[string]*lane
+
+	// clients authenticates local callers; nil or empty allows everyone
+	clients *clientSet
+
+	// denyByDefault only forwards allowlisted methods, in security_mode
+	// deny_by_default
+	denyByDefault bool
+
+	// connLimiter caps client connections when set
+	connLimiter *connLimiter
+
+	// acl restricts client networks when allowed_cidrs or denied_cidrs is set
+	acl *cidrACL
+
+	// secrets resolves jwt_token_ref
+	secrets *secretStore
+
+	// roots verifies the upstream when ca_file or ca_ref is set
+	roots *rootCAs
+
+	// audit records token rotations
+	audit *auditLog
+
+	// usage accounts calls per client
+	usage *usageLog
+
+	// quotas enforces client quotas
+	quotas *quotaTracker
+
+	// alerts reports upstream failures and expiring tokens
+	alerts *alerter
+
+	// listenerWrappers wrap the listener before acl and connLimiter
+	listenerWrappers []func(endpoint string, lis net.Listener) net.Listener
+
+	// closed is closed with the upstreams to stop background work
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewProxyServer creates a new proxy server with the specified configuration
+func NewProxyServer(config Config, opts ...Option) (*ProxyServer, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	switch config.Type {
+	case "", TypeGRPC, TypeHTTP:
+	default:
+		return nil, fmt.Errorf("unsupported endpoint type %q (expected grpc or http)", config.Type)
+	}
+
+	extra := []grpc.DialOption{config.Connect.dialOption()}
+	if config.Compression != "" {
+		if encoding.GetCompressor(config.Compression) == nil {
+			return nil, fmt.Errorf("unsupported compression %q", config.Compression)
+		}
+		extra = append(extra, grpc.WithDefaultCallOptions(grpc.UseCompressor(config.Compression)))
+	}
+
+	lanes, err := newLanes(config.Name, config.Lanes, o.redis)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Capture != nil && config.Capture.Path == "" {
+		return nil, fmt.Errorf("capture requires a path")
+	}
+
+	if config.OutlierDetection != nil {
+		if err := config.OutlierDetection.validate(); err != nil {
+			return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+		}
+	}
+	if config.Affinity != nil {
+		if err := config.Affinity.validate(); err != nil {
+			return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+		}
+	}
+	if config.Freshness != nil {
+		if err := config.Freshness.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Cache != nil {
+		if err := config.Cache.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	acl, err := newCIDRACL(config.AllowedCIDRs, config.DeniedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	faults, err := newFaults(config.Faults)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newUpstreamAuth(config)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+	}
+	callers, err := newClientJWT(config.ClientJWT)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+	}
+
+	var serverOpts []grpc.ServerOption
+	var listenerTLS *tls.Config
+	var listenerCert *listenerCert
+	if config.TLS != nil {
+		if listenerTLS, listenerCert, err = newListenerTLS(config.TLS, o.acme); err != nil {
+			return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(listenerTLS)))
+	}
+	if config.SizeLimits != nil {
+		if err := config.SizeLimits.validate(); err != nil {
+			return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+		}
+		request, response := config.SizeLimits.ceilings()
+		if request > 0 {
+			serverOpts = append(serverOpts, grpc.MaxRecvMsgSize(request))
+		}
+		if response > 0 {
+			extra = append(extra, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(response)))
+		}
+	}
+
+	errorMappings, err := newErrorMappings(config.Errors)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+	}
+
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+	}
+	if config.LogSampling != nil {
+		if err := config.LogSampling.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if (config.JWTTokenRef != "" || config.CARef != "" || config.OIDC != nil || (config.TokenRefresh != nil && config.TokenRefresh.RefreshTokenRef != "")) && o.secrets == nil {
+		return nil, fmt.Errorf("jwt_token_ref, ca_ref, refresh_token_ref and oidc require secrets backends, which are configured through the Manager")
+	}
+	token := secret{value: config.JWTToken}
+	if config.JWTTokenRef != "" {
+		token, err = o.secrets.fetch(context.Background(), config.JWTTokenRef)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if auth.renewer, err = newTokenRenewer(context.Background(), config, o.secrets, o.renewals); err != nil {
+		return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+	}
+	if auth.renewer != nil {
+		if token, err = auth.renewer.initial(context.Background(), config.JWTToken); err != nil {
+			if config.OIDC != nil {
+				return nil, fmt.Errorf("endpoint '%s': %v (grpc-proxy login %s signs in again)", config.Name, err, config.Name)
+			}
+			return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+		}
+	}
+	var caPEM []byte
+	if config.CARef != "" {
+		ca, err := o.secrets.fetch(context.Background(), config.CARef)
+		if err != nil {
+			return nil, err
+		}
+		caPEM = []byte(ca.value)
+	}
+	roots, err := newRootCAs(config, caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Type == TypeHTTP {
+		return newHTTPProxyServer(config, o, token, roots, acl, auth, callers, level)
+	}
+	if config.WebSocket != nil {
+		return nil, fmt.Errorf("endpoint '%s': websocket requires type: http", config.Name)
+	}
+
+	var set *descriptorSet
+	if config.DescriptorSet != "" {
+		if set, err = loadDescriptorSet(config.DescriptorSet); err != nil {
+			return nil, err
+		}
+	}
+
+	target, primaryExtra := config.RemoteAddress, extra
+	if len(config.ResolveTo) > 0 {
+		var opt grpc.DialOption
+		target, opt, err = staticResolver(config.RemoteAddress, config.ResolveTo)
+		if err != nil {
+			return nil, err
+		}
+		primaryExtra = append(append([]grpc.DialOption{}, extra...), opt)
+	}
+
+	creds, err := upstreamCredentials(config, roots)
+	if err != nil {
+		return nil, err
+	}
+	if config.AuthorityOverride != "" {
+		primaryExtra = append(append([]grpc.DialOption{}, primaryExtra...), grpc.WithAuthority(config.AuthorityOverride))
+	}
+
+	var outliers *outlierDetector
+	if config.OutlierDetection != nil {
+		outliers = newOutlierDetector(config.OutlierDetection, config.Name)
+	}
+	var affinity *affinityTable
+	if config.Affinity != nil {
+		affinity = newAffinityTable(config.Affinity, config.Name)
+	}
+	if outliers != nil || affinity != nil {
+		primaryExtra = append(append([]grpc.DialOption{}, primaryExtra...), balancedDialOption(outliers, affinity))
+	}
+
+	conn, err := dialUpstream(target, creds, primaryExtra...)
+	if err != nil {
+		if outliers != nil {
+			outliers.close()
+		}
+		if affinity != nil {
+			affinity.close()
+		}
+		return nil, fmt.Errorf("failed to connect to upstream: %v", err)
+	}
+
+	p := &ProxyServer{
+		config:   config,
+		logLevel: level,
+		upstream: conn,
+		metrics:  endpointMetrics(config.Name),
+		health:   health.NewServer(),
+		lanes:    lanes,
+		clients:  o.clients,
+
+		denyByDefault: o.denyByDefault,
+		connLimiter:   o.connLimiter,
+		acl:           acl,
+		faults:        faults,
+		errorMappings: errorMappings,
+		outliers:      outliers,
+		affinity:      affinity,
+		descriptorSet: set,
+		secrets:       o.secrets,
+		roots:         roots,
+		audit:         o.audit,
+		usage:         o.usage,
+		quotas:        o.quotas,
+		alerts:        o.alerts,
+		closed:        make(chan struct{}),
+
+		listenerWrappers: o.listenerWrappers,
+		listenerTLS:      listenerTLS,
+		listenerCert:     listenerCert,
+		auth:             auth,
+		clientJWT:        callers,
+	}
+	knownSecrets.add(token.value)
+	p.token.Store(&token.value)
+	if config.MaxConcurrentStreams > 0 {
+		p.metrics.Set("max_concurrent_streams", intVar(int64(config.MaxConcurrentStreams)))
+	}
+
+	if config.Compare != nil {
+		p.compareConn, err = dialUpstream(config.Compare.RemoteAddress, tlsOrInsecure(config.Compare.UseTLS), extra...)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to compare upstream: %v", err)
+		}
+	}
+	if config.Hedge != nil {
+		if err := config.Hedge.validate(); err != nil {
+			p.closeUpstreams()
+			return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+		}
+		p.hedgeConn, err = dialUpstream(config.Hedge.RemoteAddress, tlsOrInsecure(config.Hedge.UseTLS), extra...)
+		if err != nil {
+			p.closeUpstreams()
+			return nil, fmt.Errorf("failed to connect to hedge upstream: %v", err)
+		}
+		p.hedgeConn.Connect()
+	}
+
+	p.routes, err = newRoutes(config.Routes, extra...)
+	if err != nil {
+		p.closeUpstreams()
+		return nil, err
+	}
+
+	p.fallbacks, err = newFallbacks(config.Fallbacks, extra...)
+	if err != nil {
+		p.closeUpstreams()
+		return nil, err
+	}
+
+	p.slos, err = newSLOTrackers(p, config.SLOs)
+	if err != nil {
+		p.closeUpstreams()
+		return nil, err
+	}
+
+	p.headerRules, err = newHeaderRules(config.HeaderRules)
+	if err != nil {
+		p.closeUpstreams()
+		return nil, err
+	}
+
+	p.processor, err = newCallProcessor(config.Processor, o.processor, extra...)
+	if err != nil {
+		p.closeUpstreams()
+		return nil, fmt.Errorf("endpoint '%s': %v", config.Name, err)
+	}
+
+	if config.MethodMetrics != nil {
+		p.methodMetrics, err = newMethodMetrics(config.MethodMetrics, p.metrics)
+		if err != nil {
+			p.closeUpstreams()
+			return nil, err
+		}
+	} else {
+		p.metrics.Delete("methods")
+	}
+
+	if config.REST != nil {
+		p.restServer, err = p.newRESTServer()
+		if err != nil {
+			p.closeUpstreams()
+			return nil, err
+		}
+	}
+
+	streamInterceptors := []grpc.StreamServerInterceptor{p.requestIDInterceptor, p.diagnosticsInterceptor, p.recoveryInterceptor, p.trackInterceptor, p.clientJWTInterceptor}
+	streamInterceptors = append(streamInterceptors, o.streamInterceptors...)
+	streamInterceptors = append(streamInterceptors, p.sizeLimitInterceptor, p.faultInterceptor, p.laneInterceptor, p.sessionHeightInterceptor, p.cacheInterceptor, p.dedupInterceptor, p.heightInterceptor, p.compareInterceptor, p.captureInterceptor, p.messageLogInterceptor, p.hedgeInterceptor)
+
+	if config.MessageLog != nil {
+		p.descriptors = newDescriptorResolver(p)
+	}
+
+	// Connect eagerly so address and TLS problems surface before the first call
+	conn.Connect()
+	go p.watchUpstream()
+	if config.JWTTokenRef != "" || p.auth.renewer != nil {
+		go p.refreshToken(token)
+	}
+	if p.alerts != nil {
+		go p.watchTokenExpiry()
+	}
+	if roots != nil && config.CAFile != "" {
+		go p.watchCAFile()
+	}
+	if listenerCert != nil {
+		go p.watchListenerCert()
+	}
+	if config.ExpectedChainID != "" {
+		go p.watchChainID()
+	}
+	if callers != nil {
+		go p.watchJWKS()
+	}
+	if config.Freshness != nil {
+		go p.watchFreshness()
+	}
+	if outliers != nil {
+		outliers.logf = p.logf
+		go p.watchOutliers()
+	}
+	if affinity != nil {
+		go p.watchAffinity()
+	}
+	if len(p.fallbacks) > 0 {
+		p.metrics.Set("upstream_tier", intVar(0))
+		go p.watchTier(conn)
+		for _, t := range p.fallbacks {
+			go p.watchTier(t.conn)
+		}
+	}
+	if config.Cache != nil {
+		p.cache = newResponseCache(config.Cache)
+		if config.Cache.byHeight() {
+			go p.watchCacheHeight()
+		}
+	}
+
+	// Calls the server doesn't implement itself are forwarded as raw frames
+	serverOpts = append(serverOpts, ForwardServerOptions(p.director)...)
+	serverOpts = append(serverOpts,
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		grpc.ChainUnaryInterceptor(o.unaryInterceptors...),
+	)
+	p.server = grpc.NewServer(serverOpts...)
+	// Health is answered by the proxy itself so it can report NOT_SERVING while draining
+	healthpb.RegisterHealthServer(p.server, p.health)
+	if config.ReflectionCache != nil {
+		p.reflection = newReflectionCache(config.ReflectionCache)
+	}
+	p.registerReflection()
+
+	return p, nil
+}
+
+// Name returns the endpoint name
+func (p *ProxyServer) Name() string {
+	return p.config.Name
+}
+
+// Config returns the endpoint configuration the server was created with,
+// carrying the current token if it was changed by SetToken. Tokens read from
+// jwt_token_ref or renewed through oidc or token_refresh are not copied into
+// the configuration.
+func (p *ProxyServer) Config() Config {
+	config := p.config
+	if config.JWTTokenRef == "" && config.OIDC == nil && config.TokenRefresh == nil {
+		config.JWTToken = p.Token()
+	}
+	return config
+}
+
+// Token returns the JWT currently injected into upstream calls
+func (p *ProxyServer) Token() string {
+	return *p.token.Load()
+}
+
+// SetToken replaces the JWT injected into upstream calls. Calls already in
+// flight keep the token they started with.
+func (p *ProxyServer) SetToken(token string) {
+	knownSecrets.add(token)
+	p.token.Store(&token)
+	p.logf(levelInfo, "Updated JWT token for %s", p.config.Name)
+}
+
+// rotateToken replaces the token like SetToken and records who changed it
+func (p *ProxyServer) rotateToken(token, actor string) {
+	before := p.Token()
+	p.SetToken(token)
+	p.audit.auditToken(actor, p.config.Name, before, token)
+}
+
+// ActiveStreams returns the number of proxied calls currently in flight
+func (p *ProxyServer) ActiveStreams() int64 {
+	return p.activeStreams.Load()
+}
+
+// Calls returns the number of finished proxied calls and how many of them failed
+func (p *ProxyServer) Calls() (total, failed int64) {
+	return p.callsTotal.Load(), p.callsFailed.Load()
+}
+
+// ServingStatus returns the endpoint's health status
+func (p *ProxyServer) ServingStatus() healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := p.health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN
+	}
+	return resp.Status
+}
+
+// UpstreamState returns the connectivity state of the upstream connection.
+// HTTP endpoints connect per request and always report IDLE.
+func (p *ProxyServer) UpstreamState() connectivity.State {
+	if p.upstream == nil {
+		return connectivity.Idle
+	}
+	return p.upstream.GetState()
+}
+
+// dialUpstream creates a client connection to an upstream gRPC server
+func dialUpstream(address string, creds credentials.TransportCredentials, extra ...grpc.DialOption) (*grpc.ClientConn, error) {
+	// Create upstream connection with keep alive parameters
+	var opts []grpc.DialOption
+
+	// Add keep alive parameters as recommended
+	keepAliveParams := keepalive.ClientParameters{
+		Time:                10 * time.Second, // send pings every 10 seconds if there is no activity
+		Timeout:             time.Second,      // wait 1 second for ping ack before considering the connection dead
+		PermitWithoutStream: true,             // send pings even without active streams
+	}
+	opts = append(opts, grpc.WithKeepaliveParams(keepAliveParams))
+
+	opts = append(opts, grpc.WithTransportCredentials(creds))
+	opts = append(opts, extra...)
+
+	return grpc.NewClient(address, opts...)
+}
+
+// director function that handles JWT authentication forwarding
+func (p *ProxyServer) director(ctx context.Context, fullMethodName string) (context.Context, grpc.ClientConnInterface, error) {
+	if err := p.chainError(); err != nil {
+		return nil, nil, err
+	}
+
+	client, ok, err := p.clients.authenticate(ctx)
+	if err != nil {
+		p.metrics.Add("unauthenticated", 1)
+		return nil, nil, err
+	}
+	if ok {
+		p.metrics.Add("client_"+client.Name+"_calls", 1)
+	}
+
+	// Get incoming metadata
+	inMD, _ := metadata.FromIncomingContext(ctx)
+	if inMD == nil {
+		inMD = make(metadata.MD, 1)
+	}
+
+	// The processor's method is checked and routed like the client's
+	var processed *grpc.ClientConn
+	if p.processor != nil {
+		method := fullMethodName
+		fullMethodName, processed, err = p.process(ctx, fullMethodName, inMD, client.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fullMethodName != method {
+			ctx = context.WithValue(ctx, upstreamMethodKey{}, fullMethodName)
+		}
+	}
+
+	if !p.methodAllowed(fullMethodName) {
+		p.metrics.Add("methods_denied", 1)
+		return nil, nil, status.Errorf(codes.PermissionDenied, "method %s is not allowed on endpoint %s", fullMethodName, p.config.Name)
+	}
+	if ok && !client.policy.allows(fullMethodName) {
+		p.metrics.Add("policy_denied", 1)
+		return nil, nil, status.Errorf(codes.PermissionDenied, "client %s may not call %s", client.Name, fullMethodName)
+	}
+
+	// Calls for the endpoint's upstream go to a fallback tier while it is unreachable
+	env := p.callEnv(fullMethodName, inMD, client.Name, callerFromContext(ctx).claimSet())
+	conn := processed
+	if conn == nil {
+		conn = p.upstreamFor(env)
+	}
+	token := p.upstreamToken(ctx, client, ok)
+	auth := p.auth
+	if conn == p.upstream {
+		if fallback := p.activeFallback(); fallback != nil {
+			conn, token, auth = fallback.conn, fallback.config.JWTToken, nil
+		}
+	}
+
+	// The picker keeps the calls of one client on one upstream address
+	var affinityKey string
+	if conn == p.upstream && p.affinity != nil {
+		affinityKey = p.config.Affinity.key(ctx, inMD)
+	}
+
+	// FromIncomingContext returned a copy, so it becomes the outgoing metadata
+	if len(p.headerRules) > 0 {
+		p.applyHeaderRules(inMD, env)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, p.outgoingMetadata(inMD, fullMethodName, token, auth))
+	if affinityKey != "" {
+		ctx = context.WithValue(ctx, affinityCallKey{}, affinityKey)
+	}
+
+	return ctx, conn, nil
+}
+
+// outgoingMetadata turns a call's incoming metadata, which it modifies in
+// place, into the metadata sent upstream for a call to method, with token
+// put in by auth
+func (p *ProxyServer) outgoingMetadata(md metadata.MD, method, token string, auth *upstreamAuth) metadata.MD {
+	// The local API key must never reach the provider
+	delete(md, apiKeyHeader)
+
+	// The lane header only selects local admission control, so keep it from the upstream
+	if len(p.lanes) > 0 {
+		md.Delete(p.laneHeader())
+	}
+
+	// Credentials go in last, so the upstream may take them in x-api-key too
+	auth.setMetadata(md, method, token)
+	return md
+}
+
+// Start starts the proxy server and blocks until it stops serving
+func (p *ProxyServer) Start() error {
+	if err := p.Listen(); err != nil {
+		return err
+	}
+	return p.Serve()
+}
+
+// Listen binds the endpoint's listeners without serving on them yet
+func (p *ProxyServer) Listen() error {
+	addr := p.config.Address()
+	lis, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	// Fault injection needs the raw TCP connection, so it wraps the listener first
+	if p.faults != nil && p.faults.config.ResetPercent > 0 {
+		lis = &faultListener{Listener: lis, faults: p.faults}
+	}
+	lis = p.wrapListener(lis)
+
+	var capture *captureFile
+	if p.config.Capture != nil {
+		capture, err = openCaptureFile(p.config.Capture.Path)
+		if err != nil {
+			lis.Close()
+			return fmt.Errorf("failed to open capture file: %v", err)
+		}
+		p.logf(levelInfo, "Recording calls for %s to %s", p.config.Name, p.config.Capture.Path)
+	}
+
+	kind := "gRPC"
+	if p.httpServer != nil {
+		kind = "HTTP"
+	}
+	p.logf(levelInfo, "Starting %s proxy for %s on %s -> %s",
+		kind, p.config.Name, addr, p.config.RemoteAddress)
+	for _, r := range p.routes {
+		p.logf(levelInfo, "Routing %s calls for %s -> %s", r.config.describe(), p.config.Name, r.config.RemoteAddress)
+	}
+
+	if p.restServer != nil {
+		if err := p.startREST(); err != nil {
+			lis.Close()
+			if capture != nil {
+				capture.Close()
+			}
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.listener = lis
+	p.captureFile = capture
+	p.mu.Unlock()
+	return nil
+}
+
+// wrapListener applies the listener wrappers given as options, then the
+// endpoint's network ACL and connection limits, if any, to lis. Denied clients are turned away before they use up a slot.
+func (p *ProxyServer) wrapListener(lis net.Listener) net.Listener {
+	for _, wrap := range p.listenerWrappers {
+		lis = wrap(p.config.Name, lis)
+	}
+	if p.acl != nil {
+		lis = &aclListener{Listener: lis, acl: p.acl, metrics: p.metrics}
+	}
+	if p.connLimiter != nil {
+		lis = &limitListener{Listener: lis, limiter: p.connLimiter, metrics: p.metrics}
+	}
+	return lis
+}
+
+// Serve serves proxied calls on the listener bound by Listen and blocks until
+// the server stops
+func (p *ProxyServer) Serve() error {
+	p.mu.Lock()
+	lis := p.listener
+	p.mu.Unlock()
+	if lis == nil {
+		return fmt.Errorf("proxy server %s is not listening", p.config.Name)
+	}
+
+	p.updateHealth()
+
+	if p.httpServer != nil {
+		return p.serveHTTP(lis)
+	}
+	return p.server.Serve(lis)
+}
+
+// updateHealth reports SERVING unless the endpoint is in maintenance or an
+// upstream serves the wrong chain or stale state. It has no effect once the
+// server is draining.
+func (p *ProxyServer) updateHealth() {
+	serving := healthpb.HealthCheckResponse_SERVING
+	if p.maintenance.Load() != nil || p.chainMismatch.Load() != nil || p.stale.Load() != nil {
+		serving = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	p.health.SetServingStatus("", serving)
+}
+
+// trackInterceptor counts in-flight and finished streams so draining can
+// report progress and the admin service can report call totals. It also
+// rejects calls during maintenance, enforces max_concurrent_streams and
+// client quotas and records usage per client.
+func (p *ProxyServer) trackInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	active := p.activeStreams.Add(1)
+	p.metrics.Add("active_streams", 1)
+	defer func() {
+		p.activeStreams.Add(-1)
+		p.metrics.Add("active_streams", -1)
+	}()
+
+	start := time.Now()
+	client, ok, _ := p.clients.authenticate(ss.Context())
+	var usage *usageStream
+	if p.usage.enabled() || len(client.Quotas) > 0 || p.config.SlowRequestThreshold > 0 || p.accessLogEnabled() {
+		usage = &usageStream{ServerStream: ss}
+		ss = usage
+	}
+
+	var err error
+	if m := p.maintenance.Load(); m != nil {
+		p.metrics.Add("maintenance_rejected", 1)
+		ss.SetTrailer(metadata.Pairs(retryPushbackHeader, strconv.FormatInt(m.retryAfter.Milliseconds(), 10)))
+		err = p.maintenanceError(m)
+	} else if max := p.config.MaxConcurrentStreams; max > 0 && active > int64(max) {
+		p.metrics.Add("concurrency_rejected", 1)
+		err = status.Errorf(codes.ResourceExhausted, "endpoint %s is at its limit of %d concurrent streams", p.config.Name, max)
+	} else if reset, quotaErr := p.quotas.check(client); quotaErr != nil {
+		p.metrics.Add("quota_rejected", 1)
+		ss.SetHeader(metadata.Pairs(quotaResetHeader, reset.Format(time.RFC3339)))
+		err = quotaErr
+	} else {
+		err = handler(srv, ss)
+		if ok && usage != nil {
+			p.quotas.add(client, usage.bytesIn.Load()+usage.bytesOut.Load())
+		}
+	}
+	if usage != nil {
+		p.usage.add(p.config.Name, client.Name, usage.bytesIn.Load(), usage.bytesOut.Load(), err != nil)
+	}
+	p.callsTotal.Add(1)
+	p.metrics.Add("calls_total", 1)
+	if err != nil {
+		p.callsFailed.Add(1)
+		p.metrics.Add("calls_failed", 1)
+	}
+	elapsed := time.Since(start)
+	p.recent.record(elapsed, err != nil)
+	p.recordSLOs(info.FullMethod, elapsed, err)
+	if p.methodMetrics != nil {
+		p.methodMetrics.record(info.FullMethod, elapsed, err)
+	}
+	if threshold := p.config.SlowRequestThreshold; threshold > 0 && elapsed > threshold {
+		height := incomingHeader(ss.Context(), blockHeightHeader)
+		p.logSlowCall(info.FullMethod, requestIDFromContext(ss.Context()), height, elapsed, usage.bytesIn.Load(), usage.bytesOut.Load(), client.Name, peerAddress(ss.Context()), status.Code(err).String())
+	}
+	if p.accessLogEnabled() {
+		p.logAccess(info.FullMethod, requestIDFromContext(ss.Context()), status.Code(err).String(), err != nil, elapsed, usage.bytesIn.Load(), usage.bytesOut.Load(), client.Name, peerAddress(ss.Context()))
+	}
+	return err
+}
+
+// Stop gracefully stops the proxy server, waiting for all active streams
+func (p *ProxyServer) Stop() {
+	p.Shutdown(context.Background())
+}
+
+// Shutdown drains the proxy server: health turns NOT_SERVING, new streams are
+// refused and active streams are given until ctx expires to finish before
+// they are cancelled.
+func (p *ProxyServer) Shutdown(ctx context.Context) error {
+	_, err := p.drain(ctx)
+	return err
+}
+
+// drain implements Shutdown and also reports how many streams were still
+// active when ctx expired and had to be cancelled
+func (p *ProxyServer) drain(ctx context.Context) (int64, error) {
+	var err error
+	var remaining int64
+	if p.httpServer != nil {
+		p.health.Shutdown()
+		remaining, err = p.drainHTTP(ctx)
+	}
+	if p.server != nil {
+		p.health.Shutdown()
+		p.logf(levelInfo, "Draining proxy server for %s (%d active streams)", p.config.Name, p.activeStreams.Load())
+
+		done := make(chan struct{})
+		go func() {
+			p.server.GracefulStop()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			p.logf(levelInfo, "Stopped proxy server for %s", p.config.Name)
+		case <-ctx.Done():
+			remaining = p.activeStreams.Load()
+			p.logf(levelInfo, "Drain timeout for %s, cancelling %d remaining streams", p.config.Name, remaining)
+			p.server.Stop()
+			<-done
+			err = ctx.Err()
+		}
+	}
+	if p.restServer != nil {
+		if restErr := p.restServer.Shutdown(ctx); restErr != nil {
+			p.restServer.Close()
+			if err == nil {
+				err = restErr
+			}
+		}
+	}
+	p.closeUpstreams()
+	p.mu.Lock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.captureFile != nil {
+		p.captureFile.Close()
+		p.captureFile = nil
+	}
+	p.mu.Unlock()
+	return remaining, err
+}
+
+// closeUpstreams closes all upstream client connections
+func (p *ProxyServer) closeUpstreams() {
+	p.closeOnce.Do(func() { close(p.closed) })
+	if p.upstream != nil {
+		p.upstream.Close()
+	}
+	if p.compareConn != nil {
+		p.compareConn.Close()
+	}
+	if p.hedgeConn != nil {
+		p.hedgeConn.Close()
+	}
+	if p.outliers != nil {
+		p.outliers.close()
+	}
+	if p.affinity != nil {
+		p.affinity.close()
+	}
+	closeRoutes(p.routes)
+	closeFallbacks(p.fallbacks)
+	p.processor.close()
+	if p.httpCancel != nil {
+		p.httpCancel()
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultGRPCMaxMessage is gRPC's own receive limit, which applies unless a
+// size limit raises it
+const defaultGRPCMaxMessage = 4 << 20
+
+// SizeLimitsConfig caps the size of single messages, so oversize requests
+// are rejected before they reach a metered upstream
+type SizeLimitsConfig struct {
+	// MaxRequestBytes and MaxResponseBytes apply to every method of the
+	// endpoint; zero means gRPC's default of 4 MiB
+	MaxRequestBytes  int `mapstructure:"max_request_bytes"`
+	MaxResponseBytes int `mapstructure:"max_response_bytes"`
+
+	// Methods override the endpoint limits for matching methods, first match wins
+	Methods []MethodSizeLimit `mapstructure:"methods"`
+}
+
+// MethodSizeLimit sets the limits of methods starting with Method
+type MethodSizeLimit struct {
+	Method           string `mapstructure:"method"`
+	MaxRequestBytes  int    `mapstructure:"max_request_bytes"`
+	MaxResponseBytes int    `mapstructure:"max_response_bytes"`
+}
+
+// validate checks the limits
+func (c *SizeLimitsConfig) validate() error {
+	if c.MaxRequestBytes < 0 || c.MaxResponseBytes < 0 {
+		return fmt.Errorf("size_limits must not be negative")
+	}
+	for _, m := range c.Methods {
+		if m.Method == "" {
+			return fmt.Errorf("size_limits methods entries require a method")
+		}
+		if m.MaxRequestBytes < 0 || m.MaxResponseBytes < 0 {
+			return fmt.Errorf("size_limits for %s must not be negative", m.Method)
+		}
+	}
+	return nil
+}
+
+// limits returns the request and response limits of fullMethodName, zero
+// when unlimited
+func (c *SizeLimitsConfig) limits(fullMethodName string) (request, response int) {
+	request, response = c.MaxRequestBytes, c.MaxResponseBytes
+	for _, m := range c.Methods {
+		if matchesMethod([]string{m.Method}, fullMethodName) {
+			if m.MaxRequestBytes > 0 {
+				request = m.MaxRequestBytes
+			}
+			if m.MaxResponseBytes > 0 {
+				response = m.MaxResponseBytes
+			}
+			break
+		}
+	}
+	return request, response
+}
+
+// ceilings returns the largest request and response limits configured, to
+// raise gRPC's own receive limits when they are above its default. Zero
+// leaves the default in place.
+func (c *SizeLimitsConfig) ceilings() (request, response int) {
+	request, response = c.MaxRequestBytes, c.MaxResponseBytes
+	for _, m := range c.Methods {
+		request = max(request, m.MaxRequestBytes)
+		response = max(response, m.MaxResponseBytes)
+	}
+	if request <= defaultGRPCMaxMessage {
+		request = 0
+	}
+	if response <= defaultGRPCMaxMessage {
+		response = 0
+	}
+	return request, response
+}
+
+// sizeLimitInterceptor rejects requests and responses above the configured
+// limits. Oversize requests fail with INVALID_ARGUMENT before they are
+// forwarded; oversize responses fail with RESOURCE_EXHAUSTED instead of
+// reaching the client.
+func (p *ProxyServer) sizeLimitInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p.config.SizeLimits == nil {
+		return handler(srv, ss)
+	}
+	request, response := p.config.SizeLimits.limits(info.FullMethod)
+	s := &sizeLimitStream{ServerStream: ss, p: p, method: info.FullMethod, request: request, response: response}
+	err := handler(srv, s)
+	if violation := s.err(); violation != nil {
+		// The proxy handler reports a failed receive as INTERNAL
+		return violation
+	}
+	return err
+}
+
+// sizeLimitStream enforces the limits of one call
+type sizeLimitStream struct {
+	grpc.ServerStream
+	p                 *ProxyServer
+	method            string
+	request, response int
+
+	mu        sync.Mutex
+	violation error
+}
+
+func (s *sizeLimitStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		if status.Code(err) == codes.ResourceExhausted {
+			// gRPC refused the message before reading it
+			return s.reject(status.Errorf(codes.InvalidArgument, "request to %s exceeds the size limit of endpoint '%s': %s",
+				s.method, s.p.config.Name, status.Convert(err).Message()))
+		}
+		return err
+	}
+	if n, ok := messageSize(m); ok && s.request > 0 && n > s.request {
+		return s.reject(status.Errorf(codes.InvalidArgument, "request of %d bytes to %s exceeds the %d byte limit of endpoint '%s'",
+			n, s.method, s.request, s.p.config.Name))
+	}
+	return nil
+}
+
+func (s *sizeLimitStream) SendMsg(m interface{}) error {
+	if n, ok := messageSize(m); ok && s.response > 0 && n > s.response {
+		return s.reject(status.Errorf(codes.ResourceExhausted, "response of %d bytes from %s exceeds the %d byte limit of endpoint '%s'",
+			n, s.method, s.response, s.p.config.Name))
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// reject records err as the call's outcome and counts it
+func (s *sizeLimitStream) reject(err error) error {
+	s.mu.Lock()
+	if s.violation == nil {
+		s.violation = err
+	}
+	s.mu.Unlock()
+	if status.Code(err) == codes.InvalidArgument {
+		s.p.metrics.Add("oversize_requests", 1)
+	} else {
+		s.p.metrics.Add("oversize_responses", 1)
+	}
+	s.p.logf(levelWarn, "Warning: %s", status.Convert(err).Message())
+	return err
+}
+
+// err returns the limit the call broke, if any
+func (s *sizeLimitStream) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.violation
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultSLOWindow is the compliance period when an SLO sets none
+const defaultSLOWindow = 30 * 24 * time.Hour
+
+// SLOConfig declares a latency objective for selected methods, e.g. 99% of
+// bank queries answered successfully within 300ms over 30 days
+type SLOConfig struct {
+	Name string `mapstructure:"name"`
+
+	// Methods are full method name prefixes the SLO covers (default all)
+	Methods []string `mapstructure:"methods"`
+
+	// Latency is the longest a good call may take
+	Latency time.Duration `mapstructure:"latency"`
+
+	// Objective is the percentage of calls that must be good, e.g. 99.9
+	Objective float64 `mapstructure:"objective"`
+
+	// Window is the compliance period (default 30d)
+	Window time.Duration `mapstructure:"window"`
+}
+
+// window returns the configured window or the default
+func (c SLOConfig) window() time.Duration {
+	if c.Window > 0 {
+		return c.Window
+	}
+	return defaultSLOWindow
+}
+
+// validate checks the SLO has a name, a latency and a meaningful objective
+func (c SLOConfig) validate() error {
+	if c.Name == "" || strings.ContainsAny(c.Name, " /") {
+		return fmt.Errorf("slo name '%s' must be non-empty without spaces or slashes", c.Name)
+	}
+	if c.Latency <= 0 {
+		return fmt.Errorf("slo %s requires a latency", c.Name)
+	}
+	if c.Objective <= 0 || c.Objective >= 100 {
+		return fmt.Errorf("slo %s objective must be a percentage between 0 and 100, got %v", c.Name, c.Objective)
+	}
+	if c.Window < 0 || (c.Window > 0 && c.Window < time.Hour) {
+		return fmt.Errorf("slo %s window must be at least 1h", c.Name)
+	}
+	return nil
+}
+
+// sloUpstreamCodes are the failures that count against an SLO. Other
+// errors, such as NOT_FOUND or a client's own deadline being too short for
+// a slow call, are judged by latency alone.
+var sloUpstreamCodes = map[codes.Code]bool{
+	codes.Unknown:          true,
+	codes.DeadlineExceeded: true,
+	codes.Unimplemented:    true,
+	codes.Internal:         true,
+	codes.Unavailable:      true,
+	codes.DataLoss:         true,
+}
+
+// burnAlert is a multiwindow burn rate alert: it fires while both windows
+// burn the error budget faster than threshold. Windows are fractions of the
+// SLO window, so a 30d SLO uses the usual 1h/5m and 6h/30m pairs.
+type burnAlert struct {
+	name        string
+	long, short int64 // divisors of the SLO window
+	threshold   float64
+}
+
+var burnAlerts = []burnAlert{
+	// 2% of the budget in an hour
+	{name: "fast", long: 720, short: 8640, threshold: 14.4},
+	// 5% of the budget in six hours
+	{name: "slow", long: 120, short: 1440, threshold: 6},
+}
+
+const (
+	// sloFineBuckets splits the window into the buckets burn rates are summed
+	// from; the slow alert's long window spans sloFineBuckets/120 of them
+	sloFineBuckets = 43200
+
+	// sloCoarseBuckets splits the window for compliance
+	sloCoarseBuckets = 720
+)
+
+// sloBucket counts the calls in one slice of time
+type sloBucket struct {
+	index      int64
+	total, bad int64
+}
+
+// sloRing keeps the latest buckets of one width
+type sloRing struct {
+	width   time.Duration
+	buckets []sloBucket
+}
+
+func newSLORing(width time.Duration, n int) sloRing {
+	if width <= 0 {
+		width = time.Nanosecond
+	}
+	return sloRing{width: width, buckets: make([]sloBucket, n)}
+}
+
+// add counts a call at now
+func (r *sloRing) add(now time.Time, bad bool) {
+	index := now.UnixNano() / int64(r.width)
+	b := &r.buckets[index%int64(len(r.buckets))]
+	if b.index != index {
+		*b = sloBucket{index: index}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+}
+
+// sum counts the calls in the span ending at now
+func (r *sloRing) sum(now time.Time, span time.Duration) (total, bad int64) {
+	current := now.UnixNano() / int64(r.width)
+	n := int64(span / r.width)
+	if n > int64(len(r.buckets)) {
+		n = int64(len(r.buckets))
+	}
+	for i := int64(0); i < n; i++ {
+		b := r.buckets[(current-i)%int64(len(r.buckets))]
+		if b.index == current-i {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	return total, bad
+}
+
+// sloTracker measures one SLO of an endpoint
+type sloTracker struct {
+	config   SLOConfig
+	endpoint string
+	alerts   *alerter
+	logf     func(level logLevel, format string, args ...interface{})
+
+	mu     sync.Mutex
+	fine   sloRing
+	coarse sloRing
+
+	// firing holds the burn alerts currently firing; evaluated is the fine
+	// bucket they were last evaluated in
+	firing    map[string]bool
+	evaluated int64
+}
+
+func newSLOTracker(p *ProxyServer, config SLOConfig) *sloTracker {
+	window := config.window()
+	return &sloTracker{
+		config:   config,
+		endpoint: p.config.Name,
+		alerts:   p.alerts,
+		logf:     p.logf,
+		// The fine ring covers the longest burn window, plus the bucket in progress
+		fine:   newSLORing(window/sloFineBuckets, sloFineBuckets/120+1),
+		coarse: newSLORing(window/sloCoarseBuckets, sloCoarseBuckets+1),
+		firing: make(map[string]bool),
+	}
+}
+
+// matches reports whether the SLO covers fullMethodName
+func (t *sloTracker) matches(fullMethodName string) bool {
+	return len(t.config.Methods) == 0 || matchesMethod(t.config.Methods, fullMethodName)
+}
+
+// record counts a finished call and evaluates the burn alerts once per
+// fine bucket
+func (t *sloTracker) record(d time.Duration, err error) {
+	bad := d > t.config.Latency || sloUpstreamCodes[status.Code(err)]
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fine.add(now, bad)
+	t.coarse.add(now, bad)
+	if index := now.UnixNano() / int64(t.fine.width); index != t.evaluated {
+		t.evaluated = index
+		t.evaluate(now)
+	}
+}
+
+// burnRate is how many times faster than sustainable the budget burned
+// over span; the caller holds mu
+func (t *sloTracker) burnRate(now time.Time, span time.Duration) float64 {
+	total, bad := t.fine.sum(now, span)
+	if total == 0 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - t.config.Objective/100)
+}
+
+// evaluate starts and ends burn alerts; the caller holds mu
+func (t *sloTracker) evaluate(now time.Time) {
+	window := t.config.window()
+	for _, a := range burnAlerts {
+		long := window / time.Duration(a.long)
+		rate := t.burnRate(now, long)
+		burning := rate > a.threshold && t.burnRate(now, window/time.Duration(a.short)) > a.threshold
+		switch {
+		case burning && !t.firing[a.name]:
+			t.firing[a.name] = true
+			_, remaining := t.compliance(now)
+			t.logf(levelWarn, "Warning: endpoint %s: SLO %s is burning its error budget %.1fx too fast over the last %s; %.1f%% of the budget remains", t.endpoint, t.config.Name, rate, long, remaining*100)
+			t.alerts.send(AlertSLOBurn, t.endpoint, "SLO %s (%v%% under %s) is burning its error budget %.1fx too fast over the last %s (%s burn); %.1f%% of the budget remains",
+				t.config.Name, t.config.Objective, t.config.Latency, rate, long, a.name, remaining*100)
+		case !burning && t.firing[a.name]:
+			t.firing[a.name] = false
+			t.logf(levelInfo, "Endpoint %s: SLO %s %s burn has stopped", t.endpoint, t.config.Name, a.name)
+		}
+	}
+}
+
+// compliance returns the percentage of good calls over the window and the
+// fraction of the error budget left; the caller holds mu
+func (t *sloTracker) compliance(now time.Time) (float64, float64) {
+	total, bad := t.coarse.sum(now, t.config.window())
+	if total == 0 {
+		return 100, 1
+	}
+	allowed := float64(total) * (1 - t.config.Objective/100)
+	return 100 * float64(total-bad) / float64(total), 1 - float64(bad)/allowed
+}
+
+// publish exports the SLO's compliance, remaining budget and burn rates in
+// the endpoint's metrics, computed when they are read
+func (t *sloTracker) publish(metrics *expvar.Map) {
+	prefix := "slo_" + t.config.Name + "_"
+	locked := func(f func(now time.Time) float64) expvar.Func {
+		return func() interface{} {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			return f(time.Now())
+		}
+	}
+	metrics.Set(prefix+"compliance", locked(func(now time.Time) float64 {
+		c, _ := t.compliance(now)
+		return c
+	}))
+	metrics.Set(prefix+"budget_remaining", locked(func(now time.Time) float64 {
+		_, r := t.compliance(now)
+		return r
+	}))
+	for _, a := range burnAlerts {
+		span := t.config.window() / time.Duration(a.long)
+		metrics.Set(prefix+"burn_rate_"+a.name, locked(func(now time.Time) float64 {
+			return t.burnRate(now, span)
+		}))
+	}
+}
+
+// newSLOTrackers validates the SLOs of p and starts tracking them
+func newSLOTrackers(p *ProxyServer, configs []SLOConfig) ([]*sloTracker, error) {
+	var trackers []*sloTracker
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate slo name '%s'", c.Name)
+		}
+		names[c.Name] = true
+		t := newSLOTracker(p, c)
+		t.publish(p.metrics)
+		trackers = append(trackers, t)
+	}
+	return trackers, nil
+}
+
+// recordSLOs counts a finished call towards every SLO covering it
+func (p *ProxyServer) recordSLOs(fullMethodName string, d time.Duration, err error) {
+	for _, t := range p.slos {
+		if t.matches(fullMethodName) {
+			t.record(d, err)
+		}
+	}
+}
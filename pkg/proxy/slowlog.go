@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// logSlowCall warns about a call that took longer than slow_request_threshold.
+// height is the block height the call pinned, if any, and client the
+// caller's client name, if it sent an API key.
+func (p *ProxyServer) logSlowCall(method, id, height string, elapsed time.Duration, bytesIn, bytesOut int64, client, addr, result string) {
+	p.metrics.Add("slow_calls", 1)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Warning: slow call on %s: %s took %s", p.config.Name, method, elapsed.Round(time.Millisecond))
+	if height != "" {
+		fmt.Fprintf(&b, " at height %s", height)
+	}
+	fmt.Fprintf(&b, " (%s, request %d bytes, response %d bytes) from %s", result, bytesIn, bytesOut, addr)
+	if client != "" {
+		fmt.Fprintf(&b, ", client %s", client)
+	}
+	fmt.Fprintf(&b, ", request %s", id)
+	p.logf(levelWarn, "%s", b.String())
+}
+
+// peerAddress returns the network address of the caller, or "local" when
+// it is not known, e.g. on a unix socket
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil && p.Addr.String() != "" {
+		return p.Addr.String()
+	}
+	return "local"
+}
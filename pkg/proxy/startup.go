@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+)
+
+// Startup policies decide what Start does when some endpoints cannot start
+const (
+	// StartupStrict refuses to start unless every endpoint can be created,
+	// binds its listener and reaches its upstream
+	StartupStrict = "strict"
+
+	// StartupPartial starts every endpoint it can and reports the others as
+	// failed on /readyz, the status page and the start_failed metric
+	StartupPartial = "partial"
+)
+
+// validateStartupPolicy checks startup_policy
+func (c *ProxyConfig) validateStartupPolicy() error {
+	switch c.StartupPolicy {
+	case "", StartupStrict, StartupPartial:
+		return nil
+	}
+	return fmt.Errorf("startup_policy must be %s or %s, got %q", StartupStrict, StartupPartial, c.StartupPolicy)
+}
+
+// markFailed records that the named endpoint is not serving because of err.
+// Callers must hold m.mu.
+func (m *Manager) markFailed(name string, err error) {
+	log.Printf("Warning: endpoint %s is not serving: %v", name, err)
+	m.failed[name] = err
+	endpointMetrics(name).Set("start_failed", intVar(1))
+}
+
+// clearFailed forgets a failure of the named endpoint once it serves again.
+// Callers must hold m.mu.
+func (m *Manager) clearFailed(name string) {
+	if _, ok := m.failed[name]; ok {
+		delete(m.failed, name)
+		endpointMetrics(name).Set("start_failed", intVar(0))
+	}
+}
+
+// pruneFailed forgets the failures of endpoints config no longer has.
+// Callers must hold m.mu.
+func (m *Manager) pruneFailed(config *ProxyConfig) {
+	wanted := make(map[string]bool, len(config.Endpoints))
+	for _, e := range config.Endpoints {
+		wanted[e.Name] = true
+	}
+	for name := range m.failed {
+		if !wanted[name] {
+			delete(m.failed, name)
+		}
+	}
+}
+
+// failure returns why the named endpoint is not serving, if it failed
+func (m *Manager) failure(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed[name]
+}
+
+// startPartially drops the servers that failed, closing their upstreams and
+// recording them as failed, and returns the others. Callers must hold m.mu.
+func (m *Manager) startPartially(servers []*ProxyServer, errs []error) []*ProxyServer {
+	var ok []*ProxyServer
+	for i, p := range servers {
+		if errs[i] != nil {
+			p.closeUpstreams()
+			m.markFailed(p.Name(), errs[i])
+			continue
+		}
+		ok = append(ok, p)
+	}
+	return ok
+}
+
+// withValidEndpoints returns a copy of config without the endpoints whose
+// own settings are invalid, recording those as failed. Callers must hold m.mu.
+func (m *Manager) withValidEndpoints(config *ProxyConfig) *ProxyConfig {
+	valid := *config
+	valid.Endpoints = nil
+	for _, e := range config.Endpoints {
+		if err := e.Validate(); err != nil {
+			m.markFailed(e.Name, err)
+			continue
+		}
+		valid.Endpoints = append(valid.Endpoints, e)
+	}
+	return &valid
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	defaultStatsdHost     = "127.0.0.1"
+	defaultStatsdPort     = 8125
+	defaultStatsdPrefix   = "grpc_proxy."
+	defaultStatsdInterval = 10 * time.Second
+
+	// statsdPacketSize keeps datagrams within a typical MTU
+	statsdPacketSize = 1432
+)
+
+// StatsdConfig pushes every endpoint's metrics to a statsd or DogStatsD
+// agent, for hosts where nothing scrapes the proxy
+type StatsdConfig struct {
+	Host string `mapstructure:"host"` // default 127.0.0.1
+	Port int    `mapstructure:"port"` // default 8125
+
+	// Prefix starts every metric name (default "grpc_proxy.")
+	Prefix string `mapstructure:"prefix"`
+
+	// Interval is how often metrics are sent (default 10s)
+	Interval time.Duration `mapstructure:"interval"`
+
+	// DogStatsD tags metrics with the endpoint name, Tags and the
+	// endpoint's metric_tags. Plain statsd puts the endpoint in the name.
+	DogStatsD bool     `mapstructure:"dogstatsd"`
+	Tags      []string `mapstructure:"tags"`
+}
+
+// address returns the agent's host:port
+func (c *StatsdConfig) address() string {
+	host, port := c.Host, c.Port
+	if host == "" {
+		host = defaultStatsdHost
+	}
+	if port == 0 {
+		port = defaultStatsdPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// prefix returns the configured prefix or the default
+func (c *StatsdConfig) prefix() string {
+	if c.Prefix != "" {
+		return c.Prefix
+	}
+	return defaultStatsdPrefix
+}
+
+// interval returns the configured interval or the default
+func (c *StatsdConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return defaultStatsdInterval
+}
+
+// validate checks the port, interval and tags
+func (c *StatsdConfig) validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("statsd port %d is out of range", c.Port)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("statsd interval must not be negative")
+	}
+	return validateMetricTags("statsd tags", c.Tags)
+}
+
+// validateMetricTags rejects tags that would break the DogStatsD line format
+func validateMetricTags(field string, tags []string) error {
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, ",|#\n ") {
+			return fmt.Errorf("%s: invalid tag '%s'", field, tag)
+		}
+	}
+	return nil
+}
+
+// statsdGauges are the integer metrics that hold a current value rather
+// than count events. Lane in-flight counts, floats and computed metrics
+// such as the SLO figures are gauges as well.
+var statsdGauges = map[string]bool{
+	"active_streams":         true,
+	"connections":            true,
+	"max_concurrent_streams": true,
+	"cache_entries":          true,
+	"chain_id_mismatch":      true,
+	"latest_height":          true,
+	"maintenance":            true,
+	"upstream_ejected":       true,
+	"upstream_height":        true,
+	"upstream_lag_blocks":    true,
+	"upstream_stale":         true,
+	"upstream_tier":          true,
+	"affinity_sessions":      true,
+	"start_failed":           true,
+}
+
+// statsdExporter sends the endpoints' expvar metrics to a statsd agent:
+// counters as the change since the previous send, gauges as their value.
+// One exporter is owned by a Manager; until it is configured it sends nothing.
+type statsdExporter struct {
+	mu        sync.Mutex
+	config    *StatsdConfig
+	endpoints []Config
+	conn      net.Conn
+	last      map[string]int64
+	failing   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// configure starts, restarts or stops sending for config, exporting the
+// metrics of endpoints
+func (s *statsdExporter) configure(config *StatsdConfig, endpoints []Config) error {
+	s.mu.Lock()
+	s.endpoints = endpoints
+	same := reflect.DeepEqual(s.config, config)
+	s.mu.Unlock()
+	if same {
+		return nil
+	}
+
+	s.Close()
+	if config == nil {
+		return nil
+	}
+	conn, err := net.Dial("udp", config.address())
+	if err != nil {
+		return fmt.Errorf("failed to set up statsd: %v", err)
+	}
+
+	s.mu.Lock()
+	s.config = config
+	s.conn = conn
+	s.last = make(map[string]int64)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+
+	go s.sendEvery(config.interval())
+	log.Printf("Sending metrics to statsd at %s every %s", config.address(), config.interval())
+	return nil
+}
+
+// sendEvery sends the metrics every interval until Close
+func (s *statsdExporter) sendEvery(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.send()
+		}
+	}
+}
+
+// send writes the current metrics of every endpoint to the agent
+func (s *statsdExporter) send() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return
+	}
+
+	var packet bytes.Buffer
+	var sendErr error
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil && sendErr == nil {
+			sendErr = err
+		}
+		packet.Reset()
+	}
+	for _, endpoint := range s.endpoints {
+		metrics, ok := proxyMetrics.Get(endpoint.Name).(*expvar.Map)
+		if !ok {
+			continue
+		}
+		metrics.Do(func(kv expvar.KeyValue) {
+			line := s.line(endpoint, kv.Key, kv.Value)
+			if line == "" {
+				return
+			}
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+				flush()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		})
+	}
+	flush()
+
+	// Log once per outage rather than every interval
+	switch {
+	case sendErr != nil && !s.failing:
+		s.failing = true
+		log.Printf("Warning: failed to send metrics to statsd at %s: %v", s.config.address(), sendErr)
+	case sendErr == nil && s.failing:
+		s.failing = false
+		log.Printf("Sending metrics to statsd at %s again", s.config.address())
+	}
+}
+
+// line formats one metric, or returns "" for values statsd cannot carry;
+// the caller holds mu
+func (s *statsdExporter) line(endpoint Config, name string, v expvar.Var) string {
+	var value string
+	kind := "g"
+	switch v := v.(type) {
+	case *expvar.Int:
+		n := v.Value()
+		if !statsdGauges[name] && !strings.HasSuffix(name, "_inflight") {
+			key := endpoint.Name + "\x00" + name
+			delta := n - s.last[key]
+			s.last[key] = n
+			// A counter that went backwards was reset, e.g. by a restart in a test
+			if delta < 0 {
+				delta = n
+			}
+			kind = "c"
+			n = delta
+		}
+		value = strconv.FormatInt(n, 10)
+	case *expvar.Float:
+		value = strconv.FormatFloat(v.Value(), 'f', -1, 64)
+	case expvar.Func:
+		switch f := v.Value().(type) {
+		case float64:
+			value = strconv.FormatFloat(f, 'f', -1, 64)
+		case int64:
+			value = strconv.FormatInt(f, 10)
+		default:
+			return ""
+		}
+	case *expvar.String:
+		// The upstream state becomes a 0/1 gauge
+		if name != "upstream_state" {
+			return ""
+		}
+		name = "upstream_ready"
+		value = "0"
+		if v.Value() == connectivity.Ready.String() {
+			value = "1"
+		}
+	default:
+		return ""
+	}
+
+	prefix := s.config.prefix()
+	if !s.config.DogStatsD {
+		return prefix + statsdName(endpoint.Name) + "." + name + ":" + value + "|" + kind
+	}
+	tags := append([]string{"endpoint:" + statsdName(endpoint.Name)}, s.config.Tags...)
+	tags = append(tags, endpoint.MetricTags...)
+	return prefix + name + ":" + value + "|" + kind + "|#" + strings.Join(tags, ",")
+}
+
+// statsdName replaces the characters the statsd line format reserves
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Close sends the final metrics and stops the exporter
+func (s *statsdExporter) Close() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop = nil
+	s.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+
+	s.send()
+	s.mu.Lock()
+	s.conn.Close()
+	s.conn = nil
+	s.config = nil
+	s.mu.Unlock()
+}
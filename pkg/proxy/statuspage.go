@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// statusRefreshSeconds is how often the status page reloads itself
+const statusRefreshSeconds = 15
+
+// endpointStatus is one endpoint on the status page and in /status.json
+type endpointStatus struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Upstream      string `json:"upstream"`
+	Up            bool   `json:"up"`
+	Serving       string `json:"serving_status"`
+	UpstreamState string `json:"upstream_state,omitempty"`
+
+	// Problem explains why the endpoint is out of service, if known
+	Problem string `json:"problem,omitempty"`
+
+	ActiveStreams int64 `json:"active_streams"`
+
+	// RecentCalls is how many of the latest calls the latency and error
+	// rate are computed over
+	RecentCalls int     `json:"recent_calls"`
+	P50Millis   float64 `json:"p50_ms"`
+	P99Millis   float64 `json:"p99_ms"`
+	ErrorRate   float64 `json:"error_rate"`
+
+	TokenExpires *time.Time `json:"token_expires,omitempty"`
+}
+
+// status describes p for the status page
+func (p *ProxyServer) status() endpointStatus {
+	config := p.Config()
+	s := endpointStatus{
+		Name:          config.Name,
+		Type:          TypeGRPC,
+		Upstream:      config.RemoteAddress,
+		Serving:       p.ServingStatus().String(),
+		ActiveStreams: p.ActiveStreams(),
+	}
+	s.Up = s.Serving == healthpb.HealthCheckResponse_SERVING.String()
+	if config.Type == TypeHTTP {
+		s.Type = TypeHTTP
+	} else {
+		s.UpstreamState = p.UpstreamState().String()
+	}
+	if m := p.maintenance.Load(); m != nil {
+		s.Problem = m.String()
+	} else if mismatch := p.chainMismatch.Load(); mismatch != nil {
+		s.Problem = mismatch.Error()
+	} else if stale := p.stale.Load(); stale != nil {
+		s.Problem = *stale
+	}
+
+	stats := p.recent.stats()
+	s.RecentCalls = stats.calls
+	s.P50Millis = float64(stats.p50.Microseconds()) / 1000
+	s.P99Millis = float64(stats.p99.Microseconds()) / 1000
+	s.ErrorRate = stats.errorRate
+
+	if claims, err := DecodeToken(p.Token()); err == nil && !claims.ExpiresAt.IsZero() {
+		expires := claims.ExpiresAt.UTC()
+		s.TokenExpires = &expires
+	}
+	return s
+}
+
+// adminHandler serves the read-only status page at / and its data at
+// /status.json, the /healthz and /readyz probes, and with debug pprof and
+// expvar under /debug/
+func (m *Manager) adminHandler(debug bool) http.Handler {
+	mux := http.NewServeMux()
+	if debug {
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", m.handleReadyz)
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Time      time.Time        `json:"time"`
+			Endpoints []endpointStatus `json:"endpoints"`
+		}{time.Now().UTC(), m.endpointStatuses()})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		endpoints := m.endpointStatuses()
+		up := 0
+		for _, e := range endpoints {
+			if e.Up {
+				up++
+			}
+		}
+		warning := defaultAlertTokenExpiry
+		if config := m.alerts.config.Load(); config != nil {
+			warning = config.tokenExpiry()
+		}
+		err := statusPage.Execute(w, map[string]interface{}{
+			"Time":         time.Now().UTC().Format(time.RFC1123),
+			"Refresh":      statusRefreshSeconds,
+			"Endpoints":    endpoints,
+			"Up":           up,
+			"TokenWarning": warning,
+		})
+		if err != nil {
+			log.Printf("Failed to render status page: %v", err)
+		}
+	})
+	return mux
+}
+
+// endpointStatuses describes every running endpoint, sorted by name,
+// followed by the endpoints that failed to start
+func (m *Manager) endpointStatuses() []endpointStatus {
+	var statuses []endpointStatus
+	for _, p := range m.Servers() {
+		statuses = append(statuses, p.status())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.config.Endpoints {
+		err, failed := m.failed[e.Name]
+		if !failed || m.servers[e.Name] != nil {
+			continue
+		}
+		s := endpointStatus{
+			Name:     e.Name,
+			Type:     TypeGRPC,
+			Upstream: e.RemoteAddress,
+			Serving:  healthpb.HealthCheckResponse_NOT_SERVING.String(),
+			Problem:  "failed to start: " + err.Error(),
+		}
+		if e.Type == TypeHTTP {
+			s.Type = TypeHTTP
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// formatExpiry describes how long until a token expires
+func formatExpiry(expires time.Time) string {
+	left := time.Until(expires)
+	switch {
+	case left <= 0:
+		return "expired"
+	case left < time.Hour:
+		return fmt.Sprintf("in %dm", int(left.Minutes()))
+	case left < 48*time.Hour:
+		return fmt.Sprintf("in %dh", int(left.Hours()))
+	}
+	return fmt.Sprintf("in %dd", int(left.Hours()/24))
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"expiry":   formatExpiry,
+	"expiring": func(expires time.Time, warning time.Duration) bool { return time.Until(expires) < warning },
+	"percent":  func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"millis": func(ms float64) string {
+		if ms >= 1000 {
+			return fmt.Sprintf("%.2fs", ms/1000)
+		}
+		return fmt.Sprintf("%.1fms", ms)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>gRPC proxy status</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { padding: .4em .8em; border-bottom: 1px solid #ddd; text-align: left; }
+td.num { text-align: right; }
+.up { color: #17803d; font-weight: bold; }
+.down { color: #c0271d; font-weight: bold; }
+.warn { color: #b86e00; }
+.problem { color: #666; font-size: .9em; }
+footer { margin-top: 1em; color: #666; font-size: .9em; }
+</style>
+</head>
+<body>
+<h1>gRPC proxy status</h1>
+<p>{{if eq .Up (len .Endpoints)}}<span class="up">All {{len .Endpoints}} endpoints are up.</span>{{else}}<span class="down">{{.Up}} of {{len .Endpoints}} endpoints are up.</span>{{end}}</p>
+<table>
+<tr><th>Endpoint</th><th>Upstream</th><th>Status</th><th>Connection</th><th>Active</th><th>p50</th><th>p99</th><th>Errors</th><th>Token expires</th></tr>
+{{- range .Endpoints}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.Upstream}}</td>
+<td>{{if .Up}}<span class="up">Up</span>{{else}}<span class="down">Down</span>{{end}}{{with .Problem}}<div class="problem">{{.}}</div>{{end}}</td>
+<td>{{if .UpstreamState}}{{.UpstreamState}}{{else}}per request{{end}}</td>
+<td class="num">{{.ActiveStreams}}</td>
+{{- if .RecentCalls}}
+<td class="num">{{millis .P50Millis}}</td>
+<td class="num">{{millis .P99Millis}}</td>
+<td class="num{{if gt .ErrorRate 0.05}} warn{{end}}">{{percent .ErrorRate}}</td>
+{{- else}}
+<td class="num">-</td><td class="num">-</td><td class="num">-</td>
+{{- end}}
+<td>{{with .TokenExpires}}<span{{if expiring . $.TokenWarning}} class="warn"{{end}} title="{{.Format "2006-01-02 15:04 MST"}}">{{expiry .}}</span>{{else}}-{{end}}</td>
+</tr>
+{{- end}}
+</table>
+<footer>Latency and error rate cover each endpoint's latest calls. Updated {{.Time}}; this page refreshes every {{.Refresh}} seconds.</footer>
+</body>
+</html>
+`))
+
+// adminListener hands the connections of a shared admin listener to either
+// the gRPC server or the status page, depending on whether a connection
+// opens with the HTTP/2 client preface
+type adminListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  *sync.Once
+}
+
+// splitAdminListener returns listeners for the gRPC and HTTP/1 connections
+// accepted by lis. Closing either closes lis.
+func splitAdminListener(lis net.Listener) (grpcLis, httpLis net.Listener) {
+	done := make(chan struct{})
+	once := &sync.Once{}
+	g := &adminListener{Listener: lis, conns: make(chan net.Conn), done: done, once: once}
+	h := &adminListener{Listener: lis, conns: make(chan net.Conn), done: done, once: once}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				g.Close()
+				return
+			}
+			go func() {
+				// A client that never sends anything must not hold a goroutine forever
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				r := bufio.NewReader(conn)
+				preface, err := r.Peek(3)
+				conn.SetReadDeadline(time.Time{})
+				if err != nil {
+					conn.Close()
+					return
+				}
+				target := h
+				if string(preface) == "PRI" {
+					target = g
+				}
+				select {
+				case target.conns <- &peekedConn{Conn: conn, r: r}:
+				case <-done:
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	return g, h
+}
+
+func (l *adminListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *adminListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// peekedConn replays the bytes peeked from a connection before reading on
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
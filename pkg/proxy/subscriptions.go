@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWebSocketPingInterval is how often supervised upstream sockets are pinged
+const defaultWebSocketPingInterval = 20 * time.Second
+
+// maxPendingWebSocketMessages bounds what a client may send while its
+// upstream is reconnecting; further messages are dropped
+const maxPendingWebSocketMessages = 100
+
+// WebSocketConfig makes an http endpoint terminate WebSocket connections
+// itself so it can keep them alive: a dropped upstream socket is redialed and
+// the client's CometBFT subscriptions are replayed on it
+type WebSocketConfig struct {
+	// PingInterval is how often the upstream is pinged (default 20s); an
+	// upstream silent for two intervals is treated as dropped
+	PingInterval time.Duration `mapstructure:"ping_interval"`
+}
+
+// pingInterval returns the configured ping interval or the default
+func (c *WebSocketConfig) pingInterval() time.Duration {
+	if c.PingInterval > 0 {
+		return c.PingInterval
+	}
+	return defaultWebSocketPingInterval
+}
+
+// jsonRPCMessage is the part of a CometBFT JSON-RPC request or response the
+// supervisor inspects
+type jsonRPCMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// subscriptionQuery returns the query of subscribe/unsubscribe params, which
+// CometBFT accepts by name ({"query": ...}) or by position ([...])
+func subscriptionQuery(params json.RawMessage) string {
+	var named struct {
+		Query string `json:"query"`
+	}
+	if json.Unmarshal(params, &named) == nil && named.Query != "" {
+		return named.Query
+	}
+	var positional []string
+	if json.Unmarshal(params, &positional) == nil && len(positional) > 0 {
+		return positional[0]
+	}
+	return ""
+}
+
+// wsSubscription is a subscribe request to replay after a reconnect
+type wsSubscription struct {
+	id      string
+	query   string
+	message []byte
+
+	// sent is set once an upstream has acknowledged or been sent the
+	// request, so the replayed acknowledgement is not passed on again
+	sent bool
+}
+
+// wsSession relays one client WebSocket to a supervised upstream socket
+type wsSession struct {
+	p         *ProxyServer
+	target    *url.URL
+	header    http.Header
+	tlsConfig *tls.Config
+	client    *wsConn
+
+	// dropped is signalled when the current upstream socket goes away
+	dropped chan struct{}
+
+	mu            sync.Mutex
+	upstream      *wsConn
+	subscriptions []*wsSubscription
+	replayed      map[string]bool
+	pending       []wsMessage
+}
+
+// wsMessage is a data message queued while the upstream reconnects
+type wsMessage struct {
+	opcode  byte
+	payload []byte
+}
+
+// superviseWebSockets serves WebSocket upgrades to target through a
+// supervised session and passes any other request to next
+func (p *ProxyServer) superviseWebSockets(target *url.URL, tlsConfig *tls.Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := *target
+		u.Path = singleJoiningSlash(target.Path, r.URL.Path)
+		u.RawQuery = r.URL.RawQuery
+
+		header := r.Header.Clone()
+		for _, h := range []string{"Connection", "Upgrade", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", apiKeyHeader} {
+			header.Del(h)
+		}
+		client, ok := clientFromContext(r.Context())
+		p.auth.setHeader(header, u.Path, p.upstreamToken(r.Context(), client, ok))
+		if p.config.AuthorityOverride != "" {
+			header.Set("Host", p.config.AuthorityOverride)
+		}
+
+		s := &wsSession{
+			p:         p,
+			target:    &u,
+			header:    header,
+			tlsConfig: tlsConfig,
+			dropped:   make(chan struct{}, 1),
+			replayed:  make(map[string]bool),
+		}
+		upstream, err := s.dial(r.Context())
+		if err != nil {
+			p.logf(levelWarn, "HTTP proxy %s failed to open WebSocket to %s: %v", p.config.Name, u.Host, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if s.client, err = acceptWebSocket(w, r); err != nil {
+			upstream.Close()
+			return
+		}
+		s.run(r.Context(), upstream)
+	})
+}
+
+// singleJoiningSlash joins a target base path and a request path like the
+// reverse proxy does
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// dial opens an upstream socket within the endpoint's connect timeout
+func (s *wsSession) dial(ctx context.Context) (*wsConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.p.config.Connect.timeout())
+	defer cancel()
+	// A reconnect needs a fresh signature timestamp
+	s.p.auth.hmac.signHeader(s.header, s.target.Path)
+	return dialWebSocket(ctx, s.target, s.header, s.tlsConfig)
+}
+
+// run relays messages until the client goes away or ctx is cancelled,
+// redialing the upstream whenever it drops
+func (s *wsSession) run(ctx context.Context, upstream *wsConn) {
+	name := s.p.config.Name
+	s.upstream = upstream
+	go s.readUpstream(upstream)
+
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		s.readClient()
+	}()
+
+	defer func() {
+		s.mu.Lock()
+		if s.upstream != nil {
+			s.upstream.Close()
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-clientGone:
+			s.client.Close()
+			return
+		case <-ctx.Done():
+			s.client.closeWith(1001, "proxy shutting down")
+			return
+		case <-s.dropped:
+		}
+
+		s.p.logf(levelWarn, "HTTP proxy %s: WebSocket upstream %s dropped, reconnecting", name, s.target.Host)
+		for retries := 0; ; retries++ {
+			select {
+			case <-clientGone:
+				s.client.Close()
+				return
+			case <-ctx.Done():
+				s.client.closeWith(1001, "proxy shutting down")
+				return
+			case <-time.After(s.p.config.Connect.backoffDelay(retries)):
+			}
+			upstream, err := s.dial(ctx)
+			if err != nil {
+				s.p.logf(levelWarn, "HTTP proxy %s: WebSocket reconnect to %s failed: %v", name, s.target.Host, err)
+				continue
+			}
+			replayed := s.resume(upstream)
+			s.p.metrics.Add("websocket_reconnects", 1)
+			s.p.logf(levelInfo, "HTTP proxy %s: WebSocket upstream %s reconnected, replayed %d subscriptions", name, s.target.Host, replayed)
+			go s.readUpstream(upstream)
+			break
+		}
+	}
+}
+
+// resume makes upstream current, replays the active subscriptions on it
+// and flushes messages queued while disconnected
+func (s *wsSession) resume(upstream *wsConn) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upstream = upstream
+	for _, sub := range s.subscriptions {
+		if sub.sent {
+			s.replayed[sub.id] = true
+		}
+		sub.sent = true
+		upstream.writeMessage(wsText, sub.message)
+	}
+	for _, m := range s.pending {
+		upstream.writeMessage(m.opcode, m.payload)
+	}
+	s.pending = nil
+	return len(s.subscriptions)
+}
+
+// readClient forwards client messages upstream, recording subscriptions,
+// until the client closes its socket
+func (s *wsSession) readClient() {
+	for {
+		op, data, err := s.client.readMessage()
+		if err != nil {
+			return
+		}
+		switch op {
+		case wsPing:
+			s.client.writeMessage(wsPong, data)
+		case wsPong:
+		case wsClose:
+			s.client.writeMessage(wsClose, data)
+			return
+		default:
+			s.forward(op, data)
+		}
+	}
+}
+
+// forward sends a client message to the current upstream, or queues it
+// while reconnecting. Subscribe requests are recorded for replay instead of
+// being queued.
+func (s *wsSession) forward(op byte, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscribe := op == wsText && s.track(data)
+	if s.upstream != nil {
+		if subscribe {
+			s.subscriptions[len(s.subscriptions)-1].sent = true
+		}
+		// A failed write surfaces as a read error on the upstream socket
+		s.upstream.writeMessage(op, data)
+		return
+	}
+	if subscribe {
+		return
+	}
+	if len(s.pending) >= maxPendingWebSocketMessages {
+		s.p.logf(levelWarn, "HTTP proxy %s: dropping WebSocket message while reconnecting to %s", s.p.config.Name, s.target.Host)
+		return
+	}
+	s.pending = append(s.pending, wsMessage{op, data})
+}
+
+// track updates the recorded subscriptions from a client request and
+// reports whether it was a subscribe, appended last. Called with s.mu held.
+func (s *wsSession) track(data []byte) bool {
+	var m jsonRPCMessage
+	if json.Unmarshal(data, &m) != nil {
+		return false
+	}
+	switch m.Method {
+	case "subscribe":
+		query := subscriptionQuery(m.Params)
+		if query == "" {
+			return false
+		}
+		s.unsubscribe(query)
+		s.subscriptions = append(s.subscriptions, &wsSubscription{id: string(m.ID), query: query, message: data})
+		return true
+	case "unsubscribe":
+		s.unsubscribe(subscriptionQuery(m.Params))
+	case "unsubscribe_all":
+		s.subscriptions = nil
+	}
+	return false
+}
+
+// unsubscribe forgets the subscription to query. Called with s.mu held.
+func (s *wsSession) unsubscribe(query string) {
+	for i, sub := range s.subscriptions {
+		if sub.query == query {
+			s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// readUpstream forwards upstream messages to the client until the socket
+// fails or stays silent for two ping intervals, then signals dropped
+func (s *wsSession) readUpstream(upstream *wsConn) {
+	interval := s.p.config.WebSocket.pingInterval()
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				upstream.writeMessage(wsPing, nil)
+			}
+		}
+	}()
+
+	for {
+		upstream.conn.SetReadDeadline(time.Now().Add(2 * interval))
+		op, data, err := upstream.readMessage()
+		if err != nil || op == wsClose {
+			break
+		}
+		switch op {
+		case wsPing:
+			upstream.writeMessage(wsPong, data)
+		case wsPong:
+		default:
+			if s.swallow(op, data) {
+				continue
+			}
+			if err := s.client.writeMessage(op, data); err != nil {
+				s.client.Close()
+			}
+		}
+	}
+	close(stop)
+	upstream.Close()
+
+	s.mu.Lock()
+	current := s.upstream == upstream
+	if current {
+		s.upstream = nil
+	}
+	s.mu.Unlock()
+	if current {
+		select {
+		case s.dropped <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// swallow reports whether an upstream message is the successful
+// acknowledgement of a replayed subscribe, which the client already received
+func (s *wsSession) swallow(op byte, data []byte) bool {
+	if op != wsText {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.replayed) == 0 {
+		return false
+	}
+	var m jsonRPCMessage
+	if json.Unmarshal(data, &m) != nil || m.Method != "" {
+		return false
+	}
+	id := string(m.ID)
+	if !s.replayed[id] {
+		return false
+	}
+	if len(m.Error) > 0 && !bytes.Equal(m.Error, []byte("null")) {
+		delete(s.replayed, id)
+		return false
+	}
+	var result map[string]json.RawMessage
+	if json.Unmarshal(m.Result, &result) != nil || len(result) > 0 {
+		// An event for the subscription rather than its acknowledgement
+		return false
+	}
+	delete(s.replayed, id)
+	return true
+}
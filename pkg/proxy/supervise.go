@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+)
+
+const (
+	defaultMaxRestarts       = 5
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = 30 * time.Second
+
+	// supervisionStable is how long an endpoint must serve after a restart
+	// before a later crash starts counting restarts from zero again
+	supervisionStable = time.Minute
+)
+
+// SupervisionConfig tunes how endpoints whose listener stops serving after
+// startup are restarted
+type SupervisionConfig struct {
+	// MaxRestarts is how many restarts in a row are attempted before the
+	// endpoint is given up on (default 5)
+	MaxRestarts int `mapstructure:"max_restarts"`
+
+	// Backoff is the delay before the first restart (default 1s), doubled
+	// after each failed attempt up to MaxBackoff (default 30s)
+	Backoff    time.Duration `mapstructure:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+
+	// ExitOnFailure makes the proxy exit non-zero once an endpoint is
+	// given up on, so a service manager can restart the process
+	ExitOnFailure bool `mapstructure:"exit_on_failure"`
+}
+
+// validate checks the supervision settings
+func (c SupervisionConfig) validate() error {
+	if c.MaxRestarts < 0 || c.Backoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("supervision settings must not be negative")
+	}
+	return nil
+}
+
+// maxRestarts returns the configured restart limit or the default
+func (c SupervisionConfig) maxRestarts() int {
+	if c.MaxRestarts > 0 {
+		return c.MaxRestarts
+	}
+	return defaultMaxRestarts
+}
+
+// backoff returns the configured first restart delay or the default
+func (c SupervisionConfig) backoff() time.Duration {
+	if c.Backoff > 0 {
+		return c.Backoff
+	}
+	return defaultRestartBackoff
+}
+
+// maxBackoff returns the configured longest restart delay or the default
+func (c SupervisionConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff > 0 {
+		return c.MaxBackoff
+	}
+	return defaultMaxRestartBackoff
+}
+
+// Failed receives an error when an endpoint stopped serving and could not
+// be restarted, if supervision.exit_on_failure is set. The caller is
+// expected to stop the manager and exit non-zero.
+func (m *Manager) Failed() <-chan error {
+	return m.fatal
+}
+
+// supervise handles a running endpoint whose Serve returned serveErr: it is
+// reported as failed and restarted in the background. Endpoints that were
+// drained, replaced or stopped meanwhile are left alone.
+func (m *Manager) supervise(p *ProxyServer, started time.Time, serveErr error) {
+	name := p.Name()
+	m.mu.Lock()
+	if m.servers[name] != p {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.servers, name)
+	m.markFailed(name, fmt.Errorf("stopped serving: %v", serveErr))
+	if time.Since(started) >= supervisionStable {
+		delete(m.restarts, name)
+	}
+	timeout := m.config.shutdownTimeout()
+	m.mu.Unlock()
+
+	p.metrics.Add("endpoint_crashes", 1)
+	m.alerts.send(AlertEndpointCrashed, name, "endpoint %s stopped serving: %v", name, serveErr)
+
+	// Let the calls still in flight on the old server finish, then restart
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		p.Shutdown(ctx)
+		cancel()
+		m.restart(p.config)
+	}()
+}
+
+// restart recreates an endpoint that stopped serving, with exponential
+// backoff, until it serves again, a reload or shutdown takes over, or
+// supervision.max_restarts attempts in a row failed
+func (m *Manager) restart(config Config) {
+	m.mu.Lock()
+	supervision := m.config.Supervision
+	m.mu.Unlock()
+
+	delay := supervision.backoff()
+	for {
+		m.mu.Lock()
+		attempt := m.restarts[config.Name] + 1
+		m.restarts[config.Name] = attempt
+		m.mu.Unlock()
+		if attempt > supervision.maxRestarts() {
+			break
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-m.done:
+			return
+		}
+
+		m.mu.Lock()
+		pending := m.awaitsRestart(config)
+		m.mu.Unlock()
+		if !pending {
+			return
+		}
+
+		// Bind without holding m.mu, so a slow bind does not hold up
+		// reloads and admin calls, then check again before serving
+		p, err := NewProxyServer(config, m.opts...)
+		if err == nil {
+			if err = p.Listen(); err != nil {
+				p.closeUpstreams()
+			}
+		}
+		m.mu.Lock()
+		if !m.awaitsRestart(config) {
+			m.mu.Unlock()
+			if err == nil {
+				p.Shutdown(context.Background())
+			}
+			return
+		}
+		if err == nil {
+			log.Printf("Restarted endpoint %s after it stopped serving (attempt %d of %d)", config.Name, attempt, supervision.maxRestarts())
+			p.metrics.Add("endpoint_restarts", 1)
+			m.serve(p)
+			m.mu.Unlock()
+			return
+		}
+		m.markFailed(config.Name, fmt.Errorf("restart %d of %d failed: %v", attempt, supervision.maxRestarts(), err))
+		m.mu.Unlock()
+
+		delay *= 2
+		if delay > supervision.maxBackoff() {
+			delay = supervision.maxBackoff()
+		}
+	}
+
+	err := fmt.Errorf("endpoint %s could not be restarted after %d attempts", config.Name, supervision.maxRestarts())
+	log.Printf("Error: %v; it stays down until the next reload", err)
+	m.alerts.send(AlertEndpointCrashed, config.Name, "%v", err)
+	if supervision.ExitOnFailure {
+		select {
+		case m.fatal <- err:
+		default:
+		}
+	}
+}
+
+// awaitsRestart reports whether config is still a configured endpoint that
+// is not running, so a reload has neither removed, changed nor restarted
+// it, and the manager is not shutting down. Callers must hold m.mu.
+func (m *Manager) awaitsRestart(config Config) bool {
+	if m.stopping() || m.servers[config.Name] != nil {
+		return false
+	}
+	for _, e := range m.config.Endpoints {
+		if e.Name == config.Name {
+			return reflect.DeepEqual(e, config)
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// FallbackConfig is a lower-priority upstream an endpoint falls back to
+// while every upstream above it is unreachable, e.g. a public rate-limited
+// node behind a paid one
+type FallbackConfig struct {
+	RemoteAddress string `mapstructure:"remote_address"`
+	UseTLS        bool   `mapstructure:"use_tls"`
+
+	// JWTToken is sent to this upstream. Without one, calls carry no
+	// authorization header, so the endpoint's token never reaches another
+	// provider.
+	JWTToken string `mapstructure:"jwt_token"`
+}
+
+// upstreamTier is a fallback upstream with its connection
+type upstreamTier struct {
+	config FallbackConfig
+	conn   *grpc.ClientConn
+}
+
+// newFallbacks validates the fallback tiers and dials every one of them
+func newFallbacks(configs []FallbackConfig, extra ...grpc.DialOption) ([]*upstreamTier, error) {
+	tiers := make([]*upstreamTier, 0, len(configs))
+	for i, c := range configs {
+		if c.RemoteAddress == "" {
+			closeFallbacks(tiers)
+			return nil, fmt.Errorf("fallback %d has no remote_address", i+1)
+		}
+		conn, err := dialUpstream(c.RemoteAddress, tlsOrInsecure(c.UseTLS), extra...)
+		if err != nil {
+			closeFallbacks(tiers)
+			return nil, fmt.Errorf("failed to connect to fallback upstream %s: %v", c.RemoteAddress, err)
+		}
+		conn.Connect()
+		tiers = append(tiers, &upstreamTier{config: c, conn: conn})
+	}
+	return tiers, nil
+}
+
+// closeFallbacks closes the connections of tiers
+func closeFallbacks(tiers []*upstreamTier) {
+	for _, t := range tiers {
+		t.conn.Close()
+	}
+}
+
+// tierReachable reports whether an upstream may take calls: anything but a
+// failed or closed connection
+func tierReachable(conn *grpc.ClientConn) bool {
+	state := conn.GetState()
+	return state != connectivity.TransientFailure && state != connectivity.Shutdown
+}
+
+// activeFallback returns the fallback tier calls go to, or nil while they
+// go to the endpoint's upstream
+func (p *ProxyServer) activeFallback() *upstreamTier {
+	tier := int(p.tier.Load())
+	if tier == 0 || tier > len(p.fallbacks) {
+		return nil
+	}
+	return p.fallbacks[tier-1]
+}
+
+// tierAddress returns the upstream address of a tier, 0 being remote_address
+func (p *ProxyServer) tierAddress(tier int) string {
+	if tier == 0 {
+		return p.config.RemoteAddress
+	}
+	return p.fallbacks[tier-1].config.RemoteAddress
+}
+
+// selectTier moves calls to the highest reachable tier. With none
+// reachable, calls go to the endpoint's upstream.
+func (p *ProxyServer) selectTier() {
+	p.tierMu.Lock()
+	defer p.tierMu.Unlock()
+
+	next := 0
+	if !tierReachable(p.upstream) {
+		for i, t := range p.fallbacks {
+			if tierReachable(t.conn) {
+				next = i + 1
+				break
+			}
+		}
+	}
+	current := int(p.tier.Load())
+	if next == current {
+		return
+	}
+	p.tier.Store(int32(next))
+	p.metrics.Set("upstream_tier", intVar(int64(next)))
+	p.metrics.Add("upstream_tier_changes", 1)
+	if next > current {
+		p.logf(levelWarn, "Warning: %s falls back to tier %d upstream %s, as %s is unreachable", p.config.Name, next, p.tierAddress(next), p.tierAddress(current))
+		p.alerts.send(AlertUpstreamTier, p.config.Name, "%s fell back to tier %d upstream %s, as %s is unreachable", p.config.Name, next, p.tierAddress(next), p.tierAddress(current))
+	} else {
+		p.logf(levelInfo, "%s is back on tier %d upstream %s", p.config.Name, next, p.tierAddress(next))
+		p.alerts.send(AlertUpstreamTier, p.config.Name, "%s is back on tier %d upstream %s", p.config.Name, next, p.tierAddress(next))
+	}
+}
+
+// watchTier reselects the tier whenever the state of conn changes. Idle
+// connections are reconnected right away, so a dropped upstream shows as
+// unreachable instead of waiting for the next call.
+func (p *ProxyServer) watchTier(conn *grpc.ClientConn) {
+	state := conn.GetState()
+	for state != connectivity.Shutdown {
+		if !conn.WaitForStateChange(context.Background(), state) {
+			return
+		}
+		state = conn.GetState()
+		if state == connectivity.Idle {
+			conn.Connect()
+		}
+		p.selectTier()
+	}
+}
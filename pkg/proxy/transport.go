@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/alts"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Upstream protocols selectable with upstream_protocol
+const (
+	// ProtocolTLS is HTTP/2 over TLS, the default when use_tls is set
+	ProtocolTLS = "tls"
+	// ProtocolH2C is cleartext HTTP/2 with prior knowledge, the default otherwise
+	ProtocolH2C = "h2c"
+	// ProtocolALTS is Google's Application Layer Transport Security, for upstreams on GCP
+	ProtocolALTS = "alts"
+)
+
+// upstreamCredentials returns the transport credentials for an endpoint's
+// upstream_protocol. An empty protocol falls back to use_tls. roots holds the
+// CA bundle from ca_file or ca_ref, if any.
+func upstreamCredentials(config Config, roots *rootCAs) (credentials.TransportCredentials, error) {
+	protocol := config.UpstreamProtocol
+	if protocol == "" {
+		protocol = ProtocolH2C
+		if config.UseTLS {
+			protocol = ProtocolTLS
+		}
+	} else if config.UseTLS && protocol != ProtocolTLS {
+		return nil, fmt.Errorf("upstream_protocol %q conflicts with use_tls", protocol)
+	}
+
+	if protocol != ProtocolTLS && (roots != nil || config.ServerName != "" || config.InsecureSkipVerify) {
+		return nil, fmt.Errorf("ca_file, ca_ref, server_name and insecure_skip_verify require TLS to the upstream")
+	}
+
+	switch protocol {
+	case ProtocolTLS:
+		return credentials.NewTLS(upstreamTLSConfig(config, roots)), nil
+	case ProtocolH2C:
+		return insecure.NewCredentials(), nil
+	case ProtocolALTS:
+		return alts.NewClientCreds(alts.DefaultClientOptions()), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream_protocol %q (expected %s, %s or %s)", protocol, ProtocolTLS, ProtocolH2C, ProtocolALTS)
+	}
+}
+
+// upstreamTLSConfig builds the client TLS configuration for an endpoint
+func upstreamTLSConfig(config Config, roots *rootCAs) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1024),
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.InsecureSkipVerify {
+		log.Printf("Warning: endpoint %s does not verify the upstream TLS certificate", config.Name)
+	} else if roots != nil {
+		// Verify against the current pool ourselves so a rotated ca_file
+		// applies to new connections without redialing
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = roots.verify
+	}
+	return tlsConfig
+}
+
+// rootCAs holds the CA pool an upstream certificate is verified against
+type rootCAs struct {
+	pool atomic.Pointer[x509.CertPool]
+}
+
+// newRootCAs loads ca_file, or the bundle read from ca_ref; it returns nil
+// when neither is set and the system roots apply
+func newRootCAs(config Config, caPEM []byte) (*rootCAs, error) {
+	source := config.CARef
+	if config.CAFile != "" {
+		var err error
+		caPEM, err = os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %v", err)
+		}
+		source = config.CAFile
+	}
+	if caPEM == nil {
+		return nil, nil
+	}
+	roots := &rootCAs{}
+	if err := roots.set(caPEM, source); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// set replaces the pool with the certificates in caPEM
+func (r *rootCAs) set(caPEM []byte, source string) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", source)
+	}
+	r.pool.Store(pool)
+	return nil
+}
+
+// verify checks the upstream's certificate chain and name like crypto/tls would
+func (r *rootCAs) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("upstream presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         r.pool.Load(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// tlsOrInsecure returns default TLS credentials or cleartext HTTP/2
+func tlsOrInsecure(useTLS bool) credentials.TransportCredentials {
+	if !useTLS {
+		return insecure.NewCredentials()
+	}
+	return credentials.NewTLS(&tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1024),
+	})
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+)
+
+// defaultConnectTimeout bounds the startup connectivity check
+const defaultConnectTimeout = 10 * time.Second
+
+// ConnectConfig tunes how the upstream connection is established and retried
+type ConnectConfig struct {
+	// Timeout is how long startup waits for the upstream to become ready
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// Required makes startup fail when the upstream is not ready within Timeout;
+	// otherwise a warning is logged and the connection keeps retrying
+	Required bool `mapstructure:"required"`
+
+	// Reconnect backoff; unset values use gRPC's defaults (1s, x1.6, 120s)
+	BaseDelay  time.Duration `mapstructure:"base_delay"`
+	Multiplier float64       `mapstructure:"multiplier"`
+	MaxDelay   time.Duration `mapstructure:"max_delay"`
+}
+
+// timeout returns the configured startup check timeout or the default
+func (c ConnectConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultConnectTimeout
+}
+
+// backoff returns the reconnect backoff with unset values defaulted
+func (c ConnectConfig) backoff() backoff.Config {
+	b := backoff.DefaultConfig
+	if c.BaseDelay > 0 {
+		b.BaseDelay = c.BaseDelay
+	}
+	if c.Multiplier > 0 {
+		b.Multiplier = c.Multiplier
+	}
+	if c.MaxDelay > 0 {
+		b.MaxDelay = c.MaxDelay
+	}
+	return b
+}
+
+// dialOption converts the backoff settings into a grpc dial option
+func (c ConnectConfig) dialOption() grpc.DialOption {
+	return grpc.WithConnectParams(grpc.ConnectParams{Backoff: c.backoff()})
+}
+
+// backoffDelay returns how long to wait before reconnect attempt retries
+// (counting from 0), growing and jittered like gRPC's own reconnects
+func (c ConnectConfig) backoffDelay(retries int) time.Duration {
+	b := c.backoff()
+	delay := float64(b.BaseDelay)
+	for ; retries > 0 && delay < float64(b.MaxDelay); retries-- {
+		delay *= b.Multiplier
+	}
+	delay = math.Min(delay, float64(b.MaxDelay))
+	delay *= 1 + b.Jitter*(rand.Float64()*2-1)
+	return time.Duration(delay)
+}
+
+// waitForUpstream connects eagerly and blocks until the upstream is ready or
+// the connect timeout expires
+func (p *ProxyServer) waitForUpstream() error {
+	// HTTP endpoints have no long-lived upstream connection to wait for
+	if p.upstream == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Connect.timeout())
+	defer cancel()
+
+	p.upstream.Connect()
+	for {
+		state := p.upstream.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !p.upstream.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("upstream %s not ready after %s (state %s)",
+				p.config.RemoteAddress, p.config.Connect.timeout(), state)
+		}
+	}
+}
+
+// watchUpstream logs upstream connectivity transitions and publishes the
+// current state until the connection is closed
+func (p *ProxyServer) watchUpstream() {
+	state := p.upstream.GetState()
+	// down alerts once per outage, while reconnects keep failing
+	down := false
+	for state != connectivity.Shutdown {
+		p.metrics.Set("upstream_state", stringVar(state.String()))
+		if !p.upstream.WaitForStateChange(context.Background(), state) {
+			return
+		}
+		next := p.upstream.GetState()
+		switch next {
+		case connectivity.Ready:
+			p.logf(levelInfo, "Upstream %s for %s is READY", p.config.RemoteAddress, p.config.Name)
+			if down {
+				down = false
+				p.alerts.send(AlertEndpointUp, p.config.Name, "upstream %s for %s is ready again", p.config.RemoteAddress, p.config.Name)
+			}
+		case connectivity.Idle:
+			// A dropped connection only reconnects on the next call; with
+			// alerts, reconnect now so an outage is noticed without traffic
+			if p.alerts.enabled() {
+				p.upstream.Connect()
+			}
+		case connectivity.TransientFailure:
+			p.logf(levelWarn, "Upstream %s for %s is in TRANSIENT_FAILURE, reconnecting with backoff", p.config.RemoteAddress, p.config.Name)
+			p.metrics.Add("upstream_failures", 1)
+			if !down {
+				down = true
+				p.alerts.send(AlertEndpointDown, p.config.Name, "upstream %s for %s is unreachable", p.config.RemoteAddress, p.config.Name)
+			}
+		}
+		state = next
+	}
+	p.metrics.Set("upstream_state", stringVar(state.String()))
+}
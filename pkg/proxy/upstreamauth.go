@@ -0,0 +1,425 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Upstream auth types
+const (
+	// AuthBearer sends jwt_token as a bearer token (default)
+	AuthBearer = "bearer"
+
+	// AuthBasic sends a username and password with HTTP basic auth
+	AuthBasic = "basic"
+
+	// AuthRaw sends jwt_token as it is, without a scheme
+	AuthRaw = "raw"
+
+	// AuthHMAC signs every call with a shared secret, sending jwt_token as
+	// a bearer token as well when it is set
+	AuthHMAC = "hmac"
+)
+
+// UpstreamAuthConfig selects how calls authenticate to the upstream
+type UpstreamAuthConfig struct {
+	// Type is bearer (default), basic, raw or hmac
+	Type string `mapstructure:"type"`
+
+	// Header carries the credential instead of authorization, e.g.
+	// x-api-key for a raw token
+	Header string `mapstructure:"header"`
+
+	// Username and Password of type basic. Without a password jwt_token is
+	// the password, so it can be read through jwt_token_ref.
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+
+	// HMAC configures the signatures of type hmac
+	HMAC *HMACAuthConfig `mapstructure:"hmac"`
+}
+
+// HMACAuthConfig signs each upstream call over its method and the current
+// time. The signed string is the full method name, or the request path for
+// http endpoints, a newline and the Unix time in seconds.
+type HMACAuthConfig struct {
+	KeyID  string `mapstructure:"key_id"`
+	Secret string `mapstructure:"secret"`
+
+	// Algorithm is sha256 (default) or sha512
+	Algorithm string `mapstructure:"algorithm"`
+
+	// Encoding of the signature, hex (default) or base64
+	Encoding string `mapstructure:"encoding"`
+
+	// Header names, by default x-auth-key-id, x-auth-timestamp and
+	// x-auth-signature
+	KeyIDHeader     string `mapstructure:"key_id_header"`
+	TimestampHeader string `mapstructure:"timestamp_header"`
+	SignatureHeader string `mapstructure:"signature_header"`
+
+	// ClockSkew is added to the local clock for the timestamp, for upstreams
+	// whose clock is known to be off
+	ClockSkew time.Duration `mapstructure:"clock_skew"`
+}
+
+// Default HMAC header names
+const (
+	defaultHMACKeyIDHeader     = "x-auth-key-id"
+	defaultHMACTimestampHeader = "x-auth-timestamp"
+	defaultHMACSignatureHeader = "x-auth-signature"
+)
+
+// authType returns the configured auth type or the default
+func (c *UpstreamAuthConfig) authType() string {
+	if c == nil || c.Type == "" {
+		return AuthBearer
+	}
+	return c.Type
+}
+
+// header returns the name of the header carrying the credential
+func (c *UpstreamAuthConfig) header() string {
+	if c == nil || c.Header == "" {
+		return "authorization"
+	}
+	return strings.ToLower(c.Header)
+}
+
+// needsToken reports whether calls carry nothing without jwt_token
+func (c *UpstreamAuthConfig) needsToken() bool {
+	switch c.authType() {
+	case AuthHMAC:
+		return false
+	case AuthBasic:
+		return c.Password == ""
+	}
+	return true
+}
+
+// validate checks the auth type and its settings. A nil config uses the
+// default.
+func (c *UpstreamAuthConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.authType() {
+	case AuthBearer, AuthRaw:
+	case AuthBasic:
+		if c.Username == "" || strings.Contains(c.Username, ":") {
+			return fmt.Errorf("auth type basic needs a username without colons")
+		}
+	case AuthHMAC:
+		if c.HMAC == nil {
+			return fmt.Errorf("auth type hmac needs an hmac section")
+		}
+		if err := c.HMAC.validate(); err != nil {
+			return err
+		}
+		for _, name := range c.HMAC.headers() {
+			if name == c.header() {
+				return fmt.Errorf("auth hmac uses header %q twice", name)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported auth type %q (expected bearer, basic, raw or hmac)", c.Type)
+	}
+	if c.HMAC != nil && c.authType() != AuthHMAC {
+		return fmt.Errorf("auth hmac needs type: hmac")
+	}
+	if (c.Username != "" || c.Password != "") && c.authType() != AuthBasic {
+		return fmt.Errorf("auth username and password need type: basic")
+	}
+	if reservedHeader(c.header()) {
+		return fmt.Errorf("auth may not use header %q", c.header())
+	}
+	return nil
+}
+
+// reservedHeader reports whether gRPC itself uses a header
+func reservedHeader(name string) bool {
+	return strings.HasPrefix(name, "grpc-") || strings.HasPrefix(name, ":")
+}
+
+// validate checks the key, algorithm, encoding and header names
+func (c *HMACAuthConfig) validate() error {
+	if c.KeyID == "" || c.Secret == "" {
+		return fmt.Errorf("auth hmac needs key_id and secret")
+	}
+	if _, ok := hmacHashes[c.algorithm()]; !ok {
+		return fmt.Errorf("unsupported auth hmac algorithm %q (expected sha256 or sha512)", c.Algorithm)
+	}
+	switch c.Encoding {
+	case "", "hex", "base64":
+	default:
+		return fmt.Errorf("unsupported auth hmac encoding %q (expected hex or base64)", c.Encoding)
+	}
+	names := make(map[string]bool, 3)
+	for _, name := range c.headers() {
+		if name == "authorization" || reservedHeader(name) {
+			return fmt.Errorf("auth hmac may not use header %q", name)
+		}
+		if names[name] {
+			return fmt.Errorf("auth hmac uses header %q twice", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// hmacHashes are the supported signature algorithms
+var hmacHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// algorithm returns the configured algorithm or the default
+func (c *HMACAuthConfig) algorithm() string {
+	if c.Algorithm == "" {
+		return "sha256"
+	}
+	return strings.ToLower(c.Algorithm)
+}
+
+// headers returns the key id, timestamp and signature header names
+func (c *HMACAuthConfig) headers() [3]string {
+	names := [3]string{defaultHMACKeyIDHeader, defaultHMACTimestampHeader, defaultHMACSignatureHeader}
+	for i, name := range []string{c.KeyIDHeader, c.TimestampHeader, c.SignatureHeader} {
+		if name != "" {
+			names[i] = strings.ToLower(name)
+		}
+	}
+	return names
+}
+
+// hmacSigner adds signature headers to upstream calls. A nil signer adds
+// nothing.
+type hmacSigner struct {
+	config  *HMACAuthConfig
+	newHash func() hash.Hash
+	headers [3]string
+}
+
+// newHMACSigner returns the signer of a validated auth config, or nil if
+// it does not use hmac
+func newHMACSigner(config *UpstreamAuthConfig) *hmacSigner {
+	if config.authType() != AuthHMAC {
+		return nil
+	}
+	return &hmacSigner{
+		config:  config.HMAC,
+		newHash: hmacHashes[config.HMAC.algorithm()],
+		headers: config.HMAC.headers(),
+	}
+}
+
+// sign returns the timestamp and signature of a call to method at now
+func (s *hmacSigner) sign(method string, now time.Time) (string, string) {
+	timestamp := strconv.FormatInt(now.Add(s.config.ClockSkew).Unix(), 10)
+	mac := hmac.New(s.newHash, []byte(s.config.Secret))
+	mac.Write([]byte(method + "\n" + timestamp))
+	sum := mac.Sum(nil)
+	if s.config.Encoding == "base64" {
+		return timestamp, base64.StdEncoding.EncodeToString(sum)
+	}
+	return timestamp, hex.EncodeToString(sum)
+}
+
+// set calls set with each header of a call to method
+func (s *hmacSigner) set(method string, set func(name, value string)) {
+	if s == nil {
+		return
+	}
+	timestamp, signature := s.sign(method, time.Now())
+	set(s.headers[0], s.config.KeyID)
+	set(s.headers[1], timestamp)
+	set(s.headers[2], signature)
+}
+
+// signMetadata adds the headers of a call to method to md, replacing any
+// the client sent
+func (s *hmacSigner) signMetadata(md metadata.MD, method string) {
+	s.set(method, func(name, value string) { md[name] = []string{value} })
+}
+
+// unsignMetadata removes the headers from md, for a call to another upstream
+func (s *hmacSigner) unsignMetadata(md metadata.MD) {
+	if s == nil {
+		return
+	}
+	for _, name := range s.headers {
+		delete(md, name)
+	}
+}
+
+// signHeader adds the headers of an HTTP request for path to h
+func (s *hmacSigner) signHeader(h http.Header, path string) {
+	s.set(path, h.Set)
+}
+
+// upstreamAuth puts credentials into the calls to an endpoint's upstream.
+// A nil upstreamAuth sends a token as a bearer token on authorization, as
+// calls to fallbacks and to compare and hedge upstreams with tokens of their
+// own do.
+type upstreamAuth struct {
+	config *UpstreamAuthConfig
+	header string
+	hmac   *hmacSigner
+
+	// minter signs the endpoint's tokens when mint_jwt is configured
+	minter *jwtMinter
+
+	// renewer renews the endpoint's token with oidc or token_refresh
+	renewer *tokenRenewer
+
+	// last caches the credential of the last token forwarded
+	last atomic.Pointer[credentialHeader]
+}
+
+// credentialHeader is the header value sent for a token, nil if there is
+// nothing to send
+type credentialHeader struct {
+	token string
+	value []string
+}
+
+// newUpstreamAuth returns the auth of an endpoint
+func newUpstreamAuth(endpoint Config) (*upstreamAuth, error) {
+	config := endpoint.Auth
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config != nil {
+		knownSecrets.add(config.Password)
+		if config.HMAC != nil {
+			knownSecrets.add(config.HMAC.Secret)
+		}
+	}
+	a := &upstreamAuth{config: config, header: config.header(), hmac: newHMACSigner(config)}
+	if endpoint.MintJWT != nil {
+		var err error
+		if a.minter, err = newJWTMinter(endpoint.Name, endpoint.MintJWT); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// headerName returns the name of the header carrying the credential
+func (a *upstreamAuth) headerName() string {
+	if a == nil {
+		return "authorization"
+	}
+	return a.header
+}
+
+// tokenFor returns token, or for calls with the endpoint's own token a
+// minted one when mint_jwt is configured
+func (a *upstreamAuth) tokenFor(method, token string) string {
+	if token != "" || a == nil || a.minter == nil {
+		return token
+	}
+	// The minter signed a token when it was created, so it only fails if
+	// the system's random source does
+	minted, _ := a.minter.tokenFor(method, time.Now())
+	return minted
+}
+
+// credential returns the header value for token, built once per token
+// rather than on every call. It is nil if there is nothing to send. The
+// value must not be modified.
+func (a *upstreamAuth) credential(token string) []string {
+	if a == nil {
+		if token == "" {
+			return nil
+		}
+		return []string{"Bearer " + token}
+	}
+	if c := a.last.Load(); c != nil && c.token == token {
+		return c.value
+	}
+	c := &credentialHeader{token: token}
+	if value, ok := a.format(token); ok {
+		c.value = []string{value}
+	}
+	a.last.Store(c)
+	return c.value
+}
+
+// format builds the credential for token
+func (a *upstreamAuth) format(token string) (string, bool) {
+	switch a.config.authType() {
+	case AuthBasic:
+		password := a.config.Password
+		if password == "" {
+			password = token
+		}
+		if password == "" {
+			return "", false
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.config.Username+":"+password)), true
+	case AuthRaw:
+		return token, token != ""
+	default:
+		return "Bearer " + token, token != ""
+	}
+}
+
+// setMetadata replaces the credentials in md, which may hold a client's
+// own, with those of a call to method with token
+func (a *upstreamAuth) setMetadata(md metadata.MD, method, token string) {
+	delete(md, "authorization")
+	if value := a.credential(a.tokenFor(method, token)); value != nil {
+		md[a.headerName()] = value
+	} else {
+		delete(md, a.headerName())
+	}
+	if a != nil {
+		a.hmac.signMetadata(md, method)
+	}
+}
+
+// removeMetadata removes the credentials from md, for a call to another
+// upstream
+func (a *upstreamAuth) removeMetadata(md metadata.MD) {
+	delete(md, "authorization")
+	delete(md, a.headerName())
+	if a != nil {
+		a.hmac.unsignMetadata(md)
+	}
+}
+
+// setHeader replaces the credentials of an HTTP request for path with those
+// for token
+func (a *upstreamAuth) setHeader(h http.Header, path, token string) {
+	h.Del("Authorization")
+	if value := a.credential(a.tokenFor(path, token)); value != nil {
+		h.Set(a.headerName(), value[0])
+	} else {
+		h.Del(a.headerName())
+	}
+	if a != nil {
+		a.hmac.signHeader(h, path)
+	}
+}
+
+// upstreamContext returns ctx carrying the endpoint's credentials for a
+// call the proxy makes to its upstream itself, such as a health check
+func (p *ProxyServer) upstreamContext(ctx context.Context, method string) context.Context {
+	md := metadata.MD{}
+	p.auth.setMetadata(md, method, p.Token())
+	return metadata.NewOutgoingContext(ctx, md)
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// defaultUsageFlushInterval is how often usage counters are appended to the usage file
+const defaultUsageFlushInterval = time.Minute
+
+// UsageConfig records calls, errors and bytes per client and endpoint, for
+// charging upstream costs back to the teams behind each API key
+type UsageConfig struct {
+	// Path appends one JSON record per client and endpoint to this file
+	// every FlushInterval (default 1m) and on shutdown
+	Path          string        `mapstructure:"path"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+// flushInterval returns the configured interval or the default
+func (c *UsageConfig) flushInterval() time.Duration {
+	if c.FlushInterval > 0 {
+		return c.FlushInterval
+	}
+	return defaultUsageFlushInterval
+}
+
+// UsageRecord is one line of the usage file: what one client did on one
+// endpoint between Start and End. Client is empty for calls made without an
+// API key.
+type UsageRecord struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Endpoint string    `json:"endpoint"`
+	Client   string    `json:"client,omitempty"`
+	Calls    int64     `json:"calls"`
+	Errors   int64     `json:"errors"`
+
+	// BytesIn is received from the client, BytesOut sent back to it
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// usageKey identifies the counters of one client on one endpoint
+type usageKey struct {
+	endpoint, client string
+}
+
+// usageLog accumulates usage in memory and appends it to the usage file. One
+// log is shared by a Manager and its endpoints; until it is opened, and on a
+// nil *usageLog, usage is discarded.
+type usageLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	start    time.Time
+	counters map[usageKey]*UsageRecord
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// open starts recording usage and flushing it every flush_interval
+func (u *usageLog) open(config *UsageConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.Path == "" {
+		return fmt.Errorf("usage requires a path")
+	}
+	f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open usage file: %v", err)
+	}
+
+	u.mu.Lock()
+	u.file = f
+	u.start = time.Now().UTC()
+	u.counters = make(map[usageKey]*UsageRecord)
+	u.stop = make(chan struct{})
+	u.done = make(chan struct{})
+	u.mu.Unlock()
+
+	go u.flushEvery(config.flushInterval())
+	return nil
+}
+
+// enabled reports whether usage is being recorded
+func (u *usageLog) enabled() bool {
+	if u == nil {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.file != nil
+}
+
+// add counts one finished call
+func (u *usageLog) add(endpoint, client string, bytesIn, bytesOut int64, failed bool) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file == nil {
+		return
+	}
+	key := usageKey{endpoint, client}
+	r, ok := u.counters[key]
+	if !ok {
+		r = &UsageRecord{Endpoint: endpoint, Client: client}
+		u.counters[key] = r
+	}
+	r.Calls++
+	if failed {
+		r.Errors++
+	}
+	r.BytesIn += bytesIn
+	r.BytesOut += bytesOut
+}
+
+// flushEvery flushes at every interval until Close
+func (u *usageLog) flushEvery(interval time.Duration) {
+	defer close(u.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stop:
+			return
+		case <-ticker.C:
+			u.flush()
+		}
+	}
+}
+
+// flush appends the usage counted since the last flush and resets the counters
+func (u *usageLog) flush() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file == nil {
+		return
+	}
+	end := time.Now().UTC()
+	keys := make([]usageKey, 0, len(u.counters))
+	for key := range u.counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].client < keys[j].client
+	})
+	for _, key := range keys {
+		r := u.counters[key]
+		r.Start, r.End = u.start, end
+		line, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("Failed to encode usage record: %v", err)
+			continue
+		}
+		if _, err := u.file.Write(append(line, '\n')); err != nil {
+			log.Printf("Failed to write usage record: %v", err)
+		}
+	}
+	u.start = end
+	u.counters = make(map[usageKey]*UsageRecord)
+}
+
+// Close flushes the remaining usage and closes the usage file
+func (u *usageLog) Close() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	stop, done := u.stop, u.done
+	u.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+
+	u.flush()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.file.Close()
+	u.file = nil
+	u.stop, u.done = nil, nil
+}
+
+// usageStream counts the bytes of the messages a call receives and sends
+type usageStream struct {
+	grpc.ServerStream
+	bytesIn, bytesOut atomic.Int64
+}
+
+func (s *usageStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if n, ok := messageSize(m); ok && err == nil {
+		s.bytesIn.Add(int64(n))
+	}
+	return err
+}
+
+func (s *usageStream) SendMsg(m interface{}) error {
+	if n, ok := messageSize(m); ok {
+		s.bytesOut.Add(int64(n))
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// ReadUsage parses a usage file written by an endpoint's usage setting
+func ReadUsage(r io.Reader) ([]UsageRecord, error) {
+	var records []UsageRecord
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// SummarizeUsage adds up the records that ended after since and started
+// before until (zero times are unbounded), keeping the client and, when
+// byEndpoint is set, the endpoint apart. The totals are sorted by client,
+// then endpoint, and span the records they add up.
+func SummarizeUsage(records []UsageRecord, since, until time.Time, byEndpoint bool) []UsageRecord {
+	totals := make(map[usageKey]*UsageRecord)
+	for _, r := range records {
+		if (!since.IsZero() && !r.End.After(since)) || (!until.IsZero() && !r.Start.Before(until)) {
+			continue
+		}
+		key := usageKey{client: r.Client}
+		if byEndpoint {
+			key.endpoint = r.Endpoint
+		}
+		t, ok := totals[key]
+		if !ok {
+			t = &UsageRecord{Start: r.Start, End: r.End, Endpoint: key.endpoint, Client: r.Client}
+			totals[key] = t
+		}
+		if r.Start.Before(t.Start) {
+			t.Start = r.Start
+		}
+		if r.End.After(t.End) {
+			t.End = r.End
+		}
+		t.Calls += r.Calls
+		t.Errors += r.Errors
+		t.BytesIn += r.BytesIn
+		t.BytesOut += r.BytesOut
+	}
+
+	summary := make([]UsageRecord, 0, len(totals))
+	for _, t := range totals {
+		summary = append(summary, *t)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Client != summary[j].Client {
+			return summary[i].Client < summary[j].Client
+		}
+		return summary[i].Endpoint < summary[j].Endpoint
+	})
+	return summary
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExpandVars applies the vars and endpoint_defaults sections of a raw
+// configuration, as read from YAML, to its endpoints in place:
+//
+//   - endpoint_defaults is merged under every endpoint; keys an endpoint
+//     sets itself win, and nested sections are merged key by key
+//   - ${name} in the endpoint's strings is replaced by the variable, from
+//     the endpoint's own vars or the top-level ones, and index is the
+//     endpoint's position in the list
+//   - ${a + b - 1} adds and subtracts integer variables and literals
+//   - $${ is a literal ${
+//
+// A string that is a single ${...} takes the variable's type, so numbers
+// and booleans can be set too. Variable names are case-insensitive, since
+// configuration keys are.
+func ExpandVars(settings map[string]interface{}) error {
+	globals, err := varsSection(settings["vars"], "vars")
+	if err != nil {
+		return err
+	}
+	defaults, _ := settings["endpoint_defaults"].(map[string]interface{})
+	if settings["endpoint_defaults"] != nil && defaults == nil {
+		return fmt.Errorf("endpoint_defaults must be a map")
+	}
+	endpoints, _ := settings["endpoints"].([]interface{})
+
+	for i, e := range endpoints {
+		endpoint, ok := e.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("endpoint %d must be a map", i+1)
+		}
+		endpoint = mergeDefaults(defaults, endpoint)
+
+		vars := map[string]interface{}{"index": i}
+		for name, value := range globals {
+			vars[name] = value
+		}
+		own, err := varsSection(endpoint["vars"], fmt.Sprintf("vars of endpoint %d", i+1))
+		if err != nil {
+			return err
+		}
+		for name, value := range own {
+			vars[name] = value
+		}
+		delete(endpoint, "vars")
+
+		expanded, err := expandValue(endpoint, vars)
+		if err != nil {
+			return fmt.Errorf("endpoint %d: %v", i+1, err)
+		}
+		endpoints[i] = expanded
+	}
+	delete(settings, "vars")
+	delete(settings, "endpoint_defaults")
+	return nil
+}
+
+// varsSection returns a vars map with lowercased names
+func varsSection(section interface{}, what string) (map[string]interface{}, error) {
+	if section == nil {
+		return nil, nil
+	}
+	raw, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a map", what)
+	}
+	vars := make(map[string]interface{}, len(raw))
+	for name, value := range raw {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", what, name)
+		}
+		vars[strings.ToLower(name)] = value
+	}
+	return vars, nil
+}
+
+// mergeDefaults returns endpoint with the keys of defaults it does not set,
+// merging nested maps
+func mergeDefaults(defaults, endpoint map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(defaults)+len(endpoint))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range endpoint {
+		d, dok := merged[key].(map[string]interface{})
+		e, eok := value.(map[string]interface{})
+		if dok && eok {
+			value = mergeDefaults(d, e)
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// expandValue returns a copy of value with the variables in its strings replaced
+func expandValue(value interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return expandString(v, vars)
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			e, err := expandValue(item, vars)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			expanded[key] = e
+		}
+		return expanded, nil
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			e, err := expandValue(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			expanded[i] = e
+		}
+		return expanded, nil
+	}
+	return value, nil
+}
+
+// expandString replaces the ${...} expressions in s
+func expandString(s string, vars map[string]interface{}) (interface{}, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	// A single expression keeps the type of its value
+	if strings.HasPrefix(s, "${") && strings.Index(s, "}") == len(s)-1 {
+		return evalVarExpr(s[2:len(s)-1], vars)
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if start > 0 && s[start-1] == '$' {
+			b.WriteString(s[:start-1] + "${")
+			s = s[start+2:]
+			continue
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated ${ in %q", s)
+		}
+		value, err := evalVarExpr(s[start+2:start+end], vars)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(s[:start])
+		b.WriteString(fmt.Sprint(value))
+		s = s[start+end+1:]
+	}
+}
+
+// evalVarExpr evaluates a variable name, or a sum of integer variables and
+// literals such as "base_port + index - 1"
+func evalVarExpr(expr string, vars map[string]interface{}) (interface{}, error) {
+	tokens := strings.Fields(strings.NewReplacer("+", " + ", "-", " - ").Replace(expr))
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty ${}")
+	}
+	if len(tokens) == 1 {
+		return lookupVar(tokens[0], vars)
+	}
+
+	total, sign := 0, 1
+	expectTerm := true
+	for _, token := range tokens {
+		if !expectTerm {
+			switch token {
+			case "+":
+				sign = 1
+			case "-":
+				sign = -1
+			default:
+				return nil, fmt.Errorf("invalid expression ${%s}", expr)
+			}
+			expectTerm = true
+			continue
+		}
+		value, err := lookupVar(token, vars)
+		if err != nil {
+			return nil, err
+		}
+		n, err := varInt(value)
+		if err != nil {
+			return nil, fmt.Errorf("${%s}: %s is not an integer", expr, token)
+		}
+		total += sign * n
+		expectTerm = false
+	}
+	if expectTerm {
+		return nil, fmt.Errorf("invalid expression ${%s}", expr)
+	}
+	return total, nil
+}
+
+// lookupVar returns an integer literal or the value of a variable
+func lookupVar(token string, vars map[string]interface{}) (interface{}, error) {
+	if n, err := strconv.Atoi(token); err == nil {
+		return n, nil
+	}
+	value, ok := vars[strings.ToLower(token)]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %q", token)
+	}
+	return value, nil
+}
+
+// varInt converts a variable to an integer
+func varInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case string:
+		return strconv.Atoi(strings.TrimSpace(v))
+	}
+	return 0, fmt.Errorf("not an integer: %v", value)
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultConfig configures the HashiCorp Vault secrets backend. References look
+// like vault:secret/data/chandra#cosmos_token, naming the API path to read and
+// the field of its data to use.
+type VaultConfig struct {
+	// Address defaults to $VAULT_ADDR
+	Address string `mapstructure:"address"`
+
+	// Token authenticates to Vault; it defaults to the contents of TokenFile,
+	// then $VAULT_TOKEN
+	Token     string `mapstructure:"token"`
+	TokenFile string `mapstructure:"token_file"`
+
+	// Namespace selects a Vault Enterprise namespace
+	Namespace string `mapstructure:"namespace"`
+
+	// CAFile verifies Vault's certificate instead of the system roots
+	CAFile string `mapstructure:"ca_file"`
+}
+
+// vaultBackend reads secrets over Vault's HTTP API
+type vaultBackend struct {
+	address   string
+	token     string
+	tokenFile string
+	namespace string
+	client    *http.Client
+}
+
+func newVaultBackend(config VaultConfig) (*vaultBackend, error) {
+	v := &vaultBackend{
+		address:   strings.TrimSuffix(config.Address, "/"),
+		token:     config.Token,
+		tokenFile: config.TokenFile,
+		namespace: config.Namespace,
+	}
+	if v.address == "" {
+		v.address = strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	}
+	if v.address == "" {
+		return nil, fmt.Errorf("vault address is not set (secrets.vault.address or VAULT_ADDR)")
+	}
+	if v.token == "" && v.tokenFile == "" {
+		v.token = os.Getenv("VAULT_TOKEN")
+		if v.token == "" {
+			return nil, fmt.Errorf("vault token is not set (secrets.vault.token, token_file or VAULT_TOKEN)")
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vault ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in vault ca_file %s", config.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	v.client = &http.Client{Transport: transport, Timeout: secretFetchTimeout}
+	return v, nil
+}
+
+// vaultResponse is the part of a Vault read response the proxy uses
+type vaultResponse struct {
+	LeaseDuration int             `json:"lease_duration"`
+	Data          json.RawMessage `json:"data"`
+	Errors        []string        `json:"errors"`
+}
+
+// fetch reads path#field. KV version 2 responses nest the secret under
+// data.data; everything else carries it directly in data.
+func (v *vaultBackend) fetch(ctx context.Context, ref string) (secret, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return secret{}, fmt.Errorf("vault reference must name a field: <path>#<field>")
+	}
+
+	token := v.token
+	if v.tokenFile != "" {
+		// Re-read on every fetch so an agent rotating the file is picked up
+		b, err := os.ReadFile(v.tokenFile)
+		if err != nil {
+			return secret{}, fmt.Errorf("failed to read vault token_file: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.address+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return secret{}, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return secret{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return secret{}, err
+	}
+
+	var parsed vaultResponse
+	if err := json.Unmarshal(body, &parsed); err != nil && resp.StatusCode == http.StatusOK {
+		return secret{}, fmt.Errorf("invalid vault response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(parsed.Errors) > 0 {
+			return secret{}, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(parsed.Errors, "; "))
+		}
+		return secret{}, fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(parsed.Data, &data); err != nil {
+		return secret{}, fmt.Errorf("invalid vault response data: %v", err)
+	}
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, kv2 := data["metadata"]; kv2 {
+			data = inner
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return secret{}, fmt.Errorf("field %q not found in vault secret %s", field, path)
+	}
+	return secret{value: value, ttl: time.Duration(parsed.LeaseDuration) * time.Second}, nil
+}
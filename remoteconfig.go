@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+const (
+	// remoteConfigTimeout bounds reading the remote config
+	remoteConfigTimeout = 30 * time.Second
+
+	// remoteWatchRetry is how long to wait before watching again after a
+	// watch failed
+	remoteWatchRetry = 5 * time.Second
+)
+
+var (
+	remoteConfig string
+	remoteSource *proxy.RemoteConfigSource
+)
+
+// readRemoteConfig reads the config document from the remote source into viper
+func readRemoteConfig() error {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+	data, err := remoteSource.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", remoteSource, err)
+	}
+	viper.SetConfigType(remoteSource.Format())
+	return viper.ReadConfig(bytes.NewReader(data))
+}
+
+// watchRemoteConfig requests a reload through signals whenever the remote
+// config changes. Failed watches are logged and retried.
+func watchRemoteConfig(signals chan<- os.Signal) {
+	for {
+		if _, err := remoteSource.Watch(context.Background()); err != nil {
+			log.Printf("Warning: watching %s failed, retrying in %s: %v", remoteSource, remoteWatchRetry, err)
+			time.Sleep(remoteWatchRetry)
+			continue
+		}
+		log.Printf("Remote config %s changed", remoteSource)
+		signals <- syscall.SIGHUP
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+var (
+	replayTarget  string
+	replayTLS     bool
+	replayToken   string
+	replayMethod  string
+	replayTimeout time.Duration
+)
+
+// replayCmd re-sends calls recorded by an endpoint's capture setting
+var replayCmd = &cobra.Command{
+	Use:   "replay <capture-file>",
+	Short: "Re-send captured calls against an upstream",
+	Long: `Re-send the calls recorded in a capture file against a gRPC server and
+report, for each call, whether the status code and response messages match
+what was recorded.
+
+The target can be the proxy itself, which injects the endpoint's token, or an
+upstream directly together with --token.`,
+	Example: `  grpc-proxy replay --target localhost:9090 capture.jsonl
+  grpc-proxy replay --target cosmos-grpc-api.chandrastation.com:443 --tls --token $JWT capture.jsonl`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", args[0], err)
+		}
+		calls, err := proxy.ReadCapture(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", args[0], err)
+		}
+
+		creds := insecure.NewCredentials()
+		if replayTLS {
+			creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		}
+		conn, err := grpc.NewClient(replayTarget, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %v", replayTarget, err)
+		}
+		defer conn.Close()
+
+		out := cmd.OutOrStdout()
+		var replayed, mismatched int
+		for _, call := range calls {
+			if !strings.HasPrefix(call.Method, replayMethod) {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+			if replayToken != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", fmt.Sprintf("Bearer %s", replayToken))
+			}
+			result := proxy.Replay(ctx, conn, call)
+			cancel()
+
+			replayed++
+			verdict := "match"
+			if result.Code != call.Code {
+				verdict = fmt.Sprintf("status %s, recorded %s", result.Code, call.Code)
+			} else if !sameMessages(result.Responses, call.Responses) {
+				verdict = fmt.Sprintf("responses differ (%d messages, recorded %d)", len(result.Responses), len(call.Responses))
+			}
+			if verdict != "match" {
+				mismatched++
+			}
+			fmt.Fprintf(out, "%-70s %-8s %s\n", call.Method, result.Duration.Round(time.Millisecond), verdict)
+		}
+
+		fmt.Fprintf(out, "\n%d calls replayed, %d differed from the capture\n", replayed, mismatched)
+		return nil
+	},
+}
+
+func init() {
+	replayCmd.Flags().StringVar(&replayTarget, "target", "", "address of the gRPC server to replay against")
+	replayCmd.Flags().BoolVar(&replayTLS, "tls", false, "connect to the target with TLS")
+	replayCmd.Flags().StringVar(&replayToken, "token", "", "JWT to send as a Bearer token (not needed when targeting the proxy)")
+	replayCmd.Flags().StringVar(&replayMethod, "method", "", "only replay calls whose full method name starts with this prefix")
+	replayCmd.Flags().DurationVar(&replayTimeout, "timeout", 30*time.Second, "deadline for each replayed call")
+	replayCmd.MarkFlagRequired("target")
+	rootCmd.AddCommand(replayCmd)
+}
+
+// sameMessages reports whether two calls returned byte-identical messages
+func sameMessages(a, b []proxy.CapturedMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
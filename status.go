@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"grpc-auth-proxy/pkg/adminpb"
+)
+
+var statusAdminAddress string
+
+// statusCmd prints the state of a running proxy through its admin service
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the endpoints of a running proxy",
+	Long: `Connect to a running proxy's admin service and print each endpoint's
+listener, upstream connectivity, call counts and error rate since it started.
+
+The admin address is read from the admin section of the config file unless
+--admin is given.`,
+	Example: `  grpc-proxy status
+  grpc-proxy status --admin unix:///run/grpc-proxy/admin.sock`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		addr := statusAdminAddress
+		if addr == "" {
+			initConfig()
+			if proxyConfig.Admin == nil {
+				return fmt.Errorf("no admin section in the config file; enable it or pass --admin")
+			}
+			addr = proxyConfig.Admin.Address()
+		}
+
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return fmt.Errorf("failed to connect to admin service at %s: %v", addr, err)
+		}
+		defer conn.Close()
+		admin := adminpb.NewProxyAdminClient(conn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		list, err := admin.ListEndpoints(ctx, &adminpb.ListEndpointsRequest{})
+		if err != nil {
+			return fmt.Errorf("failed to list endpoints from %s: %v", addr, err)
+		}
+
+		tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ENDPOINT\tLISTEN\tUPSTREAM\tSTATE\tHEALTH\tACTIVE\tCALLS\tERRORS")
+		for _, e := range list.Endpoints {
+			st, err := admin.GetEndpointStatus(ctx, &adminpb.GetEndpointStatusRequest{Name: e.Name})
+			if err != nil {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t\t\t\t\n", e.Name, e.ListenAddress, e.RemoteAddress, err)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+				e.Name, e.ListenAddress, e.RemoteAddress, st.UpstreamState, st.ServingStatus,
+				st.ActiveStreams, st.CallsTotal, errorRate(st.CallsFailed, st.CallsTotal))
+		}
+		return tw.Flush()
+	},
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&statusAdminAddress, "admin", "", "admin service address, e.g. localhost:9190 or unix:///path/admin.sock")
+	rootCmd.AddCommand(statusCmd)
+}
+
+// errorRate formats failed calls as a share of total calls
+func errorRate(failed, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d (%.1f%%)", failed, 100*float64(failed)/float64(total))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// runStatus runs the status command against the admin service at addr
+func runStatus(addr string) (string, error) {
+	var out bytes.Buffer
+	statusAdminAddress = addr
+	statusCmd.SetOut(&out)
+	err := statusCmd.RunE(statusCmd, nil)
+	return out.String(), err
+}
+
+func TestStatusCommand(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "cosmos",
+			LocalPort:     18813,
+			RemoteAddress: lis.Addr().String(),
+			JWTToken:      "status_jwt_token",
+		}},
+		Admin:           &proxy.AdminConfig{LocalPort: 18814},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18813", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	// The upstream serves no services, so the call fails
+	_, err = testpb.NewTestServiceClient(conn).EmptyCall(context.Background(), &testpb.Empty{})
+	require.Error(t, err)
+
+	out, err := runStatus("127.0.0.1:18814")
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace([]byte(out)), []byte("\n"))
+	require.Len(t, lines, 2)
+	assert.Equal(t, []string{"ENDPOINT", "LISTEN", "UPSTREAM", "STATE", "HEALTH", "ACTIVE", "CALLS", "ERRORS"}, fields(lines[0]))
+	row := fields(lines[1])
+	require.Len(t, row, 9)
+	assert.Equal(t, []string{"cosmos", "127.0.0.1:18813", lis.Addr().String(), "READY", "SERVING"}, row[:5])
+	assert.Equal(t, []string{"0", "1", "1", "(100.0%)"}, row[5:])
+
+	_, err = runStatus("unix://" + filepath.Join(t.TempDir(), "admin.sock"))
+	assert.ErrorContains(t, err, "failed to list endpoints from unix://")
+}
+
+// fields splits a rendered status line into its columns
+func fields(line []byte) []string {
+	var out []string
+	for _, f := range bytes.Fields(line) {
+		out = append(out, string(f))
+	}
+	return out
+}
+
+func TestErrorRate(t *testing.T) {
+	assert.Equal(t, "-", errorRate(0, 0))
+	assert.Equal(t, "0 (0.0%)", errorRate(0, 4))
+	assert.Equal(t, "1 (33.3%)", errorRate(1, 3))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenNotifySocket binds a unixgram socket at name, as systemd does for
+// Type=notify units, and points NOTIFY_SOCKET at it
+func listenNotifySocket(t *testing.T, name string) *net.UnixConn {
+	addr := name
+	if name[0] == '@' {
+		addr = "\x00" + name[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+// readNotify returns the next datagram sent to conn
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 256)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Run("path socket", func(t *testing.T) {
+		conn := listenNotifySocket(t, filepath.Join(t.TempDir(), "notify.sock"))
+		sdNotify("READY=1")
+		assert.Equal(t, "READY=1", readNotify(t, conn))
+	})
+
+	t.Run("abstract socket", func(t *testing.T) {
+		conn := listenNotifySocket(t, fmt.Sprintf("@grpc-proxy-test-%d", os.Getpid()))
+		sdNotify("STOPPING=1")
+		assert.Equal(t, "STOPPING=1", readNotify(t, conn))
+	})
+
+	t.Run("without NOTIFY_SOCKET", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		sdNotify("READY=1")
+	})
+}
+
+func TestSdWatchdog(t *testing.T) {
+	conn := listenNotifySocket(t, filepath.Join(t.TempDir(), "notify.sock"))
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 50*time.Millisecond, sdWatchdogInterval())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		sdWatchdog(stop)
+		close(done)
+	}()
+	assert.Equal(t, "WATCHDOG=1", readNotify(t, conn))
+	assert.Equal(t, "WATCHDOG=1", readNotify(t, conn))
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not stop")
+	}
+
+	// Keepalives are off without WatchdogSec or for another process
+	t.Setenv("WATCHDOG_PID", "1")
+	assert.Zero(t, sdWatchdogInterval())
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	assert.Zero(t, sdWatchdogInterval())
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/adminpb"
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestAdminService(t *testing.T) {
+	mockServer, mockService, err := startMockGRPCServer(19994)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "admin-test",
+			LocalPort:     18994,
+			RemoteAddress: "localhost:19994",
+			JWTToken:      "admin_token_1",
+		}},
+		ShutdownTimeout: 2 * time.Second,
+		Admin:           &proxy.AdminConfig{LocalPort: 18993},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := grpc.NewClient("localhost:18993", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	admin := adminpb.NewProxyAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("list endpoints", func(t *testing.T) {
+		resp, err := admin.ListEndpoints(ctx, &adminpb.ListEndpointsRequest{})
+		require.NoError(t, err)
+		require.Len(t, resp.Endpoints, 1)
+		assert.Equal(t, "admin-test", resp.Endpoints[0].Name)
+		assert.Equal(t, "127.0.0.1:18994", resp.Endpoints[0].ListenAddress)
+		assert.Equal(t, "localhost:19994", resp.Endpoints[0].RemoteAddress)
+	})
+
+	t.Run("update token", func(t *testing.T) {
+		_, err := admin.UpdateToken(ctx, &adminpb.UpdateTokenRequest{Name: "admin-test", JwtToken: "admin_token_2"})
+		require.NoError(t, err)
+
+		require.NoError(t, listServicesThrough(t, "localhost:18994"))
+		assert.Equal(t, []string{"Bearer admin_token_2"}, mockService.ReceivedHeaders["authorization"])
+
+		_, err = admin.UpdateToken(ctx, &adminpb.UpdateTokenRequest{Name: "admin-test"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("endpoint status", func(t *testing.T) {
+		resp, err := admin.GetEndpointStatus(ctx, &adminpb.GetEndpointStatusRequest{Name: "admin-test"})
+		require.NoError(t, err)
+		assert.Equal(t, "SERVING", resp.ServingStatus)
+		assert.GreaterOrEqual(t, resp.CallsTotal, int64(1))
+
+		_, err = admin.GetEndpointStatus(ctx, &adminpb.GetEndpointStatusRequest{Name: "missing"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		resp, err := admin.Drain(ctx, &adminpb.DrainRequest{Name: "admin-test", TimeoutSeconds: 1})
+		require.NoError(t, err)
+		assert.Zero(t, resp.RemainingStreams)
+
+		assert.Error(t, listServicesThrough(t, "localhost:18994"))
+		list, err := admin.ListEndpoints(ctx, &adminpb.ListEndpointsRequest{})
+		require.NoError(t, err)
+		assert.Empty(t, list.Endpoints)
+	})
+
+	t.Run("reflection", func(t *testing.T) {
+		require.NoError(t, listServicesThrough(t, "localhost:18993"))
+	})
+}
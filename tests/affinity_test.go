@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// namedTestService answers with its name, to tell upstream nodes apart
+type namedTestService struct {
+	testpb.UnimplementedTestServiceServer
+	name string
+}
+
+func (s namedTestService) UnaryCall(context.Context, *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	return &testpb.SimpleResponse{OauthScope: s.name}, nil
+}
+
+func TestUpstreamAffinity(t *testing.T) {
+	for _, port := range []string{"19914", "19913"} {
+		lis, err := net.Listen("tcp", "127.0.0.1:"+port)
+		require.NoError(t, err)
+		server := grpc.NewServer()
+		testpb.RegisterTestServiceServer(server, namedTestService{name: port})
+		go server.Serve(lis)
+		defer server.Stop()
+	}
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "affinity",
+		LocalPort:     18888,
+		RemoteAddress: "node.test:9090",
+		ResolveTo:     []string{"127.0.0.1:19914", "127.0.0.1:19913"},
+		JWTToken:      "affinity_token",
+		Affinity:      &proxy.AffinityConfig{Metadata: "x-session-id"},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dial := func() testpb.TestServiceClient {
+		conn, err := grpc.NewClient("127.0.0.1:18888", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return testpb.NewTestServiceClient(conn)
+	}
+	node := func(ctx context.Context, client testpb.TestServiceClient) string {
+		resp, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		return resp.OauthScope
+	}
+
+	// All calls of a connection stay on one node
+	client := dial()
+	first := node(ctx, client)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, node(ctx, client))
+	}
+
+	// A session header binds calls across connections
+	session := metadata.AppendToOutgoingContext(ctx, "x-session-id", "pagination-1")
+	bound := node(session, dial())
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, bound, node(session, dial()))
+	}
+
+	// While different clients are spread over the nodes
+	nodes := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		nodes[node(ctx, dial())] = true
+	}
+	assert.Len(t, nodes, 2)
+	assert.Equal(t, 12.0, endpointMetric(t, "affinity", "affinity_sessions"))
+}
+
+func TestUpstreamAffinityConfig(t *testing.T) {
+	for _, config := range []proxy.AffinityConfig{
+		{Key: "client_id"},
+		{TTL: -time.Minute},
+		{PinHeight: true},
+	} {
+		_, err := proxy.NewProxyServer(proxy.Config{Name: "affinity", JWTToken: "affinity_token", RemoteAddress: "127.0.0.1:19914",
+			Affinity: &config})
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+// heightTestService serves queries at the height they ask for, or at a new
+// latest height it reports in x-cosmos-block-height
+type heightTestService struct {
+	testpb.UnimplementedTestServiceServer
+	latest atomic.Int64
+}
+
+func (s *heightTestService) UnaryCall(ctx context.Context, _ *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if heights := md.Get("x-cosmos-block-height"); len(heights) > 0 {
+		return &testpb.SimpleResponse{OauthScope: heights[0]}, nil
+	}
+	height := strconv.FormatInt(s.latest.Add(1), 10)
+	grpc.SetHeader(ctx, metadata.Pairs("x-cosmos-block-height", height))
+	return &testpb.SimpleResponse{OauthScope: height}, nil
+}
+
+func TestSessionHeightPinning(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19858")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	testpb.RegisterTestServiceServer(server, &heightTestService{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "session-height",
+		LocalPort:     18858,
+		RemoteAddress: "127.0.0.1:19858",
+		JWTToken:      "session_token",
+		Affinity:      &proxy.AffinityConfig{Metadata: "x-session-id", PinHeight: true},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := grpc.NewClient("127.0.0.1:18858", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	height := func(ctx context.Context) string {
+		resp, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		return resp.OauthScope
+	}
+
+	// Every call of a session queries the height its first call got
+	first := metadata.AppendToOutgoingContext(ctx, "x-session-id", "page-1")
+	assert.Equal(t, "1", height(first))
+	assert.Equal(t, "1", height(first))
+
+	// Other sessions and calls without one see the latest state
+	assert.Equal(t, "2", height(metadata.AppendToOutgoingContext(ctx, "x-session-id", "page-2")))
+	assert.Equal(t, "3", height(ctx))
+	assert.Equal(t, "1", height(first))
+
+	// An explicit height wins over the session's
+	assert.Equal(t, "7", height(metadata.AppendToOutgoingContext(first, "x-cosmos-block-height", "7")))
+	assert.Equal(t, 2.0, endpointMetric(t, "session-height", "affinity_height_pins"))
+}
@@ -0,0 +1,212 @@
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// webhookRecorder collects the alerts posted to it, failing the first
+// failures deliveries
+type webhookRecorder struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+	headers  []http.Header
+	alerts   []proxy.Alert
+}
+
+func startWebhook(t *testing.T, failures int) *webhookRecorder {
+	w := &webhookRecorder{failures: failures}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.attempts++
+		if w.failures > 0 {
+			w.failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var alert proxy.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.headers = append(w.headers, r.Header.Clone())
+		w.alerts = append(w.alerts, alert)
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+// events returns the events received so far
+func (w *webhookRecorder) events() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var events []string
+	for _, a := range w.alerts {
+		events = append(events, a.Event)
+	}
+	return events
+}
+
+// expiringToken returns an unsigned JWT expiring after d
+func expiringToken(d time.Duration) string {
+	segment := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	return segment(`{"alg":"RS256","typ":"JWT"}`) + "." +
+		segment(fmt.Sprintf(`{"sub":"customer-1","exp":%d}`, time.Now().Add(d).Unix())) + ".signature"
+}
+
+func TestAlerts(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19936")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+
+	all := startWebhook(t, 0)
+	reloads := startWebhook(t, 0)
+	config := &proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "alerts",
+			LocalPort:     18923,
+			RemoteAddress: "127.0.0.1:19936",
+			JWTToken:      expiringToken(24 * time.Hour),
+		}},
+		Alerts: &proxy.AlertsConfig{
+			Webhooks: []proxy.WebhookConfig{
+				{URL: all.URL, Headers: map[string]string{"Authorization": "Bearer webhook-secret"}},
+				{URL: reloads.URL, Events: []string{proxy.AlertReloadFailed}},
+			},
+			RetryDelay: 10 * time.Millisecond,
+		},
+		ShutdownTimeout: time.Second,
+	}
+	manager := proxy.NewManager(config)
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	t.Run("token expiring", func(t *testing.T) {
+		require.Eventually(t, func() bool { return len(all.events()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		all.mu.Lock()
+		alert := all.alerts[0]
+		header := all.headers[0]
+		all.mu.Unlock()
+		assert.Equal(t, proxy.AlertTokenExpiring, alert.Event)
+		assert.Equal(t, "alerts", alert.Endpoint)
+		assert.Contains(t, alert.Message, "expires at")
+		assert.Equal(t, "Bearer webhook-secret", header.Get("Authorization"))
+		assert.Equal(t, "application/json", header.Get("Content-Type"))
+	})
+
+	t.Run("endpoint down and up", func(t *testing.T) {
+		upstream.Stop()
+		require.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{proxy.AlertTokenExpiring, proxy.AlertEndpointDown}, all.events())
+		}, 10*time.Second, 10*time.Millisecond)
+
+		lis, err := net.Listen("tcp", "127.0.0.1:19936")
+		require.NoError(t, err)
+		upstream = grpc.NewServer()
+		testpb.RegisterTestServiceServer(upstream, testService{})
+		go upstream.Serve(lis)
+		defer upstream.Stop()
+		require.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{proxy.AlertTokenExpiring, proxy.AlertEndpointDown, proxy.AlertEndpointUp}, all.events())
+		}, 30*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("reload failed", func(t *testing.T) {
+		bad := *config
+		bad.Endpoints = append([]proxy.Config{}, config.Endpoints...)
+		bad.Endpoints = append(bad.Endpoints, config.Endpoints[0])
+		require.Error(t, manager.Reload(&bad))
+		require.Eventually(t, func() bool { return len(reloads.events()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{proxy.AlertReloadFailed}, reloads.events())
+		reloads.mu.Lock()
+		assert.Contains(t, reloads.alerts[0].Message, "duplicate endpoint name")
+		reloads.mu.Unlock()
+	})
+}
+
+func TestAlertRetries(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19935")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	flaky := startWebhook(t, 2)
+	down := startWebhook(t, 100)
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "alert-retries",
+			LocalPort:     18922,
+			RemoteAddress: "127.0.0.1:19935",
+			JWTToken:      expiringToken(-time.Hour),
+		}},
+		Alerts: &proxy.AlertsConfig{
+			Webhooks:   []proxy.WebhookConfig{{URL: flaky.URL}, {URL: down.URL}},
+			Retries:    2,
+			RetryDelay: 10 * time.Millisecond,
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+
+	require.Eventually(t, func() bool { return len(flaky.events()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	flaky.mu.Lock()
+	assert.Contains(t, flaky.alerts[0].Message, "expired at")
+	flaky.mu.Unlock()
+
+	// Deliveries give up after the retries
+	require.Eventually(t, func() bool {
+		down.mu.Lock()
+		defer down.mu.Unlock()
+		return down.attempts == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	manager.Stop()
+	flaky.mu.Lock()
+	assert.Equal(t, 3, flaky.attempts)
+	flaky.mu.Unlock()
+	down.mu.Lock()
+	assert.Equal(t, 3, down.attempts)
+	assert.Empty(t, down.alerts)
+	down.mu.Unlock()
+}
+
+func TestAlertValidation(t *testing.T) {
+	for _, alerts := range []*proxy.AlertsConfig{
+		{},
+		{Webhooks: []proxy.WebhookConfig{{URL: "hooks.example.com/alerts"}}},
+		{Webhooks: []proxy.WebhookConfig{{URL: "https://hooks.example.com/alerts", Events: []string{"disk_full"}}}},
+	} {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "alerts",
+				LocalPort:     18921,
+				RemoteAddress: "127.0.0.1:19935",
+				JWTToken:      "alerts_jwt_token",
+			}},
+			Alerts:          alerts,
+			ShutdownTimeout: time.Second,
+		})
+		assert.Error(t, manager.Start())
+	}
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/adminpb"
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// readAudit parses every entry written to an audit log file
+func readAudit(t *testing.T, path string) []proxy.AuditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []proxy.AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry proxy.AuditEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// findAudit returns the entries with the given action
+func findAudit(entries []proxy.AuditEntry, action string) []proxy.AuditEntry {
+	var found []proxy.AuditEntry
+	for _, e := range entries {
+		if e.Action == action {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestAuditLog(t *testing.T) {
+	mockServer, _, err := startMockGRPCServer(19960)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	endpoint := proxy.Config{
+		Name:          "audit-test",
+		LocalPort:     18960,
+		RemoteAddress: "localhost:19960",
+		JWTToken:      "audit_token_1",
+	}
+	clients := []proxy.ClientConfig{{Name: "ops", APIKey: "ops_key"}}
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints:       []proxy.Config{endpoint},
+		Clients:         clients,
+		ShutdownTimeout: time.Second,
+		Admin:           &proxy.AdminConfig{LocalPort: 18959},
+		Audit:           &proxy.AuditConfig{Path: path},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("localhost:18959", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", "ops_key")
+	_, err = adminpb.NewProxyAdminClient(conn).UpdateToken(ctx, &adminpb.UpdateTokenRequest{Name: "audit-test", JwtToken: "audit_token_2"})
+	require.NoError(t, err)
+
+	// Change the upstream and add an endpoint
+	changed := endpoint
+	changed.JWTToken = "audit_token_3"
+	added := proxy.Config{Name: "audit-added", LocalPort: 18958, RemoteAddress: "localhost:19960", JWTToken: "audit_token_4"}
+	require.NoError(t, manager.Reload(&proxy.ProxyConfig{
+		Endpoints:       []proxy.Config{changed, added},
+		Clients:         clients,
+		ShutdownTimeout: time.Second,
+		Admin:           &proxy.AdminConfig{LocalPort: 18959},
+		Audit:           &proxy.AuditConfig{Path: path},
+	}))
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, secret := range []string{"audit_token_1", "audit_token_2", "audit_token_3", "audit_token_4", "ops_key"} {
+		assert.NotContains(t, string(raw), secret, "secrets must be redacted")
+	}
+
+	entries := readAudit(t, path)
+	require.Len(t, findAudit(entries, "config.load"), 1)
+
+	calls := findAudit(entries, "admin.UpdateToken")
+	require.Len(t, calls, 1)
+	assert.Equal(t, "client:ops", calls[0].Actor)
+	assert.Equal(t, "audit-test", calls[0].Endpoint)
+	assert.Equal(t, "OK", calls[0].Result)
+
+	rotations := findAudit(entries, "token.rotate")
+	require.Len(t, rotations, 1)
+	assert.Equal(t, "client:ops", rotations[0].Actor)
+	require.Len(t, rotations[0].Changes, 1)
+	assert.True(t, strings.HasPrefix(rotations[0].Changes[0].After, "sha256:"))
+	assert.NotEqual(t, rotations[0].Changes[0].Before, rotations[0].Changes[0].After)
+
+	reloads := findAudit(entries, "config.reload")
+	require.Len(t, reloads, 1)
+	assert.True(t, strings.HasPrefix(reloads[0].Actor, "local"))
+	assert.Equal(t, "OK", reloads[0].Result)
+	fields := map[string]bool{}
+	for _, c := range reloads[0].Changes {
+		fields[c.Field] = true
+	}
+	assert.True(t, fields["endpoints[audit-test].jwt_token"])
+	assert.True(t, fields["endpoints[audit-added].remote_address"])
+
+	adds := findAudit(entries, "endpoint.add")
+	require.Len(t, adds, 1)
+	assert.Equal(t, "audit-added", adds[0].Endpoint)
+}
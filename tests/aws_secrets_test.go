@@ -0,0 +1,171 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeAWS answers GetSecretValue and GetParameter from in-memory values
+type fakeAWS struct {
+	mu         sync.Mutex
+	secrets    map[string]string
+	parameters map[string]string
+	services   map[string]bool
+}
+
+func (f *fakeAWS) set(name, value string) {
+	f.mu.Lock()
+	f.parameters[name] = value
+	f.mu.Unlock()
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDTEST/") || !strings.Contains(auth, "/us-west-2/") {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"__type": "UnrecognizedClientException", "message": "bad signature"})
+		return
+	}
+	scope := strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 Credential="), "/")
+	f.services[scope[3]] = true
+
+	var params map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&params)
+	notFound := func() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"__type": "ResourceNotFoundException", "message": "not found"})
+	}
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "secretsmanager.GetSecretValue":
+		value, ok := f.secrets[params["SecretId"].(string)]
+		if !ok {
+			notFound()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": value})
+	case "AmazonSSM.GetParameter":
+		value, ok := f.parameters[params["Name"].(string)]
+		if !ok || params["WithDecryption"] != true {
+			notFound()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Parameter": map[string]string{"Value": value}})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestAWSTokenRefs(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	aws := &fakeAWS{
+		secrets:    map[string]string{"chandra/cosmos-token": `{"token":"sm_token"}`},
+		parameters: map[string]string{"/chandra/osmosis-token": "ssm_token_1"},
+		services:   map[string]bool{},
+	}
+	ts := httptest.NewServer(aws)
+	defer ts.Close()
+
+	mockServer, mockService, err := startMockGRPCServer(19971)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{
+				Name:          "aws-sm",
+				LocalPort:     18971,
+				RemoteAddress: "localhost:19971",
+				JWTTokenRef:   "aws-sm:chandra/cosmos-token#token",
+			},
+			{
+				Name:          "aws-ssm",
+				LocalPort:     18970,
+				RemoteAddress: "localhost:19971",
+				JWTTokenRef:   "aws-ssm:/chandra/osmosis-token",
+			},
+		},
+		Secrets: proxy.SecretsConfig{
+			RefreshInterval: 300 * time.Millisecond,
+			AWS:             proxy.AWSConfig{Region: "us-west-2", Endpoint: ts.URL},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18971"))
+	assert.Equal(t, []string{"Bearer sm_token"}, mockService.ReceivedHeaders["authorization"])
+	require.NoError(t, listServicesThrough(t, "localhost:18970"))
+	assert.Equal(t, []string{"Bearer ssm_token_1"}, mockService.ReceivedHeaders["authorization"])
+
+	aws.mu.Lock()
+	assert.True(t, aws.services["secretsmanager"])
+	assert.True(t, aws.services["ssm"])
+	aws.mu.Unlock()
+
+	// Rotations are picked up on the next refresh
+	aws.set("/chandra/osmosis-token", "ssm_token_2")
+	time.Sleep(500 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18970"))
+	assert.Equal(t, []string{"Bearer ssm_token_2"}, mockService.ReceivedHeaders["authorization"])
+}
+
+func TestAWSTokenRefErrors(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	aws := &fakeAWS{
+		secrets:    map[string]string{"chandra/plain": "plain_token"},
+		parameters: map[string]string{},
+		services:   map[string]bool{},
+	}
+	ts := httptest.NewServer(aws)
+	defer ts.Close()
+
+	start := func(ref, region string) error {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "aws-errors",
+				LocalPort:     18969,
+				RemoteAddress: "localhost:19969",
+				JWTTokenRef:   ref,
+			}},
+			Secrets: proxy.SecretsConfig{
+				AWS: proxy.AWSConfig{Region: region, Endpoint: ts.URL},
+			},
+		})
+		err := manager.Start()
+		if err == nil {
+			manager.Stop()
+		}
+		return err
+	}
+
+	assert.ErrorContains(t, start("aws-ssm:/chandra/missing", "us-west-2"), "ResourceNotFoundException")
+	assert.ErrorContains(t, start("aws-sm:chandra/plain#token", "us-west-2"), "not a JSON object")
+	assert.ErrorContains(t, start("aws-sm:chandra/plain", "eu-central-1"), "UnrecognizedClientException")
+
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	assert.ErrorContains(t, start("aws-sm:chandra/plain", ""), "region")
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// countingTestService answers UnaryCall, counting the calls it gets
+type countingTestService struct {
+	testpb.UnimplementedTestServiceServer
+	calls atomic.Int32
+}
+
+func (s *countingTestService) UnaryCall(context.Context, *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	s.calls.Add(1)
+	return &testpb.SimpleResponse{}, nil
+}
+
+func TestResponseCache(t *testing.T) {
+	// A node reporting its latest block, with the test service alongside
+	lis, err := net.Listen("tcp", "127.0.0.1:19940")
+	require.NoError(t, err)
+	node := &fakeNode{}
+	node.height.Store(100)
+	node.blockTime.Store(time.Now())
+	upstream := grpc.NewServer(grpc.UnknownServiceHandler(node.handle))
+	service := &countingTestService{}
+	testpb.RegisterTestServiceServer(upstream, service)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	methods := []string{"/grpc.testing.TestService/UnaryCall"}
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "cache-height",
+			LocalPort:     18933,
+			RemoteAddress: "127.0.0.1:19940",
+			JWTToken:      "cache_jwt_token",
+			Cache: &proxy.CacheConfig{
+				Methods:        methods,
+				TTL:            time.Minute,
+				Invalidation:   proxy.CacheInvalidationHeight,
+				HeightInterval: 50 * time.Millisecond,
+			},
+		}, {
+			Name:          "cache-ttl",
+			LocalPort:     18932,
+			RemoteAddress: "127.0.0.1:19940",
+			JWTToken:      "cache_jwt_token",
+			Cache:         &proxy.CacheConfig{Methods: methods, TTL: 200 * time.Millisecond},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	call := func(t *testing.T, port string, height string) {
+		conn, err := grpc.NewClient("127.0.0.1:"+port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if height != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-cosmos-block-height", height)
+		}
+		_, err = testpb.NewTestServiceClient(conn).UnaryCall(ctx, &testpb.SimpleRequest{ResponseSize: 1})
+		require.NoError(t, err)
+	}
+
+	t.Run("height invalidation", func(t *testing.T) {
+		// Let the proxy learn the current height
+		time.Sleep(200 * time.Millisecond)
+		before := service.calls.Load()
+
+		call(t, "18933", "")
+		call(t, "18933", "")
+		call(t, "18933", "50")
+		call(t, "18933", "50")
+		assert.Equal(t, before+2, service.calls.Load())
+
+		// A new block drops the latest-state response but not the pinned one
+		node.height.Store(101)
+		time.Sleep(200 * time.Millisecond)
+		call(t, "18933", "")
+		call(t, "18933", "50")
+		assert.Equal(t, before+3, service.calls.Load())
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		before := service.calls.Load()
+		call(t, "18932", "")
+		call(t, "18932", "")
+		assert.Equal(t, before+1, service.calls.Load())
+
+		time.Sleep(300 * time.Millisecond)
+		call(t, "18932", "")
+		assert.Equal(t, before+2, service.calls.Load())
+	})
+}
+
+func TestResponseCacheInvalid(t *testing.T) {
+	for _, cache := range []*proxy.CacheConfig{
+		{},
+		{Methods: []string{"/grpc.testing."}, Invalidation: "block"},
+		{Methods: []string{"/grpc.testing."}, TTL: -time.Second},
+	} {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "cache",
+			LocalPort:     18931,
+			RemoteAddress: "127.0.0.1:19940",
+			JWTToken:      "cache_jwt_token",
+			Cache:         cache,
+		})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	mockServer, mockService, err := startMockGRPCServer(19984)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	capturePath := filepath.Join(t.TempDir(), "capture.jsonl")
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "capture-test",
+			LocalPort:     18984,
+			RemoteAddress: "localhost:19984",
+			JWTToken:      "capture_token",
+			Capture:       &proxy.CaptureConfig{Path: capturePath},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-trace", "abc", "x-api-key", "never-recorded")
+	require.NoError(t, listServicesThroughContext(t, ctx, "localhost:18984"))
+
+	// Stopping flushes and closes the capture file
+	require.NoError(t, manager.Stop())
+
+	f, err := os.Open(capturePath)
+	require.NoError(t, err)
+	defer f.Close()
+	calls, err := proxy.ReadCapture(f)
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+
+	call := calls[0]
+	assert.Equal(t, "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", call.Method)
+	assert.Equal(t, "OK", call.Code)
+	assert.Equal(t, []string{"abc"}, call.Metadata["x-trace"])
+	assert.NotContains(t, call.Metadata, "x-api-key")
+	assert.Len(t, call.Requests, 1)
+	assert.Len(t, call.Responses, 1)
+
+	t.Run("replay against the upstream", func(t *testing.T) {
+		conn, err := grpc.NewClient("localhost:19984", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result := proxy.Replay(ctx, conn, call)
+		assert.Equal(t, "OK", result.Code)
+		require.Len(t, result.Responses, 1)
+		assert.Equal(t, call.Responses[0].Data, result.Responses[0].Data)
+		assert.Equal(t, []string{"abc"}, mockService.ReceivedHeaders["x-trace"])
+	})
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeNode answers the Tendermint service's GetNodeInfo and GetLatestBlock
+// with a configurable chain-id and latest block, and serves reflection
+type fakeNode struct {
+	chainID   atomic.Value
+	height    atomic.Int64
+	blockTime atomic.Value
+}
+
+// handle encodes the Cosmos responses by hand, carrying only the fields the proxy reads
+func (n *fakeNode) handle(srv interface{}, stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+		return err
+	}
+	var resp []byte
+	switch method, _ := grpc.MethodFromServerStream(stream); method {
+	case "/cosmos.base.tendermint.v1beta1.Service/GetNodeInfo":
+		var nodeInfo []byte
+		nodeInfo = protowire.AppendTag(nodeInfo, 7, protowire.BytesType)
+		nodeInfo = protowire.AppendString(nodeInfo, "moniker")
+		nodeInfo = protowire.AppendTag(nodeInfo, 4, protowire.BytesType)
+		nodeInfo = protowire.AppendString(nodeInfo, n.chainID.Load().(string))
+		resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+		resp = protowire.AppendBytes(resp, nodeInfo)
+	case "/cosmos.base.tendermint.v1beta1.Service/GetLatestBlock":
+		blockTime := n.blockTime.Load().(time.Time)
+		var ts []byte
+		ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(blockTime.Unix()))
+		var header []byte
+		header = protowire.AppendTag(header, 3, protowire.VarintType)
+		header = protowire.AppendVarint(header, uint64(n.height.Load()))
+		header = protowire.AppendTag(header, 4, protowire.BytesType)
+		header = protowire.AppendBytes(header, ts)
+		var block []byte
+		block = protowire.AppendTag(block, 1, protowire.BytesType)
+		block = protowire.AppendBytes(block, header)
+		resp = protowire.AppendTag(resp, 3, protowire.BytesType)
+		resp = protowire.AppendBytes(resp, block)
+	default:
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+
+	msg := &emptypb.Empty{}
+	msg.ProtoReflect().SetUnknown(resp)
+	return stream.SendMsg(msg)
+}
+
+func startFakeNode(t *testing.T, port int, chainID string) *fakeNode {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	require.NoError(t, err)
+	node := &fakeNode{}
+	node.chainID.Store(chainID)
+	node.height.Store(1000)
+	node.blockTime.Store(time.Now())
+	server := grpc.NewServer(grpc.UnknownServiceHandler(node.handle))
+	grpc_reflection_v1alpha.RegisterServerReflectionServer(server, &MockGRPCServer{})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return node
+}
+
+func TestExpectedChainID(t *testing.T) {
+	node := startFakeNode(t, 19950, "cosmoshub-4")
+
+	newManager := func(port int, chainID string) *proxy.Manager {
+		return proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:                 "chainid-test",
+				LocalPort:            port,
+				RemoteAddress:        "localhost:19950",
+				JWTToken:             "chainid_token",
+				ExpectedChainID:      chainID,
+				ChainIDCheckInterval: 100 * time.Millisecond,
+				Connect:              proxy.ConnectConfig{Timeout: 2 * time.Second},
+			}},
+			ShutdownTimeout: time.Second,
+		})
+	}
+
+	t.Run("mismatch refuses to start", func(t *testing.T) {
+		err := newManager(18949, "osmosis-1").Start()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `serves chain "cosmoshub-4", expected "osmosis-1"`)
+	})
+
+	t.Run("periodic check", func(t *testing.T) {
+		manager := newManager(18950, "cosmoshub-4")
+		require.NoError(t, manager.Start())
+		defer manager.Stop()
+		p, ok := manager.Server("chainid-test")
+		require.True(t, ok)
+
+		require.NoError(t, listServicesThrough(t, "localhost:18950"))
+
+		node.chainID.Store("osmosis-1")
+		defer node.chainID.Store("cosmoshub-4")
+		require.Eventually(t, func() bool {
+			return p.ServingStatus() == healthpb.HealthCheckResponse_NOT_SERVING
+		}, 2*time.Second, 50*time.Millisecond)
+		assert.Equal(t, codes.Unavailable, status.Code(listServicesThrough(t, "localhost:18950")))
+
+		node.chainID.Store("cosmoshub-4")
+		require.Eventually(t, func() bool {
+			return p.ServingStatus() == healthpb.HealthCheckResponse_SERVING
+		}, 2*time.Second, 50*time.Millisecond)
+		assert.NoError(t, listServicesThrough(t, "localhost:18950"))
+	})
+}
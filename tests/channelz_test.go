@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestChannelz(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19931")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "channelz",
+			LocalPort:     18912,
+			RemoteAddress: "127.0.0.1:19931",
+			JWTToken:      "channelz_jwt_token",
+		}},
+		Admin:           &proxy.AdminConfig{LocalPort: 18911},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18911", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	channelz := channelzpb.NewChannelzClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("upstream channels", func(t *testing.T) {
+		resp, err := channelz.GetTopChannels(ctx, &channelzpb.GetTopChannelsRequest{})
+		require.NoError(t, err)
+		var upstream *channelzpb.Channel
+		for _, c := range resp.Channel {
+			if c.Data.Target == "127.0.0.1:19931" {
+				upstream = c
+			}
+		}
+		require.NotNil(t, upstream, "no channel to the upstream")
+		assert.Equal(t, channelzpb.ChannelConnectivityState_READY, upstream.Data.State.State)
+		assert.NotEmpty(t, upstream.SubchannelRef)
+	})
+
+	t.Run("local servers", func(t *testing.T) {
+		resp, err := channelz.GetServers(ctx, &channelzpb.GetServersRequest{})
+		require.NoError(t, err)
+		var listeners []string
+		for _, s := range resp.Server {
+			for _, ref := range s.ListenSocket {
+				listeners = append(listeners, ref.Name)
+			}
+		}
+		assert.Contains(t, listeners, "127.0.0.1:18912")
+	})
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestCheck(t *testing.T) {
+	// The upstream only accepts check_token
+	lis, err := net.Listen("tcp", "127.0.0.1:19912")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		if auth := md.Get("authorization"); len(auth) == 0 || auth[0] != "Bearer check_token" {
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return handler(srv, ss)
+	}))
+	testpb.RegisterTestServiceServer(server, testService{})
+	reflection.Register(server)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	// The mock only serves v1alpha reflection
+	mockServer, _, err := startMockGRPCServer(19911)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer check_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer rpc.Close()
+
+	results, err := proxy.NewManager(&proxy.ProxyConfig{Endpoints: []proxy.Config{
+		{Name: "check-ok", LocalPort: 18887, RemoteAddress: "127.0.0.1:19912", JWTToken: "check_token",
+			Fallbacks: []proxy.FallbackConfig{{RemoteAddress: "127.0.0.1:19911"}}},
+		{Name: "check-token", LocalPort: 18886, RemoteAddress: "127.0.0.1:19912", JWTToken: "wrong_token"},
+		{Name: "check-down", LocalPort: 18885, RemoteAddress: "127.0.0.1:19910", JWTToken: "check_token"},
+		{Name: "check-rpc", LocalPort: 18884, Type: proxy.TypeHTTP, RemoteAddress: rpc.URL, JWTToken: "check_token"},
+	}}).Check(2 * time.Second)
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+
+	byUpstream := map[string]proxy.CheckResult{}
+	for _, r := range results {
+		byUpstream[r.Endpoint+" "+r.Role] = r
+	}
+	assert.NoError(t, byUpstream["check-ok upstream"].Err)
+	assert.Equal(t, 3, byUpstream["check-ok upstream"].Services, "test service and both reflection versions")
+	assert.NoError(t, byUpstream["check-ok fallback"].Err)
+	assert.Equal(t, codes.Unauthenticated, status.Code(byUpstream["check-token upstream"].Err))
+	assert.Equal(t, codes.Unavailable, status.Code(byUpstream["check-down upstream"].Err))
+	assert.NoError(t, byUpstream["check-rpc upstream"].Err)
+	assert.Equal(t, -1, byUpstream["check-rpc upstream"].Services)
+
+	// Nothing listens after a check
+	_, err = net.Dial("tcp", "127.0.0.1:18887")
+	assert.Error(t, err)
+
+	_, err = proxy.NewManager(&proxy.ProxyConfig{}).Check(time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,303 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// jwtIssuer signs client JWTs and publishes its keys as a JWK set. It
+// counts the reads of the set and answers them with an error while fail is
+// set.
+type jwtIssuer struct {
+	*httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	reads  atomic.Int32
+	fail   atomic.Bool
+}
+
+func newJWTIssuer(t *testing.T) *jwtIssuer {
+	iss := &jwtIssuer{}
+	var err error
+	iss.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	iss.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(iss.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(iss.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(iss.ecKey.X.FillBytes(make([]byte, 32))), "y": b64(iss.ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "oct", "kid": "skipped", "k": "c2VjcmV0"},
+	}})
+	require.NoError(t, err)
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss.reads.Add(1)
+		if iss.fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(jwks)
+	}))
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// sign returns a token with claims, signed with the RSA key or, for kid
+// ec-1, the EC key
+func (iss *jwtIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if kid == "ec-1" {
+		alg = "ES256"
+	}
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	if alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, iss.ecKey, digest[:])
+		require.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, iss.rsaKey, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claims returns valid claims for a tenant with the given scope
+func (iss *jwtIssuer) claims(tenant, scope string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    "https://auth.chandra.test",
+		"aud":    []string{"grpc-proxy", "other"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"tenant": tenant,
+		"scope":  scope,
+	}
+}
+
+func TestClientJWT(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+	iss := newJWTIssuer(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "client-jwt",
+			LocalPort:     18824,
+			RemoteAddress: upstreamAddr,
+			JWTToken:      "shared-upstream",
+			ClientJWT: &proxy.ClientJWTConfig{
+				JWKSURL:  iss.URL,
+				Issuer:   "https://auth.chandra.test",
+				Audience: "grpc-proxy",
+				Require:  `claims.scope.contains("query") && "tenant" in claims`,
+				Tokens: []proxy.ClaimTokenConfig{
+					{When: `claims.tenant == "acme"`, JWTToken: "acme-upstream"},
+				},
+			},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client, conn := dialTestService(t, "127.0.0.1:18824")
+	call := func(token string) error {
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		return err
+	}
+
+	t.Run("tenant claim selects the upstream token", func(t *testing.T) {
+		require.NoError(t, call(iss.sign(t, "rsa-1", iss.claims("acme", "query tx"))))
+		assert.Equal(t, []string{"Bearer acme-upstream"}, upstream.metadata().Get("authorization"))
+
+		require.NoError(t, call(iss.sign(t, "ec-1", iss.claims("globex", "query"))))
+		assert.Equal(t, []string{"Bearer shared-upstream"}, upstream.metadata().Get("authorization"))
+	})
+
+	t.Run("invalid tokens are rejected", func(t *testing.T) {
+		expired := iss.claims("acme", "query")
+		expired["exp"] = time.Now().Add(-time.Hour).Unix()
+		otherIssuer := iss.claims("acme", "query")
+		otherIssuer["iss"] = "https://evil.test"
+		otherAudience := iss.claims("acme", "query")
+		otherAudience["aud"] = "someone-else"
+		forged := iss.sign(t, "rsa-1", iss.claims("acme", "query"))
+		forged = forged[:len(forged)-4] + "AAAA"
+
+		for name, token := range map[string]string{
+			"missing":        "",
+			"expired":        iss.sign(t, "rsa-1", expired),
+			"other issuer":   iss.sign(t, "rsa-1", otherIssuer),
+			"other audience": iss.sign(t, "rsa-1", otherAudience),
+			"bad signature":  forged,
+			"unknown key":    iss.sign(t, "rsa-2", iss.claims("acme", "query")),
+		} {
+			assert.Equal(t, codes.Unauthenticated, status.Code(call(token)), name)
+		}
+	})
+
+	t.Run("require denies calls", func(t *testing.T) {
+		err := call(iss.sign(t, "rsa-1", iss.claims("acme", "tx")))
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		assert.Equal(t, 1.0, endpointMetric(t, "client-jwt", "client_jwt_denied"))
+	})
+
+	t.Run("health checks need no token", func(t *testing.T) {
+		_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.NoError(t, err)
+	})
+}
+
+func TestClientJWTUnknownKeys(t *testing.T) {
+	_, upstreamAddr := serveRecording(t)
+	iss := newJWTIssuer(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "client-jwt-unknown",
+			LocalPort:     18821,
+			RemoteAddress: upstreamAddr,
+			JWTToken:      "shared-upstream",
+			ClientJWT:     &proxy.ClientJWTConfig{JWKSURL: iss.URL, Issuer: "https://auth.chandra.test"},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+	require.Equal(t, int32(1), iss.reads.Load())
+
+	client, _ := dialTestService(t, "127.0.0.1:18821")
+	call := func(kid string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+iss.sign(t, kid, iss.claims("acme", "query")))
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		return err
+	}
+
+	// While the issuer fails, concurrent and later tokens with unknown keys
+	// share a single re-read
+	iss.fail.Store(true)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Equal(t, codes.Unauthenticated, status.Code(call(fmt.Sprintf("rotated-%d", i))))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, codes.Unauthenticated, status.Code(call("rotated")))
+	}
+	assert.Equal(t, int32(2), iss.reads.Load())
+
+	// Known keys keep working
+	assert.NoError(t, call("rsa-1"))
+}
+
+func TestClientJWTHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var seen http.Header
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = r.Header.Clone()
+		mu.Unlock()
+	}))
+	defer rpc.Close()
+	iss := newJWTIssuer(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "client-jwt-rpc",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18823,
+			RemoteAddress: rpc.URL,
+			JWTToken:      "shared-upstream",
+			ClientJWT: &proxy.ClientJWTConfig{
+				JWKSURL: iss.URL,
+				Issuer:  "https://auth.chandra.test",
+				Header:  "X-Client-Token",
+				Require: `!request.method.startsWith("broadcast") || claims.scope.contains("tx")`,
+				Tokens:  []proxy.ClaimTokenConfig{{When: `claims["tenant"] == "acme"`, JWTToken: "acme-upstream"}},
+			},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	get := func(path, token string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:18823"+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("X-Client-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	query := iss.sign(t, "rsa-1", iss.claims("acme", "query"))
+	assert.Equal(t, http.StatusOK, get("/status", query))
+	mu.Lock()
+	assert.Equal(t, "Bearer acme-upstream", seen.Get("Authorization"))
+	assert.Empty(t, seen.Get("X-Client-Token"))
+	mu.Unlock()
+
+	assert.Equal(t, http.StatusUnauthorized, get("/status", ""))
+	assert.Equal(t, http.StatusForbidden, get("/broadcast_tx_sync", query))
+	assert.Equal(t, http.StatusOK, get("/broadcast_tx_sync", iss.sign(t, "ec-1", iss.claims("globex", "tx"))))
+}
+
+func TestClientJWTValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "client-jwt-invalid", LocalPort: 18822, RemoteAddress: "127.0.0.1:1", JWTToken: "token"}
+
+	endpoint.ClientJWT = &proxy.ClientJWTConfig{JWKSURL: "auth.chandra.test/jwks", Issuer: "https://auth.chandra.test"}
+	assert.ErrorContains(t, endpoint.Validate(), "needs an http(s) jwks_url")
+
+	endpoint.ClientJWT = &proxy.ClientJWTConfig{JWKSURL: "https://auth.chandra.test/jwks"}
+	assert.ErrorContains(t, endpoint.Validate(), "needs an issuer")
+
+	endpoint.ClientJWT.Issuer = "https://auth.chandra.test"
+	endpoint.ClientJWT.Header = "x-api-key"
+	assert.ErrorContains(t, endpoint.Validate(), `may not use header "x-api-key"`)
+
+	endpoint.ClientJWT.Header = ""
+	endpoint.ClientJWT.Tokens = []proxy.ClaimTokenConfig{{JWTToken: "t"}}
+	assert.ErrorContains(t, endpoint.Validate(), "token 1 needs when")
+
+	iss := newJWTIssuer(t)
+	endpoint.ClientJWT = &proxy.ClientJWTConfig{JWKSURL: iss.URL, Issuer: "https://auth.chandra.test", Require: `claims == "acme"`}
+	_, err := proxy.NewProxyServer(endpoint)
+	assert.ErrorContains(t, err, "cannot compare claims")
+}
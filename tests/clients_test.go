@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// listServicesWithKey lists services through the proxy at addr sending apiKey as x-api-key
+func listServicesWithKey(t *testing.T, addr, apiKey string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", apiKey)
+	}
+	return listServicesThroughContext(t, ctx, addr)
+}
+
+func TestClientAPIKeys(t *testing.T) {
+	mockServer, mockService, err := startMockGRPCServer(19991)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	endpoints := []proxy.Config{{
+		Name:          "clients-test",
+		LocalPort:     18991,
+		RemoteAddress: "localhost:19991",
+		JWTToken:      "clients_token",
+	}}
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints:       endpoints,
+		ShutdownTimeout: 2 * time.Second,
+		Clients: []proxy.ClientConfig{
+			{Name: "team-a", APIKey: "key-a"},
+			{Name: "team-b", APIKey: "key-b"},
+			{Name: "customer-1", APIKey: "key-1", JWTToken: "customer_1_token"},
+			{Name: "customer-2", APIKey: "key-2", JWTToken: "customer_2_token", Tokens: map[string]string{"Clients-Test": "customer_2_clients_token"}},
+		},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	t.Run("valid key is forwarded without the key", func(t *testing.T) {
+		require.NoError(t, listServicesWithKey(t, "localhost:18991", "key-a"))
+		assert.Equal(t, []string{"Bearer clients_token"}, mockService.ReceivedHeaders["authorization"])
+		assert.Empty(t, mockService.ReceivedHeaders["x-api-key"])
+	})
+
+	t.Run("client tokens replace the endpoint token", func(t *testing.T) {
+		require.NoError(t, listServicesWithKey(t, "localhost:18991", "key-1"))
+		assert.Equal(t, []string{"Bearer customer_1_token"}, mockService.ReceivedHeaders["authorization"])
+
+		require.NoError(t, listServicesWithKey(t, "localhost:18991", "key-2"))
+		assert.Equal(t, []string{"Bearer customer_2_clients_token"}, mockService.ReceivedHeaders["authorization"])
+	})
+
+	t.Run("missing key is rejected", func(t *testing.T) {
+		err := listServicesWithKey(t, "localhost:18991", "")
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("unknown key is rejected", func(t *testing.T) {
+		err := listServicesWithKey(t, "localhost:18991", "key-c")
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("reload revokes a key", func(t *testing.T) {
+		err := manager.Reload(&proxy.ProxyConfig{
+			Endpoints:       endpoints,
+			ShutdownTimeout: 2 * time.Second,
+			Clients:         []proxy.ClientConfig{{Name: "team-a", APIKey: "key-a"}},
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, codes.Unauthenticated, status.Code(listServicesWithKey(t, "localhost:18991", "key-b")))
+		assert.NoError(t, listServicesWithKey(t, "localhost:18991", "key-a"))
+	})
+}
+
+func TestValidateClients(t *testing.T) {
+	endpoints := []proxy.Config{{Name: "a", JWTToken: "token"}}
+	assert.Error(t, (&proxy.ProxyConfig{Endpoints: endpoints, Clients: []proxy.ClientConfig{{Name: "a"}}}).Validate())
+	assert.Error(t, (&proxy.ProxyConfig{Endpoints: endpoints, Clients: []proxy.ClientConfig{{Name: "a", APIKey: "k"}, {Name: "b", APIKey: "k"}}}).Validate())
+	assert.Error(t, (&proxy.ProxyConfig{Endpoints: endpoints, Clients: []proxy.ClientConfig{{Name: "a", APIKey: "k", Tokens: map[string]string{"a": ""}}}}).Validate())
+	assert.NoError(t, (&proxy.ProxyConfig{Endpoints: endpoints, Clients: []proxy.ClientConfig{{Name: "a", APIKey: "k"}}}).Validate())
+}
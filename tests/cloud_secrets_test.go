@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestGCPSecretRefs(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	upstream, mockService, caFile := startMockTLSServer(t, 19968, "staging.chandra.test")
+	defer upstream.Stop()
+	caPEM, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+
+	secrets := map[string]string{
+		"/v1/projects/chandra-prod/secrets/cosmos-token/versions/latest:access": "gcp_token\n",
+		"/v1/projects/chandra-prod/secrets/staging-ca/versions/2:access":        string(caPEM),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		// The assertion must be signed by the service account key
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" ||
+			rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad assertion"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "gcp_access", "expires_in": 3600})
+	})
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		value, ok := secrets[r.URL.Path]
+		if r.Header.Get("Authorization") != "Bearer gcp_access" || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": 404, "status": "NOT_FOUND", "message": "Secret not found"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(value))}})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "chandra-prod",
+		"client_email": "proxy@chandra-prod.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    ts.URL + "/token",
+	})
+	credentialsFile := filepath.Join(t.TempDir(), "sa.json")
+	require.NoError(t, os.WriteFile(credentialsFile, credentials, 0600))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentialsFile)
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "gcp-test",
+			LocalPort:     18968,
+			RemoteAddress: "localhost:19968",
+			UseTLS:        true,
+			ServerName:    "staging.chandra.test",
+			CARef:         "gcp-sm:staging-ca/versions/2",
+			JWTTokenRef:   "gcp-sm:projects/chandra-prod/secrets/cosmos-token",
+		}},
+		Secrets: proxy.SecretsConfig{
+			GCP: proxy.GCPConfig{Endpoint: ts.URL},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18968"))
+	assert.Equal(t, []string{"Bearer gcp_token"}, mockService.ReceivedHeaders["authorization"])
+
+	missing := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "gcp-missing",
+			LocalPort:     18966,
+			RemoteAddress: "localhost:19966",
+			JWTTokenRef:   "gcp-sm:missing",
+		}},
+		Secrets: proxy.SecretsConfig{
+			GCP: proxy.GCPConfig{Endpoint: ts.URL},
+		},
+	})
+	assert.ErrorContains(t, missing.Start(), "NOT_FOUND Secret not found")
+}
+
+func TestAzureSecretRefs(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chandra-tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_secret") != "azure_client_secret" || r.Form.Get("scope") != "https://vault.azure.net/.default" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client", "error_description": "bad secret"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "azure_access", "expires_in": 3600})
+	})
+	mux.HandleFunc("/secrets/cosmos-token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer azure_access" || r.URL.Query().Get("api-version") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": "azure_token"})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	t.Setenv("AZURE_AUTHORITY_HOST", ts.URL)
+	t.Setenv("AZURE_TENANT_ID", "chandra-tenant")
+	t.Setenv("AZURE_CLIENT_ID", "proxy")
+	t.Setenv("AZURE_CLIENT_SECRET", "azure_client_secret")
+
+	mockServer, mockService, err := startMockGRPCServer(19967)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "azure-test",
+			LocalPort:     18967,
+			RemoteAddress: "localhost:19967",
+			JWTTokenRef:   "azure-kv:" + ts.URL + "/secrets/cosmos-token",
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18967"))
+	assert.Equal(t, []string{"Bearer azure_token"}, mockService.ReceivedHeaders["authorization"])
+
+	t.Setenv("AZURE_CLIENT_SECRET", "wrong")
+	rejected := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "azure-rejected",
+			LocalPort:     18966,
+			RemoteAddress: "localhost:19966",
+			JWTTokenRef:   "azure-kv:" + ts.URL + "/secrets/cosmos-token",
+		}},
+	})
+	assert.ErrorContains(t, rejected.Start(), "invalid_client bad secret")
+
+	// Short references need a vault and a secret name
+	invalid := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{Name: "azure-invalid", LocalPort: 18966, RemoteAddress: "localhost:19966", JWTTokenRef: "azure-kv:chandra"}},
+	})
+	assert.ErrorContains(t, invalid.Start(), "<vault>/<secret>")
+}
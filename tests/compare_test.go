@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// recordingTestService echoes unary calls and remembers the metadata of the
+// last one
+type recordingTestService struct {
+	testpb.UnimplementedTestServiceServer
+
+	mu sync.Mutex
+	md metadata.MD
+}
+
+func (s *recordingTestService) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	s.md = md
+	s.mu.Unlock()
+	return &testpb.SimpleResponse{Payload: req.Payload}, nil
+}
+
+func (s *recordingTestService) metadata() metadata.MD {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.md
+}
+
+// serveRecording serves a recordingTestService and returns its address
+func serveRecording(t *testing.T) (*recordingTestService, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	service := &recordingTestService{}
+	server := grpc.NewServer()
+	testpb.RegisterTestServiceServer(server, service)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return service, lis.Addr().String()
+}
+
+func TestCompareMode(t *testing.T) {
+	_, primaryAddr := serveRecording(t)
+	shadow, shadowAddr := serveRecording(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "compare",
+			LocalPort:     18963,
+			RemoteAddress: primaryAddr,
+			JWTToken:      "primary_token",
+			Lanes:         []proxy.LaneConfig{{Name: "default"}},
+			Compare: &proxy.CompareConfig{
+				RemoteAddress: shadowAddr,
+				JWTToken:      "compare_token",
+				Methods:       []string{"/grpc.testing.TestService/UnaryCall"},
+			},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client, _ := dialTestService(t, "127.0.0.1:18963")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-proxy-lane", "default", "x-custom", "kept")
+	req := &testpb.SimpleRequest{Payload: &testpb.Payload{Body: []byte("compare me")}}
+	_, err := client.UnaryCall(ctx, req)
+	require.NoError(t, err)
+
+	// The comparison is reported after the call returns
+	match := func() bool {
+		metrics, _ := expvar.Get("grpc_proxy").(*expvar.Map).Get("compare").(*expvar.Map)
+		return metrics != nil && metrics.Get("compare_match") != nil
+	}
+	require.Eventually(t, match, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1.0, endpointMetric(t, "compare", "compare_total"))
+
+	md := shadow.metadata()
+	assert.Equal(t, []string{"Bearer compare_token"}, md.Get("authorization"))
+	assert.Equal(t, []string{"kept"}, md.Get("x-custom"))
+	assert.Empty(t, md.Get("x-proxy-lane"))
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/stats"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// encodingRecorder remembers the grpc-encoding request header of the last
+// call a server received
+type encodingRecorder struct {
+	mu       sync.Mutex
+	encoding string
+}
+
+func (r *encodingRecorder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (r *encodingRecorder) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if h, ok := s.(*stats.InHeader); ok {
+		r.mu.Lock()
+		r.encoding = h.Compression
+		r.mu.Unlock()
+	}
+}
+
+func (r *encodingRecorder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (r *encodingRecorder) HandleConn(context.Context, stats.ConnStats) {}
+
+func (r *encodingRecorder) last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.encoding
+}
+
+func TestCompression(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	recorder := &encodingRecorder{}
+	upstream := grpc.NewServer(grpc.StatsHandler(recorder))
+	testpb.RegisterTestServiceServer(upstream, &recordingTestService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "gzip",
+			LocalPort:     18816,
+			RemoteAddress: lis.Addr().String(),
+			JWTToken:      "gzip_jwt_token",
+			Compression:   "gzip",
+		}, {
+			Name:          "identity",
+			LocalPort:     18815,
+			RemoteAddress: lis.Addr().String(),
+			JWTToken:      "identity_jwt_token",
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	payload := &testpb.SimpleRequest{Payload: &testpb.Payload{Body: make([]byte, 4096)}}
+
+	t.Run("upstream calls are compressed", func(t *testing.T) {
+		client, _ := dialTestService(t, "127.0.0.1:18816")
+		resp, err := client.UnaryCall(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Len(t, resp.Payload.Body, 4096)
+		assert.Equal(t, "gzip", recorder.last())
+	})
+
+	t.Run("without compression calls are sent as is", func(t *testing.T) {
+		client, _ := dialTestService(t, "127.0.0.1:18815")
+		_, err := client.UnaryCall(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Equal(t, "", recorder.last())
+	})
+
+	t.Run("compressed client calls are accepted", func(t *testing.T) {
+		client, _ := dialTestService(t, "127.0.0.1:18815")
+		resp, err := client.UnaryCall(context.Background(), payload, grpc.UseCompressor(gzip.Name))
+		require.NoError(t, err)
+		assert.Len(t, resp.Payload.Body, 4096)
+	})
+
+	t.Run("unknown compressors are rejected", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "brotli",
+			LocalPort:     18816,
+			RemoteAddress: lis.Addr().String(),
+			JWTToken:      "brotli_jwt_token",
+			Compression:   "br",
+		})
+		assert.ErrorContains(t, err, `unsupported compression "br"`)
+	})
+}
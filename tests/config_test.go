@@ -2,11 +2,15 @@ package tests
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
 )
 
 // Config structs - imported from main package structure
@@ -162,3 +166,106 @@ func TestConfigFileNotFound(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, config)
 }
+
+func TestConfigFormats(t *testing.T) {
+	// The same configuration in every supported format
+	formats := map[string]string{
+		"yaml": `
+shutdown_timeout: 45s
+vars:
+  base_port: 9090
+endpoints:
+  - name: "test-cosmos"
+    local_port: ${base_port + index}
+    remote_address: "cosmos-grpc-api.chandrastation.com:443"
+    use_tls: true
+    jwt_token: "test_token_123"
+    allowed_methods: ["/cosmos.bank.v1beta1.Query/"]
+    connect:
+      timeout: 5s
+      required: true
+  - name: "test-osmosis"
+    local_port: ${base_port + index}
+    remote_address: "osmosis-grpc-api.chandrastation.com:443"
+    jwt_token: "test_token_456"
+`,
+		"toml": `
+shutdown_timeout = "45s"
+
+[vars]
+base_port = 9090
+
+[[endpoints]]
+name = "test-cosmos"
+local_port = "${base_port + index}"
+remote_address = "cosmos-grpc-api.chandrastation.com:443"
+use_tls = true
+jwt_token = "test_token_123"
+allowed_methods = ["/cosmos.bank.v1beta1.Query/"]
+
+[endpoints.connect]
+timeout = "5s"
+required = true
+
+[[endpoints]]
+name = "test-osmosis"
+local_port = "${base_port + index}"
+remote_address = "osmosis-grpc-api.chandrastation.com:443"
+jwt_token = "test_token_456"
+`,
+		"json": `{
+  "shutdown_timeout": "45s",
+  "vars": {"base_port": 9090},
+  "endpoints": [
+    {
+      "name": "test-cosmos",
+      "local_port": "${base_port + index}",
+      "remote_address": "cosmos-grpc-api.chandrastation.com:443",
+      "use_tls": true,
+      "jwt_token": "test_token_123",
+      "allowed_methods": ["/cosmos.bank.v1beta1.Query/"],
+      "connect": {"timeout": "5s", "required": true}
+    },
+    {
+      "name": "test-osmosis",
+      "local_port": "${base_port + index}",
+      "remote_address": "osmosis-grpc-api.chandrastation.com:443",
+      "jwt_token": "test_token_456"
+    }
+  ]
+}`,
+	}
+
+	for format, content := range formats {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config."+format)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+			// The format is detected from the extension
+			v := viper.New()
+			v.SetConfigFile(path)
+			require.NoError(t, v.ReadInConfig())
+			settings := v.AllSettings()
+			require.NoError(t, proxy.ExpandVars(settings))
+			require.NoError(t, v.MergeConfigMap(map[string]interface{}{"endpoints": settings["endpoints"]}))
+			var config proxy.ProxyConfig
+			require.NoError(t, v.Unmarshal(&config))
+			require.NoError(t, config.Validate())
+
+			assert.Equal(t, 45*time.Second, config.ShutdownTimeout)
+			require.Len(t, config.Endpoints, 2)
+			cosmos, osmosis := config.Endpoints[0], config.Endpoints[1]
+			assert.Equal(t, "test-cosmos", cosmos.Name)
+			assert.Equal(t, 9090, cosmos.LocalPort)
+			assert.Equal(t, "cosmos-grpc-api.chandrastation.com:443", cosmos.RemoteAddress)
+			assert.True(t, cosmos.UseTLS)
+			assert.Equal(t, "test_token_123", cosmos.JWTToken)
+			assert.Equal(t, []string{"/cosmos.bank.v1beta1.Query/"}, cosmos.AllowedMethods)
+			assert.Equal(t, 5*time.Second, cosmos.Connect.Timeout)
+			assert.True(t, cosmos.Connect.Required)
+			assert.Equal(t, "test-osmosis", osmosis.Name)
+			assert.Equal(t, 9091, osmosis.LocalPort)
+			assert.False(t, osmosis.UseTLS)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeEndpointAPI serves ChandraProxyEndpoint lists and watches for one
+// namespace, like the Kubernetes API server
+type fakeEndpointAPI struct {
+	mu      sync.Mutex
+	objects map[string]map[string]interface{}
+	version int
+	changed chan struct{}
+	watches int
+}
+
+func (api *fakeEndpointAPI) object(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name, "resourceVersion": fmt.Sprint(api.version)},
+		"spec":     api.objects[name],
+	}
+}
+
+func (api *fakeEndpointAPI) put(name string, spec map[string]interface{}) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.objects[name] = spec
+	api.version++
+	close(api.changed)
+	api.changed = make(chan struct{})
+}
+
+func (api *fakeEndpointAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/grpcproxy.chandrastation.com/v1alpha1/namespaces/proxies/chandraproxyendpoints" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer sa_token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"kind":"Status","message":"Unauthorized"}`)
+		return
+	}
+	api.mu.Lock()
+	if r.URL.Query().Get("watch") == "" {
+		items := []interface{}{}
+		for name := range api.objects {
+			items = append(items, api.object(name))
+		}
+		list := map[string]interface{}{"metadata": map[string]interface{}{"resourceVersion": fmt.Sprint(api.version)}, "items": items}
+		api.mu.Unlock()
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	api.watches++
+	// The first watch ends at once, like a watch reaching timeoutSeconds
+	if api.watches == 1 {
+		api.mu.Unlock()
+		return
+	}
+	from, changed := r.URL.Query().Get("resourceVersion"), api.changed
+	if from != fmt.Sprint(api.version) {
+		api.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":   "ERROR",
+			"object": map[string]interface{}{"kind": "Status", "code": 410, "message": "too old resource version"},
+		})
+		return
+	}
+	api.mu.Unlock()
+	w.(http.Flusher).Flush()
+	select {
+	case <-changed:
+	case <-r.Context().Done():
+		return
+	}
+	api.mu.Lock()
+	event := map[string]interface{}{"type": "MODIFIED", "object": api.object("orders")}
+	api.mu.Unlock()
+	json.NewEncoder(w).Encode(event)
+}
+
+func TestKubernetesEndpointSource(t *testing.T) {
+	api := &fakeEndpointAPI{
+		objects: map[string]map[string]interface{}{
+			"orders":  {"listen_address": ":9090", "remote_address": "orders:9090"},
+			"billing": {"name": "payments", "listen_address": ":9091", "remote_address": "billing:9090", "jwt_token_ref": "env:BILLING_TOKEN"},
+		},
+		version: 7,
+		changed: make(chan struct{}),
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa_token\n"), 0o600))
+	source, err := proxy.NewKubernetesEndpointSource(proxy.KubernetesSourceConfig{
+		APIServer: server.URL,
+		Namespace: "proxies",
+		TokenFile: tokenFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "chandraproxyendpoints.grpcproxy.chandrastation.com in namespace proxies", source.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	endpoints, err := source.Endpoints(ctx)
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+	assert.Equal(t, "orders", endpoints[0]["name"], "an endpoint is named after its object")
+	assert.Equal(t, "payments", endpoints[1]["name"], "a name in the spec wins")
+	assert.Equal(t, "env:BILLING_TOKEN", endpoints[1]["jwt_token_ref"])
+
+	t.Run("watch reports changes and survives server timeouts", func(t *testing.T) {
+		done := make(chan error, 1)
+		go func() { done <- source.Watch(ctx) }()
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case err := <-done:
+			t.Fatalf("watch returned before any change: %v", err)
+		default:
+		}
+
+		api.put("orders", map[string]interface{}{"listen_address": ":9090", "remote_address": "orders-v2:9090"})
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-ctx.Done():
+			t.Fatal("watch did not report the change")
+		}
+
+		endpoints, err := source.Endpoints(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "orders-v2:9090", endpoints[0]["remote_address"])
+	})
+
+	t.Run("watch errors are returned", func(t *testing.T) {
+		api.mu.Lock()
+		api.version += 5
+		api.mu.Unlock()
+		err := source.Watch(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "too old resource version")
+	})
+
+	t.Run("endpoints merge by name", func(t *testing.T) {
+		settings := map[string]interface{}{
+			"endpoints": []interface{}{
+				map[string]interface{}{"name": "orders", "listen_address": ":8080", "log_level": "debug"},
+			},
+		}
+		proxy.MergeEndpoints(settings, endpoints)
+		merged := settings["endpoints"].([]interface{})
+		require.Len(t, merged, 2)
+		orders := merged[0].(map[string]interface{})
+		assert.Equal(t, ":9090", orders["listen_address"], "the resource overrides the file")
+		assert.Equal(t, "debug", orders["log_level"], "keys the resource leaves unset are kept")
+	})
+
+	t.Run("API errors carry the status message", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(tokenFile, []byte("revoked"), 0o600))
+		_, err := source.Endpoints(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Unauthorized")
+	})
+}
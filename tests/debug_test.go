@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19932")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	get := func(port int, path string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	start := func(adminPort, port int, debug bool) {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "debug",
+				LocalPort:     port,
+				RemoteAddress: "127.0.0.1:19932",
+				JWTToken:      "debug_jwt_token",
+			}},
+			Admin:           &proxy.AdminConfig{LocalPort: adminPort, Debug: debug},
+			ShutdownTimeout: time.Second,
+		})
+		require.NoError(t, manager.Start())
+		t.Cleanup(func() { manager.Stop() })
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		start(18916, 18915, true)
+
+		code, body := get(18916, "/debug/vars")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `"grpc_proxy"`)
+		assert.Contains(t, body, `"memstats"`)
+
+		code, body = get(18916, "/debug/pprof/goroutine?debug=1")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, "goroutine profile")
+
+		code, body = get(18916, "/debug/pprof/")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, "heap")
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		start(18914, 18913, false)
+
+		code, _ := get(18914, "/debug/vars")
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = get(18914, "/debug/pprof/")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// slowTestService answers UnaryCall after a delay, counting the calls it gets
+type slowTestService struct {
+	testpb.UnimplementedTestServiceServer
+	calls atomic.Int32
+}
+
+func (s *slowTestService) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	n := s.calls.Add(1)
+	time.Sleep(300 * time.Millisecond)
+	grpc.SetHeader(ctx, metadata.Pairs("x-cosmos-block-height", "1234"))
+	grpc.SetTrailer(ctx, metadata.Pairs("x-call", string(rune('0'+n))))
+	return &testpb.SimpleResponse{OauthScope: "size-" + string(rune('0'+req.ResponseSize))}, nil
+}
+
+func TestDedup(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19941")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	service := &slowTestService{}
+	testpb.RegisterTestServiceServer(upstream, service)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "dedup",
+			LocalPort:     18934,
+			RemoteAddress: "127.0.0.1:19941",
+			JWTToken:      "dedup_jwt_token",
+			Dedup:         &proxy.DedupConfig{Methods: []string{"/grpc.testing.TestService/UnaryCall"}},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18934", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+
+	call := func(size int32) (*testpb.SimpleResponse, metadata.MD, metadata.MD, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var header, trailer metadata.MD
+		resp, err := client.UnaryCall(ctx, &testpb.SimpleRequest{ResponseSize: size}, grpc.Header(&header), grpc.Trailer(&trailer))
+		return resp, header, trailer, err
+	}
+
+	t.Run("identical calls share one upstream call", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, header, trailer, err := call(1)
+				if assert.NoError(t, err) {
+					assert.Equal(t, "size-1", resp.OauthScope)
+					assert.Equal(t, []string{"1234"}, header.Get("x-cosmos-block-height"))
+					assert.Equal(t, []string{"1"}, trailer.Get("x-call"))
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), service.calls.Load())
+	})
+
+	t.Run("different requests are not shared", func(t *testing.T) {
+		before := service.calls.Load()
+		var wg sync.WaitGroup
+		for _, size := range []int32{2, 3} {
+			wg.Add(1)
+			go func(size int32) {
+				defer wg.Done()
+				resp, _, _, err := call(size)
+				if assert.NoError(t, err) {
+					assert.Equal(t, "size-"+string(rune('0'+size)), resp.OauthScope)
+				}
+			}(size)
+		}
+		wg.Wait()
+		assert.Equal(t, before+2, service.calls.Load())
+	})
+
+	t.Run("finished calls are not reused", func(t *testing.T) {
+		before := service.calls.Load()
+		_, _, _, err := call(1)
+		require.NoError(t, err)
+		assert.Equal(t, before+1, service.calls.Load())
+	})
+}
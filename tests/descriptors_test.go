@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// writeDescriptorSet writes fd and its imports as a FileDescriptorSet
+func writeDescriptorSet(t *testing.T, fd protoreflect.FileDescriptor) string {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		for i := 0; i < fd.Imports().Len(); i++ {
+			add(fd.Imports().Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	add(fd)
+	b, err := proto.Marshal(set)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "test.pb")
+	require.NoError(t, os.WriteFile(path, b, 0600))
+	return path
+}
+
+func TestDescriptorSet(t *testing.T) {
+	// The upstream has reflection turned off
+	lis, err := net.Listen("tcp", "127.0.0.1:19942")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "descriptors",
+			LocalPort:     18936,
+			RemoteAddress: "127.0.0.1:19942",
+			JWTToken:      "descriptors_jwt_token",
+			DescriptorSet: writeDescriptorSet(t, testpb.File_grpc_testing_test_proto),
+			MessageLog:    &proxy.MessageLogConfig{Methods: []string{"grpc.testing."}},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18936", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("message log", func(t *testing.T) {
+		_, err := testpb.NewTestServiceClient(conn).UnaryCall(ctx, &testpb.SimpleRequest{ResponseSize: 42})
+		require.NoError(t, err)
+		out := strings.ReplaceAll(logs.String(), " ", "")
+		assert.Contains(t, out, `/grpc.testing.TestService/UnaryCallrequest:{"responseSize":42}`)
+	})
+
+	t.Run("reflection", func(t *testing.T) {
+		stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		require.NoError(t, err)
+		defer stream.CloseSend()
+		ask := func(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+			require.NoError(t, stream.Send(req))
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			return resp
+		}
+
+		resp := ask(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+		})
+		var names []string
+		for _, s := range resp.GetListServicesResponse().GetService() {
+			names = append(names, s.Name)
+		}
+		assert.Contains(t, names, "grpc.testing.TestService")
+
+		resp = ask(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.testing.SimpleRequest"},
+		})
+		files := resp.GetFileDescriptorResponse().GetFileDescriptorProto()
+		require.NotEmpty(t, files)
+		fd := &descriptorpb.FileDescriptorProto{}
+		require.NoError(t, proto.Unmarshal(files[0], fd))
+		assert.Equal(t, "grpc/testing/messages.proto", fd.GetName())
+
+		resp = ask(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "no.such.Message"},
+		})
+		require.NotNil(t, resp.GetErrorResponse())
+		assert.Equal(t, int32(codes.NotFound), resp.GetErrorResponse().ErrorCode)
+	})
+}
+
+func TestDescriptorSetInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.pb")
+	require.NoError(t, os.WriteFile(path, []byte("not a descriptor set"), 0600))
+	for _, descriptorSet := range []string{path, filepath.Join(t.TempDir(), "missing.pb")} {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "descriptors",
+			LocalPort:     18935,
+			RemoteAddress: "127.0.0.1:19942",
+			JWTToken:      "descriptors_jwt_token",
+			DescriptorSet: descriptorSet,
+		})
+		assert.Error(t, err)
+	}
+}
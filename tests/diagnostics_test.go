@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestDiagnosticHeaders(t *testing.T) {
+	_, upstream := serveRecording(t)
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:              "diagnostics",
+		LocalPort:         18856,
+		RemoteAddress:     upstream,
+		JWTToken:          "diagnostics_token",
+		DiagnosticHeaders: true,
+		Cache:             &proxy.CacheConfig{Methods: []string{"/grpc.testing.TestService/UnaryCall"}, TTL: time.Minute},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	client, _ := dialTestService(t, "127.0.0.1:18856")
+	ctx := context.Background()
+	call := func() (metadata.MD, metadata.MD) {
+		var header, trailer metadata.MD
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header), grpc.Trailer(&trailer))
+		require.NoError(t, err)
+		return header, trailer
+	}
+
+	header, trailer := call()
+	assert.Equal(t, []string{"diagnostics"}, header.Get("x-proxy-endpoint"))
+	assert.Equal(t, []string{upstream}, header.Get("x-upstream-address"))
+	assert.Equal(t, []string{"miss"}, header.Get("x-cache-status"))
+	assert.Len(t, trailer.Get("x-proxy-duration-ms"), 1)
+
+	// A cached response was not served by any upstream
+	header, trailer = call()
+	assert.Equal(t, []string{"hit"}, header.Get("x-cache-status"))
+	assert.Empty(t, header.Get("x-upstream-address"))
+	assert.Len(t, trailer.Get("x-proxy-duration-ms"), 1)
+
+	// Failed calls carry everything in the trailer
+	var trailer2 metadata.MD
+	_, err = client.EmptyCall(ctx, &testpb.Empty{}, grpc.Trailer(&trailer2))
+	require.Error(t, err)
+	assert.Equal(t, []string{"diagnostics"}, trailer2.Get("x-proxy-endpoint"))
+	assert.Equal(t, []string{upstream}, trailer2.Get("x-upstream-address"))
+	assert.Empty(t, trailer2.Get("x-cache-status"))
+}
+
+func TestDiagnosticHeadersOff(t *testing.T) {
+	_, upstream := serveRecording(t)
+	p, err := proxy.NewProxyServer(proxy.Config{Name: "no-diagnostics", LocalPort: 18855, RemoteAddress: upstream, JWTToken: "diagnostics_token"})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	client, _ := dialTestService(t, "127.0.0.1:18855")
+	var header, trailer metadata.MD
+	_, err = client.UnaryCall(context.Background(), &testpb.SimpleRequest{}, grpc.Header(&header), grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	assert.Empty(t, header.Get("x-proxy-endpoint"))
+	assert.Empty(t, trailer.Get("x-proxy-duration-ms"))
+}
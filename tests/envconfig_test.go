@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// loadEnvConfig merges env-defined endpoints into a YAML config the way grpc-proxy does
+func loadEnvConfig(t *testing.T, yaml string, environ []string) (*proxy.ProxyConfig, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(yaml)))
+	settings := v.AllSettings()
+	if err := proxy.MergeEnvEndpoints(settings, environ); err != nil {
+		return nil, err
+	}
+	require.NoError(t, proxy.ExpandVars(settings))
+	if settings["endpoints"] != nil {
+		require.NoError(t, v.MergeConfigMap(map[string]interface{}{"endpoints": settings["endpoints"]}))
+	}
+	var config proxy.ProxyConfig
+	require.NoError(t, v.Unmarshal(&config))
+	return &config, nil
+}
+
+func TestEnvEndpoints(t *testing.T) {
+	t.Run("without a config file", func(t *testing.T) {
+		environ := []string{
+			"HOME=/root",
+			"GRPC_PROXY_ENDPOINTS_1_NAME=osmosis",
+			"GRPC_PROXY_ENDPOINTS_1_LOCAL_PORT=9091",
+			"GRPC_PROXY_ENDPOINTS_1_REMOTE_ADDRESS=osmosis-grpc-api.chandrastation.com:443",
+			"GRPC_PROXY_ENDPOINTS_1_JWT_TOKEN=osmosis_token",
+			"GRPC_PROXY_ENDPOINTS_0_NAME=cosmos",
+			"GRPC_PROXY_ENDPOINTS_0_LOCAL_PORT=9090",
+			"GRPC_PROXY_ENDPOINTS_0_REMOTE_ADDRESS=cosmos-grpc-api.chandrastation.com:443",
+			"GRPC_PROXY_ENDPOINTS_0_USE_TLS=true",
+			"GRPC_PROXY_ENDPOINTS_0_JWT_TOKEN=cosmos_token",
+			"GRPC_PROXY_ENDPOINTS_0_CONNECT__TIMEOUT=5s",
+			"GRPC_PROXY_ENDPOINTS_0_ALLOWED_METHODS=/cosmos.bank.v1beta1.Query/,/cosmos.staking.v1beta1.Query/",
+		}
+		assert.True(t, proxy.HasEnvEndpoints(environ))
+		config, err := loadEnvConfig(t, "", environ)
+		require.NoError(t, err)
+		require.NoError(t, config.Validate())
+		require.Len(t, config.Endpoints, 2)
+
+		cosmos, osmosis := config.Endpoints[0], config.Endpoints[1]
+		assert.Equal(t, "cosmos", cosmos.Name)
+		assert.Equal(t, 9090, cosmos.LocalPort)
+		assert.True(t, cosmos.UseTLS)
+		assert.Equal(t, "cosmos_token", cosmos.JWTToken)
+		assert.Equal(t, 5*time.Second, cosmos.Connect.Timeout)
+		assert.Equal(t, []string{"/cosmos.bank.v1beta1.Query/", "/cosmos.staking.v1beta1.Query/"}, cosmos.AllowedMethods)
+		assert.Equal(t, "osmosis", osmosis.Name)
+		assert.False(t, osmosis.UseTLS)
+	})
+
+	t.Run("merged with a config file", func(t *testing.T) {
+		config, err := loadEnvConfig(t, `
+vars:
+  provider: chandrastation.com
+endpoints:
+  - name: cosmos
+    local_port: 9090
+    remote_address: cosmos-grpc-api.chandrastation.com:443
+    use_tls: true
+    jwt_token: file_token
+    connect:
+      timeout: 5s
+`, []string{
+			// Overrides the token of the file's endpoint
+			"GRPC_PROXY_ENDPOINTS_0_NAME=cosmos",
+			"GRPC_PROXY_ENDPOINTS_0_JWT_TOKEN=env_token",
+			"GRPC_PROXY_ENDPOINTS_0_CONNECT__REQUIRED=true",
+			// And adds another one, using the file's variables
+			"GRPC_PROXY_ENDPOINTS_1_NAME=juno",
+			"GRPC_PROXY_ENDPOINTS_1_LOCAL_PORT=9092",
+			"GRPC_PROXY_ENDPOINTS_1_REMOTE_ADDRESS=juno-grpc-api.${provider}:443",
+			"GRPC_PROXY_ENDPOINTS_1_JWT_TOKEN=juno_token",
+		})
+		require.NoError(t, err)
+		require.Len(t, config.Endpoints, 2)
+
+		cosmos, juno := config.Endpoints[0], config.Endpoints[1]
+		assert.Equal(t, "env_token", cosmos.JWTToken)
+		assert.Equal(t, 9090, cosmos.LocalPort)
+		assert.Equal(t, 5*time.Second, cosmos.Connect.Timeout)
+		assert.True(t, cosmos.Connect.Required)
+		assert.Equal(t, "juno", juno.Name)
+		assert.Equal(t, "juno-grpc-api.chandrastation.com:443", juno.RemoteAddress)
+	})
+
+	t.Run("invalid variables", func(t *testing.T) {
+		assert.False(t, proxy.HasEnvEndpoints([]string{"HOME=/root", "GRPC_PROXY_CONFIG=x"}))
+		for _, environ := range [][]string{
+			{"GRPC_PROXY_ENDPOINTS_0_LOCAL_PORT=9090"},
+			{"GRPC_PROXY_ENDPOINTS_NAME=cosmos"},
+			{"GRPC_PROXY_ENDPOINTS_x_NAME=cosmos"},
+			{"GRPC_PROXY_ENDPOINTS_0_=cosmos"},
+		} {
+			_, err := loadEnvConfig(t, "", environ)
+			assert.Error(t, err, environ)
+		}
+	})
+}
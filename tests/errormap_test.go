@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestErrorTranslation(t *testing.T) {
+	mockServer, _, err := startMockGRPCServer(19922)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	// Faults stand in for an upstream that rejects the call
+	start := func(t *testing.T, port int, abortCode string, errors *proxy.ErrorsConfig) *proxy.ProxyServer {
+		p, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "errors-test",
+			LocalPort:     port,
+			RemoteAddress: "localhost:19922",
+			JWTToken:      "errors_token",
+			Faults:        &proxy.FaultConfig{AbortCode: abortCode, AbortPercent: 100},
+			Errors:        errors,
+		})
+		require.NoError(t, err)
+		go p.Start()
+		time.Sleep(200 * time.Millisecond)
+		return p
+	}
+
+	errorInfo := func(t *testing.T, st *status.Status) *errdetails.ErrorInfo {
+		t.Helper()
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.ErrorInfo); ok {
+				return info
+			}
+		}
+		t.Fatalf("no ErrorInfo in %v", st.Details())
+		return nil
+	}
+
+	t.Run("mapping and details", func(t *testing.T) {
+		p := start(t, 18899, "UNAUTHENTICATED", &proxy.ErrorsConfig{
+			Details: true,
+			Mappings: []proxy.ErrorMapping{
+				{Code: "NOT_FOUND", NewMessage: "not this one"},
+				{Code: "UNAUTHENTICATED", Message: "fault", NewCode: "PERMISSION_DENIED", NewMessage: "{endpoint}: proxy token expired - contact infra ({message})"},
+			},
+		})
+		defer p.Stop()
+
+		st := status.Convert(listServicesThrough(t, "localhost:18899"))
+		assert.Equal(t, codes.PermissionDenied, st.Code())
+		assert.Equal(t, "errors-test: proxy token expired - contact infra (aborted by fault injection)", st.Message())
+
+		info := errorInfo(t, st)
+		assert.Equal(t, "PERMISSION_DENIED", info.Reason)
+		assert.Equal(t, "grpc-proxy", info.Domain)
+		assert.Equal(t, "errors-test", info.Metadata["endpoint"])
+		assert.Equal(t, "UNAUTHENTICATED", info.Metadata["upstream_code"])
+		assert.Equal(t, float64(1), endpointMetric(t, "errors-test", "errors_translated"))
+	})
+
+	t.Run("details without a match", func(t *testing.T) {
+		p := start(t, 18898, "UNAVAILABLE", &proxy.ErrorsConfig{
+			Details:  true,
+			Mappings: []proxy.ErrorMapping{{Code: "UNAUTHENTICATED", NewMessage: "proxy token expired"}},
+		})
+		defer p.Stop()
+
+		st := status.Convert(listServicesThrough(t, "localhost:18898"))
+		assert.Equal(t, codes.Unavailable, st.Code())
+		assert.Equal(t, "aborted by fault injection", st.Message())
+
+		info := errorInfo(t, st)
+		assert.Equal(t, "UNAVAILABLE", info.Reason)
+		assert.Equal(t, "errors-test", info.Metadata["endpoint"])
+		assert.NotContains(t, info.Metadata, "upstream_code")
+	})
+
+	t.Run("mapping without details", func(t *testing.T) {
+		p := start(t, 18897, "UNAUTHENTICATED", &proxy.ErrorsConfig{
+			Mappings: []proxy.ErrorMapping{{Message: "^aborted", NewMessage: "proxy token expired"}},
+		})
+		defer p.Stop()
+
+		st := status.Convert(listServicesThrough(t, "localhost:18897"))
+		assert.Equal(t, codes.Unauthenticated, st.Code())
+		assert.Equal(t, "proxy token expired", st.Message())
+		assert.Empty(t, st.Details())
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		for _, mapping := range []proxy.ErrorMapping{
+			{Code: "NOT_A_CODE", NewMessage: "x"},
+			{NewCode: "OK"},
+			{Message: "(", NewMessage: "x"},
+			{Code: "UNAUTHENTICATED"},
+		} {
+			_, err := proxy.NewProxyServer(proxy.Config{Name: "errors-test", JWTToken: "errors_token", RemoteAddress: "localhost:19922",
+				Errors: &proxy.ErrorsConfig{Mappings: []proxy.ErrorMapping{mapping}}})
+			assert.Error(t, err, "%+v", mapping)
+		}
+	})
+}
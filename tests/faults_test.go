@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestFaultInjection(t *testing.T) {
+	mockServer, _, err := startMockGRPCServer(19982)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	start := func(t *testing.T, port int, faults *proxy.FaultConfig) *proxy.ProxyServer {
+		p, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "faults-test",
+			LocalPort:     port,
+			RemoteAddress: "localhost:19982",
+			JWTToken:      "faults_token",
+			Faults:        faults,
+		})
+		require.NoError(t, err)
+		go p.Start()
+		time.Sleep(200 * time.Millisecond)
+		return p
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		p := start(t, 18982, &proxy.FaultConfig{AbortCode: "UNAVAILABLE", AbortPercent: 100})
+		defer p.Stop()
+		assert.Equal(t, codes.Unavailable, status.Code(listServicesThrough(t, "localhost:18982")))
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		p := start(t, 18981, &proxy.FaultConfig{Delay: 300 * time.Millisecond, DelayPercent: 100})
+		defer p.Stop()
+		begin := time.Now()
+		require.NoError(t, listServicesThrough(t, "localhost:18981"))
+		assert.GreaterOrEqual(t, time.Since(begin), 300*time.Millisecond)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		p := start(t, 18980, &proxy.FaultConfig{ResetPercent: 100})
+		defer p.Stop()
+		assert.Equal(t, codes.Unavailable, status.Code(listServicesThrough(t, "localhost:18980")))
+	})
+
+	t.Run("methods not selected", func(t *testing.T) {
+		p := start(t, 18979, &proxy.FaultConfig{Methods: []string{"/cosmos."}, AbortCode: "UNAVAILABLE", AbortPercent: 100})
+		defer p.Stop()
+		assert.NoError(t, listServicesThrough(t, "localhost:18979"))
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{Name: "faults-test", JWTToken: "faults_token", RemoteAddress: "localhost:19982",
+			Faults: &proxy.FaultConfig{AbortCode: "NOT_A_CODE", AbortPercent: 10}})
+		assert.Error(t, err)
+	})
+}
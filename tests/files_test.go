@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// kubeletVolume mimics how the kubelet projects a Secret: each file is a
+// symlink through ..data to a timestamped directory, and updates swap ..data
+type kubeletVolume struct {
+	t       *testing.T
+	dir     string
+	version int
+}
+
+func newKubeletVolume(t *testing.T, files map[string][]byte) *kubeletVolume {
+	v := &kubeletVolume{t: t, dir: t.TempDir()}
+	v.update(files)
+	for name := range files {
+		require.NoError(t, os.Symlink(filepath.Join("..data", name), filepath.Join(v.dir, name)))
+	}
+	return v
+}
+
+func (v *kubeletVolume) path(name string) string {
+	return filepath.Join(v.dir, name)
+}
+
+// update writes a new timestamped directory and atomically points ..data at it
+func (v *kubeletVolume) update(files map[string][]byte) {
+	v.version++
+	version := filepath.Join(v.dir, fmt.Sprintf("..version_%d", v.version))
+	require.NoError(v.t, os.Mkdir(version, 0755))
+	for name, content := range files {
+		require.NoError(v.t, os.WriteFile(filepath.Join(version, name), content, 0600))
+	}
+	tmp := filepath.Join(v.dir, "..data_tmp")
+	require.NoError(v.t, os.Symlink(filepath.Base(version), tmp))
+	require.NoError(v.t, os.Rename(tmp, filepath.Join(v.dir, "..data")))
+}
+
+func TestMountedSecretRotation(t *testing.T) {
+	upstream, mockService, caFile := startMockTLSServer(t, 19965, "staging.chandra.test")
+	defer upstream.Stop()
+	ca, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+
+	// Start with a CA that did not sign the upstream's certificate
+	other, _, otherCAFile := startMockTLSServer(t, 19964, "other.chandra.test")
+	other.Stop()
+	otherCA, err := os.ReadFile(otherCAFile)
+	require.NoError(t, err)
+
+	volume := newKubeletVolume(t, map[string][]byte{"token": []byte("file_token_1\n"), "ca.pem": otherCA})
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "mounted",
+			LocalPort:     18965,
+			RemoteAddress: "localhost:19965",
+			UseTLS:        true,
+			ServerName:    "staging.chandra.test",
+			CAFile:        volume.path("ca.pem"),
+			JWTTokenRef:   "file:" + volume.path("token"),
+			Connect:       proxy.ConnectConfig{Timeout: 200 * time.Millisecond, MaxDelay: 200 * time.Millisecond},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	assert.Error(t, listServicesThrough(t, "localhost:18965"))
+
+	volume.update(map[string][]byte{"token": []byte("file_token_2\n"), "ca.pem": ca})
+	time.Sleep(3 * time.Second)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18965"))
+	assert.Equal(t, []string{"Bearer file_token_2"}, mockService.ReceivedHeaders["authorization"])
+}
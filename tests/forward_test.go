@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// echoTestService echoes unary and full duplex calls; full duplex calls
+// report the authorization they received in their header
+type echoTestService struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (echoTestService) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	if req.ResponseStatus != nil {
+		return nil, status.Error(codes.Code(req.ResponseStatus.Code), req.ResponseStatus.Message)
+	}
+	return &testpb.SimpleResponse{Payload: req.Payload}, nil
+}
+
+func (echoTestService) FullDuplexCall(stream testpb.TestService_FullDuplexCallServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	stream.SetHeader(metadata.Pairs("seen-authorization", md.Get("authorization")[0]))
+	stream.SetTrailer(metadata.Pairs("echoed", "true"))
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{Payload: req.Payload}); err != nil {
+			return err
+		}
+	}
+}
+
+// forwardingServer serves a proxy forwarding to conn with handler options
+// built from director, returning its address
+func forwardingServer(t testing.TB, listen string, opts func(proxy.StreamDirector) []grpc.ServerOption, conn *grpc.ClientConn) string {
+	director := func(ctx context.Context, _ string) (context.Context, grpc.ClientConnInterface, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		md = md.Copy()
+		md.Set("authorization", "Bearer forwarded")
+		return metadata.NewOutgoingContext(ctx, md), conn, nil
+	}
+	lis, err := net.Listen("tcp", listen)
+	require.NoError(t, err)
+	server := grpc.NewServer(opts(director)...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+// echoUpstream serves echoTestService and returns a connection to it
+func echoUpstream(t testing.TB, listen string) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", listen)
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, echoTestService{})
+	go upstream.Serve(lis)
+	t.Cleanup(upstream.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func dialTestService(t testing.TB, addr string) (testpb.TestServiceClient, *grpc.ClientConn) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return testpb.NewTestServiceClient(conn), conn
+}
+
+func TestForwardHandler(t *testing.T) {
+	upstream := echoUpstream(t, "127.0.0.1:19903")
+	addr := forwardingServer(t, "127.0.0.1:18859", proxy.ForwardServerOptions, upstream)
+	client, conn := dialTestService(t, addr)
+	ctx := context.Background()
+
+	t.Run("unary", func(t *testing.T) {
+		body := []byte("hello through the proxy")
+		resp, err := client.UnaryCall(ctx, &testpb.SimpleRequest{Payload: &testpb.Payload{Body: body}})
+		require.NoError(t, err)
+		assert.Equal(t, body, resp.Payload.Body)
+	})
+
+	t.Run("upstream errors are passed through", func(t *testing.T) {
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{ResponseStatus: &testpb.EchoStatus{Code: int32(codes.NotFound), Message: "no such block"}})
+		require.Error(t, err)
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		assert.Equal(t, "no such block", status.Convert(err).Message())
+	})
+
+	t.Run("stream with header and trailer", func(t *testing.T) {
+		stream, err := client.FullDuplexCall(ctx)
+		require.NoError(t, err)
+		for i := 0; i < 50; i++ {
+			body := make([]byte, 1+i*997)
+			body[0] = byte(i)
+			require.NoError(t, stream.Send(&testpb.StreamingOutputCallRequest{Payload: &testpb.Payload{Body: body}}))
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, body, resp.Payload.Body)
+		}
+		require.NoError(t, stream.CloseSend())
+		_, err = stream.Recv()
+		assert.Equal(t, io.EOF, err)
+
+		header, err := stream.Header()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bearer forwarded"}, header.Get("seen-authorization"))
+		assert.Equal(t, []string{"true"}, stream.Trailer().Get("echoed"))
+	})
+
+	t.Run("local services keep the proto codec", func(t *testing.T) {
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	})
+}
@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestUpstreamFreshness(t *testing.T) {
+	node := startFakeNode(t, 19948, "cosmoshub-4")
+
+	var referenceHeight atomic.Int64
+	reference := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":-1,"result":{"sync_info":{"latest_block_height":"%d"}}}`, referenceHeight.Load())
+	}))
+	defer reference.Close()
+
+	start := func(t *testing.T, port int, freshness *proxy.FreshnessConfig) *proxy.ProxyServer {
+		p, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "freshness-test",
+			LocalPort:     port,
+			RemoteAddress: "localhost:19948",
+			JWTToken:      "freshness_token",
+			Freshness:     freshness,
+		})
+		require.NoError(t, err)
+		go p.Start()
+		time.Sleep(200 * time.Millisecond)
+		return p
+	}
+	servingStatus := func(p *proxy.ProxyServer, want healthpb.HealthCheckResponse_ServingStatus) func() bool {
+		return func() bool { return p.ServingStatus() == want }
+	}
+
+	t.Run("max block age", func(t *testing.T) {
+		node.height.Store(1000)
+		node.blockTime.Store(time.Now())
+		p := start(t, 18948, &proxy.FreshnessConfig{Interval: 100 * time.Millisecond, MaxBlockAge: time.Minute})
+		defer p.Stop()
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, p.ServingStatus())
+
+		node.blockTime.Store(time.Now().Add(-time.Hour))
+		require.Eventually(t, servingStatus(p, healthpb.HealthCheckResponse_NOT_SERVING), 2*time.Second, 50*time.Millisecond)
+		// Stale upstreams are reported, not cut off
+		assert.NoError(t, listServicesThrough(t, "localhost:18948"))
+
+		node.blockTime.Store(time.Now())
+		require.Eventually(t, servingStatus(p, healthpb.HealthCheckResponse_SERVING), 2*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("reference lag", func(t *testing.T) {
+		node.height.Store(995)
+		node.blockTime.Store(time.Now())
+		referenceHeight.Store(1000)
+		p := start(t, 18947, &proxy.FreshnessConfig{Interval: 100 * time.Millisecond, ReferenceRPC: reference.URL, MaxLagBlocks: 10})
+		defer p.Stop()
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, p.ServingStatus())
+
+		referenceHeight.Store(2000)
+		require.Eventually(t, servingStatus(p, healthpb.HealthCheckResponse_NOT_SERVING), 2*time.Second, 50*time.Millisecond)
+
+		node.height.Store(1999)
+		require.Eventually(t, servingStatus(p, healthpb.HealthCheckResponse_SERVING), 2*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "freshness-test",
+			LocalPort:     18946,
+			RemoteAddress: "localhost:19948",
+			JWTToken:      "freshness_token",
+			Freshness:     &proxy.FreshnessConfig{Interval: time.Second},
+		})
+		assert.Error(t, err)
+	})
+}
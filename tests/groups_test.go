@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestSelectEndpoints(t *testing.T) {
+	endpoints := []proxy.Config{
+		{Name: "cosmos-hub", Groups: []string{"cosmos", "mainnet"}},
+		{Name: "cosmos-testnet", Groups: []string{"cosmos", "testnet"}},
+		{Name: "osmosis", Groups: []string{"mainnet"}},
+		{Name: "juno"},
+	}
+	names := func(configs []proxy.Config) []string {
+		var n []string
+		for _, c := range configs {
+			n = append(n, c.Name)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name          string
+		only, exclude []string
+		want          []string
+		unmatched     []string
+	}{
+		{name: "no selection", want: []string{"cosmos-hub", "cosmos-testnet", "osmosis", "juno"}},
+		{name: "only a group", only: []string{"cosmos"}, want: []string{"cosmos-hub", "cosmos-testnet"}},
+		{name: "only groups and names", only: []string{"cosmos", "osmosis"}, want: []string{"cosmos-hub", "cosmos-testnet", "osmosis"}},
+		{name: "exclude a name", exclude: []string{"juno"}, want: []string{"cosmos-hub", "cosmos-testnet", "osmosis"}},
+		{name: "exclude wins over only", only: []string{"mainnet"}, exclude: []string{"osmosis"}, want: []string{"cosmos-hub"}},
+		{name: "unmatched selectors", only: []string{"cosmos", "cosmso"}, exclude: []string{"stargaze"},
+			want: []string{"cosmos-hub", "cosmos-testnet"}, unmatched: []string{"cosmso", "stargaze"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, unmatched, err := proxy.SelectEndpoints(endpoints, tt.only, tt.exclude)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, names(selected))
+			assert.Equal(t, tt.unmatched, unmatched)
+		})
+	}
+
+	t.Run("nothing selected", func(t *testing.T) {
+		_, _, err := proxy.SelectEndpoints(endpoints, []string{"testnet"}, []string{"cosmos"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "--only testnet --exclude cosmos")
+	})
+
+	t.Run("invalid group", func(t *testing.T) {
+		config := proxy.Config{Name: "cosmos-hub", LocalPort: 9090, RemoteAddress: "localhost:9091",
+			JWTToken: "token", Groups: []string{"cosmos,osmosis"}}
+		err := config.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid group")
+	})
+}
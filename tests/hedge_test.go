@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestHedging(t *testing.T) {
+	// The slow upstream takes 300ms per call and tags its answers
+	slow := &slowTestService{}
+	for port, service := range map[string]testpb.TestServiceServer{"19920": slow, "19919": testService{}} {
+		lis, err := net.Listen("tcp", "127.0.0.1:"+port)
+		require.NoError(t, err)
+		server := grpc.NewServer()
+		testpb.RegisterTestServiceServer(server, service)
+		go server.Serve(lis)
+		defer server.Stop()
+	}
+
+	start := func(t *testing.T, name string, port int, primary, secondary string) *proxy.Manager {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          name,
+				LocalPort:     port,
+				RemoteAddress: primary,
+				JWTToken:      "hedge_token",
+				Hedge: &proxy.HedgeConfig{
+					RemoteAddress: secondary,
+					Delay:         50 * time.Millisecond,
+					Methods:       []string{"/grpc.testing.TestService/UnaryCall"},
+				},
+			}},
+			ShutdownTimeout: time.Second,
+		})
+		require.NoError(t, manager.Start())
+		return manager
+	}
+	call := func(t *testing.T, addr string) (*testpb.SimpleResponse, metadata.MD, time.Duration) {
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var header metadata.MD
+		begin := time.Now()
+		resp, err := testpb.NewTestServiceClient(conn).UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		return resp, header, time.Since(begin)
+	}
+
+	t.Run("slow primary", func(t *testing.T) {
+		manager := start(t, "hedge-slow", 18893, "127.0.0.1:19920", "127.0.0.1:19919")
+		defer manager.Stop()
+
+		resp, header, elapsed := call(t, "127.0.0.1:18893")
+		assert.Empty(t, resp.OauthScope, "answered by the hedge upstream")
+		assert.Empty(t, header.Get("x-cosmos-block-height"))
+		assert.Less(t, elapsed, 250*time.Millisecond)
+		assert.Equal(t, 1.0, endpointMetric(t, "hedge-slow", "hedged_calls"))
+		assert.Equal(t, 1.0, endpointMetric(t, "hedge-slow", "hedge_wins"))
+	})
+
+	t.Run("fast primary", func(t *testing.T) {
+		manager := start(t, "hedge-fast", 18892, "127.0.0.1:19919", "127.0.0.1:19920")
+		defer manager.Stop()
+
+		before := slow.calls.Load()
+		call(t, "127.0.0.1:18892")
+		assert.Equal(t, before, slow.calls.Load(), "the hedge upstream was not called")
+	})
+
+	t.Run("slow hedge", func(t *testing.T) {
+		// Both upstreams are slow, so the primary still wins
+		manager := start(t, "hedge-both", 18891, "127.0.0.1:19920", "127.0.0.1:19920")
+		defer manager.Stop()
+
+		resp, header, _ := call(t, "127.0.0.1:18891")
+		assert.Equal(t, "size-0", resp.OauthScope)
+		assert.Equal(t, []string{"1234"}, header.Get("x-cosmos-block-height"))
+		assert.Equal(t, 1.0, endpointMetric(t, "hedge-both", "hedged_calls"))
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{Name: "hedge", JWTToken: "hedge_token", RemoteAddress: "127.0.0.1:19919",
+			Hedge: &proxy.HedgeConfig{Delay: time.Second}})
+		assert.Error(t, err)
+	})
+}
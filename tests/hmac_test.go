@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// hmacHex is the hex HMAC-SHA256 an upstream expects for method at timestamp
+func hmacHex(secret, method, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACSigning(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{
+				Name:          "hmac",
+				LocalPort:     18840,
+				RemoteAddress: upstreamAddr,
+				Auth: &proxy.UpstreamAuthConfig{
+					Type: proxy.AuthHMAC,
+					HMAC: &proxy.HMACAuthConfig{KeyID: "chandra-1", Secret: "s3cret"},
+				},
+			},
+			{
+				Name:          "hmac-with-token",
+				LocalPort:     18839,
+				RemoteAddress: upstreamAddr,
+				JWTToken:      "hmac_token",
+				Auth: &proxy.UpstreamAuthConfig{
+					Type: proxy.AuthHMAC,
+					HMAC: &proxy.HMACAuthConfig{
+						KeyID:           "chandra-2",
+						Secret:          "other",
+						Algorithm:       "sha512",
+						Encoding:        "base64",
+						SignatureHeader: "X-Signature",
+						ClockSkew:       time.Hour,
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	const method = "/grpc.testing.TestService/UnaryCall"
+
+	t.Run("signs instead of the token", func(t *testing.T) {
+		client, _ := dialTestService(t, "127.0.0.1:18840")
+		// A client cannot supply its own signature
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-auth-signature", "forged")
+		before := time.Now().Unix()
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+
+		md := upstream.metadata()
+		assert.Empty(t, md.Get("authorization"))
+		assert.Equal(t, []string{"chandra-1"}, md.Get("x-auth-key-id"))
+		require.Len(t, md.Get("x-auth-timestamp"), 1)
+		timestamp := md.Get("x-auth-timestamp")[0]
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		require.NoError(t, err)
+		assert.InDelta(t, before, ts, 2)
+		assert.Equal(t, []string{hmacHex("s3cret", method, timestamp)}, md.Get("x-auth-signature"))
+	})
+
+	t.Run("signs alongside the token", func(t *testing.T) {
+		client, _ := dialTestService(t, "127.0.0.1:18839")
+		_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		require.NoError(t, err)
+
+		md := upstream.metadata()
+		assert.Equal(t, []string{"Bearer hmac_token"}, md.Get("authorization"))
+		require.Len(t, md.Get("x-auth-timestamp"), 1)
+		timestamp := md.Get("x-auth-timestamp")[0]
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		require.NoError(t, err)
+		assert.InDelta(t, time.Now().Add(time.Hour).Unix(), ts, 2)
+
+		mac := hmac.New(sha512.New, []byte("other"))
+		mac.Write([]byte(method + "\n" + timestamp))
+		assert.Equal(t, []string{base64.StdEncoding.EncodeToString(mac.Sum(nil))}, md.Get("x-signature"))
+		assert.Empty(t, md.Get("x-auth-signature"))
+	})
+}
+
+func TestHMACSigningHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var seen http.Header
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = r.Header.Clone()
+		mu.Unlock()
+	}))
+	defer rpc.Close()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "hmac-rpc",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18838,
+			RemoteAddress: rpc.URL,
+			Auth: &proxy.UpstreamAuthConfig{
+				Type: proxy.AuthHMAC,
+				HMAC: &proxy.HMACAuthConfig{KeyID: "rpc", Secret: "rpc-secret"},
+			},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	resp, err := http.Get("http://127.0.0.1:18838/status")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Empty(t, seen.Get("Authorization"))
+	assert.Equal(t, "rpc", seen.Get("X-Auth-Key-Id"))
+	assert.Equal(t, hmacHex("rpc-secret", "/status", seen.Get("X-Auth-Timestamp")), seen.Get("X-Auth-Signature"))
+}
+
+func TestHMACValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "hmac-invalid", LocalPort: 18840, RemoteAddress: "127.0.0.1:1"}
+
+	endpoint.Auth = &proxy.UpstreamAuthConfig{Type: proxy.AuthHMAC}
+	assert.ErrorContains(t, endpoint.Validate(), "needs an hmac section")
+
+	endpoint.Auth.HMAC = &proxy.HMACAuthConfig{KeyID: "id"}
+	assert.ErrorContains(t, endpoint.Validate(), "needs key_id and secret")
+
+	endpoint.Auth.HMAC = &proxy.HMACAuthConfig{KeyID: "id", Secret: "secret", Algorithm: "md5"}
+	assert.ErrorContains(t, endpoint.Validate(), "unsupported auth hmac algorithm")
+
+	endpoint.Auth.HMAC = &proxy.HMACAuthConfig{KeyID: "id", Secret: "secret", SignatureHeader: "Authorization"}
+	assert.ErrorContains(t, endpoint.Validate(), `may not use header "authorization"`)
+
+	endpoint.Auth = &proxy.UpstreamAuthConfig{Type: "kerberos"}
+	assert.ErrorContains(t, endpoint.Validate(), "unsupported auth type")
+
+	// Without hmac the token is still required
+	endpoint.Auth = nil
+	assert.ErrorContains(t, endpoint.Validate(), "please set a valid JWT token")
+}
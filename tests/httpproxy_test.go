@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// startFakeRPC serves a JSON echo of the request headers, and for WebSocket
+// upgrades a line echo over the hijacked connection
+func startFakeRPC(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			json.NewEncoder(w).Encode(map[string]string{
+				"path":          r.URL.Path,
+				"authorization": r.Header.Get("Authorization"),
+				"api_key":       r.Header.Get("X-Api-Key"),
+				"request_id":    r.Header.Get("X-Request-Id"),
+			})
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nX-Authorization: %s\r\n\r\n", r.Header.Get("Authorization"))
+		rw.Flush()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPEndpoint(t *testing.T) {
+	upstream := startFakeRPC(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "rpc",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18945,
+			RemoteAddress: upstream.URL,
+			JWTToken:      "rpc_jwt_token",
+		}},
+		Clients:         []proxy.ClientConfig{{Name: "relayer", APIKey: "relayer-key"}},
+		ShutdownTimeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, manager.Start())
+	stopped := false
+	defer func() {
+		if !stopped {
+			manager.Stop()
+		}
+	}()
+
+	get := func(apiKey string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:18945/status", nil)
+		require.NoError(t, err)
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("http", func(t *testing.T) {
+		resp := get("relayer-key")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var seen map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&seen))
+		assert.Equal(t, "/status", seen["path"])
+		assert.Equal(t, "Bearer rpc_jwt_token", seen["authorization"])
+		assert.Empty(t, seen["api_key"])
+	})
+
+	t.Run("missing api key", func(t *testing.T) {
+		resp := get("")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:18945")
+		require.NoError(t, err)
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET /websocket HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nX-Api-Key: relayer-key\r\n\r\n")
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "Bearer rpc_jwt_token", resp.Header.Get("X-Authorization"))
+
+		fmt.Fprintf(conn, "subscribe\n")
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "subscribe\n", line)
+
+		// Shutdown closes WebSocket connections still open at the drain deadline
+		p, ok := manager.Server("rpc")
+		require.True(t, ok)
+		assert.EqualValues(t, 1, p.ActiveStreams())
+		stopped = true
+		begin := time.Now()
+		manager.Stop()
+		assert.Less(t, time.Since(begin), 2*time.Second)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = br.ReadString('\n')
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("grpc-only options", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "rpc",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18944,
+			RemoteAddress: upstream.URL,
+			JWTToken:      "rpc_jwt_token",
+			Compression:   "gzip",
+			Lanes:         []proxy.LaneConfig{{Name: "default"}},
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "does not support lanes, compression")
+
+		_, err = proxy.NewProxyServer(proxy.Config{
+			Name:          "rpc",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18944,
+			RemoteAddress: "rpc.internal:26657",
+			JWTToken:      "rpc_jwt_token",
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestRESTCompanion(t *testing.T) {
+	upstream := startFakeRPC(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "cosmos",
+			LocalPort:     18875,
+			RemoteAddress: "127.0.0.1:19090",
+			JWTToken:      "cosmos_jwt_token",
+			REST:          &proxy.RESTConfig{LocalPort: 18876, RemoteAddress: upstream.URL},
+			Connect:       proxy.ConnectConfig{Timeout: 200 * time.Millisecond},
+		}},
+		Clients: []proxy.ClientConfig{{Name: "relayer", APIKey: "relayer-key"}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	get := func(apiKey string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:18876/cosmos/base/tendermint/v1beta1/node_info", nil)
+		require.NoError(t, err)
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("api key", func(t *testing.T) {
+		resp := get("relayer-key")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var seen map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&seen))
+		assert.Equal(t, "Bearer cosmos_jwt_token", seen["authorization"])
+		assert.Empty(t, seen["api_key"])
+	})
+
+	t.Run("missing api key", func(t *testing.T) {
+		resp := get("")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// contextStream overrides the context of a server stream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestWithInterceptors(t *testing.T) {
+	mockServer, mockService, err := startMockGRPCServer(19996)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	var seen []string
+	recordMethod := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		seen = append(seen, info.FullMethod)
+		return handler(srv, ss)
+	}
+	addHeader := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		md = md.Copy()
+		md.Set("x-team", "indexer")
+		return handler(srv, &contextStream{ServerStream: ss, ctx: metadata.NewIncomingContext(ss.Context(), md)})
+	}
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "interceptor-test",
+		LocalPort:     18996,
+		RemoteAddress: "localhost:19996",
+		JWTToken:      "interceptor_token",
+	}, proxy.WithInterceptors(recordMethod, addHeader))
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18996"))
+	assert.Equal(t, []string{"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"}, seen)
+	assert.Equal(t, []string{"indexer"}, mockService.ReceivedHeaders["x-team"])
+	assert.Equal(t, []string{"Bearer interceptor_token"}, mockService.ReceivedHeaders["authorization"])
+}
+
+func TestWithInterceptorsReject(t *testing.T) {
+	deny := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return status.Error(codes.PermissionDenied, "denied by custom interceptor")
+	}
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "interceptor-reject-test",
+		LocalPort:     18995,
+		RemoteAddress: "localhost:19995",
+		JWTToken:      "interceptor_token",
+	}, proxy.WithInterceptors(deny))
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+
+	err = listServicesThrough(t, "localhost:18995")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestPanicRecoveryAndSanitization(t *testing.T) {
+	fail := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		if len(md.Get("x-panic")) > 0 {
+			panic("boom")
+		}
+		return status.Error(codes.Unavailable, "dial tcp 10.1.2.3:9090 for upstream.internal:9090 with Bearer secret_token_123 failed")
+	}
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "recovery-test",
+		LocalPort:     18988,
+		RemoteAddress: "upstream.internal:9090",
+		JWTToken:      "secret_token_123",
+	}, proxy.WithInterceptors(fail))
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+
+	t.Run("upstream errors are sanitized", func(t *testing.T) {
+		err := listServicesThrough(t, "localhost:18988")
+		st := status.Convert(err)
+		assert.Equal(t, codes.Unavailable, st.Code())
+		assert.NotContains(t, st.Message(), "10.1.2.3")
+		assert.NotContains(t, st.Message(), "upstream.internal")
+		assert.NotContains(t, st.Message(), "secret_token_123")
+	})
+
+	t.Run("panics become internal errors", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-panic", "1")
+
+		st := status.Convert(listServicesThroughContext(t, ctx, "localhost:18988"))
+		assert.Equal(t, codes.Internal, st.Code())
+		assert.Contains(t, st.Message(), "incident")
+	})
+}
@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestDecodeToken(t *testing.T) {
+	segment := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	t.Run("registered claims", func(t *testing.T) {
+		token := segment(`{"alg":"RS256","typ":"JWT"}`) + "." +
+			segment(`{"iss":"chandrastation","sub":"customer-1","aud":["grpc","rest"],"exp":1893456000,"iat":1700000000}`) + ".signature"
+
+		claims, err := proxy.DecodeToken(token)
+		require.NoError(t, err)
+		assert.Equal(t, "RS256", claims.Algorithm)
+		assert.Equal(t, "chandrastation", claims.Issuer)
+		assert.Equal(t, "customer-1", claims.Subject)
+		assert.Equal(t, []string{"grpc", "rest"}, claims.Audience)
+		assert.Equal(t, time.Unix(1893456000, 0), claims.ExpiresAt)
+		assert.True(t, claims.NotBefore.IsZero())
+	})
+
+	t.Run("single audience", func(t *testing.T) {
+		claims, err := proxy.DecodeToken(segment(`{"alg":"HS256"}`) + "." + segment(`{"aud":"grpc"}`) + ".")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"grpc"}, claims.Audience)
+		assert.True(t, claims.ExpiresAt.IsZero())
+	})
+
+	t.Run("not a JWT", func(t *testing.T) {
+		_, err := proxy.DecodeToken("your_cosmos_jwt_token_here")
+		assert.Error(t, err)
+		_, err = proxy.DecodeToken("a.b.c")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeSecretTool stores secret-tool items as files, keyed by the account attribute
+const fakeSecretTool = `#!/bin/sh
+dir=$(dirname "$0")/items
+mkdir -p "$dir"
+case "$1" in
+store) shift 3; cat > "$dir/$4" ;;
+lookup) cat "$dir/$5" 2>/dev/null || exit 1 ;;
+esac
+`
+
+func TestKeyringTokenRef(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("uses a fake secret-tool")
+	}
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "secret-tool"), []byte(fakeSecretTool), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	require.NoError(t, proxy.SetKeyringToken("cosmos", "keyring_token"))
+	assert.Error(t, proxy.SetKeyringToken("cosmos", ""))
+
+	mockServer, mockService, err := startMockGRPCServer(19962)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "keyring-test",
+			LocalPort:     18962,
+			RemoteAddress: "localhost:19962",
+			JWTTokenRef:   "keyring:cosmos",
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18962"))
+	assert.Equal(t, []string{"Bearer keyring_token"}, mockService.ReceivedHeaders["authorization"])
+
+	missing := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{Name: "keyring-missing", LocalPort: 18961, RemoteAddress: "localhost:19961", JWTTokenRef: "keyring:osmosis"}},
+	})
+	assert.ErrorContains(t, missing.Start(), "secret service item grpc-proxy/osmosis")
+}
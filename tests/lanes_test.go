@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// heldTestService answers UnaryCall once the test lets it: each call
+// reports on started and waits for a value on release
+type heldTestService struct {
+	testpb.UnimplementedTestServiceServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *heldTestService) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return &testpb.SimpleResponse{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestLanes(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	service := &heldTestService{started: make(chan struct{}, 8), release: make(chan struct{})}
+	testpb.RegisterTestServiceServer(upstream, service)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "lanes",
+			LocalPort:     18817,
+			RemoteAddress: lis.Addr().String(),
+			JWTToken:      "lanes_jwt_token",
+			Lanes: []proxy.LaneConfig{
+				{Name: "batch", MaxConcurrent: 2, QueueTimeout: 300 * time.Millisecond},
+				{Name: "default", MaxConcurrent: 1, QueueTimeout: 100 * time.Millisecond},
+			},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client, _ := dialTestService(t, "127.0.0.1:18817")
+	call := func(lane string) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			ctx := context.Background()
+			if lane != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-proxy-lane", lane)
+			}
+			_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+			done <- err
+		}()
+		return done
+	}
+	waitStarted := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-service.started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("call did not reach the upstream")
+			}
+		}
+	}
+
+	t.Run("full lane queues calls", func(t *testing.T) {
+		first, second := call("batch"), call("batch")
+		waitStarted(2)
+
+		queued := call("batch")
+		select {
+		case err := <-queued:
+			t.Fatalf("call was not queued: %v", err)
+		case <-service.started:
+			t.Fatal("call passed a full lane")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// A finished call frees a slot for the queued one
+		service.release <- struct{}{}
+		waitStarted(1)
+		service.release <- struct{}{}
+		service.release <- struct{}{}
+		for _, done := range []<-chan error{first, second, queued} {
+			assert.NoError(t, <-done)
+		}
+	})
+
+	t.Run("queued calls fail after queue_timeout", func(t *testing.T) {
+		first, second := call("batch"), call("batch")
+		waitStarted(2)
+
+		start := time.Now()
+		err := <-call("batch")
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), `lane "batch" has no free slots (max 2 concurrent)`)
+		assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+		assert.Equal(t, 1.0, endpointMetric(t, "lanes", "lane_batch_rejected"))
+
+		service.release <- struct{}{}
+		service.release <- struct{}{}
+		assert.NoError(t, <-first)
+		assert.NoError(t, <-second)
+	})
+
+	t.Run("calls without a known lane use the default lane", func(t *testing.T) {
+		held := call("")
+		waitStarted(1)
+
+		for _, lane := range []string{"", "unknown"} {
+			err := <-call(lane)
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+			assert.Contains(t, status.Convert(err).Message(), `lane "default"`)
+		}
+		assert.Equal(t, 2.0, endpointMetric(t, "lanes", "lane_default_rejected"))
+
+		// The batch lane has slots of its own
+		batch := call("batch")
+		waitStarted(1)
+		service.release <- struct{}{}
+		service.release <- struct{}{}
+		assert.NoError(t, <-held)
+		assert.NoError(t, <-batch)
+	})
+}
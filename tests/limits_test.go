@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	mockServer, _, err := startMockGRPCServer(19990)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:                 "limit-test",
+			LocalPort:            18990,
+			RemoteAddress:        "localhost:19990",
+			JWTToken:             "limit_token",
+			MaxConcurrentStreams: 1,
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.NewClient("localhost:18990", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Hold one stream open without sending so the endpoint is at its limit
+	held, err := grpc_reflection_v1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	err = listServicesThrough(t, "localhost:18990")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	held.CloseSend()
+	_, _ = held.Recv()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, listServicesThrough(t, "localhost:18990"))
+}
+
+func TestConnectionLimits(t *testing.T) {
+	mockServer, _, err := startMockGRPCServer(19989)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "conn-limit-test",
+			LocalPort:     18989,
+			RemoteAddress: "localhost:19989",
+			JWTToken:      "limit_token",
+		}},
+		ShutdownTimeout:  time.Second,
+		ConnectionLimits: proxy.ConnectionLimits{PerIP: 2},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	// isOpen reports whether the proxy kept the connection instead of closing it;
+	// an accepted connection gets the server's HTTP/2 settings or nothing at all
+	isOpen := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		var netErr net.Error
+		return err == nil || (errors.As(err, &netErr) && netErr.Timeout())
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:18989")
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	assert.True(t, isOpen(conns[0]))
+	assert.True(t, isOpen(conns[1]))
+	assert.False(t, isOpen(conns[2]), "connection over the per-IP limit should be closed")
+
+	// Freeing a slot lets the client connect again
+	conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, listServicesThrough(t, "127.0.0.1:18989"))
+}
+
+func TestCIDRAccessControl(t *testing.T) {
+	mockServer, _, err := startMockGRPCServer(19987)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	start := func(t *testing.T, port int, allowed, denied []string) *proxy.Manager {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "acl-test",
+				LocalPort:     port,
+				RemoteAddress: "localhost:19987",
+				JWTToken:      "acl_token",
+				AllowedCIDRs:  allowed,
+				DeniedCIDRs:   denied,
+			}},
+			ShutdownTimeout: time.Second,
+		})
+		require.NoError(t, manager.Start())
+		time.Sleep(200 * time.Millisecond)
+		return manager
+	}
+
+	t.Run("allowed network", func(t *testing.T) {
+		manager := start(t, 18987, []string{"127.0.0.0/8"}, nil)
+		defer manager.Stop()
+		assert.NoError(t, listServicesThrough(t, "127.0.0.1:18987"))
+	})
+
+	t.Run("not in allowed networks", func(t *testing.T) {
+		manager := start(t, 18986, []string{"10.0.0.0/8"}, nil)
+		defer manager.Stop()
+		assert.Error(t, listServicesThrough(t, "127.0.0.1:18986"))
+	})
+
+	t.Run("denied takes precedence", func(t *testing.T) {
+		manager := start(t, 18985, []string{"127.0.0.0/8"}, []string{"127.0.0.1"})
+		defer manager.Stop()
+		assert.Error(t, listServicesThrough(t, "127.0.0.1:18985"))
+	})
+
+	t.Run("invalid cidr", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{Name: "acl-test", JWTToken: "acl_token", RemoteAddress: "localhost:19987", AllowedCIDRs: []string{"10.0.0.0/33"}})
+		assert.Error(t, err)
+	})
+}
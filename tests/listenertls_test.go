@@ -0,0 +1,335 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// writeListenerCert writes a self-signed certificate for dnsName valid for
+// validFor to dir, and returns the certificate and key files and the
+// parsed certificate
+func writeListenerCert(t *testing.T, dir, dnsName string, validFor time.Duration) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, dnsName+".crt")
+	keyFile := filepath.Join(dir, dnsName+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert
+}
+
+// dialTLSTestService connects to a TLS listener trusting only cert
+func dialTLSTestService(t *testing.T, addr, serverName string, cert *x509.Certificate) testpb.TestServiceClient {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	creds := credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: serverName})
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return testpb.NewTestServiceClient(conn)
+}
+
+func TestListenerTLS(t *testing.T) {
+	_, upstreamAddr := serveRecording(t)
+	certFile, keyFile, cert := writeListenerCert(t, t.TempDir(), "proxy.chandra.test", 24*time.Hour)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "listener-tls",
+			LocalPort:     18848,
+			RemoteAddress: upstreamAddr,
+			JWTToken:      "tls_token",
+			TLS:           &proxy.ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client := dialTLSTestService(t, "127.0.0.1:18848", "proxy.chandra.test", cert)
+	_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+	require.NoError(t, err)
+
+	// Plaintext clients are refused
+	plain, _ := dialTestService(t, "127.0.0.1:18848")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = plain.UnaryCall(ctx, &testpb.SimpleRequest{})
+	assert.Error(t, err)
+}
+
+func TestACMEListener(t *testing.T) {
+	_, upstreamAddr := serveRecording(t)
+
+	// A cached certificate is served without asking the CA
+	cacheDir := t.TempDir()
+	certFile, keyFile, cert := writeListenerCert(t, t.TempDir(), "acme.chandra.test", 90*24*time.Hour)
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	keyPEM, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "acme.chandra.test"), append(keyPEM, certPEM...), 0600))
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		ACME: &proxy.ACMEConfig{
+			AcceptTOS:    true,
+			DirectoryURL: "http://127.0.0.1:1/directory",
+			CacheDir:     cacheDir,
+			HTTPAddress:  "127.0.0.1:18846",
+		},
+		Endpoints: []proxy.Config{{
+			Name:          "acme",
+			LocalPort:     18847,
+			RemoteAddress: upstreamAddr,
+			JWTToken:      "acme_token",
+			TLS:           &proxy.ListenerTLSConfig{ACMEHosts: []string{"acme.chandra.test"}},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	t.Run("serves the certificate", func(t *testing.T) {
+		client := dialTLSTestService(t, "127.0.0.1:18847", "acme.chandra.test", cert)
+		_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		require.NoError(t, err)
+	})
+
+	t.Run("refuses other hostnames", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", "127.0.0.1:18847", &tls.Config{ServerName: "other.chandra.test", InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+		}
+		assert.Error(t, err)
+	})
+
+	t.Run("challenge listener redirects to https", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:18846/status", nil)
+		require.NoError(t, err)
+		req.Host = "acme.chandra.test"
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "https://acme.chandra.test/status", resp.Header.Get("Location"))
+	})
+}
+
+func TestListenerTLSValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "tls-invalid", LocalPort: 18845, RemoteAddress: "127.0.0.1:1", JWTToken: "token"}
+
+	t.Run("acme_hosts need acme", func(t *testing.T) {
+		e := endpoint
+		e.TLS = &proxy.ListenerTLSConfig{ACMEHosts: []string{"proxy.chandra.test"}}
+		err := (&proxy.ProxyConfig{Endpoints: []proxy.Config{e}}).Validate()
+		assert.ErrorContains(t, err, "acme is not configured")
+	})
+
+	t.Run("acme needs the terms accepted", func(t *testing.T) {
+		err := (&proxy.ProxyConfig{ACME: &proxy.ACMEConfig{}, Endpoints: []proxy.Config{endpoint}}).Validate()
+		assert.ErrorContains(t, err, "accept_tos")
+	})
+
+	t.Run("one certificate source", func(t *testing.T) {
+		e := endpoint
+		e.TLS = &proxy.ListenerTLSConfig{CertFile: "cert.pem", ACMEHosts: []string{"proxy.chandra.test"}}
+		assert.ErrorContains(t, e.Validate(), "both cert_file/key_file and acme_hosts")
+		e.TLS = &proxy.ListenerTLSConfig{CertFile: "cert.pem"}
+		assert.ErrorContains(t, e.Validate(), "needs both cert_file and key_file")
+	})
+}
+
+// handshakeCert connects to a TLS listener trusting pool and returns the
+// certificate and OCSP response it presented
+func handshakeCert(t *testing.T, addr, serverName string, pool *x509.CertPool) (*x509.Certificate, []byte) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: serverName})
+	require.NoError(t, err)
+	defer conn.Close()
+	state := conn.ConnectionState()
+	return state.PeerCertificates[0], state.OCSPResponse
+}
+
+func TestListenerCertReload(t *testing.T) {
+	_, upstreamAddr := serveRecording(t)
+	dir := t.TempDir()
+	certFile, keyFile, first := writeListenerCert(t, dir, "reload.chandra.test", 24*time.Hour)
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "listener-cert-reload",
+		LocalPort:     18844,
+		RemoteAddress: upstreamAddr,
+		JWTToken:      "reload_token",
+		TLS:           &proxy.ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(first)
+	served, _ := handshakeCert(t, "127.0.0.1:18844", "reload.chandra.test", pool)
+	assert.Equal(t, first.SerialNumber, served.SerialNumber)
+
+	// A connection made before the rotation keeps working
+	client := dialTLSTestService(t, "127.0.0.1:18844", "reload.chandra.test", first)
+	_, err = client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+	require.NoError(t, err)
+
+	_, _, second := writeListenerCert(t, dir, "reload.chandra.test", 24*time.Hour)
+	pool.AddCert(second)
+	require.Eventually(t, func() bool {
+		served, _ := handshakeCert(t, "127.0.0.1:18844", "reload.chandra.test", pool)
+		return served.SerialNumber.Cmp(second.SerialNumber) == 0
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, 1.0, endpointMetric(t, "listener-cert-reload", "listener_cert_reloads"))
+
+	_, err = client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+	require.NoError(t, err)
+}
+
+func TestOCSPStapling(t *testing.T) {
+	_, upstreamAddr := serveRecording(t)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Chandra Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "ocsp.chandra.test"},
+		DNSNames:     []string{"ocsp.chandra.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{responder.URL},
+	}, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+	require.NoError(t, os.WriteFile(certFile, chain, 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "ocsp-stapling",
+		LocalPort:     18843,
+		RemoteAddress: upstreamAddr,
+		JWTToken:      "ocsp_token",
+		TLS:           &proxy.ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile, OCSPStapling: true},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	var staple []byte
+	require.Eventually(t, func() bool {
+		_, staple = handshakeCert(t, "127.0.0.1:18843", "ocsp.chandra.test", pool)
+		return len(staple) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	resp, err := ocsp.ParseResponse(staple, ca)
+	require.NoError(t, err)
+	assert.Equal(t, ocsp.Good, resp.Status)
+	assert.Equal(t, int64(42), resp.SerialNumber.Int64())
+
+	t.Run("needs the issuer certificate", func(t *testing.T) {
+		leafOnly := filepath.Join(dir, "leaf.crt")
+		require.NoError(t, os.WriteFile(leafOnly, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}), 0600))
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "ocsp-invalid",
+			LocalPort:     18843,
+			RemoteAddress: upstreamAddr,
+			JWTToken:      "ocsp_token",
+			TLS:           &proxy.ListenerTLSConfig{CertFile: leafOnly, KeyFile: keyFile, OCSPStapling: true},
+		})
+		assert.ErrorContains(t, err, "issuer certificate")
+	})
+}
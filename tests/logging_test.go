@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.log")
+	w, err := proxy.OpenLog(&proxy.LogConfig{Output: proxy.LogFile, Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Each line is 256KiB, so every fourth line starts a new file
+	line := append(bytes.Repeat([]byte("x"), 256<<10-1), '\n')
+	for i := 0; i < 14; i++ {
+		_, err := w.Write(line)
+		require.NoError(t, err)
+		// Backups are named by the millisecond they were rotated
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Len(t, backups, 2, "only max_backups rotated files are kept")
+	for _, b := range backups {
+		fi, err := os.Stat(b)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1<<20), fi.Size())
+	}
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*len(line)), fi.Size())
+}
+
+func TestLogFileRotationByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	w, err := proxy.OpenLog(&proxy.LogConfig{Output: proxy.LogFile, Path: path, MaxAge: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.Write([]byte("first\n"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("second\n"))
+	require.NoError(t, err)
+	time.Sleep(60 * time.Millisecond)
+	_, err = w.Write([]byte("third\n"))
+	require.NoError(t, err)
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "third\n", string(current))
+	backups, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	rotated, err := os.ReadFile(backups[0])
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(rotated))
+}
+
+func TestLogConfigValidation(t *testing.T) {
+	endpoints := []proxy.Config{{Name: "log", LocalPort: 18905, RemoteAddress: "127.0.0.1:19927", JWTToken: "log_jwt_token"}}
+	for _, config := range []*proxy.LogConfig{
+		{Output: "kafka"},
+		{Output: proxy.LogFile},
+		{Output: proxy.LogFile, Path: "proxy.log", MaxBackups: -1},
+	} {
+		err := (&proxy.ProxyConfig{Endpoints: endpoints, Log: config}).Validate()
+		assert.Error(t, err)
+		_, err = proxy.OpenLog(config)
+		assert.Error(t, err)
+	}
+	assert.NoError(t, (&proxy.ProxyConfig{Endpoints: endpoints, Log: &proxy.LogConfig{Output: proxy.LogJournald}}).Validate())
+
+	_, err := proxy.OpenLog(&proxy.LogConfig{Output: proxy.LogFile, Path: filepath.Join(t.TempDir(), "missing", "proxy.log")})
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "failed to open log file"))
+
+	// Syslog and the journal stamp their own entries
+	assert.True(t, (&proxy.LogConfig{Output: proxy.LogSyslog}).Timestamped())
+	assert.False(t, (&proxy.LogConfig{Output: proxy.LogFile, Path: "proxy.log"}).Timestamped())
+	assert.False(t, (*proxy.LogConfig)(nil).Timestamped())
+}
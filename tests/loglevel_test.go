@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestEndpointLogLevels(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19923")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	none, all := 0.0, 100.0
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{
+				Name:                 "quiet",
+				LocalPort:            18902,
+				RemoteAddress:        "127.0.0.1:19923",
+				JWTToken:             "loglevel_jwt_token",
+				LogLevel:             proxy.LogLevelWarn,
+				SlowRequestThreshold: 50 * time.Millisecond,
+				Faults:               &proxy.FaultConfig{Methods: []string{"/grpc.testing.TestService/UnaryCall"}, Delay: 100 * time.Millisecond, DelayPercent: 100},
+			},
+			{
+				Name:          "verbose",
+				LocalPort:     18901,
+				RemoteAddress: "127.0.0.1:19923",
+				JWTToken:      "loglevel_jwt_token",
+				LogLevel:      proxy.LogLevelDebug,
+				LogSampling:   &proxy.LogSamplingConfig{SuccessPercent: &none, ErrorPercent: &all},
+			},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	call := func(port string, f func(testpb.TestServiceClient, context.Context) error) error {
+		conn, err := grpc.NewClient("127.0.0.1:"+port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return f(testpb.NewTestServiceClient(conn), ctx)
+	}
+
+	t.Run("warn hides info lines", func(t *testing.T) {
+		require.NoError(t, call("18902", func(c testpb.TestServiceClient, ctx context.Context) error {
+			_, err := c.UnaryCall(ctx, &testpb.SimpleRequest{})
+			return err
+		}))
+		out := logs.String()
+		assert.NotContains(t, out, "proxy for quiet on")
+		assert.Contains(t, out, "proxy for verbose on")
+		assert.Contains(t, out, "Warning: slow call on quiet: /grpc.testing.TestService/UnaryCall")
+	})
+
+	t.Run("debug logs sampled calls", func(t *testing.T) {
+		require.NoError(t, call("18901", func(c testpb.TestServiceClient, ctx context.Context) error {
+			_, err := c.EmptyCall(ctx, &testpb.Empty{})
+			return err
+		}))
+		require.Error(t, call("18901", func(c testpb.TestServiceClient, ctx context.Context) error {
+			_, err := c.UnimplementedCall(ctx, &testpb.Empty{})
+			return err
+		}))
+
+		var access []string
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "[verbose] ") {
+				access = append(access, line)
+			}
+		}
+		// Successful calls are not sampled, failed ones all are
+		require.Len(t, access, 1)
+		assert.Contains(t, access[0], " /grpc.testing.TestService/UnimplementedCall Unimplemented ")
+		assert.Contains(t, access[0], "(request 0 bytes, response 0 bytes) from 127.0.0.1:")
+	})
+}
+
+func TestEndpointLogLevelValidation(t *testing.T) {
+	over := 150.0
+	for _, config := range []proxy.Config{
+		{LogLevel: "trace"},
+		{LogSampling: &proxy.LogSamplingConfig{ErrorPercent: &over}},
+	} {
+		config.Name, config.LocalPort, config.RemoteAddress, config.JWTToken = "loglevel", 18900, "127.0.0.1:19923", "loglevel_jwt_token"
+		_, err := proxy.NewProxyServer(config)
+		assert.Error(t, err)
+	}
+}
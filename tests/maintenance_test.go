@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/adminpb"
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19921")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, &slowTestService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	rpc := startFakeRPC(t)
+	defer rpc.Close()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{Name: "maintenance", LocalPort: 18896, RemoteAddress: "127.0.0.1:19921", JWTToken: "maintenance_token"},
+			{Name: "maintenance-rpc", Type: proxy.TypeHTTP, LocalPort: 18895, RemoteAddress: rpc.URL, JWTToken: "maintenance_token"},
+		},
+		ShutdownTimeout: time.Second,
+		Admin:           &proxy.AdminConfig{LocalPort: 18894},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	adminConn, err := grpc.NewClient("127.0.0.1:18894", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer adminConn.Close()
+	admin := adminpb.NewProxyAdminClient(adminConn)
+
+	conn, err := grpc.NewClient("127.0.0.1:18896", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("grpc", func(t *testing.T) {
+		// A call in flight when maintenance starts is left to finish
+		inFlight := make(chan error, 1)
+		go func() {
+			_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+			inFlight <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		resp, err := admin.SetMaintenance(ctx, &adminpb.SetMaintenanceRequest{Name: "maintenance", Enabled: true, RetryAfterSeconds: 30, Message: "provider upgrade"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), resp.ActiveStreams)
+
+		var trailer metadata.MD
+		_, err = client.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Trailer(&trailer))
+		st := status.Convert(err)
+		assert.Equal(t, codes.Unavailable, st.Code())
+		assert.Equal(t, "endpoint maintenance is down for maintenance: provider upgrade", st.Message())
+		assert.Equal(t, []string{"30000"}, trailer.Get("grpc-retry-pushback-ms"))
+		require.Len(t, st.Details(), 1)
+		info, ok := st.Details()[0].(*errdetails.RetryInfo)
+		require.True(t, ok)
+		assert.Equal(t, 30*time.Second, info.RetryDelay.AsDuration())
+
+		require.NoError(t, <-inFlight)
+
+		health, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, health.Status)
+		endpointStatus, err := admin.GetEndpointStatus(ctx, &adminpb.GetEndpointStatusRequest{Name: "maintenance"})
+		require.NoError(t, err)
+		assert.True(t, endpointStatus.Maintenance)
+		assert.Equal(t, 1.0, endpointMetric(t, "maintenance", "maintenance"))
+		assert.Equal(t, 1.0, endpointMetric(t, "maintenance", "maintenance_rejected"))
+
+		_, err = admin.SetMaintenance(ctx, &adminpb.SetMaintenanceRequest{Name: "maintenance"})
+		require.NoError(t, err)
+		_, err = client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		assert.NoError(t, err)
+		health, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health.Status)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		_, err := admin.SetMaintenance(ctx, &adminpb.SetMaintenanceRequest{Name: "maintenance-rpc", Enabled: true})
+		require.NoError(t, err)
+
+		resp, err := http.Get("http://127.0.0.1:18895/status")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+		_, err = admin.SetMaintenance(ctx, &adminpb.SetMaintenanceRequest{Name: "maintenance-rpc"})
+		require.NoError(t, err)
+		resp, err = http.Get("http://127.0.0.1:18895/status")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		_, err := admin.SetMaintenance(ctx, &adminpb.SetMaintenanceRequest{Name: "missing", Enabled: true})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
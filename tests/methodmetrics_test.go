@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// methodMetric returns a metric of one method of an endpoint
+func methodMetric(t *testing.T, endpoint, method string, path ...string) expvar.Var {
+	endpointMetrics, _ := expvar.Get("grpc_proxy").(*expvar.Map).Get(endpoint).(*expvar.Map)
+	require.NotNil(t, endpointMetrics)
+	v := endpointMetrics.Get("methods").(*expvar.Map).Get(method)
+	for _, key := range path {
+		require.NotNil(t, v, "%s %v", method, path)
+		v = v.(*expvar.Map).Get(key)
+	}
+	return v
+}
+
+func TestMethodMetrics(t *testing.T) {
+	_, upstream := serveRecording(t)
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "method-metrics",
+		LocalPort:     18857,
+		RemoteAddress: upstream,
+		JWTToken:      "method_token",
+		MethodMetrics: &proxy.MethodMetricsConfig{
+			Methods:    []string{"/grpc.testing.TestService/"},
+			MaxMethods: 2,
+			Buckets:    []time.Duration{time.Millisecond, time.Minute},
+		},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	client, _ := dialTestService(t, "127.0.0.1:18857")
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+	}
+	_, err = client.EmptyCall(ctx, &testpb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	// Beyond max_methods, calls are counted under other
+	_, err = client.StreamingOutputCall(ctx, &testpb.StreamingOutputCallRequest{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return methodMetric(t, "method-metrics", "other") != nil
+	}, time.Second, 10*time.Millisecond)
+
+	unary := "/grpc.testing.TestService/UnaryCall"
+	assert.Equal(t, "3", methodMetric(t, "method-metrics", unary, "calls").String())
+	assert.Equal(t, "3", methodMetric(t, "method-metrics", unary, "codes", "OK").String())
+	assert.Equal(t, "3", methodMetric(t, "method-metrics", unary, "latency", "le_1m0s").String())
+	assert.Equal(t, "3", methodMetric(t, "method-metrics", unary, "latency", "le_+Inf").String())
+	assert.NotNil(t, methodMetric(t, "method-metrics", unary, "latency_sum_ms"))
+
+	empty := "/grpc.testing.TestService/EmptyCall"
+	assert.Equal(t, "1", methodMetric(t, "method-metrics", empty, "calls_failed").String())
+	assert.Equal(t, "1", methodMetric(t, "method-metrics", empty, "codes", "Unimplemented").String())
+}
+
+func TestMethodMetricsConfig(t *testing.T) {
+	_, err := proxy.NewProxyServer(proxy.Config{
+		Name: "method-metrics", LocalPort: 18857, RemoteAddress: "127.0.0.1:19857", JWTToken: "method_token",
+		MethodMetrics: &proxy.MethodMetricsConfig{Buckets: []time.Duration{time.Second, time.Millisecond}},
+	})
+	assert.ErrorContains(t, err, "ascending")
+}
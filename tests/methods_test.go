@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// testService answers the unary calls of the interop TestService
+type testService struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (testService) EmptyCall(context.Context, *testpb.Empty) (*testpb.Empty, error) {
+	return &testpb.Empty{}, nil
+}
+
+func (testService) UnaryCall(context.Context, *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	return &testpb.SimpleResponse{}, nil
+}
+
+func TestMethodRules(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19943")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	healthpb.RegisterHealthServer(upstream, health.NewServer())
+	reflection.Register(upstream)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:           "methods",
+			LocalPort:      18937,
+			RemoteAddress:  "127.0.0.1:19943",
+			JWTToken:       "methods_jwt_token",
+			AllowedMethods: []string{"grpc.testing.TestService/"},
+			DeniedMethods:  []string{"/grpc.testing.TestService/UnaryCall"},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18937", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("calls", func(t *testing.T) {
+		client := testpb.NewTestServiceClient(conn)
+		_, err := client.EmptyCall(ctx, &testpb.Empty{})
+		require.NoError(t, err)
+		_, err = client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	defer stream.CloseSend()
+	ask := func(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+		require.NoError(t, stream.Send(req))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("list services", func(t *testing.T) {
+		resp := ask(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+		})
+		var names []string
+		for _, s := range resp.GetListServicesResponse().GetService() {
+			names = append(names, s.Name)
+		}
+		assert.Contains(t, names, "grpc.testing.TestService")
+		assert.Contains(t, names, "grpc.reflection.v1.ServerReflection")
+		assert.NotContains(t, names, "grpc.health.v1.Health")
+	})
+
+	t.Run("file containing symbol", func(t *testing.T) {
+		resp := ask(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.testing.TestService"},
+		})
+		var methods []string
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			require.NoError(t, proto.Unmarshal(b, fd))
+			for _, sd := range fd.Service {
+				if sd.GetName() == "TestService" {
+					for _, md := range sd.Method {
+						methods = append(methods, md.GetName())
+					}
+				}
+			}
+		}
+		assert.Contains(t, methods, "EmptyCall")
+		assert.NotContains(t, methods, "UnaryCall")
+	})
+
+	t.Run("hidden symbols", func(t *testing.T) {
+		for _, symbol := range []string{"grpc.testing.TestService.UnaryCall", "grpc.health.v1.Health"} {
+			resp := ask(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+			})
+			require.NotNil(t, resp.GetErrorResponse(), symbol)
+			assert.Equal(t, int32(codes.NotFound), resp.GetErrorResponse().ErrorCode)
+		}
+	})
+}
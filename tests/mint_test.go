@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// mintedToken splits the bearer token an upstream received into its
+// signing input, decoded claims and signature
+func mintedToken(t *testing.T, authorization []string) (string, map[string]interface{}, []byte) {
+	t.Helper()
+	require.Len(t, authorization, 1)
+	token := strings.TrimPrefix(authorization[0], "Bearer ")
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]interface{}
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	return parts[0] + "." + parts[1], claims, sig
+}
+
+func TestMintJWT(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaFile := filepath.Join(dir, "rsa.pem")
+	require.NoError(t, os.WriteFile(rsaFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	ecFile := filepath.Join(dir, "ec.pem")
+	require.NoError(t, os.WriteFile(ecFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}), 0600))
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{
+				Name:          "mint-hs",
+				LocalPort:     18833,
+				RemoteAddress: upstreamAddr,
+				MintJWT: &proxy.MintJWTConfig{
+					Secret: "gateway-secret",
+					KeyID:  "proxy-1",
+					Claims: map[string]interface{}{"iss": "chandra-proxy", "aud": "{endpoint}", "scope": []interface{}{"read"}},
+				},
+			},
+			{
+				Name:          "mint-rs",
+				LocalPort:     18832,
+				RemoteAddress: upstreamAddr,
+				MintJWT: &proxy.MintJWTConfig{
+					KeyFile:    rsaFile,
+					Lifetime:   30 * time.Second,
+					PerRequest: true,
+					Claims:     map[string]interface{}{"sub": "{method}"},
+				},
+			},
+			{
+				Name:          "mint-es",
+				LocalPort:     18831,
+				RemoteAddress: upstreamAddr,
+				MintJWT:       &proxy.MintJWTConfig{KeyFile: ecFile},
+			},
+		},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	call := func(t *testing.T, addr string) []string {
+		client, _ := dialTestService(t, addr)
+		_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		return upstream.metadata().Get("authorization")
+	}
+
+	t.Run("hmac key with claims template", func(t *testing.T) {
+		first := call(t, "127.0.0.1:18833")
+		input, claims, sig := mintedToken(t, first)
+		mac := hmac.New(sha256.New, []byte("gateway-secret"))
+		mac.Write([]byte(input))
+		assert.Equal(t, mac.Sum(nil), sig)
+
+		assert.Equal(t, "chandra-proxy", claims["iss"])
+		assert.Equal(t, "mint-hs", claims["aud"])
+		assert.Equal(t, []interface{}{"read"}, claims["scope"])
+		assert.Equal(t, 300.0, claims["exp"].(float64)-claims["iat"].(float64))
+
+		header, err := base64.RawURLEncoding.DecodeString(strings.Split(input, ".")[0])
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"alg":"HS256","typ":"JWT","kid":"proxy-1"}`, string(header))
+
+		// Calls within the same minute share a token
+		second := call(t, "127.0.0.1:18833")
+		_, secondClaims, _ := mintedToken(t, second)
+		if int64(claims["iat"].(float64))/60 == int64(secondClaims["iat"].(float64))/60 {
+			assert.Equal(t, first, second)
+		}
+	})
+
+	t.Run("rsa key per request", func(t *testing.T) {
+		first := call(t, "127.0.0.1:18832")
+		input, claims, sig := mintedToken(t, first)
+		digest := sha256.Sum256([]byte(input))
+		assert.NoError(t, rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig))
+		assert.Equal(t, "/grpc.testing.TestService/UnaryCall", claims["sub"])
+		assert.Equal(t, 30.0, claims["exp"].(float64)-claims["iat"].(float64))
+
+		assert.NotEqual(t, first, call(t, "127.0.0.1:18832"))
+	})
+
+	t.Run("ecdsa key", func(t *testing.T) {
+		input, _, sig := mintedToken(t, call(t, "127.0.0.1:18831"))
+		require.Len(t, sig, 64)
+		digest := sha256.Sum256([]byte(input))
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		assert.True(t, ecdsa.Verify(&ecKey.PublicKey, digest[:], r, s))
+	})
+}
+
+func TestMintJWTValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "mint-invalid", LocalPort: 18833, RemoteAddress: "127.0.0.1:1"}
+
+	endpoint.MintJWT = &proxy.MintJWTConfig{}
+	assert.ErrorContains(t, endpoint.Validate(), "exactly one of secret and key_file")
+
+	endpoint.MintJWT = &proxy.MintJWTConfig{Secret: "s", Lifetime: 30 * time.Second}
+	assert.ErrorContains(t, endpoint.Validate(), "must exceed 1m")
+
+	endpoint.MintJWT = &proxy.MintJWTConfig{Secret: "s", Claims: map[string]interface{}{"sub": "{method}"}}
+	assert.ErrorContains(t, endpoint.Validate(), "needs per_request")
+
+	endpoint.MintJWT = &proxy.MintJWTConfig{Secret: "s"}
+	endpoint.JWTToken = "token"
+	assert.ErrorContains(t, endpoint.Validate(), "both mint_jwt and a jwt_token")
+
+	endpoint.JWTToken = ""
+	assert.NoError(t, endpoint.Validate())
+
+	endpoint.MintJWT = &proxy.MintJWTConfig{Secret: "s", Algorithm: "RS256"}
+	_, err := proxy.NewProxyServer(endpoint)
+	assert.ErrorContains(t, err, "does not fit a secret")
+}
@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestMessageLogDecodesWithReflection(t *testing.T) {
+	// An upstream with real reflection, so the proxy can resolve descriptors from it
+	lis, err := net.Listen("tcp", "localhost:19983")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	reflection.Register(upstream)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "msglog-test",
+		LocalPort:     18983,
+		RemoteAddress: "localhost:19983",
+		JWTToken:      "msglog_token",
+		MessageLog:    &proxy.MessageLogConfig{Methods: []string{"grpc.reflection."}},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18983"))
+
+	// protojson output is deliberately unstable in its whitespace, so ignore spaces
+	out := strings.ReplaceAll(logs.String(), " ", "")
+	assert.Contains(t, out, `/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInforequest:{"host":"localhost","listServices":"*"}`)
+	assert.Contains(t, out, `ServerReflectionInforesponse:{"validHost":"localhost"`)
+}
@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// testCA issues client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a CA and writes its certificate to dir
+func newTestCA(t *testing.T, dir string) (*testCA, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Chandra Clients CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	file := filepath.Join(dir, "clients-ca.pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return &testCA{cert: cert, key: key}, file
+}
+
+// issue signs a client certificate with the given common name and URIs
+func (ca *testCA) issue(t *testing.T, commonName string, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// dialMTLS connects to a TLS listener trusting serverCert, presenting
+// clientCert unless it is nil
+func dialMTLS(t *testing.T, addr, serverName string, serverCert *x509.Certificate, clientCert *tls.Certificate) testpb.TestServiceClient {
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCert)
+	config := &tls.Config{RootCAs: pool, ServerName: serverName}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{*clientCert}
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return testpb.NewTestServiceClient(conn)
+}
+
+func TestClientCertificates(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+	dir := t.TempDir()
+	certFile, keyFile, serverCert := writeListenerCert(t, dir, "mtls.chandra.test", 24*time.Hour)
+	ca, caFile := newTestCA(t, dir)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Clients: []proxy.ClientConfig{
+			{Name: "indexer", CertNames: []string{"indexer.internal"}, JWTToken: "indexer_token"},
+			{Name: "relayer", CertNames: []string{"spiffe://chandra/relayer"}, JWTToken: "relayer_token"},
+			{Name: "wallet", APIKey: "wallet-key", JWTToken: "wallet_token"},
+		},
+		Endpoints: []proxy.Config{
+			{
+				Name:          "mtls-required",
+				LocalPort:     18842,
+				RemoteAddress: upstreamAddr,
+				JWTToken:      "endpoint_token",
+				TLS:           &proxy.ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile},
+			},
+			{
+				Name:          "mtls-optional",
+				LocalPort:     18841,
+				RemoteAddress: upstreamAddr,
+				JWTToken:      "endpoint_token",
+				TLS:           &proxy.ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientCertOptional: true},
+			},
+		},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	call := func(client testpb.TestServiceClient, pairs ...string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := client.UnaryCall(metadata.AppendToOutgoingContext(ctx, pairs...), &testpb.SimpleRequest{})
+		return err
+	}
+
+	t.Run("certificate identifies the client", func(t *testing.T) {
+		cert := ca.issue(t, "indexer.internal")
+		require.NoError(t, call(dialMTLS(t, "127.0.0.1:18842", "mtls.chandra.test", serverCert, &cert)))
+		assert.Equal(t, []string{"Bearer indexer_token"}, upstream.metadata().Get("authorization"))
+		assert.Equal(t, 1.0, endpointMetric(t, "mtls-required", "client_indexer_calls"))
+	})
+
+	t.Run("certificate URI identifies the client", func(t *testing.T) {
+		cert := ca.issue(t, "relayer-7", "spiffe://chandra/relayer")
+		require.NoError(t, call(dialMTLS(t, "127.0.0.1:18842", "mtls.chandra.test", serverCert, &cert)))
+		assert.Equal(t, []string{"Bearer relayer_token"}, upstream.metadata().Get("authorization"))
+	})
+
+	t.Run("unassigned certificate is rejected", func(t *testing.T) {
+		cert := ca.issue(t, "stranger.internal")
+		err := call(dialMTLS(t, "127.0.0.1:18842", "mtls.chandra.test", serverCert, &cert))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "stranger.internal")
+	})
+
+	t.Run("certificate is required", func(t *testing.T) {
+		err := call(dialMTLS(t, "127.0.0.1:18842", "mtls.chandra.test", serverCert, nil), "x-api-key", "wallet-key")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("certificate from another CA is refused", func(t *testing.T) {
+		other, _ := newTestCA(t, t.TempDir())
+		cert := other.issue(t, "indexer.internal")
+		err := call(dialMTLS(t, "127.0.0.1:18842", "mtls.chandra.test", serverCert, &cert))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("optional certificate falls back to API keys", func(t *testing.T) {
+		client := dialMTLS(t, "127.0.0.1:18841", "mtls.chandra.test", serverCert, nil)
+		require.NoError(t, call(client, "x-api-key", "wallet-key"))
+		assert.Equal(t, []string{"Bearer wallet_token"}, upstream.metadata().Get("authorization"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(call(client)))
+
+		cert := ca.issue(t, "indexer.internal")
+		require.NoError(t, call(dialMTLS(t, "127.0.0.1:18841", "mtls.chandra.test", serverCert, &cert)))
+		assert.Equal(t, []string{"Bearer indexer_token"}, upstream.metadata().Get("authorization"))
+	})
+}
+
+func TestClientCertificateValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "mtls-invalid", LocalPort: 18841, RemoteAddress: "127.0.0.1:1", JWTToken: "token"}
+
+	err := (&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{endpoint},
+		Clients:   []proxy.ClientConfig{{Name: "nameless-machine"}},
+	}).Validate()
+	assert.ErrorContains(t, err, "api_key or cert_names")
+
+	err = (&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{endpoint},
+		Clients: []proxy.ClientConfig{
+			{Name: "a", CertNames: []string{"shared.internal"}},
+			{Name: "b", CertNames: []string{"shared.internal"}},
+		},
+	}).Validate()
+	assert.ErrorContains(t, err, "reuses cert name")
+
+	endpoint.TLS = &proxy.ListenerTLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientCertOptional: true}
+	assert.ErrorContains(t, endpoint.Validate(), "client_cert_optional needs client_ca_file")
+}
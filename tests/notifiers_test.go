@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// startChatWebhook records the raw JSON bodies posted to it
+func startChatWebhook(t *testing.T) (*httptest.Server, func() []map[string]string) {
+	var mu sync.Mutex
+	var bodies []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		var body map[string]string
+		if err := json.Unmarshal(b, &body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]string{}, bodies...)
+	}
+}
+
+func TestChatNotifiers(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19934")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	slackOps, slackBodies := startChatWebhook(t)
+	slackTokens, slackTokenBodies := startChatWebhook(t)
+	discord, discordBodies := startChatWebhook(t)
+	config := &proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "notifiers",
+			LocalPort:     18920,
+			RemoteAddress: "127.0.0.1:19934",
+			JWTToken:      expiringToken(time.Hour),
+		}},
+		Alerts: &proxy.AlertsConfig{Webhooks: []proxy.WebhookConfig{
+			{URL: slackOps.URL, Type: proxy.WebhookSlack, Channel: "#node-ops", Username: "grpc-proxy", Events: []string{proxy.AlertReloadFailed}},
+			{URL: slackTokens.URL, Type: proxy.WebhookSlack, Channel: "#tokens", Events: []string{proxy.AlertTokenExpiring},
+				Template: `:key: {{.Endpoint}} needs a new token ({{.Event}})`},
+			{URL: discord.URL, Type: proxy.WebhookDiscord, Username: "grpc-proxy"},
+		}},
+		ShutdownTimeout: time.Second,
+	}
+	manager := proxy.NewManager(config)
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	bad := *config
+	bad.Endpoints = []proxy.Config{config.Endpoints[0], config.Endpoints[0]}
+	require.Error(t, manager.Reload(&bad))
+
+	require.Eventually(t, func() bool {
+		return len(slackBodies()) == 1 && len(slackTokenBodies()) == 1 && len(discordBodies()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ops := slackBodies()[0]
+	assert.Equal(t, "#node-ops", ops["channel"])
+	assert.Equal(t, "grpc-proxy", ops["username"])
+	assert.True(t, strings.HasPrefix(ops["text"], "[reload_failed] configuration reload failed: duplicate endpoint name"), ops["text"])
+
+	assert.Equal(t, map[string]string{"text": ":key: notifiers needs a new token (token_expiring)", "channel": "#tokens"}, slackTokenBodies()[0])
+
+	var contents []string
+	for _, body := range discordBodies() {
+		assert.Equal(t, "grpc-proxy", body["username"])
+		assert.NotContains(t, body, "channel")
+		contents = append(contents, body["content"])
+	}
+	assert.Contains(t, strings.Join(contents, "\n"), "[token_expiring] notifiers: JWT token for notifiers expires at")
+}
+
+func TestChatNotifierValidation(t *testing.T) {
+	for _, webhook := range []proxy.WebhookConfig{
+		{URL: "https://hooks.example.com/alerts", Type: "teams"},
+		{URL: "https://hooks.example.com/alerts", Type: proxy.WebhookSlack, Template: "{{.Event"},
+		{URL: "https://hooks.example.com/alerts", Channel: "#node-ops"},
+	} {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "notifiers",
+				LocalPort:     18919,
+				RemoteAddress: "127.0.0.1:19934",
+				JWTToken:      "notifiers_jwt_token",
+			}},
+			Alerts:          &proxy.AlertsConfig{Webhooks: []proxy.WebhookConfig{webhook}},
+			ShutdownTimeout: time.Second,
+		})
+		assert.Error(t, manager.Start())
+	}
+}
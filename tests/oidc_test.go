@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeIdP is an OIDC provider supporting the device flow and refresh
+// tokens. Each refresh rotates the refresh token.
+type fakeIdP struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	polls  int
+	issued int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	idp := &fakeIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                        idp.URL,
+			"token_endpoint":                idp.URL + "/token",
+			"device_authorization_endpoint": idp.URL + "/device",
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "grpc-proxy" || r.Form.Get("scope") != "openid offline_access" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      "device-1",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": idp.URL + "/activate",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		fail := func(code string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": code})
+		}
+		switch r.Form.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			// The user approves on the second poll
+			if idp.polls++; idp.polls == 1 {
+				fail("authorization_pending")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "login-access", "refresh_token": "refresh-0", "expires_in": 3600})
+		case "refresh_token":
+			want := fmt.Sprintf("refresh-%d", idp.issued)
+			if r.Form.Get("refresh_token") != want {
+				fail("invalid_grant")
+				return
+			}
+			idp.issued++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  fmt.Sprintf("access-%d", idp.issued),
+				"refresh_token": fmt.Sprintf("refresh-%d", idp.issued),
+				"expires_in":    3,
+			})
+		default:
+			fail("unsupported_grant_type")
+		}
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func TestOIDCDeviceLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	ref := "file:" + filepath.Join(t.TempDir(), "refresh")
+	endpoint := proxy.Config{
+		Name:          "oidc-login",
+		LocalPort:     18830,
+		RemoteAddress: "127.0.0.1:1",
+		OIDC:          &proxy.OIDCConfig{Issuer: idp.URL, ClientID: "grpc-proxy", RefreshTokenRef: ref},
+	}
+
+	login, err := proxy.StartDeviceLogin(context.Background(), endpoint)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", login.UserCode)
+	assert.Equal(t, idp.URL+"/activate", login.VerificationURI)
+
+	stored, err := login.Wait(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ref, stored)
+	assert.Equal(t, 2, idp.polls)
+
+	content, err := os.ReadFile(strings.TrimPrefix(ref, "file:"))
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-0", strings.TrimSpace(string(content)))
+}
+
+func TestOIDCTokenRenewal(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+	idp := newFakeIdP(t)
+	refreshFile := filepath.Join(t.TempDir(), "refresh")
+	require.NoError(t, os.WriteFile(refreshFile, []byte("refresh-0\n"), 0600))
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "oidc-renew",
+			LocalPort:     18829,
+			RemoteAddress: upstreamAddr,
+			OIDC:          &proxy.OIDCConfig{Issuer: idp.URL, ClientID: "grpc-proxy", RefreshTokenRef: "file:" + refreshFile},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client, _ := dialTestService(t, "127.0.0.1:18829")
+	_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer access-1"}, upstream.metadata().Get("authorization"))
+
+	// Renewed two thirds of the way through the 3s lifetime, with the
+	// rotated refresh token stored for the next start
+	require.Eventually(t, func() bool {
+		_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		return err == nil && upstream.metadata().Get("authorization")[0] != "Bearer access-1"
+	}, 5*time.Second, 100*time.Millisecond)
+	content, err := os.ReadFile(refreshFile)
+	require.NoError(t, err)
+	assert.NotEqual(t, "refresh-0", strings.TrimSpace(string(content)))
+}
+
+func TestOIDCValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "oidc-invalid", LocalPort: 18828, RemoteAddress: "127.0.0.1:1"}
+
+	endpoint.OIDC = &proxy.OIDCConfig{Issuer: "https://login.chandra.test"}
+	assert.ErrorContains(t, endpoint.Validate(), "needs issuer and client_id")
+
+	endpoint.OIDC = &proxy.OIDCConfig{Issuer: "login.chandra.test", ClientID: "grpc-proxy"}
+	assert.ErrorContains(t, endpoint.Validate(), "not an http(s) URL")
+
+	endpoint.OIDC = &proxy.OIDCConfig{Issuer: "https://login.chandra.test", ClientID: "grpc-proxy"}
+	endpoint.JWTToken = "token"
+	assert.ErrorContains(t, endpoint.Validate(), "sets oidc with jwt_token")
+
+	endpoint.JWTToken = ""
+	assert.NoError(t, endpoint.Validate())
+
+	_, err := proxy.NewProxyServer(endpoint)
+	assert.ErrorContains(t, err, "require secrets backends")
+}
+
+func TestOIDCWithoutLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "oidc-missing",
+			LocalPort:     18828,
+			RemoteAddress: "127.0.0.1:1",
+			OIDC:          &proxy.OIDCConfig{Issuer: idp.URL, ClientID: "grpc-proxy", RefreshTokenRef: "file:" + filepath.Join(t.TempDir(), "refresh")},
+		}},
+	})
+	err := manager.Start()
+	defer manager.Stop()
+	assert.ErrorContains(t, err, "grpc-proxy login oidc-missing")
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// failingTestService is an upstream node that has gone bad
+type failingTestService struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (failingTestService) UnaryCall(context.Context, *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	return nil, status.Error(codes.Unavailable, "node is syncing")
+}
+
+func TestOutlierDetection(t *testing.T) {
+	for port, service := range map[string]testpb.TestServiceServer{"19918": testService{}, "19917": failingTestService{}} {
+		lis, err := net.Listen("tcp", "127.0.0.1:"+port)
+		require.NoError(t, err)
+		server := grpc.NewServer()
+		testpb.RegisterTestServiceServer(server, service)
+		go server.Serve(lis)
+		defer server.Stop()
+	}
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "outliers",
+			LocalPort:     18890,
+			RemoteAddress: "node.test:9090",
+			ResolveTo:     []string{"127.0.0.1:19918", "127.0.0.1:19917"},
+			JWTToken:      "outlier_token",
+			OutlierDetection: &proxy.OutlierDetectionConfig{
+				Interval:     200 * time.Millisecond,
+				MinCalls:     5,
+				EjectionTime: 600 * time.Millisecond,
+				RampUp:       time.Millisecond,
+			},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18890", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	failures := func(n int) int {
+		failed := 0
+		for i := 0; i < n; i++ {
+			if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+				assert.Equal(t, codes.Unavailable, status.Code(err))
+				failed++
+			}
+		}
+		return failed
+	}
+
+	// Calls are spread over both addresses until the failing one is ejected
+	assert.Greater(t, failures(20), 0)
+	require.Eventually(t, func() bool {
+		return endpointMetric(t, "outliers", "upstream_ejected") == 1
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 0, failures(20))
+	assert.Equal(t, 1.0, endpointMetric(t, "outliers", "upstream_ejections"))
+
+	// After the cool-down the address is back in rotation
+	time.Sleep(700 * time.Millisecond)
+	assert.Greater(t, failures(20), 0)
+}
+
+func TestOutlierDetectionConfig(t *testing.T) {
+	for _, config := range []proxy.OutlierDetectionConfig{
+		{MaxErrorPercent: 120},
+		{MaxEjectionPercent: -1},
+		{EjectionTime: -time.Second},
+	} {
+		_, err := proxy.NewProxyServer(proxy.Config{Name: "outliers", JWTToken: "outlier_token", RemoteAddress: "127.0.0.1:19918",
+			OutlierDetection: &config})
+		assert.Error(t, err, "%+v", config)
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestClientPolicies(t *testing.T) {
+	_, upstream := serveRecording(t)
+	config := &proxy.ProxyConfig{
+		Policies: []proxy.PolicyConfig{
+			{Name: "query", AllowedMethods: []string{"/grpc.*.TestService/Unary"}},
+			{Name: "empty", AllowedMethods: []string{"/grpc.testing.TestService/"}, DeniedMethods: []string{"/grpc.testing.TestService/StreamingOutputCall"}},
+		},
+		Clients: []proxy.ClientConfig{
+			{Name: "reader", APIKey: "reader-key", Policies: []string{"query"}},
+			{Name: "simulator", APIKey: "simulator-key", Policies: []string{"query", "empty"}},
+			{Name: "admin", APIKey: "admin-key"},
+		},
+		Endpoints: []proxy.Config{{
+			Name:          "policies",
+			LocalPort:     18853,
+			RemoteAddress: upstream,
+			JWTToken:      "policies_token",
+			Connect:       proxy.ConnectConfig{Timeout: 200 * time.Millisecond},
+		}},
+	}
+	manager := proxy.NewManager(config)
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client, _ := dialTestService(t, "127.0.0.1:18853")
+	as := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+	}
+	emptyCall := func(key string) codes.Code {
+		_, err := client.EmptyCall(as(key), &testpb.Empty{})
+		return status.Code(err)
+	}
+
+	_, err := client.UnaryCall(as("reader-key"), &testpb.SimpleRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, codes.PermissionDenied, emptyCall("reader-key"))
+
+	// The upstream itself does not implement EmptyCall
+	assert.Equal(t, codes.Unimplemented, emptyCall("simulator-key"))
+	assert.Equal(t, codes.Unimplemented, emptyCall("admin-key"))
+
+	stream, err := client.StreamingOutputCall(as("simulator-key"), &testpb.StreamingOutputCallRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, 2.0, endpointMetric(t, "policies", "policy_denied"))
+
+	t.Run("reload applies changed policies", func(t *testing.T) {
+		reloaded := *config
+		reloaded.Policies = []proxy.PolicyConfig{
+			{Name: "query", AllowedMethods: []string{"/grpc.testing.TestService/"}},
+			config.Policies[1],
+		}
+		require.NoError(t, manager.Reload(&reloaded))
+		assert.Equal(t, codes.Unimplemented, emptyCall("reader-key"))
+	})
+}
+
+func TestClientPolicyValidation(t *testing.T) {
+	config := &proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{Name: "policies", LocalPort: 18853, RemoteAddress: "127.0.0.1:19853", JWTToken: "policies_token"}},
+		Clients:   []proxy.ClientConfig{{Name: "reader", APIKey: "reader-key", Policies: []string{"query"}}},
+	}
+	assert.ErrorContains(t, config.Validate(), "unknown policy 'query'")
+
+	config.Policies = []proxy.PolicyConfig{{Name: "query"}}
+	assert.ErrorContains(t, config.Validate(), "requires allowed_methods")
+}
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/adminpb"
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestPortRange(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19908")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	// Another process holds a port of the range
+	busy, err := net.Listen("tcp", "127.0.0.1:18872")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	endpoint := func(name string, port int) proxy.Config {
+		return proxy.Config{Name: name, LocalPort: port, RemoteAddress: "127.0.0.1:19908", JWTToken: "token"}
+	}
+	config := &proxy.ProxyConfig{
+		PortRange:       "18870-18874",
+		Endpoints:       []proxy.Config{endpoint("akash", 0), endpoint("cosmos-hub", 18870), endpoint("osmosis", 0)},
+		Admin:           &proxy.AdminConfig{LocalPort: 18869},
+		ShutdownTimeout: time.Second,
+	}
+	manager := proxy.NewManager(config)
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	ports := func() map[string]string {
+		conn, err := grpc.NewClient("127.0.0.1:18869", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+		resp, err := adminpb.NewProxyAdminClient(conn).ListEndpoints(context.Background(), &adminpb.ListEndpointsRequest{})
+		require.NoError(t, err)
+		listen := make(map[string]string)
+		for _, e := range resp.Endpoints {
+			listen[e.Name] = e.ListenAddress
+		}
+		return listen
+	}
+
+	t.Run("free ports are assigned in order", func(t *testing.T) {
+		assert.Equal(t, map[string]string{
+			"akash":      "127.0.0.1:18871",
+			"cosmos-hub": "127.0.0.1:18870",
+			"osmosis":    "127.0.0.1:18873",
+		}, ports())
+	})
+
+	t.Run("reload keeps assigned ports", func(t *testing.T) {
+		reloaded := &proxy.ProxyConfig{
+			PortRange:       "18870-18874",
+			Endpoints:       []proxy.Config{endpoint("juno", 0), endpoint("osmosis", 0), endpoint("akash", 0)},
+			Admin:           &proxy.AdminConfig{LocalPort: 18869},
+			ShutdownTimeout: time.Second,
+		}
+		require.NoError(t, manager.Reload(reloaded))
+		listen := ports()
+		assert.Equal(t, "127.0.0.1:18871", listen["akash"])
+		assert.Equal(t, "127.0.0.1:18873", listen["osmosis"])
+		// 18870 is still held by cosmos-hub while it drains
+		assert.Equal(t, "127.0.0.1:18874", listen["juno"])
+	})
+
+	t.Run("range exhausted", func(t *testing.T) {
+		full := &proxy.ProxyConfig{
+			PortRange: "18870-18874",
+			Endpoints: []proxy.Config{endpoint("juno", 0), endpoint("osmosis", 0), endpoint("akash", 0),
+				endpoint("stargaze", 0), endpoint("evmos", 0)},
+			Admin:           &proxy.AdminConfig{LocalPort: 18869},
+			ShutdownTimeout: time.Second,
+		}
+		err := manager.Reload(full)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no free port left in port_range 18870-18874")
+	})
+}
+
+func TestListenConflicts(t *testing.T) {
+	config := &proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{Name: "cosmos-hub", LocalPort: 9090, RemoteAddress: "localhost:1", JWTToken: "token"},
+			{Name: "osmosis", LocalPort: 9090, RemoteAddress: "localhost:1", JWTToken: "token"},
+			{Name: "juno", BindAddress: "0.0.0.0", LocalPort: 9091, RemoteAddress: "localhost:1", JWTToken: "token"},
+			{Name: "akash", LocalPort: 9092, RemoteAddress: "localhost:1", JWTToken: "token",
+				REST: &proxy.RESTConfig{LocalPort: 9092, RemoteAddress: "http://localhost:1317"}},
+			{Name: "evmos", BindAddress: "10.0.0.5", LocalPort: 9090, RemoteAddress: "localhost:1", JWTToken: "token"},
+		},
+		Admin: &proxy.AdminConfig{LocalPort: 9091},
+	}
+	err := config.Validate()
+	require.Error(t, err)
+	msg := err.Error()
+	assert.Contains(t, msg, "endpoint 'cosmos-hub' (127.0.0.1:9090) and endpoint 'osmosis' (127.0.0.1:9090)")
+	assert.Contains(t, msg, "endpoint 'juno' (0.0.0.0:9091) and admin (127.0.0.1:9091)")
+	assert.Contains(t, msg, "endpoint 'akash' (127.0.0.1:9092) and endpoint 'akash' rest (127.0.0.1:9092)")
+	assert.NotContains(t, msg, "evmos", "different interfaces may share a port")
+
+	assert.Error(t, (&proxy.ProxyConfig{PortRange: "9200-9100", Endpoints: config.Endpoints[:1]}).Validate())
+}
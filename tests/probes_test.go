@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// readyzResponse is the body of /readyz
+type readyzResponse struct {
+	Ready     bool `json:"ready"`
+	Endpoints []struct {
+		Name           string   `json:"name"`
+		Ready          bool     `json:"ready"`
+		Listening      bool     `json:"listening"`
+		ReadyUpstreams int      `json:"ready_upstreams"`
+		Problems       []string `json:"problems"`
+	} `json:"endpoints"`
+}
+
+func TestProbes(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19909")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{Name: "cosmos-hub", LocalPort: 18883, RemoteAddress: "127.0.0.1:19909", JWTToken: expiringToken(time.Hour)},
+			{Name: "osmosis", LocalPort: 18881, RemoteAddress: "127.0.0.1:19909", JWTToken: "opaque_token"},
+		},
+		Admin:           &proxy.AdminConfig{LocalPort: 18882},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	readyz := func() (int, readyzResponse) {
+		resp, err := http.Get("http://127.0.0.1:18882/readyz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		var body readyzResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	t.Run("healthz", func(t *testing.T) {
+		resp, err := http.Get("http://127.0.0.1:18882/healthz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		code, body := readyz()
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, body.Ready)
+		require.Len(t, body.Endpoints, 2)
+		for _, e := range body.Endpoints {
+			assert.True(t, e.Ready, e.Name)
+			assert.True(t, e.Listening, e.Name)
+			assert.Equal(t, 1, e.ReadyUpstreams, e.Name)
+			assert.Empty(t, e.Problems, e.Name)
+		}
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		p, ok := manager.Server("cosmos-hub")
+		require.True(t, ok)
+		p.SetToken(expiringToken(-time.Minute))
+		defer p.SetToken(expiringToken(time.Hour))
+
+		code, body := readyz()
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.False(t, body.Ready)
+		assert.False(t, body.Endpoints[0].Ready)
+		require.Len(t, body.Endpoints[0].Problems, 1)
+		assert.Contains(t, body.Endpoints[0].Problems[0], "token expired")
+		assert.True(t, body.Endpoints[1].Ready, "other endpoints are reported separately")
+	})
+
+	t.Run("drained endpoint", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := manager.Drain(ctx, "osmosis")
+		require.NoError(t, err)
+
+		code, body := readyz()
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, []string{"endpoint is not running"}, body.Endpoints[1].Problems)
+	})
+
+	t.Run("upstream down", func(t *testing.T) {
+		upstream.Stop()
+		require.Eventually(t, func() bool {
+			_, body := readyz()
+			return len(body.Endpoints) > 0 && body.Endpoints[0].ReadyUpstreams == 0
+		}, 5*time.Second, 50*time.Millisecond)
+
+		_, body := readyz()
+		require.Len(t, body.Endpoints[0].Problems, 1)
+		assert.Contains(t, body.Endpoints[0].Problems[0], "no upstream is READY")
+
+		resp, err := http.Get("http://127.0.0.1:18882/healthz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "liveness does not depend on upstreams")
+	})
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// processorFunc adapts a function to proxy.Processor
+type processorFunc func(req *proxy.ProcessorRequest) (*proxy.ProcessorResponse, error)
+
+func (f processorFunc) Process(_ context.Context, req *proxy.ProcessorRequest) (*proxy.ProcessorResponse, error) {
+	return f(req)
+}
+
+// teamProcessor denies blocked teams, tags calls with their tenant and lets
+// the x-route header pick the archive upstream
+func teamProcessor(archiveAddr string) processorFunc {
+	return func(req *proxy.ProcessorRequest) (*proxy.ProcessorResponse, error) {
+		team := req.Metadata.Get("x-team")
+		switch {
+		case len(team) == 0:
+			return nil, nil
+		case team[0] == "blocked":
+			return &proxy.ProcessorResponse{Deny: status.New(codes.PermissionDenied, "team blocked")}, nil
+		case team[0] == "sneaky":
+			return &proxy.ProcessorResponse{SetMetadata: map[string]string{"authorization": "Bearer stolen"}}, nil
+		}
+		resp := &proxy.ProcessorResponse{
+			SetMetadata:    map[string]string{"x-tenant": team[0] + "@" + req.Endpoint},
+			RemoveMetadata: []string{"x-secret"},
+		}
+		if len(req.Metadata.Get("x-route")) > 0 {
+			resp.Upstream = archiveAddr
+		}
+		if req.Method == "/grpc.testing.TestService/EmptyCall" {
+			resp.Method = "/grpc.testing.TestService/UnaryCall"
+		}
+		return resp, nil
+	}
+}
+
+func TestExternalProcessor(t *testing.T) {
+	primary, primaryAddr := serveRecording(t)
+	archive, archiveAddr := serveRecording(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	proxy.RegisterProcessorServer(server, teamProcessor(archiveAddr))
+	go server.Serve(lis)
+	defer server.Stop()
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "processor",
+		LocalPort:     18851,
+		RemoteAddress: primaryAddr,
+		JWTToken:      "processor_token",
+		Routes: []proxy.RouteConfig{{
+			Methods:       []string{"grpc.testing.TestService/StreamingOutputCall"},
+			RemoteAddress: archiveAddr,
+		}},
+		Processor: &proxy.ProcessorConfig{Address: lis.Addr().String()},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	client, _ := dialTestService(t, "127.0.0.1:18851")
+	call := func(pairs ...string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), pairs...)
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		return err
+	}
+
+	t.Run("changes metadata", func(t *testing.T) {
+		require.NoError(t, call("x-team", "indexer", "x-secret", "hunter2"))
+		md := primary.metadata()
+		assert.Equal(t, []string{"indexer@processor"}, md.Get("x-tenant"))
+		assert.Empty(t, md.Get("x-secret"))
+		assert.Equal(t, []string{"Bearer processor_token"}, md.Get("authorization"))
+	})
+
+	t.Run("denies calls", func(t *testing.T) {
+		err := call("x-team", "blocked")
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "team blocked")
+		assert.Equal(t, 1.0, endpointMetric(t, "processor", "processor_denied"))
+	})
+
+	t.Run("picks the upstream", func(t *testing.T) {
+		require.NoError(t, call("x-team", "archive-team", "x-route", "1"))
+		assert.Equal(t, []string{"archive-team@processor"}, archive.metadata().Get("x-tenant"))
+	})
+
+	t.Run("rewrites the method", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-team", "rewritten")
+		_, err := client.EmptyCall(ctx, &testpb.Empty{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"rewritten@processor"}, primary.metadata().Get("x-tenant"))
+	})
+
+	t.Run("rejects protected changes", func(t *testing.T) {
+		err := call("x-team", "sneaky")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Equal(t, 1.0, endpointMetric(t, "processor", "processor_errors"))
+	})
+}
+
+func TestProcessorOption(t *testing.T) {
+	primary, primaryAddr := serveRecording(t)
+	failing := processorFunc(func(req *proxy.ProcessorRequest) (*proxy.ProcessorResponse, error) {
+		return nil, status.Error(codes.Internal, "processor down")
+	})
+
+	t.Run("fails closed by default", func(t *testing.T) {
+		p, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "processor-option",
+			LocalPort:     18850,
+			RemoteAddress: primaryAddr,
+			JWTToken:      "option_token",
+		}, proxy.WithProcessor(failing))
+		require.NoError(t, err)
+		go p.Start()
+		defer p.Stop()
+		time.Sleep(200 * time.Millisecond)
+
+		client, _ := dialTestService(t, "127.0.0.1:18850")
+		_, err = client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("endpoint processor takes precedence", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server := grpc.NewServer()
+		proxy.RegisterProcessorServer(server, failing)
+		go server.Serve(lis)
+		defer server.Stop()
+
+		p, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "processor-fail-open",
+			LocalPort:     18849,
+			RemoteAddress: primaryAddr,
+			JWTToken:      "option_token",
+			Processor:     &proxy.ProcessorConfig{Address: lis.Addr().String(), FailOpen: true},
+		}, proxy.WithProcessor(teamProcessor("")))
+		require.NoError(t, err)
+		go p.Start()
+		defer p.Stop()
+		time.Sleep(200 * time.Millisecond)
+
+		client, _ := dialTestService(t, "127.0.0.1:18849")
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-team", "blocked")
+		_, err = client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"blocked"}, primary.metadata().Get("x-team"))
+		assert.Equal(t, 1.0, endpointMetric(t, "processor-fail-open", "processor_errors"))
+	})
+
+	t.Run("needs an address or a plugin", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "processor-invalid",
+			LocalPort:     18849,
+			RemoteAddress: primaryAddr,
+			JWTToken:      "option_token",
+			Processor:     &proxy.ProcessorConfig{},
+		})
+		assert.ErrorContains(t, err, "processor needs either address or plugin")
+
+		_, err = proxy.NewProxyServer(proxy.Config{
+			Name:          "processor-invalid",
+			LocalPort:     18849,
+			RemoteAddress: primaryAddr,
+			JWTToken:      "option_token",
+			Processor:     &proxy.ProcessorConfig{Plugin: "/nonexistent/processor.so"},
+		})
+		assert.ErrorContains(t, err, "failed to open processor plugin")
+	})
+}
@@ -0,0 +1,296 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// listServicesThrough sends a single reflection request through the proxy at addr
+func listServicesThrough(t *testing.T, addr string) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return listServicesThroughContext(t, ctx, addr)
+}
+
+// listServicesThroughContext is listServicesThrough with a caller-supplied context
+func listServicesThroughContext(t *testing.T, ctx context.Context, addr string) error {
+	t.Helper()
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := grpc_reflection_v1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&grpc_reflection_v1alpha.ServerReflectionRequest{
+		Host: "localhost",
+		MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_ListServices{
+			ListServices: "*",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = stream.Recv()
+	stream.CloseSend()
+	return err
+}
+
+func TestProxyPackageJWTInjection(t *testing.T) {
+	mockServer, mockService, err := startMockGRPCServer(19997)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "lib-test",
+			LocalPort:     18997,
+			RemoteAddress: "localhost:19997",
+			JWTToken:      "lib_token_1",
+		}},
+		ShutdownTimeout: 2 * time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18997"))
+	assert.Equal(t, []string{"Bearer lib_token_1"}, mockService.ReceivedHeaders["authorization"])
+
+	t.Run("reload swaps token", func(t *testing.T) {
+		err := manager.Reload(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "lib-test",
+				LocalPort:     18997,
+				RemoteAddress: "localhost:19997",
+				JWTToken:      "lib_token_2",
+			}},
+			ShutdownTimeout: 2 * time.Second,
+		})
+		require.NoError(t, err)
+		time.Sleep(200 * time.Millisecond)
+
+		require.NoError(t, listServicesThrough(t, "localhost:18997"))
+		assert.Equal(t, []string{"Bearer lib_token_2"}, mockService.ReceivedHeaders["authorization"])
+	})
+
+	t.Run("invalid reload keeps running endpoints", func(t *testing.T) {
+		err := manager.Reload(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{Name: "lib-test", LocalPort: 18997, RemoteAddress: "localhost:19997"}},
+		})
+		assert.Error(t, err)
+
+		require.NoError(t, listServicesThrough(t, "localhost:18997"))
+		assert.Len(t, manager.Servers(), 1)
+	})
+
+	t.Run("endpoint failing to start keeps the rest of the reload", func(t *testing.T) {
+		busy, err := net.Listen("tcp", "127.0.0.1:18998")
+		require.NoError(t, err)
+		defer busy.Close()
+
+		err = manager.Reload(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{
+				{Name: "lib-test", LocalPort: 18997, RemoteAddress: "localhost:19997", JWTToken: "lib_token_3"},
+				{Name: "busy", LocalPort: 18998, RemoteAddress: "localhost:19997", JWTToken: "lib_token_3"},
+			},
+			ShutdownTimeout: 2 * time.Second,
+		})
+		var partial *proxy.PartialReloadError
+		require.ErrorAs(t, err, &partial)
+		assert.Contains(t, err.Error(), "failed to start endpoint busy")
+
+		require.NoError(t, listServicesThrough(t, "localhost:18997"))
+		assert.Equal(t, []string{"Bearer lib_token_3"}, mockService.ReceivedHeaders["authorization"])
+	})
+
+	t.Run("upstream check does not hold up the manager", func(t *testing.T) {
+		reloaded := make(chan error, 1)
+		go func() {
+			reloaded <- manager.Reload(&proxy.ProxyConfig{
+				Endpoints: []proxy.Config{
+					{Name: "lib-test", LocalPort: 18997, RemoteAddress: "localhost:19997", JWTToken: "lib_token_3"},
+					{Name: "unreachable", LocalPort: 18998, RemoteAddress: "localhost:19992", JWTToken: "lib_token_3",
+						Connect: proxy.ConnectConfig{Timeout: time.Second}},
+				},
+				ShutdownTimeout: 2 * time.Second,
+			})
+		}()
+		time.Sleep(200 * time.Millisecond)
+
+		begin := time.Now()
+		_, ok := manager.Server("lib-test")
+		assert.True(t, ok)
+		assert.Less(t, time.Since(begin), 100*time.Millisecond)
+		require.NoError(t, <-reloaded)
+	})
+}
+
+func TestProxyConfigValidate(t *testing.T) {
+	valid := proxy.Config{Name: "a", LocalPort: 9090, RemoteAddress: "example.com:443", JWTToken: "token"}
+
+	tests := []struct {
+		name    string
+		config  proxy.ProxyConfig
+		wantErr bool
+	}{
+		{"valid", proxy.ProxyConfig{Endpoints: []proxy.Config{valid}}, false},
+		{"no endpoints", proxy.ProxyConfig{}, true},
+		{"placeholder token", proxy.ProxyConfig{Endpoints: []proxy.Config{{Name: "a", JWTToken: "your_cosmos_jwt_token_here"}}}, true},
+		{"duplicate names", proxy.ProxyConfig{Endpoints: []proxy.Config{valid, valid}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigAddress(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:9090", proxy.Config{LocalPort: 9090}.Address())
+	assert.Equal(t, "0.0.0.0:9090", proxy.Config{BindAddress: "0.0.0.0", LocalPort: 9090}.Address())
+	assert.Equal(t, "[::1]:9090", proxy.Config{BindAddress: "::1", LocalPort: 9090}.Address())
+	assert.Equal(t, "unix:///tmp/p.sock", proxy.Config{LocalPort: 9090, ListenAddress: "unix:///tmp/p.sock"}.Address())
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	endpoint := proxy.Config{
+		Name:          "unix",
+		ListenAddress: "unix://" + path,
+		RemoteAddress: "localhost:19992",
+		JWTToken:      "token",
+		Connect:       proxy.ConnectConfig{Timeout: 200 * time.Millisecond},
+	}
+
+	// A socket file nobody listens on is removed
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	first := proxy.NewManager(&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}})
+	require.NoError(t, first.Start())
+	defer first.Stop()
+
+	// A live socket is not taken over
+	second := proxy.NewManager(&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}})
+	err = second.Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "address already in use")
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestUpstreamConnectCheck(t *testing.T) {
+	endpoint := proxy.Config{
+		Name:          "connect-test",
+		LocalPort:     18992,
+		RemoteAddress: "localhost:19992", // nothing listens here
+		JWTToken:      "token",
+		Connect:       proxy.ConnectConfig{Timeout: 300 * time.Millisecond},
+	}
+
+	t.Run("required upstream fails startup", func(t *testing.T) {
+		required := endpoint
+		required.Connect.Required = true
+		manager := proxy.NewManager(&proxy.ProxyConfig{Endpoints: []proxy.Config{required}})
+		assert.Error(t, manager.Start())
+		assert.Empty(t, manager.Servers())
+	})
+
+	t.Run("optional upstream starts and keeps retrying", func(t *testing.T) {
+		manager := proxy.NewManager(&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}, ShutdownTimeout: time.Second})
+		require.NoError(t, manager.Start())
+		defer manager.Stop()
+
+		p, ok := manager.Server("connect-test")
+		require.True(t, ok)
+		assert.NotEqual(t, "READY", p.UpstreamState().String())
+	})
+}
+
+func TestResolveTo(t *testing.T) {
+	mockServer, mockService, err := startMockGRPCServer(19978)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "resolve-test",
+			LocalPort:     18978,
+			RemoteAddress: "upstream.invalid:443", // never resolved
+			ResolveTo:     []string{"127.0.0.1:19978"},
+			JWTToken:      "resolve_token",
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18978"))
+	assert.Equal(t, []string{"Bearer resolve_token"}, mockService.ReceivedHeaders["authorization"])
+	assert.Equal(t, []string{"upstream.invalid:443"}, mockService.ReceivedHeaders[":authority"])
+
+	_, err = proxy.NewProxyServer(proxy.Config{Name: "bad", JWTToken: "t", RemoteAddress: "x:443", ResolveTo: []string{"no-port"}})
+	assert.Error(t, err)
+}
+
+func TestUpstreamProtocolAndAuthority(t *testing.T) {
+	mockServer, mockService, err := startMockGRPCServer(19977)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:              "h2c-test",
+			LocalPort:         18977,
+			RemoteAddress:     "localhost:19977",
+			UpstreamProtocol:  "h2c",
+			AuthorityOverride: "grpc.chandra.internal",
+			JWTToken:          "h2c_token",
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18977"))
+	assert.Equal(t, []string{"grpc.chandra.internal"}, mockService.ReceivedHeaders[":authority"])
+
+	_, err = proxy.NewProxyServer(proxy.Config{Name: "conflict", JWTToken: "t", RemoteAddress: "x:443", UseTLS: true, UpstreamProtocol: "h2c"})
+	assert.Error(t, err)
+	_, err = proxy.NewProxyServer(proxy.Config{Name: "unknown", JWTToken: "t", RemoteAddress: "x:443", UpstreamProtocol: "quic"})
+	assert.Error(t, err)
+}
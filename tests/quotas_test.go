@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestQuotas(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19938")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	// The wallet used 4 calls today before a restart
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	line, err := json.Marshal(proxy.UsageRecord{Start: time.Now().Add(-time.Minute), End: time.Now(), Endpoint: "quotas", Client: "wallet", Calls: 4})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, append(line, '\n'), 0600))
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "quotas",
+			LocalPort:     18929,
+			RemoteAddress: "127.0.0.1:19938",
+			JWTToken:      "quotas_jwt_token",
+		}},
+		Clients: []proxy.ClientConfig{
+			{Name: "indexer", APIKey: "indexer-key", Quotas: []proxy.QuotaConfig{
+				{Period: proxy.QuotaDaily, Calls: 2, Hard: true},
+				{Period: proxy.QuotaMonthly, Calls: 1},
+			}},
+			{Name: "wallet", APIKey: "wallet-key", Quotas: []proxy.QuotaConfig{
+				{Period: proxy.QuotaMonthly, Calls: 5, Hard: true},
+			}},
+			{Name: "explorer", APIKey: "explorer-key"},
+		},
+		Usage:           &proxy.UsageConfig{Path: path},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18929", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	call := func(key string) (metadata.MD, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", key)
+		var header metadata.MD
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header))
+		return header, err
+	}
+
+	t.Run("hard quota", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, err := call("indexer-key")
+			require.NoError(t, err)
+		}
+		header, err := call("indexer-key")
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		now := time.Now().UTC()
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		assert.Equal(t, []string{tomorrow.Format(time.RFC3339)}, header.Get("x-quota-reset"))
+
+		// Other clients are not affected
+		_, err = call("explorer-key")
+		require.NoError(t, err)
+	})
+
+	t.Run("usage before a restart counts", func(t *testing.T) {
+		_, err := call("wallet-key")
+		require.NoError(t, err)
+		_, err = call("wallet-key")
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+}
+
+func TestQuotaConcurrentCalls(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	service := &slowTestService{}
+	testpb.RegisterTestServiceServer(upstream, service)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "quotas-concurrent",
+			LocalPort:     18819,
+			RemoteAddress: lis.Addr().String(),
+			JWTToken:      "quotas_jwt_token",
+		}},
+		Clients: []proxy.ClientConfig{{Name: "indexer", APIKey: "indexer-key", Quotas: []proxy.QuotaConfig{
+			{Period: proxy.QuotaDaily, Calls: 5, Hard: true},
+		}}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client, _ := dialTestService(t, "127.0.0.1:18819")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "indexer-key")
+
+	// All calls are in flight at once, so none has finished when the
+	// others are checked
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	codeCounts := make(map[codes.Code]int)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+			mu.Lock()
+			codeCounts[status.Code(err)]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, map[codes.Code]int{codes.OK: 5, codes.ResourceExhausted: 15}, codeCounts)
+	assert.Equal(t, int32(5), service.calls.Load())
+}
+
+func TestHTTPQuota(t *testing.T) {
+	upstream := startFakeRPC(t)
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "rpc-quotas",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18928,
+			RemoteAddress: upstream.URL,
+			JWTToken:      "rpc_jwt_token",
+		}},
+		Clients: []proxy.ClientConfig{{Name: "relayer", APIKey: "relayer-key", Quotas: []proxy.QuotaConfig{
+			{Period: proxy.QuotaDaily, Bytes: 1, Hard: true},
+		}}},
+		ShutdownTimeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	get := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:18928/status", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Api-Key", "relayer-key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	assert.Equal(t, http.StatusOK, get().StatusCode)
+	resp := get()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("X-Quota-Reset"))
+}
+
+func TestQuotaValidation(t *testing.T) {
+	for _, quota := range []proxy.QuotaConfig{
+		{Period: "weekly", Calls: 10},
+		{Period: proxy.QuotaDaily},
+		{Period: proxy.QuotaDaily, Calls: -1},
+	} {
+		config := &proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{Name: "quotas", LocalPort: 18927, RemoteAddress: "127.0.0.1:19938", JWTToken: "quotas_jwt_token"}},
+			Clients:   []proxy.ClientConfig{{Name: "indexer", APIKey: "indexer-key", Quotas: []proxy.QuotaConfig{quota}}},
+		}
+		assert.Error(t, config.Validate())
+	}
+}
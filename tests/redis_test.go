@@ -0,0 +1,275 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeRedis speaks enough RESP for the proxy's counters, requiring password.
+// Each command is answered after delay.
+type fakeRedis struct {
+	lis      net.Listener
+	password string
+
+	mu     sync.Mutex
+	values map[string]int64
+	delay  time.Duration
+}
+
+// value returns the counter at key
+func (r *fakeRedis) value(key string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.values[key]
+}
+
+// setDelay slows down the answers to later commands
+func (r *fakeRedis) setDelay(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = d
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	r := &fakeRedis{lis: lis, password: password, values: make(map[string]int64)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { lis.Close() })
+	return r
+}
+
+func (r *fakeRedis) addr() string { return r.lis.Addr().String() }
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:size])
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		r.mu.Lock()
+		delay := r.delay
+		r.mu.Unlock()
+		time.Sleep(delay)
+		r.mu.Lock()
+		switch cmd {
+		case "AUTH":
+			if args[len(args)-1] != r.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			} else {
+				authed = true
+				fmt.Fprint(conn, "+OK\r\n")
+			}
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case "SELECT", "PEXPIRE", "EXPIREAT":
+			fmt.Fprint(conn, ":1\r\n")
+		case "INCR", "INCRBY":
+			delta := int64(1)
+			if cmd == "INCRBY" {
+				delta, _ = strconv.ParseInt(args[2], 10, 64)
+			}
+			r.values[args[1]] += delta
+			fmt.Fprintf(conn, ":%d\r\n", r.values[args[1]])
+		case "MGET":
+			fmt.Fprintf(conn, "*%d\r\n", len(args)-1)
+			for _, key := range args[1:] {
+				if v, ok := r.values[key]; ok {
+					s := strconv.FormatInt(v, 10)
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
+				} else {
+					fmt.Fprint(conn, "$-1\r\n")
+				}
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		}
+		r.mu.Unlock()
+	}
+}
+
+func TestRedisSharedLimits(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19937")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	redis := startFakeRedis(t, "redis-password")
+
+	// Two replicas of the same configuration share one Redis
+	replica := func(port int) *proxy.Manager {
+		m := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "shared",
+				LocalPort:     port,
+				RemoteAddress: "127.0.0.1:19937",
+				JWTToken:      "shared_jwt_token",
+				Lanes:         []proxy.LaneConfig{{Name: "batch", RateLimit: 1, Burst: 4, QueueTimeout: 50 * time.Millisecond}},
+			}},
+			Clients: []proxy.ClientConfig{{Name: "indexer", APIKey: "indexer-key", Quotas: []proxy.QuotaConfig{
+				{Period: proxy.QuotaDaily, Calls: 3, Hard: true},
+			}}, {Name: "explorer", APIKey: "explorer-key"}},
+			Redis:           &proxy.RedisConfig{Address: redis.addr(), Password: "redis-password", DB: 2},
+			ShutdownTimeout: time.Second,
+		})
+		require.NoError(t, m.Start())
+		t.Cleanup(func() { m.Stop() })
+		return m
+	}
+	replica(18926)
+	replica(18925)
+
+	call := func(port int, md ...string) error {
+		conn, err := grpc.NewClient(fmt.Sprintf("127.0.0.1:%d", port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, md...)
+		_, err = testpb.NewTestServiceClient(conn).EmptyCall(ctx, &testpb.Empty{})
+		return err
+	}
+
+	t.Run("quota", func(t *testing.T) {
+		// Replicas sync their counts with Redis every second
+		sync := func() { time.Sleep(1500 * time.Millisecond) }
+		require.NoError(t, call(18926, "x-api-key", "indexer-key"))
+		require.NoError(t, call(18926, "x-api-key", "indexer-key"))
+		sync()
+		require.NoError(t, call(18925, "x-api-key", "indexer-key"))
+		sync()
+		assert.Equal(t, codes.ResourceExhausted, status.Code(call(18925, "x-api-key", "indexer-key")))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(call(18926, "x-api-key", "indexer-key")))
+		today := time.Now().UTC().Format("2006-01-02")
+		assert.Equal(t, int64(3), redis.value("grpc-proxy:quota:indexer:daily:"+today+":calls"))
+	})
+
+	t.Run("lane rate limit", func(t *testing.T) {
+		// Start well inside a 4s window so all calls land in the same one
+		window := 4 * time.Second
+		if left := window - time.Duration(time.Now().UnixNano()%int64(window)); left < 2*time.Second {
+			time.Sleep(left)
+		}
+		admitted := 0
+		for i := 0; i < 6; i++ {
+			for _, port := range []int{18926, 18925} {
+				if call(port, "x-api-key", "explorer-key", "x-proxy-lane", "batch") == nil {
+					admitted++
+				}
+			}
+		}
+		assert.Equal(t, 4, admitted)
+	})
+}
+
+func TestRedisSlowQuotas(t *testing.T) {
+	_, upstreamAddr := serveRecording(t)
+	redis := startFakeRedis(t, "")
+	m := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "shared-slow",
+			LocalPort:     18818,
+			RemoteAddress: upstreamAddr,
+			JWTToken:      "shared_jwt_token",
+		}},
+		Clients: []proxy.ClientConfig{{Name: "indexer", APIKey: "indexer-key", Quotas: []proxy.QuotaConfig{
+			{Period: proxy.QuotaDaily, Calls: 100, Hard: true},
+		}}},
+		Redis:           &proxy.RedisConfig{Address: redis.addr(), Timeout: 2 * time.Second},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, m.Start())
+	defer m.Stop()
+
+	// Calls do not wait for Redis, which now takes 200ms per command
+	redis.setDelay(200 * time.Millisecond)
+	client, _ := dialTestService(t, "127.0.0.1:18818")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "indexer-key")
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		assert.Less(t, time.Since(start), 400*time.Millisecond)
+	}
+
+	// and the counts still reach it
+	today := time.Now().UTC().Format("2006-01-02")
+	require.Eventually(t, func() bool {
+		return redis.value("grpc-proxy:quota:indexer:daily:"+today+":calls") == 3
+	}, 5*time.Second, 100*time.Millisecond)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, int64(3), redis.value("grpc-proxy:quota:indexer:daily:"+today+":calls"))
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	redis := startFakeRedis(t, "redis-password")
+	for _, config := range []*proxy.RedisConfig{
+		{Address: "127.0.0.1:1"},
+		{Address: redis.addr(), Password: "wrong-password"},
+		{},
+	} {
+		m := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "shared",
+				LocalPort:     18924,
+				RemoteAddress: "127.0.0.1:19937",
+				JWTToken:      "shared_jwt_token",
+			}},
+			Redis:           config,
+			ShutdownTimeout: time.Second,
+		})
+		assert.Error(t, m.Start())
+	}
+}
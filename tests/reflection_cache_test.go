@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	rpbalpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// countingStream counts the messages a server stream receives
+type countingStream struct {
+	grpc.ServerStream
+	count *atomic.Int64
+}
+
+func (s *countingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.count.Add(1)
+	}
+	return err
+}
+
+// startReflectionUpstream serves reflection and health, counting reflection requests
+func startReflectionUpstream(t *testing.T, address string) (*grpc.Server, *atomic.Int64) {
+	lis, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+	requests := &atomic.Int64{}
+	server := grpc.NewServer(grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &countingStream{ServerStream: ss, count: requests})
+	}))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	reflection.Register(server)
+	go server.Serve(lis)
+	return server, requests
+}
+
+func TestReflectionCache(t *testing.T) {
+	upstream, requests := startReflectionUpstream(t, "127.0.0.1:19947")
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:            "reflect",
+			LocalPort:       18941,
+			RemoteAddress:   "127.0.0.1:19947",
+			JWTToken:        "reflect_jwt_token",
+			ReflectionCache: &proxy.ReflectionCacheConfig{TTL: time.Hour},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18941", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listServices := &rpb.ServerReflectionRequest{
+		Host:           "proxy",
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	}
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(listServices))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "proxy", resp.ValidHost)
+		var names []string
+		for _, s := range resp.GetListServicesResponse().GetService() {
+			names = append(names, s.Name)
+		}
+		assert.Contains(t, names, "grpc.health.v1.Health")
+	}
+	require.NoError(t, stream.CloseSend())
+	assert.Equal(t, int64(1), requests.Load(), "repeated requests are answered from the cache")
+
+	// v1alpha shares the cache
+	alpha, err := rpbalpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	require.NoError(t, alpha.Send(&rpbalpha.ServerReflectionRequest{
+		MessageRequest: &rpbalpha.ServerReflectionRequest_ListServices{ListServices: "*"},
+	}))
+	resp, err := alpha.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.GetListServicesResponse().GetService())
+
+	// File descriptors are cached too, but errors are not
+	symbol := &rpbalpha.ServerReflectionRequest{
+		MessageRequest: &rpbalpha.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.health.v1.Health"},
+	}
+	require.NoError(t, alpha.Send(symbol))
+	resp, err = alpha.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.GetFileDescriptorResponse().GetFileDescriptorProto())
+	unknown := &rpbalpha.ServerReflectionRequest{
+		MessageRequest: &rpbalpha.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "no.such.Service"},
+	}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, alpha.Send(unknown))
+		resp, err = alpha.Recv()
+		require.NoError(t, err)
+		assert.NotNil(t, resp.GetErrorResponse())
+	}
+	require.NoError(t, alpha.CloseSend())
+	assert.Equal(t, int64(4), requests.Load())
+
+	// Cached descriptors keep working while the upstream is down
+	upstream.Stop()
+	offline, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	require.NoError(t, offline.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.health.v1.Health"},
+	}))
+	fileResp, err := offline.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, fileResp.GetFileDescriptorResponse().GetFileDescriptorProto())
+	require.NoError(t, offline.CloseSend())
+}
+
+func TestReflectionCacheServesStaleWhileUpstreamDown(t *testing.T) {
+	upstream, _ := startReflectionUpstream(t, "127.0.0.1:19946")
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:            "reflect-stale",
+			LocalPort:       18940,
+			RemoteAddress:   "127.0.0.1:19946",
+			JWTToken:        "reflect_jwt_token",
+			ReflectionCache: &proxy.ReflectionCacheConfig{TTL: time.Millisecond},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18940", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ask := func() (*rpb.ServerReflectionResponse, error) {
+		stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer stream.CloseSend()
+		if err := stream.Send(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+		}); err != nil {
+			return nil, err
+		}
+		return stream.Recv()
+	}
+
+	_, err = ask()
+	require.NoError(t, err)
+	upstream.Stop()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := ask()
+	require.NoError(t, err, "an expired entry is served while the upstream is unreachable")
+	assert.NotEmpty(t, resp.GetListServicesResponse().GetService())
+}
+
+func TestReflectionVersionTranslation(t *testing.T) {
+	// One upstream only serves v1alpha, the other only v1
+	alphaOnly := grpc.NewServer()
+	healthpb.RegisterHealthServer(alphaOnly, health.NewServer())
+	rpbalpha.RegisterServerReflectionServer(alphaOnly, reflection.NewServer(reflection.ServerOptions{Services: alphaOnly}))
+	v1Only := grpc.NewServer()
+	healthpb.RegisterHealthServer(v1Only, health.NewServer())
+	reflection.RegisterV1(v1Only)
+	for address, server := range map[string]*grpc.Server{"127.0.0.1:19945": alphaOnly, "127.0.0.1:19944": v1Only} {
+		lis, err := net.Listen("tcp", address)
+		require.NoError(t, err)
+		go server.Serve(lis)
+		defer server.Stop()
+	}
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{Name: "alpha-only", LocalPort: 18939, RemoteAddress: "127.0.0.1:19945", JWTToken: "reflect_jwt_token"},
+			{Name: "v1-only", LocalPort: 18938, RemoteAddress: "127.0.0.1:19944", JWTToken: "reflect_jwt_token"},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, address := range []string{"127.0.0.1:18939", "127.0.0.1:18938"} {
+		conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		v1, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, v1.Send(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+			}))
+			resp, err := v1.Recv()
+			require.NoError(t, err, address)
+			assert.NotEmpty(t, resp.GetListServicesResponse().GetService(), address)
+		}
+		require.NoError(t, v1.CloseSend())
+
+		alpha, err := rpbalpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		require.NoError(t, err)
+		require.NoError(t, alpha.Send(&rpbalpha.ServerReflectionRequest{
+			MessageRequest: &rpbalpha.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "grpc.health.v1.Health"},
+		}))
+		resp, err := alpha.Recv()
+		require.NoError(t, err, address)
+		assert.NotEmpty(t, resp.GetFileDescriptorResponse().GetFileDescriptorProto(), address)
+		require.NoError(t, alpha.CloseSend())
+	}
+}
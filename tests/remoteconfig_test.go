@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeKV is a versioned value that waiters are told about when it changes
+type fakeKV struct {
+	mu      sync.Mutex
+	value   string
+	version int64
+	changed chan struct{}
+}
+
+func newFakeKV(value string) *fakeKV {
+	return &fakeKV{value: value, version: 10, changed: make(chan struct{})}
+}
+
+func (kv *fakeKV) get() (string, int64, chan struct{}) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.value, kv.version, kv.changed
+}
+
+func (kv *fakeKV) set(value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.value = value
+	kv.version++
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+}
+
+// fakeConsul serves the KV endpoint with blocking queries
+func fakeConsul(t *testing.T, key string, kv *fakeKV) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/"+key {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Consul-Token") != "acl_token" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		value, version, changed := kv.get()
+		if index := r.URL.Query().Get("index"); index == strconv.FormatInt(version, 10) {
+			select {
+			case <-changed:
+			case <-time.After(200 * time.Millisecond):
+			}
+			value, version, _ = kv.get()
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatInt(version, 10))
+		fmt.Fprint(w, value)
+	}))
+}
+
+// fakeEtcd serves range, watch and authenticate on the JSON gateway
+func fakeEtcd(t *testing.T, key string, kv *fakeKV) *httptest.Server {
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if r.URL.Path == "/v3/auth/authenticate" {
+			if body["name"] != "proxy" || body["password"] != "secret" {
+				http.Error(w, `{"error":"authentication failed"}`, http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "etcd_token"})
+			return
+		}
+		if r.Header.Get("Authorization") != "etcd_token" {
+			http.Error(w, `{"error":"user name is empty"}`, http.StatusUnauthorized)
+			return
+		}
+		value, version, changed := kv.get()
+		kvJSON := func(value string, version int64) map[string]string {
+			return map[string]string{"key": encodedKey, "value": base64.StdEncoding.EncodeToString([]byte(value)), "mod_revision": strconv.FormatInt(version, 10)}
+		}
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			assert.Equal(t, encodedKey, body["key"])
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"header": map[string]string{"revision": strconv.FormatInt(version, 10)},
+				"kvs":    []interface{}{kvJSON(value, version)},
+			})
+		case "/v3/watch":
+			create := body["create_request"].(map[string]interface{})
+			assert.Equal(t, strconv.FormatInt(version+1, 10), create["start_revision"])
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+			w.(http.Flusher).Flush()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			value, version, _ = kv.get()
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+				"events": []interface{}{map[string]interface{}{"kv": kvJSON(value, version)}},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestRemoteConfig(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_TOKEN", "acl_token")
+	for name, start := range map[string]func(*testing.T, string, *fakeKV) *httptest.Server{"consul": fakeConsul, "etcd": fakeEtcd} {
+		t.Run(name, func(t *testing.T) {
+			kv := newFakeKV("endpoints: []\n")
+			server := start(t, "grpc-proxy/config.yaml", kv)
+			defer server.Close()
+
+			sourceURL := fmt.Sprintf("%s://%s/grpc-proxy/config.yaml", name, server.Listener.Addr())
+			if name == "etcd" {
+				sourceURL = fmt.Sprintf("etcd://proxy:secret@%s/grpc-proxy/config.yaml", server.Listener.Addr())
+			}
+			source, err := proxy.NewRemoteConfigSource(sourceURL)
+			require.NoError(t, err)
+			assert.Equal(t, "yaml", source.Format())
+			assert.NotContains(t, source.String(), "secret")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			value, err := source.Get(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "endpoints: []\n", string(value))
+
+			// A watch returns once the key changes
+			watched := make(chan string, 1)
+			go func() {
+				value, err := source.Watch(ctx)
+				assert.NoError(t, err)
+				watched <- string(value)
+			}()
+			time.Sleep(300 * time.Millisecond)
+			select {
+			case v := <-watched:
+				t.Fatalf("watch returned without a change: %q", v)
+			default:
+			}
+			kv.set("shutdown_timeout: 10s\n")
+			select {
+			case v := <-watched:
+				assert.Equal(t, "shutdown_timeout: 10s\n", v)
+			case <-ctx.Done():
+				t.Fatal("watch did not return after the change")
+			}
+		})
+	}
+}
+
+func TestRemoteConfigSourceURL(t *testing.T) {
+	source, err := proxy.NewRemoteConfigSource("etcd+https://10.0.0.5:2379/grpc-proxy/config.toml")
+	require.NoError(t, err)
+	assert.Equal(t, "toml", source.Format())
+
+	for _, rawURL := range []string{
+		"zookeeper://127.0.0.1:2181/config.yaml",
+		"consul+ftp://127.0.0.1:8500/config.yaml",
+		"consul://127.0.0.1:8500",
+		"consul:///config.yaml",
+	} {
+		_, err := proxy.NewRemoteConfigSource(rawURL)
+		assert.Error(t, err, rawURL)
+	}
+}
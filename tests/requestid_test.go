@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// requestIDService records the request IDs it receives and echoes each
+// back in its response header, as some providers do
+type requestIDService struct {
+	testpb.UnimplementedTestServiceServer
+
+	mu  sync.Mutex
+	ids []string
+}
+
+func (s *requestIDService) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	s.ids = append(s.ids, md.Get("x-request-id")...)
+	s.mu.Unlock()
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", "upstream-echo"))
+	time.Sleep(60 * time.Millisecond)
+	return &testpb.SimpleResponse{}, nil
+}
+
+func (s *requestIDService) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ids...)
+}
+
+func TestRequestIDs(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19928")
+	require.NoError(t, err)
+	service := &requestIDService{}
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, service)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	rpc := startFakeRPC(t)
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{
+				Name:                 "requestid",
+				LocalPort:            18907,
+				RemoteAddress:        "127.0.0.1:19928",
+				JWTToken:             "requestid_jwt_token",
+				SlowRequestThreshold: 50 * time.Millisecond,
+			},
+			{
+				Name:          "requestid-rpc",
+				Type:          proxy.TypeHTTP,
+				LocalPort:     18906,
+				RemoteAddress: rpc.URL,
+				JWTToken:      "requestid_jwt_token",
+			},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18907", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("generated", func(t *testing.T) {
+		var header metadata.MD
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		ids := header.Get("x-request-id")
+		require.Len(t, ids, 1)
+		assert.Regexp(t, uuidPattern, ids[0])
+		assert.Equal(t, ids[0], service.received()[0])
+		assert.Contains(t, logs.String(), ", request "+ids[0])
+	})
+
+	t.Run("supplied by the client", func(t *testing.T) {
+		var header metadata.MD
+		ctx := metadata.AppendToOutgoingContext(ctx, "x-request-id", "wallet-1234")
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"wallet-1234"}, header.Get("x-request-id"))
+		assert.Equal(t, "wallet-1234", service.received()[1])
+	})
+
+	t.Run("unusable client ID is replaced", func(t *testing.T) {
+		var header metadata.MD
+		ctx := metadata.AppendToOutgoingContext(ctx, "x-request-id", "has spaces")
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		assert.Regexp(t, uuidPattern, header.Get("x-request-id")[0])
+	})
+
+	t.Run("http", func(t *testing.T) {
+		get := func(id string) (string, string) {
+			req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:18906/status", nil)
+			require.NoError(t, err)
+			if id != "" {
+				req.Header.Set("X-Request-Id", id)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var echo map[string]string
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+			require.Len(t, resp.Header.Values("X-Request-Id"), 1)
+			return resp.Header.Get("X-Request-Id"), echo["request_id"]
+		}
+		returned, forwarded := get("")
+		assert.Regexp(t, uuidPattern, returned)
+		assert.Equal(t, returned, forwarded)
+
+		returned, forwarded = get("relayer-42")
+		assert.Equal(t, "relayer-42", returned)
+		assert.Equal(t, "relayer-42", forwarded)
+	})
+}
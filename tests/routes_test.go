@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestMethodRoutes(t *testing.T) {
+	queryServer, queryMock, err := startMockGRPCServer(19956)
+	require.NoError(t, err)
+	defer queryServer.Stop()
+	txServer, txMock, err := startMockGRPCServer(19955)
+	require.NoError(t, err)
+	defer txServer.Stop()
+
+	start := func(t *testing.T, port int, routes []proxy.RouteConfig) *proxy.ProxyServer {
+		p, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "routes-test",
+			LocalPort:     port,
+			RemoteAddress: "localhost:19956",
+			JWTToken:      "routes_token",
+			Routes:        routes,
+		})
+		require.NoError(t, err)
+		go p.Start()
+		time.Sleep(200 * time.Millisecond)
+		return p
+	}
+
+	t.Run("matching route", func(t *testing.T) {
+		queryMock.ReceivedHeaders, txMock.ReceivedHeaders = nil, nil
+		p := start(t, 18956, []proxy.RouteConfig{
+			{Methods: []string{"cosmos.tx.*"}, RemoteAddress: "localhost:19954"},
+			{Methods: []string{"grpc.reflection.*"}, RemoteAddress: "localhost:19955"},
+		})
+		defer p.Stop()
+
+		require.NoError(t, listServicesThrough(t, "localhost:18956"))
+		assert.Nil(t, queryMock.ReceivedHeaders)
+		require.NotNil(t, txMock.ReceivedHeaders)
+		assert.Equal(t, []string{"Bearer routes_token"}, txMock.ReceivedHeaders["authorization"])
+	})
+
+	t.Run("no matching route", func(t *testing.T) {
+		queryMock.ReceivedHeaders, txMock.ReceivedHeaders = nil, nil
+		p := start(t, 18955, []proxy.RouteConfig{
+			{Methods: []string{"/cosmos.tx.v1beta1.Service/"}, RemoteAddress: "localhost:19955"},
+		})
+		defer p.Stop()
+
+		require.NoError(t, listServicesThrough(t, "localhost:18955"))
+		assert.NotNil(t, queryMock.ReceivedHeaders)
+		assert.Nil(t, txMock.ReceivedHeaders)
+	})
+
+	t.Run("invalid routes", func(t *testing.T) {
+		for _, route := range []proxy.RouteConfig{
+			{RemoteAddress: "localhost:19955"},
+			{Methods: []string{"cosmos.tx."}},
+		} {
+			_, err := proxy.NewProxyServer(proxy.Config{
+				Name:          "routes-test",
+				LocalPort:     18954,
+				RemoteAddress: "localhost:19956",
+				JWTToken:      "routes_token",
+				Routes:        []proxy.RouteConfig{route},
+			})
+			assert.Error(t, err)
+		}
+	})
+}
+
+// heightMock answers reflection calls and reports a block height like a Cosmos node
+type heightMock struct {
+	grpc_reflection_v1alpha.UnimplementedServerReflectionServer
+	height string
+	calls  atomic.Int32
+}
+
+func (m *heightMock) ServerReflectionInfo(stream grpc_reflection_v1alpha.ServerReflection_ServerReflectionInfoServer) error {
+	m.calls.Add(1)
+	if err := stream.SendHeader(metadata.Pairs("x-cosmos-block-height", m.height)); err != nil {
+		return err
+	}
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	return stream.Send(&grpc_reflection_v1alpha.ServerReflectionResponse{OriginalRequest: req})
+}
+
+func startHeightMock(t *testing.T, port int, height string) *heightMock {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	mock := &heightMock{height: height}
+	grpc_reflection_v1alpha.RegisterServerReflectionServer(server, mock)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return mock
+}
+
+func TestHeightRoutes(t *testing.T) {
+	pruned := startHeightMock(t, 19953, "10000")
+	archive := startHeightMock(t, 19952, "1")
+
+	start := func(t *testing.T, port int, route proxy.RouteConfig) *proxy.ProxyServer {
+		route.RemoteAddress = "localhost:19952"
+		p, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "height-routes-test",
+			LocalPort:     port,
+			RemoteAddress: "localhost:19953",
+			JWTToken:      "height_routes_token",
+			Routes:        []proxy.RouteConfig{route},
+		})
+		require.NoError(t, err)
+		go p.Start()
+		time.Sleep(200 * time.Millisecond)
+		return p
+	}
+
+	// call sends a query pinned to height (empty for the latest block) and
+	// returns which upstream answered it
+	call := func(t *testing.T, addr, height string) string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if height != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-cosmos-block-height", height)
+		}
+		prunedBefore, archiveBefore := pruned.calls.Load(), archive.calls.Load()
+		require.NoError(t, listServicesThroughContext(t, ctx, addr))
+		switch {
+		case archive.calls.Load() > archiveBefore:
+			return "archive"
+		case pruned.calls.Load() > prunedBefore:
+			return "pruned"
+		}
+		return ""
+	}
+
+	t.Run("max height", func(t *testing.T) {
+		p := start(t, 18953, proxy.RouteConfig{MaxHeight: 1000})
+		defer p.Stop()
+
+		assert.Equal(t, "archive", call(t, "localhost:18953", "500"))
+		assert.Equal(t, "archive", call(t, "localhost:18953", "1000"))
+		assert.Equal(t, "pruned", call(t, "localhost:18953", "1001"))
+		assert.Equal(t, "pruned", call(t, "localhost:18953", ""))
+		assert.Equal(t, "pruned", call(t, "localhost:18953", "0"))
+	})
+
+	t.Run("older than blocks", func(t *testing.T) {
+		p := start(t, 18952, proxy.RouteConfig{OlderThanBlocks: 100})
+		defer p.Stop()
+
+		// Until an upstream has reported the latest height everything stays on the pruned node
+		assert.Equal(t, "pruned", call(t, "localhost:18952", "9000"))
+		assert.Equal(t, "pruned", call(t, "localhost:18952", "9950"))
+		assert.Equal(t, "archive", call(t, "localhost:18952", "9000"))
+		// The archive's lower height must not move the latest height back
+		assert.Equal(t, "pruned", call(t, "localhost:18952", "9950"))
+	})
+}
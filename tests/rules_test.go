@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestExpressionRules(t *testing.T) {
+	primary, primaryAddr := serveRecording(t)
+	staging, stagingAddr := serveRecording(t)
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "rules",
+		LocalPort:     18852,
+		RemoteAddress: primaryAddr,
+		JWTToken:      "rules_token",
+		Routes: []proxy.RouteConfig{{
+			RemoteAddress: stagingAddr,
+			When:          `request.method.startsWith("grpc.testing.") && metadata["x-env"] == "staging"`,
+		}},
+		HeaderRules: []proxy.HeaderRuleConfig{
+			{When: `"x-debug" in metadata && request.height > 100`, Set: map[string]string{"x-trace": "on"}, Remove: []string{"x-debug"}},
+			{When: `!(endpoint == "other") && request.service.matches("^grpc\\.testing\\.")`, Set: map[string]string{"x-endpoint": "rules"}},
+		},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	client, _ := dialTestService(t, "127.0.0.1:18852")
+	call := func(pairs ...string) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), pairs...)
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+	}
+
+	call("x-env", "staging", "x-debug", "1", "x-cosmos-block-height", "150")
+	md := staging.metadata()
+	require.NotNil(t, md)
+	assert.Equal(t, []string{"on"}, md.Get("x-trace"))
+	assert.Empty(t, md.Get("x-debug"))
+	assert.Equal(t, []string{"rules"}, md.Get("x-endpoint"))
+	assert.Equal(t, []string{"Bearer rules_token"}, md.Get("authorization"))
+
+	call("x-env", "production", "x-debug", "1", "x-cosmos-block-height", "50")
+	md = primary.metadata()
+	require.NotNil(t, md)
+	assert.Empty(t, md.Get("x-trace"))
+	assert.Equal(t, []string{"1"}, md.Get("x-debug"))
+	assert.Equal(t, []string{"rules"}, md.Get("x-endpoint"))
+}
+
+func TestExpressionRuleValidation(t *testing.T) {
+	for _, c := range []struct {
+		when, err string
+	}{
+		{`request.method == 1`, "cannot compare string == int"},
+		{`request.height`, "not a bool"},
+		{`metadata["x-env"] == staging`, "unknown name staging"},
+		{`request.method.matches(metadata["x-re"])`, "literal regular expression"},
+		{`request.method.startsWith("cosmos."`, "expected ')'"},
+		{`request.path == "x"`, "request has no field path"},
+	} {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name: "rules", LocalPort: 18852, RemoteAddress: "127.0.0.1:19852", JWTToken: "rules_token",
+			HeaderRules: []proxy.HeaderRuleConfig{{When: c.when, Set: map[string]string{"x-a": "b"}}},
+		})
+		assert.ErrorContains(t, err, c.err, c.when)
+	}
+
+	_, err := proxy.NewProxyServer(proxy.Config{
+		Name: "rules", LocalPort: 18852, RemoteAddress: "127.0.0.1:19852", JWTToken: "rules_token",
+		HeaderRules: []proxy.HeaderRuleConfig{{Set: map[string]string{"authorization": "Bearer other"}}},
+	})
+	assert.ErrorContains(t, err, "cannot set authorization")
+}
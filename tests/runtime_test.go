@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// writeCgroup writes files under a temporary cgroup root
+func writeCgroup(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return root
+}
+
+func TestReadContainerLimits(t *testing.T) {
+	t.Run("cgroup v2", func(t *testing.T) {
+		root := writeCgroup(t, map[string]string{
+			"cgroup.controllers": "cpu memory\n",
+			"cpu.max":            "150000 100000\n",
+			"memory.max":         "536870912\n",
+		})
+		limits, err := proxy.ReadContainerLimits(root)
+		require.NoError(t, err)
+		assert.Equal(t, proxy.ContainerLimits{CPUs: 1.5, Memory: 512 << 20}, limits)
+	})
+
+	t.Run("cgroup v2 without limits", func(t *testing.T) {
+		root := writeCgroup(t, map[string]string{
+			"cgroup.controllers": "cpu memory\n",
+			"cpu.max":            "max 100000\n",
+			"memory.max":         "max\n",
+		})
+		limits, err := proxy.ReadContainerLimits(root)
+		require.NoError(t, err)
+		assert.Equal(t, proxy.ContainerLimits{}, limits)
+	})
+
+	t.Run("cgroup v1", func(t *testing.T) {
+		root := writeCgroup(t, map[string]string{
+			"cpu/cpu.cfs_quota_us":         "200000\n",
+			"cpu/cpu.cfs_period_us":        "100000\n",
+			"memory/memory.limit_in_bytes": "9223372036854771712\n",
+		})
+		limits, err := proxy.ReadContainerLimits(root)
+		require.NoError(t, err)
+		assert.Equal(t, proxy.ContainerLimits{CPUs: 2}, limits)
+	})
+
+	t.Run("invalid quota", func(t *testing.T) {
+		root := writeCgroup(t, map[string]string{
+			"cgroup.controllers": "cpu\n",
+			"cpu.max":            "lots 100000\n",
+		})
+		_, err := proxy.ReadContainerLimits(root)
+		assert.ErrorContains(t, err, "invalid cpu.max")
+	})
+}
+
+func TestResolveRuntimeLimits(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	container := proxy.ContainerLimits{CPUs: 0.5, Memory: 1000 << 20}
+
+	t.Run("container limits", func(t *testing.T) {
+		limits := proxy.ResolveRuntimeLimits(nil, container, noEnv)
+		assert.Equal(t, 1, limits.GOMAXPROCS)
+		assert.Equal(t, int64(900<<20), limits.MemoryLimit)
+		assert.Equal(t, "container memory limit", limits.MemoryLimitSource)
+	})
+
+	t.Run("environment before container", func(t *testing.T) {
+		env := map[string]string{"GOMAXPROCS": "3", "GOMEMLIMIT": "256MiB"}
+		limits := proxy.ResolveRuntimeLimits(nil, container, func(key string) string { return env[key] })
+		assert.Equal(t, 3, limits.GOMAXPROCS)
+		assert.Equal(t, int64(256<<20), limits.MemoryLimit)
+		assert.Equal(t, "GOMEMLIMIT", limits.MemoryLimitSource)
+	})
+
+	t.Run("config before environment", func(t *testing.T) {
+		env := map[string]string{"GOMAXPROCS": "3", "GOMEMLIMIT": "off"}
+		config := &proxy.RuntimeConfig{GOMAXPROCS: 2, MemoryLimitMB: 700}
+		limits := proxy.ResolveRuntimeLimits(config, container, func(key string) string { return env[key] })
+		assert.Equal(t, 2, limits.GOMAXPROCS)
+		assert.Equal(t, int64(700<<20), limits.MemoryLimit)
+	})
+
+	t.Run("memory limit ratio", func(t *testing.T) {
+		limits := proxy.ResolveRuntimeLimits(&proxy.RuntimeConfig{MemoryLimitRatio: 0.5}, container, noEnv)
+		assert.Equal(t, int64(500<<20), limits.MemoryLimit)
+	})
+
+	t.Run("ignore container", func(t *testing.T) {
+		limits := proxy.ResolveRuntimeLimits(&proxy.RuntimeConfig{IgnoreContainer: true}, container, noEnv)
+		assert.Equal(t, runtime.NumCPU(), limits.GOMAXPROCS)
+		assert.Equal(t, int64(math.MaxInt64), limits.MemoryLimit)
+	})
+}
+
+func TestRuntimeConfigValidation(t *testing.T) {
+	config := &proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{Name: "runtime", LocalPort: 18964, RemoteAddress: "localhost:19964", JWTToken: "token"}},
+		Runtime:   &proxy.RuntimeConfig{MemoryLimitRatio: 1.5},
+	}
+	assert.ErrorContains(t, config.Validate(), "memory_limit_ratio")
+}
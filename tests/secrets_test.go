@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// fakeVault serves a single KV version 2 secret at secret/data/chandra
+type fakeVault struct {
+	mu    sync.Mutex
+	token string
+	lease int
+}
+
+func (v *fakeVault) set(token string) {
+	v.mu.Lock()
+	v.token = token
+	v.mu.Unlock()
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+	if r.URL.Path != "/v1/secret/data/chandra" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lease_duration": v.lease,
+		"data": map[string]interface{}{
+			"data":     map[string]interface{}{"cosmos_token": v.token},
+			"metadata": map[string]interface{}{"version": 1},
+		},
+	})
+}
+
+func TestVaultTokenRef(t *testing.T) {
+	vault := &fakeVault{token: "vault_token_1", lease: 1}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+
+	mockServer, mockService, err := startMockGRPCServer(19973)
+	require.NoError(t, err)
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "vault-test",
+			LocalPort:     18973,
+			RemoteAddress: "localhost:19973",
+			JWTTokenRef:   "vault:secret/data/chandra#cosmos_token",
+		}},
+		Secrets: proxy.SecretsConfig{
+			Vault: &proxy.VaultConfig{Address: ts.URL, Token: "root"},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18973"))
+	assert.Equal(t, []string{"Bearer vault_token_1"}, mockService.ReceivedHeaders["authorization"])
+
+	// A one second lease is re-read after two thirds of it
+	vault.set("vault_token_2")
+	time.Sleep(time.Second)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18973"))
+	assert.Equal(t, []string{"Bearer vault_token_2"}, mockService.ReceivedHeaders["authorization"])
+}
+
+func TestVaultTokenRefErrors(t *testing.T) {
+	vault := &fakeVault{token: "vault_token"}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+
+	start := func(ref string, vaultToken string) error {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "vault-errors",
+				LocalPort:     18972,
+				RemoteAddress: "localhost:19972",
+				JWTTokenRef:   ref,
+			}},
+			Secrets: proxy.SecretsConfig{
+				Vault: &proxy.VaultConfig{Address: ts.URL, Token: vaultToken},
+			},
+		})
+		err := manager.Start()
+		if err == nil {
+			manager.Stop()
+		}
+		return err
+	}
+
+	assert.ErrorContains(t, start("vault:secret/data/chandra#cosmos_token", "wrong"), "permission denied")
+	assert.ErrorContains(t, start("vault:secret/data/missing#cosmos_token", "root"), "404")
+	assert.ErrorContains(t, start("vault:secret/data/chandra#other", "root"), "not found")
+	assert.ErrorContains(t, start("vault:secret/data/chandra", "root"), "must name a field")
+	assert.ErrorContains(t, start("keychain:chandra", "root"), "unknown secrets backend")
+
+	// Setting both the token and a reference is ambiguous
+	err := proxy.Config{Name: "both", JWTToken: "t", JWTTokenRef: "vault:secret/data/chandra#cosmos_token"}.Validate()
+	assert.Error(t, err)
+}
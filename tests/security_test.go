@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// denyByDefaultConfig allows one method of an upstream to one client
+func denyByDefaultConfig(upstream string, allowed ...string) *proxy.ProxyConfig {
+	return &proxy.ProxyConfig{
+		SecurityMode: proxy.SecurityDenyByDefault,
+		Clients:      []proxy.ClientConfig{{Name: "partner", APIKey: "partner-key"}},
+		Endpoints: []proxy.Config{{
+			Name:           "hardened",
+			LocalPort:      18854,
+			RemoteAddress:  upstream,
+			JWTToken:       "hardened_token",
+			AllowedMethods: allowed,
+			Connect:        proxy.ConnectConfig{Timeout: 200 * time.Millisecond},
+		}},
+	}
+}
+
+func TestDenyByDefault(t *testing.T) {
+	_, upstream := serveRecording(t)
+	manager := proxy.NewManager(denyByDefaultConfig(upstream, "/grpc.testing.TestService/UnaryCall"))
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	client, _ := dialTestService(t, "127.0.0.1:18854")
+	keyed := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "partner-key")
+
+	_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.UnaryCall(keyed, &testpb.SimpleRequest{})
+	require.NoError(t, err)
+
+	_, err = client.EmptyCall(keyed, &testpb.Empty{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Reflection is not exempt from the allowlist
+	ctx, cancel := context.WithTimeout(keyed, 5*time.Second)
+	defer cancel()
+	assert.Equal(t, codes.PermissionDenied, status.Code(listServicesThroughContext(t, ctx, "127.0.0.1:18854")))
+
+	t.Run("reload cannot leave the mode", func(t *testing.T) {
+		config := denyByDefaultConfig(upstream, "/grpc.testing.TestService/")
+		config.SecurityMode = proxy.SecurityStandard
+		assert.ErrorContains(t, manager.Reload(config), "security_mode cannot be changed")
+
+		_, err = client.EmptyCall(keyed, &testpb.Empty{})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+}
+
+func TestDenyByDefaultValidation(t *testing.T) {
+	config := denyByDefaultConfig("127.0.0.1:19854")
+	assert.ErrorContains(t, config.Validate(), "requires allowed_methods")
+
+	config = denyByDefaultConfig("127.0.0.1:19854", "/cosmos.")
+	config.Clients = nil
+	assert.ErrorContains(t, config.Validate(), "requires clients")
+
+	config = denyByDefaultConfig("127.0.0.1:19854", "/cosmos.")
+	config.Endpoints[0].Type = proxy.TypeHTTP
+	assert.ErrorContains(t, config.Validate(), "only supports gRPC endpoints")
+
+	config = denyByDefaultConfig("127.0.0.1:19854", "/cosmos.")
+	config.SecurityMode = "paranoid"
+	assert.ErrorContains(t, config.Validate(), "unknown security_mode")
+}
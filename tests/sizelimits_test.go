@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/status"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// sizedTestService answers UnaryCall with a payload of the requested size
+// and counts the calls that reached it
+type sizedTestService struct {
+	testpb.UnimplementedTestServiceServer
+	calls atomic.Int32
+}
+
+func (s *sizedTestService) UnaryCall(_ context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	s.calls.Add(1)
+	return &testpb.SimpleResponse{Payload: &testpb.Payload{Body: make([]byte, req.ResponseSize)}}, nil
+}
+
+func (s *sizedTestService) EmptyCall(context.Context, *testpb.Empty) (*testpb.Empty, error) {
+	s.calls.Add(1)
+	return &testpb.Empty{}, nil
+}
+
+func TestSizeLimits(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19904")
+	require.NoError(t, err)
+	service := &sizedTestService{}
+	upstream := grpc.NewServer(grpc.MaxRecvMsgSize(16 << 20))
+	testpb.RegisterTestServiceServer(upstream, service)
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "sizes",
+			LocalPort:     18861,
+			RemoteAddress: "127.0.0.1:19904",
+			JWTToken:      "token",
+			SizeLimits: &proxy.SizeLimitsConfig{
+				MaxRequestBytes:  1024,
+				MaxResponseBytes: 2048,
+				Methods: []proxy.MethodSizeLimit{
+					{Method: "grpc.testing.TestService/EmptyCall", MaxRequestBytes: 8 << 20},
+				},
+			},
+		}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18861", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("small calls pass", func(t *testing.T) {
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{ResponseSize: 1000, Payload: &testpb.Payload{Body: make([]byte, 500)}})
+		require.NoError(t, err)
+	})
+
+	t.Run("oversize request is rejected before the upstream", func(t *testing.T) {
+		before := service.calls.Load()
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{Payload: &testpb.Payload{Body: make([]byte, 4096)}})
+		require.Error(t, err)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "exceeds the 1024 byte limit of endpoint 'sizes'")
+		assert.Equal(t, before, service.calls.Load())
+		assert.Equal(t, 1.0, endpointMetric(t, "sizes", "oversize_requests"))
+	})
+
+	t.Run("request above gRPC's default limit", func(t *testing.T) {
+		// EmptyCall's limit is 8 MiB; the upstream reads the payload as unknown fields
+		big := &testpb.SimpleRequest{Payload: &testpb.Payload{Body: make([]byte, 6<<20)}}
+		err := conn.Invoke(ctx, "/grpc.testing.TestService/EmptyCall", big, &testpb.Empty{})
+		require.NoError(t, err)
+
+		// UnaryCall keeps the endpoint limit
+		_, err = client.UnaryCall(ctx, big)
+		require.Error(t, err)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("oversize response is withheld", func(t *testing.T) {
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{ResponseSize: 4096})
+		require.Error(t, err)
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "exceeds the 2048 byte limit of endpoint 'sizes'")
+		assert.Equal(t, 1.0, endpointMetric(t, "sizes", "oversize_responses"))
+	})
+
+	t.Run("invalid limits", func(t *testing.T) {
+		_, err := proxy.NewProxyServer(proxy.Config{Name: "sizes-invalid", LocalPort: 18860, RemoteAddress: "127.0.0.1:19904", JWTToken: "token",
+			SizeLimits: &proxy.SizeLimitsConfig{MaxRequestBytes: -1}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "size_limits")
+	})
+}
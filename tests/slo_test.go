@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// endpointMetric reads one of an endpoint's published metrics as a number
+func endpointMetric(t *testing.T, endpoint, name string) float64 {
+	metrics, ok := expvar.Get("grpc_proxy").(*expvar.Map).Get(endpoint).(*expvar.Map)
+	require.True(t, ok, "no metrics for endpoint %s", endpoint)
+	v := metrics.Get(name)
+	require.NotNil(t, v, "no metric %s", name)
+	f, err := strconv.ParseFloat(v.String(), 64)
+	require.NoError(t, err)
+	return f
+}
+
+func TestSLOs(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19930")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	webhook := startWebhook(t, 0)
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "slo",
+			LocalPort:     18910,
+			RemoteAddress: "127.0.0.1:19930",
+			JWTToken:      "slo_jwt_token",
+			Faults:        &proxy.FaultConfig{Methods: []string{"/grpc.testing.TestService/UnaryCall"}, Delay: 100 * time.Millisecond, DelayPercent: 100},
+			SLOs: []proxy.SLOConfig{
+				{Name: "unary", Methods: []string{"/grpc.testing.TestService/UnaryCall"}, Latency: 50 * time.Millisecond, Objective: 99, Window: 12 * time.Hour},
+				{Name: "empty", Methods: []string{"/grpc.testing.TestService/EmptyCall"}, Latency: time.Second, Objective: 99.9},
+			},
+		}},
+		Alerts:          &proxy.AlertsConfig{Webhooks: []proxy.WebhookConfig{{URL: webhook.URL, Events: []string{proxy.AlertSLOBurn}}}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18910", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		_, err = client.EmptyCall(ctx, &testpb.Empty{})
+		require.NoError(t, err)
+	}
+
+	t.Run("metrics", func(t *testing.T) {
+		assert.Equal(t, 0.0, endpointMetric(t, "slo", "slo_unary_compliance"))
+		assert.InDelta(t, -99.0, endpointMetric(t, "slo", "slo_unary_budget_remaining"), 1e-6)
+		assert.InDelta(t, 100.0, endpointMetric(t, "slo", "slo_unary_burn_rate_fast"), 1e-6)
+		assert.Equal(t, 100.0, endpointMetric(t, "slo", "slo_empty_compliance"))
+		assert.Equal(t, 1.0, endpointMetric(t, "slo", "slo_empty_budget_remaining"))
+		assert.Equal(t, 0.0, endpointMetric(t, "slo", "slo_empty_burn_rate_slow"))
+	})
+
+	t.Run("burn rate alerts", func(t *testing.T) {
+		// The fast and slow burn alerts fire once each, for the slow method only
+		require.Eventually(t, func() bool { return len(webhook.events()) == 2 }, 5*time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		webhook.mu.Lock()
+		defer webhook.mu.Unlock()
+		require.Len(t, webhook.alerts, 2)
+		var messages []string
+		for _, a := range webhook.alerts {
+			assert.Equal(t, proxy.AlertSLOBurn, a.Event)
+			assert.Equal(t, "slo", a.Endpoint)
+			messages = append(messages, a.Message)
+		}
+		assert.Contains(t, messages[0]+messages[1], "SLO unary (99% under 50ms) is burning its error budget 100.0x too fast over the last 1m0s (fast burn)")
+		assert.Contains(t, messages[0]+messages[1], "over the last 6m0s (slow burn)")
+	})
+}
+
+func TestSLOValidation(t *testing.T) {
+	for _, slos := range [][]proxy.SLOConfig{
+		{{Latency: time.Second, Objective: 99}},
+		{{Name: "bank", Objective: 99}},
+		{{Name: "bank", Latency: time.Second, Objective: 100}},
+		{{Name: "bank", Latency: time.Second, Objective: 99, Window: time.Minute}},
+		{{Name: "bank", Latency: time.Second, Objective: 99}, {Name: "bank", Latency: time.Second, Objective: 99.9}},
+	} {
+		_, err := proxy.NewProxyServer(proxy.Config{
+			Name:          "slo",
+			LocalPort:     18909,
+			RemoteAddress: "127.0.0.1:19930",
+			JWTToken:      "slo_jwt_token",
+			SLOs:          slos,
+		})
+		assert.Error(t, err)
+	}
+}
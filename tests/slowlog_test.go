@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestSlowRequestLogging(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19929")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:                 "slowlog",
+			LocalPort:            18908,
+			RemoteAddress:        "127.0.0.1:19929",
+			JWTToken:             "slowlog_jwt_token",
+			SlowRequestThreshold: 50 * time.Millisecond,
+			Faults:               &proxy.FaultConfig{Methods: []string{"/grpc.testing.TestService/UnaryCall"}, Delay: 100 * time.Millisecond, DelayPercent: 100},
+		}},
+		Clients:         []proxy.ClientConfig{{Name: "indexer", APIKey: "indexer-key"}},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18908", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", "indexer-key", "x-cosmos-block-height", "1200")
+
+	_, err = client.EmptyCall(ctx, &testpb.Empty{})
+	require.NoError(t, err)
+	assert.NotContains(t, logs.String(), "slow call")
+
+	_, err = client.UnaryCall(ctx, &testpb.SimpleRequest{Payload: &testpb.Payload{Body: make([]byte, 64)}})
+	require.NoError(t, err)
+	out := logs.String()
+	assert.Contains(t, out, "Warning: slow call on slowlog: /grpc.testing.TestService/UnaryCall took ")
+	assert.Contains(t, out, " at height 1200 (OK, request 68 bytes, response 0 bytes)")
+	assert.Contains(t, out, " from 127.0.0.1:")
+	assert.Contains(t, out, ", client indexer")
+	assert.NotContains(t, out, "EmptyCall took")
+	assert.Equal(t, 1.0, endpointMetric(t, "slowlog", "slow_calls"))
+}
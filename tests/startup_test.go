@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestStartupPolicy(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19907")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	good := proxy.Config{Name: "startup-good", LocalPort: 18868, RemoteAddress: "127.0.0.1:19907", JWTToken: "token"}
+	// Nothing listens on 19906
+	unreachable := proxy.Config{Name: "startup-unreachable", LocalPort: 18867, RemoteAddress: "127.0.0.1:19906", JWTToken: "token",
+		Connect: proxy.ConnectConfig{Timeout: 200 * time.Millisecond}}
+
+	t.Run("default starts without optional upstreams", func(t *testing.T) {
+		manager := proxy.NewManager(&proxy.ProxyConfig{Endpoints: []proxy.Config{good, unreachable}, ShutdownTimeout: time.Second})
+		require.NoError(t, manager.Start())
+		assert.Len(t, manager.Servers(), 2)
+		manager.Stop()
+	})
+
+	t.Run("strict requires every upstream", func(t *testing.T) {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints:       []proxy.Config{good, unreachable},
+			StartupPolicy:   proxy.StartupStrict,
+			ShutdownTimeout: time.Second,
+		})
+		err := manager.Start()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "startup-unreachable")
+		assert.Empty(t, manager.Servers())
+
+		// Nothing was left listening
+		l, err := net.Listen("tcp", "127.0.0.1:18868")
+		require.NoError(t, err)
+		l.Close()
+	})
+
+	t.Run("partial starts what it can", func(t *testing.T) {
+		// Another process holds the port of startup-busy
+		busy, err := net.Listen("tcp", "127.0.0.1:18866")
+		require.NoError(t, err)
+		defer busy.Close()
+
+		required := unreachable
+		required.Connect.Required = true
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{
+				good,
+				required,
+				{Name: "startup-busy", LocalPort: 18866, RemoteAddress: "127.0.0.1:19907", JWTToken: "token"},
+				{Name: "startup-invalid", LocalPort: 18865, RemoteAddress: "127.0.0.1:19907", JWTToken: "your_invalid_jwt_token_here"},
+			},
+			StartupPolicy:   proxy.StartupPartial,
+			Admin:           &proxy.AdminConfig{LocalPort: 18863},
+			ShutdownTimeout: time.Second,
+		})
+		require.NoError(t, manager.Start())
+		defer manager.Stop()
+
+		servers := manager.Servers()
+		require.Len(t, servers, 1)
+		assert.Equal(t, "startup-good", servers[0].Name())
+		assert.Equal(t, 1.0, endpointMetric(t, "startup-busy", "start_failed"))
+		assert.Equal(t, 1.0, endpointMetric(t, "startup-unreachable", "start_failed"))
+
+		resp, err := http.Get("http://127.0.0.1:18863/readyz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		var body readyzResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		problems := make(map[string][]string)
+		for _, e := range body.Endpoints {
+			problems[e.Name] = e.Problems
+		}
+		assert.Empty(t, problems["startup-good"])
+		for _, name := range []string{"startup-unreachable", "startup-busy", "startup-invalid"} {
+			require.Len(t, problems[name], 1, name)
+			assert.Contains(t, problems[name][0], "failed to start: ", name)
+		}
+		assert.Contains(t, problems["startup-busy"][0], "address already in use")
+
+		resp, err = http.Get("http://127.0.0.1:18863/status.json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var status struct {
+			Endpoints []struct {
+				Name    string `json:"name"`
+				Up      bool   `json:"up"`
+				Problem string `json:"problem"`
+			} `json:"endpoints"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		assert.Len(t, status.Endpoints, 4, "failed endpoints are listed on the status page")
+
+		t.Run("a reload retries failed endpoints", func(t *testing.T) {
+			busy.Close()
+			require.NoError(t, manager.Reload(&proxy.ProxyConfig{
+				Endpoints: []proxy.Config{
+					good,
+					{Name: "startup-busy", LocalPort: 18866, RemoteAddress: "127.0.0.1:19907", JWTToken: "token"},
+				},
+				StartupPolicy:   proxy.StartupPartial,
+				Admin:           &proxy.AdminConfig{LocalPort: 18863},
+				ShutdownTimeout: time.Second,
+			}))
+			assert.Len(t, manager.Servers(), 2)
+			assert.Equal(t, 0.0, endpointMetric(t, "startup-busy", "start_failed"))
+		})
+	})
+
+	t.Run("partial fails when nothing starts", func(t *testing.T) {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{
+				{Name: "startup-none", LocalPort: 18864, RemoteAddress: "127.0.0.1:19906", JWTToken: "token",
+					Connect: proxy.ConnectConfig{Timeout: 200 * time.Millisecond, Required: true}},
+			},
+			StartupPolicy:   proxy.StartupPartial,
+			ShutdownTimeout: time.Second,
+		})
+		err := manager.Start()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "none of the 1 endpoints could be started")
+	})
+
+	t.Run("invalid policy", func(t *testing.T) {
+		err := (&proxy.ProxyConfig{Endpoints: []proxy.Config{good}, StartupPolicy: "lenient"}).Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "startup_policy")
+	})
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// statsdAgent collects the lines of the datagrams sent to a UDP port
+type statsdAgent struct {
+	conn  net.PacketConn
+	lines chan string
+}
+
+func startStatsdAgent(t *testing.T, addr string) *statsdAgent {
+	conn, err := net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	a := &statsdAgent{conn: conn, lines: make(chan string, 1024)}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				a.lines <- line
+			}
+		}
+	}()
+	return a
+}
+
+// waitFor returns the next line starting with prefix, discarding the
+// lines before it
+func (a *statsdAgent) waitFor(t *testing.T, prefix string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-a.lines:
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("no statsd line starting with %s", prefix)
+			return ""
+		}
+	}
+}
+
+func TestStatsdExporter(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19926")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	start := func(t *testing.T, port int, statsd *proxy.StatsdConfig, tags []string) {
+		manager := proxy.NewManager(&proxy.ProxyConfig{
+			Endpoints: []proxy.Config{{
+				Name:          "statsd",
+				LocalPort:     port,
+				RemoteAddress: "127.0.0.1:19926",
+				JWTToken:      "statsd_jwt_token",
+				MetricTags:    tags,
+			}},
+			Statsd:          statsd,
+			ShutdownTimeout: time.Second,
+		})
+		require.NoError(t, manager.Start())
+		t.Cleanup(func() { manager.Stop() })
+
+		conn, err := grpc.NewClient(fmt.Sprintf("127.0.0.1:%d", port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for i := 0; i < 2; i++ {
+			_, err := testpb.NewTestServiceClient(conn).EmptyCall(ctx, &testpb.Empty{})
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("dogstatsd", func(t *testing.T) {
+		agent := startStatsdAgent(t, "127.0.0.1:19925")
+		start(t, 18904, &proxy.StatsdConfig{Port: 19925, Interval: 100 * time.Millisecond, DogStatsD: true, Tags: []string{"env:test"}}, []string{"chain:test-1"})
+
+		tags := "|#endpoint:statsd,env:test,chain:test-1"
+		// The calls counter carries the change since the last send, so the
+		// sends add up to the two calls
+		calls := 0
+		for calls < 2 {
+			line := agent.waitFor(t, "grpc_proxy.calls_total:")
+			require.True(t, strings.HasSuffix(line, "|c"+tags), line)
+			n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "grpc_proxy.calls_total:"), "|c"+tags))
+			require.NoError(t, err)
+			calls += n
+		}
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, "grpc_proxy.calls_total:0|c"+tags, agent.waitFor(t, "grpc_proxy.calls_total:"))
+		assert.Equal(t, "grpc_proxy.upstream_ready:1|g"+tags, agent.waitFor(t, "grpc_proxy.upstream_ready:"))
+		assert.Equal(t, "grpc_proxy.active_streams:0|g"+tags, agent.waitFor(t, "grpc_proxy.active_streams:"))
+	})
+
+	t.Run("plain statsd", func(t *testing.T) {
+		agent := startStatsdAgent(t, "127.0.0.1:19924")
+		start(t, 18903, &proxy.StatsdConfig{Port: 19924, Prefix: "proxy.", Interval: 100 * time.Millisecond}, nil)
+
+		assert.Equal(t, "proxy.statsd.active_streams:0|g", agent.waitFor(t, "proxy.statsd.active_streams:"))
+		assert.Regexp(t, `^proxy\.statsd\.calls_total:\d+\|c$`, agent.waitFor(t, "proxy.statsd.calls_total:"))
+	})
+}
+
+func TestStatsdValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "statsd", LocalPort: 18903, RemoteAddress: "127.0.0.1:19926", JWTToken: "statsd_jwt_token"}
+	assert.Error(t, (&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}, Statsd: &proxy.StatsdConfig{Port: 70000}}).Validate())
+	assert.Error(t, (&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}, Statsd: &proxy.StatsdConfig{Tags: []string{"env:a,b"}}}).Validate())
+	endpoint.MetricTags = []string{"chain id"}
+	assert.Error(t, (&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}}).Validate())
+}
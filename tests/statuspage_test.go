@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/adminpb"
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestStatusPage(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19933")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "cosmos-hub",
+			LocalPort:     18917,
+			RemoteAddress: "127.0.0.1:19933",
+			JWTToken:      expiringToken(50 * time.Hour),
+		}},
+		Admin:           &proxy.AdminConfig{LocalPort: 18918},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := grpc.NewClient("127.0.0.1:18917", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		_, err := testpb.NewTestServiceClient(conn).EmptyCall(ctx, &testpb.Empty{})
+		require.NoError(t, err)
+	}
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get("http://127.0.0.1:18918" + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	t.Run("html", func(t *testing.T) {
+		resp, body := get("/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		page := string(body)
+		assert.Contains(t, page, "All 1 endpoints are up.")
+		assert.Contains(t, page, "<td>cosmos-hub</td>")
+		assert.Contains(t, page, "<td>127.0.0.1:19933</td>")
+		assert.Contains(t, page, "READY")
+		assert.Contains(t, page, "in 2d")
+		assert.Contains(t, page, `http-equiv="refresh"`)
+
+		resp, _ = get("/missing")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		resp, body := get("/status.json")
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		var status struct {
+			Endpoints []struct {
+				Name          string     `json:"name"`
+				Up            bool       `json:"up"`
+				UpstreamState string     `json:"upstream_state"`
+				RecentCalls   int        `json:"recent_calls"`
+				P50           float64    `json:"p50_ms"`
+				ErrorRate     float64    `json:"error_rate"`
+				TokenExpires  *time.Time `json:"token_expires"`
+			} `json:"endpoints"`
+		}
+		require.NoError(t, json.Unmarshal(body, &status))
+		require.Len(t, status.Endpoints, 1)
+		e := status.Endpoints[0]
+		assert.Equal(t, "cosmos-hub", e.Name)
+		assert.True(t, e.Up)
+		assert.Equal(t, "READY", e.UpstreamState)
+		assert.Equal(t, 3, e.RecentCalls)
+		assert.Greater(t, e.P50, 0.0)
+		assert.Zero(t, e.ErrorRate)
+		require.NotNil(t, e.TokenExpires)
+		assert.WithinDuration(t, time.Now().Add(50*time.Hour), *e.TokenExpires, time.Minute)
+	})
+
+	t.Run("admin service on the same port", func(t *testing.T) {
+		adminConn, err := grpc.NewClient("127.0.0.1:18918", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer adminConn.Close()
+		resp, err := adminpb.NewProxyAdminClient(adminConn).GetEndpointStatus(ctx, &adminpb.GetEndpointStatusRequest{Name: "cosmos-hub"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), resp.CallsTotal)
+	})
+}
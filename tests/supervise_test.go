@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// crashingListener fails Accept once crashNext is set, after accepting the
+// connection that wakes it, or at once while crashAlways is set
+type crashingListener struct {
+	net.Listener
+	crashNext, crashAlways *atomic.Bool
+}
+
+func (l *crashingListener) Accept() (net.Conn, error) {
+	if l.crashAlways.Load() {
+		return nil, errors.New("listener broke")
+	}
+	conn, err := l.Listener.Accept()
+	if err == nil && l.crashNext.CompareAndSwap(true, false) {
+		conn.Close()
+		return nil, errors.New("listener broke")
+	}
+	return conn, err
+}
+
+func TestSupervision(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19905")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	var crashNext, crashAlways atomic.Bool
+	wrapper := proxy.WithListenerWrapper(func(endpoint string, lis net.Listener) net.Listener {
+		return &crashingListener{Listener: lis, crashNext: &crashNext, crashAlways: &crashAlways}
+	})
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{Name: "supervised", LocalPort: 18862, RemoteAddress: "127.0.0.1:19905", JWTToken: "token"}},
+		Supervision: proxy.SupervisionConfig{
+			MaxRestarts:   2,
+			Backoff:       10 * time.Millisecond,
+			ExitOnFailure: true,
+		},
+		ShutdownTimeout: time.Second,
+	}, wrapper)
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	first, ok := manager.Server("supervised")
+	require.True(t, ok)
+
+	t.Run("a crashed listener is restarted", func(t *testing.T) {
+		crashNext.Store(true)
+		c, err := net.Dial("tcp", "127.0.0.1:18862")
+		require.NoError(t, err)
+		c.Close()
+
+		require.Eventually(t, func() bool {
+			p, ok := manager.Server("supervised")
+			return ok && p != first
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, 1.0, endpointMetric(t, "supervised", "endpoint_crashes"))
+		assert.Equal(t, 1.0, endpointMetric(t, "supervised", "endpoint_restarts"))
+		assert.Equal(t, 0.0, endpointMetric(t, "supervised", "start_failed"))
+
+		conn, err := grpc.NewClient("127.0.0.1:18862", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = testpb.NewTestServiceClient(conn).EmptyCall(ctx, &testpb.Empty{})
+		require.NoError(t, err)
+	})
+
+	t.Run("an endpoint that keeps crashing is given up on", func(t *testing.T) {
+		crashAlways.Store(true)
+		crashNext.Store(true)
+		c, err := net.Dial("tcp", "127.0.0.1:18862")
+		require.NoError(t, err)
+		c.Close()
+
+		select {
+		case err := <-manager.Failed():
+			assert.Contains(t, err.Error(), "endpoint supervised could not be restarted after 2 attempts")
+		case <-time.After(5 * time.Second):
+			t.Fatal("no failure reported")
+		}
+		_, running := manager.Server("supervised")
+		assert.False(t, running)
+		assert.Equal(t, 1.0, endpointMetric(t, "supervised", "start_failed"))
+	})
+}
+
+func TestSupervisionAfterShutdown(t *testing.T) {
+	var crashNext, crashAlways atomic.Bool
+	wrapper := proxy.WithListenerWrapper(func(endpoint string, lis net.Listener) net.Listener {
+		return &crashingListener{Listener: lis, crashNext: &crashNext, crashAlways: &crashAlways}
+	})
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{Name: "supervised", LocalPort: 18951, RemoteAddress: "127.0.0.1:19905", JWTToken: "token", Connect: proxy.ConnectConfig{Timeout: 200 * time.Millisecond}}},
+		Supervision: proxy.SupervisionConfig{
+			Backoff: 200 * time.Millisecond,
+		},
+		ShutdownTimeout: time.Second,
+	}, wrapper)
+	require.NoError(t, manager.Start())
+
+	crashNext.Store(true)
+	c, err := net.Dial("tcp", "127.0.0.1:18951")
+	require.NoError(t, err)
+	c.Close()
+	require.Eventually(t, func() bool {
+		_, running := manager.Server("supervised")
+		return !running
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A restart pending when the manager shuts down must not bind again
+	require.NoError(t, manager.Stop())
+	time.Sleep(400 * time.Millisecond)
+	_, running := manager.Server("supervised")
+	assert.False(t, running)
+	lis, err := net.Listen("tcp", "127.0.0.1:18951")
+	require.NoError(t, err)
+	lis.Close()
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestUpstreamTiers(t *testing.T) {
+	primaryServer, primaryMock, err := startMockGRPCServer(19916)
+	require.NoError(t, err)
+	defer func() { primaryServer.Stop() }()
+	fallbackServer, fallbackMock, err := startMockGRPCServer(19915)
+	require.NoError(t, err)
+	defer fallbackServer.Stop()
+
+	p, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "tiers",
+		LocalPort:     18889,
+		RemoteAddress: "localhost:19916",
+		JWTToken:      "paid_token",
+		Fallbacks:     []proxy.FallbackConfig{{RemoteAddress: "localhost:19915"}},
+	})
+	require.NoError(t, err)
+	go p.Start()
+	defer p.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	// Healthy primary
+	require.NoError(t, listServicesThrough(t, "localhost:18889"))
+	assert.Equal(t, []string{"Bearer paid_token"}, primaryMock.ReceivedHeaders["authorization"])
+	assert.Nil(t, fallbackMock.ReceivedHeaders)
+	assert.Equal(t, 0.0, endpointMetric(t, "tiers", "upstream_tier"))
+
+	// Calls fall back while the primary is down, without its token
+	primaryServer.Stop()
+	require.Eventually(t, func() bool {
+		return endpointMetric(t, "tiers", "upstream_tier") == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	primaryMock.ReceivedHeaders = nil
+	require.NoError(t, listServicesThrough(t, "localhost:18889"))
+	require.NotNil(t, fallbackMock.ReceivedHeaders)
+	assert.NotContains(t, fallbackMock.ReceivedHeaders, "authorization")
+	assert.Nil(t, primaryMock.ReceivedHeaders)
+
+	// And return once it is back
+	primaryServer, primaryMock, err = startMockGRPCServer(19916)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return endpointMetric(t, "tiers", "upstream_tier") == 0
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NoError(t, listServicesThrough(t, "localhost:18889"))
+	assert.Equal(t, []string{"Bearer paid_token"}, primaryMock.ReceivedHeaders["authorization"])
+	assert.Equal(t, 2.0, endpointMetric(t, "tiers", "upstream_tier_changes"))
+}
+
+func TestUpstreamTiersConfig(t *testing.T) {
+	_, err := proxy.NewProxyServer(proxy.Config{Name: "tiers", JWTToken: "paid_token", RemoteAddress: "localhost:19916",
+		Fallbacks: []proxy.FallbackConfig{{UseTLS: true}}})
+	assert.Error(t, err)
+}
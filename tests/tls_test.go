@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// startMockTLSServer starts the mock reflection service behind a self-signed
+// certificate for dnsName and returns the path of the certificate in PEM form
+func startMockTLSServer(t *testing.T, port int, dnsName string) (*grpc.Server, *MockGRPCServer, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	})))
+	mockService := &MockGRPCServer{}
+	grpc_reflection_v1alpha.RegisterServerReflectionServer(server, mockService)
+	go server.Serve(lis)
+
+	return server, mockService, caFile
+}
+
+func TestUpstreamTLSOptions(t *testing.T) {
+	mockServer, mockService, caFile := startMockTLSServer(t, 19976, "staging.chandra.test")
+	defer mockServer.Stop()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{
+				Name:          "custom-ca",
+				LocalPort:     18976,
+				RemoteAddress: "localhost:19976",
+				UseTLS:        true,
+				CAFile:        caFile,
+				ServerName:    "staging.chandra.test",
+				JWTToken:      "tls_token",
+			},
+			{
+				Name:               "skip-verify",
+				LocalPort:          18975,
+				RemoteAddress:      "localhost:19976",
+				UseTLS:             true,
+				InsecureSkipVerify: true,
+				JWTToken:           "tls_token",
+			},
+			{
+				Name:          "default-roots",
+				LocalPort:     18974,
+				RemoteAddress: "localhost:19976",
+				UseTLS:        true,
+				JWTToken:      "tls_token",
+				Connect:       proxy.ConnectConfig{Timeout: 200 * time.Millisecond},
+			},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	// Wait for proxy to start
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, listServicesThrough(t, "localhost:18976"))
+	assert.Equal(t, []string{"Bearer tls_token"}, mockService.ReceivedHeaders["authorization"])
+	require.NoError(t, listServicesThrough(t, "localhost:18975"))
+
+	// The self-signed certificate is not trusted by the system roots
+	assert.Error(t, listServicesThrough(t, "localhost:18974"))
+}
+
+func TestRESTUpstreamTLSOptions(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+
+	// The test certificate is for example.com, not localhost
+	u, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	restAddress := "https://localhost:" + u.Port()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{
+			{
+				Name:          "custom-ca",
+				LocalPort:     18877,
+				RemoteAddress: "localhost:19976",
+				UseTLS:        true,
+				CAFile:        caFile,
+				ServerName:    "example.com",
+				JWTToken:      "tls_token",
+				REST:          &proxy.RESTConfig{LocalPort: 18878, RemoteAddress: restAddress},
+				Connect:       proxy.ConnectConfig{Timeout: 200 * time.Millisecond},
+			},
+			{
+				Name:          "default-roots",
+				LocalPort:     18879,
+				RemoteAddress: "localhost:19976",
+				UseTLS:        true,
+				JWTToken:      "tls_token",
+				REST:          &proxy.RESTConfig{LocalPort: 18880, RemoteAddress: restAddress},
+				Connect:       proxy.ConnectConfig{Timeout: 200 * time.Millisecond},
+			},
+		},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	resp, err := http.Get("http://127.0.0.1:18878/status")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Bearer tls_token", string(body))
+
+	// The test certificate is not trusted by the system roots
+	resp, err = http.Get("http://127.0.0.1:18880/status")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestUpstreamTLSOptionsValidation(t *testing.T) {
+	_, err := proxy.NewProxyServer(proxy.Config{Name: "no-tls", JWTToken: "t", RemoteAddress: "x:443", CAFile: "/dev/null"})
+	assert.Error(t, err)
+
+	_, err = proxy.NewProxyServer(proxy.Config{Name: "missing-ca", JWTToken: "t", RemoteAddress: "x:443", UseTLS: true, CAFile: "/nonexistent/ca.pem"})
+	assert.Error(t, err)
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(empty, nil, 0600))
+	_, err = proxy.NewProxyServer(proxy.Config{Name: "empty-ca", JWTToken: "t", RemoteAddress: "x:443", UseTLS: true, CAFile: empty})
+	assert.Error(t, err)
+}
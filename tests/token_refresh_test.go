@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestTokenRefresh(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+	idp := newFakeIdP(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "refresh-expired",
+			LocalPort:     18827,
+			RemoteAddress: upstreamAddr,
+			JWTToken:      expiringToken(-time.Hour),
+			TokenRefresh:  &proxy.TokenRefreshConfig{TokenURL: idp.URL + "/token", RefreshToken: "refresh-0", ClientID: "grpc-proxy"},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	call := func() []string {
+		client, _ := dialTestService(t, "127.0.0.1:18827")
+		_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		return upstream.metadata().Get("authorization")
+	}
+
+	// The expired token is renewed before the endpoint starts
+	assert.Equal(t, []string{"Bearer access-1"}, call())
+
+	// and renewed again before its 3s lifetime ends, with the refresh token
+	// the issuer rotated to
+	require.Eventually(t, func() bool {
+		return call()[0] == "Bearer access-2"
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestTokenRefreshReload(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+	idp := newFakeIdP(t)
+
+	endpoint := proxy.Config{
+		Name:          "refresh-reload",
+		LocalPort:     18820,
+		RemoteAddress: upstreamAddr,
+		JWTToken:      expiringToken(-time.Hour),
+		TokenRefresh:  &proxy.TokenRefreshConfig{TokenURL: idp.URL + "/token", RefreshToken: "refresh-0"},
+	}
+	manager := proxy.NewManager(&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	call := func() string {
+		client, _ := dialTestService(t, "127.0.0.1:18820")
+		_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		return upstream.metadata().Get("authorization")[0]
+	}
+	require.Eventually(t, func() bool {
+		return call() == "Bearer access-2"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// The issuer invalidated refresh-0, so the replacement server renews
+	// with the refresh token rotated in memory
+	endpoint.LogLevel = "debug"
+	require.NoError(t, manager.Reload(&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}}))
+	require.Eventually(t, func() bool {
+		return call() == "Bearer access-4"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// A newly configured refresh token starts over
+	endpoint.TokenRefresh = &proxy.TokenRefreshConfig{TokenURL: idp.URL + "/token", RefreshToken: "refresh-1"}
+	assert.ErrorContains(t, manager.Reload(&proxy.ProxyConfig{Endpoints: []proxy.Config{endpoint}}), "invalid_grant")
+}
+
+func TestTokenRefreshHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		mu.Unlock()
+	}))
+	defer rpc.Close()
+	idp := newFakeIdP(t)
+	refreshFile := filepath.Join(t.TempDir(), "refresh")
+	require.NoError(t, os.WriteFile(refreshFile, []byte("refresh-0\n"), 0600))
+
+	// A token valid for longer is used until two thirds of its lifetime
+	valid := expiringToken(time.Hour)
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "refresh-rpc",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18826,
+			RemoteAddress: rpc.URL,
+			JWTToken:      valid,
+			TokenRefresh:  &proxy.TokenRefreshConfig{TokenURL: idp.URL + "/token", RefreshTokenRef: "file:" + refreshFile},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	resp, err := http.Get("http://127.0.0.1:18826/status")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"Bearer " + valid}, seen)
+	content, err := os.ReadFile(refreshFile)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-0", strings.TrimSpace(string(content)))
+}
+
+func TestTokenRefreshValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "refresh-invalid", LocalPort: 18825, RemoteAddress: "127.0.0.1:1"}
+
+	endpoint.TokenRefresh = &proxy.TokenRefreshConfig{TokenURL: "auth.chandra.test/token", RefreshToken: "r"}
+	assert.ErrorContains(t, endpoint.Validate(), "needs an http(s) token_url")
+
+	endpoint.TokenRefresh = &proxy.TokenRefreshConfig{TokenURL: "https://auth.chandra.test/token"}
+	assert.ErrorContains(t, endpoint.Validate(), "exactly one of refresh_token and refresh_token_ref")
+
+	endpoint.TokenRefresh.RefreshTokenRef = "vault:secret/data/chandra#refresh"
+	endpoint.JWTTokenRef = "vault:secret/data/chandra#token"
+	assert.ErrorContains(t, endpoint.Validate(), "sets token_refresh with jwt_token_ref")
+
+	// Without a jwt_token the first one is obtained at startup
+	endpoint.JWTTokenRef = ""
+	assert.NoError(t, endpoint.Validate())
+	_, err := proxy.NewProxyServer(endpoint)
+	assert.ErrorContains(t, err, "require secrets backends")
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestUpstreamAuthSchemes(t *testing.T) {
+	upstream, upstreamAddr := serveRecording(t)
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Clients: []proxy.ClientConfig{{Name: "wallet", APIKey: "wallet-key"}},
+		Endpoints: []proxy.Config{
+			{
+				Name:          "auth-basic",
+				LocalPort:     18837,
+				RemoteAddress: upstreamAddr,
+				Auth:          &proxy.UpstreamAuthConfig{Type: proxy.AuthBasic, Username: "chandra", Password: "hunter2"},
+			},
+			{
+				Name:          "auth-basic-token",
+				LocalPort:     18836,
+				RemoteAddress: upstreamAddr,
+				JWTToken:      "token-as-password",
+				Auth:          &proxy.UpstreamAuthConfig{Type: proxy.AuthBasic, Username: "chandra"},
+			},
+			{
+				Name:          "auth-raw-header",
+				LocalPort:     18835,
+				RemoteAddress: upstreamAddr,
+				JWTToken:      "provider-key",
+				Auth:          &proxy.UpstreamAuthConfig{Type: proxy.AuthRaw, Header: "X-Api-Key"},
+			},
+		},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	call := func(t *testing.T, addr string) metadata.MD {
+		client, _ := dialTestService(t, addr)
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "wallet-key", "authorization", "Bearer client-supplied")
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{})
+		require.NoError(t, err)
+		return upstream.metadata()
+	}
+	basic := func(credentials string) []string {
+		return []string{"Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))}
+	}
+
+	t.Run("basic with a password", func(t *testing.T) {
+		md := call(t, "127.0.0.1:18837")
+		assert.Equal(t, basic("chandra:hunter2"), md.Get("authorization"))
+		assert.Empty(t, md.Get("x-api-key"))
+	})
+
+	t.Run("basic with the token as password", func(t *testing.T) {
+		md := call(t, "127.0.0.1:18836")
+		assert.Equal(t, basic("chandra:token-as-password"), md.Get("authorization"))
+	})
+
+	t.Run("raw token in a custom header", func(t *testing.T) {
+		md := call(t, "127.0.0.1:18835")
+		// The client's API key is replaced by the provider's, and the
+		// client's authorization header is dropped
+		assert.Equal(t, []string{"provider-key"}, md.Get("x-api-key"))
+		assert.Empty(t, md.Get("authorization"))
+	})
+}
+
+func TestUpstreamAuthSchemesHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var seen http.Header
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = r.Header.Clone()
+		mu.Unlock()
+	}))
+	defer rpc.Close()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "auth-raw-rpc",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18834,
+			RemoteAddress: rpc.URL,
+			JWTToken:      "rpc-key",
+			Auth:          &proxy.UpstreamAuthConfig{Type: proxy.AuthRaw},
+		}},
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	resp, err := http.Get("http://127.0.0.1:18834/status")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "rpc-key", seen.Get("Authorization"))
+}
+
+func TestUpstreamAuthValidation(t *testing.T) {
+	endpoint := proxy.Config{Name: "auth-invalid", LocalPort: 18837, RemoteAddress: "127.0.0.1:1"}
+
+	endpoint.Auth = &proxy.UpstreamAuthConfig{Type: proxy.AuthBasic}
+	assert.ErrorContains(t, endpoint.Validate(), "needs a username")
+
+	// Without a password, basic auth needs the token
+	endpoint.Auth = &proxy.UpstreamAuthConfig{Type: proxy.AuthBasic, Username: "chandra"}
+	assert.ErrorContains(t, endpoint.Validate(), "please set a valid JWT token")
+	endpoint.Auth.Password = "hunter2"
+	assert.NoError(t, endpoint.Validate())
+
+	endpoint.Auth = &proxy.UpstreamAuthConfig{Type: proxy.AuthRaw, Username: "chandra"}
+	assert.ErrorContains(t, endpoint.Validate(), "need type: basic")
+
+	endpoint.Auth = &proxy.UpstreamAuthConfig{Type: proxy.AuthRaw, Header: "grpc-status"}
+	endpoint.JWTToken = "token"
+	assert.ErrorContains(t, endpoint.Validate(), `may not use header "grpc-status"`)
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+func TestUsage(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:19939")
+	require.NoError(t, err)
+	upstream := grpc.NewServer()
+	testpb.RegisterTestServiceServer(upstream, testService{})
+	go upstream.Serve(lis)
+	defer upstream.Stop()
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "usage",
+			LocalPort:     18930,
+			RemoteAddress: "127.0.0.1:19939",
+			JWTToken:      "usage_jwt_token",
+		}},
+		Clients: []proxy.ClientConfig{
+			{Name: "indexer", APIKey: "indexer-key"},
+			{Name: "wallet", APIKey: "wallet-key"},
+		},
+		Usage:           &proxy.UsageConfig{Path: path, FlushInterval: time.Hour},
+		ShutdownTimeout: time.Second,
+	})
+	require.NoError(t, manager.Start())
+
+	conn, err := grpc.NewClient("127.0.0.1:18930", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := testpb.NewTestServiceClient(conn)
+	call := func(key string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", key)
+		_, err := client.UnaryCall(ctx, &testpb.SimpleRequest{ResponseSize: 7})
+		return err
+	}
+	require.NoError(t, call("indexer-key"))
+	require.NoError(t, call("indexer-key"))
+	require.NoError(t, call("wallet-key"))
+	require.Error(t, call("unknown-key"))
+
+	// Stopping flushes what was counted since the last flush
+	require.NoError(t, manager.Stop())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	records, err := proxy.ReadUsage(f)
+	require.NoError(t, err)
+
+	summary := proxy.SummarizeUsage(records, time.Time{}, time.Time{}, true)
+	require.Len(t, summary, 3)
+	assert.Equal(t, "", summary[0].Client)
+	assert.Equal(t, int64(1), summary[0].Calls)
+	assert.Equal(t, int64(1), summary[0].Errors)
+
+	assert.Equal(t, "indexer", summary[1].Client)
+	assert.Equal(t, "usage", summary[1].Endpoint)
+	assert.Equal(t, int64(2), summary[1].Calls)
+	assert.Equal(t, int64(0), summary[1].Errors)
+	assert.Positive(t, summary[1].BytesIn)
+
+	assert.Equal(t, "wallet", summary[2].Client)
+	assert.Equal(t, int64(1), summary[2].Calls)
+	assert.Equal(t, summary[1].BytesIn/2, summary[2].BytesIn)
+}
+
+func TestSummarizeUsage(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC) }
+	records := []proxy.UsageRecord{
+		{Start: day(1), End: day(2), Endpoint: "hub", Client: "indexer", Calls: 10, Errors: 1, BytesIn: 100, BytesOut: 1000},
+		{Start: day(1), End: day(2), Endpoint: "osmosis", Client: "indexer", Calls: 5, BytesIn: 50, BytesOut: 500},
+		{Start: day(2), End: day(3), Endpoint: "hub", Client: "indexer", Calls: 20, Errors: 2, BytesIn: 200, BytesOut: 2000},
+		{Start: day(2), End: day(3), Endpoint: "hub", Client: "wallet", Calls: 1, BytesIn: 10, BytesOut: 10},
+	}
+
+	summary := proxy.SummarizeUsage(records, time.Time{}, time.Time{}, false)
+	require.Len(t, summary, 2)
+	assert.Equal(t, proxy.UsageRecord{Start: day(1), End: day(3), Client: "indexer", Calls: 35, Errors: 3, BytesIn: 350, BytesOut: 3500}, summary[0])
+	assert.Equal(t, "wallet", summary[1].Client)
+
+	summary = proxy.SummarizeUsage(records, day(2), time.Time{}, true)
+	require.Len(t, summary, 2)
+	assert.Equal(t, "hub", summary[0].Endpoint)
+	assert.Equal(t, int64(20), summary[0].Calls)
+
+	summary = proxy.SummarizeUsage(records, time.Time{}, day(2), true)
+	require.Len(t, summary, 2)
+	assert.Equal(t, int64(10), summary[0].Calls)
+	assert.Equal(t, "osmosis", summary[1].Endpoint)
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// loadExpandedConfig reads a YAML config and expands its variables the way grpc-proxy does
+func loadExpandedConfig(t *testing.T, yaml string) (*proxy.ProxyConfig, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(yaml)))
+	settings := v.AllSettings()
+	if err := proxy.ExpandVars(settings); err != nil {
+		return nil, err
+	}
+	require.NoError(t, v.MergeConfigMap(map[string]interface{}{"endpoints": settings["endpoints"]}))
+	var config proxy.ProxyConfig
+	require.NoError(t, v.Unmarshal(&config))
+	return &config, nil
+}
+
+func TestConfigVars(t *testing.T) {
+	config, err := loadExpandedConfig(t, `
+vars:
+  provider: chandrastation.com
+  base_port: 9090
+  token: shared_token
+endpoint_defaults:
+  name: ${chain}
+  local_port: ${base_port + index}
+  remote_address: ${chain}-grpc-api.${provider}:443
+  use_tls: true
+  jwt_token: ${token}
+  connect:
+    timeout: 5s
+    required: true
+endpoints:
+  - vars: {chain: cosmos}
+  - vars: {chain: osmosis, token: osmosis_token}
+    connect:
+      required: false
+  - name: local
+    local_port: ${base_port - 1}
+    remote_address: localhost:9090
+    use_tls: false
+    jwt_token: literal $${token}
+`)
+	require.NoError(t, err)
+	require.Len(t, config.Endpoints, 3)
+
+	cosmos, osmosis, local := config.Endpoints[0], config.Endpoints[1], config.Endpoints[2]
+	assert.Equal(t, "cosmos", cosmos.Name)
+	assert.Equal(t, 9090, cosmos.LocalPort)
+	assert.Equal(t, "cosmos-grpc-api.chandrastation.com:443", cosmos.RemoteAddress)
+	assert.True(t, cosmos.UseTLS)
+	assert.Equal(t, "shared_token", cosmos.JWTToken)
+	assert.True(t, cosmos.Connect.Required)
+
+	assert.Equal(t, "osmosis", osmosis.Name)
+	assert.Equal(t, 9091, osmosis.LocalPort)
+	assert.Equal(t, "osmosis_token", osmosis.JWTToken)
+	assert.Equal(t, 5*time.Second, osmosis.Connect.Timeout, "nested defaults are merged")
+	assert.False(t, osmosis.Connect.Required)
+
+	assert.Equal(t, "local", local.Name)
+	assert.Equal(t, 9089, local.LocalPort)
+	assert.False(t, local.UseTLS)
+	assert.Equal(t, "literal ${token}", local.JWTToken)
+}
+
+func TestConfigVarsErrors(t *testing.T) {
+	for _, yaml := range []string{
+		"endpoints:\n  - name: ${chain}\n",
+		"vars: {chain: cosmos}\nendpoints:\n  - local_port: ${chain + 1}\n",
+		"endpoints:\n  - name: ${index\n",
+		"endpoints:\n  - local_port: ${index +}\n",
+		"vars: [a, b]\nendpoints:\n  - name: a\n",
+	} {
+		_, err := loadExpandedConfig(t, yaml)
+		assert.Error(t, err, yaml)
+	}
+}
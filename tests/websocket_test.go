@@ -0,0 +1,245 @@
+package tests
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// writeWSFrame writes a single unfragmented WebSocket frame
+func writeWSFrame(w io.Writer, masked bool, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readWSFrame reads a single WebSocket frame, unmasking it if needed
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if head[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+// fakeCometWS is a CometBFT-like WebSocket endpoint: every subscribe is
+// acknowledged and followed by one event naming the connection it came on
+type fakeCometWS struct {
+	mu             sync.Mutex
+	conns          []net.Conn
+	subscribes     int
+	authorizations []string
+}
+
+func (f *fakeCometWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	h := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h[:]))
+	rw.Flush()
+
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.authorizations = append(f.authorizations, r.Header.Get("Authorization"))
+	connNum := len(f.conns)
+	f.mu.Unlock()
+
+	for {
+		op, payload, err := readWSFrame(rw.Reader)
+		if err != nil || op == 0x8 {
+			return
+		}
+		if op == 0x9 {
+			writeWSFrame(conn, false, 0xa, payload)
+			continue
+		}
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return
+		}
+		writeWSFrame(conn, false, 0x1, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":{}}`, req.ID)))
+		if req.Method == "subscribe" {
+			f.mu.Lock()
+			f.subscribes++
+			f.mu.Unlock()
+			writeWSFrame(conn, false, 0x1, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":{"query":"tm.event='NewBlock'","data":{"conn":%d}}}`, req.ID, connNum)))
+		}
+	}
+}
+
+// drop closes every upstream connection, as a provider restart would
+func (f *fakeCometWS) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+}
+
+func (f *fakeCometWS) counts() (conns, subscribes int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns), f.subscribes
+}
+
+func TestWebSocketResubscribe(t *testing.T) {
+	comet := &fakeCometWS{}
+	upstream := httptest.NewServer(comet)
+	defer upstream.Close()
+
+	manager := proxy.NewManager(&proxy.ProxyConfig{
+		Endpoints: []proxy.Config{{
+			Name:          "rpc-ws",
+			Type:          proxy.TypeHTTP,
+			LocalPort:     18943,
+			RemoteAddress: upstream.URL,
+			JWTToken:      "rpc_jwt_token",
+			WebSocket:     &proxy.WebSocketConfig{PingInterval: time.Second},
+			Connect:       proxy.ConnectConfig{BaseDelay: 20 * time.Millisecond, MaxDelay: 100 * time.Millisecond},
+		}},
+		ShutdownTimeout: 500 * time.Millisecond,
+	})
+	require.NoError(t, manager.Start())
+	defer manager.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:18943")
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /websocket HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	send := func(message string) {
+		require.NoError(t, writeWSFrame(conn, true, 0x1, []byte(message)))
+	}
+	receive := func() string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		op, payload, err := readWSFrame(br)
+		require.NoError(t, err)
+		require.Equal(t, byte(0x1), op)
+		return string(payload)
+	}
+
+	send(`{"jsonrpc":"2.0","id":1,"method":"subscribe","params":{"query":"tm.event='NewBlock'"}}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{}}`, receive())
+	assert.Contains(t, receive(), `"conn":1`)
+
+	// The subscription is replayed on the new upstream socket and its
+	// acknowledgement is not passed on a second time
+	comet.drop()
+	assert.Contains(t, receive(), `"conn":2`)
+
+	send(`{"jsonrpc":"2.0","id":2,"method":"unsubscribe","params":{"query":"tm.event='NewBlock'"}}`)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":{}}`, receive())
+
+	// Nothing is replayed once the client has unsubscribed
+	comet.drop()
+	require.Eventually(t, func() bool {
+		conns, _ := comet.counts()
+		return conns == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	_, subscribes := comet.counts()
+	assert.Equal(t, 2, subscribes)
+
+	comet.mu.Lock()
+	for _, auth := range comet.authorizations {
+		assert.Equal(t, "Bearer rpc_jwt_token", auth)
+	}
+	comet.mu.Unlock()
+
+	// Client pings are answered by the proxy
+	require.NoError(t, writeWSFrame(conn, true, 0x9, []byte("hi")))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	op, payload, err := readWSFrame(br)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0xa), op)
+	assert.Equal(t, "hi", string(payload))
+}
+
+func TestWebSocketRequiresHTTPType(t *testing.T) {
+	_, err := proxy.NewProxyServer(proxy.Config{
+		Name:          "grpc",
+		LocalPort:     18942,
+		RemoteAddress: "localhost:9090",
+		JWTToken:      "jwt",
+		WebSocket:     &proxy.WebSocketConfig{},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "websocket requires type: http")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+// tokenCmd groups subcommands that work with JWT tokens
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Work with the configured JWT tokens",
+}
+
+// tokenInspectCmd prints the claims of configured or given tokens
+var tokenInspectCmd = &cobra.Command{
+	Use:   "inspect [token...]",
+	Short: "Show issuer, audience and expiry of JWT tokens",
+	Long: `Decode JWT tokens locally and print their issuer, audience, expiry and
+the time remaining. Signatures are not verified and nothing is sent over the
+network, so there is no need to paste tokens into websites.
+
+Without arguments every token in the config file is inspected: endpoint,
+compare and client tokens.`,
+	Example: `  grpc-proxy token inspect
+  grpc-proxy token inspect --config /etc/grpc-proxy/config.yaml
+  grpc-proxy token inspect "$JWT"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var tokens []namedToken
+		if len(args) > 0 {
+			for i, token := range args {
+				tokens = append(tokens, namedToken{name: fmt.Sprintf("argument %d", i+1), token: token})
+			}
+		} else {
+			initConfig()
+			tokens = configuredTokens(proxyConfig)
+		}
+		printTokens(cmd.OutOrStdout(), tokens, time.Now())
+	},
+}
+
+// tokenSetCmd stores a JWT in the OS keychain
+var tokenSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "Store a JWT token in the OS keychain",
+	Long: `Store a JWT token in the OS keychain (macOS Keychain, Windows Credential
+Manager, or the Secret Service on Linux) so the config file can refer to it
+with jwt_token_ref: keyring:<name> instead of holding it in plaintext.
+
+The token is read from standard input, so it does not end up in the shell
+history or the process list.`,
+	Example: `  grpc-proxy token set cosmos
+  pbpaste | grpc-proxy token set cosmos`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		token, err := readToken(cmd.ErrOrStderr(), name)
+		if err != nil {
+			return err
+		}
+		if err := (proxy.Config{Name: name, JWTToken: token}).Validate(); err != nil {
+			return err
+		}
+		if err := proxy.SetKeyringToken(name, token); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Stored token for %s; use jwt_token_ref: \"keyring:%s\"\n", name, name)
+		return nil
+	},
+}
+
+func init() {
+	tokenCmd.AddCommand(tokenInspectCmd)
+	tokenCmd.AddCommand(tokenSetCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
+
+// readToken reads one line from stdin, prompting without echo on a terminal
+func readToken(prompt io.Writer, name string) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintf(prompt, "JWT token for %s: ", name)
+		if setEcho(false) == nil {
+			defer func() {
+				setEcho(true)
+				fmt.Fprintln(prompt)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read token: %v", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// setEcho turns terminal echo on or off with stty; it fails harmlessly where stty is unavailable
+func setEcho(on bool) error {
+	mode := "-echo"
+	if on {
+		mode = "echo"
+	}
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// namedToken is a token and where it was configured
+type namedToken struct {
+	name  string
+	token string
+}
+
+// configuredTokens lists every JWT in the configuration
+func configuredTokens(config *proxy.ProxyConfig) []namedToken {
+	var tokens []namedToken
+	for _, e := range config.Endpoints {
+		// Tokens read from jwt_token_ref are not in the file to inspect
+		if e.JWTToken != "" {
+			tokens = append(tokens, namedToken{name: e.Name, token: e.JWTToken})
+		}
+		if e.Compare != nil && e.Compare.JWTToken != "" {
+			tokens = append(tokens, namedToken{name: e.Name + " (compare)", token: e.Compare.JWTToken})
+		}
+	}
+	for _, c := range config.Clients {
+		if c.JWTToken != "" {
+			tokens = append(tokens, namedToken{name: "client " + c.Name, token: c.JWTToken})
+		}
+		for endpoint, token := range c.Tokens {
+			tokens = append(tokens, namedToken{name: fmt.Sprintf("client %s on %s", c.Name, endpoint), token: token})
+		}
+	}
+	return tokens
+}
+
+// printTokens writes a table of decoded tokens, relative to now
+func printTokens(w io.Writer, tokens []namedToken, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tISSUER\tAUDIENCE\tEXPIRES\tREMAINING")
+	for _, t := range tokens {
+		claims, err := proxy.DecodeToken(t.token)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t%v\t\t\t\n", t.name, err)
+			continue
+		}
+		expires, remaining := "never", "-"
+		if !claims.ExpiresAt.IsZero() {
+			expires = claims.ExpiresAt.UTC().Format(time.RFC3339)
+			if left := claims.ExpiresAt.Sub(now); left > 0 {
+				remaining = formatRemaining(left)
+			} else {
+				remaining = "EXPIRED"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.name, orDash(claims.Issuer), orDash(strings.Join(claims.Audience, ",")), expires, remaining)
+	}
+	tw.Flush()
+}
+
+// formatRemaining renders a duration in days and hours, or minutes when short
+func formatRemaining(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, int(d%time.Hour/time.Minute))
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
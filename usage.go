@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"grpc-auth-proxy/pkg/proxy"
+)
+
+var (
+	usageFile       string
+	usageSince      string
+	usageUntil      string
+	usageByEndpoint bool
+	usageCSV        bool
+)
+
+// usageCmd reports the usage recorded by the usage setting
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Report calls, errors and bytes per client",
+	Long: `Add up the usage file written by the proxy's usage setting and print the
+calls, errors and bytes of each client, optionally per endpoint. Calls made
+without an API key are reported as client "-".
+
+The usage file is read from the usage section of the config file unless
+--file is given. --since and --until take an RFC 3339 time or a date.`,
+	Example: `  grpc-proxy usage
+  grpc-proxy usage --since 2024-05-01 --until 2024-06-01 --by-endpoint
+  grpc-proxy usage --file /var/lib/grpc-proxy/usage.jsonl --csv > usage.csv`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := usageFile
+		if path == "" {
+			initConfig()
+			if proxyConfig.Usage == nil || proxyConfig.Usage.Path == "" {
+				return fmt.Errorf("no usage path in the config file; enable it or pass --file")
+			}
+			path = proxyConfig.Usage.Path
+		}
+		since, err := parseUsageTime(usageSince)
+		if err != nil {
+			return fmt.Errorf("invalid --since: %v", err)
+		}
+		until, err := parseUsageTime(usageUntil)
+		if err != nil {
+			return fmt.Errorf("invalid --until: %v", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", path, err)
+		}
+		records, err := proxy.ReadUsage(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		summary := proxy.SummarizeUsage(records, since, until, usageByEndpoint)
+
+		if usageCSV {
+			w := csv.NewWriter(cmd.OutOrStdout())
+			w.Write([]string{"client", "endpoint", "start", "end", "calls", "errors", "bytes_in", "bytes_out"})
+			for _, r := range summary {
+				w.Write([]string{
+					clientName(r.Client), r.Endpoint, r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339),
+					strconv.FormatInt(r.Calls, 10), strconv.FormatInt(r.Errors, 10),
+					strconv.FormatInt(r.BytesIn, 10), strconv.FormatInt(r.BytesOut, 10),
+				})
+			}
+			w.Flush()
+			return w.Error()
+		}
+
+		tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		if usageByEndpoint {
+			fmt.Fprintln(tw, "CLIENT\tENDPOINT\tCALLS\tERRORS\tBYTES IN\tBYTES OUT")
+		} else {
+			fmt.Fprintln(tw, "CLIENT\tCALLS\tERRORS\tBYTES IN\tBYTES OUT")
+		}
+		for _, r := range summary {
+			client := clientName(r.Client)
+			if usageByEndpoint {
+				client += "\t" + r.Endpoint
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\n", client, r.Calls, errorRate(r.Errors, r.Calls), r.BytesIn, r.BytesOut)
+		}
+		return tw.Flush()
+	},
+}
+
+func init() {
+	usageCmd.Flags().StringVar(&usageFile, "file", "", "usage file to read (default: usage.path from the config file)")
+	usageCmd.Flags().StringVar(&usageSince, "since", "", "only count usage after this time")
+	usageCmd.Flags().StringVar(&usageUntil, "until", "", "only count usage before this time")
+	usageCmd.Flags().BoolVar(&usageByEndpoint, "by-endpoint", false, "report each client's usage per endpoint")
+	usageCmd.Flags().BoolVar(&usageCSV, "csv", false, "write CSV instead of a table")
+	rootCmd.AddCommand(usageCmd)
+}
+
+// parseUsageTime parses an RFC 3339 time or a YYYY-MM-DD date in UTC; "" is no bound
+func parseUsageTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// clientName names the client of calls made without an API key "-"
+func clientName(name string) string {
+	if name == "" {
+		return "-"
+	}
+	return name
+}